@@ -0,0 +1,179 @@
+// Package build allows building gokrazy images from Go code, for tools like
+// build servers or CI plugins which would otherwise need to run gok.
+//
+// Build does not change the working directory, so callers can build instances
+// of different parent directories. Building writes to the instance directory
+// (e.g. its build directory), so do not build the same instance concurrently.
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/packer"
+)
+
+// OutputType specifies the kind of image to build.
+type OutputType string
+
+const (
+	// OutputTypeFull is a full disk image (boot, root and MBR/GPT), which
+	// can be written to an SD card.
+	OutputTypeFull OutputType = OutputType(packer.OutputTypeFull)
+
+	// OutputTypeGaf is a gokrazy archive format (.gaf) file, which can be
+	// used for updating a gokrazy device.
+	OutputTypeGaf OutputType = OutputType(packer.OutputTypeGaf)
+)
+
+// Output specifies where to write the built image to.
+type Output struct {
+	Type OutputType
+
+	// Path is the file (or device) to write the image to.
+	Path string
+
+	// TargetStorageBytes is the size of the target storage device. Required
+	// for writing OutputTypeFull images to a file.
+	TargetStorageBytes int
+}
+
+// Stage identifies a phase of the build, see Options.OnStage.
+type Stage = packer.Stage
+
+const (
+	StageBuild    = packer.StageBuild
+	StageAssemble = packer.StageAssemble
+	StageWrite    = packer.StageWrite
+	StageDone     = packer.StageDone
+)
+
+// Options configure which gokrazy instance to build.
+type Options struct {
+	// ParentDir is the directory containing gokrazy instance directories.
+	// Defaults to ~/gokrazy.
+	ParentDir string
+
+	// Instance is the name of the gokrazy instance (a directory within
+	// ParentDir containing config.json).
+	Instance string
+
+	// InterpolationAllowlist lists the environment variables and files which
+	// may be referenced using ${…} in the instance config.
+	InterpolationAllowlist []string
+
+	// OnStage, if non-nil, is called whenever the build enters a new stage.
+	OnStage func(Stage)
+}
+
+// Result describes a successfully built image.
+type Result struct {
+	// Path is the file the image was written to.
+	Path string
+
+	// SBOM is the JSON-encoded Software Bill Of Materials of the image.
+	SBOM []byte
+
+	// SBOMHash is the hash of the SBOM, which identifies the image contents.
+	SBOMHash string
+}
+
+// Error is returned by Build when building fails. The Stage field allows
+// callers to distinguish e.g. compilation errors from I/O errors.
+type Error struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Stage == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Build builds the gokrazy instance specified by opts and writes the image to
+// output. Canceling ctx aborts the build and removes partially written output.
+func Build(ctx context.Context, opts Options, output Output) (*Result, error) {
+	if opts.Instance == "" {
+		return nil, errors.New("build: Options.Instance must not be empty")
+	}
+	if output.Type != OutputTypeFull && output.Type != OutputTypeGaf {
+		return nil, fmt.Errorf("build: unknown output type %q", output.Type)
+	}
+	if output.Path == "" {
+		return nil, errors.New("build: Output.Path must not be empty")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	parentDir := opts.ParentDir
+	if parentDir == "" {
+		parentDir = instanceflag.ParentDir()
+	}
+	instanceDir := filepath.Join(parentDir, opts.Instance)
+
+	fileCfg, err := packer.ReadConfig(instanceDir)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := packer.CloneConfig(fileCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := filepath.Abs(output.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Building an image is mutually exclusive with updating.
+	cfg.InternalCompatibilityFlags.Update = ""
+	cfg.InternalCompatibilityFlags.OverwriteBoot = ""
+	cfg.InternalCompatibilityFlags.OverwriteRoot = ""
+	cfg.InternalCompatibilityFlags.OverwriteMBR = ""
+	cfg.InternalCompatibilityFlags.Overwrite = ""
+	if output.Type == OutputTypeFull {
+		cfg.InternalCompatibilityFlags.Overwrite = path
+	}
+	if output.TargetStorageBytes > 0 {
+		cfg.InternalCompatibilityFlags.TargetStorageBytes = output.TargetStorageBytes
+	}
+
+	var current Stage
+	pack := &packer.Pack{
+		FileCfg:     fileCfg,
+		Cfg:         cfg,
+		InstanceDir: instanceDir,
+		Output: &packer.OutputStruct{
+			Type: packer.OutputType(output.Type),
+			Path: path,
+		},
+		InterpolationAllowlist: opts.InterpolationAllowlist,
+		OnStage: func(s Stage) {
+			current = s
+			if opts.OnStage != nil {
+				opts.OnStage(s)
+			}
+		},
+	}
+	if err := pack.Build(ctx, "gokrazy build"); err != nil {
+		return nil, &Error{Stage: current, Err: err}
+	}
+
+	sbom, sbomWithHash, err := pack.GenerateSBOM()
+	if err != nil {
+		return nil, &Error{Stage: StageDone, Err: err}
+	}
+	return &Result{
+		Path:     path,
+		SBOM:     sbom,
+		SBOMHash: sbomWithHash.SBOMHash,
+	}, nil
+}
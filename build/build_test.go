@@ -0,0 +1,145 @@
+package build_test
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/gokrazy/tools/build"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildValidatesOptions(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name   string
+		opts   build.Options
+		output build.Output
+	}{
+		{
+			name:   "NoInstance",
+			output: build.Output{Type: build.OutputTypeGaf, Path: "/tmp/x.gaf"},
+		},
+		{
+			name:   "UnknownType",
+			opts:   build.Options{Instance: "hello"},
+			output: build.Output{Type: "iso", Path: "/tmp/x.iso"},
+		},
+		{
+			name:   "NoPath",
+			opts:   build.Options{Instance: "hello"},
+			output: build.Output{Type: build.OutputTypeFull},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := build.Build(ctx, tt.opts, tt.output); err == nil {
+				t.Errorf("Build unexpectedly succeeded")
+			}
+		})
+	}
+}
+
+func TestErrorUnwrap(t *testing.T) {
+	err := error(&build.Error{Stage: build.StageBuild, Err: fs.ErrNotExist})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("errors.Is(%v, fs.ErrNotExist) = false, want true", err)
+	}
+	if got, want := err.Error(), "build: file does not exist"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+// writeFile writes contents to path, creating its parent directories.
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addLocalModule creates the Go module modulePath in a temporary directory
+// with files (name: contents) and adds it to the builddir of the instance
+// directory instanceDir, like gok add does for local directories. This way,
+// building the instance does not download any modules.
+func addLocalModule(t *testing.T, instanceDir, modulePath string, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "go.mod"), "module "+modulePath+"\n\ngo 1.22\n")
+	for name, contents := range files {
+		writeFile(t, filepath.Join(dir, name), contents)
+	}
+	writeFile(t, filepath.Join(instanceDir, "builddir", modulePath, "go.mod"), `module gokrazy/build/`+modulePath+`
+
+go 1.22
+
+require `+modulePath+` v0.0.0-00010101000000-000000000000
+
+replace `+modulePath+` => `+dir+"\n")
+}
+
+func TestBuildGaf(t *testing.T) {
+	kernel, err := os.ReadFile("../internal/packer/testdata/kernel.arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentDir := t.TempDir()
+	instanceDir := filepath.Join(parentDir, "buildtest")
+	const mainGo = "package main\n\nfunc main() {}\n"
+	addLocalModule(t, instanceDir, "example.com/hello", map[string]string{"hello.go": mainGo})
+	addLocalModule(t, instanceDir, "example.com/init", map[string]string{"init.go": mainGo})
+	addLocalModule(t, instanceDir, "example.com/kernel", map[string]string{
+		"kernel.go":   "package kernel\n",
+		"vmlinuz":     string(kernel),
+		"cmdline.txt": "console=tty1\n",
+		"config.txt":  "arm_64bit=1\n",
+	})
+	writeFile(t, filepath.Join(instanceDir, "config.json"), `{
+  "Hostname": "buildtest",
+  "Update": {"HTTPPassword": "secret"},
+  "GokrazyPackages": [],
+  "Packages": ["example.com/hello"],
+  "KernelPackage": "example.com/kernel",
+  "FirmwarePackage": "",
+  "EEPROMPackage": "",
+  "InternalCompatibilityFlags": {"InitPkg": "example.com/init"}
+}`)
+	var stages []build.Stage
+	result, err := build.Build(context.Background(), build.Options{
+		ParentDir: parentDir,
+		Instance:  "buildtest",
+		OnStage:   func(s build.Stage) { stages = append(stages, s) },
+	}, build.Output{
+		Type: build.OutputTypeGaf,
+		Path: filepath.Join(t.TempDir(), "buildtest.gaf"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]build.Stage{build.StageBuild, build.StageAssemble, build.StageWrite, build.StageDone}, stages); diff != "" {
+		t.Errorf("OnStage: unexpected stages (-want +got):\n%s", diff)
+	}
+	if len(result.SBOM) == 0 || result.SBOMHash == "" {
+		t.Errorf("Build returned an empty SBOM: %+v", result)
+	}
+	gaf, err := zip.OpenReader(result.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gaf.Close()
+	var names []string
+	for _, f := range gaf.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	if diff := cmp.Diff([]string{"boot.img", "mbr.img", "root.img", "sbom.json"}, names); diff != "" {
+		t.Errorf("gaf archive: unexpected files (-want +got):\n%s", diff)
+	}
+}
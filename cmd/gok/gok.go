@@ -13,6 +13,9 @@ import (
 
 func main() {
 	if err := (gok.Context{}).Execute(context.Background()); err != nil {
+		if hint := gok.Hint(err); hint != "" {
+			log.Fatalf("%v\nhint: %s", err, hint)
+		}
 		log.Fatal(err)
 	}
 }
@@ -11,9 +11,14 @@ require (
 	github.com/google/renameio/v2 v2.0.0
 	github.com/spf13/cobra v1.6.1
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/crypto v0.23.0
 	golang.org/x/mod v0.11.0
+	golang.org/x/net v0.25.0
 	golang.org/x/sync v0.1.0
 	golang.org/x/sys v0.20.0
 )
 
-require github.com/inconshreveable/mousetrap v1.1.0 // indirect
+require (
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	golang.org/x/text v0.15.0 // indirect
+)
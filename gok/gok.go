@@ -6,7 +6,9 @@ import (
 	"context"
 	"io"
 
+	"github.com/gokrazy/tools/internal/elevate"
 	"github.com/gokrazy/tools/internal/gok"
+	"github.com/gokrazy/tools/internal/packer"
 )
 
 type Context struct {
@@ -17,6 +19,10 @@ type Context struct {
 }
 
 func (c Context) Execute(ctx context.Context) error {
+	// When running as privileged helper process (see package elevate), run
+	// the requested operation and exit.
+	elevate.Main()
+
 	root := gok.RootCmd
 	if r := c.Stdin; r != nil {
 		root.SetIn(r)
@@ -31,5 +37,15 @@ func (c Context) Execute(ctx context.Context) error {
 		root.SetArgs(args)
 	}
 	root.SetContext(ctx)
+	if err := gok.LoadGlobalConfig(); err != nil {
+		return err
+	}
 	return root.Execute()
 }
+
+// Hint returns a remediation hint for an error returned by Execute (e.g. how
+// to fix a kernel architecture mismatch), or the empty string if there is
+// none.
+func Hint(err error) string {
+	return packer.Hint(err)
+}
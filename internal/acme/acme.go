@@ -0,0 +1,124 @@
+// Package acme obtains certificates using DNS-01 challenges, e.g. from Let’s
+// Encrypt, for gokrazy devices which are not reachable from the internet. The
+// ACME protocol (RFC 8555) is implemented by golang.org/x/crypto/acme; this
+// package answers its DNS-01 challenges using DNS providers (see ProviderFor).
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/acme"
+)
+
+// DNSProvider creates and removes the TXT records for DNS-01 challenges.
+type DNSProvider interface {
+	// Present creates a TXT record named fqdn (e.g.
+	// _acme-challenge.gokrazy.example.net.) containing value and returns once
+	// the record can be queried by the CA.
+	Present(ctx context.Context, fqdn, value string) error
+
+	// CleanUp removes the TXT record created by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// Register creates an ACME account for the account key of client (or looks up
+// the existing account), agreeing to the terms of service of the CA.
+func Register(ctx context.Context, client *acme.Client, email string) error {
+	account := &acme.Account{}
+	if email != "" {
+		account.Contact = []string{"mailto:" + email}
+	}
+	_, err := client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+// ObtainCertificate orders a certificate for domains (the first domain is
+// used as subject common name) and key, answering DNS-01 challenges using
+// provider. It returns the PEM-encoded certificate chain. Register must be
+// called first.
+func ObtainCertificate(ctx context.Context, client *acme.Client, domains []string, key crypto.Signer, provider DNSProvider) ([]byte, error) {
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("acme: no domains specified")
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := authorize(ctx, client, authzURL, provider); err != nil {
+			return nil, err
+		}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true /* bundle */)
+	if err != nil {
+		return nil, fmt.Errorf("acme: finalizing order: %w", err)
+	}
+	var chain []byte
+	for _, cert := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	return chain, nil
+}
+
+func authorize(ctx context.Context, client *acme.Client, authzURL string, provider DNSProvider) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil // e.g. authorized recently
+	}
+	var chal *acme.Challenge
+	for _, ch := range authz.Challenges {
+		if ch.Type == "dns-01" {
+			chal = ch
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acme: CA offers no dns-01 challenge for %s", authz.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + authz.Identifier.Value + "."
+	if err := provider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("acme: creating TXT record %s: %v", fqdn, err)
+	}
+	defer provider.CleanUp(context.WithoutCancel(ctx), fqdn, value)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("acme: responding to challenge: %w", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+		return fmt.Errorf("acme: authorization for %s: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// GenerateKey returns a new ECDSA P-256 key, usable as account key and as
+// certificate key.
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
@@ -0,0 +1,252 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// fakeCA implements the ACME server endpoints used by ObtainCertificate,
+// verifying the JWS signatures and the DNS-01 records presented by the DNS
+// provider.
+type fakeCA struct {
+	t       *testing.T
+	srv     *httptest.Server
+	mu      sync.Mutex
+	nonce   int
+	account *ecdsa.PublicKey
+	records map[string]string // fqdn → value, as presented
+	status  string            // authorization status
+	cert    []byte
+}
+
+func (ca *fakeCA) verify(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	var jws struct {
+		Protected, Payload, Signature string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	hdrJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var hdr struct {
+		URL string
+		JWK *struct{ X, Y string }
+	}
+	json.Unmarshal(hdrJSON, &hdr)
+	if want := ca.srv.URL + r.URL.Path; hdr.URL != want {
+		ca.t.Errorf("JWS url = %q, want %q", hdr.URL, want)
+	}
+	if hdr.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(hdr.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(hdr.JWK.Y)
+		ca.account = &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if ca.account == nil || len(sig) != 64 ||
+		!ecdsa.Verify(ca.account, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		http.Error(w, `{"type":"urn:ietf:params:acme:error:malformed","detail":"bad signature"}`, http.StatusBadRequest)
+		return nil, false
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprint(ca.nonce))
+	return payload, true
+}
+
+func (ca *fakeCA) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"newNonce":"%[1]s/nonce","newAccount":"%[1]s/account","newOrder":"%[1]s/order"}`, ca.srv.URL)
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "initial")
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ca.verify(w, r); !ok {
+			return
+		}
+		w.Header().Set("Location", ca.srv.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"status":"valid"}`)
+	})
+	mux.HandleFunc("/order", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ca.verify(w, r); !ok {
+			return
+		}
+		w.Header().Set("Location", ca.srv.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"status":"pending","authorizations":["%[1]s/authz/1"],"finalize":"%[1]s/finalize/1"}`, ca.srv.URL)
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ca.verify(w, r); !ok {
+			return
+		}
+		fmt.Fprintf(w, `{"identifier":{"type":"dns","value":"gokrazy.example.net"},"status":"%s","challenges":[`+
+			`{"type":"http-01","url":"%[2]s/chall/http","token":"httptoken"},`+
+			`{"type":"dns-01","url":"%[2]s/chall/dns","token":"dnstoken"}]}`, ca.status, ca.srv.URL)
+	})
+	mux.HandleFunc("/chall/dns", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ca.verify(w, r); !ok {
+			return
+		}
+		keyAuth := sha256.Sum256([]byte("dnstoken." + thumbprint(ca.account)))
+		if got, want := ca.records["_acme-challenge.gokrazy.example.net."], base64.RawURLEncoding.EncodeToString(keyAuth[:]); got != want {
+			ca.t.Errorf("TXT record = %q, want %q", got, want)
+			ca.status = "invalid"
+		} else {
+			ca.status = "valid"
+		}
+		fmt.Fprintf(w, `{"type":"dns-01","status":"processing"}`)
+	})
+	mux.HandleFunc("/finalize/1", func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := ca.verify(w, r)
+		if !ok {
+			return
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			ca.t.Errorf("parsing CSR: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.cert = issue(ca.t, csr)
+		w.Header().Set("Location", ca.srv.URL+"/order/1")
+		fmt.Fprintf(w, `{"status":"valid","certificate":"%s/cert/1"}`, ca.srv.URL)
+	})
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ca.verify(w, r); !ok {
+			return
+		}
+		fmt.Fprintf(w, `{"status":"valid","certificate":"%s/cert/1"}`, ca.srv.URL)
+	})
+	mux.HandleFunc("/cert/1", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ca.verify(w, r); !ok {
+			return
+		}
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func thumbprint(pub *ecdsa.PublicKey) string {
+	tp, _ := acme.JWKThumbprint(pub)
+	return tp
+}
+
+func issue(t *testing.T, csr *x509.CertificateRequest) []byte {
+	caKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, csr.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+type recordingProvider struct {
+	records map[string]string
+}
+
+func (p *recordingProvider) Present(ctx context.Context, fqdn, value string) error {
+	p.records[fqdn] = value
+	return nil
+}
+
+func (p *recordingProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	delete(p.records, fqdn)
+	return nil
+}
+
+func TestObtainCertificate(t *testing.T) {
+	ca := &fakeCA{
+		t:       t,
+		records: make(map[string]string),
+		status:  "pending",
+	}
+	ca.srv = httptest.NewServer(ca.handler())
+	defer ca.srv.Close()
+
+	accountKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &acme.Client{
+		DirectoryURL: ca.srv.URL + "/directory",
+		Key:          accountKey,
+	}
+	ctx := context.Background()
+	if err := Register(ctx, c, "admin@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	certKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &recordingProvider{records: ca.records}
+	chain, err := ObtainCertificate(ctx, c, []string{"gokrazy.example.net"}, certKey, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(chain)
+	if block == nil {
+		t.Fatalf("ObtainCertificate returned no PEM data: %q", chain)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("gokrazy.example.net"); err != nil {
+		t.Error(err)
+	}
+	if len(ca.records) > 0 {
+		t.Errorf("TXT records not cleaned up: %v", ca.records)
+	}
+}
+
+func TestProviderFor(t *testing.T) {
+	if _, err := ProviderFor("exec", ProviderConfig{}); err == nil {
+		t.Errorf("ProviderFor(exec) without command succeeded unexpectedly")
+	}
+	_, err := ProviderFor("route53", ProviderConfig{})
+	if err == nil || !strings.Contains(err.Error(), "exec, manual") {
+		t.Errorf("ProviderFor(route53) = %v, want error listing available providers", err)
+	}
+}
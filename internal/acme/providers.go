@@ -0,0 +1,118 @@
+package acme
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProviderConfig configures a DNS provider.
+type ProviderConfig struct {
+	// Command is the program (followed by its arguments) which the exec
+	// provider runs.
+	Command []string
+
+	// Stdin and Stdout are used by the manual provider to interact with the
+	// user.
+	Stdin  io.Reader
+	Stdout io.Writer
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = map[string]func(ProviderConfig) (DNSProvider, error){
+		"exec":   newExecProvider,
+		"manual": newManualProvider,
+	}
+)
+
+// RegisterProvider makes the DNS provider name available to ProviderFor.
+func RegisterProvider(name string, newProvider func(ProviderConfig) (DNSProvider, error)) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = newProvider
+}
+
+// ProviderFor returns the DNS provider registered as name.
+func ProviderFor(name string, cfg ProviderConfig) (DNSProvider, error) {
+	providersMu.Lock()
+	newProvider, ok := providers[name]
+	var names []string
+	for n := range providers {
+		names = append(names, n)
+	}
+	providersMu.Unlock()
+	if !ok {
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown DNS provider %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return newProvider(cfg)
+}
+
+// execProvider runs a command to create and remove TXT records, with the
+// same interface as the exec provider of lego: the command is called with
+// the arguments present (or cleanup), the record name and the record value.
+type execProvider struct {
+	command []string
+}
+
+func newExecProvider(cfg ProviderConfig) (DNSProvider, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("exec DNS provider: no command configured")
+	}
+	return &execProvider{command: cfg.Command}, nil
+}
+
+func (p *execProvider) run(ctx context.Context, action, fqdn, value string) error {
+	args := append(append([]string{}, p.command[1:]...), action, fqdn, value)
+	cmd := exec.CommandContext(ctx, p.command[0], args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return nil
+}
+
+func (p *execProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+// manualProvider asks the user to create and remove TXT records.
+type manualProvider struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func newManualProvider(cfg ProviderConfig) (DNSProvider, error) {
+	in, out := cfg.Stdin, cfg.Stdout
+	if in == nil {
+		in = os.Stdin
+	}
+	if out == nil {
+		out = os.Stdout
+	}
+	return &manualProvider{in: bufio.NewReader(in), out: out}, nil
+}
+
+func (p *manualProvider) Present(ctx context.Context, fqdn, value string) error {
+	fmt.Fprintf(p.out, "Please create the following DNS record:\n\n\t%s 60 IN TXT %q\n\n", fqdn, value)
+	fmt.Fprintf(p.out, "Press Enter once the record can be queried...")
+	_, err := p.in.ReadString('\n')
+	return err
+}
+
+func (p *manualProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	fmt.Fprintf(p.out, "You can now remove the DNS record %s (value %q).\n", fqdn, value)
+	return nil
+}
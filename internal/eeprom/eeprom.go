@@ -0,0 +1,288 @@
+// Package eeprom reads and modifies the bootloader configuration
+// (bootconf.txt) which is embedded in Raspberry Pi 4 and 5 EEPROM images
+// (pieeprom-*.bin), like the rpi-eeprom-config tool of the rpi-eeprom
+// repository.
+//
+// An EEPROM image is a sequence of sections, each starting with a 32-bit
+// magic number and a 32-bit length (big-endian), aligned to 8 bytes. File
+// sections (e.g. bootconf.txt) start with a 12-byte file name. Pad sections
+// fill the space up to the next section. Assemble only modifies the
+// bootconf.txt section and the pad space following it; all other sections
+// keep their offsets and contents.
+package eeprom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	magic       = 0x55aaf00f
+	magicMask   = 0xfffff00f
+	fileMagic   = 0x55aaf11f
+	padMagic    = 0x55aafeef
+	filenameLen = 12
+	fileHdrLen  = 8 + filenameLen
+)
+
+// BootconfName is the name of the bootloader configuration file section.
+const BootconfName = "bootconf.txt"
+
+// MaxBootconfSize is the maximum size of bootconf.txt which the bootloader
+// reads (see rpi-eeprom-config).
+const MaxBootconfSize = 2024
+
+type section struct {
+	magic  uint32
+	offset int
+	length int    // excluding the 8 byte magic and length header
+	name   string // file sections only
+}
+
+func (s section) end() int { return align8(s.offset + 8 + s.length) }
+
+func align8(off int) int { return (off + 7) &^ 7 }
+
+// sections parses the sections of image, see the package documentation.
+func sections(image []byte) ([]section, error) {
+	var secs []section
+	for off := 0; off+8 <= len(image); {
+		m := binary.BigEndian.Uint32(image[off:])
+		if m == 0 || m == 0xffffffff {
+			break // end of sections (erased flash)
+		}
+		if m&magicMask != magic {
+			return nil, fmt.Errorf("corrupt EEPROM image: invalid magic %08x at offset %d", m, off)
+		}
+		length := int(binary.BigEndian.Uint32(image[off+4:]))
+		if length > len(image)-off-8 {
+			return nil, fmt.Errorf("corrupt EEPROM image: section at offset %d (length %d) exceeds the image size %d", off, length, len(image))
+		}
+		s := section{magic: m, offset: off, length: length}
+		if m == fileMagic {
+			if length < filenameLen {
+				return nil, fmt.Errorf("corrupt EEPROM image: file section at offset %d is too short", off)
+			}
+			s.name = strings.TrimRight(string(image[off+8:off+fileHdrLen]), "\x00")
+		}
+		secs = append(secs, s)
+		off = s.end()
+	}
+	return secs, nil
+}
+
+func findFile(secs []section, name string) (int, error) {
+	for idx, s := range secs {
+		if s.magic == fileMagic && s.name == name {
+			return idx, nil
+		}
+	}
+	return -1, fmt.Errorf("EEPROM image contains no %s", name)
+}
+
+// Bootconf returns the bootloader configuration (bootconf.txt) of image.
+func Bootconf(image []byte) ([]byte, error) {
+	secs, err := sections(image)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := findFile(secs, BootconfName)
+	if err != nil {
+		return nil, err
+	}
+	s := secs[idx]
+	return bytes.Clone(image[s.offset+fileHdrLen : s.offset+8+s.length]), nil
+}
+
+// replaceBootconf returns a copy of image in which bootconf.txt contains
+// bootconf. It returns an error if bootconf does not fit into the space up
+// to the next (non-pad) section.
+func replaceBootconf(image, bootconf []byte) ([]byte, error) {
+	if len(bootconf) > MaxBootconfSize {
+		return nil, fmt.Errorf("%s is too large: %d bytes, the bootloader reads at most %d bytes", BootconfName, len(bootconf), MaxBootconfSize)
+	}
+	secs, err := sections(image)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := findFile(secs, BootconfName)
+	if err != nil {
+		return nil, err
+	}
+	s := secs[idx]
+	// The space of pad sections following bootconf.txt is available, too.
+	next := len(image)
+	last := true
+	for _, follow := range secs[idx+1:] {
+		if follow.magic != padMagic {
+			next = follow.offset
+			last = false
+			break
+		}
+	}
+	dataEnd := s.offset + fileHdrLen + len(bootconf)
+	end := align8(dataEnd)
+	if end > next || (!last && end < next && end+8 > next) {
+		return nil, fmt.Errorf("%s (%d bytes) does not fit into the EEPROM image (%d bytes available)", BootconfName, len(bootconf), next-8-s.offset-fileHdrLen)
+	}
+
+	out := bytes.Clone(image)
+	binary.BigEndian.PutUint32(out[s.offset+4:], uint32(filenameLen+len(bootconf)))
+	copy(out[s.offset+fileHdrLen:], bootconf)
+	for i := dataEnd; i < next; i++ {
+		out[i] = 0xff // erased flash
+	}
+	if !last && end < next {
+		// Bridge the gap to the next section with a pad section.
+		binary.BigEndian.PutUint32(out[end:], padMagic)
+		binary.BigEndian.PutUint32(out[end+4:], uint32(next-end-8))
+	}
+
+	// Verify that all other sections are unchanged.
+	got, err := sections(out)
+	if err != nil {
+		return nil, fmt.Errorf("BUG: modified EEPROM image cannot be parsed: %v", err)
+	}
+	if err := sameSections(secs, got); err != nil {
+		return nil, fmt.Errorf("BUG: modified EEPROM image: %v", err)
+	}
+	return out, nil
+}
+
+// sameSections returns an error if the non-pad sections of got differ from
+// want in their offset, magic or name.
+func sameSections(want, got []section) error {
+	nonPad := func(secs []section) []section {
+		var result []section
+		for _, s := range secs {
+			if s.magic != padMagic {
+				result = append(result, section{magic: s.magic, offset: s.offset, name: s.name})
+			}
+		}
+		return result
+	}
+	w, g := nonPad(want), nonPad(got)
+	if len(w) != len(g) {
+		return fmt.Errorf("%d sections, want %d", len(g), len(w))
+	}
+	for i := range w {
+		if w[i] != g[i] {
+			return fmt.Errorf("section %d is %+v, want %+v", i, g[i], w[i])
+		}
+	}
+	return nil
+}
+
+// Assemble returns a copy of the EEPROM image in which the bootconf.txt lines
+// are modified as specified by lines (see Apply).
+func Assemble(image []byte, lines []string) ([]byte, error) {
+	if err := CheckLines(lines); err != nil {
+		return nil, err
+	}
+	bootconf, err := Bootconf(image)
+	if err != nil {
+		return nil, err
+	}
+	return replaceBootconf(image, Apply(bootconf, lines))
+}
+
+var lineRe = regexp.MustCompile(`^([A-Za-z0-9_]+)=(.*)$`)
+
+// CheckLines returns an error if lines contains a line which is not of the
+// form KEY=VALUE.
+func CheckLines(lines []string) error {
+	for _, line := range lines {
+		if !lineRe.MatchString(line) {
+			return fmt.Errorf("invalid bootloader configuration line %q: must be KEY=VALUE", line)
+		}
+	}
+	return nil
+}
+
+// Key returns the key of a KEY=VALUE line, or the empty string for comments,
+// section headers ([…]) and empty lines.
+func Key(line string) string {
+	m := lineRe.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// Apply returns bootconf with the KEY=VALUE lines applied: a line replaces
+// the unconditional lines (outside of conditional sections such as [pi4])
+// with the same key, or is appended in an [all] section.
+func Apply(bootconf []byte, lines []string) []byte {
+	current := strings.Split(strings.TrimSuffix(string(bootconf), "\n"), "\n")
+	if len(current) == 1 && current[0] == "" {
+		current = nil
+	}
+	for _, line := range lines {
+		key := Key(line)
+		replaced := false
+		conditional := false
+		for idx, l := range current {
+			trimmed := strings.TrimSpace(l)
+			if strings.HasPrefix(trimmed, "[") {
+				conditional = trimmed != "[all]"
+				continue
+			}
+			if !conditional && Key(l) == key {
+				current[idx] = line
+				replaced = true
+			}
+		}
+		if replaced {
+			continue
+		}
+		if conditional {
+			current = append(current, "[all]")
+		}
+		current = append(current, line)
+	}
+	return []byte(strings.Join(current, "\n") + "\n")
+}
+
+// Set returns lines with the line for key replaced by key=value, or with
+// key=value appended if lines contains no line for key.
+func Set(lines []string, key, value string) []string {
+	result := make([]string, 0, len(lines)+1)
+	found := false
+	for _, line := range lines {
+		if Key(line) == key {
+			if found {
+				continue // drop duplicates
+			}
+			found = true
+			line = key + "=" + value
+		}
+		result = append(result, line)
+	}
+	if !found {
+		result = append(result, key+"="+value)
+	}
+	return result
+}
+
+// Get returns the value of the last unconditional line for key in bootconf.
+func Get(bootconf []byte, key string) (string, bool) {
+	var (
+		value       string
+		found       bool
+		conditional bool
+	)
+	for _, l := range strings.Split(string(bootconf), "\n") {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "[") {
+			conditional = trimmed != "[all]"
+			continue
+		}
+		if m := lineRe.FindStringSubmatch(trimmed); m != nil && !conditional && m[1] == key {
+			value, found = m[2], true
+		}
+	}
+	return value, found
+}
@@ -0,0 +1,115 @@
+package eeprom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testImage returns an EEPROM image consisting of a code section, bootconf.txt
+// with bootconf (followed by a pad section up to offset 4096) and a second
+// file section, in 8 KiB of erased flash.
+func testImage(t *testing.T, bootconf string) []byte {
+	t.Helper()
+	image := bytes.Repeat([]byte{0xff}, 8192)
+	off := 0
+	put := func(m uint32, length int) {
+		binary.BigEndian.PutUint32(image[off:], m)
+		binary.BigEndian.PutUint32(image[off+4:], uint32(length))
+	}
+	// code section
+	put(magic, 100)
+	copy(image[off+8:], bytes.Repeat([]byte{0xaa}, 100))
+	off = align8(off + 8 + 100)
+	// bootconf.txt
+	put(fileMagic, filenameLen+len(bootconf))
+	copy(image[off+8:], BootconfName)
+	for i := len(BootconfName); i < filenameLen; i++ {
+		image[off+8+i] = 0
+	}
+	copy(image[off+fileHdrLen:], bootconf)
+	off = align8(off + fileHdrLen + len(bootconf))
+	put(padMagic, 4096-off-8)
+	off = 4096
+	// another file
+	put(fileMagic, filenameLen+5)
+	copy(image[off+8:], "pubkey.bin\x00\x00")
+	copy(image[off+fileHdrLen:], "hello")
+	return image
+}
+
+func TestAssemble(t *testing.T) {
+	const bootconf = "[all]\nBOOT_UART=0\nBOOT_ORDER=0xf41\n[pi400]\nBOOT_ORDER=0xf14\n"
+	image := testImage(t, bootconf)
+	got, err := Bootconf(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != bootconf {
+		t.Fatalf("Bootconf = %q, want %q", got, bootconf)
+	}
+
+	modified, err := Assemble(image, []string{"BOOT_ORDER=0xf461", "POWER_OFF_ON_HALT=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = Bootconf(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[all]\nBOOT_UART=0\nBOOT_ORDER=0xf461\n[pi400]\nBOOT_ORDER=0xf14\n[all]\nPOWER_OFF_ON_HALT=1\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("Bootconf(Assemble) unexpected contents (-want +got):\n%s", diff)
+	}
+	// All other sections are unchanged.
+	if !bytes.Equal(image[:108], modified[:108]) {
+		t.Errorf("Assemble modified the code section")
+	}
+	if !bytes.Equal(image[4096:], modified[4096:]) {
+		t.Errorf("Assemble modified the sections following bootconf.txt")
+	}
+	secs, err := sections(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := secs[len(secs)-1].name, "pubkey.bin"; got != want {
+		t.Errorf("last section = %q, want %q", got, want)
+	}
+
+	// Shrinking bootconf.txt works, too.
+	if _, err := replaceBootconf(modified, []byte("BOOT_UART=1\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := replaceBootconf(image, bytes.Repeat([]byte("#"), MaxBootconfSize+1)); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("replaceBootconf(too large) = %v, want too large error", err)
+	}
+	if _, err := Assemble(image, []string{"not a key value line"}); err == nil {
+		t.Errorf("Assemble(invalid line) unexpectedly succeeded")
+	}
+	corrupt := bytes.Clone(image)
+	binary.BigEndian.PutUint32(corrupt, 0x12345678)
+	if _, err := Bootconf(corrupt); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("Bootconf(corrupt) = %v, want corrupt error", err)
+	}
+}
+
+func TestSetGet(t *testing.T) {
+	lines := Set([]string{"BOOT_UART=1", "BOOT_ORDER=0xf41"}, "BOOT_ORDER", "0xf14")
+	lines = Set(lines, "PSU_MAX_CURRENT", "5000")
+	want := []string{"BOOT_UART=1", "BOOT_ORDER=0xf14", "PSU_MAX_CURRENT=5000"}
+	if diff := cmp.Diff(want, lines); diff != "" {
+		t.Errorf("Set: unexpected lines (-want +got):\n%s", diff)
+	}
+
+	bootconf := Apply([]byte("[all]\nBOOT_ORDER=0xf41\n[pi400]\nBOOT_ORDER=0xf14\n"), lines)
+	if got, ok := Get(bootconf, "BOOT_ORDER"); !ok || got != "0xf14" {
+		t.Errorf("Get(BOOT_ORDER) = %q, %v, want 0xf14", got, ok)
+	}
+	if _, ok := Get(bootconf, "WAKE_ON_GPIO"); ok {
+		t.Errorf("Get(WAKE_ON_GPIO) unexpectedly found a value")
+	}
+}
@@ -0,0 +1,130 @@
+// Package elevate runs privileged operations, like opening a block device for
+// writing or re-reading its partition table, in a helper process started via
+// sudo, as configured by the Sudo config setting (auto, always or never).
+//
+// The helper process is the current program, re-executed via sudo with the
+// operation to run in its environment. Programs using this package must call
+// Main at the start of their main function (before parsing flags), so that
+// the helper process runs the operation and exits. Files which the operation
+// opens are passed back to the parent process via a Unix domain socket, as
+// sudo closes all other file descriptors.
+package elevate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// Values of the Sudo config setting.
+const (
+	Auto   = "auto"   // elevate when permission is denied (default)
+	Always = "always" // always elevate
+	Never  = "never"  // never elevate
+)
+
+const (
+	envOp   = "GOKRAZY_ELEVATE_OP"
+	envArgs = "GOKRAZY_ELEVATE_ARGS"
+	envFD   = "GOKRAZY_ELEVATE_FD"
+)
+
+// Operation is a privileged operation, run in the helper process. The
+// returned file (if any) is passed back to the parent process.
+type Operation func(args []string) (*os.File, error)
+
+var (
+	operationsMu sync.Mutex
+	operations   = map[string]Operation{
+		"open": func(args []string) (*os.File, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("open: expected exactly one path")
+			}
+			return os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
+		},
+	}
+)
+
+// Register makes an operation available for Run. Register must be called
+// from an init function, so that the operation is available in the helper
+// process when Main runs.
+func Register(name string, op Operation) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	if _, ok := operations[name]; ok {
+		panic("elevate: operation " + name + " registered twice")
+	}
+	operations[name] = op
+}
+
+func runOperation(name, argsJSON string) (*os.File, error) {
+	operationsMu.Lock()
+	op, ok := operations[name]
+	operationsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown operation %q", name)
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", envArgs, err)
+	}
+	return op(args)
+}
+
+// Needed returns whether to elevate privileges for an operation in mode,
+// given the error of running the operation without privileges (nil if it was
+// not attempted).
+func Needed(mode string, err error) bool {
+	switch mode {
+	case Always:
+		return true
+	case Never:
+		return false
+	default:
+		return errors.Is(err, fs.ErrPermission)
+	}
+}
+
+// Writable returns whether the current user can open path for writing.
+func Writable(path string) bool {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// OpenFile opens (or creates) path for reading and writing, using the helper
+// process when Needed. elevated is true if the helper process opened path.
+func OpenFile(mode, path string) (f *os.File, elevated bool, _ error) {
+	if mode != Always {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err == nil || !Needed(mode, err) {
+			return f, false, err
+		}
+		log.Printf("Using sudo to gain permission to write %s", path)
+		log.Printf("If you prefer, cancel and use: sudo setfacl -m u:${USER}:rw %s", path)
+	}
+	f, err := Run("open", path)
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+// Command returns a command running the program name with args, prefixed
+// with sudo when mode is always, or when mode is auto and privileges are
+// needed (e.g. because the file to write to is not Writable).
+func Command(ctx context.Context, mode string, needed bool, name string, args ...string) *exec.Cmd {
+	if mode == Always || (mode != Never && needed) {
+		return exec.CommandContext(ctx, "sudo", append([]string{name}, args...)...)
+	}
+	return exec.CommandContext(ctx, name, args...)
+}
@@ -0,0 +1,65 @@
+package elevate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNeeded(t *testing.T) {
+	permErr := &fs.PathError{Op: "open", Path: "/dev/sdx", Err: fs.ErrPermission}
+	for _, tt := range []struct {
+		mode string
+		err  error
+		want bool
+	}{
+		{Auto, nil, false},
+		{Auto, permErr, true},
+		{Auto, fs.ErrNotExist, false},
+		{Always, nil, true},
+		{Never, permErr, false},
+	} {
+		if got := Needed(tt.mode, tt.err); got != tt.want {
+			t.Errorf("Needed(%q, %v) = %v, want %v", tt.mode, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		mode   string
+		needed bool
+		want   []string
+	}{
+		{Auto, false, []string{"mkfs.ext4", "/dev/sdx"}},
+		{Auto, true, []string{"sudo", "mkfs.ext4", "/dev/sdx"}},
+		{Always, false, []string{"sudo", "mkfs.ext4", "/dev/sdx"}},
+		{Never, true, []string{"mkfs.ext4", "/dev/sdx"}},
+	} {
+		cmd := Command(ctx, tt.mode, tt.needed, "mkfs.ext4", "/dev/sdx")
+		if diff := cmp.Diff(tt.want, cmd.Args); diff != "" {
+			t.Errorf("Command(%q, %v): unexpected args (-want +got):\n%s", tt.mode, tt.needed, diff)
+		}
+	}
+}
+
+func TestRunOperation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := runOperation("open", fmt.Sprintf("[%q]", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("open operation did not create %s: %v", path, err)
+	}
+	if _, err := runOperation("format-everything", "[]"); err == nil {
+		t.Errorf("runOperation unexpectedly succeeded for an unknown operation")
+	}
+}
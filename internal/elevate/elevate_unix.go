@@ -0,0 +1,132 @@
+//go:build !windows
+// +build !windows
+
+package elevate
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// Main runs the requested operation and exits if the process is a helper
+// process started by Run. Otherwise, Main returns immediately.
+func Main() {
+	name := os.Getenv(envOp)
+	if name == "" {
+		return
+	}
+	fd, err := strconv.Atoi(os.Getenv(envFD))
+	if err != nil {
+		log.Fatalf("elevate: invalid %s: %v", envFD, err)
+	}
+	fc, err := net.FileConn(os.NewFile(uintptr(fd), ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn := fc.(*net.UnixConn)
+	f, err := runOperation(name, os.Getenv(envArgs))
+	if err != nil {
+		// Status byte 1 indicates an error, followed by the message.
+		if _, _, err := conn.WriteMsgUnix(append([]byte{1}, err.Error()...), nil, nil); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(1)
+	}
+	var oob []byte
+	if f != nil {
+		oob = syscall.UnixRights(int(f.Fd()))
+	}
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, oob, nil); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+// Run runs the operation name (see Register) with args in a helper process
+// started via sudo and returns the file the operation returned, if any.
+func Run(name string, args ...string) (*os.File, error) {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(pair[0]) // used in the parent process
+	parent := os.NewFile(uintptr(pair[0]), "")
+	defer parent.Close()
+	child := os.NewFile(uintptr(pair[1]), "")
+
+	// Use absolute path because $PATH might not be the same when using sudo:
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	cmd := exec.Command("sudo", append([]string{"--preserve-env", exe}, os.Args[1:]...)...)
+	// We cannot use cmd.ExtraFiles with sudo, as sudo closes all file
+	// descriptors but stdin, stdout and stderr.
+	cmd.Env = []string{
+		envOp + "=" + name,
+		envArgs + "=" + string(argsJSON),
+		envFD + "=1",
+		fmt.Sprintf("HOME=%s", os.Getenv("HOME")), // for instance config detection
+	}
+	cmd.Stdin = os.Stdin // for the sudo password prompt
+	cmd.Stdout = child
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		child.Close()
+		return nil, err
+	}
+	child.Close() // only used by the helper process
+
+	fc, err := net.FileConn(parent)
+	if err != nil {
+		return nil, err
+	}
+	conn := fc.(*net.UnixConn)
+	defer conn.Close()
+	// 32 bytes as per
+	// https://github.com/golang/go/blob/21d2e15ee1bed44a7a1b8f775aff4a57cae9533a/src/syscall/syscall_unix_test.go#L177
+	buf := make([]byte, 4096)
+	oob := make([]byte, 32)
+	n, oobn, _, _, readErr := conn.ReadMsgUnix(buf, oob)
+	if err := cmd.Wait(); err != nil && readErr == nil && n > 0 && buf[0] == 1 {
+		return nil, fmt.Errorf("%s (as root): %s", name, buf[1:n])
+	} else if err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%s (as root): no response from helper process", name)
+	}
+	if oobn <= 0 {
+		return nil, nil // operation did not return a file
+	}
+
+	// file descriptors are now open in this process
+	scm, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if got, want := len(scm), 1; got != want {
+		return nil, fmt.Errorf("SCM message: got %d, want %d", got, want)
+	}
+	fds, err := syscall.ParseUnixRights(&scm[0])
+	if err != nil {
+		return nil, err
+	}
+	if got, want := len(fds), 1; got != want {
+		return nil, fmt.Errorf("ParseUnixRights: got %d fds, want %d fds", got, want)
+	}
+	return os.NewFile(uintptr(fds[0]), ""), nil
+}
@@ -0,0 +1,17 @@
+package elevate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Main returns immediately: Windows has no sudo, so there are no helper
+// processes.
+func Main() {}
+
+// Run returns an error: elevating privileges is not supported on Windows.
+// Writing to devices is not supported on Windows, either.
+func Run(name string, args ...string) (*os.File, error) {
+	return nil, fmt.Errorf("%s: elevating privileges: %w", name, errors.ErrUnsupported)
+}
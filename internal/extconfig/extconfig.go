@@ -0,0 +1,743 @@
+// Package extconfig reads the gokrazy instance config fields which gok
+// supports in addition to the fields of github.com/gokrazy/internal/config.
+//
+// The fields are stored in the same config.json file. Because config.Struct
+// does not know about these fields, programs which modify config.json must
+// use FormatForFile to retain them.
+package extconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/gokrazy/internal/config"
+)
+
+// PackageConfig contains the extension fields of config.PackageConfig.
+type PackageConfig struct {
+	// Basename overrides the file name of the program binary (and hence the
+	// service name), which defaults to the last import path element. This
+	// allows including multiple programs of the same name, e.g. two
+	// different cmd/server packages.
+	Basename string `json:",omitempty"`
+
+	// PrePackHooks are run in the package directory (with GOARCH and GOOS
+	// set) after building and before collecting extra files, e.g. to
+	// generate web assets or download architecture-specific files into
+	// _gokrazy/extrafiles. Hooks run with a minimal environment.
+	PrePackHooks []Hook `json:",omitempty"`
+
+	// RunAsUser is the name of a Users entry as which the program runs
+	// (instead of as root). The root file system does not store file
+	// ownership: all files, including the program's ExtraFilePaths and
+	// ExtraFileContents, are owned by root (uid/gid 0). gok makes the extra
+	// files of such programs readable for all users; programs which need to
+	// write must use a directory on the permanent partition (e.g. their
+	// Home) instead.
+	RunAsUser string `json:",omitempty"`
+
+	// MemoryLimitMB limits the memory usage of the program (cgroup v2
+	// memory.max, or RLIMIT_AS if cgroups are unavailable).
+	MemoryLimitMB int `json:",omitempty"`
+
+	// CPUQuota limits the CPU time of the program, in percent of one CPU
+	// (e.g. 50 for half a CPU, 200 for two CPUs), via cgroup v2 cpu.max.
+	CPUQuota int `json:",omitempty"`
+
+	// OOMScoreAdj is the oom_score_adj (-1000 to 1000) of the program: higher
+	// values make the kernel prefer it when killing processes on out of
+	// memory conditions.
+	OOMScoreAdj int `json:",omitempty"`
+
+	// After lists packages (import paths) which are started before the
+	// program.
+	After []string `json:",omitempty"`
+
+	// Requires lists packages which are started before the program (like
+	// After) and whose HealthCheckURL (if any) must pass before the program
+	// is started.
+	Requires []string `json:",omitempty"`
+
+	// HealthCheckURL is an HTTP URL (e.g. http://localhost:8080/healthz)
+	// which responds with a 2xx status code once the program is ready to
+	// serve the packages which require it.
+	HealthCheckURL string `json:",omitempty"`
+
+	// RestartPolicy is one of always (the default), on-failure (restart only
+	// when the program exits with a non-zero status) or never.
+	RestartPolicy string `json:",omitempty"`
+
+	// RestartBackoff is the delay before restarting the program (a Go
+	// duration, e.g. 10s), defaulting to 1s.
+	RestartBackoff string `json:",omitempty"`
+
+	// WatchdogInterval enables a systemd-style watchdog (a Go duration, e.g.
+	// 30s): the program must send WATCHDOG=1 notifications to $NOTIFY_SOCKET
+	// (see sd_notify(3)) at least this often, or it is aborted and restarted
+	// according to RestartPolicy.
+	WatchdogInterval string `json:",omitempty"`
+
+	// ExtraFileOCI maps paths (files or directories) to digest-pinned
+	// container images (e.g. ghcr.io/org/foo:1.2@sha256:…) whose contents at
+	// that path are included in the root file system at the same path. The
+	// image is pulled for linux and the target architecture.
+	ExtraFileOCI map[string]string `json:",omitempty"`
+}
+
+// Hook is a command which produces files as part of the build.
+type Hook struct {
+	// Command is the program to run, followed by its arguments.
+	Command []string
+
+	// Outputs lists the files and directories (relative to the package
+	// directory) which the hook creates. They are hashed into the SBOM.
+	Outputs []string `json:",omitempty"`
+}
+
+// Struct contains the extension fields of config.Struct.
+type Struct struct {
+	// KernelModulesInclude lists the loadable kernel modules (e.g. brcmfmac
+	// or snd-usb-audio) to include when KernelModulesAutoprune is enabled.
+	// Modules these modules depend on (see modules.dep) are included, too.
+	KernelModulesInclude []string `json:",omitempty"`
+
+	// KernelModulesAutoprune removes all loadable kernel modules which are
+	// not listed in KernelModulesInclude (or required by them) from the root
+	// file system.
+	KernelModulesAutoprune bool `json:",omitempty"`
+
+	// InitramfsPackage is a Go package whose directory contains an
+	// initramfs.img file, which is copied into the boot file system (like
+	// KernelPackage).
+	InitramfsPackage string `json:",omitempty"`
+
+	// InitramfsPath is the path to an initramfs (initrd) file to copy into
+	// the boot file system. Relative paths are relative to the instance
+	// directory. InitramfsPath takes precedence over InitramfsPackage.
+	InitramfsPath string `json:",omitempty"`
+
+	// Target is the platform to build for. It takes precedence over the
+	// GOOS, GOARCH and GOARM environment variables, which only apply to
+	// fields Target does not set; the default is linux/arm64 (Raspberry Pi 3,
+	// 4, Zero 2 W). gok overwrite --archs overrides the GOARCH field.
+	Target *Target `json:",omitempty"`
+
+	// ArchPackages overrides the KernelPackage, FirmwarePackage and
+	// EEPROMPackage config fields per target architecture (GOARCH), so that
+	// the same instance can be built for e.g. a Raspberry Pi (arm64) and a PC
+	// (amd64), see gok overwrite --archs.
+	ArchPackages map[string]ArchPackages `json:",omitempty"`
+
+	// RootSizeBudgetMB and BootSizeBudgetMB limit the size of the root file
+	// system (SquashFS) and the boot file system (FAT). Building fails with a
+	// list of the largest files when a file system exceeds its budget. The
+	// partition sizes (500 MB root, BootPartitionSizeMB boot) are always
+	// enforced.
+	RootSizeBudgetMB int `json:",omitempty"`
+	BootSizeBudgetMB int `json:",omitempty"`
+
+	// BootPartitionSizeMB is the size of the boot partition, between 100 (the
+	// default) and 128 (the FAT16B boot file system cannot be larger).
+	//
+	// The partition table is only written by gok overwrite: updates keep the
+	// partition table of the device, so after changing BootPartitionSizeMB,
+	// overwrite the device before updating it.
+	BootPartitionSizeMB int `json:",omitempty"`
+
+	// RootCompression selects the compression algorithm of the root file
+	// system (SquashFS), RootBlockSizeKB its data block size.
+	//
+	// The SquashFS writer (github.com/gokrazy/internal/squashfs) only
+	// implements gzip with 128 KB blocks, so the only supported values are
+	// "gzip" and 128 (the defaults). gok rejects other values (e.g. zstd,
+	// lzo or none) instead of ignoring them.
+	RootCompression string `json:",omitempty"`
+	RootBlockSizeKB int    `json:",omitempty"`
+
+	// InitTemplatePath is the path to a Go text/template file which replaces
+	// the default init template (see initTmplContents in
+	// internal/packer/buildinit.go) and is rendered with the same data.
+	// Relative paths are relative to the instance directory. The rendered
+	// init must compile, and must include {{ template "wrap" . }} if
+	// PackageConfig settings require the service wrapper.
+	InitTemplatePath string `json:",omitempty"`
+
+	// Bootloader selects the UEFI bootloader: systemd-boot (default) or
+	// grub, for firmware which systemd-boot does not work with.
+	Bootloader string `json:",omitempty"`
+
+	// GrubPackage is a Go package whose directory contains the GRUB EFI
+	// images grubx64.efi and/or grubaa64.efi (built using grub-mkimage
+	// with prefix /EFI/BOOT). Defaults to the kernel package.
+	GrubPackage string `json:",omitempty"`
+
+	// GoToolchain pins the Go toolchain (e.g. go1.22.4) used to build all
+	// packages, regardless of the locally installed Go version. The go
+	// command downloads the toolchain if needed (requires Go 1.21 or newer).
+	GoToolchain string `json:",omitempty"`
+
+	// PinnedModules maps module paths to the version at which gok get -u
+	// keeps them, e.g. a kernel package pinned to a known-good version for a
+	// hardware quirk. Packages of a pinned module are updated to the pinned
+	// version, and builddirs which require the module keep requiring it at
+	// the pinned version.
+	PinnedModules map[string]string `json:",omitempty"`
+
+	// ExcludeFromUpdateAll lists packages (import paths) or modules (all of
+	// their packages) which gok get -u does not update.
+	ExcludeFromUpdateAll []string `json:",omitempty"`
+
+	// BuildOptions apply to all packages, in addition to their GoBuildFlags,
+	// e.g. to build smaller and reproducible binaries.
+	BuildOptions *BuildOptions `json:",omitempty"`
+
+	// RemoteBuilder builds Go packages on another machine via SSH, specified
+	// as ssh://[user@]host[:port][/dir]. The binaries are copied back and
+	// packed locally. gok update --remote_builder overrides this field.
+	RemoteBuilder string `json:",omitempty"`
+
+	// RebootTimeout is how long gok update waits for the device to become
+	// reachable with the new version after rebooting, as a Go duration
+	// (e.g. 10m). Defaults to 5m.
+	RebootTimeout string `json:",omitempty"`
+
+	// PollInterval is how long gok update waits between checking whether the
+	// device runs the new version, as a Go duration. Defaults to 1s.
+	PollInterval string `json:",omitempty"`
+
+	// NoReboot makes gok update switch to the new root partition without
+	// rebooting the device (and without waiting for it), for devices which
+	// are power-cycled externally.
+	NoReboot bool `json:",omitempty"`
+
+	// UpdateAddressFamily is the address family (ipv4 or ipv6) which gok
+	// update tries first when the update hostname resolves to addresses of
+	// both families. By default, Go’s Happy Eyeballs dialing is used.
+	UpdateAddressFamily string `json:",omitempty"`
+
+	// Users are written to /etc/passwd (in addition to root and nobody), so
+	// that programs can run as unprivileged users (see RunAsUser).
+	Users []User `json:",omitempty"`
+
+	// Groups are written to /etc/group (in addition to root, nogroup and a
+	// group for each user whose GID is not listed).
+	Groups []Group `json:",omitempty"`
+
+	// PermSeed maps paths on the perm partition (e.g. /perm/db/initial.db)
+	// to files or directories on the host (relative to the instance
+	// directory), which gok overwrite --full copies into the perm file system
+	// it creates, e.g. for an initial database. gok update never modifies
+	// the perm partition.
+	PermSeed map[string]string `json:",omitempty"`
+
+	// MountDevices contains the extension fields of the cfg.MountDevices
+	// entries with the same index.
+	MountDevices []MountDevice `json:",omitempty"`
+
+	// Network configures WiFi, static IP addresses and DNS servers, which the
+	// packer renders into the root file system (see Network).
+	Network *Network `json:",omitempty"`
+
+	// Hooks are commands which gok runs in the instance directory after
+	// building, after writing images and after updating a device, e.g. to
+	// upload artifacts, send notifications or flash devices.
+	Hooks *Hooks `json:",omitempty"`
+
+	// Notify configures notifications which gok update sends after
+	// updating the device (or failing to).
+	Notify *Notify `json:",omitempty"`
+
+	Update *UpdateConfig `json:",omitempty"`
+
+	// EEPROM controls the Raspberry Pi EEPROM updates which gok installs
+	// from the EEPROMPackage, see gok eeprom status.
+	EEPROM *EEPROMConfig `json:",omitempty"`
+
+	// BootloaderExtraEEPROM are KEY=VALUE lines (e.g. BOOT_ORDER=0xf41)
+	// which gok applies to the bootloader configuration (bootconf.txt) of the
+	// pieeprom file of the EEPROMPackage before installing it: each line
+	// replaces the unconditional line of the same key, or is appended. Use
+	// gok eeprom config to inspect and modify them.
+	BootloaderExtraEEPROM []string `json:",omitempty"`
+
+	PackageConfig map[string]PackageConfig `json:",omitempty"`
+}
+
+// Hooks are the instance-level hooks. Unlike PrePackHooks, they run with the
+// environment of gok, plus environment variables for the artifacts produced so
+// far: GOKRAZY_INSTANCE, GOKRAZY_BUILD_TIMESTAMP and GOKRAZY_BIN_DIR (the Go
+// programs) for all hooks; GOKRAZY_SBOM, GOKRAZY_BOOT, GOKRAZY_ROOT (the
+// root.squashfs file), GOKRAZY_MBR, GOKRAZY_GAF and GOKRAZY_FULL (as far as
+// they were written) for PostImage and PostUpdate hooks; GOKRAZY_DEVICE_URL
+// for PostUpdate hooks.
+type Hooks struct {
+	// PostBuild hooks run after the Go programs were built.
+	PostBuild []InstanceHook `json:",omitempty"`
+
+	// PostImage hooks run after the images (e.g. gaf or full disk image)
+	// were written.
+	PostImage []InstanceHook `json:",omitempty"`
+
+	// PostUpdate hooks run after a device was updated successfully.
+	PostUpdate []InstanceHook `json:",omitempty"`
+}
+
+// InstanceHook is a command which gok runs at a certain point of a build.
+type InstanceHook struct {
+	// Command is the program to run, followed by its arguments.
+	Command []string
+}
+
+// Notify configures update notifications. The notifications contain the
+// instance name, whether the update succeeded (or the error), the SBOM hash
+// of the old (if the device reports it) and the new version, and how long the
+// update took.
+type Notify struct {
+	// WebhookURL receives an HTTP POST request with a JSON body (see
+	// packer.Notification).
+	WebhookURL string `json:",omitempty"`
+
+	// SlackWebhookURL is a Slack incoming webhook URL
+	// (https://hooks.slack.com/services/…) to post a message to.
+	SlackWebhookURL string `json:",omitempty"`
+
+	// Email sends the notification via SMTP.
+	Email *EmailNotify `json:",omitempty"`
+
+	// OnlyFailures suppresses notifications about successful updates.
+	OnlyFailures bool `json:",omitempty"`
+}
+
+// EmailNotify configures sending notifications via SMTP.
+type EmailNotify struct {
+	// SMTPAddr is the host:port of the SMTP server, e.g. smtp.example.com:587.
+	SMTPAddr string
+	From     string
+	To       []string
+
+	// Username and PasswordFile (the path to a file containing the password)
+	// enable SMTP authentication (PLAIN, which requires TLS). Relative paths
+	// are relative to the instance directory.
+	Username     string `json:",omitempty"`
+	PasswordFile string `json:",omitempty"`
+}
+
+// MountDevice contains the extension fields of config.MountDevice. They are
+// written to /etc/gokrazy/mountdevices.json along with the config.MountDevice
+// fields, for gokrazy to honor when mounting the device.
+type MountDevice struct {
+	// Fsck checks (and repairs) the file system before mounting it.
+	Fsck bool `json:",omitempty"`
+
+	// AutoFormat creates a file system of the configured Type (ext4 or
+	// vfat) on the device if it does not contain a file system yet, e.g. for
+	// a new USB disk. Devices which contain a file system are never
+	// formatted.
+	AutoFormat bool `json:",omitempty"`
+}
+
+// Network is the network bootstrap configuration of an instance.
+type Network struct {
+	// WiFi is rendered into /etc/wifi.json, which github.com/gokrazy/wifi
+	// reads (the wifi package must be part of the instance).
+	WiFi *WiFi `json:",omitempty"`
+
+	// Interfaces are rendered into /etc/gokrazy/interfaces.json, for network
+	// configuration programs which set up static IP addresses.
+	Interfaces []NetworkInterface `json:",omitempty"`
+
+	// DNS lists the IP addresses of the DNS servers to write into
+	// /etc/resolv.conf, instead of the servers obtained via DHCP.
+	DNS []string `json:",omitempty"`
+}
+
+// WiFi configures the WiFi network to connect to.
+type WiFi struct {
+	SSID string
+
+	// PSK is the pre-shared key (password) of the network. It should
+	// reference a secret (e.g. ${secret:wifi-psk}, see gok secret add), so
+	// that config.json does not contain the password and the SBOM only
+	// contains the hash of the encrypted secret. Empty for open networks.
+	PSK string `json:",omitempty"`
+}
+
+// NetworkInterface is the static IP configuration of a network interface.
+type NetworkInterface struct {
+	// Name is the interface name, e.g. eth0 or wlan0.
+	Name string
+
+	// Addresses are IP addresses in CIDR notation, e.g. 192.168.1.5/24.
+	Addresses []string `json:",omitempty"`
+
+	// Gateway is the IP address of the default gateway, if any.
+	Gateway string `json:",omitempty"`
+}
+
+// BuildOptions are go build options for all packages (and init).
+type BuildOptions struct {
+	// Trimpath builds with -trimpath.
+	Trimpath bool `json:",omitempty"`
+
+	// StripDebug builds with -ldflags=-s -w (merged with the -ldflags of
+	// GoBuildFlags, if any).
+	StripDebug bool `json:",omitempty"`
+
+	// BuildMode is passed as -buildmode: exe (default) or pie.
+	BuildMode string `json:",omitempty"`
+}
+
+// Target is the platform to build for.
+type Target struct {
+	GOOS   string `json:",omitempty"`
+	GOARCH string `json:",omitempty"`
+	GOARM  string `json:",omitempty"`
+}
+
+// ArchPackages are the packages to use for one target architecture. Like in
+// the config, an empty FirmwarePackage or EEPROMPackage disables it.
+type ArchPackages struct {
+	KernelPackage   *string `json:",omitempty"`
+	FirmwarePackage *string `json:",omitempty"`
+	EEPROMPackage   *string `json:",omitempty"`
+}
+
+// EEPROMConfig controls Raspberry Pi EEPROM updates. By default, gok installs
+// the most recent EEPROM files of the EEPROMPackage, and the device flashes
+// them on the next boot unless it reports that it already runs them.
+type EEPROMConfig struct {
+	// Skip disables EEPROM updates: the boot file system contains no EEPROM
+	// files (pieeprom.upd, vl805.bin, recovery.bin), so devices keep their
+	// EEPROM version regardless of the EEPROMPackage.
+	Skip bool `json:",omitempty"`
+
+	// PieepromSHA256 and VL805SHA256 pin the EEPROM version to the files of
+	// the EEPROMPackage with these sha256 sums (as printed by gok eeprom
+	// status) instead of the most recent files. Building fails when the
+	// EEPROMPackage (e.g. after gok get -u) does not contain them.
+	PieepromSHA256 string `json:",omitempty"`
+	VL805SHA256    string `json:",omitempty"`
+}
+
+// User is a user account in the generated /etc/passwd.
+type User struct {
+	Name string
+	UID  int
+
+	// GID is the primary group of the user. Defaults to UID.
+	GID int `json:",omitempty"`
+
+	// Groups are the names of supplementary groups (Groups entries).
+	Groups []string `json:",omitempty"`
+
+	// Home defaults to /perm/home/<Name>.
+	Home string `json:",omitempty"`
+}
+
+// Group is a group in the generated /etc/group.
+type Group struct {
+	Name string
+	GID  int
+}
+
+// UpdateConfig contains the extension fields of config.UpdateStruct.
+type UpdateConfig struct {
+	// CACertPath is the path to a PEM file with additional CA certificates
+	// to trust when updating via https, e.g. for devices with certificates
+	// issued by an internal CA. Relative paths are relative to the instance
+	// directory.
+	CACertPath string `json:",omitempty"`
+
+	// ACME configures obtaining the certificate of the device via ACME
+	// (e.g. Let’s Encrypt), which is enabled by setting Update.UseTLS to
+	// acme:<domain>.
+	ACME *ACMEConfig `json:",omitempty"`
+}
+
+// ACMEConfig configures obtaining certificates via ACME DNS-01 challenges.
+type ACMEConfig struct {
+	// Directory is the ACME directory URL. Defaults to Let’s Encrypt.
+	Directory string `json:",omitempty"`
+
+	// Email is the contact address of the ACME account (optional).
+	Email string `json:",omitempty"`
+
+	// DNSProvider creates the TXT records for the DNS-01 challenges: exec
+	// (runs DNSProviderCommand) or manual (prints the records to create).
+	// Defaults to manual.
+	DNSProvider string `json:",omitempty"`
+
+	// DNSProviderCommand is the program (and its arguments) which the exec
+	// DNS provider runs with the arguments present|cleanup <fqdn> <value>,
+	// like the exec provider of lego.
+	DNSProviderCommand []string `json:",omitempty"`
+}
+
+// Parse parses the extension fields from the contents of a config.json file.
+func Parse(b []byte) (*Struct, error) {
+	var ext Struct
+	if err := json.Unmarshal(b, &ext); err != nil {
+		return nil, err
+	}
+	return &ext, nil
+}
+
+// ReadFromFile reads the extension fields from the config.json file at path.
+// An empty Struct is returned if path is empty (e.g. when the config was not
+// loaded from a file).
+func ReadFromFile(path string) (*Struct, error) {
+	if path == "" {
+		return &Struct{}, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ext, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", path, err)
+	}
+	return ext, nil
+}
+
+// Basenames returns the binary name overrides (PackageConfig Basename
+// fields), keyed by import path.
+func (ext *Struct) Basenames() map[string]string {
+	basenames := make(map[string]string)
+	for importPath, pc := range ext.PackageConfig {
+		if pc.Basename != "" {
+			basenames[importPath] = pc.Basename
+		}
+	}
+	return basenames
+}
+
+// For reads the extension fields of cfg from the file cfg was loaded from.
+func For(cfg *config.Struct) (*Struct, error) {
+	return ReadFromFile(cfg.Meta.Path)
+}
+
+// member is a key/value pair of a JSON object.
+type member struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// object is a JSON object which retains the order of its members.
+type object []member
+
+func parseObject(b []byte) (object, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, fmt.Errorf("expected JSON object, got %v", tok)
+	}
+	var obj object
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected JSON object key, got %v", tok)
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		obj = append(obj, member{Key: key, Value: value})
+	}
+	return obj, nil
+}
+
+func (o object) get(key string) (json.RawMessage, bool) {
+	for _, m := range o {
+		if m.Key == key {
+			return m.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (o object) set(key string, value json.RawMessage) object {
+	for idx, m := range o {
+		if m.Key == key {
+			o[idx].Value = value
+			return o
+		}
+	}
+	return append(o, member{Key: key, Value: value})
+}
+
+// merge adds all members of other to o (overwriting members of the same
+// name).
+func (o object) merge(other object) object {
+	for _, m := range other {
+		o = o.set(m.Key, m.Value)
+	}
+	return o
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for idx, m := range o {
+		if idx > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(m.Key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(m.Value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func marshalObject(v any) (object, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return parseObject(b)
+}
+
+// mergeMountDevices merges the extension fields extRaw (a JSON array) into
+// the MountDevices entries of obj with the same index.
+func mergeMountDevices(obj object, extRaw json.RawMessage) (json.RawMessage, error) {
+	var devs, extDevs []json.RawMessage
+	if raw, ok := obj.get("MountDevices"); ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &devs); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(extRaw, &extDevs); err != nil {
+		return nil, err
+	}
+	if len(extDevs) > len(devs) {
+		return nil, fmt.Errorf("MountDevices: %d extension entries, but only %d mount devices", len(extDevs), len(devs))
+	}
+	for idx, extDev := range extDevs {
+		dev, err := parseObject(devs[idx])
+		if err != nil {
+			return nil, err
+		}
+		extObj, err := parseObject(extDev)
+		if err != nil {
+			return nil, err
+		}
+		if devs[idx], err = dev.merge(extObj).MarshalJSON(); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(devs)
+}
+
+// FormatForFile pretty-prints cfg and ext as JSON, ready for storing it in
+// the config.json file. The extension fields are stored after the fields of
+// cfg, and extension fields of the Update object, of MountDevices entries and
+// of PackageConfig entries after the fields of the corresponding cfg.Update,
+// cfg.MountDevices or cfg.PackageConfig entry.
+func FormatForFile(cfg *config.Struct, ext *Struct) ([]byte, error) {
+	if ext == nil || reflect.ValueOf(*ext).IsZero() {
+		return cfg.FormatForFile()
+	}
+	obj, err := marshalObject(cfg)
+	if err != nil {
+		return nil, err
+	}
+	extObj, err := marshalObject(ext)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range extObj {
+		if m.Key == "Update" {
+			var update object
+			if raw, ok := obj.get("Update"); ok && string(raw) != "null" {
+				if update, err = parseObject(raw); err != nil {
+					return nil, err
+				}
+			}
+			extUpdate, err := parseObject(m.Value)
+			if err != nil {
+				return nil, err
+			}
+			if len(extUpdate) == 0 && update == nil {
+				continue // do not introduce an empty Update object
+			}
+			b, err := update.merge(extUpdate).MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			obj = obj.set("Update", b)
+			continue
+		}
+		if m.Key == "MountDevices" {
+			b, err := mergeMountDevices(obj, m.Value)
+			if err != nil {
+				return nil, err
+			}
+			obj = obj.set("MountDevices", b)
+			continue
+		}
+		if m.Key != "PackageConfig" {
+			obj = obj.set(m.Key, m.Value)
+			continue
+		}
+		var pkgs object
+		if raw, ok := obj.get("PackageConfig"); ok {
+			if pkgs, err = parseObject(raw); err != nil {
+				return nil, err
+			}
+		}
+		extPkgs, err := parseObject(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, extPkg := range extPkgs {
+			var pkg object
+			if raw, ok := pkgs.get(extPkg.Key); ok {
+				if pkg, err = parseObject(raw); err != nil {
+					return nil, err
+				}
+			}
+			extPkgObj, err := parseObject(extPkg.Value)
+			if err != nil {
+				return nil, err
+			}
+			if len(extPkgObj) == 0 && pkg == nil {
+				continue // do not introduce empty package configs
+			}
+			b, err := pkg.merge(extPkgObj).MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			pkgs = pkgs.set(extPkg.Key, b)
+		}
+		b, err := pkgs.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		obj = obj.set("PackageConfig", b)
+	}
+	b, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", "    "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
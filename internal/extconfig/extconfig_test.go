@@ -0,0 +1,219 @@
+package extconfig
+
+import (
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFormatForFileWithoutExtensions(t *testing.T) {
+	cfg := &config.Struct{
+		Hostname: "scanner",
+		Packages: []string{"github.com/gokrazy/hello"},
+		PackageConfig: map[string]config.PackageConfig{
+			"github.com/gokrazy/hello": {
+				CommandLineFlags: []string{"-greeting=<hi>"},
+			},
+		},
+	}
+	want, err := cfg.FormatForFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []*Struct{
+		nil,
+		{},
+		{PackageConfig: map[string]PackageConfig{}},
+	} {
+		got, err := FormatForFile(cfg, ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(string(want), string(got)); diff != "" {
+			t.Errorf("FormatForFile(%+v): unexpected diff (-want +got):\n%s", ext, diff)
+		}
+	}
+}
+
+func TestFormatForFileRoundTrip(t *testing.T) {
+	const configJSON = `{
+    "Hostname": "scanner",
+    "Packages": [
+        "github.com/gokrazy/hello"
+    ],
+    "KernelModulesInclude": [
+        "brcmfmac"
+    ],
+    "KernelModulesAutoprune": true
+}
+`
+	ext, err := Parse([]byte(configJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Struct{
+		Hostname: "scanner",
+		Packages: []string{"github.com/gokrazy/hello"},
+	}
+	got, err := FormatForFile(cfg, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(configJSON, string(got)); diff != "" {
+		t.Errorf("FormatForFile: unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFormatForFilePackageConfig(t *testing.T) {
+	cfg := &config.Struct{
+		Hostname: "scanner",
+		Packages: []string{
+			"example.com/a/cmd/server",
+			"example.com/b/cmd/server",
+		},
+		PackageConfig: map[string]config.PackageConfig{
+			"example.com/a/cmd/server": {
+				CommandLineFlags: []string{"-listen=:80"},
+			},
+		},
+	}
+	ext := &Struct{
+		PackageConfig: map[string]PackageConfig{
+			"example.com/a/cmd/server": {Basename: "server-a"},
+			"example.com/b/cmd/server": {Basename: "server-b"},
+		},
+	}
+	got, err := FormatForFile(cfg, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{
+    "Hostname": "scanner",
+    "Packages": [
+        "example.com/a/cmd/server",
+        "example.com/b/cmd/server"
+    ],
+    "PackageConfig": {
+        "example.com/a/cmd/server": {
+            "CommandLineFlags": [
+                "-listen=:80"
+            ],
+            "Basename": "server-a"
+        },
+        "example.com/b/cmd/server": {
+            "Basename": "server-b"
+        }
+    }
+}
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("FormatForFile: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	parsed, err := Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ext.Basenames(), parsed.Basenames()); diff != "" {
+		t.Errorf("Basenames: unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFormatForFileUpdate(t *testing.T) {
+	cfg := &config.Struct{
+		Hostname: "scanner",
+		Packages: []string{"github.com/gokrazy/hello"},
+		Update: &config.UpdateStruct{
+			Hostname: "scanner.example.net",
+		},
+	}
+	ext := &Struct{
+		Update: &UpdateConfig{CACertPath: "internal-ca.pem"},
+	}
+	got, err := FormatForFile(cfg, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{
+    "Hostname": "scanner",
+    "Update": {
+        "Hostname": "scanner.example.net",
+        "CACertPath": "internal-ca.pem"
+    },
+    "Packages": [
+        "github.com/gokrazy/hello"
+    ]
+}
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("FormatForFile: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	parsed, err := Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ext, parsed); diff != "" {
+		t.Errorf("Parse: unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFormatForFileMountDevices(t *testing.T) {
+	cfg := &config.Struct{
+		Hostname: "nas",
+		Packages: []string{"github.com/gokrazy/hello"},
+		MountDevices: []config.MountDevice{
+			{Source: "PARTUUID=abcdef", Type: "ext4", Target: "/mnt/usb"},
+			{Source: "/dev/sdb1", Type: "vfat", Target: "/mnt/camera", Options: "ro"},
+		},
+	}
+	ext := &Struct{
+		MountDevices: []MountDevice{
+			{Fsck: true, AutoFormat: true},
+		},
+	}
+	got, err := FormatForFile(cfg, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{
+    "Hostname": "nas",
+    "Packages": [
+        "github.com/gokrazy/hello"
+    ],
+    "MountDevices": [
+        {
+            "Source": "PARTUUID=abcdef",
+            "Type": "ext4",
+            "Target": "/mnt/usb",
+            "Options": "",
+            "Fsck": true,
+            "AutoFormat": true
+        },
+        {
+            "Source": "/dev/sdb1",
+            "Type": "vfat",
+            "Target": "/mnt/camera",
+            "Options": "ro"
+        }
+    ]
+}
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("FormatForFile: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	parsed, err := Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(append(ext.MountDevices, MountDevice{}), parsed.MountDevices); diff != "" {
+		t.Errorf("Parse: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	ext.MountDevices = append(ext.MountDevices, MountDevice{}, MountDevice{})
+	if _, err := FormatForFile(cfg, ext); err == nil {
+		t.Errorf("FormatForFile unexpectedly succeeded with more extension entries than mount devices")
+	}
+}
@@ -0,0 +1,194 @@
+package extconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+)
+
+// Schema is a (subset of a) JSON Schema, see https://json-schema.org/.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"` // *Schema or false
+	Items                *Schema            `json:"items,omitempty"`
+}
+
+// schemaFor returns the schema of values of type t.
+func schemaFor(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaFor(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaFor(t.Elem())}
+	case reflect.Struct:
+		s := &Schema{
+			Type:                 "object",
+			Properties:           make(map[string]*Schema),
+			AdditionalProperties: false,
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			s.Properties[name] = schemaFor(f.Type)
+		}
+		return s
+	}
+	return &Schema{} // any value
+}
+
+// merge adds the properties of other to s, merging the schemas of nested
+// objects (e.g. PackageConfig or MountDevices entries).
+func (s *Schema) merge(other *Schema) {
+	if s.Items != nil && other.Items != nil {
+		s.Items.merge(other.Items)
+	}
+	for name, prop := range other.Properties {
+		if existing, ok := s.Properties[name]; ok {
+			existing.merge(prop)
+			continue
+		}
+		s.Properties[name] = prop
+	}
+	if add, ok := s.AdditionalProperties.(*Schema); ok {
+		if otherAdd, ok := other.AdditionalProperties.(*Schema); ok {
+			add.merge(otherAdd)
+		}
+	}
+}
+
+// JSONSchema returns the JSON Schema of config.json files, covering the
+// fields of config.Struct and the extension fields of Struct. Editors can use
+// it for completion and validation; see also Validate.
+func JSONSchema() *Schema {
+	s := schemaFor(reflect.TypeOf(config.Struct{}))
+	s.merge(schemaFor(reflect.TypeOf(Struct{})))
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	// Allow referencing the schema from config.json, see gok edit.
+	s.Properties["$schema"] = &Schema{Type: "string"}
+	return s
+}
+
+// jsonType returns the JSON Schema type of the decoded JSON value v.
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// validate returns an error for each value in v (at path) which does not match
+// s.
+func (s *Schema) validate(path string, v any) []error {
+	typ := jsonType(v)
+	if typ == "null" {
+		return nil // omitted pointer, slice or map
+	}
+	if s.Type != "" && s.Type != typ && !(s.Type == "number" && typ == "integer") {
+		return []error{fmt.Errorf("%s: expected %s, got %s", path, s.Type, typ)}
+	}
+	var errs []error
+	switch v := v.(type) {
+	case []any:
+		if s.Items != nil {
+			for idx, item := range v {
+				errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, idx), item)...)
+			}
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keyPath := path + "." + key
+			if path == "" {
+				keyPath = key
+			}
+			if prop, ok := s.Properties[key]; ok {
+				errs = append(errs, prop.validate(keyPath, v[key])...)
+				continue
+			}
+			switch add := s.AdditionalProperties.(type) {
+			case *Schema:
+				errs = append(errs, add.validate(keyPath, v[key])...)
+			case bool:
+				if !add {
+					errs = append(errs, fmt.Errorf("%s: unknown field", keyPath))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// Validate returns an error if the contents of a config.json file are not
+// valid JSON, or contain fields which are unknown or of the wrong type.
+func Validate(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	if _, err := dec.Token(); err == nil {
+		return fmt.Errorf("invalid JSON: unexpected data after the top-level object")
+	}
+	if errs := JSONSchema().validate("", v); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for idx, err := range errs {
+			msgs[idx] = err.Error()
+		}
+		return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+	}
+	var cfg config.Struct
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return err
+	}
+	if cfg.Hostname == "" {
+		return fmt.Errorf("Hostname: must not be empty")
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package extconfig
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			config: `{
+    "$schema": "./config.schema.json",
+    "Hostname": "scanner",
+    "Update": {"HTTPPassword": "secret", "CACertPath": "ca.pem"},
+    "Packages": ["github.com/gokrazy/hello"],
+    "PackageConfig": {
+        "github.com/gokrazy/hello": {
+            "CommandLineFlags": ["-v"],
+            "MemoryLimitMB": 64
+        }
+    },
+    "RootSizeBudgetMB": 300
+}`,
+		},
+		{
+			name:    "syntax",
+			config:  `{"Hostname": "scanner",}`,
+			wantErr: "invalid JSON",
+		},
+		{
+			name:    "unknown field",
+			config:  `{"Hostname": "scanner", "Pakages": []}`,
+			wantErr: "Pakages: unknown field",
+		},
+		{
+			name:    "unknown package config field",
+			config:  `{"Hostname": "scanner", "PackageConfig": {"example.com/x": {"DontStrat": true}}}`,
+			wantErr: "PackageConfig.example.com/x.DontStrat: unknown field",
+		},
+		{
+			name:    "wrong type",
+			config:  `{"Hostname": "scanner", "Update": {"HTTPPort": 8080}}`,
+			wantErr: "Update.HTTPPort: expected string, got integer",
+		},
+		{
+			name:    "wrong element type",
+			config:  `{"Hostname": "scanner", "Packages": ["a", 2]}`,
+			wantErr: "Packages[1]: expected string, got integer",
+		},
+		{
+			name:    "missing hostname",
+			config:  `{"Packages": []}`,
+			wantErr: "Hostname: must not be empty",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate([]byte(tt.config))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate: unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate: got error %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Package fleet implements the optional device inventory of a parent
+// directory (fleet.json), which lists the devices of a fleet with their
+// instance, address and labels, and label selectors for targeting gok
+// commands at a subset of the devices (e.g. site=lab).
+package fleet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// InventoryFile is the name of the inventory file in the parent directory.
+const InventoryFile = "fleet.json"
+
+// Device is a device of the fleet.
+type Device struct {
+	// Instance is the name of the instance directory (in the parent
+	// directory) from which the device is built.
+	Instance string
+
+	// Address, if non-empty, is the hostname or IP address at which the
+	// device is reached for updates. It overrides the Update.Hostname config
+	// field of the instance.
+	Address string `json:",omitempty"`
+
+	// Labels are arbitrary key/value pairs for selecting devices, e.g.
+	// site=garage or role=sensor.
+	Labels map[string]string `json:",omitempty"`
+}
+
+// Inventory is the contents of fleet.json.
+type Inventory struct {
+	Devices []Device
+}
+
+// InventoryPath returns the path of the inventory file in parentDir.
+func InventoryPath(parentDir string) string {
+	return filepath.Join(parentDir, InventoryFile)
+}
+
+// Load reads the inventory of parentDir. The error wraps fs.ErrNotExist if
+// parentDir contains no inventory file.
+func Load(parentDir string) (*Inventory, error) {
+	b, err := os.ReadFile(InventoryPath(parentDir))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse parses and validates the inventory b (in fleet.json format).
+func Parse(b []byte) (*Inventory, error) {
+	var inv Inventory
+	if err := json.Unmarshal(b, &inv); err != nil {
+		return nil, fmt.Errorf("%s: %v", InventoryFile, err)
+	}
+	seen := make(map[string]bool)
+	for idx, d := range inv.Devices {
+		if d.Instance == "" {
+			return nil, fmt.Errorf("%s: Devices[%d]: Instance must not be empty", InventoryFile, idx)
+		}
+		if seen[d.Instance] {
+			return nil, fmt.Errorf("%s: Devices[%d]: instance %q listed more than once", InventoryFile, idx, d.Instance)
+		}
+		seen[d.Instance] = true
+		for key := range d.Labels {
+			if err := validKey(key); err != nil {
+				return nil, fmt.Errorf("%s: Devices[%d] (%s): %v", InventoryFile, idx, d.Instance, err)
+			}
+		}
+	}
+	return &inv, nil
+}
+
+// Device returns the device of instance, or nil if the inventory does not
+// list it.
+func (inv *Inventory) Device(instance string) *Device {
+	for idx := range inv.Devices {
+		if inv.Devices[idx].Instance == instance {
+			return &inv.Devices[idx]
+		}
+	}
+	return nil
+}
+
+// Select returns the devices (in inventory order) whose labels match sel.
+func (inv *Inventory) Select(sel Selector) []Device {
+	var devices []Device
+	for _, d := range inv.Devices {
+		if sel.Matches(d.Labels) {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// Instances returns the instance names of devices.
+func Instances(devices []Device) []string {
+	instances := make([]string, 0, len(devices))
+	for _, d := range devices {
+		instances = append(instances, d.Instance)
+	}
+	return instances
+}
+
+// FormatLabels formats labels as a selector which matches them, e.g.
+// role=sensor,site=garage.
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+labels[key])
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,123 @@
+package fleet
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+const inventory = `{
+    "Devices": [
+        {
+            "Instance": "garage-door",
+            "Address": "10.0.0.23",
+            "Labels": {"site": "garage", "role": "actuator"}
+        },
+        {
+            "Instance": "lab-sensor",
+            "Labels": {"site": "lab", "role": "sensor", "canary": ""}
+        },
+        {
+            "Instance": "lab-router",
+            "Labels": {"site": "lab", "role": "router"}
+        },
+        {
+            "Instance": "unlabeled"
+        }
+    ]
+}`
+
+func TestSelect(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Load(empty dir) = %v, want fs.ErrNotExist", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, InventoryFile), []byte(inventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inv, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := inv.Device("garage-door").Address, "10.0.0.23"; got != want {
+		t.Errorf("Device(garage-door).Address = %q, want %q", got, want)
+	}
+	if d := inv.Device("nonexistent"); d != nil {
+		t.Errorf("Device(nonexistent) = %+v, want nil", d)
+	}
+
+	for _, tt := range []struct {
+		selector string
+		want     []string
+	}{
+		{"", []string{"garage-door", "lab-sensor", "lab-router", "unlabeled"}},
+		{"site=lab", []string{"lab-sensor", "lab-router"}},
+		{"site==lab", []string{"lab-sensor", "lab-router"}},
+		{"site=lab,role!=router", []string{"lab-sensor"}},
+		{"site!=lab", []string{"garage-door", "unlabeled"}},
+		{"canary", []string{"lab-sensor"}},
+		{"site, !canary", []string{"garage-door", "lab-router"}},
+		{"site=attic", nil},
+	} {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := Instances(inv.Select(sel))
+			if diff := cmp.Diff(tt.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("Select(%q): unexpected diff (-want +got):\n%s", tt.selector, diff)
+			}
+		})
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, selector := range []string{
+		"=lab",
+		"site=lab,",
+		"!",
+		"si te=lab",
+	} {
+		if _, err := ParseSelector(selector); err == nil {
+			t.Errorf("ParseSelector(%q) = nil error, want error", selector)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		inventory string
+	}{
+		{"no instance", `{"Devices": [{"Address": "10.0.0.1"}]}`},
+		{"duplicate instance", `{"Devices": [{"Instance": "a"}, {"Instance": "a"}]}`},
+		{"invalid label", `{"Devices": [{"Instance": "a", "Labels": {"a=b": "c"}}]}`},
+		{"syntax", `{"Devices": [`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.inventory)); err == nil {
+				t.Errorf("Parse = nil error, want error")
+			}
+		})
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	labels := map[string]string{"site": "lab", "role": "sensor"}
+	if got, want := FormatLabels(labels), "role=sensor,site=lab"; got != want {
+		t.Errorf("FormatLabels = %q, want %q", got, want)
+	}
+	sel, err := ParseSelector(FormatLabels(labels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sel.Matches(labels) {
+		t.Errorf("selector %q does not match the labels it was formatted from", sel)
+	}
+}
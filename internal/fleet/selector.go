@@ -0,0 +1,107 @@
+package fleet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// requirement is one comma-separated part of a Selector.
+type requirement struct {
+	key   string
+	op    string // "=", "!=", "exists" or "!exists"
+	value string
+}
+
+func (r requirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.op {
+	case "=":
+		return ok && value == r.value
+	case "!=":
+		return !ok || value != r.value
+	case "exists":
+		return ok
+	case "!exists":
+		return !ok
+	}
+	return false
+}
+
+func (r requirement) String() string {
+	switch r.op {
+	case "exists":
+		return r.key
+	case "!exists":
+		return "!" + r.key
+	}
+	return r.key + r.op + r.value
+}
+
+// Selector selects devices by their labels. A selector is a comma-separated
+// list of requirements, all of which must be met:
+//
+//	site=lab      label site has value lab
+//	site!=lab     label site is missing or has a value other than lab
+//	canary        label canary is present (with any value)
+//	!canary       label canary is missing
+//
+// The empty selector selects all devices.
+type Selector []requirement
+
+// ParseSelector parses the label selector s (see Selector).
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	if strings.TrimSpace(s) == "" {
+		return sel, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var r requirement
+		if key, value, ok := strings.Cut(part, "!="); ok {
+			r = requirement{key: key, op: "!=", value: value}
+		} else if key, value, ok := strings.Cut(part, "=="); ok {
+			r = requirement{key: key, op: "=", value: value}
+		} else if key, value, ok := strings.Cut(part, "="); ok {
+			r = requirement{key: key, op: "=", value: value}
+		} else if key, ok := strings.CutPrefix(part, "!"); ok {
+			r = requirement{key: key, op: "!exists"}
+		} else {
+			r = requirement{key: part, op: "exists"}
+		}
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if err := validKey(r.key); err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %v", s, err)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// Matches returns whether labels meet all requirements of s.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	parts := make([]string, 0, len(s))
+	for _, r := range s {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func validKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty label key")
+	}
+	if strings.ContainsAny(key, "=!, \t") {
+		return fmt.Errorf("label key %q must not contain =, !, commas or whitespace", key)
+	}
+	return nil
+}
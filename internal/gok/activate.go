@@ -0,0 +1,88 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/spf13/cobra"
+)
+
+// activateCmd is gok activate.
+var activateCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "activate",
+	Short:   "Reboot a gokrazy instance into an update which gok update did not activate",
+	Long: `gok activate reboots a gokrazy instance into the update which
+gok update --no_reboot or gok update --activate_at wrote to the device, and
+waits until the device runs the new version.
+
+gok update records the pending activation in the instance directory
+(pending-activation.json). When the update was deployed with --activate_at,
+gok activate waits until the requested time before rebooting the device, so
+that you can start gok activate right after gok update, or from a cron job or
+systemd timer. If the device already runs the new version (e.g. because it was
+power-cycled), gok activate only removes the pending activation.
+
+The gokrazy update protocol has no way to schedule a reboot on the device
+itself, so gok activate must be running (and able to reach the device) at the
+activation time.
+
+Examples:
+  % gok -i scanner update --activate_at=2024-09-01T03:00:00+02:00
+  % gok -i scanner activate
+
+  # Activate now, regardless of the time requested with --activate_at
+  % gok -i scanner activate --at=now
+`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return activateImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type activateImplConfig struct {
+	at            string
+	rebootTimeout time.Duration
+	pollInterval  time.Duration
+}
+
+var activateImpl activateImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(activateCmd.Flags())
+	activateCmd.Flags().StringVarP(&activateImpl.at, "at", "", "", "time at which to activate the update (RFC3339, or now), overriding the time requested with gok update --activate_at")
+	activateCmd.Flags().DurationVarP(&activateImpl.rebootTimeout, "reboot_timeout", "", 0, "how long to wait for the device to become reachable with the new version after rebooting. Overrides the RebootTimeout config field (default 5m)")
+	activateCmd.Flags().DurationVarP(&activateImpl.pollInterval, "poll_interval", "", 0, "how long to wait between checking whether the device runs the new version. Overrides the PollInterval config field (default 1s)")
+}
+
+// parseActivateAt parses the value of gok activate --at.
+func parseActivateAt(at string, now time.Time) (time.Time, error) {
+	switch at {
+	case "":
+		return time.Time{}, nil
+	case "now":
+		return now, nil
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("--at: %v", err)
+	}
+	return t, nil
+}
+
+func (r *activateImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	at, err := parseActivateAt(r.at, time.Now())
+	if err != nil {
+		return err
+	}
+	pack, err := newUpdatePack()
+	if err != nil {
+		return err
+	}
+	pack.RebootTimeout = r.rebootTimeout
+	pack.PollInterval = r.pollInterval
+	return pack.Activate(ctx, at)
+}
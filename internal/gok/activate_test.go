@@ -0,0 +1,29 @@
+package gok
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseActivateAt(t *testing.T) {
+	now := time.Date(2024, 8, 31, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		at      string
+		want    time.Time
+		wantErr bool
+	}{
+		{at: "", want: time.Time{}},
+		{at: "now", want: now},
+		{at: "2024-09-01T03:00:00Z", want: time.Date(2024, 9, 1, 3, 0, 0, 0, time.UTC)},
+		{at: "03:00", wantErr: true},
+	} {
+		got, err := parseActivateAt(tt.at, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseActivateAt(%q): err = %v, wantErr %v", tt.at, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseActivateAt(%q) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
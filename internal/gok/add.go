@@ -13,25 +13,51 @@ import (
 
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/instanceflag"
-	"github.com/google/renameio/v2"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/gokrazy/tools/packer"
 	"github.com/spf13/cobra"
 	"golang.org/x/mod/modfile"
+	"golang.org/x/sync/errgroup"
 )
 
 // addCmd is gok add.
 var addCmd = &cobra.Command{
 	GroupID:               "edit",
-	Use:                   "add [flags] importpath[@version]",
+	Use:                   "add [flags] importpath[@version]...",
 	DisableFlagsInUseLine: true,
 	Short:                 "Add a Go package to a gokrazy instance",
 	Long: `Add a Go package to a gokrazy instance.
 
 This command creates the required build directory, runs go get, and adds
-the specified package to the gokrazy instance configuration (Packages field).
+the specified packages to the gokrazy instance configuration (Packages field).
+
+The --build_tags, --env and --flag flags populate the PackageConfig entry of
+each added package, so that no separate 'gok edit' is required.
+
+Each program is installed as /user/<basename>, where basename defaults to the
+last element of the import path. If that name is already taken by another
+package, use --basename to choose a different name.
 
 When using a relative or absolute path, it configures a replace directive:
 https://go.dev/ref/mod#go-mod-file-replace
 
+Packages can also be specified as git URL (https://, ssh:// or scp-like
+git@host:path), optionally followed by @branch, @tag or @commit. A double
+slash separates the repository from the package directory, e.g.
+git@github.com:org/repo.git//cmd/tool. Branches are pinned to their current
+commit (as a pseudo-version); run gok add again to update to the latest
+commit. Forks which declare the module path of their upstream module are
+added using a replace directive.
+
+Packages of private modules (matching GOPRIVATE or GONOPROXY, see 'go help
+private') are resolved using the go tool instead of the module proxy, so that
+the go tool's authentication applies, e.g. git credentials via SSH keys
+(git config --global url."git@github.com:".insteadOf https://github.com/) or a
+~/.netrc file. The environment (GOPRIVATE, GONOSUMDB, SSH_AUTH_SOCK, …) is
+passed on to the go commands building the instance. Use GONOSUMDB (implied by
+GOPRIVATE) for modules which are not in the public checksum database.
+
 Examples:
   # Add a Go package from the internet:
   % gok -i scan2drive add github.com/gokrazy/rsync/cmd/gokr-rsyncd
@@ -39,28 +65,53 @@ Examples:
   # …same, but using a specific version:
   % gok -i scan2drive add github.com/gokrazy/rsync/cmd/gokr-rsyncd@v2
 
+  # Add a Go package from a development branch, using its git URL:
+  % gok -i scan2drive add https://github.com/gokrazy/rsync/cmd/gokr-rsyncd@main
+
+  # Add a Go package from a fork (replacing the upstream module):
+  % gok -i scan2drive add git@github.com:me/rsync//cmd/gokr-rsyncd@fix
+
+  # Add a Go package from a private module:
+  % go env -w GOPRIVATE=git.example.com
+  % gok -i scan2drive add git.example.com/infra/cmd/agent
+
   # Add a Go package from local disk (using a replace directive):
   % gok -i scan2drive add /home/michael/projects/scanui/cmd/scanui
 
+  # Add multiple Go packages, with command line flags:
+  % gok -i scan2drive add --flag=-listen=:8080 \
+      github.com/gokrazy/rsync/cmd/gokr-rsyncd \
+      github.com/gokrazy/timestamps
+
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if cmd.Flags().NArg() != 1 {
+		if cmd.Flags().NArg() < 1 {
 			fmt.Fprint(os.Stderr, `expected Go package name, name@version, or path
 
 `)
 			return cmd.Usage()
 		}
 
-		return addImpl.run(cmd.Context(), args[0], cmd.OutOrStdout(), cmd.OutOrStderr())
+		return addImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
 	},
 }
 
-type addImplConfig struct{}
+type addImplConfig struct {
+	basename  string
+	buildTags []string
+	env       []string
+	flags     []string
+}
 
 var addImpl addImplConfig
 
 func init() {
 	instanceflag.RegisterPflags(addCmd.Flags())
+	registerNoCommitFlag(addCmd.Flags())
+	addCmd.Flags().StringVarP(&addImpl.basename, "basename", "", "", "binary (and service) name of the added package, overriding the last element of its import path. Only valid when adding a single package")
+	addCmd.Flags().StringSliceVarP(&addImpl.buildTags, "build_tags", "", nil, "Go build tags to add to the PackageConfig GoBuildTags of the added packages")
+	addCmd.Flags().StringArrayVarP(&addImpl.env, "env", "", nil, "environment variable (KEY=VALUE) to add to the PackageConfig Environment of the added packages. Can be specified multiple times")
+	addCmd.Flags().StringArrayVarP(&addImpl.flags, "flag", "", nil, "command line flag to add to the PackageConfig CommandLineFlags of the added packages. Can be specified multiple times")
 }
 
 type packageInfo struct {
@@ -88,6 +139,7 @@ type packageInfo struct {
 func inspectDir(ctx context.Context, abs string) (*packageInfo, error) {
 	listPackage := exec.CommandContext(ctx, "go", "list", "-json")
 	listPackage.Dir = abs
+	listPackage.Env = withGlobalEnv(os.Environ())
 	listPackage.Stderr = os.Stderr
 	output, err := listPackage.Output()
 	if err != nil {
@@ -146,10 +198,10 @@ func (r *addImplConfig) copyReplaceDirectives(ctx context.Context, oldDir, newDi
 	return nil
 }
 
-func (r *addImplConfig) addLocal(ctx context.Context, abs string, stdout, stderr io.Writer) error {
+func (r *addImplConfig) addLocal(ctx context.Context, abs string, stdout, stderr io.Writer) (string, error) {
 	pkg, err := inspectDir(ctx, abs)
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.Printf(`Adding the following package to gokrazy instance %q:
   Go package  : %s
@@ -160,7 +212,7 @@ func (r *addImplConfig) addLocal(ctx context.Context, abs string, stdout, stderr
 	if _, err := os.Stat(buildDir); err != nil {
 		log.Printf("Creating gokrazy builddir for package %s", pkg.ImportPath)
 		if err := os.MkdirAll(buildDir, 0755); err != nil {
-			return fmt.Errorf("could not create builddir: %v", err)
+			return "", fmt.Errorf("could not create builddir: %v", err)
 		}
 	}
 
@@ -170,18 +222,18 @@ func (r *addImplConfig) addLocal(ctx context.Context, abs string, stdout, stderr
 	} else {
 		log.Printf("Creating go.mod with replace directive")
 		if err := r.createGoMod(ctx, buildDir, pkg.Module.Path, stdout, stderr); err != nil {
-			return err
+			return "", err
 		}
 	}
 	modEdit := exec.CommandContext(ctx, "go", "mod", "edit", "-replace", pkg.Module.Path+"="+pkg.Module.Dir, "go.mod")
 	modEdit.Dir = buildDir
 	modEdit.Stderr = os.Stderr
 	if err := modEdit.Run(); err != nil {
-		return fmt.Errorf("%v: %v", modEdit.Args, err)
+		return "", fmt.Errorf("%v: %v", modEdit.Args, err)
 	}
 
 	if err := r.copyReplaceDirectives(ctx, pkg.Module.Dir, buildDir, stdout, stderr); err != nil {
-		return err
+		return "", err
 	}
 
 	// Add a require line to go.mod. We use go mod edit instead of go get
@@ -192,32 +244,116 @@ func (r *addImplConfig) addLocal(ctx context.Context, abs string, stdout, stderr
 	get.Dir = buildDir
 	get.Stderr = os.Stderr
 	if err := get.Run(); err != nil {
-		return fmt.Errorf("%v: %v", get.Args, err)
+		return "", fmt.Errorf("%v: %v", get.Args, err)
 	}
 
-	if err := r.addPackageToConfig(pkg.ImportPath); err != nil {
-		return err
-	}
+	return pkg.ImportPath, nil
+}
 
-	log.Printf("All done! Next, use 'gok overwrite' (first deployment), 'gok update' (following deployments) or 'gok run' (run on running instance temporarily)")
+// appendMissing appends all values to slice which slice does not already
+// contain.
+func appendMissing(slice []string, values ...string) []string {
+	for _, val := range values {
+		found := false
+		for _, existing := range slice {
+			if existing == val {
+				found = true
+				break
+			}
+		}
+		if !found {
+			slice = append(slice, val)
+		}
+	}
+	return slice
+}
 
+// basenameConflicts returns an error if any of importPaths would be installed
+// under the same binary name as another package.
+func basenameConflicts(cfg *config.Struct, ext *extconfig.Struct, importPaths []string) error {
+	basenames := ext.Basenames()
+	basename := func(importPath string) string {
+		return (&packer.Pkg{
+			ImportPath:       importPath,
+			BasenameOverride: basenames[importPath],
+		}).Basename()
+	}
+	taken := make(map[string]string) // basename → import path
+	var configured []string
+	configured = append(configured, cfg.GokrazyPackagesOrDefault()...)
+	configured = append(configured, cfg.Packages...)
+	for _, importPath := range configured {
+		if strings.HasSuffix(importPath, "/...") {
+			continue // cannot determine the binary names without go list
+		}
+		importPath, _ = splitVersion(importPath)
+		taken[basename(importPath)] = importPath
+	}
+	for _, importPath := range importPaths {
+		name := basename(importPath)
+		if other, ok := taken[name]; ok && other != importPath {
+			return fmt.Errorf("package %s would be installed as /user/%s, which conflicts with package %s. Use --basename to choose a different name", importPath, name, other)
+		}
+		taken[name] = importPath
+	}
 	return nil
 }
 
-func (r *addImplConfig) addPackageToConfig(importPath string) error {
+func (r *addImplConfig) addPackagesToConfig(importPaths []string) error {
 	cfg, err := config.ReadFromFile()
 	if err != nil {
 		return err
 	}
-	for _, existing := range cfg.Packages {
-		if existing == importPath {
-			log.Printf("Package already configured (see 'gok -i %s edit')", instanceflag.Instance())
-			return nil
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	modified := false
+	if r.basename != "" {
+		if ext.PackageConfig == nil {
+			ext.PackageConfig = make(map[string]extconfig.PackageConfig)
+		}
+		pc := ext.PackageConfig[importPaths[0]]
+		pc.Basename = r.basename
+		ext.PackageConfig[importPaths[0]] = pc
+		modified = true
+	}
+	if err := basenameConflicts(cfg, ext, importPaths); err != nil {
+		return err
+	}
+	for _, importPath := range importPaths {
+		configured := false
+		for _, existing := range cfg.Packages {
+			if existing == importPath {
+				configured = true
+				break
+			}
+		}
+		if configured {
+			log.Printf("Package %s already configured (see 'gok -i %s edit')", importPath, instanceflag.Instance())
+		} else {
+			log.Printf("Adding package %s to gokrazy config", importPath)
+			cfg.Packages = append(cfg.Packages, importPath)
+			modified = true
+		}
+
+		if len(r.buildTags) == 0 && len(r.env) == 0 && len(r.flags) == 0 {
+			continue
+		}
+		if cfg.PackageConfig == nil {
+			cfg.PackageConfig = make(map[string]config.PackageConfig)
 		}
+		pc := cfg.PackageConfig[importPath]
+		pc.GoBuildTags = appendMissing(pc.GoBuildTags, r.buildTags...)
+		pc.Environment = append(pc.Environment, r.env...)
+		pc.CommandLineFlags = append(pc.CommandLineFlags, r.flags...)
+		cfg.PackageConfig[importPath] = pc
+		modified = true
 	}
-	log.Printf("Adding package to gokrazy config")
-	cfg.Packages = append(cfg.Packages, importPath)
-	b, err := cfg.FormatForFile()
+	if !modified {
+		return nil
+	}
+	b, err := extconfig.FormatForFile(cfg, ext)
 	if err != nil {
 		return err
 	}
@@ -227,28 +363,40 @@ func (r *addImplConfig) addPackageToConfig(importPath string) error {
 	return nil
 }
 
-func (r *addImplConfig) addNonLocal(ctx context.Context, arg string, stdout, stderr io.Writer) error {
-	log.Printf("Adding %s as a (non-local) package to gokrazy instance %s", arg, instanceflag.Instance())
-	importPath := arg
-	version := "latest"
-	if idx := strings.IndexByte(importPath, '@'); idx > -1 {
+// splitVersion splits arg into import path and version (latest if arg has
+// no @version suffix).
+func splitVersion(arg string) (importPath, version string) {
+	if idx := strings.IndexByte(arg, '@'); idx > -1 {
 		// Trim @version suffix from import path, if any
-		version = importPath[idx+1:]
-		importPath = importPath[:idx]
+		return arg[:idx], arg[idx+1:]
 	}
-	resolved, err := resolveModule(ctx, importPath, version)
-	if err != nil {
-		return err
+	return arg, "latest"
+}
+
+func (r *addImplConfig) addNonLocal(ctx context.Context, arg string, resolved *resolvedModule, stdout, stderr io.Writer) (string, error) {
+	log.Printf("Adding %s as a (non-local) package to gokrazy instance %s", arg, instanceflag.Instance())
+	importPath, _ := splitVersion(arg)
+
+	// A fork (e.g. github.com/me/gokrazy) declares the module path of the
+	// upstream module (github.com/gokrazy/gokrazy) in its go.mod file, so
+	// its packages need to be imported using the upstream module path and
+	// the fork needs to be used via a replace directive.
+	modulePath := resolved.module
+	if declared := modfile.ModulePath(resolved.goMod); declared != "" && declared != resolved.module {
+		log.Printf("Module %s declares module path %s, using a replace directive", resolved.module, declared)
+		importPath = declared + strings.TrimPrefix(importPath, resolved.module)
+		modulePath = declared
 	}
+
 	log.Printf(`Adding the following package to gokrazy instance %q:
   Go package  : %s
   in Go module: %s`, instanceflag.Instance(), importPath, resolved.module)
 
-	buildDir := filepath.Join(config.InstancePath(), "builddir", resolved.module)
+	buildDir := filepath.Join(config.InstancePath(), "builddir", modulePath)
 	if _, err := os.Stat(buildDir); err != nil {
 		log.Printf("Creating gokrazy builddir for module %s", resolved.module)
 		if err := os.MkdirAll(buildDir, 0755); err != nil {
-			return fmt.Errorf("could not create builddir: %v", err)
+			return "", fmt.Errorf("could not create builddir: %v", err)
 		}
 	}
 
@@ -258,40 +406,56 @@ func (r *addImplConfig) addNonLocal(ctx context.Context, arg string, stdout, std
 		log.Printf("Creating go.mod based on upstream go.mod")
 		modf, err := modfile.Parse("go.mod", resolved.goMod, nil)
 		if err != nil {
-			return fmt.Errorf("parsing old go.mod: %v", err)
+			return "", fmt.Errorf("parsing old go.mod: %v", err)
 		}
-		if err := modf.AddModuleStmt("gokrazy/build/" + resolved.module); err != nil {
-			return err
+		if err := modf.AddModuleStmt("gokrazy/build/" + modulePath); err != nil {
+			return "", err
 		}
 
 		b, err := modf.Format()
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		if err := os.WriteFile(filepath.Join(buildDir, "go.mod"), b, 0600); err != nil {
-			return err
+			return "", err
 		}
 	}
 
 	// Add a require line to go.mod. We use go mod edit instead of go get
 	// because the latter does not work for evcc: “panic: internal error: can't
 	// find reason for requirement on github.com/rogpeppe/go-internal@v1.6.1.”
-	get := exec.CommandContext(ctx, "go", "mod", "edit", "-require", resolved.module+"@"+resolved.version)
+	editArgs := []string{"mod", "edit", "-require", modulePath + "@" + resolved.version}
+	if modulePath != resolved.module {
+		editArgs = append(editArgs, "-replace", modulePath+"="+resolved.module+"@"+resolved.version)
+	}
+	get := exec.CommandContext(ctx, "go", editArgs...)
 	get.Dir = buildDir
 	get.Stderr = os.Stderr
 	if err := get.Run(); err != nil {
-		return fmt.Errorf("%v: %v", get.Args, err)
+		return "", fmt.Errorf("%v: %v", get.Args, err)
 	}
 
-	if err := r.addPackageToConfig(importPath); err != nil {
-		return err
-	}
+	return importPath, nil
+}
 
-	return nil
+// isPath returns true if arg refers to a directory on the local disk (as
+// opposed to a Go import path).
+func isPath(arg string) bool {
+	// Clear cases: an absolute path on the local disk
+	// (e.g. /home/michael/go/src/mytool), or an explicitly relative path
+	// (./mytool or ../mytool).
+	if strings.HasPrefix(arg, string(os.PathSeparator)) ||
+		strings.HasPrefix(arg, ".") {
+		return true
+	}
+	// We are less sure now. The argument could still be a relative path
+	// (mytool), so see if the directory exists
+	_, err := os.Stat(arg)
+	return err == nil
 }
 
-func (r *addImplConfig) run(ctx context.Context, arg string, stdout, stderr io.Writer) error {
+func (r *addImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 	parentDir := instanceflag.ParentDir()
 	instance := instanceflag.Instance()
 
@@ -299,26 +463,88 @@ func (r *addImplConfig) run(ctx context.Context, arg string, stdout, stderr io.W
 		return fmt.Errorf("instance %q does not exist (%v), create it using 'gok -i %s new'", instance, err, instance)
 	}
 
-	// Clear cases: an absolute path on the local disk
-	// (e.g. /home/michael/go/src/mytool), or an explicitly relative path
-	// (./mytool or ../mytool).
-	isPath := strings.HasPrefix(arg, string(os.PathSeparator)) ||
-		strings.HasPrefix(arg, ".")
-	if !isPath {
-		// We are less sure now. The argument could still be a relative path
-		// (mytool), so see if the directory exists
-		if _, err := os.Stat(arg); err == nil {
-			isPath = true
+	if r.basename != "" {
+		if len(args) > 1 {
+			return fmt.Errorf("--basename can only be used when adding a single package")
+		}
+		if strings.ContainsRune(r.basename, '/') {
+			return fmt.Errorf("invalid --basename %q: must not contain /", r.basename)
 		}
 	}
 
-	if isPath {
-		abs, err := filepath.Abs(arg)
+	for _, env := range r.env {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("invalid --env value %q: expected KEY=VALUE", env)
+		}
+	}
+
+	args = append([]string(nil), args...) // copy, git URLs are replaced below
+	for idx, arg := range args {
+		if !isGitURL(arg) {
+			continue
+		}
+		importPath, version, err := parseGitURL(arg)
 		if err != nil {
 			return err
 		}
-		return r.addLocal(ctx, abs, stdout, stderr)
+		log.Printf("Resolving git URL %s as %s@%s", arg, importPath, version)
+		args[idx] = importPath + "@" + version
+	}
+
+	// Resolve all non-local packages concurrently, as each resolution
+	// requires multiple (potentially slow) module proxy requests.
+	resolved := make([]*resolvedModule, len(args))
+	eg, resolvectx := errgroup.WithContext(ctx)
+	for idx, arg := range args {
+		if isPath(arg) {
+			continue
+		}
+		eg.Go(func() error {
+			importPath, version := splitVersion(arg)
+			res, err := resolveModule(resolvectx, importPath, version)
+			if err != nil {
+				return fmt.Errorf("%s: %v", arg, err)
+			}
+			resolved[idx] = res
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	importPaths := make([]string, 0, len(args))
+	for idx, arg := range args {
+		var importPath string
+		if resolved[idx] == nil {
+			abs, err := filepath.Abs(arg)
+			if err != nil {
+				return err
+			}
+			importPath, err = r.addLocal(ctx, abs, stdout, stderr)
+			if err != nil {
+				return err
+			}
+		} else {
+			var err error
+			importPath, err = r.addNonLocal(ctx, arg, resolved[idx], stdout, stderr)
+			if err != nil {
+				return err
+			}
+		}
+		importPaths = append(importPaths, importPath)
+	}
+
+	if err := r.addPackagesToConfig(importPaths); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("%s: add %s", instance, strings.Join(importPaths, ", "))
+	if err := commitInstanceChanges(ctx, filepath.Join(parentDir, instance), msg); err != nil {
+		return err
 	}
 
-	return r.addNonLocal(ctx, arg, stdout, stderr)
+	log.Printf("All done! Next, use 'gok overwrite' (first deployment), 'gok update' (following deployments) or 'gok run' (run on running instance temporarily)")
+
+	return nil
 }
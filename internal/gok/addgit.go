@@ -0,0 +1,58 @@
+package gok
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// scpLikeRe matches scp-like git URLs, e.g. git@github.com:org/repo.
+var scpLikeRe = regexp.MustCompile(`^[A-Za-z0-9._-]+@([A-Za-z0-9.-]+):(.+)$`)
+
+// isGitURL returns true if arg refers to a git repository (see parseGitURL)
+// instead of a Go import path.
+func isGitURL(arg string) bool {
+	for _, prefix := range []string{"https://", "http://", "ssh://", "git+ssh://", "git://"} {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	return scpLikeRe.MatchString(arg)
+}
+
+// parseGitURL turns a git URL into the Go import path and version it refers
+// to, e.g.:
+//
+//	https://github.com/org/repo/cmd/tool@main → github.com/org/repo/cmd/tool, main
+//	git@github.com:org/repo.git//cmd/tool     → github.com/org/repo/cmd/tool, latest
+//
+// A double slash separates the repository from the package directory within
+// it (like in go-getter URLs), which is required when the repository path
+// ends in .git. The version (a branch, tag or commit) defaults to latest.
+func parseGitURL(arg string) (importPath, version string, _ error) {
+	var host, p string
+	if m := scpLikeRe.FindStringSubmatch(arg); m != nil {
+		host, p = m[1], m[2]
+	} else {
+		u, err := url.Parse(arg)
+		if err != nil {
+			return "", "", err
+		}
+		host, p = u.Hostname(), u.Path
+	}
+	version = "latest"
+	if idx := strings.LastIndexByte(p, '@'); idx > -1 {
+		p, version = p[:idx], p[idx+1:]
+		if version == "" {
+			return "", "", fmt.Errorf("%s: empty version after @", arg)
+		}
+	}
+	repo, dir, _ := strings.Cut(strings.TrimPrefix(p, "/"), "//")
+	repo = strings.TrimSuffix(strings.TrimSuffix(repo, "/"), ".git")
+	if host == "" || repo == "" {
+		return "", "", fmt.Errorf("%s: expected a git URL like https://github.com/org/repo/cmd/tool@branch or git@github.com:org/repo//cmd/tool", arg)
+	}
+	return path.Join(host, repo, dir), version, nil
+}
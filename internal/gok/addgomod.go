@@ -1,12 +1,14 @@
 package gok
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
 	"strings"
 
@@ -27,7 +29,11 @@ type latestResp struct {
 
 func proxyRequest(importPath, suffix string) (*http.Request, error) {
 	proxyBase := "https://proxy.golang.org"
-	if gp := os.Getenv("GOPROXY"); gp != "" {
+	gp, ok := os.LookupEnv("GOPROXY")
+	if !ok {
+		gp = globalCfg.GOPROXY
+	}
+	if gp != "" {
 		if strings.ContainsRune(gp, ',') ||
 			strings.ContainsRune(gp, '|') ||
 			gp == "off" ||
@@ -65,7 +71,7 @@ func moduleInfo(ctx context.Context, importPath, version string) (*latestResp, e
 		return nil, err
 	}
 	req.Header.Set("Accept", "application/json")
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	resp, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +101,7 @@ func resolveGoMod(ctx context.Context, importPath string, latest *latestResp) (*
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	resp, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -117,7 +123,120 @@ func resolveGoMod(ctx context.Context, importPath string, latest *latestResp) (*
 	}, nil
 }
 
+// notAModule returns true for import path prefixes which cannot be Go modules.
+func notAModule(importPath string) bool {
+	if importPath == "github.com" {
+		// Short-circuit: github.com is not a Go module :)
+		return true
+	}
+	if strings.HasPrefix(importPath, "github.com/") &&
+		!strings.ContainsRune(strings.TrimPrefix(importPath, "github.com/"), '/') {
+		// Short-circuit: github.com/<something> references an
+		// organisation or user, not a repository.
+		return true
+	}
+	return false
+}
+
+// isPrivate returns true if importPath matches the GOPRIVATE or GONOPROXY
+// patterns (see go help private), i.e. the go tool does not use the module
+// proxy for it. The settings are read using go env, so that settings made
+// with go env -w are respected.
+func isPrivate(ctx context.Context, importPath string) (bool, error) {
+	goEnv := exec.CommandContext(ctx, "go", "env", "GOPRIVATE", "GONOPROXY")
+	goEnv.Stderr = os.Stderr
+	out, err := goEnv.Output()
+	if err != nil {
+		return false, fmt.Errorf("%v: %v", goEnv.Args, err)
+	}
+	patterns := strings.Join(strings.Fields(string(out)), ",")
+	return module.MatchPrefixPatterns(patterns, importPath), nil
+}
+
+// goListModule is the subset of the go list -m -json output which gok uses.
+type goListModule struct {
+	Path    string
+	Version string
+	GoMod   string // path to the go.mod file in the module cache
+}
+
+// goModuleInfo resolves importPath@version using go list -m, which
+// downloads the module using the go tool's configuration (GOPRIVATE,
+// GOPROXY, git credentials, …).
+func goModuleInfo(ctx context.Context, importPath, version string) (*goListModule, error) {
+	var stderr bytes.Buffer
+	list := exec.CommandContext(ctx, "go", "list", "-m", "-json", importPath+"@"+version)
+	// Run outside of any module or workspace, like go install pkg@version.
+	list.Dir = os.TempDir()
+	list.Env = withGlobalEnv(os.Environ(), "GO111MODULE=on", "GOWORK=off")
+	list.Stderr = &stderr
+	out, err := list.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v: %s", list.Args, err, strings.TrimSpace(stderr.String()))
+	}
+	var mod goListModule
+	if err := json.Unmarshal(out, &mod); err != nil {
+		return nil, fmt.Errorf("decoding %v output: %v", list.Args, err)
+	}
+	return &mod, nil
+}
+
+// resolveModuleWithGo is like resolveModule, but uses the go tool instead of
+// requesting the module proxy directly, e.g. for private modules which are
+// only reachable via git (see isPrivate).
+func resolveModuleWithGo(ctx context.Context, importPath, version string) (*resolvedModule, error) {
+	eg, listctx := errgroup.WithContext(ctx)
+
+	parts := strings.Split(path.Clean(importPath), "/")
+	mods := make([]*goListModule, len(parts))
+	errs := make([]error, len(parts))
+	for idx := len(parts); idx > 0; idx-- {
+		idx := idx // copy
+		importPath := strings.Join(parts[:idx], "/")
+		if notAModule(importPath) {
+			continue
+		}
+		eg.Go(func() error {
+			// Errors are expected for prefixes which are not modules.
+			mods[idx-1], errs[idx-1] = goModuleInfo(listctx, importPath, version)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for idx := len(parts); idx > 0; idx-- {
+		mod := mods[idx-1]
+		if mod == nil {
+			if firstErr == nil {
+				firstErr = errs[idx-1]
+			}
+			continue
+		}
+		goMod, err := os.ReadFile(mod.GoMod)
+		if err != nil {
+			return nil, err
+		}
+		return &resolvedModule{
+			module:  mod.Path,
+			version: mod.Version,
+			goMod:   goMod,
+		}, nil
+	}
+	return nil, fmt.Errorf("could not resolve private import path %q to any Go module: %v", importPath, firstErr)
+}
+
 func resolveModule(ctx context.Context, importPath, version string) (*resolvedModule, error) {
+	private, err := isPrivate(ctx, importPath)
+	if err != nil {
+		return nil, err
+	}
+	if private {
+		return resolveModuleWithGo(ctx, importPath, version)
+	}
+
 	eg, latestctx := errgroup.WithContext(ctx)
 
 	parts := strings.Split(path.Clean(importPath), "/")
@@ -126,14 +245,7 @@ func resolveModule(ctx context.Context, importPath, version string) (*resolvedMo
 		idx := idx // copy
 		importPath := strings.Join(parts[:idx], "/")
 		eg.Go(func() error {
-			if importPath == "github.com" {
-				// Short-circuit: github.com is not a Go module :)
-				return nil
-			}
-			if strings.HasPrefix(importPath, "github.com/") &&
-				!strings.ContainsRune(strings.TrimPrefix(importPath, "github.com/"), '/') {
-				// Short-circuit: github.com/<something> references an
-				// organisation or user, not a repository.
+			if notAModule(importPath) {
 				return nil
 			}
 			resp, err := moduleInfo(latestctx, importPath, version)
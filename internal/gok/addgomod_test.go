@@ -0,0 +1,63 @@
+package gok
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIsPrivate(t *testing.T) {
+	t.Setenv("GOPRIVATE", "git.example.com,*.corp.example")
+	t.Setenv("GONOPROXY", "")
+	for _, tt := range []struct {
+		importPath string
+		want       bool
+	}{
+		{"git.example.com/infra/cmd/agent", true},
+		{"git.example.com", true},
+		{"build.corp.example/tools/cmd/x", true},
+		{"github.com/gokrazy/hello", false},
+		{"git.example.community/x", false},
+	} {
+		got, err := isPrivate(context.Background(), tt.importPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("isPrivate(%q) = %v, want %v", tt.importPath, got, tt.want)
+		}
+	}
+}
+
+func TestParseGitURL(t *testing.T) {
+	for _, tt := range []struct {
+		arg        string
+		importPath string
+		version    string
+	}{
+		{"https://github.com/org/repo/cmd/tool@main", "github.com/org/repo/cmd/tool", "main"},
+		{"https://github.com/org/repo", "github.com/org/repo", "latest"},
+		{"https://github.com/org/repo.git//cmd/tool@feature/x", "github.com/org/repo/cmd/tool", "feature/x"},
+		{"git@github.com:org/repo//cmd/tool", "github.com/org/repo/cmd/tool", "latest"},
+		{"git@github.com:org/repo.git//cmd/tool@v1.2.3", "github.com/org/repo/cmd/tool", "v1.2.3"},
+		{"ssh://git@git.example.com:2222/infra/agent.git@main", "git.example.com/infra/agent", "main"},
+	} {
+		if !isGitURL(tt.arg) {
+			t.Errorf("isGitURL(%q) = false, want true", tt.arg)
+			continue
+		}
+		importPath, version, err := parseGitURL(tt.arg)
+		if err != nil {
+			t.Errorf("parseGitURL(%q): %v", tt.arg, err)
+			continue
+		}
+		if importPath != tt.importPath || version != tt.version {
+			t.Errorf("parseGitURL(%q) = %q, %q, want %q, %q", tt.arg, importPath, version, tt.importPath, tt.version)
+		}
+	}
+
+	for _, arg := range []string{"github.com/org/repo/cmd/tool", "./cmd/tool", "github.com/org/repo@v1.0.0"} {
+		if isGitURL(arg) {
+			t.Errorf("isGitURL(%q) = true, want false", arg)
+		}
+	}
+}
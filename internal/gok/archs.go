@@ -0,0 +1,19 @@
+package gok
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const archsFlagUsage = "comma-separated list of target architectures (GOARCH, e.g. arm64,amd64) to build for, one after the other. Output paths are suffixed with the architecture (e.g. /tmp/scanner.gaf becomes /tmp/scanner-arm64.gaf). Use the ArchPackages config field to select a kernel per architecture"
+
+// archPath returns path with arch inserted before the file extension, e.g.
+// /tmp/scanner-arm64.gaf for /tmp/scanner.gaf. Directories (isDir) get a
+// subdirectory per architecture.
+func archPath(path, arch string, isDir bool) string {
+	if isDir {
+		return filepath.Join(path, arch)
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + arch + ext
+}
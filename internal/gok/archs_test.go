@@ -0,0 +1,20 @@
+package gok
+
+import "testing"
+
+func TestArchPath(t *testing.T) {
+	for _, tt := range []struct {
+		path  string
+		isDir bool
+		want  string
+	}{
+		{"/tmp/scanner.gaf", false, "/tmp/scanner-amd64.gaf"},
+		{"/tmp/scanner.img", false, "/tmp/scanner-amd64.img"},
+		{"/tmp/scanner", false, "/tmp/scanner-amd64"},
+		{"out", true, "out/amd64"},
+	} {
+		if got := archPath(tt.path, "amd64", tt.isDir); got != tt.want {
+			t.Errorf("archPath(%q, amd64, %v) = %q, want %q", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package gok
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// buildCmd is gok build.
+var buildCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "build [importpath...]",
+	Short:   "Build the Go programs of a gokrazy instance, without creating an image",
+	Long: `gok build builds the Go programs of your gokrazy instance (or only the
+specified packages) for the target architecture and writes them into the output
+directory. It uses the same per-package configuration (GoBuildFlags,
+GoBuildTags, Basenames) and build directories as gok overwrite and gok update,
+but does not create any file system image.
+
+This is useful to copy a single program onto a development board manually, or
+to inspect the binaries, e.g. with objdump.
+
+Examples:
+  # build all programs of the instance into ./bin
+  % gok -i scanner build -o bin
+
+  # build only scan2drive
+  % gok -i scanner build -o /tmp/bins github.com/stapelberg/scan2drive/cmd/scan2drive
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return buildImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type buildImplConfig struct {
+	outputDir     string
+	verbose       bool
+	noBinaryCache bool
+	remoteCache   string
+}
+
+var buildImpl buildImplConfig
+
+func init() {
+	buildCmd.Flags().StringVarP(&buildImpl.outputDir, "output_dir", "o", ".", "directory to write the built programs to")
+	buildCmd.Flags().BoolVarP(&buildImpl.verbose, "verbose", "v", false, verboseFlagUsage)
+	buildCmd.Flags().BoolVarP(&buildImpl.noBinaryCache, "no_binary_cache", "", false, noBinaryCacheFlagUsage)
+	buildCmd.Flags().StringVarP(&buildImpl.remoteCache, "remote_cache", "", "", remoteCacheFlagUsage)
+	instanceflag.RegisterPflags(buildCmd.Flags())
+}
+
+func (r *buildImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	outputDir, err := filepath.Abs(r.outputDir)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+	pack := &packer.Pack{
+		Cfg:           cfg,
+		Verbose:       r.verbose,
+		NoBinaryCache: r.noBinaryCache,
+		RemoteCache:   remoteCacheURL(r.remoteCache),
+		Env:           globalCfg.environ(),
+		HTTPClient:    httpClient,
+	}
+	return pack.BuildBinaries(ctx, outputDir, args)
+}
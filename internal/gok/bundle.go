@@ -0,0 +1,279 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// bundleCmd is gok bundle.
+var bundleCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "bundle",
+	Short:   "Export a gokrazy instance with everything needed to build it offline",
+	Long: `A bundle is a single .tar.gz file containing everything needed to build a
+gokrazy instance on another machine without network access, e.g. in regulated
+or air-gapped environments:
+
+- the files of the instance directory (like gok snapshot)
+- all Go modules (zip files from the module cache), including the kernel,
+  firmware and EEPROM packages and the pinned GoToolchain (see gok vendor)
+- ExtraFilePaths URLs and ExtraFileOCI images
+
+Unlike gok snapshot, which archives the configuration only (modules are
+downloaded again when building), a bundle is self-contained, and therefore
+much larger.
+
+The GoToolchain is downloaded for the machine running gok bundle export, so
+build the bundle on a machine with the same operating system and architecture.
+Without a GoToolchain, the go command installed on the building machine is used.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var bundleExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write a bundle of a gokrazy instance",
+	Long: `gok bundle export downloads all modules of the instance into its modcache/
+directory (like gok vendor) and writes a bundle containing the instance and
+its modules.
+
+Examples:
+  % gok -i scanner bundle export
+  % gok -i scanner bundle export --output /media/usb/scanner.bundle.tar.gz
+`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return bundleExportImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+var bundleImportCmd = &cobra.Command{
+	Use:   "import <bundle>",
+	Short: "Create a gokrazy instance from a bundle",
+	Long: `gok bundle import creates a gokrazy instance directory from a bundle written by
+gok bundle export, verifying the SHA256 sum of every file, like gok restore.
+The instance is named like the exported instance, unless you specify a
+different name with -i. Downloaded extra files are placed in your gokrazy
+cache directory (e.g. ~/.cache/gokrazy).
+
+Build the imported instance with gok overwrite --offline (or gok update
+--offline), which never accesses the network.
+
+Examples:
+  % gok bundle import /media/usb/scanner.bundle.tar.gz
+  % gok -i scanner overwrite --offline --gaf /tmp/scanner.gaf
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bundleImportImpl.instanceSet = cmd.Flags().Changed("instance")
+		return bundleImportImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+var bundleBuildCmd = &cobra.Command{
+	Use:   "build <bundle>",
+	Short: "Build a gaf file from a bundle without network access",
+	Long: `gok bundle build imports a bundle into a temporary directory (see gok bundle
+import), builds a gaf file (gokrazy archive format, see gok overwrite --gaf)
+from it with gok overwrite --offline and removes the temporary directory.
+
+Examples:
+  % gok bundle build --gaf /tmp/scanner.gaf /media/usb/scanner.bundle.tar.gz
+  % gok push --gaf /tmp/scanner.gaf
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return bundleBuildImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type bundleExportConfig struct {
+	output string
+}
+
+var bundleExportImpl bundleExportConfig
+
+type bundleImportConfig struct {
+	instanceSet bool
+}
+
+var bundleImportImpl bundleImportConfig
+
+type bundleBuildConfig struct {
+	gaf     string
+	verbose bool
+}
+
+var bundleBuildImpl bundleBuildConfig
+
+func init() {
+	bundleExportCmd.Flags().StringVarP(&bundleExportImpl.output, "output", "o", "", "path of the bundle to write (default: <instance>.bundle.tar.gz in the current directory)")
+	instanceflag.RegisterPflags(bundleExportCmd.Flags())
+	instanceflag.RegisterPflags(bundleImportCmd.Flags())
+	bundleBuildCmd.Flags().StringVarP(&bundleBuildImpl.gaf, "gaf", "", "", "write a .gaf (gokrazy archive format) file to the specified path (e.g. /tmp/gokrazy.gaf)")
+	bundleBuildCmd.Flags().BoolVarP(&bundleBuildImpl.verbose, "verbose", "v", false, verboseFlagUsage)
+	bundleBuildCmd.MarkFlagRequired("gaf")
+	bundleCmd.AddCommand(bundleExportCmd)
+	bundleCmd.AddCommand(bundleImportCmd)
+	bundleCmd.AddCommand(bundleBuildCmd)
+}
+
+func (r *bundleExportConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	output := r.output
+	if output == "" {
+		output = instanceflag.Instance() + ".bundle.tar.gz"
+	}
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	if cfg.InternalCompatibilityFlags == nil {
+		cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
+	}
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+	updateflag.SetUpdate("yes")
+	modCache, err := filepath.Abs(packer.ModCacheDir)
+	if err != nil {
+		return err
+	}
+	pack := &packer.Pack{
+		FileCfg:    cfg,
+		Cfg:        cfg,
+		Ext:        ext,
+		Env:        globalCfg.environ(),
+		HTTPClient: httpClient,
+	}
+	if err := pack.Vendor(ctx, modCache, stdout); err != nil {
+		return err
+	}
+
+	f, err := renameio.TempFile("", output)
+	if err != nil {
+		return err
+	}
+	defer f.Cleanup()
+	manifest, err := pack.Bundle(f)
+	if err != nil {
+		return err
+	}
+	if err := f.CloseAtomicallyReplace(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Wrote bundle of instance %s (%d modules, %d files) to %s\n",
+		manifest.Instance, manifest.Modules, len(manifest.Files), output)
+	if manifest.GoToolchain != "" {
+		fmt.Fprintf(stdout, "The bundle contains Go toolchain %s for %s/%s only\n",
+			manifest.GoToolchain, manifest.GOOS, manifest.GOARCH)
+	}
+	return nil
+}
+
+func (r *bundleImportConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	manifest, err := importBundle(args[0], r.instanceSet)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Imported instance %s (bundle of %s created at %v, %d modules) to %s\n",
+		instanceflag.Instance(), manifest.Instance, manifest.Created.Format("2006-01-02 15:04:05"), manifest.Modules, config.InstancePath())
+	fmt.Fprintf(stdout, "Build it without network access using: gok -i %s overwrite --offline\n", instanceflag.Instance())
+	return nil
+}
+
+// importBundle imports the bundle at path into a new instance directory,
+// named like the exported instance unless instanceSet (-i).
+func importBundle(path string, instanceSet bool) (*packer.BundleManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if !instanceSet {
+		manifest, err := packer.ReadBundleManifest(f)
+		if err != nil {
+			return nil, err
+		}
+		instanceflag.SetInstance(manifest.Instance)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	dir := config.InstancePath()
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("instance directory %s already exists, refusing to overwrite it", dir)
+	}
+	manifest, err := packer.ImportBundle(f, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := restoreConfigFile(&manifest.SnapshotManifest); err != nil {
+		return nil, err
+	}
+	if manifest.GoToolchain != "" && (manifest.GOOS != runtime.GOOS || manifest.GOARCH != runtime.GOARCH) {
+		log.Printf("WARNING: the bundle contains Go toolchain %s for %s/%s, but this machine is %s/%s: offline builds will fail",
+			manifest.GoToolchain, manifest.GOOS, manifest.GOARCH, runtime.GOOS, runtime.GOARCH)
+	}
+	return manifest, nil
+}
+
+func (r *bundleBuildConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	gaf, err := filepath.Abs(r.gaf)
+	if err != nil {
+		return err
+	}
+	bundle, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	parentDir, err := os.MkdirTemp("", "gok-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(parentDir)
+	instanceflag.SetParentDir(parentDir)
+	manifest, err := importBundle(bundle, false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Building instance %s (bundle created at %v) offline\n",
+		manifest.Instance, manifest.Created.Format("2006-01-02 15:04:05"))
+	overwrite := &overwriteImplConfig{
+		gaf:      gaf,
+		offline:  true,
+		verbose:  r.verbose,
+		mkfsPerm: true,
+		discard:  packer.DiscardUnused,
+		// Build all programs from the bundle, instead of taking programs
+		// from the binary cache of this machine.
+		noBinaryCache: true,
+		// Keep the module cache writable, so that os.RemoveAll succeeds.
+		env: []string{"GOFLAGS=" + strings.TrimSpace(os.Getenv("GOFLAGS")+" -modcacherw")},
+	}
+	return overwrite.run(ctx, nil, stdout, stderr)
+}
@@ -0,0 +1,185 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/spf13/cobra"
+)
+
+// completionCmd is gok completion.
+var completionCmd = &cobra.Command{
+	Use:   "completion bash|zsh|fish",
+	Short: "Generate the shell completion script for gok",
+	Long: `gok completion prints a shell completion script for gok to stdout.
+
+Besides sub commands and flags, the completion script completes instance
+names (-i/--instance), package names (gok get) and service names (gok logs,
+gok restart, gok stop). Service names are queried from the gokrazy instance
+if it is reachable, otherwise they are derived from the instance config.
+
+Examples:
+  # Enable completion in the current bash session:
+  % source <(gok completion bash)
+
+  # Enable completion for all new zsh sessions:
+  % gok completion zsh > "${fpath[1]}/_gok"
+
+  # Enable completion for all new fish sessions:
+  % gok completion fish > ~/.config/fish/completions/gok.fish
+`,
+	ValidArgs:             []string{"bash", "zsh", "fish"},
+	Args:                  cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	DisableFlagsInUseLine: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return completionImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type completionImplConfig struct{}
+
+var completionImpl completionImplConfig
+
+func (r *completionImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	switch args[0] {
+	case "bash":
+		return RootCmd.GenBashCompletionV2(stdout, true)
+	case "zsh":
+		return RootCmd.GenZshCompletion(stdout)
+	case "fish":
+		return RootCmd.GenFishCompletion(stdout, true)
+	}
+	return fmt.Errorf("unsupported shell %q", args[0])
+}
+
+var registerCompletionsOnce sync.Once
+
+// registerCompletions registers the dynamic completion functions on all
+// commands. It runs before executing any command (including cobra’s hidden
+// __complete command), at which point all sub commands have been added.
+func registerCompletions() {
+	registerCompletionsOnce.Do(func() {
+		walkCommands(RootCmd, func(cmd *cobra.Command) {
+			if cmd.Flags().Lookup("instance") != nil {
+				cmd.RegisterFlagCompletionFunc("instance", completeInstances)
+			}
+			if cmd.Flags().Lookup("parent_dir") != nil {
+				cmd.RegisterFlagCompletionFunc("parent_dir", completeDirectories)
+			}
+		})
+		getCmd.ValidArgsFunction = completePackages
+		logsCmd.RegisterFlagCompletionFunc("service", completeServices)
+		logsCmd.RegisterFlagCompletionFunc("services", completeServices)
+		restartCmd.ValidArgsFunction = completeServices
+		stopCmd.ValidArgsFunction = completeServices
+	})
+}
+
+func walkCommands(cmd *cobra.Command, fn func(*cobra.Command)) {
+	fn(cmd)
+	for _, sub := range cmd.Commands() {
+		walkCommands(sub, fn)
+	}
+}
+
+func completeDirectories(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return nil, cobra.ShellCompDirectiveFilterDirs
+}
+
+// instanceNames returns the names of all instances in parentDir, i.e. all
+// sub directories containing a config.json file.
+func instanceNames(parentDir string) ([]string, error) {
+	entries, err := os.ReadDir(parentDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(parentDir, e.Name(), "config.json")); err != nil {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+func completeInstances(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	names, err := instanceNames(instanceflag.ParentDir())
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// packageNames returns the import paths (without version suffix) of all
+// packages in cfg.Packages.
+func packageNames(cfg *config.Struct) []string {
+	names := make([]string, 0, len(cfg.Packages))
+	for _, pkg := range cfg.Packages {
+		if idx := strings.IndexByte(pkg, '@'); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		names = append(names, pkg)
+	}
+	return names
+}
+
+func completePackages(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	names := append(packageNames(cfg), "gokrazy")
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// serviceName is the inverse of servicePath: it turns a service path of the
+// gokrazy web interface like /user/scanui back into a service name.
+func serviceName(path string) string {
+	if name, ok := strings.CutPrefix(path, "/user/"); ok {
+		return name
+	}
+	return path
+}
+
+// completionTimeout bounds how long completion waits for the gokrazy
+// instance, as the user is waiting for their shell to respond.
+const completionTimeout = 2 * time.Second
+
+func completeServices(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	sc, err := newServiceClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	ctx, canc := context.WithTimeout(context.Background(), completionTimeout)
+	defer canc()
+	var names []string
+	if services, err := sc.services(ctx); err == nil {
+		for _, svc := range services {
+			names = append(names, serviceName(svc.Path))
+		}
+	} else {
+		// The instance is not reachable: fall back to the packages of the
+		// instance config.
+		ext, err := extconfig.For(sc.cfg)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		names = serviceNames(sc.cfg, ext.Basenames())
+	}
+	sort.Strings(names)
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,70 @@
+package gok
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lineDiff returns a diff of the lines of a and b, in which removed lines are
+// prefixed with "-", added lines with "+" and unchanged lines with " ".
+// Unchanged lines further than context lines away from a change are omitted.
+func lineDiff(a, b string, context int) string {
+	al := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bl := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	// lcs[i][j] is the length of the longest common subsequence of al[i:] and
+	// bl[j:].
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var lines []string
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			lines = append(lines, " "+al[i])
+			i++
+			j++
+		case j < len(bl) && (i == len(al) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, "+"+bl[j])
+			j++
+		default:
+			lines = append(lines, "-"+al[i])
+			i++
+		}
+	}
+
+	// Only keep unchanged lines close to changes.
+	keep := make([]bool, len(lines))
+	for idx, line := range lines {
+		if line[0] == ' ' {
+			continue
+		}
+		for k := max(0, idx-context); k <= min(len(lines)-1, idx+context); k++ {
+			keep[k] = true
+		}
+	}
+	var out strings.Builder
+	skipped := false
+	for idx, line := range lines {
+		if !keep[idx] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			fmt.Fprintf(&out, "@@\n")
+			skipped = false
+		}
+		fmt.Fprintf(&out, "%s\n", line)
+	}
+	return out.String()
+}
@@ -0,0 +1,141 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// doctorCmd is gok doctor.
+var doctorCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "doctor",
+	Short:   "Check a gokrazy instance configuration for problems",
+	Long: `gok doctor checks the configuration of a gokrazy instance for problems which
+do not necessarily break the build, but indicate mistakes:
+
+  config       config.json contains unknown fields or values of the wrong type
+  devices      devices.json (device profiles for boards which are not built
+               into gokrazy) is invalid, or DeviceType refers to an unknown
+               device type
+  orphans      per-package configuration which does not take effect, i.e.
+               legacy files (e.g. flags/<pkg>/flags.txt) or PackageConfig
+               entries for packages which are not part of the build (e.g.
+               after renaming a package), or legacy files which are ignored
+               because config.json contains PackageConfig (see gok migrate)
+
+gok doctor exits with a non-zero exit code if any check finds problems. Use
+gok update --strict or gok overwrite --strict to fail builds on orphans.
+
+Examples:
+  % gok -i scanner doctor
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 0 {
+			fmt.Fprint(os.Stderr, `positional arguments are not supported
+
+`)
+			return cmd.Usage()
+		}
+		return doctorImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type doctorImplConfig struct{}
+
+var doctorImpl doctorImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(doctorCmd.Flags())
+}
+
+// doctorCheck is a check of gok doctor. run is called in the instance
+// directory and returns the problems it found.
+type doctorCheck struct {
+	name string
+	run  func(cfg *config.Struct, ext *extconfig.Struct) ([]string, error)
+}
+
+var doctorChecks = []doctorCheck{
+	{
+		name: "config",
+		run: func(cfg *config.Struct, ext *extconfig.Struct) ([]string, error) {
+			b, err := os.ReadFile(config.InstanceConfigPath())
+			if err != nil {
+				return nil, err
+			}
+			if err := extconfig.Validate(b); err != nil {
+				return strings.Split(err.Error(), "\n"), nil
+			}
+			return nil, nil
+		},
+	},
+	{
+		name: "devices",
+		run: func(cfg *config.Struct, ext *extconfig.Struct) ([]string, error) {
+			if _, err := packer.ReadDeviceProfiles("."); err != nil {
+				return []string{err.Error()}, nil
+			}
+			if err := packer.CheckDeviceType(".", cfg.DeviceType); err != nil {
+				return []string{"DeviceType: " + err.Error()}, nil
+			}
+			return nil, nil
+		},
+	},
+	{
+		name: "orphans",
+		run: func(cfg *config.Struct, ext *extconfig.Struct) ([]string, error) {
+			orphans, err := packer.FindOrphans(cfg, ext)
+			if err != nil {
+				return nil, err
+			}
+			problems := make([]string, len(orphans))
+			for idx, o := range orphans {
+				problems[idx] = o.String()
+			}
+			return problems, nil
+		},
+	},
+}
+
+func (r *doctorImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+	var failed int
+	for _, check := range doctorChecks {
+		problems, err := check.run(cfg, ext)
+		if err != nil {
+			return fmt.Errorf("check %s: %v", check.name, err)
+		}
+		if len(problems) == 0 {
+			fmt.Fprintf(stdout, "ok    %s\n", check.name)
+			continue
+		}
+		failed++
+		fmt.Fprintf(stdout, "FAIL  %s\n", check.name)
+		for _, p := range problems {
+			fmt.Fprintf(stdout, "      %s\n", p)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks found problems in instance %s", failed, len(doctorChecks), cfg.Hostname)
+	}
+	return nil
+}
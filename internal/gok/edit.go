@@ -1,14 +1,19 @@
 package gok
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"syscall"
+	"strings"
 
 	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/renameio"
 	"github.com/spf13/cobra"
 )
 
@@ -18,6 +23,16 @@ var editCmd = &cobra.Command{
 	Use:     "edit",
 	Short:   "Edit a gokrazy instance configuration interactively",
 	Long: `Edit a gokrazy instance configuration interactively.
+
+gok edit opens a copy of config.json in your editor ($VISUAL or $EDITOR,
+falling back to editor, nano or vi), next to a JSON Schema of all config
+fields (config.schema.json, referenced via "$schema"), so that editors with
+JSON language support offer completion.
+
+After you save and close the editor, the config is validated. If it is invalid
+(e.g. a misspelled field name), the editor is opened again, with the errors
+shown as comments at the top. config.json is only replaced with a valid
+config. Empty the file to abort.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if cmd.Flags().NArg() > 0 {
@@ -37,6 +52,70 @@ var editImpl editImplConfig
 
 func init() {
 	instanceflag.RegisterPflags(editCmd.Flags())
+	registerNoCommitFlag(editCmd.Flags())
+}
+
+// schemaLine is inserted into the config.json copy which gok edit opens, so
+// that editors find the JSON Schema.
+const schemaLine = `
+    "$schema": "./config.schema.json"`
+
+// withSchema inserts schemaLine as first member of the config b.
+func withSchema(b []byte) []byte {
+	idx := bytes.IndexByte(b, '{')
+	if idx == -1 {
+		return b
+	}
+	line := schemaLine
+	if rest := bytes.TrimSpace(b[idx+1:]); !bytes.HasPrefix(rest, []byte("}")) {
+		line += ","
+	}
+	return append(append(append([]byte{}, b[:idx+1]...), line...), b[idx+1:]...)
+}
+
+// withoutSchema removes the schemaLine inserted by withSchema and the comments
+// inserted by withErrors from b.
+func withoutSchema(b []byte) []byte {
+	for bytes.HasPrefix(b, []byte("//")) {
+		if idx := bytes.IndexByte(b, '\n'); idx > -1 {
+			b = b[idx+1:]
+		} else {
+			b = nil
+		}
+	}
+	for _, line := range []string{schemaLine + ",", schemaLine} {
+		if idx := bytes.Index(b, []byte(line)); idx > -1 {
+			return append(append([]byte{}, b[:idx]...), b[idx+len(line):]...)
+		}
+	}
+	return b
+}
+
+// withErrors prepends err as comments to the config b.
+func withErrors(b []byte, err error) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("// gok edit: the config is invalid, please fix these errors and save\n")
+	buf.WriteString("// (or empty the file to abort):\n")
+	for _, line := range strings.Split(err.Error(), "\n") {
+		buf.WriteString("//   " + line + "\n")
+	}
+	buf.Write(withSchema(b))
+	return buf.Bytes()
+}
+
+// findEditor returns the editor command to use.
+func findEditor() (string, error) {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if editor := os.Getenv(env); editor != "" {
+			return editor, nil
+		}
+	}
+	for _, editor := range []string{"editor", "nano", "vi"} {
+		if _, err := exec.LookPath(editor); err == nil {
+			return editor, nil
+		}
+	}
+	return "", fmt.Errorf("no editor found: set $EDITOR (e.g. export EDITOR=vim)")
 }
 
 func (r *editImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
@@ -44,13 +123,71 @@ func (r *editImplConfig) run(ctx context.Context, args []string, stdout, stderr
 	instance := instanceflag.Instance()
 
 	configJSON := filepath.Join(parentDir, instance, "config.json")
-	editor := os.Getenv("VISUAL")
-	if editor == "" {
-		editor = os.Getenv("EDITOR")
+	orig, err := os.ReadFile(configJSON)
+	if err != nil {
+		return err
+	}
+	st, err := os.Stat(configJSON)
+	if err != nil {
+		return err
+	}
+	editor, err := findEditor()
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := os.MkdirTemp("", "gok-edit-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	schema, err := json.MarshalIndent(extconfig.JSONSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmpdir, "config.schema.json"), schema, 0644); err != nil {
+		return err
 	}
-	if editor == "" {
-		editor = "vi" // most likely available
+
+	tmpConfig := filepath.Join(tmpdir, "config.json")
+	contents := withSchema(orig)
+	for {
+		if err := os.WriteFile(tmpConfig, contents, 0600); err != nil {
+			return err
+		}
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", editor+` "$1"`, "sh", tmpConfig)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v (config.json not modified)", editor, err)
+		}
+		edited, err := os.ReadFile(tmpConfig)
+		if err != nil {
+			return err
+		}
+		edited = withoutSchema(edited)
+		if len(bytes.TrimSpace(edited)) == 0 {
+			fmt.Fprintf(stderr, "config is empty, not modifying %s\n", configJSON)
+			return nil
+		}
+		if bytes.Equal(edited, orig) {
+			fmt.Fprintf(stderr, "%s not modified\n", configJSON)
+			return nil
+		}
+		if err := extconfig.Validate(edited); err != nil {
+			fmt.Fprintf(stderr, "config is invalid:\n%v\nre-opening editor\n", err)
+			contents = withErrors(edited, err)
+			continue
+		}
+		if err := renameio.WriteFile(configJSON, edited, st.Mode().Perm()); err != nil {
+			return err
+		}
+		fmt.Fprintf(stderr, "%s updated\n", configJSON)
+		msg := fmt.Sprintf("%s: edit config.json", instance)
+		if keys := changedConfigKeys(orig, edited); len(keys) > 0 {
+			msg += " (" + strings.Join(keys, ", ") + ")"
+		}
+		return commitInstanceChanges(ctx, filepath.Join(parentDir, instance), msg)
 	}
-	shellCmd := fmt.Sprintf("%s %q", editor, configJSON)
-	return syscall.Exec("/bin/sh", []string{"/bin/sh", "-c", shellCmd}, os.Environ())
 }
@@ -0,0 +1,294 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/eeprom"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// eepromCmd is gok eeprom.
+var eepromCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "eeprom",
+	Short:   "Inspect Raspberry Pi EEPROM updates",
+	Long: `On Raspberry Pi 4 and newer, gok update installs the EEPROM (bootloader)
+files of the EEPROMPackage, and the device flashes them on the next boot,
+unless it reports that it already runs them.
+
+To avoid unexpected EEPROM updates (e.g. on a fleet of devices), pin the EEPROM
+version by setting the PieepromSHA256 and VL805SHA256 fields of the EEPROM
+config field to the sums printed by gok eeprom status, or disable EEPROM
+updates entirely by setting its Skip field:
+
+  "EEPROM": {"Skip": true}
+
+To change the bootloader configuration (bootconf.txt, e.g. the BOOT_ORDER),
+use gok eeprom config set, which stores the changed lines in the
+BootloaderExtraEEPROM config field.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var eepromStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Compare the EEPROM package with the EEPROM version of the device",
+	Long: `gok eeprom status compares the EEPROM files of the configured EEPROM package
+with the EEPROM version which the running device reports, and prints whether
+the next gok update makes the device flash its EEPROM. The device is not
+modified.
+
+Examples:
+  % gok -i scanner eeprom status
+`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return eepromStatusImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type eepromStatusConfig struct{}
+
+var eepromStatusImpl eepromStatusConfig
+
+var eepromConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Show or modify the EEPROM bootloader configuration (bootconf.txt)",
+	Long: `The EEPROM bootloader configuration (bootconf.txt) is part of the pieeprom
+file of the EEPROMPackage. gok update applies the KEY=VALUE lines of the
+BootloaderExtraEEPROM config field to it before installing the EEPROM update.
+
+gok eeprom config get prints the resulting bootconf.txt (or the values of the
+specified keys), gok eeprom config set modifies the BootloaderExtraEEPROM
+config field and prints the resulting changes to bootconf.txt.
+
+Use --from to read bootconf.txt from an EEPROM image file (e.g. a dump made with
+rpi-eeprom-config or downloaded from the rpi-eeprom repository) instead of the
+EEPROMPackage.
+
+See https://www.raspberrypi.com/documentation/computers/raspberry-pi.html#raspberry-pi-bootloader-configuration
+for the available settings.
+
+Examples:
+  % gok -i scanner eeprom config get
+  % gok -i scanner eeprom config get BOOT_ORDER
+  % gok -i scanner eeprom config set BOOT_ORDER=0xf41 POWER_OFF_ON_HALT=1
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var eepromConfigGetCmd = &cobra.Command{
+	Use:   "get [KEY...]",
+	Short: "Print the EEPROM bootloader configuration (bootconf.txt)",
+	Long:  eepromConfigCmd.Long,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return eepromConfigImpl.get(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+var eepromConfigSetCmd = &cobra.Command{
+	Use:   "set KEY=VALUE...",
+	Short: "Modify the EEPROM bootloader configuration (bootconf.txt)",
+	Long:  eepromConfigCmd.Long,
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return eepromConfigImpl.set(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type eepromConfigConfig struct {
+	from string
+}
+
+var eepromConfigImpl eepromConfigConfig
+
+func init() {
+	instanceflag.RegisterPflags(eepromStatusCmd.Flags())
+	eepromCmd.AddCommand(eepromStatusCmd)
+
+	for _, cmd := range []*cobra.Command{eepromConfigGetCmd, eepromConfigSetCmd} {
+		instanceflag.RegisterPflags(cmd.Flags())
+		cmd.Flags().StringVarP(&eepromConfigImpl.from, "from", "", "", "read bootconf.txt from this EEPROM image file (pieeprom-*.bin) instead of the EEPROMPackage")
+		eepromConfigCmd.AddCommand(cmd)
+	}
+	registerNoCommitFlag(eepromConfigSetCmd.Flags())
+	eepromCmd.AddCommand(eepromConfigCmd)
+}
+
+// orUnknown returns sum, or a placeholder if the device did not report it.
+func orUnknown(sum string) string {
+	if sum == "" {
+		return "(not reported)"
+	}
+	return sum
+}
+
+func (r *eepromStatusConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	pack, err := newUpdatePack()
+	if err != nil {
+		return err
+	}
+	status, err := pack.EEPROMStatus(ctx)
+	if err != nil {
+		return err
+	}
+	files := status.Files
+	fmt.Fprintf(stdout, "EEPROM package: %s\n\n", status.Package)
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "FILE\tPACKAGE SHA256\tDEVICE SHA256\n")
+	fmt.Fprintf(tw, "%s\t%s\t%s\n", filepath.Base(files.Pieeprom), files.ImageSHA256, orUnknown(status.Device.PieepromSHA256))
+	fmt.Fprintf(tw, "%s\t%s\t%s\n", filepath.Base(files.VL805), files.VL805SHA256, orUnknown(status.Device.VL805SHA256))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout)
+	if files.ImageSHA256 != files.PieepromSHA256 {
+		fmt.Fprintf(stdout, "%s with BootloaderExtraEEPROM applied, unmodified: %s\n", filepath.Base(files.Pieeprom), files.PieepromSHA256)
+	}
+	if status.Pinned {
+		fmt.Fprintf(stdout, "The EEPROM version is pinned via the EEPROM config field.\n")
+	}
+	switch {
+	case status.Skip:
+		fmt.Fprintf(stdout, "gok update does not install EEPROM updates (EEPROM.Skip is set).\n")
+	case !status.Flash():
+		fmt.Fprintf(stdout, "The device runs this EEPROM version: gok update does not flash the EEPROM.\n")
+	case status.Device.PieepromSHA256 == "" && status.Device.VL805SHA256 == "":
+		fmt.Fprintf(stdout, "The device does not report its EEPROM version (no EEPROM, e.g. Raspberry Pi 3, or an older gokrazy version):\n"+
+			"gok update installs recovery.bin, which flashes the EEPROM files above on the next boot of a Raspberry Pi 4 or newer.\n")
+	default:
+		fmt.Fprintf(stdout, "The device runs a different EEPROM version: gok update installs recovery.bin,\n"+
+			"which flashes the EEPROM files above on the next boot.\n")
+	}
+	return nil
+}
+
+// image returns the unmodified EEPROM image (from --from or the EEPROMPackage)
+// and the BootloaderExtraEEPROM lines of the instance.
+func (r *eepromConfigConfig) image() ([]byte, []string, error) {
+	pack, err := newUpdatePack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.from != "" {
+		ext, err := extconfig.For(pack.FileCfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		image, err := os.ReadFile(r.from)
+		if err != nil {
+			return nil, nil, err
+		}
+		return image, ext.BootloaderExtraEEPROM, nil
+	}
+	files, err := pack.EEPROMFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	image, err := os.ReadFile(files.Pieeprom)
+	if err != nil {
+		return nil, nil, err
+	}
+	return image, pack.Ext.BootloaderExtraEEPROM, nil
+}
+
+// effectiveBootconf returns the bootconf.txt of image with lines applied.
+func effectiveBootconf(image []byte, lines []string) ([]byte, error) {
+	if len(lines) == 0 {
+		return eeprom.Bootconf(image)
+	}
+	modified, err := eeprom.Assemble(image, lines)
+	if err != nil {
+		return nil, err
+	}
+	return eeprom.Bootconf(modified)
+}
+
+func (r *eepromConfigConfig) get(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	image, lines, err := r.image()
+	if err != nil {
+		return err
+	}
+	bootconf, err := effectiveBootconf(image, lines)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		_, err := stdout.Write(bootconf)
+		return err
+	}
+	for _, key := range args {
+		value, ok := eeprom.Get(bootconf, key)
+		if !ok {
+			return fmt.Errorf("%s is not set in %s", key, eeprom.BootconfName)
+		}
+		fmt.Fprintf(stdout, "%s=%s\n", key, value)
+	}
+	return nil
+}
+
+func (r *eepromConfigConfig) set(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if err := eeprom.CheckLines(args); err != nil {
+		return err
+	}
+	image, lines, err := r.image()
+	if err != nil {
+		return err
+	}
+	updated := slices.Clone(lines)
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		updated = eeprom.Set(updated, key, value)
+	}
+	if slices.Equal(lines, updated) {
+		fmt.Fprintf(stdout, "BootloaderExtraEEPROM already contains %s\n", strings.Join(args, " "))
+		return nil
+	}
+	before, err := effectiveBootconf(image, lines)
+	if err != nil {
+		return err
+	}
+	after, err := effectiveBootconf(image, updated)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s changes:\n%s", eeprom.BootconfName, lineDiff(string(before), string(after), 3))
+
+	// Modify the config as stored in config.json, without the defaults and
+	// overrides which newUpdatePack applies.
+	fileCfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	ext, err := extconfig.For(fileCfg)
+	if err != nil {
+		return err
+	}
+	ext.BootloaderExtraEEPROM = updated
+	b, err := extconfig.FormatForFile(fileCfg, ext)
+	if err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(config.InstanceConfigPath(), b, 0600, renameio.WithExistingPermissions()); err != nil {
+		return fmt.Errorf("updating config.json: %v", err)
+	}
+	log.Printf("Set BootloaderExtraEEPROM of instance %s, the next gok update installs the modified EEPROM configuration", instanceflag.Instance())
+	msg := fmt.Sprintf("%s: gok eeprom config set %s", instanceflag.Instance(), strings.Join(args, " "))
+	return commitInstanceChanges(ctx, config.InstancePath(), msg)
+}
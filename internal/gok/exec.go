@@ -0,0 +1,166 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/spf13/cobra"
+)
+
+const (
+	breakglassPkg = "github.com/gokrazy/breakglass"
+
+	// breakglassAuthorizedKeys is the path of the authorized_keys file in the
+	// root file system, as set up by gok new.
+	breakglassAuthorizedKeys = "/etc/breakglass.authorized_keys"
+)
+
+// execCmd is gok exec.
+var execCmd = &cobra.Command{
+	GroupID:               "runtime",
+	Use:                   "exec [flags] -- command [args...]",
+	DisableFlagsInUseLine: true,
+	Short:                 "Run a command on a running gokrazy instance (via breakglass)",
+	Long: `gok exec runs a command on a running gokrazy instance using breakglass
+(https://github.com/gokrazy/breakglass) and streams its output.
+
+The SSH port and keys are taken from the breakglass package config of your
+gokrazy instance, so you do not need to specify host names, ports or keys.
+
+Examples:
+  % gok -i scanner exec -- ls -l /perm
+
+  # Without a command, an interactive shell is started:
+  % gok -i scanner exec
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return execImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type execImplConfig struct {
+	dryRun bool
+}
+
+var execImpl execImplConfig
+
+func init() {
+	execCmd.Flags().BoolVarP(&execImpl.dryRun, "dryrun", "", false, "print the ssh command instead of running it")
+	instanceflag.RegisterPflags(execCmd.Flags())
+}
+
+// breakglassPort returns the SSH port breakglass listens on, as configured
+// via its command line flags.
+func breakglassPort(pc config.PackageConfig) string {
+	for _, flag := range pc.CommandLineFlags {
+		flag = strings.TrimPrefix(flag, "-")
+		flag = strings.TrimPrefix(flag, "-")
+		if port, ok := strings.CutPrefix(flag, "ssh_port="); ok {
+			return port
+		}
+	}
+	return "22"
+}
+
+// breakglassInstalled returns whether cfg includes the breakglass package.
+func breakglassInstalled(cfg *config.Struct) bool {
+	for _, pkg := range cfg.Packages {
+		if pkg == breakglassPkg || strings.HasPrefix(pkg, breakglassPkg+"@") {
+			return true
+		}
+	}
+	return false
+}
+
+// breakglassAuthorizedKeysPath returns the path of the file which is
+// included as breakglass authorized_keys file.
+func breakglassAuthorizedKeysPath(pc config.PackageConfig) (string, bool) {
+	authorizedPath, ok := pc.ExtraFilePaths[breakglassAuthorizedKeys]
+	if !ok {
+		return "", false
+	}
+	if !filepath.IsAbs(authorizedPath) {
+		authorizedPath = filepath.Join(config.InstancePath(), authorizedPath)
+	}
+	return authorizedPath, true
+}
+
+// breakglassIdentities returns the paths of all private keys in ~/.ssh whose
+// public key is contained in the breakglass authorized_keys file.
+func breakglassIdentities(pc config.PackageConfig) []string {
+	authorizedPath, ok := breakglassAuthorizedKeysPath(pc)
+	if !ok {
+		return nil
+	}
+	authorized, err := os.ReadFile(authorizedPath)
+	if err != nil {
+		return nil
+	}
+	matches, err := filepath.Glob(os.Getenv("HOME") + "/.ssh/id_*.pub")
+	if err != nil {
+		return nil
+	}
+	var identities []string
+	for _, match := range matches {
+		b, err := os.ReadFile(match)
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) < 2 || !strings.Contains(string(authorized), fields[1]) {
+			continue
+		}
+		identities = append(identities, strings.TrimSuffix(match, ".pub"))
+	}
+	return identities
+}
+
+func (r *execImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+
+	if !breakglassInstalled(cfg) {
+		return fmt.Errorf("breakglass is not installed on gokrazy instance %q, add it using 'gok -i %s add %s'", instanceflag.Instance(), instanceflag.Instance(), breakglassPkg)
+	}
+
+	pc := cfg.PackageConfig[breakglassPkg]
+	sshArgs := []string{
+		"-p", breakglassPort(pc),
+	}
+	for _, identity := range breakglassIdentities(pc) {
+		sshArgs = append(sshArgs, "-i", identity)
+	}
+	if len(args) == 0 {
+		sshArgs = append(sshArgs, "-t") // interactive shell
+	}
+	sshArgs = append(sshArgs, cfg.Hostname)
+	sshArgs = append(sshArgs, args...)
+
+	ssh := exec.CommandContext(ctx, "ssh", sshArgs...)
+	if r.dryRun {
+		fmt.Fprintln(stdout, strings.Join(ssh.Args, " "))
+		return nil
+	}
+	ssh.Stdin = os.Stdin
+	ssh.Stdout = stdout
+	ssh.Stderr = stderr
+	log.Printf("running %q on gokrazy instance %q via breakglass", args, cfg.Hostname)
+	if err := ssh.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			// Propagate the exit code of the remote command.
+			os.Exit(exitErr.ExitCode())
+		}
+		return fmt.Errorf("%v: %v", ssh.Args, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package gok
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/fleet"
+	"github.com/spf13/cobra"
+)
+
+// fleetCmd is the gok fleet subcommand, which (only) has nested commands like
+// rollout.
+var fleetCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "fleet",
+	Short:   "Deploy to multiple gokrazy instances at once",
+	Long: `Deploy to multiple gokrazy instances (all instances in the parent directory,
+see --parent_dir, or the instances given on the command line), e.g. to update a
+fleet of devices in waves.
+
+The optional fleet inventory (fleet.json in the parent directory) lists the
+devices of the fleet with their instance, address (overriding the
+Update.Hostname config field) and labels:
+
+  {
+      "Devices": [
+          {
+              "Instance": "garage-door",
+              "Address": "10.0.0.23",
+              "Labels": {"site": "garage", "role": "actuator"}
+          },
+          {
+              "Instance": "lab-sensor",
+              "Labels": {"site": "lab", "role": "sensor"}
+          }
+      ]
+  }
+
+gok fleet rollout, gok update and gok scan select devices from the inventory
+with --selector, a comma-separated list of label requirements which must all
+be met: key=value, key!=value, key (label present) or !key (label missing).
+
+Examples:
+  # Update all devices in the lab
+  % gok update --selector=site=lab
+
+  # Roll out to all sensors, one canary first
+  % gok fleet rollout --selector=role=sensor --canary=1
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+// selectorFlagUsage is shared between the commands which support --selector.
+const selectorFlagUsage = "label selector (e.g. site=lab,role!=router) selecting the devices of the fleet inventory (fleet.json in the parent directory) to work with"
+
+// loadInventory loads the fleet inventory of the parent directory. Without
+// an inventory, loadInventory returns an empty inventory.
+func loadInventory() (*fleet.Inventory, error) {
+	inv, err := fleet.Load(instanceflag.ParentDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return &fleet.Inventory{}, nil
+	}
+	return inv, err
+}
+
+// selectDevices returns the devices of the fleet inventory which match
+// selector. It is an error if no device matches.
+func selectDevices(selector string) ([]fleet.Device, error) {
+	sel, err := fleet.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := fleet.Load(instanceflag.ParentDir())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("--selector requires a fleet inventory: %v", err)
+		}
+		return nil, err
+	}
+	devices := inv.Select(sel)
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no devices in %s match selector %q", fleet.InventoryPath(instanceflag.ParentDir()), sel)
+	}
+	return devices, nil
+}
+
+// applyInventoryAddress sets the Update.Hostname field of cfg (of the current
+// instance) to the address of the device in the fleet inventory, if any.
+func applyInventoryAddress(cfg *config.Struct) error {
+	inv, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	d := inv.Device(instanceflag.Instance())
+	if d == nil || d.Address == "" {
+		return nil
+	}
+	if cfg.Update == nil {
+		cfg.Update = &config.UpdateStruct{}
+	}
+	cfg.Update.Hostname = d.Address
+	return nil
+}
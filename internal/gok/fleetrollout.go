@@ -0,0 +1,313 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/fleet"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// fleetRolloutCmd is gok fleet rollout.
+var fleetRolloutCmd = &cobra.Command{
+	Use:   "rollout [flags] [instance...]",
+	Short: "Update multiple gokrazy instances in waves, halting on failure",
+	Long: `gok fleet rollout updates the specified instances (or the devices of the fleet
+inventory matching --selector, or all instances in the parent directory) in waves: first --canary instances, then batches of --batch
+instances. Within a wave, instances are updated one after the other, like
+gok update would.
+
+After each wave, gok fleet rollout waits for --bake_time and then verifies
+that every device of the wave is healthy:
+
+  • the device responds to status requests and runs the SBOM hash which
+    gok built for it (devices running old gokrazy versions which do not report
+    their SBOM hash are only checked for responding), and
+  • if --health_url is set, the URL (in which {hostname} is replaced by the
+    hostname of the instance) responds with a 2xx HTTP status code.
+
+If updating a device or verifying the health of a device fails, the rollout
+halts. Unless --rollback=false is specified, the devices of the failed wave are
+rolled back: they are switched back to the root partition of their previous
+build and rebooted. Note that only the root file system is rolled back, not the
+boot file system (kernel, firmware).
+
+Examples:
+  # Update one canary first, then the other instances in batches of 5
+  % gok fleet rollout --canary=1 --batch=5 --bake_time=10m
+
+  # Update only the devices in the lab (see gok fleet --help)
+  % gok fleet rollout --selector=site=lab
+
+  # Only print which instances would be updated in which wave
+  % gok fleet rollout --dry_run scanner router7 hue
+
+  # Also check an HTTP endpoint of a program running on each device
+  % gok fleet rollout --health_url=http://{hostname}:8080/healthz
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fleetRolloutImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type fleetRolloutConfig struct {
+	canary        int
+	batch         int
+	bakeTime      time.Duration
+	healthURL     string
+	rollback      bool
+	dryRun        bool
+	rebootTimeout time.Duration
+	pollInterval  time.Duration
+	selector      string
+}
+
+var fleetRolloutImpl fleetRolloutConfig
+
+func init() {
+	fleetCmd.AddCommand(fleetRolloutCmd)
+	instanceflag.RegisterPflags(fleetRolloutCmd.Flags())
+	registerTelemetryFlags(fleetRolloutCmd.Flags())
+	fleetRolloutCmd.Flags().IntVarP(&fleetRolloutImpl.canary, "canary", "", 1, "number of instances to update in the first wave")
+	fleetRolloutCmd.Flags().IntVarP(&fleetRolloutImpl.batch, "batch", "", 5, "number of instances to update in each following wave")
+	fleetRolloutCmd.Flags().DurationVarP(&fleetRolloutImpl.bakeTime, "bake_time", "", 0, "how long to wait after updating a wave before verifying the health of its devices")
+	fleetRolloutCmd.Flags().StringVarP(&fleetRolloutImpl.healthURL, "health_url", "", "", "if non-empty, an URL which must respond with a 2xx HTTP status code for a device to be healthy. {hostname} is replaced with the hostname of the instance")
+	fleetRolloutCmd.Flags().BoolVarP(&fleetRolloutImpl.rollback, "rollback", "", true, "roll back the devices of a wave which failed to update or is unhealthy")
+	fleetRolloutCmd.Flags().BoolVarP(&fleetRolloutImpl.dryRun, "dry_run", "", false, "print the waves, but do not update any instances")
+	fleetRolloutCmd.Flags().DurationVarP(&fleetRolloutImpl.rebootTimeout, "reboot_timeout", "", 0, "how long to wait for a device to become reachable with the new version after rebooting. Overrides the RebootTimeout config field (default 5m)")
+	fleetRolloutCmd.Flags().StringVarP(&fleetRolloutImpl.selector, "selector", "", "", selectorFlagUsage)
+	fleetRolloutCmd.Flags().DurationVarP(&fleetRolloutImpl.pollInterval, "poll_interval", "", 0, "how long to wait between checking whether a device runs the new version. Overrides the PollInterval config field (default 1s)")
+}
+
+// rolloutWaves splits instances into a wave of canary instances, followed by
+// waves of (at most) batch instances.
+func rolloutWaves(instances []string, canary, batch int) [][]string {
+	var waves [][]string
+	if canary > 0 {
+		n := min(canary, len(instances))
+		waves = append(waves, instances[:n])
+		instances = instances[n:]
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	for len(instances) > 0 {
+		n := min(batch, len(instances))
+		waves = append(waves, instances[:n])
+		instances = instances[n:]
+	}
+	return waves
+}
+
+// rolloutDevice is the state of an instance during gok fleet rollout.
+type rolloutDevice struct {
+	instance string
+	hostname string
+	old      *packer.DeviceStatus // before the update, for rolling back
+	sbomHash string               // of the build deployed by the rollout
+	result   string
+}
+
+// fleetInstances returns the instances specified on the command line, the
+// instances of the inventory devices matching selector, or all instances in
+// the parent directory.
+func fleetInstances(args []string, selector string) ([]string, error) {
+	if selector != "" {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("--selector cannot be combined with instance arguments")
+		}
+		devices, err := selectDevices(selector)
+		if err != nil {
+			return nil, err
+		}
+		return fleet.Instances(devices), nil
+	}
+	if len(args) > 0 {
+		return args, nil
+	}
+	instances, err := instanceNames(instanceflag.ParentDir())
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instances found in %s", instanceflag.ParentDir())
+	}
+	return instances, nil
+}
+
+func (r *fleetRolloutConfig) newPack(instance string) (*packer.Pack, error) {
+	instanceflag.SetInstance(instance)
+	pack, err := newUpdatePack()
+	if err != nil {
+		return nil, err
+	}
+	pack.RebootTimeout = r.rebootTimeout
+	pack.PollInterval = r.pollInterval
+	pack.Notify = globalCfg.Notify
+	return pack, nil
+}
+
+// update updates the device of d, recording its previous status first.
+func (r *fleetRolloutConfig) update(ctx context.Context, d *rolloutDevice, stdout io.Writer) error {
+	pack, err := r.newPack(d.instance)
+	if err != nil {
+		return err
+	}
+	d.hostname = pack.Cfg.Hostname
+	d.old, err = pack.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("device not reachable before updating: %v", err)
+	}
+	if err := runPack(ctx, pack, stdout); err != nil {
+		return err
+	}
+	d.sbomHash = pack.SBOMHash()
+	return nil
+}
+
+// checkHealth returns nil if the device of d is healthy (see gok fleet
+// rollout --help).
+func (r *fleetRolloutConfig) checkHealth(ctx context.Context, d *rolloutDevice) error {
+	pack, err := r.newPack(d.instance)
+	if err != nil {
+		return err
+	}
+	if err := pack.CheckHealth(ctx, d.sbomHash); err != nil {
+		return err
+	}
+	if r.healthURL == "" {
+		return nil
+	}
+	return checkHealthURL(ctx, strings.ReplaceAll(r.healthURL, "{hostname}", d.hostname))
+}
+
+// checkHealthURL returns nil if a GET request to u responds with a 2xx HTTP
+// status code within 10 seconds.
+func checkHealthURL(ctx context.Context, u string) error {
+	ctx, canc := context.WithTimeout(ctx, 10*time.Second)
+	defer canc()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: unexpected HTTP status: %v", u, resp.Status)
+	}
+	return nil
+}
+
+// rollBack rolls back the device of d to its previous build and returns the
+// result for the rollout summary.
+func (r *fleetRolloutConfig) rollBack(ctx context.Context, d *rolloutDevice) string {
+	pack, err := r.newPack(d.instance)
+	if err != nil {
+		return fmt.Sprintf("rollback failed: %v", err)
+	}
+	// When the update failed, the other root partition might only be
+	// partially written, so only switch to it if the device runs the new
+	// build.
+	if status, err := pack.Status(ctx); err == nil && status.BuildTimestamp == d.old.BuildTimestamp {
+		return "not rolled back: device still runs the previous build"
+	}
+	if err := pack.Rollback(ctx, d.old); err != nil {
+		return fmt.Sprintf("rollback failed: %v", err)
+	}
+	return "rolled back"
+}
+
+func (r *fleetRolloutConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	instances, err := fleetInstances(args, r.selector)
+	if err != nil {
+		return err
+	}
+	waves := rolloutWaves(instances, r.canary, r.batch)
+	if r.dryRun {
+		for idx, wave := range waves {
+			fmt.Fprintf(stdout, "wave %d: %s\n", idx+1, strings.Join(wave, " "))
+		}
+		return nil
+	}
+
+	ctx, stop := interruptContext(ctx)
+	defer stop()
+
+	var devices []*rolloutDevice
+	defer func() {
+		tw := tabwriter.NewWriter(stdout, 0, 0, 1, ' ', 0)
+		for _, d := range devices {
+			fmt.Fprintf(tw, "%s\t%s\n", d.instance, d.result)
+		}
+		tw.Flush()
+	}()
+	for idx, wave := range waves {
+		fmt.Fprintf(stdout, "Rollout wave %d/%d: %s\n", idx+1, len(waves), strings.Join(wave, " "))
+		var (
+			updated []*rolloutDevice
+			failed  error
+		)
+		for _, instance := range wave {
+			d := &rolloutDevice{instance: instance}
+			devices = append(devices, d)
+			if err := r.update(ctx, d, stdout); err != nil {
+				d.result = fmt.Sprintf("update failed: %v", err)
+				if d.old != nil {
+					updated = append(updated, d) // possibly partially updated
+				}
+				failed = fmt.Errorf("%s: %v", instance, err)
+				break
+			}
+			d.result = "updated"
+			updated = append(updated, d)
+		}
+
+		if failed == nil {
+			if r.bakeTime > 0 {
+				fmt.Fprintf(stdout, "Baking wave %d for %v\n", idx+1, r.bakeTime)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(r.bakeTime):
+				}
+			}
+			for _, d := range updated {
+				if err := r.checkHealth(ctx, d); err != nil {
+					d.result = fmt.Sprintf("unhealthy: %v", err)
+					failed = fmt.Errorf("%s: unhealthy: %v", d.instance, err)
+					continue
+				}
+				d.result = "healthy"
+			}
+		}
+
+		if failed == nil {
+			continue
+		}
+		if r.rollback {
+			for _, d := range updated {
+				d.result += ", " + r.rollBack(ctx, d)
+			}
+		}
+		for _, wave := range waves[idx+1:] {
+			for _, instance := range wave {
+				devices = append(devices, &rolloutDevice{
+					instance: instance,
+					result:   "not updated (rollout halted)",
+				})
+			}
+		}
+		return fmt.Errorf("rollout halted in wave %d: %v", idx+1, failed)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package gok
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gokrazy/tools/internal/fleet"
+	"github.com/gokrazy/tools/internal/mdns"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRolloutWaves(t *testing.T) {
+	instances := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for _, tt := range []struct {
+		name          string
+		canary, batch int
+		want          [][]string
+	}{
+		{
+			name:   "canary",
+			canary: 1,
+			batch:  3,
+			want:   [][]string{{"a"}, {"b", "c", "d"}, {"e", "f", "g"}},
+		},
+		{
+			name:  "no canary",
+			batch: 5,
+			want:  [][]string{{"a", "b", "c", "d", "e"}, {"f", "g"}},
+		},
+		{
+			name:   "canary covers all",
+			canary: 10,
+			batch:  5,
+			want:   [][]string{instances},
+		},
+		{
+			name:  "one by one",
+			batch: 0,
+			want:  [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}, {"f"}, {"g"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rolloutWaves(instances, tt.canary, tt.batch)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("rolloutWaves: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckHealthURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	if err := checkHealthURL(ctx, srv.URL+"/healthz"); err != nil {
+		t.Errorf("checkHealthURL(/healthz) = %v, want nil", err)
+	}
+	if err := checkHealthURL(ctx, srv.URL+"/broken"); err == nil {
+		t.Errorf("checkHealthURL(/broken) = nil, want error")
+	}
+}
+
+func TestInventoryDevice(t *testing.T) {
+	devices := []fleet.Device{
+		{Instance: "scanner"},
+		{Instance: "garage-door", Address: "10.0.0.23"},
+		{Instance: "hue", Address: "hue-bridge"},
+	}
+	for _, tt := range []struct {
+		svc  mdns.Service
+		want string
+	}{
+		{mdns.Service{Host: "scanner.local."}, "scanner"},
+		{mdns.Service{Host: "gokrazy.local.", Addrs: []net.IP{net.ParseIP("10.0.0.23")}}, "garage-door"},
+		{mdns.Service{Host: "hue-bridge.local."}, "hue"},
+		{mdns.Service{Host: "other.local.", Addrs: []net.IP{net.ParseIP("10.0.0.99")}}, ""},
+	} {
+		var got string
+		if d := inventoryDevice(devices, &tt.svc); d != nil {
+			got = d.Instance
+		}
+		if got != tt.want {
+			t.Errorf("inventoryDevice(%s) = %q, want %q", tt.svc.Host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package gok
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// gafCmd is the gok gaf subcommand, which (only) has nested commands like
+// inspect and extract.
+var gafCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "gaf",
+	Short:   "Inspect and extract gaf (gokrazy archive format) files",
+	Long: `Inspect and extract gaf (gokrazy archive format) files.
+
+A gaf file (built using gok overwrite --gaf) is an uncompressed zip archive
+containing the MBR (mbr.img), boot file system (boot.img), root file system
+(root.img) and SBOM (sbom.json) of a gokrazy instance build.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var gafInspectCmd = &cobra.Command{
+	Use:   "inspect <file.gaf>",
+	Short: "List the components of a gaf file with their sizes and hashes",
+	Long: `gok gaf inspect lists the components of a gaf file with their sizes and
+SHA256 hashes, followed by the SBOM hash.
+
+Examples:
+  % gok gaf inspect /tmp/gokrazy.gaf
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return gafInspectImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+var gafExtractCmd = &cobra.Command{
+	Use:   "extract <file.gaf>",
+	Short: "Extract the components of a gaf file",
+	Long: `gok gaf extract extracts the components of a gaf file (mbr.img, boot.img,
+root.img and sbom.json) into a directory.
+
+Examples:
+  # Extract all components into the current directory
+  % gok gaf extract /tmp/gokrazy.gaf
+
+  # Extract only the root file system into /tmp/scanner
+  % gok gaf extract --output_dir=/tmp/scanner --component=root.img /tmp/gokrazy.gaf
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return gafExtractImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type gafInspectConfig struct{}
+
+var gafInspectImpl gafInspectConfig
+
+type gafExtractConfig struct {
+	outputDir  string
+	components []string
+}
+
+var gafExtractImpl gafExtractConfig
+
+func init() {
+	gafCmd.AddCommand(gafInspectCmd)
+	gafCmd.AddCommand(gafExtractCmd)
+	gafExtractCmd.Flags().StringVarP(&gafExtractImpl.outputDir, "output_dir", "", ".", "directory to extract the gaf file components into")
+	gafExtractCmd.Flags().StringSliceVarP(&gafExtractImpl.components, "component", "", nil, "components to extract (e.g. root.img). Defaults to all components")
+}
+
+func (r *gafInspectConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	gaf, err := packer.OpenGaf(args[0])
+	if err != nil {
+		return err
+	}
+	defer gaf.Close()
+
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "COMPONENT\tSIZE\tSHA256\n")
+	for _, f := range gaf.Files() {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%x\n", f.Name, f.UncompressedSize64, h.Sum(nil))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	sbom, err := gaf.SBOM()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "\nSBOM hash: %s\n", sbom.SBOMHash)
+	return nil
+}
+
+func (r *gafExtractConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	gaf, err := packer.OpenGaf(args[0])
+	if err != nil {
+		return err
+	}
+	defer gaf.Close()
+
+	components := r.components
+	if len(components) == 0 {
+		for _, f := range gaf.Files() {
+			components = append(components, f.Name)
+		}
+	}
+	if err := os.MkdirAll(r.outputDir, 0755); err != nil {
+		return err
+	}
+	for _, name := range components {
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("refusing to extract %q: not a local path", name)
+		}
+		f, err := gaf.File(name)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(r.outputDir, name)
+		if err := extractGafFile(f.Open, dest); err != nil {
+			return fmt.Errorf("extracting %s: %v", name, err)
+		}
+		fmt.Fprintf(stdout, "extracted %s (%d bytes)\n", dest, f.UncompressedSize64)
+	}
+	return nil
+}
+
+func extractGafFile(open func() (io.ReadCloser, error), dest string) error {
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := renameio.TempFile("", dest)
+	if err != nil {
+		return err
+	}
+	defer f.Cleanup()
+	if _, err := io.Copy(f, rc); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	return f.CloseAtomicallyReplace()
+}
@@ -7,11 +7,13 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/instanceflag"
 	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/extconfig"
 	"github.com/gokrazy/tools/packer"
 	"github.com/spf13/cobra"
 )
@@ -24,6 +26,19 @@ var getCmd = &cobra.Command{
 	Long: "gok get runs `go get` to update the version of the specified Go programs" + `
 in your gokrazy instance.
 
+Before keeping the changes, gok get lists all modules whose version changes
+(old → new), with links to pkg.go.dev and to the changelog (for modules hosted
+on GitHub), and asks for confirmation. Use --yes to skip the confirmation, e.g.
+in scripts. When declined, the go.mod and go.sum files are restored.
+
+gok get -u skips packages listed in the ExcludeFromUpdateAll config field, and
+keeps the modules listed in PinnedModules at their pinned version, e.g.:
+
+  "PinnedModules": {"github.com/gokrazy/kernel.rpi": "v0.0.0-20240801…"},
+  "ExcludeFromUpdateAll": ["github.com/stapelberg/scan2drive"]
+
+Packages specified on the command line are updated regardless.
+
 Examples:
   # Update all packages on gokrazy instance scanner
   % gok -i scanner get -u
@@ -35,19 +50,22 @@ Examples:
   % gok -i scanner get gokrazy
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return getImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+		return getImpl.run(cmd.Context(), args, cmd.InOrStdin(), cmd.OutOrStdout(), cmd.OutOrStderr())
 	},
 }
 
 type getImplConfig struct {
 	updateAll bool
+	yes       bool
 }
 
 var getImpl getImplConfig
 
 func init() {
 	getCmd.Flags().BoolVarP(&getImpl.updateAll, "update_all", "u", false, "update all installed packages and gokrazy system packages")
+	getCmd.Flags().BoolVarP(&getImpl.yes, "yes", "", false, "apply the module version changes without asking for confirmation")
 	instanceflag.RegisterPflags(getCmd.Flags())
+	registerNoCommitFlag(getCmd.Flags())
 }
 
 func getGokrazySystemPackages(cfg *config.Struct) []string {
@@ -63,7 +81,7 @@ func getGokrazySystemPackages(cfg *config.Struct) []string {
 	return pkgs
 }
 
-func (r *getImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+func (r *getImplConfig) run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
 	cfg, err := config.ReadFromFile()
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -80,12 +98,27 @@ func (r *getImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 
 	updateflag.SetUpdate("yes")
 
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	if err := validatePins(ext); err != nil {
+		return err
+	}
+
 	packages := args
+	var skipped, pinned []string
 	if r.updateAll {
 		if len(packages) > 0 {
 			return fmt.Errorf("use either -u or specify package arguments, not both")
 		}
-		packages = append(getGokrazySystemPackages(cfg), cfg.Packages...)
+		for _, pkg := range append(getGokrazySystemPackages(cfg), cfg.Packages...) {
+			if excludedFromUpdateAll(ext, pkg) {
+				skipped = append(skipped, pkg)
+				continue
+			}
+			packages = append(packages, pkg)
+		}
 	} else {
 		filtered := make([]string, 0, len(packages))
 		for _, pkg := range packages {
@@ -100,6 +133,19 @@ func (r *getImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 		packages = filtered
 	}
 
+	// The go.mod and go.sum files of all modified builddirs, to restore them
+	// if go get fails or the changes are declined.
+	var backups []*goModBackup
+	backedUp := make(map[string]bool)
+	restore := func() error {
+		for _, b := range backups {
+			if err := b.restore(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	changes := make(map[moduleVersions][]string)
 	for idx, pkgAndVersion := range packages {
 		pkg := pkgAndVersion
 		if idx := strings.IndexByte(pkg, '@'); idx > -1 {
@@ -114,23 +160,92 @@ func (r *getImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 			log.Printf("Error: build directory %q does not exist in %q", buildDir, wd)
 			log.Printf("Try 'gok -i %s add %s' followed by an update.", instanceflag.Instance(), pkg)
 			log.Printf("Afterwards, your 'gok get' command should work")
-			return nil
+			return restore()
 		}
 		if err != nil {
+			restore()
 			return err
 		}
 
-		get := exec.CommandContext(ctx, "go", "get", pkgAndVersion)
-		get.Env = packer.Env()
+		backup, err := backupGoMod(buildDir)
+		if err != nil {
+			restore()
+			return err
+		}
+		if !backedUp[buildDir] {
+			backedUp[buildDir] = true
+			backups = append(backups, backup)
+		}
+		prev, err := goModRequirements(backup.goMod)
+		if err != nil {
+			restore()
+			return fmt.Errorf("%s: %v", buildDir, err)
+		}
+
+		getArgs := []string{pkgAndVersion}
+		if r.updateAll {
+			var pkgPinned []string
+			getArgs, pkgPinned = pinnedGetArgs(ext, pkgAndVersion, prev)
+			pinned = append(pinned, pkgPinned...)
+		}
+		get := exec.CommandContext(ctx, "go", append([]string{"get"}, getArgs...)...)
+		get.Env = withGlobalEnv(packer.Env())
 		get.Dir = buildDir
 		get.Stdout = os.Stdout
 		get.Stderr = os.Stderr
 		log.Printf("updating package %d of %d: %s", idx+1, len(packages), get.Args)
 		log.Printf("  in %s", buildDir)
 		if err := get.Run(); err != nil {
+			restore()
 			return fmt.Errorf("%v: %v", get.Args, err)
 		}
+
+		b, err := os.ReadFile(filepath.Join(buildDir, "go.mod"))
+		if err != nil {
+			restore()
+			return err
+		}
+		cur, err := goModRequirements(b)
+		if err != nil {
+			restore()
+			return fmt.Errorf("%s: %v", buildDir, err)
+		}
+		addModuleChanges(changes, pkg, prev, cur)
 	}
 
-	return nil
+	if len(skipped) > 0 {
+		log.Printf("WARNING: not updating %d packages listed in ExcludeFromUpdateAll:", len(skipped))
+		for _, pkg := range skipped {
+			log.Printf("  %s", pkg)
+		}
+	}
+	if pinned = uniqueSorted(pinned); len(pinned) > 0 {
+		log.Printf("WARNING: kept %d modules at their version in PinnedModules:", len(pinned))
+		for _, mod := range pinned {
+			log.Printf("  %s", mod)
+		}
+	}
+
+	if len(changes) == 0 {
+		fmt.Fprintf(stdout, "No module versions changed.\n")
+		return nil
+	}
+	fmt.Fprintf(stdout, "\nModule version changes:\n\n")
+	if err := printModuleChanges(stdout, sortedModuleChanges(changes)); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout)
+	if !r.yes && !confirm(stdin, stdout, fmt.Sprintf("Apply these %d changes?", len(changes))) {
+		if err := restore(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Not applying the changes, restored go.mod and go.sum files.\n")
+		return nil
+	}
+
+	msg := fmt.Sprintf("%s: update %s", instanceflag.Instance(), strings.Join(packages, ", "))
+	if r.updateAll {
+		msg = fmt.Sprintf("%s: update all packages\n\n%s", instanceflag.Instance(), strings.Join(packages, "\n"))
+	}
+	return commitInstanceChanges(ctx, config.InstancePath(), msg)
 }
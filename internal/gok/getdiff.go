@@ -0,0 +1,196 @@
+package gok
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// moduleChange is a module whose required version gok get changes in one or
+// more builddirs.
+type moduleChange struct {
+	Module   string
+	Old, New string // empty if added (Old) or removed (New)
+
+	// Packages are the packages (builddirs) in which the version changes.
+	Packages []string
+}
+
+// moduleVersions identifies a moduleChange, see addModuleChanges.
+type moduleVersions struct {
+	module, old, new string
+}
+
+// goModBackup is the contents of the go.mod and go.sum files of a builddir
+// before running go get.
+type goModBackup struct {
+	dir          string
+	goMod, goSum []byte // goSum is nil if there was no go.sum file
+}
+
+func backupGoMod(dir string) (*goModBackup, error) {
+	goMod, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	goSum, err := os.ReadFile(filepath.Join(dir, "go.sum"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &goModBackup{dir: dir, goMod: goMod, goSum: goSum}, nil
+}
+
+// restore writes back the go.mod and go.sum files.
+func (b *goModBackup) restore() error {
+	if err := os.WriteFile(filepath.Join(b.dir, "go.mod"), b.goMod, 0644); err != nil {
+		return err
+	}
+	if b.goSum == nil {
+		if err := os.Remove(filepath.Join(b.dir, "go.sum")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(filepath.Join(b.dir, "go.sum"), b.goSum, 0644)
+}
+
+// goModRequirements returns the required module versions (by module path)
+// of the go.mod file contents b.
+func goModRequirements(b []byte) (map[string]string, error) {
+	modf, err := modfile.Parse("go.mod", b, nil)
+	if err != nil {
+		return nil, err
+	}
+	reqs := make(map[string]string, len(modf.Require))
+	for _, r := range modf.Require {
+		reqs[r.Mod.Path] = r.Mod.Version
+	}
+	return reqs, nil
+}
+
+// addModuleChanges adds the differences between the requirements prev and cur
+// of the builddir of pkg to changes.
+func addModuleChanges(changes map[moduleVersions][]string, pkg string, prev, cur map[string]string) {
+	add := func(mod, old, new string) {
+		key := moduleVersions{module: mod, old: old, new: new}
+		changes[key] = append(changes[key], pkg)
+	}
+	for mod, v := range cur {
+		if old := prev[mod]; old != v {
+			add(mod, old, v)
+		}
+	}
+	for mod, v := range prev {
+		if _, ok := cur[mod]; !ok {
+			add(mod, v, "")
+		}
+	}
+}
+
+// sortedModuleChanges returns the changes collected by addModuleChanges,
+// sorted by module path.
+func sortedModuleChanges(changes map[moduleVersions][]string) []moduleChange {
+	sorted := make([]moduleChange, 0, len(changes))
+	for key, pkgs := range changes {
+		sort.Strings(pkgs)
+		sorted = append(sorted, moduleChange{
+			Module:   key.module,
+			Old:      key.old,
+			New:      key.new,
+			Packages: pkgs,
+		})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Module != sorted[j].Module {
+			return sorted[i].Module < sorted[j].Module
+		}
+		return sorted[i].Old < sorted[j].Old
+	})
+	return sorted
+}
+
+// versionRev returns the git revision (tag or commit) of the module version v
+// of a module in the repository subdirectory subdir.
+func versionRev(subdir, v string) string {
+	if module.IsPseudoVersion(v) {
+		rev, err := module.PseudoVersionRev(v)
+		if err == nil {
+			return rev
+		}
+	}
+	v = strings.TrimSuffix(v, "+incompatible")
+	if subdir != "" {
+		return subdir + "/" + v
+	}
+	return v
+}
+
+// changelogURL returns a URL which shows the commits between the old and new
+// version of mod, or the empty string if the repository host is not known.
+func changelogURL(mod, old, new string) string {
+	repo := ""
+	switch parts := strings.Split(mod, "/"); {
+	case parts[0] == "github.com" && len(parts) >= 3:
+		repo = strings.Join(parts[:3], "/")
+	case parts[0] == "golang.org" && len(parts) >= 3 && parts[1] == "x":
+		repo = "github.com/golang/" + parts[2]
+	default:
+		return ""
+	}
+	subdir := ""
+	if prefix, _, ok := module.SplitPathVersion(mod); ok {
+		parts := strings.Split(prefix, "/")
+		if len(parts) > 3 {
+			subdir = strings.Join(parts[3:], "/")
+		}
+	}
+	return fmt.Sprintf("https://%s/compare/%s...%s", repo, versionRev(subdir, old), versionRev(subdir, new))
+}
+
+// printModuleChanges prints changes (see sortedModuleChanges) with links to
+// the new version on pkg.go.dev and the changelog, where available.
+func printModuleChanges(w io.Writer, changes []moduleChange) error {
+	// The links are printed below each module, so the columns are aligned
+	// manually instead of using a tabwriter.
+	versions := make([]string, len(changes))
+	var modWidth, versionsWidth int
+	for idx, c := range changes {
+		switch {
+		case c.Old == "":
+			versions[idx] = "+ " + c.New
+		case c.New == "":
+			versions[idx] = "- " + c.Old
+		default:
+			versions[idx] = c.Old + " → " + c.New
+		}
+		modWidth = max(modWidth, len(c.Module))
+		versionsWidth = max(versionsWidth, utf8.RuneCountInString(versions[idx]))
+	}
+	for idx, c := range changes {
+		in := c.Packages[0]
+		if len(c.Packages) > 1 {
+			in = fmt.Sprintf("%d packages", len(c.Packages))
+		}
+		padding := strings.Repeat(" ", versionsWidth-utf8.RuneCountInString(versions[idx]))
+		if _, err := fmt.Fprintf(w, "  %-*s  %s%s  (%s)\n", modWidth, c.Module, versions[idx], padding, in); err != nil {
+			return err
+		}
+		if c.New == "" {
+			continue
+		}
+		fmt.Fprintf(w, "      https://pkg.go.dev/%s@%s\n", c.Module, c.New)
+		if c.Old != "" {
+			if u := changelogURL(c.Module, c.Old, c.New); u != "" {
+				fmt.Fprintf(w, "      %s\n", u)
+			}
+		}
+	}
+	return nil
+}
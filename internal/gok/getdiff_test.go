@@ -0,0 +1,125 @@
+package gok
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChangelogURL(t *testing.T) {
+	for _, tt := range []struct {
+		mod, old, new string
+		want          string
+	}{
+		{
+			mod:  "github.com/gokrazy/rsync",
+			old:  "v0.2.0",
+			new:  "v0.2.1",
+			want: "https://github.com/gokrazy/rsync/compare/v0.2.0...v0.2.1",
+		},
+		{
+			mod:  "github.com/gokrazy/gokrazy",
+			old:  "v0.0.0-20240802144848-676865a4e84f",
+			new:  "v0.0.0-20241008125225-a1b2c3d4e5f6",
+			want: "https://github.com/gokrazy/gokrazy/compare/676865a4e84f...a1b2c3d4e5f6",
+		},
+		{
+			// module in a subdirectory of its repository, with major version
+			mod:  "github.com/example/repo/tools/v2",
+			old:  "v2.0.0",
+			new:  "v2.1.0",
+			want: "https://github.com/example/repo/compare/tools/v2.0.0...tools/v2.1.0",
+		},
+		{
+			mod:  "golang.org/x/sys",
+			old:  "v0.24.0",
+			new:  "v0.25.0",
+			want: "https://github.com/golang/sys/compare/v0.24.0...v0.25.0",
+		},
+		{
+			mod:  "example.com/unknown",
+			old:  "v1.0.0",
+			new:  "v1.1.0",
+			want: "",
+		},
+	} {
+		if got := changelogURL(tt.mod, tt.old, tt.new); got != tt.want {
+			t.Errorf("changelogURL(%q, %q, %q) = %q, want %q", tt.mod, tt.old, tt.new, got, tt.want)
+		}
+	}
+}
+
+func TestModuleChanges(t *testing.T) {
+	changes := make(map[moduleVersions][]string)
+	addModuleChanges(changes, "github.com/gokrazy/hello",
+		map[string]string{"github.com/gokrazy/hello": "v0.1.0", "golang.org/x/sys": "v0.24.0"},
+		map[string]string{"github.com/gokrazy/hello": "v0.1.0", "golang.org/x/sys": "v0.25.0"})
+	addModuleChanges(changes, "github.com/gokrazy/breakglass",
+		map[string]string{"golang.org/x/sys": "v0.24.0", "example.com/old": "v1.0.0"},
+		map[string]string{"golang.org/x/sys": "v0.25.0", "example.com/new": "v1.0.0"})
+	want := []moduleChange{
+		{Module: "example.com/new", New: "v1.0.0", Packages: []string{"github.com/gokrazy/breakglass"}},
+		{Module: "example.com/old", Old: "v1.0.0", Packages: []string{"github.com/gokrazy/breakglass"}},
+		{
+			Module:   "golang.org/x/sys",
+			Old:      "v0.24.0",
+			New:      "v0.25.0",
+			Packages: []string{"github.com/gokrazy/breakglass", "github.com/gokrazy/hello"},
+		},
+	}
+	got := sortedModuleChanges(changes)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("sortedModuleChanges: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	var buf strings.Builder
+	if err := printModuleChanges(&buf, got); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"golang.org/x/sys  v0.24.0 → v0.25.0",
+		"(2 packages)",
+		"https://pkg.go.dev/golang.org/x/sys@v0.25.0",
+		"https://github.com/golang/sys/compare/v0.24.0...v0.25.0",
+		"- v1.0.0",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("printModuleChanges output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestGoModBackup(t *testing.T) {
+	dir := t.TempDir()
+	goMod := filepath.Join(dir, "go.mod")
+	if err := os.WriteFile(goMod, []byte("module gokrazy/build/hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := backupGoMod(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go get modifies go.mod and creates go.sum
+	if err := os.WriteFile(goMod, []byte("module gokrazy/build/hello\n\nrequire example.com/foo v1.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.sum"), []byte("example.com/foo v1.0.0 h1:abc=\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backup.restore(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(goMod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "module gokrazy/build/hello\n"; got != want {
+		t.Errorf("restored go.mod = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "go.sum")); !os.IsNotExist(err) {
+		t.Errorf("go.sum not removed by restore: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package gok
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+	"golang.org/x/mod/semver"
+)
+
+// validatePins checks the PinnedModules config field.
+func validatePins(ext *extconfig.Struct) error {
+	for mod, v := range ext.PinnedModules {
+		if !semver.IsValid(v) {
+			return fmt.Errorf("PinnedModules: %s: invalid version %q (expected e.g. v1.2.3)", mod, v)
+		}
+	}
+	return nil
+}
+
+// withinModule returns whether the package pkg is part of the module (or is
+// the package) mod.
+func withinModule(pkg, mod string) bool {
+	return pkg == mod || strings.HasPrefix(pkg, mod+"/")
+}
+
+// excludedFromUpdateAll returns whether gok get -u skips pkg, according to
+// the ExcludeFromUpdateAll config field.
+func excludedFromUpdateAll(ext *extconfig.Struct, pkg string) bool {
+	for _, excl := range ext.ExcludeFromUpdateAll {
+		if withinModule(pkg, excl) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinnedModule returns the pinned module (the longest PinnedModules entry)
+// which contains pkg, if any.
+func pinnedModule(ext *extconfig.Struct, pkg string) (mod, version string, ok bool) {
+	for m, v := range ext.PinnedModules {
+		if withinModule(pkg, m) && len(m) > len(mod) {
+			mod, version, ok = m, v, true
+		}
+	}
+	return mod, version, ok
+}
+
+// pinnedGetArgs returns the go get arguments for updating pkg in a builddir
+// whose go.mod file requires reqs, honoring the PinnedModules config field:
+// pkg is updated to the pinned version of its module (if pinned), and all
+// other pinned modules which the builddir requires stay at their pinned
+// version. pinned lists the pinned module versions, for the summary.
+func pinnedGetArgs(ext *extconfig.Struct, pkg string, reqs map[string]string) (args, pinned []string) {
+	ownMod, ownVersion, ok := pinnedModule(ext, pkg)
+	if ok {
+		args = append(args, pkg+"@"+ownVersion)
+		pinned = append(pinned, ownMod+"@"+ownVersion)
+	} else {
+		args = append(args, pkg)
+	}
+	var others []string
+	for mod, v := range ext.PinnedModules {
+		if mod == ownMod {
+			continue
+		}
+		if _, ok := reqs[mod]; ok {
+			others = append(others, mod+"@"+v)
+		}
+	}
+	sort.Strings(others)
+	return append(args, others...), append(pinned, others...)
+}
+
+// uniqueSorted sorts s and removes duplicates.
+func uniqueSorted(s []string) []string {
+	sort.Strings(s)
+	return slices.Compact(s)
+}
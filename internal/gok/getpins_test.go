@@ -0,0 +1,69 @@
+package gok
+
+import (
+	"testing"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPinnedGetArgs(t *testing.T) {
+	ext := &extconfig.Struct{
+		PinnedModules: map[string]string{
+			"github.com/gokrazy/kernel.rpi": "v0.0.0-20240801061117-1c8b5e42a6a4",
+			"golang.org/x/sys":              "v0.24.0",
+			"example.com/unused":            "v1.0.0",
+		},
+		ExcludeFromUpdateAll: []string{"github.com/stapelberg/scan2drive"},
+	}
+	if err := validatePins(ext); err != nil {
+		t.Fatal(err)
+	}
+	reqs := map[string]string{
+		"github.com/gokrazy/kernel.rpi": "v0.0.0-20240701000000-aaaaaaaaaaaa",
+		"golang.org/x/sys":              "v0.22.0",
+	}
+
+	for _, tt := range []struct {
+		pkg        string
+		wantArgs   []string
+		wantPinned []string
+	}{
+		{
+			pkg:        "github.com/gokrazy/hello",
+			wantArgs:   []string{"github.com/gokrazy/hello", "github.com/gokrazy/kernel.rpi@v0.0.0-20240801061117-1c8b5e42a6a4", "golang.org/x/sys@v0.24.0"},
+			wantPinned: []string{"github.com/gokrazy/kernel.rpi@v0.0.0-20240801061117-1c8b5e42a6a4", "golang.org/x/sys@v0.24.0"},
+		},
+		{
+			// the package itself is part of a pinned module
+			pkg:        "github.com/gokrazy/kernel.rpi",
+			wantArgs:   []string{"github.com/gokrazy/kernel.rpi@v0.0.0-20240801061117-1c8b5e42a6a4", "golang.org/x/sys@v0.24.0"},
+			wantPinned: []string{"github.com/gokrazy/kernel.rpi@v0.0.0-20240801061117-1c8b5e42a6a4", "golang.org/x/sys@v0.24.0"},
+		},
+	} {
+		t.Run(tt.pkg, func(t *testing.T) {
+			args, pinned := pinnedGetArgs(ext, tt.pkg, reqs)
+			if diff := cmp.Diff(tt.wantArgs, args); diff != "" {
+				t.Errorf("pinnedGetArgs: unexpected args (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantPinned, pinned); diff != "" {
+				t.Errorf("pinnedGetArgs: unexpected pinned (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for pkg, want := range map[string]bool{
+		"github.com/stapelberg/scan2drive":                true,
+		"github.com/stapelberg/scan2drive/cmd/scan2drive": true,
+		"github.com/stapelberg/scan2drive2":               false,
+		"github.com/gokrazy/hello":                        false,
+	} {
+		if got := excludedFromUpdateAll(ext, pkg); got != want {
+			t.Errorf("excludedFromUpdateAll(%q) = %v, want %v", pkg, got, want)
+		}
+	}
+
+	if err := validatePins(&extconfig.Struct{PinnedModules: map[string]string{"example.com/foo": "latest"}}); err == nil {
+		t.Errorf("validatePins(latest) unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,99 @@
+package gok
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// noCommit is set by the --no_commit flag, see registerNoCommitFlag.
+var noCommit bool
+
+func registerNoCommitFlag(fs *pflag.FlagSet) {
+	fs.BoolVarP(&noCommit, "no_commit", "", false, "do not commit the changes to the instance directory to git (see GitCommit in the global gok configuration)")
+}
+
+// gitCommitPathspec selects the files of an instance directory which
+// commitInstanceChanges commits: everything except for files which gok
+// generates when building or deploying.
+var gitCommitPathspec = []string{
+	".",
+	":(exclude)build-logs",
+	":(exclude)modcache",
+	":(exclude)history",
+	":(exclude)pending-activation.json",
+}
+
+// commitInstanceChanges commits all changes to the instance directory dir
+// with message, if the GitCommit global configuration setting is enabled,
+// --no_commit was not specified and dir is part of a git repository.
+// Changes outside of dir (staged or not) are not committed.
+func commitInstanceChanges(ctx context.Context, dir, message string) error {
+	if !globalCfg.GitCommit || noCommit {
+		return nil
+	}
+	git := func(args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	}
+	if err := git("rev-parse", "--is-inside-work-tree").Run(); err != nil {
+		return nil // not a git repository (or git is not installed)
+	}
+	if out, err := git(append([]string{"add", "--all", "--"}, gitCommitPathspec...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("git add: %v: %s", err, bytes.TrimSpace(out))
+	}
+	err := git(append([]string{"diff", "--cached", "--quiet", "--"}, gitCommitPathspec...)...).Run()
+	if err == nil {
+		return nil // no changes
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return fmt.Errorf("git diff: %v", err)
+	}
+	if out, err := git(append([]string{"commit", "--quiet", "--message", message, "--"}, gitCommitPathspec...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("git commit: %v: %s", err, bytes.TrimSpace(out))
+	}
+	subject, _, _ := strings.Cut(message, "\n")
+	log.Printf("Committed changes to git: %s", subject)
+	return nil
+}
+
+// changedConfigKeys returns the (sorted) top-level fields which differ
+// between the config.json contents orig and edited, for use in commit
+// messages. It returns nil if either is not a JSON object.
+func changedConfigKeys(orig, edited []byte) []string {
+	var before, after map[string]json.RawMessage
+	if json.Unmarshal(orig, &before) != nil || json.Unmarshal(edited, &after) != nil {
+		return nil
+	}
+	var keys []string
+	for key, val := range after {
+		if prev, ok := before[key]; !ok || !jsonEqual(prev, val) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonEqual returns whether a and b are the same JSON value, ignoring
+// formatting.
+func jsonEqual(a, b json.RawMessage) bool {
+	var bufA, bufB bytes.Buffer
+	if json.Compact(&bufA, a) != nil || json.Compact(&bufB, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(bufA.Bytes(), bufB.Bytes())
+}
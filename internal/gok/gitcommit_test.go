@@ -0,0 +1,105 @@
+package gok
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChangedConfigKeys(t *testing.T) {
+	orig := []byte(`{"Hostname": "scanner", "Packages": ["a"], "Update": {"HTTPPassword": "secret"}}`)
+	edited := []byte(`{
+  "Hostname": "scanner",
+  "Packages": ["a", "b"],
+  "SerialConsole": "disabled"
+}`)
+	want := []string{"Packages", "SerialConsole", "Update"}
+	if diff := cmp.Diff(want, changedConfigKeys(orig, edited)); diff != "" {
+		t.Errorf("changedConfigKeys: unexpected diff (-want +got):\n%s", diff)
+	}
+	if got := changedConfigKeys(orig, []byte("not json")); got != nil {
+		t.Errorf("changedConfigKeys(invalid) = %v, want nil", got)
+	}
+}
+
+func TestCommitInstanceChanges(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(env, "gok test")
+	}
+	for _, env := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "gok@example.com")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	prev := globalCfg
+	t.Cleanup(func() { globalCfg = prev; noCommit = false })
+
+	ctx := context.Background()
+	repo := t.TempDir()
+	dir := filepath.Join(repo, "scanner")
+	for _, name := range []string{"config.json", "build-logs/hello.log", "other.txt"} {
+		path := filepath.Join(dir, name)
+		if name == "other.txt" {
+			path = filepath.Join(repo, name) // outside of the instance directory
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-C", repo}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "--quiet")
+
+	// Not enabled: no commit.
+	globalCfg.GitCommit = false
+	if err := commitInstanceChanges(ctx, dir, "scanner: create gokrazy instance"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output(); err == nil {
+		t.Fatalf("commit created although GitCommit is disabled")
+	}
+
+	globalCfg.GitCommit = true
+	noCommit = true
+	if err := commitInstanceChanges(ctx, dir, "scanner: create gokrazy instance"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output(); err == nil {
+		t.Fatalf("commit created despite --no_commit")
+	}
+
+	noCommit = false
+	if err := commitInstanceChanges(ctx, dir, "scanner: create gokrazy instance"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := git("log", "--format=%s"), "scanner: create gokrazy instance"; got != want {
+		t.Errorf("git log = %q, want %q", got, want)
+	}
+	if got, want := git("show", "--name-only", "--format="), "scanner/config.json"; got != want {
+		t.Errorf("committed files = %q, want %q", got, want)
+	}
+
+	// No changes: no commit.
+	if err := commitInstanceChanges(ctx, dir, "scanner: edit config.json"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := git("rev-list", "--count", "HEAD"), "1"; got != want {
+		t.Errorf("commit count = %s, want %s", got, want)
+	}
+}
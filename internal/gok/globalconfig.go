@@ -0,0 +1,227 @@
+package gok
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// globalConfig is the user-level gok configuration file, which provides
+// defaults for all gokrazy instances. Flags and environment variables always
+// take precedence.
+type globalConfig struct {
+	// ParentDir is the default for --parent_dir, unless GOKRAZY_PARENT_DIR
+	// is set.
+	ParentDir string `json:",omitempty"`
+
+	// Insecure is the default for --insecure (gok update).
+	Insecure bool `json:",omitempty"`
+
+	// Output is the preferred output format: text (default) or json (the
+	// default for --json).
+	Output string `json:",omitempty"`
+
+	// HTTPProxy, HTTPSProxy, NoProxy and GOPROXY are the defaults for the
+	// corresponding environment variables (HTTP_PROXY, HTTPS_PROXY, NO_PROXY,
+	// GOPROXY) of gok and the go commands it runs, unless they are set.
+	HTTPProxy  string `json:",omitempty"`
+	HTTPSProxy string `json:",omitempty"`
+	NoProxy    string `json:",omitempty"`
+	GOPROXY    string `json:",omitempty"`
+
+	// Notify is used by gok update for instances which do not configure
+	// the Notify config field.
+	Notify *extconfig.Notify `json:",omitempty"`
+
+	// OTLPEndpoint and Pushgateway are the defaults for --otlp_endpoint and
+	// --pushgateway, for exporting telemetry of all gok update and
+	// gok overwrite runs.
+	OTLPEndpoint string `json:",omitempty"`
+	Pushgateway  string `json:",omitempty"`
+
+	// GitCommit makes gok add, gok get, gok edit and gok new commit their
+	// changes when the instance directory is part of a git repository,
+	// unless --no_commit is specified.
+	GitCommit bool `json:",omitempty"`
+
+	// RemoteCache is the default for --remote_cache, unless
+	// GOKRAZY_REMOTE_CACHE is set.
+	RemoteCache string `json:",omitempty"`
+}
+
+// globalCfg is the global configuration loaded by LoadGlobalConfig.
+var globalCfg globalConfig
+
+// globalConfigPath returns the path of the global configuration file:
+// ~/.config/gokrazy/gok.json, or $GOKRAZY_GOK_CONFIG if set.
+func globalConfigPath() string {
+	if path := os.Getenv("GOKRAZY_GOK_CONFIG"); path != "" {
+		return path
+	}
+	return filepath.Join(config.Gokrazy(), "gok.json")
+}
+
+// readGlobalConfig reads the global configuration file at path. A missing
+// file results in an empty configuration.
+func readGlobalConfig(path string) (*globalConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &globalConfig{}, nil
+		}
+		return nil, err
+	}
+	var g globalConfig
+	if err := json.Unmarshal(b, &g); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", path, err)
+	}
+	switch g.Output {
+	case "", "text", "json":
+	default:
+		return nil, fmt.Errorf("%s: invalid Output %q: expected one of text or json", path, g.Output)
+	}
+	return &g, nil
+}
+
+// flagDefaults returns the flag defaults (by flag name) which g overrides.
+func (g *globalConfig) flagDefaults() map[string]string {
+	defaults := make(map[string]string)
+	if g.ParentDir != "" && os.Getenv("GOKRAZY_PARENT_DIR") == "" {
+		defaults["parent_dir"] = g.ParentDir
+	}
+	if g.Insecure {
+		defaults["insecure"] = strconv.FormatBool(true)
+	}
+	if g.Output == "json" {
+		defaults["json"] = strconv.FormatBool(true)
+	}
+	return defaults
+}
+
+// lookupEnv returns the value of the environment variable key, or of its
+// lower case variant (e.g. https_proxy), like net/http does.
+func lookupEnv(key string) (string, bool) {
+	if val, ok := os.LookupEnv(key); ok {
+		return val, true
+	}
+	return os.LookupEnv(strings.ToLower(key))
+}
+
+// environ returns the environment variables (KEY=VALUE) of g which are not
+// set in the process environment, for the child processes of gok.
+func (g *globalConfig) environ() []string {
+	var env []string
+	for _, e := range []struct{ key, val string }{
+		{"HTTP_PROXY", g.HTTPProxy},
+		{"HTTPS_PROXY", g.HTTPSProxy},
+		{"NO_PROXY", g.NoProxy},
+		{"GOPROXY", g.GOPROXY},
+	} {
+		if e.val == "" {
+			continue
+		}
+		if _, ok := lookupEnv(e.key); ok {
+			continue
+		}
+		env = append(env, e.key+"="+e.val)
+	}
+	return env
+}
+
+// withGlobalEnv returns env (e.g. os.Environ()) plus the environment
+// variables of the global configuration and extra, which take precedence.
+func withGlobalEnv(env []string, extra ...string) []string {
+	result := append([]string{}, env...)
+	result = append(result, globalCfg.environ()...)
+	return append(result, extra...)
+}
+
+// proxyVar returns the value of the proxy environment variable key, or the
+// default of g.
+func (g *globalConfig) proxyVar(key, def string) string {
+	if val, ok := lookupEnv(key); ok {
+		return val
+	}
+	return def
+}
+
+// proxyConfig returns the proxy configuration of gok: the proxy environment
+// variables, with the defaults of g for unset variables.
+func (g *globalConfig) proxyConfig() *httpproxy.Config {
+	cfg := httpproxy.FromEnvironment()
+	cfg.HTTPProxy = g.proxyVar("HTTP_PROXY", g.HTTPProxy)
+	cfg.HTTPSProxy = g.proxyVar("HTTPS_PROXY", g.HTTPSProxy)
+	cfg.NoProxy = g.proxyVar("NO_PROXY", g.NoProxy)
+	return cfg
+}
+
+// httpClient returns an HTTP client whose transport uses the proxy
+// configuration of g (see proxyConfig).
+func (g *globalConfig) httpClient() *http.Client {
+	proxyFunc := g.proxyConfig().ProxyFunc()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// apply sets the flag defaults of g on root and all its subcommands. It must
+// be called before parsing flags, so that flags specified on the command
+// line take precedence.
+func (g *globalConfig) apply(root *cobra.Command) error {
+	defaults := g.flagDefaults()
+	var setDefaults func(cmd *cobra.Command) error
+	setDefaults = func(cmd *cobra.Command) error {
+		var err error
+		cmd.Flags().VisitAll(func(f *pflag.Flag) {
+			def, ok := defaults[f.Name]
+			if !ok || err != nil {
+				return
+			}
+			if err = f.Value.Set(def); err != nil {
+				err = fmt.Errorf("%s: --%s: %v", globalConfigPath(), f.Name, err)
+				return
+			}
+			f.DefValue = def
+		})
+		if err != nil {
+			return err
+		}
+		for _, sub := range cmd.Commands() {
+			if err := setDefaults(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return setDefaults(root)
+}
+
+// httpClient is used for the HTTP requests of gok and the packer, except for
+// requests to gokrazy devices. LoadGlobalConfig configures its proxy.
+var httpClient = http.DefaultClient
+
+// LoadGlobalConfig reads the global gok configuration file
+// (~/.config/gokrazy/gok.json) and applies its defaults to RootCmd and to
+// httpClient. It must be called before executing RootCmd.
+func LoadGlobalConfig() error {
+	g, err := readGlobalConfig(globalConfigPath())
+	if err != nil {
+		return err
+	}
+	globalCfg = *g
+	httpClient = g.httpClient()
+	return g.apply(RootCmd)
+}
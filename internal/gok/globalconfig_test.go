@@ -0,0 +1,132 @@
+package gok
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/spf13/cobra"
+)
+
+func TestGlobalConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gok.json")
+	if err := os.WriteFile(path, []byte(`{"Insecure": true, "Output": "json", "GOPROXY": "https://proxy.example", "HTTPSProxy": "http://proxy.example:3128"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := readGlobalConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("HTTPS_PROXY", "")
+	os.Unsetenv("HTTPS_PROXY")
+	os.Unsetenv("https_proxy")
+
+	var insecure, json bool
+	root := &cobra.Command{Use: "gok"}
+	sub := &cobra.Command{Use: "update", Run: func(*cobra.Command, []string) {}}
+	sub.Flags().BoolVar(&insecure, "insecure", false, "")
+	sub.Flags().BoolVar(&json, "json", false, "")
+	root.AddCommand(sub)
+	if err := g.apply(root); err != nil {
+		t.Fatal(err)
+	}
+
+	// The global config provides defaults…
+	root.SetArgs([]string{"update"})
+	if err := root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !insecure || !json {
+		t.Errorf("insecure = %v, json = %v, want true, true", insecure, json)
+	}
+	if got, want := sub.Flags().Lookup("insecure").DefValue, "true"; got != want {
+		t.Errorf("--insecure default = %q, want %q", got, want)
+	}
+
+	// …but flags take precedence.
+	root.SetArgs([]string{"update", "--json=false"})
+	if err := root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if json {
+		t.Errorf("json = true, want false (flag takes precedence)")
+	}
+
+	// So do environment variables: child processes only get the unset ones,
+	// and the process environment is left alone.
+	if diff := cmp.Diff([]string{"HTTPS_PROXY=http://proxy.example:3128"}, g.environ()); diff != "" {
+		t.Errorf("environ(): unexpected diff (-want +got):\n%s", diff)
+	}
+	if got, want := os.Getenv("GOPROXY"), "off"; got != want {
+		t.Errorf("GOPROXY = %q, want %q", got, want)
+	}
+	if got, ok := os.LookupEnv("HTTPS_PROXY"); ok {
+		t.Errorf("HTTPS_PROXY = %q, want unset", got)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"Output": "yaml"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readGlobalConfig(path); err == nil {
+		t.Errorf("readGlobalConfig unexpectedly accepted Output yaml")
+	}
+}
+
+func TestGlobalConfigProxy(t *testing.T) {
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	g := &globalConfig{
+		HTTPSProxy: "proxy.example:3128",
+		NoProxy:    "internal.example,10.0.0.0/8,192.168.1.2",
+	}
+	proxy := g.httpClient().Transport.(*http.Transport).Proxy
+	for _, tt := range []struct {
+		url  string
+		want string
+	}{
+		{url: "https://proxy.golang.org/", want: "http://proxy.example:3128"},
+		{url: "https://gokrazy.internal.example/", want: ""},
+		{url: "https://internal.example:443/", want: ""},
+		{url: "https://10.1.2.3/", want: ""},
+		{url: "https://192.168.1.2:8443/", want: ""},
+		{url: "https://192.168.1.3/", want: "http://proxy.example:3128"},
+		{url: "https://localhost/", want: ""},
+		{url: "https://127.0.0.1/", want: ""},
+		// No HTTPProxy is configured.
+		{url: "http://proxy.golang.org/", want: ""},
+	} {
+		t.Run(tt.url, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := proxy(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if u != nil {
+				got = u.String()
+			}
+			if got != tt.want {
+				t.Errorf("proxy(%s) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+
+	// Environment variables take precedence.
+	t.Setenv("NO_PROXY", "*")
+	req, err := http.NewRequest("GET", "https://proxy.golang.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy = g.httpClient().Transport.(*http.Transport).Proxy
+	if u, err := proxy(req); err != nil || u != nil {
+		t.Errorf("proxy with NO_PROXY=* = %v, %v, want nil, nil", u, err)
+	}
+}
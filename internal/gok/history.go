@@ -0,0 +1,222 @@
+package gok
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// historyCmd is gok history.
+var historyCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "history",
+	Short:   "List the deployments (gok update, gok overwrite) of a gokrazy instance",
+	Long: `gok history lists every gok update and gok overwrite of the instance,
+successful or not: when it ran, which gok version ran it, what was updated or
+written, the result, how long it took and the SBOM hash of the deployed build.
+
+The history is recorded in the history/ directory of the instance
+(deployments.jsonl, plus the SBOM of each deployed build in history/sbom/).
+
+Use gok history diff to compare two deployments.
+
+Examples:
+  % gok -i scanner history
+  % gok -i scanner history diff 3 5
+`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return historyImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+// historyDiffCmd is gok history diff.
+var historyDiffCmd = &cobra.Command{
+	Use:   "diff <n> <m>",
+	Short: "Compare two deployments of a gokrazy instance",
+	Long: `gok history diff compares deployments n and m (numbers as listed by
+gok history): their metadata, the module versions of each program and their
+SBOMs (config, go.mod, extra file and boot file hashes).
+
+Examples:
+  # What changed between the last two deployments (of 17)?
+  % gok -i scanner history diff 16 17
+`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return historyDiffImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type historyConfig struct{}
+
+var historyImpl historyConfig
+
+type historyDiffConfig struct{}
+
+var historyDiffImpl historyDiffConfig
+
+func init() {
+	instanceflag.RegisterPflags(historyCmd.PersistentFlags())
+	registerJSONFlag(historyCmd.Flags())
+	historyCmd.AddCommand(historyDiffCmd)
+}
+
+// historyDir returns the deployment history directory of the instance.
+func historyDir() string {
+	return filepath.Join(config.InstancePath(), "history")
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	if hash == "" {
+		return "-"
+	}
+	return hash
+}
+
+func deploymentResult(d *packer.Deployment) string {
+	if d.Success {
+		return "ok"
+	}
+	return "failed"
+}
+
+func (r *historyConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	deployments, err := packer.ReadHistory(historyDir())
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		for _, d := range deployments {
+			if err := enc.Encode(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(deployments) == 0 {
+		fmt.Fprintf(stderr, "no deployments recorded for instance %s yet (in %s)\n", instanceflag.Instance(), historyDir())
+		return nil
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "#\tTIME\tOPERATION\tRESULT\tDURATION\tSBOM\tGOK\tTARGET\n")
+	for idx, d := range deployments {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%v\t%s\t%s\t%s\n",
+			idx+1,
+			d.Time.Local().Format("2006-01-02 15:04:05"),
+			d.Operation,
+			deploymentResult(&d),
+			d.Duration().Round(100*time.Millisecond),
+			shortHash(d.SBOMHash),
+			d.GokVersion,
+			d.Target)
+	}
+	return tw.Flush()
+}
+
+// deploymentArg returns the deployment numbered arg (1-based).
+func deploymentArg(deployments []packer.Deployment, arg string) (*packer.Deployment, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deployment number %q: %v", arg, err)
+	}
+	if n < 1 || n > len(deployments) {
+		return nil, fmt.Errorf("deployment %d not found: the history of instance %s contains deployments 1 to %d", n, instanceflag.Instance(), len(deployments))
+	}
+	return &deployments[n-1], nil
+}
+
+// historySBOM returns the indented SBOM of d, or a placeholder if it is not
+// available.
+func historySBOM(d *packer.Deployment) string {
+	if d.SBOMHash == "" {
+		return "(no SBOM: the deployment failed before generating it)"
+	}
+	sbom, err := packer.ReadHistorySBOM(historyDir(), d.SBOMHash)
+	if err != nil {
+		return fmt.Sprintf("(SBOM %s not available: %v)", d.SBOMHash, err)
+	}
+	b, err := json.MarshalIndent(sbom.SBOM, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("(SBOM %s: %v)", d.SBOMHash, err)
+	}
+	return string(b)
+}
+
+func (r *historyDiffConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	deployments, err := packer.ReadHistory(historyDir())
+	if err != nil {
+		return err
+	}
+	a, err := deploymentArg(deployments, args[0])
+	if err != nil {
+		return err
+	}
+	b, err := deploymentArg(deployments, args[1])
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "\t#%s\t#%s\n", args[0], args[1])
+	for _, row := range []struct{ name, a, b string }{
+		{"time", a.Time.Local().Format("2006-01-02 15:04:05"), b.Time.Local().Format("2006-01-02 15:04:05")},
+		{"operation", a.Operation, b.Operation},
+		{"target", a.Target, b.Target},
+		{"result", deploymentResult(a), deploymentResult(b)},
+		{"gok", a.GokVersion, b.GokVersion},
+		{"build", a.BuildTimestamp, b.BuildTimestamp},
+		{"from gaf", a.FromGaf, b.FromGaf},
+		{"sbom", shortHash(a.SBOMHash), shortHash(b.SBOMHash)},
+	} {
+		if row.a == "" && row.b == "" {
+			continue
+		}
+		marker := ""
+		if row.a != row.b {
+			marker = " *"
+		}
+		fmt.Fprintf(tw, "%s%s\t%s\t%s\n", row.name, marker, row.a, row.b)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, d := range []*packer.Deployment{a, b} {
+		if d.Error != "" {
+			fmt.Fprintf(stdout, "\nerror of deployment %s: %s\n", d.Time.Local().Format("2006-01-02 15:04:05"), d.Error)
+		}
+	}
+
+	if len(a.Programs) > 0 && len(b.Programs) > 0 {
+		changes := b.ProgramChanges(a)
+		fmt.Fprintf(stdout, "\nProgram changes:\n")
+		if len(changes) == 0 {
+			fmt.Fprintf(stdout, "  (none)\n")
+		}
+		for _, change := range changes {
+			fmt.Fprintf(stdout, "  %s\n", change)
+		}
+	}
+
+	fmt.Fprintf(stdout, "\nSBOM changes:\n")
+	if a.SBOMHash != "" && a.SBOMHash == b.SBOMHash {
+		fmt.Fprintf(stdout, "  (none)\n")
+		return nil
+	}
+	fmt.Fprint(stdout, lineDiff(historySBOM(a), historySBOM(b), 3))
+	return nil
+}
@@ -0,0 +1,26 @@
+package gok
+
+import (
+	"testing"
+
+	"github.com/gokrazy/tools/internal/packer"
+)
+
+func TestDeploymentArg(t *testing.T) {
+	deployments := []packer.Deployment{
+		{Target: "first"},
+		{Target: "second"},
+	}
+	d, err := deploymentArg(deployments, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Target, "second"; got != want {
+		t.Errorf("deploymentArg(2).Target = %q, want %q", got, want)
+	}
+	for _, arg := range []string{"0", "3", "-1", "last"} {
+		if _, err := deploymentArg(deployments, arg); err == nil {
+			t.Errorf("deploymentArg(%q) = nil error, want error", arg)
+		}
+	}
+}
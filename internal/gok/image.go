@@ -0,0 +1,19 @@
+package gok
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// imageCmd is the gok image subcommand, which (only) has nested commands like
+// ls, cat, mount and umount.
+var imageCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "image",
+	Short:   "Inspect images built by gok overwrite",
+	Long: `Inspect images built by gok overwrite (full disk images, root or boot file
+system images), e.g. to debug the contents of the boot and root file systems.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
@@ -0,0 +1,166 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gokrazy/tools/internal/imagefs"
+	"github.com/spf13/cobra"
+)
+
+var imageLsCmd = &cobra.Command{
+	Use:   "ls <image> [path]",
+	Short: "List files in a root, boot or full disk image without mounting it",
+	Long: `gok image ls lists the files in a directory of a SquashFS root file system
+image, a FAT boot file system image or a full disk image (as built by
+gok overwrite). The files are read directly from the image, so gok image ls
+works on every operating system and does not require root privileges.
+
+In a full disk image, the boot and root file systems are the directories boot
+and root.
+
+Examples:
+  % gok image ls /tmp/root.squashfs /etc
+  % gok image ls /tmp/boot.fat
+  % gok image ls /tmp/gokrazy.img /root/user
+`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return imageLsImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+var imageCatCmd = &cobra.Command{
+	Use:   "cat <image> <path>",
+	Short: "Print a file from a root, boot or full disk image without mounting it",
+	Long: `gok image cat prints the contents of a file of a SquashFS root file system
+image, a FAT boot file system image or a full disk image (as built by
+gok overwrite). See gok image ls for how paths are resolved.
+
+Examples:
+  % gok image cat /tmp/boot.fat /cmdline.txt
+  % gok image cat /tmp/gokrazy.img /root/etc/hostname
+`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return imageCatImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type imageLsConfig struct{}
+
+var imageLsImpl imageLsConfig
+
+type imageCatConfig struct{}
+
+var imageCatImpl imageCatConfig
+
+func init() {
+	imageCmd.AddCommand(imageLsCmd)
+	imageCmd.AddCommand(imageCatCmd)
+}
+
+// openImage opens the file system of the image file at path (see
+// imagefs.Open). The returned file must be closed by the caller.
+func openImage(path string) (fs.FS, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	fsys, err := imagefs.Open(f, st.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return fsys, f, nil
+}
+
+// imagePath converts the absolute (or relative) path within an image, as
+// passed on the command line, to an io/fs path.
+func imagePath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (r *imageLsConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fsys, f, err := openImage(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	name := "."
+	if len(args) > 1 {
+		name = imagePath(args[1])
+	}
+	st, err := fs.Stat(fsys, name)
+	if err != nil {
+		return err
+	}
+	infos := []fs.FileInfo{st}
+	if st.IsDir() {
+		entries, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			return err
+		}
+		infos = infos[:0]
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			infos = append(infos, info)
+		}
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 1, ' ', 0)
+	for _, info := range infos {
+		name := info.Name()
+		if lt, ok := info.(interface{ LinkTarget() string }); ok && info.Mode()&fs.ModeSymlink != 0 {
+			name += " -> " + lt.LinkTarget()
+		}
+		fmt.Fprintf(tw, "%v\t%d\t%s\t%s\n",
+			info.Mode(),
+			info.Size(),
+			info.ModTime().Format("2006-01-02 15:04"),
+			name)
+	}
+	return tw.Flush()
+}
+
+func (r *imageCatConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fsys, f, err := openImage(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	name := imagePath(args[1])
+	in, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file (mode %v)", args[1], st.Mode())
+	}
+	_, err = io.Copy(stdout, in)
+	return err
+}
@@ -0,0 +1,221 @@
+package gok
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/gokrazy/tools/internal/elevate"
+	"github.com/gokrazy/tools/internal/imagefs"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+var imageMountCmd = &cobra.Command{
+	Use:   "mount [flags] <image>",
+	Short: "Mount the file systems of a full disk image (Linux only)",
+	Long: `gok image mount mounts the boot, root and (if formatted) perm file systems of
+a full disk image (as built by gok overwrite --full=<file>) read-only into a
+new temporary directory, whose path it prints. Each file system is mounted
+using a loop device at the partition offset read from the image's MBR.
+
+gok image mount requires Linux and uses sudo to mount the file systems (unless
+running as root). Unmount the file systems
+using gok image umount.
+
+Examples:
+  % gok image mount /tmp/gokrazy.img
+  % ls /tmp/gokrazy-image-1234/root/user
+  % gok image umount /tmp/gokrazy-image-1234
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return imageMountImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+var imageUmountCmd = &cobra.Command{
+	Use:   "umount [flags] <dir>",
+	Short: "Unmount the file systems mounted by gok image mount",
+	Long: `gok image umount unmounts the file systems which gok image mount mounted
+into dir (which detaches their loop devices) and removes dir.
+
+Examples:
+  % gok image umount /tmp/gokrazy-image-1234
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return imageUmountImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type imageMountConfig struct {
+	sudo string
+}
+
+var imageMountImpl imageMountConfig
+
+type imageUmountConfig struct {
+	sudo string
+}
+
+var imageUmountImpl imageUmountConfig
+
+func init() {
+	imageCmd.AddCommand(imageMountCmd)
+	imageCmd.AddCommand(imageUmountCmd)
+	imageMountCmd.Flags().StringVarP(&imageMountImpl.sudo, "sudo", "", elevate.Auto, "Whether to elevate privileges using sudo when required (one of auto, always, never, default auto)")
+	imageUmountCmd.Flags().StringVarP(&imageUmountImpl.sudo, "sudo", "", elevate.Auto, "Whether to elevate privileges using sudo when required (one of auto, always, never, default auto)")
+}
+
+// imageMountStateFile is the name of the file within the mount directory in
+// which gok image mount records what gok image umount needs to undo.
+const imageMountStateFile = "gok-image-mount.json"
+
+type imageMountState struct {
+	Image string
+	// Mounts are the mount points (relative to the mount directory), in the
+	// order in which they were mounted.
+	Mounts []string
+}
+
+func (s *imageMountState) write(dir string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, imageMountStateFile), append(b, '\n'), 0644)
+}
+
+// imageMount is a file system of a full disk image to mount.
+type imageMount struct {
+	Dir      string // relative to the mount directory, e.g. root
+	Type     string // file system type (mount -t)
+	Offset   int64  // in bytes
+	Size     int64  // in bytes, or 0 for up to the end of the image
+	Optional bool   // e.g. an unformatted perm partition
+}
+
+// imageMounts returns the file systems of a full disk image whose first
+// (boot) partition starts at sector firstPartitionOffsetSectors and is
+// bootSectors long, following the partition layout of gok overwrite.
+func imageMounts(firstPartitionOffsetSectors, bootSectors int64) []imageMount {
+	first := firstPartitionOffsetSectors * 512
+	bootSize := bootSectors * 512
+	const rootSize = 500 * packer.MB
+	return []imageMount{
+		{Dir: "boot", Type: "vfat", Offset: first, Size: bootSize},
+		{Dir: "root", Type: "squashfs", Offset: first + bootSize, Size: rootSize},
+		{Dir: "perm", Type: "ext4", Offset: first + bootSize + 2*rootSize, Optional: true},
+	}
+}
+
+// imageBootPartition returns the start sector and the size (in sectors) of
+// the first (boot) partition of the full disk image at path, read from its
+// MBR.
+func imageBootPartition(path string) (first, sectors int64, _ error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	first, sectors, err = imagefs.BootPartition(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %v", path, err)
+	}
+	return first, sectors, nil
+}
+
+// privileged returns a command running name with args as root (see
+// elevate.Command), connected to stderr.
+func privileged(ctx context.Context, sudo string, stderr io.Writer, name string, args ...string) *exec.Cmd {
+	cmd := elevate.Command(ctx, sudo, os.Geteuid() != 0, name, args...)
+	cmd.Stdin = os.Stdin // for the sudo password prompt
+	cmd.Stderr = stderr
+	return cmd
+}
+
+func (r *imageMountConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("gok image mount requires Linux (loop devices)")
+	}
+	image, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	first, bootSectors, err := imageBootPartition(image)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "gokrazy-image-")
+	if err != nil {
+		return err
+	}
+	state := imageMountState{Image: image}
+	if err := state.write(dir); err != nil {
+		return err
+	}
+	for _, m := range imageMounts(first, bootSectors) {
+		mountpoint := filepath.Join(dir, m.Dir)
+		if err := os.Mkdir(mountpoint, 0755); err != nil {
+			return err
+		}
+		// mount(8) sets up a loop device, which is detached on unmount.
+		opts := fmt.Sprintf("ro,loop,offset=%d", m.Offset)
+		if m.Size > 0 {
+			opts += fmt.Sprintf(",sizelimit=%d", m.Size)
+		}
+		mount := privileged(ctx, r.sudo, stderr, "mount", "-o", opts, "-t", m.Type, image, mountpoint)
+		if m.Optional {
+			mount.Stderr = nil // e.g. perm partition without a file system
+		}
+		if err := mount.Run(); err != nil {
+			if m.Optional {
+				os.Remove(mountpoint)
+				continue
+			}
+			return fmt.Errorf("%v: %v (undo using: gok image umount %s)", mount.Args, err, dir)
+		}
+		state.Mounts = append(state.Mounts, m.Dir)
+		if err := state.write(dir); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s:\t%s\n", m.Dir, mountpoint)
+	}
+	fmt.Fprintf(stdout, "\nUnmount using: gok image umount %s\n", dir)
+	return nil
+}
+
+func (r *imageUmountConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	dir := args[0]
+	b, err := os.ReadFile(filepath.Join(dir, imageMountStateFile))
+	if err != nil {
+		return fmt.Errorf("%s was not mounted by gok image mount: %v", dir, err)
+	}
+	var state imageMountState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("%s: %v", imageMountStateFile, err)
+	}
+	for i := len(state.Mounts) - 1; i >= 0; i-- {
+		mountpoint := filepath.Join(dir, state.Mounts[i])
+		umount := privileged(ctx, r.sudo, stderr, "umount", mountpoint)
+		if err := umount.Run(); err != nil {
+			return fmt.Errorf("%v: %v", umount.Args, err)
+		}
+		state.Mounts = state.Mounts[:i]
+		if err := state.write(dir); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "unmounted %s\n", state.Image)
+	return nil
+}
@@ -0,0 +1,103 @@
+package gok
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/tools/internal/packer"
+)
+
+func TestImageMounts(t *testing.T) {
+	mounts := imageMounts(8192, 128*packer.MB/512)
+	if got, want := len(mounts), 3; got != want {
+		t.Fatalf("imageMounts: got %d mounts, want %d", got, want)
+	}
+	if got, want := mounts[0].Size, int64(128*packer.MB); got != want {
+		t.Errorf("boot size: got %d, want %d", got, want)
+	}
+	if got, want := mounts[1].Offset, int64(8192*512+128*packer.MB); got != want {
+		t.Errorf("root offset: got %d, want %d", got, want)
+	}
+	if got, want := mounts[2].Offset, int64(8192*512+1128*packer.MB); got != want {
+		t.Errorf("perm offset: got %d, want %d", got, want)
+	}
+	for _, m := range mounts {
+		if m.Optional != (m.Dir == "perm") {
+			t.Errorf("%s: Optional = %v, want only perm to be optional", m.Dir, m.Optional)
+		}
+	}
+}
+
+func TestImageBootPartition(t *testing.T) {
+	var mbr [512]byte
+	mbr[446+4] = 0x0c // FAT
+	binary.LittleEndian.PutUint32(mbr[446+8:], 2048)
+	binary.LittleEndian.PutUint32(mbr[446+12:], 100*packer.MB/512)
+	mbr[510], mbr[511] = 0x55, 0xAA
+	path := filepath.Join(t.TempDir(), "full.img")
+	if err := os.WriteFile(path, mbr[:], 0644); err != nil {
+		t.Fatal(err)
+	}
+	first, sectors, err := imageBootPartition(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 2048 || sectors != 100*packer.MB/512 {
+		t.Errorf("imageBootPartition = %d, %d, want 2048, %d", first, sectors, 100*packer.MB/512)
+	}
+
+	mbr[510] = 0
+	if err := os.WriteFile(path, mbr[:], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := imageBootPartition(path); err == nil {
+		t.Errorf("imageBootPartition unexpectedly succeeded without MBR signature")
+	}
+}
+
+func TestImageUmountRemovesDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "gokrazy-image-1")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A mount which failed before any file system was mounted or the loop
+	// device was set up.
+	state := imageMountState{Image: "/tmp/gokrazy.img"}
+	if err := state.write(dir); err != nil {
+		t.Fatal(err)
+	}
+	var stdout strings.Builder
+	r := &imageUmountConfig{}
+	if err := r.run(context.Background(), []string{dir}, &stdout, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after gok image umount (err = %v)", dir, err)
+	}
+
+	if err := r.run(context.Background(), []string{t.TempDir()}, &stdout, io.Discard); err == nil {
+		t.Errorf("gok image umount succeeded for a directory which was not mounted by gok image mount")
+	}
+}
+
+func TestImagePath(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"/", "."},
+		{"", "."},
+		{"/etc", "etc"},
+		{"etc/", "etc"},
+		{"/root/../boot/cmdline.txt", "boot/cmdline.txt"},
+	} {
+		if got := imagePath(tt.name); got != tt.want {
+			t.Errorf("imagePath(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package gok
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/pflag"
+)
+
+// jsonOutput is set by the --json flag, see registerJSONFlag.
+var jsonOutput bool
+
+func registerJSONFlag(fs *pflag.FlagSet) {
+	fs.BoolVarP(&jsonOutput, "json", "", false, "print machine-readable build events (one JSON object per line) to stdout. Human-readable output is printed to stderr instead")
+}
+
+// jsonEvents returns an event handler for packer.Pack.OnEvent which encodes
+// events as JSON lines to stdout.
+//
+// Because the packer prints human-readable output to os.Stdout, os.Stdout is
+// redirected to os.Stderr until the returned restore function is called.
+func jsonEvents(stdout io.Writer) (onEvent func(packer.Event), restore func()) {
+	orig := os.Stdout
+	os.Stdout = os.Stderr
+	var mu sync.Mutex
+	enc := json.NewEncoder(stdout)
+	onEvent = func(ev packer.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(ev)
+	}
+	return onEvent, func() { os.Stdout = orig }
+}
+
+// interruptContext returns a context which is canceled on the first Ctrl-C,
+// so that the packer can abort gracefully (killing child processes and
+// removing temporary files). A second Ctrl-C terminates the program as usual.
+func interruptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// runPack builds pack, emitting JSON events to stdout when --json is set and
+// exporting telemetry when configured (see registerTelemetryFlags).
+func runPack(ctx context.Context, pack *packer.Pack, stdout io.Writer) error {
+	ctx, stop := interruptContext(ctx)
+	defer stop()
+	pack.HistoryDir = historyDir()
+	exporter, rec, err := newTelemetryRecorder(pack)
+	if err != nil {
+		return err
+	}
+	var handlers []func(packer.Event)
+	if jsonOutput {
+		onEvent, restore := jsonEvents(stdout)
+		defer restore()
+		handlers = append(handlers, onEvent)
+	}
+	if rec != nil {
+		handlers = append(handlers, rec.OnEvent)
+	}
+	if len(handlers) > 0 {
+		pack.OnEvent = func(ev packer.Event) {
+			for _, h := range handlers {
+				h(ev)
+			}
+		}
+	}
+	buildErr := pack.Build(ctx, "gokrazy gok")
+	if rec != nil {
+		rec.Finish(buildErr)
+		// Export even when the build was interrupted, as failures are what
+		// telemetry is most interesting for.
+		exportCtx, canc := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer canc()
+		if err := exporter.Export(exportCtx, rec); err != nil {
+			log.Printf("exporting telemetry: %v", err)
+		}
+	}
+	return buildErr
+}
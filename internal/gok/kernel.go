@@ -0,0 +1,314 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// kernelCmd is the gok kernel subcommand, which (only) has nested commands
+// like new and build.
+var kernelCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "kernel",
+	Short:   "Create, configure and build custom kernel packages",
+	Long: `Create, configure and build a custom kernel package, e.g. to enable drivers
+for hardware which the gokrazy kernels do not support.
+
+A kernel package is a Go package whose directory contains the kernel (vmlinuz),
+device tree files (*.dtb) and kernel modules (lib/modules). gok kernel new
+creates a kernel package which builds the upstream Linux kernel in a container
+(using docker or podman), configured by the kernel's defconfig plus the
+options in config.addendum.txt (or by config.txt, see gok kernel menuconfig).
+
+Examples:
+  # create a kernel package in ~/kernel and use it for instance scanner
+  % gok -i scanner kernel new ~/kernel
+
+  # enable additional drivers, then build the kernel
+  % gok -i scanner kernel menuconfig ~/kernel
+  % gok -i scanner kernel build ~/kernel
+
+  # deploy
+  % gok -i scanner update
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var kernelNewCmd = &cobra.Command{
+	Use:                   "new [flags] <dir>",
+	DisableFlagsInUseLine: true,
+	Short:                 "Create a custom kernel package and use it for the instance",
+	Long: `gok kernel new creates a kernel package in the (new or empty) directory and
+configures it as KernelPackage of the instance (see gok kernel use), unless
+--no_use is specified. The kernel package contains:
+
+  upstream-url.txt     URL of the Linux kernel source tarball to build
+  config.addendum.txt  kernel config options added to the defconfig
+  Containerfile        build environment (docker or podman)
+  build.sh             build script, run in the container by gok kernel build
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() != 1 {
+			fmt.Fprint(os.Stderr, `expected exactly one directory
+
+`)
+			return cmd.Usage()
+		}
+		return kernelNewImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+var kernelUseCmd = &cobra.Command{
+	Use:                   "use [flags] <dir|importpath>",
+	DisableFlagsInUseLine: true,
+	Short:                 "Use a kernel package for the instance",
+	Long: `gok kernel use sets the KernelPackage of the instance. For a kernel package in
+a local directory, a builddir with a replace directive is created (like gok
+add does for local packages).
+
+Examples:
+  % gok -i scanner kernel use ~/kernel
+  % gok -i scanner kernel use github.com/gokrazy/kernel.rpi
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() != 1 {
+			fmt.Fprint(os.Stderr, `expected exactly one directory or import path
+
+`)
+			return cmd.Usage()
+		}
+		return kernelUseImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+func init() {
+	kernelCmd.AddCommand(kernelNewCmd)
+	kernelCmd.AddCommand(kernelUseCmd)
+}
+
+type kernelNewConfig struct {
+	modulePath string
+	url        string
+	noUse      bool
+}
+
+var kernelNewImpl kernelNewConfig
+
+type kernelUseConfig struct{}
+
+var kernelUseImpl kernelUseConfig
+
+// defaultKernelURL is the kernel source tarball which gok kernel new
+// configures by default.
+const defaultKernelURL = "https://cdn.kernel.org/pub/linux/kernel/v6.x/linux-6.6.58.tar.xz"
+
+func init() {
+	kernelNewCmd.Flags().StringVarP(&kernelNewImpl.modulePath, "module", "", "", "Go module path of the kernel package (default: gokrazy.local/kernel/<dir name>)")
+	kernelNewCmd.Flags().StringVarP(&kernelNewImpl.url, "url", "", defaultKernelURL, "URL of the Linux kernel source tarball (.tar.xz) to build")
+	kernelNewCmd.Flags().BoolVarP(&kernelNewImpl.noUse, "no_use", "", false, "do not configure the new kernel package as KernelPackage of the instance")
+	instanceflag.RegisterPflags(kernelNewCmd.Flags())
+	instanceflag.RegisterPflags(kernelUseCmd.Flags())
+}
+
+// kernelTemplates are the files of a new kernel package (see gok kernel new),
+// rendered using text/template with kernelTemplateData.
+var kernelTemplates = []struct {
+	name string
+	mode os.FileMode
+	tmpl string
+}{
+	{"go.mod", 0644, `module {{ .ModulePath }}
+
+go 1.22
+`},
+
+	{"kernel.go", 0644, `// Package kernel contains a custom Linux kernel for gokrazy (vmlinuz, device
+// tree files and lib/modules), built from {{ .URL }}
+// using gok kernel build.
+package kernel
+`},
+
+	{"upstream-url.txt", 0644, `{{ .URL }}
+`},
+
+	{"config.addendum.txt", 0644, `# Kernel config options which are added to the defconfig of the kernel (unless
+# config.txt exists, see gok kernel menuconfig), e.g.:
+#
+# CONFIG_USB_NET_RTL8152=y
+
+# gokrazy requires SquashFS for the root file system:
+CONFIG_SQUASHFS=y
+CONFIG_SQUASHFS_ZLIB=y
+`},
+
+	{"Containerfile", 0644, `FROM debian:bookworm
+
+RUN apt-get update && apt-get install -y --no-install-recommends \
+	build-essential bc bison flex libssl-dev libelf-dev libncurses-dev \
+	kmod cpio xz-utils curl ca-certificates rsync \
+	gcc-aarch64-linux-gnu
+`},
+
+	{"build.sh", 0755, `#!/bin/sh
+# build.sh builds the kernel. gok kernel build and gok kernel menuconfig run it
+# in the container built from Containerfile, with the kernel package directory
+# mounted at /out and ARCH set to arm64 or x86_64.
+#
+# usage: build.sh [build|menuconfig]
+set -eu
+
+ARCH="${ARCH:-arm64}"
+case "$ARCH" in
+arm64)
+	CROSS_COMPILE=aarch64-linux-gnu-
+	IMAGE=arch/arm64/boot/Image
+	TARGETS="Image dtbs modules"
+	;;
+x86_64)
+	CROSS_COMPILE=
+	IMAGE=arch/x86/boot/bzImage
+	TARGETS="bzImage modules"
+	;;
+*)
+	echo "unsupported ARCH $ARCH" >&2
+	exit 1
+	;;
+esac
+export ARCH CROSS_COMPILE
+
+src=/tmp/linux
+mkdir -p "$src"
+curl -fsSL "$(cat /out/upstream-url.txt)" | tar -xJ --strip-components=1 -C "$src"
+cd "$src"
+
+if [ -f /out/config.txt ]; then
+	cp /out/config.txt .config
+else
+	make defconfig
+	cat /out/config.addendum.txt >> .config
+fi
+make olddefconfig
+
+if [ "${1:-build}" = "menuconfig" ]; then
+	make menuconfig
+	cp .config /out/config.txt
+	exit 0
+fi
+
+make -j"$(nproc)" $TARGETS
+cp "$IMAGE" /out/vmlinuz
+if [ "$ARCH" = "arm64" ]; then
+	find arch/arm64/boot/dts -name '*.dtb' -exec cp {} /out/ \;
+fi
+rm -rf /out/lib/modules
+make INSTALL_MOD_PATH=/out INSTALL_MOD_STRIP=1 modules_install
+rm -f /out/lib/modules/*/build /out/lib/modules/*/source
+`},
+}
+
+type kernelTemplateData struct {
+	ModulePath string
+	URL        string
+}
+
+// writeKernelPackage creates a new kernel package in dir.
+func writeKernelPackage(dir string, data kernelTemplateData) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, t := range kernelTemplates {
+		tmpl, err := template.New(t.name).Parse(t.tmpl)
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, t.name), []byte(b.String()), t.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *kernelNewConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	modulePath := r.modulePath
+	if modulePath == "" {
+		modulePath = "gokrazy.local/kernel/" + filepath.Base(dir)
+	}
+	if err := writeKernelPackage(dir, kernelTemplateData{
+		ModulePath: modulePath,
+		URL:        r.url,
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Created kernel package %s in %s\n", modulePath, dir)
+	if !r.noUse {
+		if err := useKernelPackage(ctx, dir, stdout, stderr); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, "Next, adjust %s (or use gok kernel menuconfig), then run gok kernel build %s\n",
+		filepath.Join(dir, "config.addendum.txt"), dir)
+	return nil
+}
+
+// useKernelPackage sets the KernelPackage of the instance to arg, which is
+// either a local directory (see addLocal) or an import path.
+func useKernelPackage(ctx context.Context, arg string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	importPath := arg
+	if isPath(arg) {
+		abs, err := filepath.Abs(arg)
+		if err != nil {
+			return err
+		}
+		importPath, err = (&addImplConfig{}).addLocal(ctx, abs, stdout, stderr)
+		if err != nil {
+			return err
+		}
+	}
+	cfg.KernelPackage = &importPath
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	b, err := extconfig.FormatForFile(cfg, ext)
+	if err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(config.InstanceConfigPath(), b, 0600, renameio.WithExistingPermissions()); err != nil {
+		return fmt.Errorf("updating config.json: %v", err)
+	}
+	log.Printf("Set KernelPackage of instance %s to %s", instanceflag.Instance(), importPath)
+	return nil
+}
+
+func (r *kernelUseConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	return useKernelPackage(ctx, args[0], stdout, stderr)
+}
@@ -0,0 +1,65 @@
+package gok
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteKernelPackage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "kernel")
+	data := kernelTemplateData{
+		ModulePath: "example.com/kernel",
+		URL:        "https://example.com/linux.tar.xz",
+	}
+	if err := writeKernelPackage(dir, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"go.mod", "module example.com/kernel\n"},
+		{"upstream-url.txt", "https://example.com/linux.tar.xz\n"},
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(b), tt.want) {
+			t.Errorf("%s: got %q, want prefix %q", tt.name, b, tt.want)
+		}
+	}
+	st, err := os.Stat(filepath.Join(dir, "build.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm()&0100 == 0 {
+		t.Errorf("build.sh is not executable (mode %v)", st.Mode())
+	}
+
+	// The directory is not empty anymore, so a second kernel package cannot
+	// be created in it.
+	if err := writeKernelPackage(dir, data); err == nil {
+		t.Errorf("writeKernelPackage(%s) unexpectedly succeeded on non-empty directory", dir)
+	}
+}
+
+func TestKernelArch(t *testing.T) {
+	for goarch, want := range map[string]string{
+		"arm64": "arm64",
+		"amd64": "x86_64",
+	} {
+		got, err := kernelArch(goarch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("kernelArch(%q) = %q, want %q", goarch, got, want)
+		}
+	}
+	if _, err := kernelArch("mips"); err == nil {
+		t.Errorf("kernelArch(mips) unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,209 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/packer"
+	"github.com/spf13/cobra"
+)
+
+var kernelBuildCmd = &cobra.Command{
+	Use:                   "build [flags] [dir]",
+	DisableFlagsInUseLine: true,
+	Short:                 "Build the kernel of a kernel package",
+	Long: `gok kernel build builds the kernel of the kernel package in dir (default: the
+current directory) and places vmlinuz, device tree files and lib/modules in
+the kernel package directory, ready to be picked up by gok update.
+
+Kernel packages created by gok kernel new are built in a container (using
+docker or podman, see --runtime). Kernel packages which follow the layout of
+github.com/gokrazy/kernel (i.e. contain cmd/gokr-rebuild-kernel) are built
+using their own build tooling instead.
+
+The architecture to build for defaults to the Target (or GOARCH) of the
+instance.
+
+Examples:
+  % gok -i scanner kernel build ~/kernel
+  % gok kernel build --arch=amd64 ~/kernel
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 1 {
+			fmt.Fprint(os.Stderr, `expected at most one directory
+
+`)
+			return cmd.Usage()
+		}
+		return kernelBuildImpl.run(cmd.Context(), args, "build", cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+var kernelMenuconfigCmd = &cobra.Command{
+	Use:                   "menuconfig [flags] [dir]",
+	DisableFlagsInUseLine: true,
+	Short:                 "Interactively configure the kernel of a kernel package",
+	Long: `gok kernel menuconfig runs the kernel's menuconfig for the kernel package in
+dir (default: the current directory), starting from config.txt if it exists,
+or from the defconfig plus config.addendum.txt otherwise. The resulting kernel
+config is stored in config.txt, which gok kernel build uses from then on.
+
+Examples:
+  % gok -i scanner kernel menuconfig ~/kernel
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 1 {
+			fmt.Fprint(os.Stderr, `expected at most one directory
+
+`)
+			return cmd.Usage()
+		}
+		return kernelBuildImpl.run(cmd.Context(), args, "menuconfig", cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type kernelBuildConfig struct {
+	runtime string
+	arch    string
+}
+
+var kernelBuildImpl kernelBuildConfig
+
+func init() {
+	for _, cmd := range []*cobra.Command{kernelBuildCmd, kernelMenuconfigCmd} {
+		cmd.Flags().StringVarP(&kernelBuildImpl.runtime, "runtime", "", "", "container runtime to use (docker or podman, default: whichever is installed)")
+		cmd.Flags().StringVarP(&kernelBuildImpl.arch, "arch", "", "", "GOARCH to build the kernel for (arm64 or amd64, default: Target of the instance)")
+		instanceflag.RegisterPflags(cmd.Flags())
+		kernelCmd.AddCommand(cmd)
+	}
+}
+
+// kernelArch returns the Linux ARCH for goarch.
+func kernelArch(goarch string) (string, error) {
+	switch goarch {
+	case "arm64":
+		return "arm64", nil
+	case "amd64":
+		return "x86_64", nil
+	default:
+		return "", fmt.Errorf("building kernels for GOARCH=%s is not supported (expected arm64 or amd64)", goarch)
+	}
+}
+
+// instanceGOARCH returns the GOARCH which the instance builds for: the GOARCH
+// of the Target config field, or the environment and default (see
+// packer.TargetFromEnv) if unset or the instance config cannot be read.
+func instanceGOARCH() string {
+	if cfg, err := config.ReadFromFile(); err == nil {
+		if ext, err := extconfig.For(cfg); err == nil && ext.Target != nil && ext.Target.GOARCH != "" {
+			return ext.Target.GOARCH
+		}
+	}
+	return packer.TargetFromEnv(packer.Target{}).GOARCH
+}
+
+// containerRuntime returns the container runtime to use, preferring podman
+// (which runs rootless) over docker.
+func containerRuntime(runtime string) (string, error) {
+	if runtime != "" {
+		return runtime, nil
+	}
+	for _, rt := range []string{"podman", "docker"} {
+		if _, err := exec.LookPath(rt); err == nil {
+			return rt, nil
+		}
+	}
+	return "", fmt.Errorf("neither podman nor docker found in $PATH, install one of them or specify --runtime")
+}
+
+func (r *kernelBuildConfig) run(ctx context.Context, args []string, mode string, stdout, stderr io.Writer) error {
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	goarch := r.arch
+	if goarch == "" {
+		goarch = instanceGOARCH()
+	}
+	arch, err := kernelArch(goarch)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "cmd", "gokr-rebuild-kernel")); err == nil {
+		// The kernel package comes with its own build tooling, like
+		// github.com/gokrazy/kernel does.
+		if mode != "build" {
+			return fmt.Errorf("%s: gok kernel %s is only supported for kernel packages created by gok kernel new", dir, mode)
+		}
+		rebuild := exec.CommandContext(ctx, "go", "run", "./cmd/gokr-rebuild-kernel")
+		rebuild.Dir = dir
+		rebuild.Env = withGlobalEnv(os.Environ(), "GOARCH="+goarch)
+		rebuild.Stdout = stdout
+		rebuild.Stderr = stderr
+		log.Printf("Building kernel using %s", filepath.Join(dir, "cmd", "gokr-rebuild-kernel"))
+		if err := rebuild.Run(); err != nil {
+			return fmt.Errorf("%v: %v", rebuild.Args, err)
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "build.sh")); err != nil {
+		return fmt.Errorf("%s is not a kernel package (no build.sh and no cmd/gokr-rebuild-kernel), see gok kernel new", dir)
+	}
+
+	runtime, err := containerRuntime(r.runtime)
+	if err != nil {
+		return err
+	}
+	const image = "gokrazy-kernel-build"
+	build := exec.CommandContext(ctx, runtime, "build", "-t", image, "-f", filepath.Join(dir, "Containerfile"), dir)
+	build.Stdout = stdout
+	build.Stderr = stderr
+	log.Printf("Building container image %s", image)
+	if err := build.Run(); err != nil {
+		return fmt.Errorf("%v: %v", build.Args, err)
+	}
+
+	runArgs := []string{"run", "--rm"}
+	if mode == "menuconfig" {
+		runArgs = append(runArgs, "-it")
+	}
+	// Ensure the files in the kernel package are owned by the user, not root.
+	if strings.HasSuffix(runtime, "podman") {
+		runArgs = append(runArgs, "--userns=keep-id")
+	} else {
+		runArgs = append(runArgs, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+	}
+	runArgs = append(runArgs,
+		"-v", dir+":/out",
+		"-e", "ARCH="+arch,
+		image,
+		"/out/build.sh", mode)
+	run := exec.CommandContext(ctx, runtime, runArgs...)
+	run.Stdin = os.Stdin
+	run.Stdout = stdout
+	run.Stderr = stderr
+	log.Printf("Running kernel %s for ARCH=%s in %s", mode, arch, dir)
+	if err := run.Run(); err != nil {
+		return fmt.Errorf("%v: %v", run.Args, err)
+	}
+	if mode == "build" {
+		fmt.Fprintf(stdout, "Kernel built in %s, deploy it using gok update\n", dir)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// lockCmd is gok lock.
+var lockCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "lock",
+	Short:   "Pin all build inputs of a gokrazy instance in gok.lock",
+	Long: `gok lock records the Go toolchain version, the versions of all modules
+(including the kernel, firmware and EEPROM packages) and the hashes of all
+extra files in the gok.lock file of the gokrazy instance.
+
+gok update --locked and gok overwrite --locked fail if any of these differ,
+e.g. because a module would resolve to a different version.
+
+Examples:
+  # Create or update gok.lock of instance scanner
+  % gok -i scanner lock
+
+  # Verify that gok.lock is up to date (e.g. in CI)
+  % gok -i scanner lock --check
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 0 {
+			fmt.Fprint(os.Stderr, `positional arguments are not supported
+
+`)
+			return cmd.Usage()
+		}
+		return lockImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type lockImplConfig struct {
+	check bool
+}
+
+var lockImpl lockImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(lockCmd.Flags())
+	lockCmd.Flags().BoolVarP(&lockImpl.check, "check", "", false, "do not write gok.lock, but fail if it is not up to date")
+}
+
+func (r *lockImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+
+	updateflag.SetUpdate("yes")
+
+	pack := &packer.Pack{
+		FileCfg:    cfg,
+		Env:        globalCfg.environ(),
+		HTTPClient: httpClient,
+	}
+	lock, err := pack.GenerateLock()
+	if err != nil {
+		return err
+	}
+	b, err := lock.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if r.check {
+		existing, err := os.ReadFile(packer.LockFile)
+		if err != nil {
+			return err
+		}
+		if string(existing) != string(b) {
+			return fmt.Errorf("%s is not up to date, run 'gok -i %s lock'", packer.LockFile, instanceflag.Instance())
+		}
+		fmt.Fprintf(stdout, "%s is up to date\n", packer.LockFile)
+		return nil
+	}
+
+	if err := renameio.WriteFile(packer.LockFile, b, 0644); err != nil {
+		return err
+	}
+	buildDirs := make(map[string]bool)
+	for _, m := range lock.Modules {
+		buildDirs[m.BuildDir] = true
+	}
+	fmt.Fprintf(stdout, "Locked Go %s, %d modules (in %d builddirs) and %d extra files in %s\n",
+		strings.TrimPrefix(lock.GoVersion, "go"),
+		len(lock.Modules),
+		len(buildDirs),
+		len(lock.ExtraFileHashes),
+		packer.LockFile)
+	return nil
+}
@@ -1,20 +1,25 @@
 package gok
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/donovanhide/eventsource"
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/httpclient"
 	"github.com/gokrazy/internal/instanceflag"
 	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/packer"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
@@ -25,23 +30,65 @@ var logsCmd = &cobra.Command{
 	Use:     "logs",
 	Short:   "Stream logs from a running gokrazy service",
 	Long: `Display the most recent 100 log lines from stdout and stderr each,
-and any new lines the gokrazy service produces (cancel any time with Ctrl-C)`,
+and any new lines the gokrazy service produces (cancel any time with Ctrl-C)
+
+When following multiple services (--all or --services), each line is
+prefixed with the service name.
+
+Examples:
+  # Follow the logs of the scanui service:
+  % gok -i scanner logs -s scanui
+
+  # Follow the logs of all services in the Packages config field:
+  % gok -i scanner logs --all
+
+  # Follow the logs of two services:
+  % gok -i scanner logs --services=scanui,/gokrazy/dhcp
+`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return logsImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
 	},
 }
 
 type logsImplConfig struct {
-	service string
+	service  string
+	services []string
+	all      bool
 }
 
 var logsImpl logsImplConfig
 
 func init() {
 	logsCmd.Flags().StringVarP(&logsImpl.service, "service", "s", "", "gokrazy service to fetch logs for")
+	logsCmd.Flags().StringSliceVarP(&logsImpl.services, "services", "", nil, "comma-separated list of gokrazy services to fetch logs for")
+	logsCmd.Flags().BoolVarP(&logsImpl.all, "all", "", false, "fetch logs for all services in the Packages config field")
 	instanceflag.RegisterPflags(logsCmd.Flags())
 }
 
+// servicePath returns the path of the service in the gokrazy web interface,
+// e.g. /user/scanui for scanui.
+func servicePath(service string) string {
+	if strings.HasPrefix(service, "/") {
+		return service
+	}
+	return "/user/" + service
+}
+
+// serviceNames returns the service names of all packages in cfg.Packages.
+func serviceNames(cfg *config.Struct, basenames map[string]string) []string {
+	names := make([]string, 0, len(cfg.Packages))
+	for _, pkg := range cfg.Packages {
+		if idx := strings.IndexByte(pkg, '@'); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		names = append(names, (&packer.Pkg{
+			ImportPath:       pkg,
+			BasenameOverride: basenames[pkg],
+		}).Basename())
+	}
+	return names
+}
+
 func (l *logsImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
 	cfg, err := config.ReadFromFile()
 	if err != nil {
@@ -55,8 +102,19 @@ func (l *logsImplConfig) run(ctx context.Context, args []string, stdout, stderr
 
 	updateflag.SetUpdate("yes")
 
-	if l.service == "" {
-		return fmt.Errorf("the -service flag is empty, but required")
+	services := l.services
+	if l.all {
+		ext, err := extconfig.For(cfg)
+		if err != nil {
+			return err
+		}
+		services = serviceNames(cfg, ext.Basenames())
+	}
+	if l.service != "" {
+		services = append([]string{l.service}, services...)
+	}
+	if len(services) == 0 {
+		return fmt.Errorf("the -service flag is empty, but required (or use --services or --all)")
 	}
 
 	httpClient, _, logsUrl, err := httpclient.For(cfg)
@@ -64,12 +122,12 @@ func (l *logsImplConfig) run(ctx context.Context, args []string, stdout, stderr
 		return err
 	}
 
-	q := logsUrl.Query()
-	if strings.HasPrefix(l.service, "/") {
-		q.Set("path", l.service)
-	} else {
-		q.Set("path", "/user/"+l.service)
+	if len(services) > 1 || l.all {
+		return l.multiplex(ctx, cfg, services, logsUrl, httpClient, stdout, stderr)
 	}
+
+	q := logsUrl.Query()
+	q.Set("path", servicePath(services[0]))
 	q.Set("stream", "stdout")
 	logsUrl.RawQuery = q.Encode()
 	logsUrl.Path = "/log"
@@ -78,7 +136,7 @@ func (l *logsImplConfig) run(ctx context.Context, args []string, stdout, stderr
 	logsUrl.RawQuery = q.Encode()
 	stderrUrl := logsUrl.String()
 
-	log.Printf("streaming logs of service %q from gokrazy instance %q", l.service, cfg.Hostname)
+	log.Printf("streaming logs of service %q from gokrazy instance %q", services[0], cfg.Hostname)
 	var eg errgroup.Group
 	eg.Go(func() error {
 		return l.streamLog(ctx, stdout, stdoutUrl, httpClient)
@@ -90,7 +148,7 @@ func (l *logsImplConfig) run(ctx context.Context, args []string, stdout, stderr
 		var se eventsource.SubscriptionError
 		if errors.As(err, &se) {
 			if se.Code == http.StatusNotFound {
-				return fmt.Errorf("service %q not found (HTTP code 404)", l.service)
+				return fmt.Errorf("service %q not found (HTTP code 404)", services[0])
 			}
 		}
 		return err
@@ -98,6 +156,103 @@ func (l *logsImplConfig) run(ctx context.Context, args []string, stdout, stderr
 	return nil
 }
 
+// prefixWriter prefixes every line written by a service with the service name
+// (colored when writing to a terminal). Lines of different services are
+// written atomically and never interleave.
+type prefixWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+
+	prefix string
+}
+
+func (pw *prefixWriter) Write(b []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		buf.WriteString(pw.prefix)
+		buf.WriteString(line)
+	}
+	if _, err := pw.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// logColors are ANSI color codes, cycled through for the services.
+var logColors = []int{36, 33, 32, 35, 34, 31}
+
+// useColor reports whether w is a terminal (and color is not disabled, see
+// https://no-color.org/).
+func useColor(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return st.Mode()&os.ModeCharDevice != 0
+}
+
+func (l *logsImplConfig) multiplex(ctx context.Context, cfg *config.Struct, services []string, logsUrl *url.URL, httpClient *http.Client, stdout, stderr io.Writer) error {
+	width := 0
+	for _, service := range services {
+		if len(service) > width {
+			width = len(service)
+		}
+	}
+	color := useColor(stdout)
+	var mu sync.Mutex
+
+	log.Printf("streaming logs of services %q from gokrazy instance %q", services, cfg.Hostname)
+	eg, ctx := errgroup.WithContext(ctx)
+	for idx, service := range services {
+		prefix := fmt.Sprintf("%-*s | ", width, service)
+		if color {
+			prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", logColors[idx%len(logColors)], prefix)
+		}
+		for _, stream := range []struct {
+			name string
+			w    io.Writer
+		}{
+			{"stdout", stdout},
+			{"stderr", stderr},
+		} {
+			u := *logsUrl // copy
+			q := u.Query()
+			q.Set("path", servicePath(service))
+			q.Set("stream", stream.name)
+			u.RawQuery = q.Encode()
+			u.Path = "/log"
+			w := &prefixWriter{
+				mu:     &mu,
+				w:      stream.w,
+				prefix: prefix,
+			}
+			eg.Go(func() error {
+				err := l.streamLog(ctx, w, u.String(), httpClient)
+				var se eventsource.SubscriptionError
+				if errors.As(err, &se) && se.Code == http.StatusNotFound {
+					// Do not abort streaming the logs of all other services.
+					fmt.Fprintf(w, "service not found (HTTP code 404)\n")
+					return nil
+				}
+				return err
+			})
+		}
+	}
+	return eg.Wait()
+}
+
 func (r *logsImplConfig) streamLog(ctx context.Context, w io.Writer, url string, httpClient *http.Client) error {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -117,7 +272,8 @@ func (r *logsImplConfig) streamLog(ctx context.Context, w io.Writer, url string,
 		case ev := <-stream.Events:
 			fmt.Fprintln(w, ev.Data())
 		case err := <-stream.Errors:
-			log.Printf("log streaming error: %v", err)
+			// The eventsource package reconnects automatically.
+			log.Printf("log streaming error (reconnecting): %v", err)
 		}
 	}
 }
@@ -0,0 +1,166 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd is gok migrate.
+var migrateCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "migrate",
+	Short:   "Migrate legacy per-package files (flags/, env/, …) into config.json",
+	Long: `gok migrate converts the legacy per-package configuration files of a gokrazy
+instance directory into PackageConfig entries of config.json:
+
+  flags/<pkg>/flags.txt               → CommandLineFlags
+  buildflags/<pkg>/buildflags.txt     → GoBuildFlags
+  buildtags/<pkg>/buildtags.txt       → GoBuildTags
+  env/<pkg>/env.txt                   → Environment
+  dontstart/<pkg>/dontstart.txt       → DontStart
+  waitforclock/<pkg>/waitforclock.txt → WaitForClock
+  extrafiles/<pkg>/                   → ExtraFilePaths
+
+Note that the legacy files are ignored as soon as config.json contains any
+PackageConfig entry. Existing PackageConfig settings take precedence over the
+legacy files; conflicts are reported.
+
+gok migrate does not delete the legacy files (config.json cannot hold
+comments, so any notes in the legacy files would be lost): remove them once
+you verified the migration. extrafiles/ stays in use via ExtraFilePaths.
+
+Examples:
+  # show the changes to config.json without writing them
+  % gok -i scanner migrate --dry_run
+
+  # migrate
+  % gok -i scanner migrate
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 0 {
+			fmt.Fprint(os.Stderr, `positional arguments are not supported
+
+`)
+			return cmd.Usage()
+		}
+		return migrateImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type migrateImplConfig struct {
+	dryRun bool
+}
+
+var migrateImpl migrateImplConfig
+
+func init() {
+	migrateCmd.Flags().BoolVarP(&migrateImpl.dryRun, "dry_run", "", false, "only print the changes to config.json (as a diff), do not write them")
+	instanceflag.RegisterPflags(migrateCmd.Flags())
+}
+
+// mergePackageConfig sets the fields of legacy which are not set in pc. It
+// returns the names of the fields which are set to different values in both.
+func mergePackageConfig(pc *config.PackageConfig, legacy config.PackageConfig) (conflicts []string) {
+	dst := reflect.ValueOf(pc).Elem()
+	src := reflect.ValueOf(legacy)
+	for i := 0; i < src.NumField(); i++ {
+		if src.Field(i).IsZero() {
+			continue
+		}
+		if dst.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+			continue
+		}
+		if !reflect.DeepEqual(dst.Field(i).Interface(), src.Field(i).Interface()) {
+			conflicts = append(conflicts, src.Type().Field(i).Name)
+		}
+	}
+	return conflicts
+}
+
+// migratePackageConfig merges the legacy per-package configuration files of
+// the instance in the current directory into cfg.PackageConfig. It returns
+// whether cfg was modified.
+func migratePackageConfig(cfg *config.Struct, stderr io.Writer) (bool, error) {
+	legacyCfg := *cfg
+	legacyCfg.PackageConfig = nil // read the legacy files
+	legacy, err := packer.PerPackageConfigForMigration(&legacyCfg)
+	if err != nil {
+		return false, err
+	}
+	pkgs := make([]string, 0, len(legacy))
+	for pkg := range legacy {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	modified := false
+	for _, pkg := range pkgs {
+		if cfg.PackageConfig == nil {
+			cfg.PackageConfig = make(map[string]config.PackageConfig)
+		}
+		pc := cfg.PackageConfig[pkg]
+		before := pc
+		for _, field := range mergePackageConfig(&pc, legacy[pkg]) {
+			fmt.Fprintf(stderr, "WARNING: %s: keeping %s of config.json, which differs from the legacy file\n", pkg, field)
+		}
+		if !reflect.DeepEqual(before, pc) {
+			cfg.PackageConfig[pkg] = pc
+			modified = true
+		}
+	}
+	return modified, nil
+}
+
+func (r *migrateImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+	before, err := os.ReadFile(config.InstanceConfigPath())
+	if err != nil {
+		return err
+	}
+
+	modified, err := migratePackageConfig(cfg, stderr)
+	if err != nil {
+		return err
+	}
+	if !modified {
+		fmt.Fprintf(stdout, "Nothing to migrate: %s contains the settings of all legacy per-package files (if any)\n", config.InstanceConfigPath())
+		return nil
+	}
+
+	b, err := extconfig.FormatForFile(cfg, ext)
+	if err != nil {
+		return err
+	}
+	if r.dryRun {
+		fmt.Fprintf(stdout, "--- %s\n+++ %s (migrated)\n", config.InstanceConfigPath(), config.InstanceConfigPath())
+		fmt.Fprint(stdout, lineDiff(string(before), string(b), 3))
+		return nil
+	}
+	if err := renameio.WriteFile(config.InstanceConfigPath(), b, 0600, renameio.WithExistingPermissions()); err != nil {
+		return fmt.Errorf("updating config.json: %v", err)
+	}
+	fmt.Fprintf(stdout, "Migrated the legacy per-package files into %s.\n", config.InstanceConfigPath())
+	fmt.Fprintf(stdout, "Verify the result (e.g. using gok edit), then remove the legacy files.\n")
+	return nil
+}
@@ -0,0 +1,45 @@
+package gok
+
+import (
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergePackageConfig(t *testing.T) {
+	pc := config.PackageConfig{
+		CommandLineFlags: []string{"-listen=:8080"},
+		DontStart:        true,
+	}
+	conflicts := mergePackageConfig(&pc, config.PackageConfig{
+		CommandLineFlags: []string{"-listen=:80"},
+		Environment:      []string{"TZ=Europe/Zurich"},
+		DontStart:        true,
+	})
+	want := config.PackageConfig{
+		CommandLineFlags: []string{"-listen=:8080"},
+		Environment:      []string{"TZ=Europe/Zurich"},
+		DontStart:        true,
+	}
+	if diff := cmp.Diff(want, pc); diff != "" {
+		t.Errorf("unexpected merge result: diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"CommandLineFlags"}, conflicts); diff != "" {
+		t.Errorf("unexpected conflicts: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	a := "{\n1\n2\n3\n4\n5\n6\n}\n"
+	b := "{\n1\n2\n3\n4\n5\nx\n6\n}\n"
+	want := ` 4
+ 5
++x
+ 6
+ }
+`
+	if diff := cmp.Diff("@@\n"+want, lineDiff(a, b, 2)); diff != "" {
+		t.Errorf("unexpected lineDiff: diff (-want +got):\n%s", diff)
+	}
+}
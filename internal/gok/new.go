@@ -45,6 +45,7 @@ var newImpl newImplConfig
 
 func init() {
 	instanceflag.RegisterPflags(newCmd.Flags())
+	registerNoCommitFlag(newCmd.Flags())
 	newCmd.Flags().BoolVarP(&newImpl.empty, "empty", "", false, "create an empty gokrazy instance, without the default packages")
 }
 
@@ -128,7 +129,7 @@ func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 			return err
 		}
 		if len(matches) == 0 {
-			log.Printf("No SSH keys found in %s, not adding breakglass", idPattern)
+			log.Printf("No SSH keys found in %s, not adding breakglass (add keys later using gok ssh-keys add)", idPattern)
 		}
 		if len(matches) > 0 {
 			packages = append(packages, "github.com/gokrazy/breakglass")
@@ -173,6 +174,11 @@ func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 		return err
 	}
 
+	msg := fmt.Sprintf("%s: create gokrazy instance", instance)
+	if err := commitInstanceChanges(ctx, filepath.Join(parentDir, instance), msg); err != nil {
+		return err
+	}
+
 	fmt.Printf("gokrazy instance configuration created in %s\n", configJSON)
 	fmt.Printf("(Use 'gok -i %s edit' to edit the configuration interactively.)\n", instance)
 	fmt.Println()
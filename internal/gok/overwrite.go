@@ -27,6 +27,19 @@ switch to the gok update command instead for updating over the network.
 Examples:
   # Overwrite the contents of the SD card sdx with gokrazy instance scan2drive:
   % gok -i scan2drive overwrite --full=/dev/sdx
+
+  # Build a gaf file once, then convert it into an SD card image without rebuilding:
+  % gok -i scan2drive overwrite --gaf=/tmp/scan2drive.gaf
+  % gok -i scan2drive overwrite --full=/tmp/scan2drive.img --target_storage_bytes=2147483648 --from_gaf=/tmp/scan2drive.gaf
+
+  # Build once, then write one gaf file per device type into out/:
+  % gok -i scan2drive overwrite --device_types=default,raspberrypi5,odroidhc1 --gaf_dir=out/
+
+  # Build a Raspberry Pi and a PC image (scan2drive-arm64.gaf, scan2drive-amd64.gaf):
+  % gok -i scan2drive overwrite --archs=arm64,amd64 --gaf=/tmp/scan2drive.gaf
+
+  # Build a gaf file and a signed provenance document (/tmp/scan2drive.gaf.intoto.json):
+  % gok -i scan2drive overwrite --gaf=/tmp/scan2drive.gaf --provenance --provenance_key=key.pem
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if cmd.Flags().NArg() > 0 {
@@ -49,22 +62,78 @@ type overwriteImplConfig struct {
 
 	sudo               string
 	targetStorageBytes int
+	interpolate        []string
+	locked             bool
+	strict             bool
+	verbose            bool
+	offline            bool
+	remoteBuilder      string
+	fromGaf            string
+	sizes              bool
+	noBinaryCache      bool
+	remoteCache        string
+	deviceTypes        []string
+	gafDir             string
+	archs              []string
+	provenance         bool
+	provenanceKey      string
+	mkfsPerm           bool
+	verify             bool
+	discard            string
+
+	// env contains additional environment variables (KEY=VALUE) for all go
+	// commands, see packer.Pack.Env.
+	env []string
+
+	// goarch is set for each of archs when building for multiple
+	// architectures.
+	goarch string
 }
 
 var overwriteImpl overwriteImplConfig
 
 func init() {
 	instanceflag.RegisterPflags(overwriteCmd.Flags())
+	registerJSONFlag(overwriteCmd.Flags())
+	registerTelemetryFlags(overwriteCmd.Flags())
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.full, "full", "", "", "write a full gokrazy device image to the specified device (e.g. /dev/sdx) or path (e.g. /tmp/gokrazy.img)")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.gaf, "gaf", "", "", "write a .gaf (gokrazy archive format) file to the specified path (e.g. /tmp/gokrazy.gaf)")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.boot, "boot", "", "", "write the gokrazy boot file system to the specified partition (e.g. /dev/sdx1) or path (e.g. /tmp/boot.fat)")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.root, "root", "", "", "write the gokrazy root file system to the specified partition (e.g. /dev/sdx2) or path (e.g. /tmp/root.squashfs)")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.mbr, "mbr", "", "", "write the gokrazy master boot record (MBR) to the specified device (e.g. /dev/sdx) or path (e.g. /tmp/mbr.img). only effective if -boot is specified, too")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.sudo, "sudo", "", "", "Whether to elevate privileges using sudo when required (one of auto, always, never, default auto)")
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.mkfsPerm, "mkfs_perm", "", true, "create an ext4 file system (using mkfs.ext4 from e2fsprogs) on the perm partition of --full images, populated with the PermSeed files. With --mkfs_perm=false (and no PermSeed), the perm partition is left unformatted")
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.verify, "verify", "", false, "after writing --full, read back the boot and root file systems and compare them with the written data, to detect broken SD cards or card readers")
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.discard, "discard", "", packer.DiscardUnused, "which parts of the --full device to discard (TRIM), for better write speed and longevity of SD cards and eMMC: off, unused (the unused parts of the boot and root partitions) or all (all partitions, including perm, before writing)")
 	overwriteCmd.Flags().IntVarP(&overwriteImpl.targetStorageBytes, "target_storage_bytes", "", 0, "Number of bytes which the target storage device (SD card) has. Required for using -full=<file>")
+	overwriteCmd.Flags().StringSliceVarP(&overwriteImpl.interpolate, "interpolate", "", nil, interpolateFlagUsage)
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.locked, "locked", "", false, lockedFlagUsage)
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.strict, "strict", "", false, strictFlagUsage)
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.offline, "offline", "", false, offlineFlagUsage)
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.fromGaf, "from_gaf", "", "", "path to a prebuilt .gaf (gokrazy archive format) file whose boot and root file systems to write (requires --full) instead of building")
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.remoteBuilder, "remote_builder", "", "", remoteBuilderFlagUsage)
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.sizes, "sizes", "", false, sizesFlagUsage)
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.verbose, "verbose", "v", false, verboseFlagUsage)
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.noBinaryCache, "no_binary_cache", "", false, noBinaryCacheFlagUsage)
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.remoteCache, "remote_cache", "", "", remoteCacheFlagUsage)
+	overwriteCmd.Flags().StringSliceVarP(&overwriteImpl.deviceTypes, "device_types", "", nil, "comma-separated list of device types (e.g. default,raspberrypi5,odroidhc1) for which to write a gaf file each into --gaf_dir, building the Go programs only once")
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.gafDir, "gaf_dir", "", "", "directory to write the gaf files of --device_types to")
+	overwriteCmd.Flags().StringSliceVarP(&overwriteImpl.archs, "archs", "", nil, archsFlagUsage)
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.provenance, "provenance", "", false, "write an in-toto/SLSA provenance document (describing gok version, config, Go toolchain, module versions and the image hash) to <path>.intoto.json alongside the --gaf or --full image file")
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.provenanceKey, "provenance_key", "", "", "path to a PEM-encoded ed25519 private key (e.g. from openssl genpkey -algorithm ed25519) with which to sign the --provenance document as a DSSE envelope")
 }
 
 func (r *overwriteImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if len(r.archs) > 0 {
+		if r.full == "" && r.gaf == "" && r.gafDir == "" {
+			return fmt.Errorf("--archs requires --full, --gaf or --gaf_dir")
+		}
+		if r.boot != "" || r.root != "" || r.mbr != "" || r.fromGaf != "" {
+			return fmt.Errorf("--archs cannot be combined with --boot, --root, --mbr or --from_gaf")
+		}
+		return r.runArchs(ctx, args, stdout, stderr)
+	}
+
 	fileCfg, err := config.ReadFromFile()
 	if err != nil {
 		return err
@@ -83,12 +152,44 @@ func (r *overwriteImplConfig) run(ctx context.Context, args []string, stdout, st
 		return fmt.Errorf("cannot specify both --full and --gaf")
 	}
 
+	if len(r.deviceTypes) > 0 || r.gafDir != "" {
+		if len(r.deviceTypes) == 0 || r.gafDir == "" {
+			return fmt.Errorf("--device_types and --gaf_dir must be specified together")
+		}
+		if r.full != "" || r.gaf != "" || r.boot != "" || r.root != "" || r.mbr != "" || r.fromGaf != "" {
+			return fmt.Errorf("--device_types cannot be combined with --full, --gaf, --boot, --root, --mbr or --from_gaf")
+		}
+	}
+
+	if r.provenanceKey != "" && !r.provenance {
+		return fmt.Errorf("--provenance_key requires --provenance")
+	}
+
+	switch r.discard {
+	case packer.DiscardOff, packer.DiscardUnused, packer.DiscardAll:
+	default:
+		return fmt.Errorf("invalid --discard value %q: expected one of off, unused or all", r.discard)
+	}
+
+	if r.verify && r.full == "" {
+		return fmt.Errorf("--verify requires --full")
+	}
+
+	if r.fromGaf != "" {
+		if r.full == "" {
+			return fmt.Errorf("--from_gaf requires --full")
+		}
+		if r.locked || r.remoteBuilder != "" {
+			return fmt.Errorf("--from_gaf cannot be combined with --locked or --remote_builder, as it does not build")
+		}
+	}
+
 	// gok overwrite is mutually exclusive with gok update
 	cfg.InternalCompatibilityFlags.Update = ""
 
 	// Turn all paths into absolute paths so that the output files land in the
 	// current directory despite the os.Chdir() call below.
-	for _, str := range []*string{&r.full, &r.gaf, &r.boot, &r.root, &r.mbr} {
+	for _, str := range []*string{&r.full, &r.gaf, &r.boot, &r.root, &r.mbr, &r.fromGaf, &r.gafDir, &r.provenanceKey} {
 		if *str != "" {
 			*str, err = filepath.Abs(*str)
 			if err != nil {
@@ -129,9 +230,72 @@ func (r *overwriteImplConfig) run(ctx context.Context, args []string, stdout, st
 		FileCfg: fileCfg,
 		Cfg:     cfg,
 		Output:  &output,
+
+		InterpolationAllowlist: r.interpolate,
+		Locked:                 r.locked,
+		Strict:                 r.strict,
+		Verbose:                r.verbose,
+		NoBinaryCache:          r.noBinaryCache,
+		RemoteCache:            remoteCacheURL(r.remoteCache),
+		Offline:                r.offline,
+		RemoteBuilder:          r.remoteBuilder,
+		FromGaf:                r.fromGaf,
+		PrintSizes:             r.sizes,
+		GOARCH:                 r.goarch,
+		Provenance:             r.provenance,
+		ProvenanceKey:          r.provenanceKey,
+		MkfsPerm:               r.mkfsPerm,
+		Verify:                 r.verify,
+		Discard:                r.discard,
+		Env:                    append(globalCfg.environ(), r.env...),
+		HTTPClient:             httpClient,
+	}
+
+	if len(r.deviceTypes) > 0 {
+		ctx, stop := interruptContext(ctx)
+		defer stop()
+		if jsonOutput {
+			onEvent, restore := jsonEvents(stdout)
+			defer restore()
+			pack.OnEvent = onEvent
+		}
+		return pack.BuildMatrix(ctx, "gokrazy gok", r.deviceTypes, r.gafDir)
 	}
 
-	pack.Main("gokrazy gok")
+	return runPack(ctx, pack, stdout)
+}
 
+// runArchs runs gok overwrite once per architecture of r.archs, with the
+// output paths suffixed by the architecture (see archPath).
+func (r *overwriteImplConfig) runArchs(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	// Resolve relative paths once, as run changes the working directory.
+	for _, str := range []*string{&r.full, &r.gaf, &r.gafDir, &r.provenanceKey} {
+		if *str == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*str)
+		if err != nil {
+			return err
+		}
+		*str = abs
+	}
+	for _, arch := range r.archs {
+		fmt.Fprintf(stdout, "\n=== GOARCH=%s\n\n", arch)
+		archCfg := *r
+		archCfg.archs = nil
+		archCfg.goarch = arch
+		if r.full != "" {
+			archCfg.full = archPath(r.full, arch, false)
+		}
+		if r.gaf != "" {
+			archCfg.gaf = archPath(r.gaf, arch, false)
+		}
+		if r.gafDir != "" {
+			archCfg.gafDir = archPath(r.gafDir, arch, true)
+		}
+		if err := archCfg.run(ctx, args, stdout, stderr); err != nil {
+			return fmt.Errorf("GOARCH=%s: %w", arch, err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,174 @@
+package gok
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/httpclient"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/pwgen"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// passwdCmd is gok passwd.
+var passwdCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "passwd",
+	Short:   "Rotate the HTTP password of a running gokrazy instance",
+	Long: `gok passwd generates a new HTTP password for your gokrazy instance and
+safely rotates it:
+
+1. The new password is stored in a pending file next to the host-specific
+   configuration (~/.config/gokrazy/hosts/<hostname>/http-password.pending.txt).
+2. The instance is updated (like gok update) using the current password, with
+   the new password in the new root file system.
+3. Once the device accepts the new password, it is stored where the current
+   password was configured (Update.HTTPPassword in config.json, or the
+   host-specific http-password.txt file) and the pending file is removed.
+
+If gok passwd is interrupted, run it again: it resumes with the pending
+password, skipping the update if the device already accepts it.
+
+Examples:
+  % gok -i scanner passwd
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return passwdImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type passwdImplConfig struct{}
+
+var passwdImpl passwdImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(passwdCmd.Flags())
+}
+
+// checkPassword returns whether the device accepts pw as HTTP password.
+func checkPassword(ctx context.Context, cfg *config.Struct, pw string) (bool, error) {
+	updateflag.SetUpdate("yes")
+	client, _, baseURL, err := httpclient.For(cfg)
+	if err != nil {
+		return false, err
+	}
+	u := *baseURL // copy
+	u.User = url.UserPassword("gokrazy", pw)
+	ctx, canc := context.WithTimeout(ctx, 10*time.Second)
+	defer canc()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected HTTP status: %v", resp.Status)
+}
+
+func (r *passwdImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fileCfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	if fileCfg.Update != nil {
+		if fileCfg.Update.NoPassword {
+			return fmt.Errorf("Update.NoPassword is set, there is no password to rotate")
+		}
+		if strings.Contains(fileCfg.Update.HTTPPassword, "${") {
+			return fmt.Errorf("Update.HTTPPassword references a variable or secret; change its value there and run gok update")
+		}
+	}
+
+	hostDir := string(config.HostnameSpecific(fileCfg.Hostname))
+	pendingPath := filepath.Join(hostDir, "http-password.pending.txt")
+	var newPassword string
+	if b, err := os.ReadFile(pendingPath); err == nil {
+		newPassword = strings.TrimSpace(string(b))
+		log.Printf("resuming with the pending password from %s", pendingPath)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if newPassword == "" {
+		newPassword, err = pwgen.RandomPassword(20)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(hostDir, 0700); err != nil {
+			return err
+		}
+		if err := renameio.WriteFile(pendingPath, []byte(newPassword), 0600); err != nil {
+			return err
+		}
+	}
+
+	accepted, err := checkPassword(ctx, fileCfg, newPassword)
+	if err != nil {
+		return fmt.Errorf("checking device: %v", err)
+	}
+	if accepted {
+		log.Printf("device already accepts the new password, skipping update")
+	} else {
+		pack, err := newUpdatePack()
+		if err != nil {
+			return err
+		}
+		pack.NewHTTPPassword = newPassword
+		if err := runPack(ctx, pack, stdout); err != nil {
+			return fmt.Errorf("%v (the new password is kept in %s)", err, pendingPath)
+		}
+		accepted, err := checkPassword(ctx, fileCfg, newPassword)
+		if err != nil {
+			return fmt.Errorf("verifying new password: %v (the new password is kept in %s)", err, pendingPath)
+		}
+		if !accepted {
+			return fmt.Errorf("device does not accept the new password (it is kept in %s)", pendingPath)
+		}
+	}
+
+	if fileCfg.Update != nil && fileCfg.Update.HTTPPassword != "" {
+		ext, err := extconfig.For(fileCfg)
+		if err != nil {
+			return err
+		}
+		fileCfg.Update.HTTPPassword = newPassword
+		b, err := extconfig.FormatForFile(fileCfg, ext)
+		if err != nil {
+			return err
+		}
+		if err := renameio.WriteFile(config.InstanceConfigPath(), b, 0600, renameio.WithExistingPermissions()); err != nil {
+			return fmt.Errorf("updating config.json: %v", err)
+		}
+		log.Printf("stored new password in %s", config.InstanceConfigPath())
+	} else {
+		// Store the password without a trailing \n, like gok update does.
+		pwPath := filepath.Join(hostDir, "http-password.txt")
+		if err := renameio.WriteFile(pwPath, []byte(newPassword), 0600); err != nil {
+			return err
+		}
+		log.Printf("stored new password in %s", pwPath)
+	}
+	return os.Remove(pendingPath)
+}
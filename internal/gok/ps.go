@@ -0,0 +1,72 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/spf13/cobra"
+)
+
+// psCmd is gok ps.
+var psCmd = &cobra.Command{
+	GroupID: "runtime",
+	Use:     "ps",
+	Short:   "List the services of a running gokrazy instance",
+	Long: `gok ps lists the services supervised by a running gokrazy instance,
+including their state, process ID and how often they were (re)started.
+
+Examples:
+  % gok -i scanner ps
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 0 {
+			fmt.Fprint(os.Stderr, `positional arguments are not supported
+
+`)
+			return cmd.Usage()
+		}
+
+		return psImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type psImplConfig struct{}
+
+var psImpl psImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(psCmd.Flags())
+}
+
+func (r *psImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	sc, err := newServiceClient()
+	if err != nil {
+		return err
+	}
+	services, err := sc.services(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "SERVICE\tSTATE\tPID\tSTARTS\tUPTIME\n")
+	for _, svc := range services {
+		state := "running"
+		pid := fmt.Sprint(svc.Pid)
+		uptime := time.Since(svc.StartTime).Round(time.Second).String()
+		if svc.Stopped {
+			state = "stopped"
+			pid = "-"
+			uptime = "-"
+		}
+		if svc.Diverted != "" {
+			state += " (diverted)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", svc.Path, state, pid, svc.Attempts, uptime)
+	}
+	return tw.Flush()
+}
@@ -69,7 +69,7 @@ func (r *pushConfig) run(ctx context.Context, args []string, stdout, stderr io.W
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
 	log.Printf("pushing %s (%d bytes) to %s", r.gafPath, st.Size(), url)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
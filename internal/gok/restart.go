@@ -0,0 +1,60 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/spf13/cobra"
+)
+
+// restartCmd is gok restart.
+var restartCmd = &cobra.Command{
+	GroupID:               "runtime",
+	Use:                   "restart [flags] service...",
+	DisableFlagsInUseLine: true,
+	Short:                 "Restart a service on a running gokrazy instance",
+	Long: `gok restart restarts the specified services of a running gokrazy instance.
+
+Services are specified by their name (e.g. scanui for /user/scanui)
+or by their full path (e.g. /gokrazy/dhcp).
+
+Examples:
+  % gok -i scanner restart scanui
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() < 1 {
+			fmt.Fprint(os.Stderr, `expected at least one service name
+
+`)
+			return cmd.Usage()
+		}
+
+		return restartImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type restartImplConfig struct{}
+
+var restartImpl restartImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(restartCmd.Flags())
+}
+
+func (r *restartImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	sc, err := newServiceClient()
+	if err != nil {
+		return err
+	}
+	for _, service := range args {
+		if err := sc.control(ctx, "restart", service); err != nil {
+			return err
+		}
+		log.Printf("service %s restarted", servicePath(service))
+	}
+	return nil
+}
@@ -21,6 +21,18 @@ var RootCmd = &cobra.Command{
 
 If you are unfamiliar with gokrazy, please follow:
 https://gokrazy.org/quickstart/
+
+Defaults for all instances (e.g. ParentDir, Insecure, Output, HTTPProxy,
+HTTPSProxy, NoProxy, GOPROXY and Notify) can be configured in the JSON file
+~/.config/gokrazy/gok.json (override the path with $GOKRAZY_GOK_CONFIG).
+Flags and environment variables take precedence.
+
+When the instance directory is part of a git repository, set GitCommit to true
+in gok.json to have gok add, gok get, gok edit and gok new commit their
+changes (skip a commit with --no_commit).
+
+To share built programs between machines (e.g. CI builders and laptops), set
+RemoteCache in gok.json to the URL of a remote cache (see gok cache).
 `,
 	SilenceErrors: true,
 	SilenceUsage:  true,
@@ -64,16 +76,51 @@ func init() {
 	// Cobra only parses local flags on the target command, but they can appear
 	// at any place in the command line (before or after the verb).
 	instanceflag.RegisterPflags(RootCmd.Flags())
+	registerJSONFlag(RootCmd.Flags())
+	// gok completion replaces cobra’s default completion command so that it
+	// can document the dynamic completion of instances, packages and services.
+	RootCmd.CompletionOptions.DisableDefaultCmd = true
+	cobra.OnInitialize(registerCompletions)
 	RootCmd.AddCommand(runCmd)
 	RootCmd.AddCommand(logsCmd)
+	RootCmd.AddCommand(psCmd)
+	RootCmd.AddCommand(restartCmd)
+	RootCmd.AddCommand(stopCmd)
+	RootCmd.AddCommand(execCmd)
+	RootCmd.AddCommand(scanCmd)
 	RootCmd.AddCommand(updateCmd)
+	RootCmd.AddCommand(activateCmd)
+	RootCmd.AddCommand(fleetCmd)
+	RootCmd.AddCommand(historyCmd)
+	RootCmd.AddCommand(passwdCmd)
+	RootCmd.AddCommand(buildCmd)
 	RootCmd.AddCommand(overwriteCmd)
 	RootCmd.AddCommand(versionCmd)
+	RootCmd.AddCommand(selfUpdateCmd)
+	RootCmd.AddCommand(completionCmd)
 	RootCmd.AddCommand(newCmd)
 	RootCmd.AddCommand(editCmd)
+	RootCmd.AddCommand(migrateCmd)
+	RootCmd.AddCommand(snapshotCmd)
+	RootCmd.AddCommand(restoreCmd)
+	RootCmd.AddCommand(bundleCmd)
+	RootCmd.AddCommand(doctorCmd)
+	RootCmd.AddCommand(tidyCmd)
+	RootCmd.AddCommand(vendorCmd)
+	RootCmd.AddCommand(workCmd)
+	RootCmd.AddCommand(kernelCmd)
 	RootCmd.AddCommand(addCmd)
 	RootCmd.AddCommand(getCmd)
+	RootCmd.AddCommand(upgradeCmd)
+	RootCmd.AddCommand(lockCmd)
 	RootCmd.AddCommand(sbomCmd)
+	RootCmd.AddCommand(vulnCmd)
 	RootCmd.AddCommand(pushCmd)
+	RootCmd.AddCommand(gafCmd)
+	RootCmd.AddCommand(imageCmd)
+	RootCmd.AddCommand(cacheCmd)
+	RootCmd.AddCommand(eepromCmd)
 	RootCmd.AddCommand(vmCmd)
+	RootCmd.AddCommand(secretCmd)
+	RootCmd.AddCommand(sshKeysCmd)
 }
@@ -86,6 +86,7 @@ func (r *runImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 	// Get the import path of the Go package in the current directory,
 	// e.g. github.com/stapelberg/scan2drive/cmd/scan2drive
 	list := exec.CommandContext(ctx, "go", "list")
+	list.Env = withGlobalEnv(os.Environ())
 	list.Stderr = os.Stderr
 	listb, err := list.Output()
 	if err != nil {
@@ -108,6 +109,7 @@ func (r *runImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 		// Remain in the current directory instead of building in a separate,
 		// per-package directory.
 		BuildDir: func(string) (string, error) { return "", nil },
+		Env:      globalCfg.environ(),
 	}
 	if err := buildEnv.Build(tmp, pkgs, packageBuildFlags, packageBuildTags, noBuildPkgs); err != nil {
 		return err
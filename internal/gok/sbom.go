@@ -28,6 +28,9 @@ Examples:
   # show only the hash of the SBOM
   % gok -i scanner sbom --format hash
 
+  # include the SPDX license identifiers of all Go modules
+  % gok -i scanner sbom --with_licenses
+
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return sbomImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
@@ -35,13 +38,15 @@ Examples:
 }
 
 type sbomConfig struct {
-	format string
+	format       string
+	withLicenses bool
 }
 
 var sbomImpl sbomConfig
 
 func init() {
 	sbomCmd.Flags().StringVarP(&sbomImpl.format, "format", "", "json", "output format. one of json or hash")
+	sbomCmd.Flags().BoolVarP(&sbomImpl.withLicenses, "with_licenses", "", false, "detect the licenses of all Go modules (in the module cache) that the programs are built from and include them in the SBOM")
 	instanceflag.RegisterPflags(sbomCmd.Flags())
 }
 
@@ -67,7 +72,13 @@ func (r *sbomConfig) run(ctx context.Context, args []string, stdout, stderr io.W
 	// as the SBOM should reflect what’s going into gokrazy,
 	// not its internal implementation details
 	// (i.e.  cfg.InternalCompatibilityFlags untouched).
-	sbomMarshaled, sbomWithHash, err := packer.GenerateSBOM(cfg)
+	pack := &packer.Pack{
+		FileCfg:      cfg,
+		WithLicenses: r.withLicenses,
+		Env:          globalCfg.environ(),
+		HTTPClient:   httpClient,
+	}
+	sbomMarshaled, sbomWithHash, err := pack.GenerateSBOM()
 	if os.IsNotExist(err) {
 		// Common case, handle with a good error message
 		os.Stderr.WriteString("\n")
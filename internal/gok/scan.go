@@ -0,0 +1,214 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/fleet"
+	"github.com/gokrazy/tools/internal/mdns"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// scanCmd is gok scan.
+var scanCmd = &cobra.Command{
+	GroupID: "runtime",
+	Use:     "scan",
+	Short:   "Discover gokrazy devices on the local network (mDNS)",
+	Long: `gok scan browses for gokrazy devices on the local network using mDNS/DNS-SD
+(service type _gokrazy._tcp) and prints their hostname, IP addresses, device
+model and the SBOM hash of the gokrazy installation they are running.
+
+With --selector, gok scan only prints the discovered devices which are part of
+the fleet inventory (see gok fleet --help) and match the selector, along with
+their instance and labels, and reports selected devices which were not
+discovered.
+
+With --associate, gok scan sets the Update.Hostname field of the instance to
+the address of the specified discovered device, so that gok update reaches
+the device even when its hostname does not resolve.
+
+Examples:
+  # List all gokrazy devices on the local network
+  % gok scan
+
+  # Check which lab devices are online
+  % gok scan --selector=site=lab
+
+  # Update instance scanner using the address of discovered device gokrazy
+  % gok -i scanner scan --associate=gokrazy
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return scanImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type scanImplConfig struct {
+	timeout   time.Duration
+	associate string
+	selector  string
+}
+
+var scanImpl scanImplConfig
+
+func init() {
+	scanCmd.Flags().DurationVarP(&scanImpl.timeout, "timeout", "", 2*time.Second, "how long to wait for devices to respond")
+	scanCmd.Flags().StringVarP(&scanImpl.associate, "associate", "", "", "hostname of a discovered device whose address to store in the Update.Hostname field of the instance")
+	scanCmd.Flags().StringVarP(&scanImpl.selector, "selector", "", "", selectorFlagUsage)
+	instanceflag.RegisterPflags(scanCmd.Flags())
+}
+
+// inventoryDevice returns the device of devices which svc announces, matching
+// either the instance name or the address of the device.
+func inventoryDevice(devices []fleet.Device, svc *mdns.Service) *fleet.Device {
+	for idx, d := range devices {
+		if d.Instance == svc.Hostname() {
+			return &devices[idx]
+		}
+		if d.Address == "" {
+			continue
+		}
+		if d.Address == svc.Hostname() {
+			return &devices[idx]
+		}
+		for _, ip := range svc.Addrs {
+			if d.Address == ip.String() {
+				return &devices[idx]
+			}
+		}
+	}
+	return nil
+}
+
+// deviceAddr returns the address to reach svc at, preferring IPv4.
+func deviceAddr(svc *mdns.Service) string {
+	for _, ip := range svc.Addrs {
+		if ip.To4() != nil {
+			return ip.String()
+		}
+	}
+	if len(svc.Addrs) > 0 {
+		return svc.Addrs[0].String()
+	}
+	return ""
+}
+
+func (r *scanImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	services, err := mdns.Browse(ctx, mdns.GokrazyService, r.timeout)
+	if err != nil {
+		return err
+	}
+
+	if r.associate != "" {
+		return r.associateDevice(services, stdout)
+	}
+
+	if r.selector != "" {
+		return r.printSelected(services, stdout, stderr)
+	}
+
+	if len(services) == 0 {
+		fmt.Fprintf(stderr, "no gokrazy devices found (only devices announcing %s via mDNS can be discovered)\n", mdns.GokrazyService)
+		return nil
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "HOSTNAME\tIP\tMODEL\tSBOM\n")
+	for _, svc := range services {
+		addrs := make([]string, 0, len(svc.Addrs))
+		for _, ip := range svc.Addrs {
+			addrs = append(addrs, ip.String())
+		}
+		sbom := svc.TXT["sbom"]
+		if sbom == "" {
+			sbom = "-"
+		}
+		model := svc.TXT["model"]
+		if model == "" {
+			model = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", svc.Hostname(), strings.Join(addrs, ","), model, sbom)
+	}
+	return tw.Flush()
+}
+
+// printSelected prints the discovered devices which match --selector.
+func (r *scanImplConfig) printSelected(services []*mdns.Service, stdout, stderr io.Writer) error {
+	devices, err := selectDevices(r.selector)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool)
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "INSTANCE\tHOSTNAME\tIP\tSBOM\tLABELS\n")
+	for _, svc := range services {
+		d := inventoryDevice(devices, svc)
+		if d == nil {
+			continue
+		}
+		found[d.Instance] = true
+		addrs := make([]string, 0, len(svc.Addrs))
+		for _, ip := range svc.Addrs {
+			addrs = append(addrs, ip.String())
+		}
+		sbom := svc.TXT["sbom"]
+		if sbom == "" {
+			sbom = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.Instance, svc.Hostname(), strings.Join(addrs, ","), sbom, fleet.FormatLabels(d.Labels))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	var missing []string
+	for _, d := range devices {
+		if !found[d.Instance] {
+			missing = append(missing, d.Instance)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(stderr, "%d of %d selected devices not discovered: %s\n", len(missing), len(devices), strings.Join(missing, " "))
+	}
+	return nil
+}
+
+func (r *scanImplConfig) associateDevice(services []*mdns.Service, stdout io.Writer) error {
+	var addr string
+	for _, svc := range services {
+		if svc.Hostname() == r.associate {
+			addr = deviceAddr(svc)
+			break
+		}
+	}
+	if addr == "" {
+		return fmt.Errorf("device %q not found (or it announced no address)", r.associate)
+	}
+
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.Update == nil {
+		cfg.Update = &config.UpdateStruct{}
+	}
+	cfg.Update.Hostname = addr
+	b, err := extconfig.FormatForFile(cfg, ext)
+	if err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(config.InstanceConfigPath(), b, 0600, renameio.WithExistingPermissions()); err != nil {
+		return fmt.Errorf("updating config.json: %v", err)
+	}
+	fmt.Fprintf(stdout, "set Update.Hostname of instance %q to %s (device %s)\n", instanceflag.Instance(), addr, r.associate)
+	return nil
+}
@@ -0,0 +1,28 @@
+package gok
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// secretCmd is the gok secret subcommand, which (only) has nested commands
+// like add and inject.
+var secretCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "secret",
+	Short:   "Manage encrypted secrets of a gokrazy instance",
+	Long: `Manage encrypted secrets of a gokrazy instance.
+
+Secrets are stored encrypted using age (https://age-encryption.org/) in the
+secrets directory of your gokrazy instance, so that you can check your
+instance directory into git without leaking secret values.
+
+Config values (CommandLineFlags, Environment, ExtraFileContents and
+Update.HTTPPassword) can reference secrets as ${secret:name}. gok decrypts
+secrets when building the image, using the age identity file
+~/.config/gokrazy/age-identity.txt (override with $GOKRAZY_AGE_IDENTITY).
+The SBOM only contains a hash of the encrypted secret file.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
@@ -0,0 +1,81 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/secret"
+	"github.com/spf13/cobra"
+)
+
+var secretAddCmd = &cobra.Command{
+	Use:                   "add [flags] name",
+	DisableFlagsInUseLine: true,
+	Short:                 "Encrypt a secret (read from stdin) and store it in the instance directory",
+	Long: `gok secret add encrypts the secret value read from stdin and stores it in
+the secrets directory of your gokrazy instance. Existing secrets of the same
+name are overwritten.
+
+The secret is encrypted for all age recipients listed in secrets/recipients.txt.
+If that file does not exist, it is created with the public key of your age
+identity.
+
+Examples:
+  # Store the WiFi password as secret wifi-psk:
+  % gok -i scanner secret add wifi-psk < psk.txt
+
+  # …then reference it from a config value:
+  % gok -i scanner secret inject wifi-psk \
+      --package github.com/gokrazy/wifi --file /etc/wifi.psk
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() != 1 {
+			fmt.Fprint(os.Stderr, `expected secret name
+
+`)
+			return cmd.Usage()
+		}
+
+		return secretAddImpl.run(cmd.Context(), args[0], cmd.InOrStdin(), cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+func init() {
+	secretCmd.AddCommand(secretAddCmd)
+}
+
+type secretAddConfig struct{}
+
+var secretAddImpl secretAddConfig
+
+func init() {
+	instanceflag.RegisterPflags(secretAddCmd.Flags())
+}
+
+func (r *secretAddConfig) run(ctx context.Context, name string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if err := secret.ValidateName(name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(config.InstancePath()); err != nil {
+		return fmt.Errorf("instance %q does not exist (%v), create it using 'gok -i %s new'", instanceflag.Instance(), err, instanceflag.Instance())
+	}
+	plaintext, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	if len(plaintext) == 0 {
+		return fmt.Errorf("no secret value read from stdin")
+	}
+	dir := secret.Dir(config.InstancePath())
+	if err := secret.Add(dir, name, plaintext); err != nil {
+		return err
+	}
+	log.Printf("Stored secret %q in %s", name, secret.Path(dir, name))
+	log.Printf("Reference it as ${secret:%s} in your config, see 'gok secret inject'", name)
+	return nil
+}
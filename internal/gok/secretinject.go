@@ -0,0 +1,135 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/gokrazy/tools/internal/secret"
+	"github.com/spf13/cobra"
+)
+
+var secretInjectCmd = &cobra.Command{
+	Use:                   "inject [flags] name",
+	DisableFlagsInUseLine: true,
+	Short:                 "Reference a secret from the config of a package",
+	Long: `gok secret inject adds a ${secret:name} reference to the package config of
+the specified package, either as an environment variable (--env) or as an
+extra file (--file). The secret is decrypted when building the image.
+
+Examples:
+  # Provide secret api-token as environment variable TOKEN to scanui:
+  % gok -i scanner secret inject api-token \
+      --package github.com/stapelberg/scanui --env TOKEN
+
+  # Provide secret wifi-psk as file /etc/wifi.psk:
+  % gok -i scanner secret inject wifi-psk \
+      --package github.com/gokrazy/wifi --file /etc/wifi.psk
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() != 1 {
+			fmt.Fprint(os.Stderr, `expected secret name
+
+`)
+			return cmd.Usage()
+		}
+
+		return secretInjectImpl.run(cmd.Context(), args[0], cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+func init() {
+	secretCmd.AddCommand(secretInjectCmd)
+}
+
+type secretInjectConfig struct {
+	pkg  string
+	env  string
+	file string
+}
+
+var secretInjectImpl secretInjectConfig
+
+func init() {
+	secretInjectCmd.Flags().StringVarP(&secretInjectImpl.pkg, "package", "", "", "Go package (as listed in Packages) into whose config the secret should be injected")
+	secretInjectCmd.Flags().StringVarP(&secretInjectImpl.env, "env", "", "", "name of the environment variable which should contain the secret")
+	secretInjectCmd.Flags().StringVarP(&secretInjectImpl.file, "file", "", "", "path of the extra file (e.g. /etc/wifi.psk) which should contain the secret")
+	instanceflag.RegisterPflags(secretInjectCmd.Flags())
+}
+
+func (r *secretInjectConfig) run(ctx context.Context, name string, stdout, stderr io.Writer) error {
+	if r.pkg == "" {
+		return fmt.Errorf("the --package flag is required")
+	}
+	if (r.env == "") == (r.file == "") {
+		return fmt.Errorf("exactly one of --env or --file must be specified")
+	}
+	if err := secret.ValidateName(name); err != nil {
+		return err
+	}
+	path := secret.Path(secret.Dir(config.InstancePath()), name)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("secret %q not found (%v), add it using 'gok -i %s secret add %s'", name, err, instanceflag.Instance(), name)
+	}
+
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, pkg := range cfg.Packages {
+		if pkg == r.pkg || strings.HasPrefix(pkg, r.pkg+"@") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		log.Printf("Warning: package %s is not listed in Packages", r.pkg)
+	}
+
+	if cfg.PackageConfig == nil {
+		cfg.PackageConfig = make(map[string]config.PackageConfig)
+	}
+	pc := cfg.PackageConfig[r.pkg]
+	ref := "${secret:" + name + "}"
+	if r.env != "" {
+		kv := r.env + "=" + ref
+		env := make([]string, 0, len(pc.Environment)+1)
+		for _, existing := range pc.Environment {
+			if strings.HasPrefix(existing, r.env+"=") {
+				continue // replaced below
+			}
+			env = append(env, existing)
+		}
+		pc.Environment = append(env, kv)
+		log.Printf("Setting environment variable %s for package %s", kv, r.pkg)
+	} else {
+		if pc.ExtraFileContents == nil {
+			pc.ExtraFileContents = make(map[string]string)
+		}
+		pc.ExtraFileContents[r.file] = ref
+		log.Printf("Setting extra file %s of package %s to %s", r.file, r.pkg, ref)
+	}
+	cfg.PackageConfig[r.pkg] = pc
+
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	b, err := extconfig.FormatForFile(cfg, ext)
+	if err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(config.InstanceConfigPath(), b, 0600, renameio.WithExistingPermissions()); err != nil {
+		return fmt.Errorf("updating config.json: %v", err)
+	}
+	return nil
+}
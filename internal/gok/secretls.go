@@ -0,0 +1,43 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/secret"
+	"github.com/spf13/cobra"
+)
+
+var secretLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the secrets of a gokrazy instance",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return secretLsImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+func init() {
+	secretCmd.AddCommand(secretLsCmd)
+}
+
+type secretLsConfig struct{}
+
+var secretLsImpl secretLsConfig
+
+func init() {
+	instanceflag.RegisterPflags(secretLsCmd.Flags())
+}
+
+func (r *secretLsConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	names, err := secret.List(secret.Dir(config.InstancePath()))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Fprintln(stdout, name)
+	}
+	return nil
+}
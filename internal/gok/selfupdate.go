@@ -0,0 +1,153 @@
+package gok
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/gokrazy/tools/internal/version"
+	"github.com/spf13/cobra"
+	"golang.org/x/mod/semver"
+)
+
+const toolsModule = "github.com/gokrazy/tools"
+
+// selfUpdateCmd is gok self-update.
+var selfUpdateCmd = &cobra.Command{
+	Use:   "self-update",
+	Short: "Update gok to the latest version",
+	Long: `gok self-update looks up the latest version of github.com/gokrazy/tools
+using the Go module proxy, builds gok using go install (which verifies the
+module checksum using the checksum database, see GOSUMDB) and atomically
+replaces the currently running gok executable.
+
+The go command needs to be installed.
+
+Examples:
+  # Check whether a newer version is available
+  % gok self-update --check
+
+  # Update to the latest version
+  % gok self-update
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 0 {
+			fmt.Fprint(os.Stderr, `positional arguments are not supported
+
+`)
+			return cmd.Usage()
+		}
+		return selfUpdateImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type selfUpdateImplConfig struct {
+	check   bool
+	version string
+}
+
+var selfUpdateImpl selfUpdateImplConfig
+
+func init() {
+	selfUpdateCmd.Flags().BoolVarP(&selfUpdateImpl.check, "check", "", false, "only check whether a newer version is available, do not update")
+	selfUpdateCmd.Flags().StringVarP(&selfUpdateImpl.version, "version", "", "latest", "version of github.com/gokrazy/tools to update to (e.g. a commit hash or v0.0.0-… pseudo-version)")
+}
+
+// hostGoEnv returns the environment for running the go command for the host
+// (as opposed to packer.Env, which targets the gokrazy device).
+func hostGoEnv(extra ...string) []string {
+	return withGlobalEnv(os.Environ(),
+		append([]string{
+			"GOOS=" + runtime.GOOS,
+			"GOARCH=" + runtime.GOARCH,
+		}, extra...)...)
+}
+
+// resolveToolsVersion resolves query (e.g. latest) to a module version of
+// github.com/gokrazy/tools using the module proxy.
+func resolveToolsVersion(ctx context.Context, query string) (string, error) {
+	cmd := exec.CommandContext(ctx, "go", "list", "-m", "-json", toolsModule+"@"+query)
+	cmd.Env = hostGoEnv("GO111MODULE=on")
+	cmd.Dir = os.TempDir() // outside of any module
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	var mod struct {
+		Version string
+	}
+	if err := json.Unmarshal(out, &mod); err != nil {
+		return "", err
+	}
+	return mod.Version, nil
+}
+
+// updateNeeded reports whether gok needs to be updated from version current
+// to version target, which was resolved from query. For the latest query,
+// only newer versions (see semver.Compare) are installed, so that gok does
+// not downgrade itself, e.g. when the module proxy lags behind. Explicitly
+// requested versions are installed unless they are already running.
+func updateNeeded(current, target, query string) bool {
+	if query == "latest" && semver.IsValid(current) {
+		return semver.Compare(target, current) > 0
+	}
+	return current != target
+}
+
+func (r *selfUpdateImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	current := version.Module()
+	latest, err := resolveToolsVersion(ctx, r.version)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "current version: %s\n", current)
+	fmt.Fprintf(stdout, "%s version: %s\n", r.version, latest)
+	if !updateNeeded(current, latest, r.version) {
+		fmt.Fprintf(stdout, "gok is up to date\n")
+		return nil
+	}
+	if r.check {
+		fmt.Fprintf(stdout, "run gok self-update to update\n")
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return err
+	}
+	// Build into a directory next to the executable, so that the final
+	// rename is atomic (same file system).
+	tmp, err := os.MkdirTemp(filepath.Dir(exe), ".gok-self-update")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	install := exec.CommandContext(ctx, "go", "install", toolsModule+"/cmd/gok@"+latest)
+	install.Env = hostGoEnv("GO111MODULE=on", "GOBIN="+tmp)
+	install.Dir = os.TempDir()
+	install.Stdout = stdout
+	install.Stderr = stderr
+	if err := install.Run(); err != nil {
+		return fmt.Errorf("%v: %v", install.Args, err)
+	}
+	built := filepath.Join(tmp, "gok")
+	if runtime.GOOS == "windows" {
+		built += ".exe"
+	}
+	if err := os.Rename(built, exe); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "updated %s to %s\n", exe, latest)
+	return nil
+}
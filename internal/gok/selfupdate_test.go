@@ -0,0 +1,23 @@
+package gok
+
+import "testing"
+
+func TestUpdateNeeded(t *testing.T) {
+	for _, tt := range []struct {
+		current, target, query string
+		want                   bool
+	}{
+		{"v0.0.0-20240101000000-aaaaaaaaaaaa", "v0.0.0-20240101000000-aaaaaaaaaaaa", "latest", false},
+		{"v0.0.0-20240101000000-aaaaaaaaaaaa", "v0.0.0-20240201000000-bbbbbbbbbbbb", "latest", true},
+		// The module proxy may not know about the running (newer) version.
+		{"v0.0.0-20240201000000-bbbbbbbbbbbb", "v0.0.0-20240101000000-aaaaaaaaaaaa", "latest", false},
+		{"(devel)", "v0.0.0-20240101000000-aaaaaaaaaaaa", "latest", true},
+		// Explicitly requested versions are installed, even if older.
+		{"v0.0.0-20240201000000-bbbbbbbbbbbb", "v0.0.0-20240101000000-aaaaaaaaaaaa", "aaaaaaaaaaaa", true},
+		{"v0.0.0-20240101000000-aaaaaaaaaaaa", "v0.0.0-20240101000000-aaaaaaaaaaaa", "aaaaaaaaaaaa", false},
+	} {
+		if got := updateNeeded(tt.current, tt.target, tt.query); got != tt.want {
+			t.Errorf("updateNeeded(%q, %q, %q) = %v, want %v", tt.current, tt.target, tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package gok
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/httpclient"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+)
+
+// serviceStatus is the JSON representation of a supervised service, as
+// returned by the gokrazy web interface when requesting application/json.
+type serviceStatus struct {
+	Path      string
+	Stopped   bool
+	StartTime time.Time
+	Attempts  uint64
+	Pid       int
+	Diverted  string
+}
+
+// serviceClient talks to the gokrazy web interface of a running instance.
+type serviceClient struct {
+	cfg     *config.Struct
+	client  *http.Client
+	baseURL *url.URL
+}
+
+func newServiceClient() (*serviceClient, error) {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		if os.IsNotExist(err) {
+			// best-effort compatibility for old setups
+			cfg = config.NewStruct(instanceflag.Instance())
+		} else {
+			return nil, err
+		}
+	}
+
+	updateflag.SetUpdate("yes")
+
+	httpClient, _, baseURL, err := httpclient.For(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &serviceClient{
+		cfg:     cfg,
+		client:  httpClient,
+		baseURL: baseURL,
+	}, nil
+}
+
+func (sc *serviceClient) url(path string, q url.Values) string {
+	u := *sc.baseURL // copy
+	u.Path = path
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// services returns the status of all supervised services.
+func (sc *serviceClient) services(ctx context.Context) ([]serviceStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", sc.url("/", nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected HTTP status code: got %v, want %v (body: %s)", got, want, strings.TrimSpace(string(b)))
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		return nil, fmt.Errorf("gokrazy instance %q returned Content-Type %q instead of JSON; is it running a recent gokrazy version?", sc.cfg.Hostname, ct)
+	}
+	var status struct {
+		Services []serviceStatus
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return status.Services, nil
+}
+
+// control triggers the specified action (restart or stop) of the service.
+func (sc *serviceClient) control(ctx context.Context, action, service string) error {
+	// The gokrazy web interface protects its forms with a double-submit
+	// cookie: the xsrftoken form value must match the gokrazy_xsrf cookie.
+	xsrftoken := strconv.FormatInt(int64(rand.Int31()), 10)
+	form := url.Values{
+		"path":      []string{servicePath(service)},
+		"xsrftoken": []string{xsrftoken},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", sc.url("/"+action, nil), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "gokrazy_xsrf", Value: xsrftoken})
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("service %q not found (HTTP code 404)", service)
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: unexpected HTTP status code %v (body: %s)", action, service, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// snapshotCmd is gok snapshot.
+var snapshotCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "snapshot",
+	Short:   "Archive the configuration of a gokrazy instance into a portable bundle",
+	Long: `gok snapshot archives everything needed to rebuild a gokrazy instance into a
+single bundle (a .tar.gz file), which gok restore reconstitutes on another
+machine or after losing the instance directory:
+
+- config.json, gok.lock and all other files of the instance directory
+- the go.mod and go.sum files of all builddirs (not the vendored modules)
+- extra files, including files or directories outside of the instance
+  directory to which ExtraFilePaths refer (URLs are pinned by hash)
+- the secrets/ directory, which is encrypted: the key is not included
+
+Each file is recorded with its SHA256 sum in the manifest (snapshot.json),
+together with the SBOM hash of the instance.
+
+Examples:
+  % gok -i scanner snapshot
+  % gok -i scanner snapshot --output /backup/scanner.snapshot.tar.gz
+`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return snapshotImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+// restoreCmd is gok restore.
+var restoreCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "restore <bundle>",
+	Short:   "Restore a gokrazy instance from a bundle created by gok snapshot",
+	Long: `gok restore creates a gokrazy instance directory from a bundle created by
+gok snapshot, verifying the SHA256 sum of every file. The instance is named
+like the snapshotted instance, unless you specify a different name with -i.
+gok restore refuses to overwrite an existing instance directory.
+
+ExtraFilePaths which referred to files outside of the instance directory are
+changed to refer to the restored copies in the snapshot-extrafiles/ directory
+of the instance.
+
+Examples:
+  % gok restore /backup/scanner.snapshot.tar.gz
+  % gok -i scanner2 restore --parent_dir /tmp/gokrazy scanner.snapshot.tar.gz
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		restoreImpl.instanceSet = cmd.Flags().Changed("instance")
+		return restoreImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type snapshotConfig struct {
+	output string
+}
+
+var snapshotImpl snapshotConfig
+
+type restoreConfig struct {
+	instanceSet bool
+}
+
+var restoreImpl restoreConfig
+
+func init() {
+	snapshotCmd.Flags().StringVarP(&snapshotImpl.output, "output", "o", "", "path of the bundle to write (default: <instance>.snapshot.tar.gz in the current directory)")
+	instanceflag.RegisterPflags(snapshotCmd.Flags())
+	instanceflag.RegisterPflags(restoreCmd.Flags())
+}
+
+func (r *snapshotConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	output := r.output
+	if output == "" {
+		output = instanceflag.Instance() + ".snapshot.tar.gz"
+	}
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+	updateflag.SetUpdate("yes")
+
+	f, err := renameio.TempFile("", output)
+	if err != nil {
+		return err
+	}
+	defer f.Cleanup()
+	pack := &packer.Pack{
+		FileCfg: cfg,
+	}
+	manifest, err := pack.Snapshot(f)
+	if err != nil {
+		return err
+	}
+	if err := f.CloseAtomicallyReplace(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Wrote snapshot of instance %s (%d files) to %s\n",
+		manifest.Instance, len(manifest.Files), output)
+	if _, err := os.Stat(filepath.Join(config.InstancePath(), "secrets")); err == nil {
+		fmt.Fprintf(stdout, "The secrets/ directory is encrypted: keep your key to decrypt it after gok restore\n")
+	}
+	return nil
+}
+
+func (r *restoreConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !r.instanceSet {
+		manifest, err := packer.ReadSnapshotManifest(f)
+		if err != nil {
+			return err
+		}
+		instanceflag.SetInstance(manifest.Instance)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	dir := config.InstancePath()
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("instance directory %s already exists, refusing to overwrite it", dir)
+	}
+	manifest, err := packer.RestoreSnapshot(f, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := restoreConfigFile(manifest); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Restored instance %s (snapshot of %s taken at %v) to %s\n",
+		instanceflag.Instance(), manifest.Instance, manifest.Created.Format("2006-01-02 15:04:05"), dir)
+	if manifest.SBOMHash != "" {
+		fmt.Fprintf(stdout, "SBOM hash at the time of the snapshot: %s (compare with gok sbom --format=hash)\n", manifest.SBOMHash)
+	}
+	return nil
+}
+
+// restoreConfigFile updates the config.json of the restored instance: its
+// hostname (when restoring under a different name) and ExtraFilePaths which
+// referred to files outside of the instance directory.
+func restoreConfigFile(manifest *packer.SnapshotManifest) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	changed := false
+	if manifest.Instance != instanceflag.Instance() && cfg.Hostname == manifest.Instance {
+		log.Printf("Changing hostname from %s to %s", cfg.Hostname, instanceflag.Instance())
+		cfg.Hostname = instanceflag.Instance()
+		changed = true
+	}
+	for _, ef := range manifest.ExternalExtraFiles {
+		pkgCfg, ok := cfg.PackageConfig[ef.Package]
+		if !ok || pkgCfg.ExtraFilePaths[ef.Dest] != ef.Path {
+			continue
+		}
+		pkgCfg.ExtraFilePaths[ef.Dest] = filepath.Join(config.InstancePath(), filepath.FromSlash(ef.SnapshotPath))
+		cfg.PackageConfig[ef.Package] = pkgCfg
+		log.Printf("%s: %s now refers to %s", ef.Package, ef.Dest, pkgCfg.ExtraFilePaths[ef.Dest])
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	b, err := extconfig.FormatForFile(cfg, ext)
+	if err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(config.InstanceConfigPath(), b, 0600, renameio.WithExistingPermissions()); err != nil {
+		return fmt.Errorf("updating config.json: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package gok
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/spf13/cobra"
+)
+
+// sshKeysCmd is the gok ssh-keys subcommand, which (only) has nested commands
+// like add and remove.
+var sshKeysCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "ssh-keys",
+	Short:   "Manage the SSH keys which can log into a gokrazy instance (via breakglass)",
+	Long: `Manage the SSH keys which can log into a gokrazy instance via breakglass
+(https://github.com/gokrazy/breakglass).
+
+The keys are stored in the breakglass authorized_keys file of your instance
+(breakglass.authorized_keys in the instance directory, as set up by gok new),
+which is included in the root file system as /etc/breakglass.authorized_keys.
+If breakglass is not yet set up, gok ssh-keys add sets it up.
+
+Changes take effect on the device with the next gok update, or immediately
+when using --update.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+// authorizedKey is a public key line of an authorized_keys(5) file.
+type authorizedKey struct {
+	Type    string // e.g. ssh-ed25519
+	Blob    []byte
+	Comment string
+}
+
+// parseAuthorizedKey parses a line of an authorized_keys(5) file (or of a .pub
+// file), which may start with options.
+func parseAuthorizedKey(line string) (authorizedKey, error) {
+	fields := strings.Fields(line)
+	for idx, field := range fields {
+		if !strings.HasPrefix(field, "ssh-") &&
+			!strings.HasPrefix(field, "ecdsa-") &&
+			!strings.HasPrefix(field, "sk-") {
+			continue
+		}
+		if idx+1 >= len(fields) {
+			break
+		}
+		blob, err := base64.StdEncoding.DecodeString(fields[idx+1])
+		if err != nil {
+			return authorizedKey{}, fmt.Errorf("invalid public key %q: %v", fields[idx+1], err)
+		}
+		return authorizedKey{
+			Type:    field,
+			Blob:    blob,
+			Comment: strings.Join(fields[idx+2:], " "),
+		}, nil
+	}
+	return authorizedKey{}, fmt.Errorf("no public key found in %q", line)
+}
+
+// Fingerprint returns the SHA256 fingerprint of k, like ssh-keygen -l.
+func (k authorizedKey) Fingerprint() string {
+	sum := sha256.Sum256(k.Blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// authorizedKeysFile is an authorized_keys(5) file, retaining comments.
+type authorizedKeysFile struct {
+	path  string
+	lines []string
+}
+
+func readAuthorizedKeysFile(path string) (*authorizedKeysFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		hostname, _ := os.Hostname()
+		b = []byte("# This authorized_keys(5) file allows access from keys on " + hostname + "\n")
+	}
+	return &authorizedKeysFile{
+		path:  path,
+		lines: strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"),
+	}, nil
+}
+
+// keys returns the keys of f by line index.
+func (f *authorizedKeysFile) keys() map[int]authorizedKey {
+	keys := make(map[int]authorizedKey)
+	for idx, line := range f.lines {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		k, err := parseAuthorizedKey(line)
+		if err != nil {
+			log.Printf("%s:%d: %v", f.path, idx+1, err)
+			continue
+		}
+		keys[idx] = k
+	}
+	return keys
+}
+
+// add adds the key line (from source) to f, unless it is already present.
+func (f *authorizedKeysFile) add(line, source string) (bool, error) {
+	k, err := parseAuthorizedKey(line)
+	if err != nil {
+		return false, err
+	}
+	for _, existing := range f.keys() {
+		if string(existing.Blob) == string(k.Blob) {
+			return false, nil
+		}
+	}
+	f.lines = append(f.lines, "", "# "+source, strings.TrimSpace(line))
+	return true, nil
+}
+
+// remove removes the keys for which match returns true (and the comment line
+// directly preceding them) from f, returning the removed keys.
+func (f *authorizedKeysFile) remove(match func(authorizedKey) bool) []authorizedKey {
+	keys := f.keys()
+	drop := make(map[int]bool)
+	var removed []authorizedKey
+	for idx, k := range keys {
+		if !match(k) {
+			continue
+		}
+		removed = append(removed, k)
+		drop[idx] = true
+		if idx > 0 && strings.HasPrefix(f.lines[idx-1], "#") {
+			drop[idx-1] = true
+		}
+	}
+	var lines []string
+	for idx, line := range f.lines {
+		if drop[idx] {
+			continue
+		}
+		if line == "" && len(lines) > 0 && lines[len(lines)-1] == "" {
+			continue // collapse empty lines
+		}
+		lines = append(lines, line)
+	}
+	f.lines = lines
+	return removed
+}
+
+func (f *authorizedKeysFile) write() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	b := []byte(strings.Join(f.lines, "\n") + "\n")
+	return renameio.WriteFile(f.path, b, 0600, renameio.WithExistingPermissions())
+}
+
+// ensureBreakglass sets up the breakglass package (with an authorized_keys
+// file in the instance directory) in the config of the instance, unless it is
+// already set up, and returns the path of the authorized_keys file.
+func ensureBreakglass(cfg *config.Struct) (string, error) {
+	pc := cfg.PackageConfig[breakglassPkg]
+	if path, ok := breakglassAuthorizedKeysPath(pc); ok && breakglassInstalled(cfg) {
+		return path, nil
+	}
+	path := filepath.Join(config.InstancePath(), "breakglass.authorized_keys")
+	if !breakglassInstalled(cfg) {
+		cfg.Packages = append(cfg.Packages, breakglassPkg)
+	}
+	if existing, ok := breakglassAuthorizedKeysPath(pc); ok {
+		path = existing
+	} else {
+		if pc.ExtraFilePaths == nil {
+			pc.ExtraFilePaths = make(map[string]string)
+		}
+		pc.ExtraFilePaths[breakglassAuthorizedKeys] = path
+		pc.CommandLineFlags = append(pc.CommandLineFlags, "-authorized_keys="+breakglassAuthorizedKeys)
+	}
+	if cfg.PackageConfig == nil {
+		cfg.PackageConfig = make(map[string]config.PackageConfig)
+	}
+	cfg.PackageConfig[breakglassPkg] = pc
+
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return "", err
+	}
+	b, err := extconfig.FormatForFile(cfg, ext)
+	if err != nil {
+		return "", err
+	}
+	if err := renameio.WriteFile(config.InstanceConfigPath(), b, 0600, renameio.WithExistingPermissions()); err != nil {
+		return "", fmt.Errorf("updating config.json: %v", err)
+	}
+	log.Printf("set up %s with authorized_keys file %s", breakglassPkg, path)
+	return path, nil
+}
+
+// updateAfterKeyChange runs gok update (for --update) so that the changed
+// authorized_keys file takes effect.
+func updateAfterKeyChange(ctx context.Context, stdout io.Writer) error {
+	pack, err := newUpdatePack()
+	if err != nil {
+		return err
+	}
+	return runPack(ctx, pack, stdout)
+}
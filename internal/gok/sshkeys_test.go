@@ -0,0 +1,66 @@
+package gok
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	aliceKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIJxIB8vyBaunV2/yYq4ICfzqP9rSxXDC/pGrtk9vDWn alice@laptop"
+	bobKey   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMpMjeAT/edKR9Z9kR1tPcUe7aTHxRF+OPD0msor3e91 bob@desktop"
+)
+
+func TestParseAuthorizedKey(t *testing.T) {
+	k, err := parseAuthorizedKey(`no-pty,from="10.0.0.0/8" ` + aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := k.Type, "ssh-ed25519"; got != want {
+		t.Errorf("Type = %q, want %q", got, want)
+	}
+	if got, want := k.Comment, "alice@laptop"; got != want {
+		t.Errorf("Comment = %q, want %q", got, want)
+	}
+	// as printed by ssh-keygen -l
+	if got, want := k.Fingerprint(), "SHA256:TvSV8NonkhnBavTlNHUfMxE3GYYks1VjvkaPoieOnG4"; got != want {
+		t.Errorf("Fingerprint() = %q, want %q", got, want)
+	}
+	if _, err := parseAuthorizedKey("# just a comment"); err == nil {
+		t.Errorf("parseAuthorizedKey(comment) succeeded unexpectedly")
+	}
+}
+
+func TestAuthorizedKeysFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breakglass.authorized_keys")
+	if err := os.WriteFile(path, []byte("# header\n\n# id_ed25519.pub\n"+aliceKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readAuthorizedKeysFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, err := f.add(aliceKey, "stdin"); err != nil || added {
+		t.Errorf("add(duplicate) = %v, %v, want false, nil", added, err)
+	}
+	if added, err := f.add(bobKey, "bob.pub"); err != nil || !added {
+		t.Errorf("add(bob) = %v, %v, want true, nil", added, err)
+	}
+	removed := f.remove(func(k authorizedKey) bool { return k.Comment == "alice@laptop" })
+	if len(removed) != 1 {
+		t.Errorf("remove(alice) removed %d keys, want 1", len(removed))
+	}
+	if err := f.write(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# header\n\n# bob.pub\n" + bobKey + "\n"
+	if diff := cmp.Diff(want, string(b)); diff != "" {
+		t.Errorf("authorized_keys: unexpected diff (-want +got):\n%s", diff)
+	}
+}
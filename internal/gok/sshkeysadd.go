@@ -0,0 +1,116 @@
+package gok
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/spf13/cobra"
+)
+
+var sshKeysAddCmd = &cobra.Command{
+	Use:                   "add [flags] <file.pub|->...",
+	DisableFlagsInUseLine: true,
+	Short:                 "Allow SSH public keys to log into a gokrazy instance",
+	Long: `gok ssh-keys add adds the public keys from the specified files (or from
+stdin, for -) to the breakglass authorized_keys file of your instance. Keys
+which are already present are skipped.
+
+Examples:
+  % gok -i scanner ssh-keys add ~/.ssh/id_ed25519.pub
+
+  # Add a team member’s key and update the device right away:
+  % curl https://github.com/<user>.keys | gok -i scanner ssh-keys add --update -
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() == 0 {
+			fmt.Fprint(os.Stderr, `expected at least one public key file
+
+`)
+			return cmd.Usage()
+		}
+		return sshKeysAddImpl.run(cmd.Context(), args, cmd.InOrStdin(), cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+func init() {
+	sshKeysCmd.AddCommand(sshKeysAddCmd)
+}
+
+type sshKeysAddConfig struct {
+	update bool
+}
+
+var sshKeysAddImpl sshKeysAddConfig
+
+func init() {
+	sshKeysAddCmd.Flags().BoolVarP(&sshKeysAddImpl.update, "update", "", false, "update the instance (like gok update) after adding the keys")
+	instanceflag.RegisterPflags(sshKeysAddCmd.Flags())
+}
+
+func (r *sshKeysAddConfig) run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	path, err := ensureBreakglass(cfg)
+	if err != nil {
+		return err
+	}
+	f, err := readAuthorizedKeysFile(path)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, arg := range args {
+		var b []byte
+		source := arg
+		if arg == "-" {
+			source = "stdin"
+			b, err = io.ReadAll(stdin)
+		} else {
+			b, err = os.ReadFile(arg)
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			ok, err := f.add(line, source)
+			if err != nil {
+				return fmt.Errorf("%s: %v", source, err)
+			}
+			if !ok {
+				log.Printf("%s: key already present, skipping", source)
+				continue
+			}
+			added++
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	if added == 0 {
+		log.Printf("no new keys to add")
+		return nil
+	}
+	if err := f.write(); err != nil {
+		return err
+	}
+	log.Printf("added %d key(s) to %s", added, path)
+	if r.update {
+		return updateAfterKeyChange(ctx, stdout)
+	}
+	return nil
+}
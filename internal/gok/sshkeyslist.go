@@ -0,0 +1,62 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/spf13/cobra"
+)
+
+var sshKeysListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List the SSH keys which can log into a gokrazy instance",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sshKeysListImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+func init() {
+	sshKeysCmd.AddCommand(sshKeysListCmd)
+}
+
+type sshKeysListConfig struct{}
+
+var sshKeysListImpl sshKeysListConfig
+
+func init() {
+	instanceflag.RegisterPflags(sshKeysListCmd.Flags())
+}
+
+func (r *sshKeysListConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	path, ok := breakglassAuthorizedKeysPath(cfg.PackageConfig[breakglassPkg])
+	if !ok {
+		return fmt.Errorf("instance %q has no breakglass authorized_keys file, add keys using 'gok -i %s ssh-keys add'", instanceflag.Instance(), instanceflag.Instance())
+	}
+	f, err := readAuthorizedKeysFile(path)
+	if err != nil {
+		return err
+	}
+	keys := f.keys()
+	idxs := make([]int, 0, len(keys))
+	for idx := range keys {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "TYPE\tFINGERPRINT\tCOMMENT\n")
+	for _, idx := range idxs {
+		k := keys[idx]
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", k.Type, k.Fingerprint(), k.Comment)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,89 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/spf13/cobra"
+)
+
+var sshKeysRemoveCmd = &cobra.Command{
+	Use:                   "remove [flags] <fingerprint|comment>...",
+	DisableFlagsInUseLine: true,
+	Short:                 "Revoke SSH keys from a gokrazy instance",
+	Long: `gok ssh-keys remove removes the keys with the specified fingerprints (as
+printed by gok ssh-keys list) or comments (e.g. user@host) from the breakglass
+authorized_keys file of your instance.
+
+Examples:
+  % gok -i scanner ssh-keys remove --update alice@laptop
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() == 0 {
+			fmt.Fprint(os.Stderr, `expected at least one fingerprint or comment
+
+`)
+			return cmd.Usage()
+		}
+		return sshKeysRemoveImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+func init() {
+	sshKeysCmd.AddCommand(sshKeysRemoveCmd)
+}
+
+type sshKeysRemoveConfig struct {
+	update bool
+}
+
+var sshKeysRemoveImpl sshKeysRemoveConfig
+
+func init() {
+	sshKeysRemoveCmd.Flags().BoolVarP(&sshKeysRemoveImpl.update, "update", "", false, "update the instance (like gok update) after removing the keys")
+	instanceflag.RegisterPflags(sshKeysRemoveCmd.Flags())
+}
+
+func (r *sshKeysRemoveConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	path, ok := breakglassAuthorizedKeysPath(cfg.PackageConfig[breakglassPkg])
+	if !ok {
+		return fmt.Errorf("instance %q has no breakglass authorized_keys file", instanceflag.Instance())
+	}
+	f, err := readAuthorizedKeysFile(path)
+	if err != nil {
+		return err
+	}
+	removed := f.remove(func(k authorizedKey) bool {
+		for _, arg := range args {
+			if arg == k.Fingerprint() || (k.Comment != "" && arg == k.Comment) {
+				return true
+			}
+		}
+		return false
+	})
+	if len(removed) == 0 {
+		return fmt.Errorf("no matching keys found in %s (see gok ssh-keys list)", path)
+	}
+	if len(f.keys()) == 0 {
+		log.Printf("warning: no keys left in %s, breakglass logins will not be possible", path)
+	}
+	if err := f.write(); err != nil {
+		return err
+	}
+	for _, k := range removed {
+		log.Printf("removed %s %s %s", k.Type, k.Fingerprint(), k.Comment)
+	}
+	if r.update {
+		return updateAfterKeyChange(ctx, stdout)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/spf13/cobra"
+)
+
+// stopCmd is gok stop.
+var stopCmd = &cobra.Command{
+	GroupID:               "runtime",
+	Use:                   "stop [flags] service...",
+	DisableFlagsInUseLine: true,
+	Short:                 "Stop a service on a running gokrazy instance",
+	Long: `gok stop stops the specified services of a running gokrazy instance.
+
+Services are specified by their name (e.g. scanui for /user/scanui)
+or by their full path (e.g. /gokrazy/dhcp).
+
+Examples:
+  % gok -i scanner stop scanui
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() < 1 {
+			fmt.Fprint(os.Stderr, `expected at least one service name
+
+`)
+			return cmd.Usage()
+		}
+
+		return stopImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type stopImplConfig struct{}
+
+var stopImpl stopImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(stopCmd.Flags())
+}
+
+func (r *stopImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	sc, err := newServiceClient()
+	if err != nil {
+		return err
+	}
+	for _, service := range args {
+		if err := sc.control(ctx, "stop", service); err != nil {
+			return err
+		}
+		log.Printf("service %s stopped", servicePath(service))
+	}
+	return nil
+}
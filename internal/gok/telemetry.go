@@ -0,0 +1,72 @@
+package gok
+
+import (
+	"os"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/internal/telemetry"
+	"github.com/spf13/pflag"
+)
+
+// otlpEndpoint and pushgateway are set by the flags of registerTelemetryFlags.
+var (
+	otlpEndpoint string
+	pushgateway  string
+)
+
+func registerTelemetryFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&otlpEndpoint, "otlp_endpoint", "", "", "base URL of an OpenTelemetry collector (e.g. http://localhost:4318) to export build/update spans and metrics to via OTLP/HTTP. Defaults to the OTLPEndpoint global config field or $OTEL_EXPORTER_OTLP_ENDPOINT. Additional headers are read from $OTEL_EXPORTER_OTLP_HEADERS")
+	fs.StringVarP(&pushgateway, "pushgateway", "", "", "base URL of a Prometheus Pushgateway (e.g. http://localhost:9091) to push build/update metrics to (job gok, instance <instance>). Defaults to the Pushgateway global config field")
+}
+
+// newTelemetryExporter returns the exporter configured by flags, the global
+// config or the environment (in that order of precedence).
+func newTelemetryExporter() (*telemetry.Exporter, error) {
+	e := &telemetry.Exporter{
+		OTLPEndpoint: otlpEndpoint,
+		Pushgateway:  pushgateway,
+		Client:       httpClient,
+	}
+	if e.OTLPEndpoint == "" {
+		e.OTLPEndpoint = globalCfg.OTLPEndpoint
+	}
+	if e.OTLPEndpoint == "" {
+		e.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if e.Pushgateway == "" {
+		e.Pushgateway = globalCfg.Pushgateway
+	}
+	if e.OTLPEndpoint != "" {
+		headers, err := telemetry.ParseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		if err != nil {
+			return nil, err
+		}
+		e.OTLPHeaders = headers
+	}
+	return e, nil
+}
+
+// packOperation returns the name of the operation which pack performs, for
+// telemetry.
+func packOperation(pack *packer.Pack) string {
+	if pack.Cfg != nil &&
+		pack.Cfg.InternalCompatibilityFlags != nil &&
+		pack.Cfg.InternalCompatibilityFlags.Update != "" {
+		return "update"
+	}
+	return "overwrite"
+}
+
+// newTelemetryRecorder returns a recorder for pack, or nil if no telemetry
+// exporter is configured.
+func newTelemetryRecorder(pack *packer.Pack) (*telemetry.Exporter, *telemetry.Recorder, error) {
+	exporter, err := newTelemetryExporter()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exporter.Enabled() {
+		return nil, nil, nil
+	}
+	return exporter, telemetry.NewRecorder(packOperation(pack), instanceflag.Instance()), nil
+}
@@ -0,0 +1,144 @@
+package gok
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// tidyCmd is gok tidy.
+var tidyCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "tidy",
+	Short:   "Remove unused builddirs and report dangling replace directives",
+	Long: `gok tidy cleans up the builddir/ tree of a gokrazy instance:
+
+1. builddirs (directories with a go.mod file) which none of the packages of
+   the instance is built in anymore (e.g. after removing or renaming a
+   package) are removed, after asking for confirmation (see --yes).
+
+2. replace directives which refer to local directories that do not exist
+   anymore are reported, and removed with --fix_replaces (so that the module
+   is downloaded instead).
+
+Examples:
+  # show what would be removed
+  % gok -i scanner tidy --dry_run
+
+  # remove unused builddirs without asking, and remove dangling replaces
+  % gok -i scanner tidy --yes --fix_replaces
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 0 {
+			fmt.Fprint(os.Stderr, `positional arguments are not supported
+
+`)
+			return cmd.Usage()
+		}
+		return tidyImpl.run(cmd.Context(), args, cmd.InOrStdin(), cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type tidyImplConfig struct {
+	dryRun      bool
+	yes         bool
+	fixReplaces bool
+}
+
+var tidyImpl tidyImplConfig
+
+func init() {
+	tidyCmd.Flags().BoolVarP(&tidyImpl.dryRun, "dry_run", "", false, "only report unused builddirs and dangling replace directives, do not modify anything")
+	tidyCmd.Flags().BoolVarP(&tidyImpl.yes, "yes", "", false, "remove unused builddirs without asking for confirmation")
+	tidyCmd.Flags().BoolVarP(&tidyImpl.fixReplaces, "fix_replaces", "", false, "remove replace directives which refer to directories that do not exist")
+	instanceflag.RegisterPflags(tidyCmd.Flags())
+}
+
+// confirm asks question on stdout and returns whether the user answered yes.
+func confirm(stdin io.Reader, stdout io.Writer, question string) bool {
+	fmt.Fprintf(stdout, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func (r *tidyImplConfig) run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	if cfg.InternalCompatibilityFlags == nil {
+		cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
+	}
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+
+	unused, err := packer.UnusedBuildDirs(cfg, ext)
+	if err != nil {
+		return err
+	}
+	if len(unused) > 0 {
+		fmt.Fprintf(stdout, "Unused builddirs:\n")
+		for _, dir := range unused {
+			fmt.Fprintf(stdout, "  %s\n", dir)
+		}
+		switch {
+		case r.dryRun:
+		case r.yes || confirm(stdin, stdout, fmt.Sprintf("Remove these %d builddirs?", len(unused))):
+			for _, dir := range unused {
+				if err := os.RemoveAll(dir); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(stdout, "Removed %d unused builddirs.\n", len(unused))
+		default:
+			fmt.Fprintf(stdout, "Not removing unused builddirs.\n")
+		}
+	}
+
+	dirs, err := packer.BuildDirs()
+	if err != nil {
+		return err
+	}
+	var dangling int
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue // removed above
+		}
+		replaces, err := packer.DanglingReplaces(dir)
+		if err != nil {
+			return err
+		}
+		for _, rep := range replaces {
+			fmt.Fprintf(stdout, "%s/go.mod: replace %s => %s: directory does not exist\n", dir, rep.Old.Path, rep.New.Path)
+		}
+		dangling += len(replaces)
+		if len(replaces) > 0 && r.fixReplaces && !r.dryRun {
+			if err := packer.DropReplaces(dir, replaces); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "%s/go.mod: removed %d replace directives\n", dir, len(replaces))
+		}
+	}
+	if dangling > 0 && !r.fixReplaces {
+		fmt.Fprintf(stdout, "Use --fix_replaces to remove the dangling replace directives.\n")
+	}
+	if len(unused) == 0 && dangling == 0 {
+		fmt.Fprintf(stdout, "Nothing to tidy.\n")
+	}
+	return nil
+}
@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/fleet"
 	"github.com/gokrazy/tools/internal/packer"
 	"github.com/spf13/cobra"
 )
@@ -18,6 +22,44 @@ var updateCmd = &cobra.Command{
 	Use:     "update",
 	Short:   "Build a gokrazy instance and update over the network",
 	Long: `Build a gokrazy instance and update over the network.
+
+With --from_gaf, gok update deploys a prebuilt .gaf file (e.g. built in CI
+using gok overwrite --gaf) instead of building, which allows separating build
+machines from deploy machines.
+
+Update.Hostname may be an IPv6 address, including link-local addresses with
+a zone (e.g. fe80::1%eth0).
+
+With --serial, gok update uploads the new images over the serial console of
+the device (which needs to run a gokrazy version with serial update support)
+instead of over the network.
+
+Examples:
+  # Build and deploy instance scanner
+  % gok -i scanner update
+
+  # Deploy a prebuilt gaf file to instance scanner
+  % gok -i scanner update --from_gaf=/tmp/scanner.gaf
+
+  # Update instance scanner over its serial console (e.g. broken network config)
+  % gok -i scanner update --serial=/dev/ttyUSB0
+
+  # Update instance scanner, which is power-cycled by a timer switch
+  % gok -i scanner update --no_reboot
+
+  # Update instance scanner now, but reboot it during the maintenance window
+  % gok -i scanner update --activate_at=2024-09-01T03:00:00+02:00
+  % gok -i scanner activate   # e.g. from a cron job, waits until 03:00
+
+  # Update instance scanner, preferring its IPv6 address
+  % gok -i scanner update --address_family=ipv6
+
+  # Update all devices of the fleet inventory at site lab (see gok fleet --help)
+  % gok update --selector=site=lab
+
+  # Export spans and metrics (build duration per package, upload throughput,
+  # failures) to an OpenTelemetry collector
+  % gok -i scanner update --otlp_endpoint=http://localhost:4318
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if cmd.Flags().NArg() > 0 {
@@ -27,21 +69,88 @@ var updateCmd = &cobra.Command{
 			return cmd.Usage()
 		}
 
+		if updateImpl.selector != "" {
+			return updateImpl.runSelected(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+		}
 		return updateImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
 	},
 }
 
 type updateImplConfig struct {
-	insecure bool
-	testboot bool
+	insecure          bool
+	testboot          bool
+	interpolate       []string
+	uploadConcurrency int
+	locked            bool
+	strict            bool
+	verbose           bool
+	offline           bool
+	remoteBuilder     string
+	fromGaf           string
+	rebootTimeout     time.Duration
+	pollInterval      time.Duration
+	noReboot          bool
+	activateAt        string
+	serial            string
+	serialBaud        int
+	addressFamily     string
+	sizes             bool
+	noBinaryCache     bool
+	remoteCache       string
+	selector          string
 }
 
 var updateImpl updateImplConfig
 
+// interpolateFlagUsage, lockedFlagUsage, strictFlagUsage, offlineFlagUsage,
+// remoteBuilderFlagUsage, sizesFlagUsage, verboseFlagUsage,
+// noBinaryCacheFlagUsage and remoteCacheFlagUsage are shared between gok update and gok overwrite (and
+// partially gok build).
+const (
+	interpolateFlagUsage = "comma-separated list of environment variables (e.g. WIFI_PSK) and files (e.g. file:/etc/secrets/psk.txt, or file:/etc/secrets/ for a whole directory) which may be referenced as ${WIFI_PSK} or ${file:/etc/secrets/psk.txt} in CommandLineFlags, Environment, ExtraFileContents and Update.HTTPPassword. Interpolation is disabled unless this flag is set."
+
+	lockedFlagUsage = "fail if the Go toolchain, module versions or extra files differ from gok.lock (see gok lock)"
+
+	strictFlagUsage = "fail if per-package configuration does not take effect: legacy files (e.g. flags/<pkg>/flags.txt) or PackageConfig entries for packages which are not part of the build, e.g. after renaming a package (see gok doctor)"
+
+	offlineFlagUsage = "fail instead of downloading modules, Go toolchains or extra files, e.g. in air-gapped environments. Uses the module cache in the modcache/ directory of the instance, if any (see gok vendor)"
+
+	remoteBuilderFlagUsage = "build the Go packages on a remote builder via SSH instead of locally, e.g. ssh://user@builder. Overrides the RemoteBuilder config field"
+
+	verboseFlagUsage = "print the output of go build for each program while building. It is always stored in the build-logs/ directory of the instance"
+
+	sizesFlagUsage = "print the size of each program and how it (and its module versions) changed compared to the previous build (see builddir/build-metadata.json in the instance directory)"
+
+	noBinaryCacheFlagUsage = "build all programs, instead of reusing programs whose inputs (go.mod, go.sum, sources of local modules, Go toolchain, build flags and target) did not change since they were last built"
+
+	remoteCacheFlagUsage = "URL of a remote binary cache shared with other machines building the same instance, e.g. s3://bucket/gokrazy, gs://bucket/gokrazy or https://cache.example.com/gokrazy (see gok cache). Defaults to $GOKRAZY_REMOTE_CACHE or the RemoteCache global config field"
+)
+
 func init() {
 	instanceflag.RegisterPflags(updateCmd.Flags())
+	registerJSONFlag(updateCmd.Flags())
+	registerTelemetryFlags(updateCmd.Flags())
 	updateCmd.Flags().BoolVarP(&updateImpl.insecure, "insecure", "", false, "Disable TLS stripping detection. Should only be used when first enabling TLS, not permanently.")
 	updateCmd.Flags().BoolVarP(&updateImpl.testboot, "testboot", "", false, "Trigger a testboot instead of switching to the new root partition directly")
+	updateCmd.Flags().IntVarP(&updateImpl.uploadConcurrency, "upload_concurrency", "", 1, "maximum number of files (root file system, device-specific files) to upload in parallel. Updates over --serial are always sequential")
+	updateCmd.Flags().StringSliceVarP(&updateImpl.interpolate, "interpolate", "", nil, interpolateFlagUsage)
+	updateCmd.Flags().BoolVarP(&updateImpl.locked, "locked", "", false, lockedFlagUsage)
+	updateCmd.Flags().BoolVarP(&updateImpl.strict, "strict", "", false, strictFlagUsage)
+	updateCmd.Flags().BoolVarP(&updateImpl.offline, "offline", "", false, offlineFlagUsage)
+	updateCmd.Flags().StringVarP(&updateImpl.fromGaf, "from_gaf", "", "", "path to a prebuilt .gaf (gokrazy archive format) file (e.g. built in CI using gok overwrite --gaf) to deploy instead of building")
+	updateCmd.Flags().StringVarP(&updateImpl.remoteBuilder, "remote_builder", "", "", remoteBuilderFlagUsage)
+	updateCmd.Flags().DurationVarP(&updateImpl.rebootTimeout, "reboot_timeout", "", 0, "how long to wait for the device to become reachable with the new version after rebooting. Overrides the RebootTimeout config field (default 5m)")
+	updateCmd.Flags().DurationVarP(&updateImpl.pollInterval, "poll_interval", "", 0, "how long to wait between checking whether the device runs the new version. Overrides the PollInterval config field (default 1s)")
+	updateCmd.Flags().StringVarP(&updateImpl.serial, "serial", "", "", "update over the serial console connected to this serial port (e.g. /dev/ttyUSB0) instead of over the network, e.g. to recover a device with broken network configuration")
+	updateCmd.Flags().IntVarP(&updateImpl.serialBaud, "serial_baud", "", 115200, "baud rate of the serial console (see --serial)")
+	updateCmd.Flags().StringVarP(&updateImpl.addressFamily, "address_family", "", "", "address family (ipv4 or ipv6) to try first when connecting to the device, overriding the UpdateAddressFamily config field")
+	updateCmd.Flags().BoolVarP(&updateImpl.sizes, "sizes", "", false, sizesFlagUsage)
+	updateCmd.Flags().BoolVarP(&updateImpl.verbose, "verbose", "v", false, verboseFlagUsage)
+	updateCmd.Flags().BoolVarP(&updateImpl.noBinaryCache, "no_binary_cache", "", false, noBinaryCacheFlagUsage)
+	updateCmd.Flags().StringVarP(&updateImpl.remoteCache, "remote_cache", "", "", remoteCacheFlagUsage)
+	updateCmd.Flags().BoolVarP(&updateImpl.noReboot, "no_reboot", "", false, "switch to the new root partition, but do not reboot the device (or wait for it), e.g. for devices which are power-cycled externally")
+	updateCmd.Flags().StringVarP(&updateImpl.selector, "selector", "", "", selectorFlagUsage+". Updates the devices one after the other (see also gok fleet rollout)")
+	updateCmd.Flags().StringVarP(&updateImpl.activateAt, "activate_at", "", "", "switch to the new root partition, but do not reboot the device. Instead, gok activate reboots the device at this time (RFC3339, e.g. 2024-09-01T03:00:00+02:00)")
 }
 
 func (r *updateImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
@@ -69,6 +178,10 @@ func (r *updateImplConfig) run(ctx context.Context, args []string, stdout, stder
 		cfg.InternalCompatibilityFlags.Update = "yes"
 	}
 
+	if err := applyInventoryAddress(cfg); err != nil {
+		return err
+	}
+
 	if r.insecure {
 		cfg.InternalCompatibilityFlags.Insecure = true
 	}
@@ -77,6 +190,31 @@ func (r *updateImplConfig) run(ctx context.Context, args []string, stdout, stder
 		cfg.InternalCompatibilityFlags.Testboot = true
 	}
 
+	var activateAt time.Time
+	if r.activateAt != "" {
+		if r.serial != "" {
+			return fmt.Errorf("--activate_at cannot be combined with --serial: gok activate reboots the device over the network")
+		}
+		activateAt, err = time.Parse(time.RFC3339, r.activateAt)
+		if err != nil {
+			return fmt.Errorf("--activate_at: %v", err)
+		}
+	}
+
+	if r.fromGaf != "" {
+		if r.serial != "" {
+			return fmt.Errorf("--from_gaf cannot be combined with --serial")
+		}
+		if r.locked || r.remoteBuilder != "" {
+			return fmt.Errorf("--from_gaf cannot be combined with --locked or --remote_builder, as it does not build")
+		}
+		// Resolve the path before changing the working directory.
+		r.fromGaf, err = filepath.Abs(r.fromGaf)
+		if err != nil {
+			return err
+		}
+	}
+
 	if err := os.Chdir(config.InstancePath()); err != nil {
 		return err
 	}
@@ -84,9 +222,92 @@ func (r *updateImplConfig) run(ctx context.Context, args []string, stdout, stder
 	pack := &packer.Pack{
 		FileCfg: fileCfg,
 		Cfg:     cfg,
+
+		InterpolationAllowlist: r.interpolate,
+		UploadConcurrency:      r.uploadConcurrency,
+		Locked:                 r.locked,
+		Strict:                 r.strict,
+		Verbose:                r.verbose,
+		NoBinaryCache:          r.noBinaryCache,
+		RemoteCache:            remoteCacheURL(r.remoteCache),
+		Offline:                r.offline,
+		RemoteBuilder:          r.remoteBuilder,
+		FromGaf:                r.fromGaf,
+		RebootTimeout:          r.rebootTimeout,
+		PollInterval:           r.pollInterval,
+		NoReboot:               r.noReboot,
+		ActivateAt:             activateAt,
+		AddressFamily:          r.addressFamily,
+		Serial:                 r.serial,
+		SerialBaud:             r.serialBaud,
+		PrintSizes:             r.sizes,
+		Notify:                 globalCfg.Notify,
+		Env:                    globalCfg.environ(),
+		HTTPClient:             httpClient,
 	}
 
-	pack.Main("gokrazy gok")
+	return runPack(ctx, pack, stdout)
+}
 
+// runSelected updates the devices of the fleet inventory matching
+// --selector one after the other. It continues after failures and returns an
+// error listing all failed instances.
+func (r *updateImplConfig) runSelected(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if r.serial != "" {
+		return fmt.Errorf("--selector cannot be combined with --serial")
+	}
+	devices, err := selectDevices(r.selector)
+	if err != nil {
+		return err
+	}
+	ctx, stop := interruptContext(ctx)
+	defer stop()
+	var failed []string
+	for idx, d := range devices {
+		fmt.Fprintf(stderr, "Updating %s (%d/%d, %s)\n", d.Instance, idx+1, len(devices), fleet.FormatLabels(d.Labels))
+		instanceflag.SetInstance(d.Instance)
+		if err := r.run(ctx, args, stdout, stderr); err != nil {
+			fmt.Fprintf(stderr, "updating %s failed: %v\n", d.Instance, err)
+			failed = append(failed, d.Instance)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("updating %d of %d devices failed: %s", len(failed), len(devices), strings.Join(failed, " "))
+	}
 	return nil
 }
+
+// newUpdatePack returns a Pack for updating the instance with the default
+// settings of gok update, for commands which update the instance as part of
+// their work (e.g. gok passwd).
+func newUpdatePack() (*packer.Pack, error) {
+	fileCfg, err := config.ReadFromFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.InternalCompatibilityFlags == nil {
+		cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
+	}
+	if cfg.InternalCompatibilityFlags.Update == "" {
+		cfg.InternalCompatibilityFlags.Update = "yes"
+	}
+	if err := applyInventoryAddress(cfg); err != nil {
+		return nil, err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return nil, err
+	}
+	return &packer.Pack{
+		FileCfg:    fileCfg,
+		Cfg:        cfg,
+		Env:        globalCfg.environ(),
+		HTTPClient: httpClient,
+	}, nil
+}
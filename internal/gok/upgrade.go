@@ -0,0 +1,261 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+	internalpacker "github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/packer"
+	"github.com/spf13/cobra"
+	"golang.org/x/mod/modfile"
+)
+
+// upgradeCmd is gok upgrade.
+var upgradeCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "upgrade",
+	Short:   "Upgrade the gokrazy system packages (kernel, firmware, EEPROM, gokrazy)",
+	Long: `gok upgrade updates the gokrazy system packages (kernel, firmware, rpi-eeprom
+and gokrazy/gokrazy) to their latest versions in all build directories which
+use them, and prints the resulting version changes.
+
+In contrast to 'gok get -u', gok upgrade does not update your own programs.
+
+Examples:
+  # Upgrade the gokrazy system packages of instance scanner
+  % gok -i scanner upgrade
+
+  # …and verify that the instance still builds
+  % gok -i scanner upgrade --build
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 0 {
+			fmt.Fprint(os.Stderr, `positional arguments are not supported
+
+`)
+			return cmd.Usage()
+		}
+		return upgradeImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type upgradeImplConfig struct {
+	build bool
+}
+
+var upgradeImpl upgradeImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(upgradeCmd.Flags())
+	upgradeCmd.Flags().BoolVarP(&upgradeImpl.build, "build", "", false, "build the gokrazy instance (without deploying it) after upgrading, to validate the new versions")
+}
+
+// requiredModules returns the module versions required by the go.mod file
+// at path, keyed by module path.
+func requiredModules(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := modfile.Parse(path, b, nil)
+	if err != nil {
+		return nil, err
+	}
+	required := make(map[string]string, len(f.Require))
+	for _, r := range f.Require {
+		required[r.Mod.Path] = r.Mod.Version
+	}
+	return required, nil
+}
+
+// moduleForPackage returns the module (out of required) which provides the
+// package importPath, i.e. the longest module path prefix.
+func moduleForPackage(required map[string]string, importPath string) string {
+	var best string
+	for mod := range required {
+		if (importPath == mod || strings.HasPrefix(importPath, mod+"/")) &&
+			len(mod) > len(best) {
+			best = mod
+		}
+	}
+	return best
+}
+
+// goModFiles returns the paths of all go.mod files within dir.
+func goModFiles(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() == "go.mod" {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+func (r *upgradeImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+
+	updateflag.SetUpdate("yes")
+
+	// Determine the modules which provide the system packages.
+	systemModules := make(map[string]bool)
+	for _, pkg := range getGokrazySystemPackages(cfg) {
+		pkg = strings.TrimSuffix(pkg, "/...")
+		buildDir := packer.BuildDir(pkg)
+		required, err := requiredModules(filepath.Join(buildDir, "go.mod"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Printf("skipping %s: no go.mod in %s", pkg, buildDir)
+				continue
+			}
+			return err
+		}
+		if mod := moduleForPackage(required, pkg); mod != "" {
+			systemModules[mod] = true
+		}
+	}
+	if len(systemModules) == 0 {
+		return fmt.Errorf("no gokrazy system packages found in builddir/")
+	}
+
+	goMods, err := goModFiles("builddir")
+	if err != nil {
+		return err
+	}
+	before := make(map[string]map[string]string) // go.mod → module → version
+	for _, goMod := range goMods {
+		required, err := requiredModules(goMod)
+		if err != nil {
+			return err
+		}
+		var mods []string
+		for mod := range required {
+			if systemModules[mod] {
+				mods = append(mods, mod)
+			}
+		}
+		if len(mods) == 0 {
+			continue
+		}
+		sort.Strings(mods)
+		before[goMod] = required
+
+		// Upgrade all system modules of this builddir in a single go get
+		// invocation, so that their requirements are resolved together.
+		getArgs := []string{"get"}
+		for _, mod := range mods {
+			getArgs = append(getArgs, mod+"@latest")
+		}
+		get := exec.CommandContext(ctx, "go", getArgs...)
+		get.Env = withGlobalEnv(packer.Env())
+		get.Dir = filepath.Dir(goMod)
+		get.Stdout = os.Stdout
+		get.Stderr = os.Stderr
+		log.Printf("upgrading in %s: %v", get.Dir, get.Args)
+		if err := get.Run(); err != nil {
+			return fmt.Errorf("%v: %v", get.Args, err)
+		}
+	}
+
+	// Print the version changes of all system modules.
+	type change struct{ from, to string }
+	changes := make(map[string]map[change][]string) // module → change → builddirs
+	for goMod, required := range before {
+		after, err := requiredModules(goMod)
+		if err != nil {
+			return err
+		}
+		for mod := range systemModules {
+			from, ok := required[mod]
+			if !ok || after[mod] == from {
+				continue
+			}
+			if changes[mod] == nil {
+				changes[mod] = make(map[change][]string)
+			}
+			c := change{from: from, to: after[mod]}
+			changes[mod][c] = append(changes[mod][c], filepath.Dir(goMod))
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(stdout, "All gokrazy system packages are already up to date.\n")
+	} else {
+		mods := make([]string, 0, len(changes))
+		for mod := range changes {
+			mods = append(mods, mod)
+		}
+		sort.Strings(mods)
+		fmt.Fprintf(stdout, "Upgraded gokrazy system packages:\n")
+		for _, mod := range mods {
+			for c, dirs := range changes[mod] {
+				fmt.Fprintf(stdout, "  %s: %s → %s (%d builddirs)\n", mod, c.from, c.to, len(dirs))
+			}
+		}
+	}
+
+	if !r.build {
+		return nil
+	}
+	return buildForValidation(ctx, cfg)
+}
+
+// buildForValidation builds the gokrazy instance into a temporary .gaf file,
+// which is discarded.
+func buildForValidation(ctx context.Context, cfg *config.Struct) error {
+	fileCfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	if cfg.InternalCompatibilityFlags == nil {
+		cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
+	}
+	cfg.InternalCompatibilityFlags.Update = ""
+	cfg.InternalCompatibilityFlags.Overwrite = ""
+	cfg.InternalCompatibilityFlags.OverwriteBoot = ""
+	cfg.InternalCompatibilityFlags.OverwriteRoot = ""
+	cfg.InternalCompatibilityFlags.OverwriteMBR = ""
+
+	tmp, err := os.MkdirTemp("", "gok-upgrade")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	pack := &internalpacker.Pack{
+		FileCfg: fileCfg,
+		Cfg:     cfg,
+		Output: &internalpacker.OutputStruct{
+			Type: internalpacker.OutputTypeGaf,
+			Path: filepath.Join(tmp, "validate.gaf"),
+		},
+		Env:        globalCfg.environ(),
+		HTTPClient: httpClient,
+	}
+	if err := pack.Build(ctx, "gokrazy gok"); err != nil {
+		return fmt.Errorf("build failed after upgrade (use git to revert the builddir changes): %v", err)
+	}
+	log.Printf("build succeeded")
+	return nil
+}
@@ -0,0 +1,89 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// vendorCmd is gok vendor.
+var vendorCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "vendor",
+	Short:   "Download all modules of a gokrazy instance for building offline",
+	Long: `gok vendor downloads all Go modules which are required for building a gokrazy
+instance (the modules of all builddirs, including the kernel, firmware and
+EEPROM packages of all ArchPackages, and the GoToolchain, if configured) into
+the modcache/ directory of the instance, and all ExtraFilePaths URLs into the
+extra files cache.
+
+gok update --offline and gok overwrite --offline use modcache/ as Go module
+cache and fail instead of accessing the network (for downloading modules),
+e.g. for building in air-gapped environments or reproducibly from a copy of
+the instance directory.
+
+Run gok vendor again after changing packages or module versions (e.g. gok
+get). To start from scratch, remove the modcache/ directory.
+
+Examples:
+  # download all modules of instance scanner
+  % gok -i scanner vendor
+
+  # later, without network access
+  % gok -i scanner overwrite --offline --gaf /tmp/scanner.gaf
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() > 0 {
+			fmt.Fprint(os.Stderr, `positional arguments are not supported
+
+`)
+			return cmd.Usage()
+		}
+		return vendorImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type vendorImplConfig struct{}
+
+var vendorImpl vendorImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(vendorCmd.Flags())
+}
+
+func (r *vendorImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	if cfg.InternalCompatibilityFlags == nil {
+		cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
+	}
+	ext, err := extconfig.For(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+	modCache, err := filepath.Abs(packer.ModCacheDir)
+	if err != nil {
+		return err
+	}
+	pack := &packer.Pack{
+		FileCfg:    cfg,
+		Cfg:        cfg,
+		Ext:        ext,
+		Env:        globalCfg.environ(),
+		HTTPClient: httpClient,
+	}
+	return pack.Vendor(ctx, modCache, stdout)
+}
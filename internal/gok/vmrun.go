@@ -61,8 +61,6 @@ func init() {
 }
 
 func (r *vmRunConfig) buildFullDiskImage(ctx context.Context, dest string) error {
-	os.Setenv("GOARCH", r.arch)
-
 	fileCfg, err := config.ReadFromFile()
 	if err != nil {
 		return err
@@ -110,14 +108,17 @@ func (r *vmRunConfig) buildFullDiskImage(ctx context.Context, dest string) error
 	}
 
 	pack := &packer.Pack{
-		FileCfg: fileCfg,
-		Cfg:     cfg,
-		Output:  &output,
+		FileCfg:    fileCfg,
+		Cfg:        cfg,
+		Output:     &output,
+		GOARCH:     r.arch,
+		Env:        globalCfg.environ(),
+		HTTPClient: httpClient,
 	}
 
-	pack.Main("gokrazy gok")
-
-	return nil
+	ctx, stop := interruptContext(ctx)
+	defer stop()
+	return pack.Build(ctx, "gokrazy gok")
 }
 
 func (r *vmRunConfig) runQEMU(ctx context.Context, fullDiskImage string) error {
@@ -0,0 +1,239 @@
+package gok
+
+import (
+	"bytes"
+	"context"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// vulnCmd is gok vuln.
+var vulnCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "vuln [importpath...]",
+	Short:   "Scan the Go programs of a gokrazy instance for known vulnerabilities",
+	Long: `gok vuln builds the Go programs of your gokrazy instance (like gok build) and
+scans each binary for known vulnerabilities using govulncheck in binary mode
+(install it with go install golang.org/x/vuln/cmd/govulncheck@latest).
+
+Findings are printed per program. gok vuln exits with a non-zero exit code if
+any program calls vulnerable functions (affected symbols). Vulnerabilities in
+modules or packages whose vulnerable functions are not called are only
+listed with --show_all.
+
+Examples:
+  # scan all programs of the instance, e.g. in CI before gok update
+  % gok -i scanner vuln && gok -i scanner update
+
+  # scan only scan2drive, including vulnerabilities that do not affect it
+  % gok -i scanner vuln --show_all github.com/stapelberg/scan2drive/cmd/scan2drive
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return vulnImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type vulnImplConfig struct {
+	govulncheck string
+	showAll     bool
+}
+
+var vulnImpl vulnImplConfig
+
+func init() {
+	vulnCmd.Flags().StringVarP(&vulnImpl.govulncheck, "govulncheck", "", "govulncheck", "path to the govulncheck binary")
+	vulnCmd.Flags().BoolVarP(&vulnImpl.showAll, "show_all", "", false, "also list vulnerabilities of imported modules and packages whose vulnerable functions are not called")
+	instanceflag.RegisterPflags(vulnCmd.Flags())
+}
+
+// vulnTraceFrame is a frame of a govulncheck finding trace.
+type vulnTraceFrame struct {
+	Module   string `json:"module"`
+	Version  string `json:"version"`
+	Package  string `json:"package"`
+	Function string `json:"function"`
+	Receiver string `json:"receiver"`
+}
+
+// vulnFinding is a govulncheck finding, see
+// https://pkg.go.dev/golang.org/x/vuln/internal/govulncheck#Finding
+type vulnFinding struct {
+	OSV          string           `json:"osv"`
+	FixedVersion string           `json:"fixed_version"`
+	Trace        []vulnTraceFrame `json:"trace"`
+}
+
+// symbol returns the vulnerable symbol of f (e.g. net/http.Server.Serve), or
+// the empty string if f is a module or package level finding.
+func (f *vulnFinding) symbol() string {
+	if len(f.Trace) == 0 || f.Trace[0].Function == "" {
+		return ""
+	}
+	fr := f.Trace[0]
+	if fr.Receiver != "" {
+		return fr.Package + "." + strings.TrimPrefix(fr.Receiver, "*") + "." + fr.Function
+	}
+	return fr.Package + "." + fr.Function
+}
+
+// vulnReport aggregates the govulncheck findings of one program by
+// vulnerability (OSV ID).
+type vulnReport struct {
+	summaries map[string]string // OSV ID → summary
+	findings  map[string][]vulnFinding
+}
+
+// parseVulncheck parses the output of govulncheck -format json.
+func parseVulncheck(r io.Reader) (*vulnReport, error) {
+	report := &vulnReport{
+		summaries: make(map[string]string),
+		findings:  make(map[string][]vulnFinding),
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			OSV *struct {
+				ID      string `json:"id"`
+				Summary string `json:"summary"`
+			} `json:"osv"`
+			Finding *vulnFinding `json:"finding"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if msg.OSV != nil {
+			report.summaries[msg.OSV.ID] = msg.OSV.Summary
+		}
+		if f := msg.Finding; f != nil {
+			report.findings[f.OSV] = append(report.findings[f.OSV], *f)
+		}
+	}
+	return report, nil
+}
+
+// affected returns the symbols of vulnerability id which the program calls.
+func (r *vulnReport) affected(id string) []string {
+	seen := make(map[string]bool)
+	var symbols []string
+	for _, f := range r.findings[id] {
+		if sym := f.symbol(); sym != "" && !seen[sym] {
+			seen[sym] = true
+			symbols = append(symbols, sym)
+		}
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// print prints the vulnerabilities of the report (only those with affected
+// symbols, unless showAll is set) and returns the number of vulnerabilities
+// with affected symbols.
+func (r *vulnReport) print(w io.Writer, program string, showAll bool) int {
+	ids := make([]string, 0, len(r.findings))
+	for id := range r.findings {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var affected int
+	var lines []string
+	for _, id := range ids {
+		symbols := r.affected(id)
+		if len(symbols) > 0 {
+			affected++
+		} else if !showAll {
+			continue
+		}
+		line := "  " + id
+		if f := r.findings[id][0]; f.FixedVersion != "" && len(f.Trace) > 0 {
+			line += fmt.Sprintf(" (fixed in %s@%s)", f.Trace[0].Module, f.FixedVersion)
+		}
+		if summary := r.summaries[id]; summary != "" {
+			line += ": " + summary
+		}
+		lines = append(lines, line)
+		if len(symbols) == 0 {
+			lines = append(lines, "    not called (module or package imported)")
+		}
+		for _, sym := range symbols {
+			lines = append(lines, "    calls "+sym)
+		}
+	}
+	if len(lines) > 0 {
+		fmt.Fprintf(w, "%s:\n%s\n\n", program, strings.Join(lines, "\n"))
+	}
+	return affected
+}
+
+func (r *vulnImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	govulncheck, err := exec.LookPath(r.govulncheck)
+	if err != nil {
+		return fmt.Errorf("%v (install govulncheck using go install golang.org/x/vuln/cmd/govulncheck@latest)", err)
+	}
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+	bindir, err := os.MkdirTemp("", "gokrazy-vuln-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bindir)
+	pack := &packer.Pack{
+		Cfg:        cfg,
+		Env:        globalCfg.environ(),
+		HTTPClient: httpClient,
+	}
+	if err := pack.BuildBinaries(ctx, bindir, args); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(bindir)
+	if err != nil {
+		return err
+	}
+	var affected, programs int
+	for _, ent := range entries {
+		bin := filepath.Join(bindir, ent.Name())
+		program := ent.Name()
+		if bi, err := buildinfo.ReadFile(bin); err == nil {
+			program = bi.Path
+		}
+		var out bytes.Buffer
+		cmd := exec.CommandContext(ctx, govulncheck, "-mode=binary", "-format=json", bin)
+		cmd.Stdout = &out
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+		report, err := parseVulncheck(&out)
+		if err != nil {
+			return fmt.Errorf("parsing govulncheck output for %s: %v", program, err)
+		}
+		if n := report.print(stdout, program, r.showAll); n > 0 {
+			affected += n
+			programs++
+		}
+	}
+	if affected > 0 {
+		return fmt.Errorf("%d vulnerabilities affect %d programs of instance %s", affected, programs, cfg.Hostname)
+	}
+	fmt.Fprintf(stdout, "No vulnerabilities affect the %d programs of instance %s.\n", len(entries), cfg.Hostname)
+	return nil
+}
@@ -0,0 +1,41 @@
+package gok
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const vulncheckOutput = `{"config":{"protocol_version":"v1.0.0","scanner_name":"govulncheck"}}
+{"osv":{"id":"GO-2024-2687","summary":"HTTP/2 CONTINUATION flood in net/http"}}
+{"osv":{"id":"GO-2023-1571","summary":"Denial of service via crafted HTTP/2 stream in net/http and golang.org/x/net"}}
+{"finding":{"osv":"GO-2024-2687","fixed_version":"v0.23.0","trace":[{"module":"golang.org/x/net","version":"v0.17.0"}]}}
+{"finding":{"osv":"GO-2024-2687","fixed_version":"v0.23.0","trace":[{"module":"golang.org/x/net","version":"v0.17.0","package":"golang.org/x/net/http2","function":"ServeConn","receiver":"*Server"}]}}
+{"finding":{"osv":"GO-2023-1571","fixed_version":"v0.7.0","trace":[{"module":"golang.org/x/net","version":"v0.17.0","package":"golang.org/x/net/http2"}]}}
+`
+
+func TestParseVulncheck(t *testing.T) {
+	report, err := parseVulncheck(strings.NewReader(vulncheckOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if got, want := report.print(&buf, "example.com/cmd/foo", false), 1; got != want {
+		t.Errorf("affected vulnerabilities = %d, want %d", got, want)
+	}
+	want := `example.com/cmd/foo:
+  GO-2024-2687 (fixed in golang.org/x/net@v0.23.0): HTTP/2 CONTINUATION flood in net/http
+    calls golang.org/x/net/http2.Server.ServeConn
+
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected output: got\n%s\nwant\n%s", got, want)
+	}
+
+	buf.Reset()
+	report.print(&buf, "example.com/cmd/foo", true)
+	if got := buf.String(); !strings.Contains(got, "GO-2023-1571") {
+		t.Errorf("--show_all output does not contain GO-2023-1571:\n%s", got)
+	}
+}
@@ -0,0 +1,219 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/packer"
+	"github.com/spf13/cobra"
+	"golang.org/x/mod/modfile"
+)
+
+// workCmd is the gok work subcommand, which (only) has nested commands like
+// use.
+var workCmd = &cobra.Command{
+	GroupID: "edit",
+	Use:     "work",
+	Short:   "Manage Go workspaces (go.work) for developing multiple local modules",
+	Long: `Manage Go workspaces (https://go.dev/ref/mod#workspaces) in the builddirs of a
+gokrazy instance.
+
+When working on several interdependent local modules, using a workspace is
+more convenient than maintaining replace directives in every builddir: all
+modules used by the workspace take precedence over the module versions
+required in go.mod.
+
+gok work use creates a go.work file in the builddirs, which gok update and gok
+overwrite honor (set GOWORK=off to build without the workspaces). Workspaces
+are not supported with remote builders.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var workUseCmd = &cobra.Command{
+	Use:                   "use [flags] <dir>...",
+	DisableFlagsInUseLine: true,
+	Short:                 "Add local module directories to the workspaces of a gokrazy instance",
+	Long: `gok work use adds the local module directories to the go.work file of the
+builddirs of the specified packages (default: all packages of the instance),
+creating it if needed (like go work init followed by go work use).
+
+With --drop, the directories are removed from the go.work files instead. go.work
+files which no longer use any local module directory are removed.
+
+Examples:
+  # build all packages of instance scanner with local copies of two modules
+  % gok -i scanner work use ~/go/src/github.com/gokrazy/gokrazy ./rsync
+
+  # only for one package
+  % gok -i scanner work use --package github.com/gokrazy/rsync/cmd/gokr-rsyncd ./rsync
+
+  # stop using the local copy
+  % gok -i scanner work use --drop ./rsync
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().NArg() == 0 {
+			fmt.Fprint(os.Stderr, `expected at least one module directory
+
+`)
+			return cmd.Usage()
+		}
+		return workUseImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+func init() {
+	workCmd.AddCommand(workUseCmd)
+}
+
+type workUseConfig struct {
+	packages []string
+	drop     bool
+}
+
+var workUseImpl workUseConfig
+
+func init() {
+	workUseCmd.Flags().StringSliceVarP(&workUseImpl.packages, "package", "", nil, "comma-separated list of packages whose builddirs to modify (default: all packages of the instance)")
+	workUseCmd.Flags().BoolVarP(&workUseImpl.drop, "drop", "", false, "remove the directories from the go.work files instead of adding them")
+	instanceflag.RegisterPflags(workUseCmd.Flags())
+}
+
+// workUses returns the directories used by the go.work file in buildDir,
+// other than buildDir itself.
+func workUses(buildDir string) ([]string, error) {
+	fn := filepath.Join(buildDir, "go.work")
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	wf, err := modfile.ParseWork(fn, b, nil)
+	if err != nil {
+		return nil, err
+	}
+	var uses []string
+	for _, u := range wf.Use {
+		if u.Path == "." {
+			continue
+		}
+		uses = append(uses, u.Path)
+	}
+	return uses, nil
+}
+
+// goWork runs go work with args in buildDir.
+func goWork(ctx context.Context, buildDir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "go", append([]string{"work"}, args...)...)
+	cmd.Dir = buildDir
+	// Operate on the go.work file in buildDir, even if GOWORK is set.
+	cmd.Env = withGlobalEnv(os.Environ(), "GOWORK="+filepath.Join(buildDir, "go.work"))
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v (in %s): %v", cmd.Args, buildDir, err)
+	}
+	return nil
+}
+
+func (r *workUseConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+
+	// Resolve the directories before changing the working directory.
+	dirs := make([]string, len(args))
+	for idx, arg := range args {
+		abs, err := filepath.Abs(arg)
+		if err != nil {
+			return err
+		}
+		if !r.drop {
+			if _, err := os.Stat(filepath.Join(abs, "go.mod")); err != nil {
+				return fmt.Errorf("%s is not a Go module directory: %v", arg, err)
+			}
+		}
+		dirs[idx] = abs
+	}
+
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+
+	pkgs := r.packages
+	if len(pkgs) == 0 {
+		pkgs = cfg.Packages
+	}
+	seen := make(map[string]bool)
+	for _, pkg := range pkgs {
+		if idx := strings.IndexByte(pkg, '@'); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		buildDir, err := filepath.Abs(packer.BuildDir(pkg))
+		if err != nil {
+			return err
+		}
+		if seen[buildDir] {
+			continue
+		}
+		seen[buildDir] = true
+		if _, err := os.Stat(filepath.Join(buildDir, "go.mod")); err != nil {
+			return fmt.Errorf("package %s has no builddir yet (%v), run gok add or gok update first", pkg, err)
+		}
+
+		workFile := filepath.Join(buildDir, "go.work")
+		if r.drop {
+			if _, err := os.Stat(workFile); os.IsNotExist(err) {
+				continue
+			}
+			editArgs := []string{"edit"}
+			for _, dir := range dirs {
+				editArgs = append(editArgs, "-dropuse="+dir)
+			}
+			if err := goWork(ctx, buildDir, editArgs...); err != nil {
+				return err
+			}
+		} else {
+			if _, err := os.Stat(workFile); os.IsNotExist(err) {
+				if err := goWork(ctx, buildDir, "init", "."); err != nil {
+					return err
+				}
+			}
+			if err := goWork(ctx, buildDir, append([]string{"use"}, dirs...)...); err != nil {
+				return err
+			}
+		}
+
+		uses, err := workUses(buildDir)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(config.InstancePath(), buildDir)
+		if err != nil {
+			rel = buildDir
+		}
+		if len(uses) == 0 {
+			// Only the builddir itself is left: go back to module mode.
+			for _, fn := range []string{workFile, workFile + ".sum"} {
+				if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			fmt.Fprintf(stdout, "%s: no workspace\n", rel)
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: workspace uses %s\n", rel, strings.Join(uses, ", "))
+	}
+	return nil
+}
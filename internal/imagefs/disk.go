@@ -0,0 +1,102 @@
+package imagefs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+const mb = 1024 * 1024
+
+// rootPartitionBytes is the size of the root partitions (see
+// packer.RootPartitionBytes).
+const rootPartitionBytes = 500 * mb
+
+// BootPartition returns the start sector and the size (in sectors) of the
+// first (boot) partition of the full disk image r, read from its MBR. The
+// size of the boot partition is configurable (BootPartitionSizeMB).
+func BootPartition(r io.ReaderAt) (first, sectors int64, _ error) {
+	var mbr [512]byte
+	if _, err := r.ReadAt(mbr[:], 0); err != nil {
+		return 0, 0, fmt.Errorf("reading MBR: %v", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return 0, 0, fmt.Errorf("no MBR found, not a full disk image (gok overwrite --full)")
+	}
+	const entry1 = 446
+	if typ := mbr[entry1+4]; typ != 0x0c {
+		return 0, 0, fmt.Errorf("partition 1 has type %#x, want FAT (0xc)", typ)
+	}
+	first = int64(binary.LittleEndian.Uint32(mbr[entry1+8:]))
+	sectors = int64(binary.LittleEndian.Uint32(mbr[entry1+12:]))
+	return first, sectors, nil
+}
+
+// Disk is the file system of a full disk image, which contains the boot
+// (FAT) and root (SquashFS) file systems as directories boot and root.
+type Disk struct {
+	boot *FAT
+	root *SquashFS
+}
+
+// NewDisk opens the boot and root file systems of the full disk image r,
+// following the partition layout of gok overwrite.
+func NewDisk(r io.ReaderAt) (*Disk, error) {
+	first, sectors, err := BootPartition(r)
+	if err != nil {
+		return nil, err
+	}
+	offset, size := first*512, sectors*512
+	boot, err := NewFAT(io.NewSectionReader(r, offset, size))
+	if err != nil {
+		return nil, fmt.Errorf("boot file system: %v", err)
+	}
+	root, err := NewSquashFS(io.NewSectionReader(r, offset+size, rootPartitionBytes))
+	if err != nil {
+		return nil, fmt.Errorf("root file system: %v", err)
+	}
+	return &Disk{boot: boot, root: root}, nil
+}
+
+// Open implements fs.FS.
+func (fsys *Disk) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		root := &fileInfo{name: ".", mode: fs.ModeDir | 0555}
+		return &file{fi: root, entries: dirEntries([]*fileInfo{
+			{name: "boot", mode: fs.ModeDir | 0555},
+			{name: "root", mode: fs.ModeDir | 0555},
+		})}, nil
+	}
+	dir, rest, _ := strings.Cut(name, "/")
+	if rest == "" {
+		rest = "."
+	}
+	var sub fs.FS
+	switch dir {
+	case "boot":
+		sub = fsys.boot
+	case "root":
+		sub = fsys.root
+	default:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	f, err := sub.Open(rest)
+	if err != nil {
+		if pe, ok := err.(*fs.PathError); ok {
+			pe.Path = name
+		}
+		return nil, err
+	}
+	if rest == "." {
+		// Present the root directory of the file system as boot or root,
+		// with the same file info as in the directory listing of the disk.
+		df := f.(*file)
+		df.fi = &fileInfo{name: dir, mode: fs.ModeDir | 0555}
+	}
+	return f, nil
+}
@@ -0,0 +1,254 @@
+package imagefs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gokrazy/internal/fat"
+)
+
+const (
+	fatAttrVolumeID  = 0x08
+	fatAttrDirectory = 0x10
+	fatAttrLongName  = 0x0F
+)
+
+// FAT is a read-only FAT16 file system, e.g. a gokrazy boot file system.
+// Directories are read from the file allocation table, file contents are read
+// using github.com/gokrazy/internal/fat, which requires files to be stored
+// un-fragmented (as github.com/gokrazy/internal/fat.Writer does).
+type FAT struct {
+	r  *io.SectionReader
+	rd *fat.Reader
+
+	clusterSize   int64
+	fatOffset     int64
+	rootDirOffset int64
+	rootDirSize   int64
+	dataOffset    int64
+	clusters      uint16 // number of FAT entries
+}
+
+// NewFAT reads the boot sector of the FAT file system r.
+func NewFAT(r *io.SectionReader) (*FAT, error) {
+	var bs struct {
+		JumpCode          [3]byte
+		OEM               [8]byte
+		SectorSize        uint16
+		SectorsPerCluster uint8
+		ReservedSectors   uint16
+		FATs              uint8
+		RootDirEntries    uint16
+		Sectors           uint16
+		MediaDescriptor   uint8
+		FATSectors        uint16
+	}
+	if err := binary.Read(io.NewSectionReader(r, 0, 512), binary.LittleEndian, &bs); err != nil {
+		return nil, fmt.Errorf("reading FAT boot sector: %v", err)
+	}
+	if bs.SectorSize == 0 || bs.SectorSize%512 != 0 || bs.SectorsPerCluster == 0 || bs.FATs == 0 {
+		return nil, fmt.Errorf("invalid FAT boot sector")
+	}
+	if bs.FATSectors == 0 {
+		return nil, fmt.Errorf("unsupported FAT file system: only FAT16 is supported")
+	}
+	rd, err := fat.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	sectorSize := int64(bs.SectorSize)
+	fatSize := int64(bs.FATSectors) * sectorSize
+	fsys := &FAT{
+		r:             r,
+		rd:            rd,
+		clusterSize:   int64(bs.SectorsPerCluster) * sectorSize,
+		fatOffset:     int64(bs.ReservedSectors) * sectorSize,
+		rootDirOffset: int64(bs.ReservedSectors)*sectorSize + int64(bs.FATs)*fatSize,
+		rootDirSize:   int64(bs.RootDirEntries) * 32,
+		clusters:      uint16(min(fatSize/2, 0xFFF0)),
+	}
+	// The root directory spans an integral number of sectors.
+	fsys.dataOffset = fsys.rootDirOffset + (fsys.rootDirSize+sectorSize-1)/sectorSize*sectorSize
+	return fsys, nil
+}
+
+// readChain returns the contents of the cluster chain starting at cluster.
+func (fsys *FAT) readChain(cluster uint16) ([]byte, error) {
+	var b []byte
+	for i := 0; cluster >= 2 && cluster < 0xFFF0; i++ {
+		if cluster >= fsys.clusters || i >= int(fsys.clusters) {
+			return nil, fmt.Errorf("invalid cluster chain (cluster %d)", cluster)
+		}
+		buf := make([]byte, fsys.clusterSize)
+		if _, err := fsys.r.ReadAt(buf, fsys.dataOffset+int64(cluster-2)*fsys.clusterSize); err != nil {
+			return nil, err
+		}
+		b = append(b, buf...)
+		var next [2]byte
+		if _, err := fsys.r.ReadAt(next[:], fsys.fatOffset+int64(cluster)*2); err != nil {
+			return nil, err
+		}
+		cluster = binary.LittleEndian.Uint16(next[:])
+	}
+	return b, nil
+}
+
+type fatDirent struct {
+	fileInfo
+	cluster uint16
+}
+
+func fatTime(t, d uint16) time.Time {
+	return time.Date(
+		1980+int(d>>9&0x7F), time.Month(d>>5&0x0F), int(d&0x1F),
+		int(t>>11&0x1F), int(t>>5&0x3F), int(t&0x1F)*2, 0, time.UTC)
+}
+
+// parseDir parses the directory entries b, using the long file names (if
+// present) as names.
+func parseDir(b []byte) []fatDirent {
+	var (
+		dirents  []fatDirent
+		longName []uint16
+		checksum byte
+	)
+	for off := 0; off+32 <= len(b); off += 32 {
+		ent := b[off : off+32]
+		if ent[0] == 0 {
+			break // end of directory
+		}
+		if ent[0] == 0xE5 {
+			longName = nil
+			continue // deleted
+		}
+		attr := ent[11]
+		if attr&fatAttrLongName == fatAttrLongName {
+			order := ent[0]
+			if order&0x40 != 0 {
+				longName = make([]uint16, 13*int(order&0x1F))
+				checksum = ent[13]
+			}
+			idx := int(order&0x1F) - 1
+			if longName == nil || idx < 0 || (idx+1)*13 > len(longName) {
+				longName = nil
+				continue
+			}
+			chars := longName[idx*13 : (idx+1)*13]
+			for i, pos := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				chars[i] = binary.LittleEndian.Uint16(ent[pos:])
+			}
+			continue
+		}
+		if attr&fatAttrVolumeID != 0 {
+			longName = nil
+			continue
+		}
+		name := strings.TrimRight(string(ent[0:8]), " ")
+		if ext := strings.TrimRight(string(ent[8:11]), " "); ext != "" {
+			name += "." + ext
+		}
+		var sum byte
+		for _, c := range ent[:11] {
+			sum = (sum&1)<<7 | sum>>1 + c
+		}
+		if longName != nil && sum == checksum {
+			for idx, c := range longName {
+				if c == 0 || c == 0xFFFF {
+					longName = longName[:idx]
+					break
+				}
+			}
+			name = string(utf16.Decode(longName))
+		}
+		longName = nil
+		if name == "." || name == ".." {
+			continue
+		}
+		de := fatDirent{
+			fileInfo: fileInfo{
+				name:    name,
+				mode:    0444,
+				modTime: fatTime(binary.LittleEndian.Uint16(ent[22:]), binary.LittleEndian.Uint16(ent[24:])),
+			},
+			cluster: binary.LittleEndian.Uint16(ent[26:]),
+		}
+		if attr&fatAttrDirectory != 0 {
+			de.mode = fs.ModeDir | 0555
+		} else {
+			de.size = int64(binary.LittleEndian.Uint32(ent[28:]))
+		}
+		dirents = append(dirents, de)
+	}
+	return dirents
+}
+
+func (fsys *FAT) readDir(cluster uint16) ([]fatDirent, error) {
+	if cluster == 0 { // root directory
+		b := make([]byte, fsys.rootDirSize)
+		if _, err := fsys.r.ReadAt(b, fsys.rootDirOffset); err != nil {
+			return nil, err
+		}
+		return parseDir(b), nil
+	}
+	b, err := fsys.readChain(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return parseDir(b), nil
+}
+
+// Open implements fs.FS. Names are matched case-insensitively, like FAT does.
+func (fsys *FAT) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	cur := fatDirent{fileInfo: fileInfo{name: ".", mode: fs.ModeDir | 0555}}
+	var resolved string // name, with the case of the directory entries
+	if name != "." {
+		for _, component := range strings.Split(name, "/") {
+			if !cur.IsDir() {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			dirents, err := fsys.readDir(cur.cluster)
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			found := false
+			for _, de := range dirents {
+				if strings.EqualFold(de.name, component) {
+					cur = de
+					resolved += "/" + de.name
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+		}
+	}
+	f := &file{fi: &cur.fileInfo}
+	if cur.IsDir() {
+		dirents, err := fsys.readDir(cur.cluster)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		infos := make([]*fileInfo, len(dirents))
+		for idx := range dirents {
+			infos[idx] = &dirents[idx].fileInfo
+		}
+		f.entries = dirEntries(infos)
+		return f, nil
+	}
+	offset, length, err := fsys.rd.Extents(resolved)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	f.r = io.NewSectionReader(fsys.r, offset, length)
+	return f, nil
+}
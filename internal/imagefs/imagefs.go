@@ -0,0 +1,103 @@
+// Package imagefs reads the file systems of gokrazy images without mounting
+// them: SquashFS root file systems, FAT boot file systems and full disk images
+// (containing both), as written by gok overwrite. The file systems implement
+// io/fs.FS, so they work with fs.WalkDir, fs.ReadFile, etc.
+package imagefs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Open returns the file system of the image r (of size bytes), which can be
+// a SquashFS file system, a FAT file system or a full disk image. The file
+// system of a full disk image contains the directories boot and root.
+func Open(r io.ReaderAt, size int64) (fs.FS, error) {
+	var b [512]byte
+	if _, err := r.ReadAt(b[:], 0); err != nil {
+		return nil, err
+	}
+	switch {
+	case binary.LittleEndian.Uint32(b[:]) == squashfsMagic:
+		return NewSquashFS(r)
+
+	case bytes.HasPrefix(b[54:], []byte("FAT")):
+		return NewFAT(io.NewSectionReader(r, 0, size))
+
+	case b[510] == 0x55 && b[511] == 0xAA:
+		return NewDisk(r)
+	}
+	return nil, fmt.Errorf("unknown image format: neither SquashFS, FAT nor a full disk image")
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	target  string // for symlinks
+}
+
+func (fi *fileInfo) Name() string               { return fi.name }
+func (fi *fileInfo) Size() int64                { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode          { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi *fileInfo) IsDir() bool                { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() any                   { return nil }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// LinkTarget returns the target of a symbolic link.
+func (fi *fileInfo) LinkTarget() string { return fi.target }
+
+// file implements fs.File and fs.ReadDirFile.
+type file struct {
+	fi      *fileInfo
+	r       io.Reader     // nil for directories
+	entries []fs.DirEntry // for directories
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.fi, nil }
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.fi.name, Err: errors.New("is a directory or special file")}
+	}
+	return f.r.Read(b)
+}
+
+func (f *file) Close() error { return nil }
+
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.fi.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.fi.name, Err: errors.New("not a directory")}
+	}
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func dirEntries(infos []*fileInfo) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(infos))
+	for idx, fi := range infos {
+		entries[idx] = fi
+	}
+	return entries
+}
@@ -0,0 +1,242 @@
+package imagefs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/gokrazy/internal/fat"
+	"github.com/gokrazy/internal/squashfs"
+)
+
+var (
+	modTime = time.Date(2024, 8, 27, 19, 0, 0, 0, time.UTC)
+	// big spans multiple SquashFS data blocks (128 KiB each).
+	big = func() []byte {
+		b := make([]byte, 300*1024)
+		rand.New(rand.NewSource(1)).Read(b)
+		return b
+	}()
+)
+
+func writeSquashFS(t *testing.T, w io.WriteSeeker) {
+	t.Helper()
+	sw, err := squashfs.NewWriter(w, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etc := sw.Root.Directory("etc", modTime)
+	f, err := etc.File("hostname", modTime, 0444)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("scanner\n"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := etc.Symlink("/tmp/resolv.conf", "resolv.conf", modTime, 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := etc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	user := sw.Root.Directory("user", modTime)
+	f, err = user.File("big", modTime, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(big)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Root.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFAT(t *testing.T, w io.Writer) {
+	t.Helper()
+	fw, err := fat.NewWriter(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		path     string
+		contents string
+	}{
+		{"/cmdline.txt", "console=tty1\n"},
+		{"/overlays/gokrazy-long-name.dtbo", "dtbo"},
+	} {
+		w, err := fw.File(f.path, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSquashFS(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "root.squashfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeSquashFS(t, f)
+
+	fsys, err := NewSquashFS(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(mustSub(t, fsys, "user"), "big"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile(fsys, "user/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, big) {
+		t.Errorf("user/big: contents differ (%d bytes, want %d bytes)", len(got), len(big))
+	}
+	hostname, err := fs.ReadFile(fsys, "etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(hostname), "scanner\n"; got != want {
+		t.Errorf("etc/hostname: got %q, want %q", got, want)
+	}
+
+	st, err := fs.Stat(fsys, "etc/resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("etc/resolv.conf: mode %v, want a symlink", st.Mode())
+	}
+	if got, want := st.(interface{ LinkTarget() string }).LinkTarget(), "/tmp/resolv.conf"; got != want {
+		t.Errorf("etc/resolv.conf: target %q, want %q", got, want)
+	}
+	if _, err := fs.Stat(fsys, "etc/passwd"); !os.IsNotExist(err) {
+		t.Errorf("Stat(etc/passwd) = %v, want not exist", err)
+	}
+}
+
+func TestFAT(t *testing.T) {
+	var buf bytes.Buffer
+	writeFAT(t, &buf)
+	fsys, err := NewFAT(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "cmdline.txt", "overlays/gokrazy-long-name.dtbo"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile(fsys, "overlays/gokrazy-long-name.dtbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "dtbo"; string(got) != want {
+		t.Errorf("overlays/gokrazy-long-name.dtbo: got %q, want %q", got, want)
+	}
+}
+
+func TestOpenDisk(t *testing.T) {
+	const (
+		first = 2048           // sectors
+		boot  = 128 * mb / 512 // sectors, BootPartitionSizeMB: 128
+	)
+	path := filepath.Join(t.TempDir(), "full.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var mbr [512]byte
+	mbr[446+4] = 0x0c // FAT
+	binary.LittleEndian.PutUint32(mbr[446+8:], first)
+	binary.LittleEndian.PutUint32(mbr[446+12:], boot)
+	mbr[510], mbr[511] = 0x55, 0xAA
+	if _, err := f.Write(mbr[:]); err != nil {
+		t.Fatal(err)
+	}
+	var bootFS bytes.Buffer
+	writeFAT(t, &bootFS)
+	if _, err := f.WriteAt(bootFS.Bytes(), first*512); err != nil {
+		t.Fatal(err)
+	}
+	writeSquashFS(t, &offsetWriteSeeker{f, (first + boot) * 512})
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := Open(f, st.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fsys.(*Disk); !ok {
+		t.Fatalf("Open returned %T, want *Disk", fsys)
+	}
+	if err := fstest.TestFS(mustSub(t, fsys, "boot"), "cmdline.txt"); err != nil {
+		t.Fatal(err)
+	}
+	cmdline, err := fs.ReadFile(fsys, "boot/cmdline.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(cmdline), "console=tty1\n"; got != want {
+		t.Errorf("boot/cmdline.txt: got %q, want %q", got, want)
+	}
+	entries, err := fs.ReadDir(fsys, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if got, want := len(names), 2; got != want {
+		t.Errorf("ReadDir(root) = %v, want etc and user", names)
+	}
+}
+
+func mustSub(t *testing.T, fsys fs.FS, dir string) fs.FS {
+	t.Helper()
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+type offsetWriteSeeker struct {
+	f      *os.File
+	offset int64
+}
+
+func (w *offsetWriteSeeker) Write(b []byte) (int, error) { return w.f.Write(b) }
+
+func (w *offsetWriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += w.offset
+	}
+	n, err := w.f.Seek(offset, whence)
+	return n - w.offset, err
+}
@@ -0,0 +1,554 @@
+package imagefs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+const squashfsMagic = 0x73717368 // hsqs
+
+const (
+	squashfsZlib = 1
+
+	squashfsUncompressedMetadata = 0x8000
+	squashfsUncompressedData     = 1 << 24
+	squashfsInvalidFragment      = 0xFFFFFFFF
+)
+
+// SquashFS inode types.
+const (
+	squashfsDir = 1 + iota
+	squashfsReg
+	squashfsSymlink
+	squashfsBlkdev
+	squashfsChrdev
+	squashfsFifo
+	squashfsSocket
+	squashfsLdir
+	squashfsLreg
+	squashfsLsymlink
+	squashfsLblkdev
+	squashfsLchrdev
+	squashfsLfifo
+	squashfsLsocket
+)
+
+type squashfsSuperblock struct {
+	Magic               uint32
+	Inodes              uint32
+	MkfsTime            int32
+	BlockSize           uint32
+	Fragments           uint32
+	Compression         uint16
+	BlockLog            uint16
+	Flags               uint16
+	NoIds               uint16
+	Major               uint16
+	Minor               uint16
+	RootInode           uint64
+	BytesUsed           int64
+	IdTableStart        int64
+	XattrIdTableStart   int64
+	InodeTableStart     int64
+	DirectoryTableStart int64
+	FragmentTableStart  int64
+	LookupTableStart    int64
+}
+
+// SquashFS is a read-only SquashFS file system (version 4, zlib compression),
+// e.g. a gokrazy root file system.
+type SquashFS struct {
+	r  io.ReaderAt
+	sb squashfsSuperblock
+}
+
+// NewSquashFS reads the superblock of the SquashFS file system r.
+func NewSquashFS(r io.ReaderAt) (*SquashFS, error) {
+	fsys := &SquashFS{r: r}
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, &fsys.sb); err != nil {
+		return nil, fmt.Errorf("reading SquashFS superblock: %v", err)
+	}
+	if fsys.sb.Magic != squashfsMagic {
+		return nil, fmt.Errorf("not a SquashFS file system (magic %#x)", fsys.sb.Magic)
+	}
+	if fsys.sb.Major != 4 {
+		return nil, fmt.Errorf("unsupported SquashFS version %d.%d", fsys.sb.Major, fsys.sb.Minor)
+	}
+	if fsys.sb.Compression != squashfsZlib {
+		return nil, fmt.Errorf("unsupported SquashFS compression %d (only zlib/gzip is supported)", fsys.sb.Compression)
+	}
+	if bs := fsys.sb.BlockSize; bs < 4096 || bs > 1<<20 {
+		return nil, fmt.Errorf("invalid SquashFS block size %d", bs)
+	}
+	return fsys, nil
+}
+
+func decompress(b []byte, max int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(zr, int64(max)+1)); err != nil {
+		return nil, err
+	}
+	if buf.Len() > max {
+		return nil, fmt.Errorf("block decompresses to more than %d bytes", max)
+	}
+	return buf.Bytes(), nil
+}
+
+// metaReader reads consecutive metadata blocks (of the inode, directory or
+// fragment table).
+type metaReader struct {
+	fsys *SquashFS
+	next int64 // offset of the next metadata block
+	buf  []byte
+}
+
+func (fsys *SquashFS) metaReader(start int64, offset uint16) (*metaReader, error) {
+	m := &metaReader{fsys: fsys, next: start}
+	if err := m.fill(); err != nil {
+		return nil, err
+	}
+	if int(offset) > len(m.buf) {
+		return nil, fmt.Errorf("metadata offset %d out of range", offset)
+	}
+	m.buf = m.buf[offset:]
+	return m, nil
+}
+
+func (m *metaReader) fill() error {
+	var hdr [2]byte
+	if _, err := m.fsys.r.ReadAt(hdr[:], m.next); err != nil {
+		return err
+	}
+	h := binary.LittleEndian.Uint16(hdr[:])
+	size := int64(h &^ squashfsUncompressedMetadata)
+	if size == 0 || size > 8192 {
+		return fmt.Errorf("invalid metadata block size %d at offset %d", size, m.next)
+	}
+	b := make([]byte, size)
+	if _, err := m.fsys.r.ReadAt(b, m.next+2); err != nil {
+		return err
+	}
+	m.next += 2 + size
+	if h&squashfsUncompressedMetadata == 0 {
+		var err error
+		if b, err = decompress(b, 8192); err != nil {
+			return fmt.Errorf("metadata block: %v", err)
+		}
+	}
+	m.buf = b
+	return nil
+}
+
+func (m *metaReader) Read(p []byte) (int, error) {
+	if len(m.buf) == 0 {
+		if err := m.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, m.buf)
+	m.buf = m.buf[n:]
+	return n, nil
+}
+
+// squashfsInode is a parsed inode.
+type squashfsInode struct {
+	fileInfo
+
+	// directories
+	dirBlock  uint32
+	dirOffset uint16
+	dirSize   uint32
+
+	// regular files
+	start      uint64
+	fragment   uint32
+	fragOffset uint32
+	blocks     []uint32
+}
+
+func squashfsMode(mode uint16) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+func (fsys *SquashFS) readInode(block uint32, offset uint16) (*squashfsInode, error) {
+	m, err := fsys.metaReader(fsys.sb.InodeTableStart+int64(block), offset)
+	if err != nil {
+		return nil, err
+	}
+	var hdr struct {
+		Type        uint16
+		Mode        uint16
+		Uid         uint16
+		Gid         uint16
+		Mtime       int32
+		InodeNumber uint32
+	}
+	if err := binary.Read(m, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	ino := &squashfsInode{
+		fileInfo: fileInfo{
+			mode:    squashfsMode(hdr.Mode),
+			modTime: time.Unix(int64(hdr.Mtime), 0),
+		},
+	}
+	switch hdr.Type {
+	case squashfsDir:
+		var d struct {
+			StartBlock  uint32
+			Nlink       uint32
+			FileSize    uint16
+			Offset      uint16
+			ParentInode uint32
+		}
+		if err := binary.Read(m, binary.LittleEndian, &d); err != nil {
+			return nil, err
+		}
+		ino.mode |= fs.ModeDir
+		ino.dirBlock, ino.dirOffset, ino.dirSize = d.StartBlock, d.Offset, uint32(d.FileSize)
+
+	case squashfsLdir:
+		var d struct {
+			Nlink       uint32
+			FileSize    uint32
+			StartBlock  uint32
+			ParentInode uint32
+			Icount      uint16
+			Offset      uint16
+			Xattr       uint32
+		}
+		if err := binary.Read(m, binary.LittleEndian, &d); err != nil {
+			return nil, err
+		}
+		ino.mode |= fs.ModeDir
+		ino.dirBlock, ino.dirOffset, ino.dirSize = d.StartBlock, d.Offset, d.FileSize
+
+	case squashfsReg, squashfsLreg:
+		if hdr.Type == squashfsReg {
+			var r struct {
+				StartBlock uint32
+				Fragment   uint32
+				Offset     uint32
+				FileSize   uint32
+			}
+			if err := binary.Read(m, binary.LittleEndian, &r); err != nil {
+				return nil, err
+			}
+			ino.start, ino.fragment, ino.fragOffset, ino.size = uint64(r.StartBlock), r.Fragment, r.Offset, int64(r.FileSize)
+		} else {
+			var r struct {
+				StartBlock uint64
+				FileSize   uint64
+				Sparse     uint64
+				Nlink      uint32
+				Fragment   uint32
+				Offset     uint32
+				Xattr      uint32
+			}
+			if err := binary.Read(m, binary.LittleEndian, &r); err != nil {
+				return nil, err
+			}
+			if r.FileSize > 1<<40 {
+				return nil, fmt.Errorf("invalid file size %d", r.FileSize)
+			}
+			ino.start, ino.fragment, ino.fragOffset, ino.size = r.StartBlock, r.Fragment, r.Offset, int64(r.FileSize)
+		}
+		bs := int64(fsys.sb.BlockSize)
+		n := ino.size / bs
+		if ino.fragment == squashfsInvalidFragment && ino.size%bs != 0 {
+			n++
+		}
+		if n > 1<<20 {
+			return nil, fmt.Errorf("invalid file size %d", ino.size)
+		}
+		ino.blocks = make([]uint32, n)
+		if err := binary.Read(m, binary.LittleEndian, ino.blocks); err != nil {
+			return nil, err
+		}
+
+	case squashfsSymlink, squashfsLsymlink:
+		var s struct {
+			Nlink       uint32
+			SymlinkSize uint32
+		}
+		if err := binary.Read(m, binary.LittleEndian, &s); err != nil {
+			return nil, err
+		}
+		if s.SymlinkSize > 4096 {
+			return nil, fmt.Errorf("invalid symlink size %d", s.SymlinkSize)
+		}
+		target := make([]byte, s.SymlinkSize)
+		if _, err := io.ReadFull(m, target); err != nil {
+			return nil, err
+		}
+		ino.mode |= fs.ModeSymlink
+		ino.target = string(target)
+		ino.size = int64(len(target))
+
+	case squashfsBlkdev, squashfsLblkdev:
+		ino.mode |= fs.ModeDevice
+	case squashfsChrdev, squashfsLchrdev:
+		ino.mode |= fs.ModeDevice | fs.ModeCharDevice
+	case squashfsFifo, squashfsLfifo:
+		ino.mode |= fs.ModeNamedPipe
+	case squashfsSocket, squashfsLsocket:
+		ino.mode |= fs.ModeSocket
+	default:
+		return nil, fmt.Errorf("unknown inode type %d", hdr.Type)
+	}
+	return ino, nil
+}
+
+type squashfsDirent struct {
+	name   string
+	block  uint32
+	offset uint16
+}
+
+func (fsys *SquashFS) readDir(ino *squashfsInode) ([]squashfsDirent, error) {
+	// The directory size includes 3 bytes for the implicit . and .. entries.
+	remaining := int64(ino.dirSize) - 3
+	if remaining <= 0 {
+		return nil, nil
+	}
+	m, err := fsys.metaReader(fsys.sb.DirectoryTableStart+int64(ino.dirBlock), ino.dirOffset)
+	if err != nil {
+		return nil, err
+	}
+	var dirents []squashfsDirent
+	for remaining > 0 {
+		var hdr struct {
+			Count       uint32
+			StartBlock  uint32
+			InodeNumber uint32
+		}
+		if err := binary.Read(m, binary.LittleEndian, &hdr); err != nil {
+			return nil, err
+		}
+		remaining -= 12
+		for i := uint32(0); i <= hdr.Count; i++ {
+			if remaining <= 0 {
+				return nil, fmt.Errorf("directory entries exceed the directory size")
+			}
+			var ent struct {
+				Offset      uint16
+				InodeOffset int16
+				Type        uint16
+				Size        uint16
+			}
+			if err := binary.Read(m, binary.LittleEndian, &ent); err != nil {
+				return nil, err
+			}
+			if ent.Size >= 256 {
+				return nil, fmt.Errorf("invalid directory entry name size %d", ent.Size+1)
+			}
+			name := make([]byte, ent.Size+1)
+			if _, err := io.ReadFull(m, name); err != nil {
+				return nil, err
+			}
+			remaining -= 8 + int64(len(name))
+			dirents = append(dirents, squashfsDirent{
+				name:   string(name),
+				block:  hdr.StartBlock,
+				offset: ent.Offset,
+			})
+		}
+	}
+	return dirents, nil
+}
+
+func (fsys *SquashFS) lookup(name string) (*squashfsInode, error) {
+	ref := fsys.sb.RootInode
+	ino, err := fsys.readInode(uint32(ref>>16), uint16(ref&0xFFFF))
+	if err != nil {
+		return nil, err
+	}
+	ino.name = "."
+	if name == "." {
+		return ino, nil
+	}
+	for _, component := range strings.Split(name, "/") {
+		if !ino.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		dirents, err := fsys.readDir(ino)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, de := range dirents {
+			if de.name != component {
+				continue
+			}
+			if ino, err = fsys.readInode(de.block, de.offset); err != nil {
+				return nil, err
+			}
+			ino.name = de.name
+			found = true
+			break
+		}
+		if !found {
+			return nil, fs.ErrNotExist
+		}
+	}
+	return ino, nil
+}
+
+// Open implements fs.FS. Symbolic links are not followed.
+func (fsys *SquashFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	ino, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	f := &file{fi: &ino.fileInfo}
+	switch {
+	case ino.IsDir():
+		dirents, err := fsys.readDir(ino)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		infos := make([]*fileInfo, len(dirents))
+		for idx, de := range dirents {
+			child, err := fsys.readInode(de.block, de.offset)
+			if err != nil {
+				return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+			}
+			child.name = de.name
+			infos[idx] = &child.fileInfo
+		}
+		f.entries = dirEntries(infos)
+
+	case ino.Mode().IsRegular():
+		f.r = &squashfsFileReader{fsys: fsys, ino: ino, pos: int64(ino.start), remaining: ino.size}
+	}
+	return f, nil
+}
+
+// squashfsFileReader reads the data blocks and the fragment (if any) of a
+// regular file.
+type squashfsFileReader struct {
+	fsys      *SquashFS
+	ino       *squashfsInode
+	next      int   // index of the next block
+	pos       int64 // offset of the next block
+	remaining int64
+	buf       []byte
+}
+
+func (r *squashfsFileReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *squashfsFileReader) fill() error {
+	bs := int64(r.fsys.sb.BlockSize)
+	var b []byte
+	if r.next < len(r.ino.blocks) {
+		size := r.ino.blocks[r.next]
+		r.next++
+		if size == 0 { // sparse block
+			b = make([]byte, bs)
+		} else {
+			var err error
+			b, err = r.fsys.readBlock(r.pos, size)
+			if err != nil {
+				return err
+			}
+			r.pos += int64(size &^ squashfsUncompressedData)
+		}
+	} else if r.ino.fragment != squashfsInvalidFragment {
+		frag, err := r.fsys.readFragment(r.ino.fragment)
+		if err != nil {
+			return err
+		}
+		start := int64(r.ino.fragOffset)
+		if start+r.remaining > int64(len(frag)) {
+			return errors.New("fragment too short")
+		}
+		b = frag[start : start+r.remaining]
+	} else {
+		return io.ErrUnexpectedEOF
+	}
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	r.remaining -= int64(len(b))
+	r.buf = b
+	return nil
+}
+
+// readBlock reads the (data or fragment) block at offset with the on-disk
+// size (including the uncompressed bit) size.
+func (fsys *SquashFS) readBlock(offset int64, size uint32) ([]byte, error) {
+	n := size &^ squashfsUncompressedData
+	if n > fsys.sb.BlockSize {
+		return nil, fmt.Errorf("invalid block size %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := fsys.r.ReadAt(b, offset); err != nil {
+		return nil, err
+	}
+	if size&squashfsUncompressedData != 0 {
+		return b, nil
+	}
+	return decompress(b, int(fsys.sb.BlockSize))
+}
+
+func (fsys *SquashFS) readFragment(idx uint32) ([]byte, error) {
+	if idx >= fsys.sb.Fragments {
+		return nil, fmt.Errorf("invalid fragment index %d", idx)
+	}
+	// The fragment table is indexed by the locations of the metadata blocks
+	// holding 512 fragment entries (16 bytes) each.
+	var loc [8]byte
+	if _, err := fsys.r.ReadAt(loc[:], fsys.sb.FragmentTableStart+int64(idx/512)*8); err != nil {
+		return nil, err
+	}
+	m, err := fsys.metaReader(int64(binary.LittleEndian.Uint64(loc[:])), uint16(idx%512)*16)
+	if err != nil {
+		return nil, err
+	}
+	var ent struct {
+		Start  uint64
+		Size   uint32
+		Unused uint32
+	}
+	if err := binary.Read(m, binary.LittleEndian, &ent); err != nil {
+		return nil, err
+	}
+	return fsys.readBlock(int64(ent.Start), ent.Size)
+}
@@ -0,0 +1,97 @@
+// Package license detects the license of a Go module by classifying the
+// license files (LICENSE, COPYING, …) in its root directory.
+//
+// The classification is based on characteristic phrases of common open source
+// licenses and returns SPDX license identifiers. It is not a substitute for
+// legal review, but good enough for compliance reports.
+package license
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// NoAssertion is the SPDX value for a license which could not be determined.
+const NoAssertion = "NOASSERTION"
+
+// fileRe matches the names of license files.
+var fileRe = regexp.MustCompile(`(?i)^(licen[cs]e|copying|unlicense)([-._].*)?$`)
+
+// phrase identifies a license by (all of) its characteristic phrases, which
+// must be lower case and whitespace-normalized.
+type phrase struct {
+	id  string
+	all []string
+}
+
+// phrases are checked in order, so more specific licenses (e.g. LGPL) must
+// come before the licenses they contain phrases of (e.g. GPL).
+var phrases = []phrase{
+	{"Apache-2.0", []string{"apache license", "version 2.0"}},
+	{"MPL-2.0", []string{"mozilla public license", "2.0"}},
+	{"AGPL-3.0", []string{"gnu affero general public license", "version 3"}},
+	{"LGPL-3.0", []string{"gnu lesser general public license", "version 3"}},
+	{"LGPL-2.1", []string{"gnu lesser general public license", "version 2.1"}},
+	{"GPL-3.0", []string{"gnu general public license", "version 3"}},
+	{"GPL-2.0", []string{"gnu general public license", "version 2"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+	{"CC0-1.0", []string{"cc0 1.0 universal"}},
+	{"MIT", []string{"permission is hereby granted, free of charge"}},
+	{"ISC", []string{"permission to use, copy, modify, and/or distribute this software for any purpose"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "endorse or promote products"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+}
+
+// Classify returns the SPDX identifier of the license text, or NoAssertion.
+func Classify(text string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(text), " "))
+	for _, p := range phrases {
+		matches := true
+		for _, s := range p.all {
+			if !strings.Contains(normalized, s) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return p.id
+		}
+	}
+	return NoAssertion
+}
+
+// Detect returns the SPDX license expression of the module in dir, combining
+// the licenses of multiple license files with AND (e.g. “Apache-2.0 AND
+// MIT”). Detect returns NoAssertion if dir contains no (recognized) license
+// file.
+func Detect(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, ent := range entries {
+		if !ent.Type().IsRegular() || !fileRe.MatchString(ent.Name()) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, ent.Name()))
+		if err != nil {
+			return "", err
+		}
+		id := Classify(string(b))
+		if id == NoAssertion || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return NoAssertion, nil
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " AND "), nil
+}
@@ -0,0 +1,71 @@
+package license
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const mitText = `MIT License
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction…`
+
+const bsd3Text = `Copyright (c) 2009 The Go Authors. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+…
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.`
+
+func TestClassify(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want string
+	}{
+		{mitText, "MIT"},
+		{bsd3Text, "BSD-3-Clause"},
+		{"Apache License\n  Version 2.0, January 2004", "Apache-2.0"},
+		{"GNU LESSER GENERAL PUBLIC LICENSE\nVersion 2.1, February 1999", "LGPL-2.1"},
+		{"GNU GENERAL PUBLIC LICENSE\nVersion 2, June 1991", "GPL-2.0"},
+		{"All rights reserved.", NoAssertion},
+	} {
+		if got := Classify(tt.text); got != tt.want {
+			t.Errorf("Classify(%.20q…) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"LICENSE":     bsd3Text,
+		"LICENSE-MIT": mitText,
+		"PATENTS":     "Additional IP Rights Grant (Patents)",
+		"main.go":     "package main",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := Detect(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "BSD-3-Clause AND MIT"; got != want {
+		t.Errorf("Detect() = %q, want %q", got, want)
+	}
+
+	empty := t.TempDir()
+	got, err = Detect(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != NoAssertion {
+		t.Errorf("Detect(empty) = %q, want %q", got, NoAssertion)
+	}
+}
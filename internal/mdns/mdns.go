@@ -0,0 +1,336 @@
+// Package mdns implements a minimal DNS-SD (RFC 6763) browser over multicast
+// DNS (RFC 6762), used for discovering gokrazy devices on the local network.
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GokrazyService is the DNS-SD service type which gokrazy devices announce.
+// The TXT record contains model= (device model) and sbom= (SBOM hash of the
+// running gokrazy installation) entries.
+const GokrazyService = "_gokrazy._tcp.local."
+
+// DNS resource record types.
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+
+	classIN = 1
+)
+
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Service is a service instance discovered via DNS-SD.
+type Service struct {
+	Instance string // e.g. scanner._gokrazy._tcp.local.
+	Host     string // e.g. scanner.local.
+	Port     uint16
+	Addrs    []net.IP
+	TXT      map[string]string
+}
+
+// Hostname returns the host name of s without the .local. suffix.
+func (s *Service) Hostname() string {
+	return strings.TrimSuffix(strings.TrimSuffix(s.Host, "."), ".local")
+}
+
+type question struct {
+	name  string
+	qtype uint16
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// query returns a DNS query message for questions.
+func query(questions []question) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(questions)))
+	for _, q := range questions {
+		b = appendName(b, q.name)
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, classIN)
+	}
+	return b
+}
+
+var errMalformed = errors.New("malformed DNS message")
+
+// readName reads the (possibly compressed) domain name at off in msg and
+// returns it (with trailing dot) and the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 64 {
+			return "", 0, errMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end == -1 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0: // compression pointer
+			if off+1 >= len(msg) {
+				return "", 0, errMalformed
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+type record struct {
+	name  string
+	rtype uint16
+	data  []byte
+	off   int // offset of data in msg, for decompressing names in data
+}
+
+// parse returns all resource records (answers, authority and additional
+// records) of the DNS message msg.
+func parse(msg []byte) ([]record, error) {
+	if len(msg) < 12 {
+		return nil, errMalformed
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4 // type, class
+	}
+	var records []record
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return nil, errMalformed
+		}
+		records = append(records, record{
+			name:  strings.ToLower(name),
+			rtype: rtype,
+			data:  msg[off : off+rdlength],
+			off:   off,
+		})
+		off += rdlength
+	}
+	return records, nil
+}
+
+// browser accumulates services from DNS responses.
+type browser struct {
+	service  string
+	services map[string]*Service // by instance name
+	addrs    map[string][]net.IP // by host name
+}
+
+func (b *browser) add(msg []byte) error {
+	records, err := parse(msg)
+	if err != nil {
+		return err
+	}
+	get := func(instance string) *Service {
+		svc, ok := b.services[instance]
+		if !ok {
+			svc = &Service{Instance: instance}
+			b.services[instance] = svc
+		}
+		return svc
+	}
+	for _, rr := range records {
+		switch rr.rtype {
+		case typePTR:
+			if rr.name != b.service {
+				continue
+			}
+			instance, _, err := readName(msg, rr.off)
+			if err != nil {
+				return err
+			}
+			get(strings.ToLower(instance))
+		case typeSRV:
+			if !strings.HasSuffix(rr.name, "."+b.service) || len(rr.data) < 7 {
+				continue
+			}
+			host, _, err := readName(msg, rr.off+6)
+			if err != nil {
+				return err
+			}
+			svc := get(rr.name)
+			svc.Port = binary.BigEndian.Uint16(rr.data[4:])
+			svc.Host = strings.ToLower(host)
+		case typeTXT:
+			if !strings.HasSuffix(rr.name, "."+b.service) {
+				continue
+			}
+			svc := get(rr.name)
+			svc.TXT = parseTXT(rr.data)
+		case typeA, typeAAAA:
+			ip := net.IP(append([]byte(nil), rr.data...))
+			if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+				continue
+			}
+			if !containsIP(b.addrs[rr.name], ip) {
+				b.addrs[rr.name] = append(b.addrs[rr.name], ip)
+			}
+		}
+	}
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTXT(data []byte) map[string]string {
+	txt := make(map[string]string)
+	for len(data) > 0 {
+		l := int(data[0])
+		if 1+l > len(data) {
+			break
+		}
+		key, value, _ := strings.Cut(string(data[1:1+l]), "=")
+		txt[strings.ToLower(key)] = value
+		data = data[1+l:]
+	}
+	return txt
+}
+
+// result returns the discovered services, sorted by instance name.
+func (b *browser) result() []*Service {
+	var result []*Service
+	for _, svc := range b.services {
+		svc.Addrs = b.addrs[svc.Host]
+		result = append(result, svc)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Instance < result[j].Instance
+	})
+	return result
+}
+
+// incomplete returns follow-up questions for services whose SRV, TXT or
+// address records were not yet received.
+func (b *browser) incomplete() []question {
+	var questions []question
+	for _, svc := range b.services {
+		if svc.Host == "" {
+			questions = append(questions, question{svc.Instance, typeSRV})
+		}
+		if svc.TXT == nil {
+			questions = append(questions, question{svc.Instance, typeTXT})
+		}
+		if svc.Host != "" && len(b.addrs[svc.Host]) == 0 {
+			questions = append(questions, question{svc.Host, typeA})
+		}
+	}
+	return questions
+}
+
+// Browse sends a DNS-SD query for service (e.g. GokrazyService) and returns
+// the service instances which responded until ctx is done or timeout has
+// passed.
+func Browse(ctx context.Context, service string, timeout time.Duration) ([]*Service, error) {
+	// Queries from a port other than 5353 are answered via unicast (legacy
+	// unicast, RFC 6762 section 6.7), so no multicast group membership is
+	// required.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	service = strings.ToLower(service)
+	b := &browser{
+		service:  service,
+		services: make(map[string]*Service),
+		addrs:    make(map[string][]net.IP),
+	}
+	if _, err := conn.WriteToUDP(query([]question{{service, typePTR}}), mdnsAddr); err != nil {
+		return nil, fmt.Errorf("sending mDNS query: %v", err)
+	}
+	// After half of the timeout, ask for records which were not included in
+	// the responses so far.
+	followUp := time.Now().Add(timeout / 2)
+	deadline := time.Now().Add(timeout)
+	followUpSent := false
+	buf := make([]byte, 9000)
+	for {
+		readDeadline := deadline
+		if !followUpSent {
+			readDeadline = followUp
+		}
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
+			break // conn closed because ctx is done
+		}
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if ctx.Err() != nil || !errors.As(err, &ne) || !ne.Timeout() {
+				if ctx.Err() != nil {
+					break
+				}
+				return nil, err
+			}
+			if followUpSent {
+				break
+			}
+			followUpSent = true
+			if questions := b.incomplete(); len(questions) > 0 {
+				conn.WriteToUDP(query(questions), mdnsAddr)
+			}
+			continue
+		}
+		b.add(buf[:n]) // ignore malformed responses
+	}
+	return b.result(), ctx.Err()
+}
@@ -0,0 +1,78 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func appendRecord(b []byte, name []byte, rtype uint16, data []byte) []byte {
+	b = append(b, name...)
+	b = binary.BigEndian.AppendUint16(b, rtype)
+	b = binary.BigEndian.AppendUint16(b, classIN|0x8000) // cache flush
+	b = binary.BigEndian.AppendUint32(b, 120)            // TTL
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func TestBrowserAdd(t *testing.T) {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[6:], 1)      // answers
+	binary.BigEndian.PutUint16(msg[10:], 3)     // additional records
+
+	// PTR _gokrazy._tcp.local. → scanner._gokrazy._tcp.local.
+	serviceOff := len(msg)
+	msg = appendName(msg, GokrazyService)
+	msg = binary.BigEndian.AppendUint16(msg, typePTR)
+	msg = binary.BigEndian.AppendUint16(msg, classIN)
+	msg = binary.BigEndian.AppendUint32(msg, 120)
+	instanceData := append([]byte{7}, "scanner"...)
+	instanceData = binary.BigEndian.AppendUint16(instanceData, 0xc000|uint16(serviceOff))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(instanceData)))
+	instanceOff := len(msg)
+	msg = append(msg, instanceData...)
+	instance := binary.BigEndian.AppendUint16(nil, 0xc000|uint16(instanceOff))
+
+	srv := []byte{0, 0, 0, 0, 0, 80}
+	srv = appendName(srv, "Scanner.local.")
+	msg = appendRecord(msg, instance, typeSRV, srv)
+	txt := append([]byte{15}, "model=Pi 4 Mod."...)
+	txt = append(txt, append([]byte{8}, "sbom=abc"...)...)
+	msg = appendRecord(msg, instance, typeTXT, txt)
+	msg = appendRecord(msg, appendName(nil, "scanner.local."), typeA, []byte{10, 0, 0, 76})
+
+	b := &browser{
+		service:  GokrazyService,
+		services: make(map[string]*Service),
+		addrs:    make(map[string][]net.IP),
+	}
+	if err := b.add(msg); err != nil {
+		t.Fatal(err)
+	}
+	want := []*Service{
+		{
+			Instance: "scanner._gokrazy._tcp.local.",
+			Host:     "scanner.local.",
+			Port:     80,
+			Addrs:    []net.IP{{10, 0, 0, 76}},
+			TXT:      map[string]string{"model": "Pi 4 Mod.", "sbom": "abc"},
+		},
+	}
+	got := b.result()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("browser: unexpected result: diff (-want +got):\n%s", diff)
+	}
+	if got, want := got[0].Hostname(), "scanner"; got != want {
+		t.Errorf("Hostname() = %q, want %q", got, want)
+	}
+	if questions := b.incomplete(); len(questions) > 0 {
+		t.Errorf("incomplete() = %v, want none", questions)
+	}
+
+	if _, err := parse(msg[:len(msg)-3]); err == nil {
+		t.Errorf("parse(truncated message) succeeded unexpectedly")
+	}
+}
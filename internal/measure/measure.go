@@ -3,17 +3,47 @@ package measure
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
+var (
+	mu sync.Mutex
+	// width is the length of the current interactive status line, so that
+	// the next line can overwrite it completely.
+	width int
+)
+
 func Interactively(status string) (done func(fragment string)) {
 	status = "[" + status + "]"
+	mu.Lock()
 	fmt.Print(status)
+	width = len(status)
+	mu.Unlock()
 	start := time.Now()
 	return func(fragment string) {
 		build := time.Since(start)
-		fmt.Printf("\r[done] in %.2fs%s"+strings.Repeat(" ", len(status))+"\n",
-			build.Seconds(),
-			fragment)
+		mu.Lock()
+		defer mu.Unlock()
+		line := fmt.Sprintf("\r[done] in %.2fs%s", build.Seconds(), fragment)
+		pad := len(status)
+		if rest := width - len(line) + 1; rest > pad {
+			pad = rest
+		}
+		fmt.Print(line + strings.Repeat(" ", pad) + "\n")
+		width = 0
+	}
+}
+
+// Update replaces the current interactive status line, e.g. to display
+// progress of the operation started with Interactively.
+func Update(line string) {
+	mu.Lock()
+	defer mu.Unlock()
+	pad := 0
+	if width > len(line) {
+		pad = width - len(line)
 	}
+	fmt.Print("\r" + line + strings.Repeat(" ", pad))
+	width = len(line)
 }
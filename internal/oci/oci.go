@@ -0,0 +1,449 @@
+// Package oci pulls container images from OCI (Docker) registries and
+// flattens their layers into a tar archive, so that files from container
+// images can be included in the gokrazy root file system.
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/tools/internal/renameio"
+)
+
+const (
+	mediaTypeOCIIndex        = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest     = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList      = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest  = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCILayerGzip    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCILayer        = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// Reference is a digest-pinned image reference, e.g.
+// ghcr.io/org/foo:1.2@sha256:….
+type Reference struct {
+	Registry   string // e.g. ghcr.io
+	Repository string // e.g. org/foo
+	Tag        string // informational only, may be empty
+	Digest     string // e.g. sha256:…
+}
+
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	return s + "@" + r.Digest
+}
+
+// ParseReference parses an image reference, which must be pinned to a
+// digest so that builds are reproducible. Like the docker command, images
+// without a registry are pulled from Docker Hub.
+func ParseReference(ref string) (Reference, error) {
+	name, digest, ok := strings.Cut(ref, "@")
+	if !ok {
+		return Reference{}, fmt.Errorf("image %q must be pinned using @sha256:<hex>", ref)
+	}
+	hex, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hex) != 2*sha256.Size {
+		return Reference{}, fmt.Errorf("image %q: invalid digest %q", ref, digest)
+	}
+	var r Reference
+	r.Digest = digest
+	if idx := strings.LastIndexByte(name, ':'); idx > strings.LastIndexByte(name, '/') {
+		r.Tag = name[idx+1:]
+		name = name[:idx]
+	}
+	first, rest, ok := strings.Cut(name, "/")
+	if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		r.Registry = first
+		r.Repository = rest
+	} else {
+		r.Registry = "docker.io"
+		r.Repository = name
+		if !ok {
+			r.Repository = "library/" + name
+		}
+	}
+	if r.Repository == "" {
+		return Reference{}, fmt.Errorf("image %q: missing repository", ref)
+	}
+	return r, nil
+}
+
+// registryHost returns the host name of the registry API endpoint.
+func (r Reference) registryHost() string {
+	if r.Registry == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return r.Registry
+}
+
+// Client pulls images. Downloaded blobs are stored in CacheDir.
+type Client struct {
+	HTTPClient *http.Client
+	CacheDir   string
+
+	token string
+}
+
+// NewClient returns a Client which caches blobs in the user cache directory.
+func NewClient() (*Client, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		HTTPClient: http.DefaultClient,
+		CacheDir:   filepath.Join(cacheDir, "gokrazy", "oci"),
+	}, nil
+}
+
+// authenticate obtains an anonymous bearer token, as requested by the
+// WWW-Authenticate header of a 401 response.
+func (c *Client) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unsupported registry authentication scheme %q", scheme)
+	}
+	values := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+		values[key] = strings.Trim(val, `"`)
+	}
+	u, err := url.Parse(values["realm"])
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	for _, key := range []string{"service", "scope"} {
+		if v := values[key]; v != "" {
+			q.Set(key, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	resp, err := c.HTTPClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected HTTP status %v", u, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	return nil
+}
+
+func (c *Client) get(ref Reference, kind, digest string, accept []string) (*http.Response, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/%s/%s", ref.registryHost(), ref.Repository, kind, digest)
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			if err := c.authenticate(resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, fmt.Errorf("%s: %v", u, err)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: unexpected HTTP status %v", u, resp.Status)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("%s: authentication failed", u)
+}
+
+// verify returns an error if b does not match digest.
+func verify(b []byte, digest string) error {
+	if got := fmt.Sprintf("sha256:%x", sha256.Sum256(b)); got != digest {
+		return fmt.Errorf("digest mismatch: got %s, want %s", got, digest)
+	}
+	return nil
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"` // index
+	Layers    []descriptor `json:"layers"`    // image manifest
+}
+
+func (c *Client) manifest(ref Reference, digest string) (*manifest, error) {
+	resp, err := c.get(ref, "manifests", digest, []string{
+		mediaTypeOCIIndex,
+		mediaTypeOCIManifest,
+		mediaTypeDockerList,
+		mediaTypeDockerManifest,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(b, digest); err != nil {
+		return nil, fmt.Errorf("manifest of %s: %v", ref, err)
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+	return &m, nil
+}
+
+// platformManifest returns the image manifest for goarch, resolving image
+// indexes (multi-platform images).
+func (c *Client) platformManifest(ref Reference, goarch string) (*manifest, error) {
+	m, err := c.manifest(ref, ref.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) == 0 {
+		return m, nil // single-platform image
+	}
+	for _, desc := range m.Manifests {
+		p := desc.Platform
+		if p == nil || p.OS != "linux" || p.Architecture != goarch {
+			continue
+		}
+		if goarch == "arm" && p.Variant != "" && p.Variant != "v7" {
+			continue
+		}
+		return c.manifest(ref, desc.Digest)
+	}
+	return nil, fmt.Errorf("image %s is not available for linux/%s", ref, goarch)
+}
+
+// blob returns the path of the (cached) blob with the specified digest.
+func (c *Client) blob(ref Reference, digest string) (string, error) {
+	hex, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	fn := filepath.Join(c.CacheDir, "blobs", "sha256", hex)
+	if _, err := os.Stat(fn); err == nil {
+		return fn, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return "", err
+	}
+	resp, err := c.get(ref, "blobs", digest, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	f, err := renameio.TempFile("", fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Cleanup()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return "", err
+	}
+	if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != digest {
+		return "", fmt.Errorf("blob of %s: digest mismatch: got %s, want %s", ref, got, digest)
+	}
+	if err := f.CloseAtomicallyReplace(); err != nil {
+		return "", err
+	}
+	return fn, nil
+}
+
+// entry is a file system entry of a flattened image.
+type entry struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+// applyLayer applies the tar layer rd onto entries (keyed by cleaned path),
+// honoring whiteout files. Only entries within prefix are retained.
+func applyLayer(entries map[string]*entry, rd io.Reader, prefix string) error {
+	within := func(p string) bool {
+		return p == prefix || strings.HasPrefix(p, prefix+"/")
+	}
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+		if base == ".wh..wh..opq" {
+			// Opaque whiteout: remove everything below dir from lower layers.
+			for p := range entries {
+				if strings.HasPrefix(p, dir+"/") {
+					delete(entries, p)
+				}
+			}
+			continue
+		}
+		if removed, ok := strings.CutPrefix(base, ".wh."); ok {
+			removed = path.Join(dir, removed)
+			delete(entries, removed)
+			for p := range entries {
+				if strings.HasPrefix(p, removed+"/") {
+					delete(entries, p)
+				}
+			}
+			continue
+		}
+		if !within(name) {
+			continue
+		}
+		e := &entry{hdr: hdr}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			e.data = b
+		case tar.TypeLink:
+			// Resolve hard links into regular files, which the gokrazy root
+			// file system does not support otherwise.
+			target, ok := entries[path.Clean(strings.TrimPrefix(hdr.Linkname, "/"))]
+			if !ok || target.hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			h := *target.hdr
+			h.Name = hdr.Name
+			e = &entry{hdr: &h, data: target.data}
+		case tar.TypeDir, tar.TypeSymlink:
+		default:
+			continue // device files, FIFOs etc.
+		}
+		entries[name] = e
+	}
+}
+
+// Flatten pulls ref (for linux/goarch), applies all image layers and writes
+// the file or directory subpath (e.g. /usr/share/foo) as a tar archive to w.
+// The archive entries are relative to the parent directory of subpath, e.g.
+// foo/bar.txt.
+func (c *Client) Flatten(ref Reference, goarch, subpath string, w io.Writer) error {
+	prefix := path.Clean(strings.TrimPrefix(subpath, "/"))
+	if prefix == "." || prefix == "" || strings.HasPrefix(prefix, "../") {
+		return fmt.Errorf("image %s: invalid path %q: must refer to a file or directory below /", ref, subpath)
+	}
+	parent := path.Dir(prefix)
+	m, err := c.platformManifest(ref, goarch)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]*entry)
+	for _, layer := range m.Layers {
+		fn, err := c.blob(ref, layer.Digest)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		var rd io.Reader = f
+		switch layer.MediaType {
+		case mediaTypeOCILayerGzip, mediaTypeDockerLayerGzip:
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			rd = zr
+		case mediaTypeOCILayer:
+		default:
+			f.Close()
+			return fmt.Errorf("image %s: unsupported layer media type %q", ref, layer.MediaType)
+		}
+		err = applyLayer(entries, rd, prefix)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("image %s: layer %s: %v", ref, layer.Digest, err)
+		}
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("image %s does not contain %s", ref, subpath)
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		e := entries[name]
+		rel := name
+		if parent != "." {
+			rel = strings.TrimPrefix(name, parent+"/")
+		}
+		hdr := *e.hdr
+		hdr.Name = rel
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		hdr.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,201 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseReference(t *testing.T) {
+	for _, tt := range []struct {
+		ref  string
+		want Reference
+	}{
+		{
+			ref:  "ghcr.io/org/foo:1.2@" + testDigest,
+			want: Reference{Registry: "ghcr.io", Repository: "org/foo", Tag: "1.2", Digest: testDigest},
+		},
+		{
+			ref:  "alpine@" + testDigest,
+			want: Reference{Registry: "docker.io", Repository: "library/alpine", Digest: testDigest},
+		},
+		{
+			ref:  "grafana/grafana:11.0.0@" + testDigest,
+			want: Reference{Registry: "docker.io", Repository: "grafana/grafana", Tag: "11.0.0", Digest: testDigest},
+		},
+		{
+			ref:  "localhost:5000/foo@" + testDigest,
+			want: Reference{Registry: "localhost:5000", Repository: "foo", Digest: testDigest},
+		},
+	} {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := ParseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ParseReference: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, ref := range []string{"ghcr.io/org/foo:1.2", "ghcr.io/org/foo@sha256:1234"} {
+		if _, err := ParseReference(ref); err == nil {
+			t.Errorf("ParseReference(%q) succeeded unexpectedly", ref)
+		}
+	}
+}
+
+type testFile struct {
+	name     string
+	contents string
+	dir      bool
+}
+
+func testLayer(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.name,
+			Mode:     0644,
+			Size:     int64(len(f.contents)),
+			Typeflag: tar.TypeReg,
+		}
+		if f.dir {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func digestOf(b []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+func TestFlatten(t *testing.T) {
+	layers := [][]byte{
+		testLayer(t, []testFile{
+			{name: "usr/share/foo/", dir: true},
+			{name: "usr/share/foo/a.txt", contents: "a"},
+			{name: "usr/share/foo/b.txt", contents: "b"},
+			{name: "usr/bin/foo", contents: "binary"},
+		}),
+		testLayer(t, []testFile{
+			{name: "usr/share/foo/.wh.b.txt"},
+			{name: "usr/share/foo/a.txt", contents: "a2"},
+		}),
+	}
+	blobs := make(map[string][]byte)
+	var layerDescs []descriptor
+	for _, l := range layers {
+		blobs[digestOf(l)] = l
+		layerDescs = append(layerDescs, descriptor{MediaType: mediaTypeOCILayer, Digest: digestOf(l)})
+	}
+	imageManifest, err := json.Marshal(manifest{MediaType: mediaTypeOCIManifest, Layers: layerDescs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := fmt.Sprintf(`{"mediaType":%q,"manifests":[`+
+		`{"digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000","platform":{"os":"linux","architecture":"amd64"}},`+
+		`{"digest":%q,"platform":{"os":"linux","architecture":"arm64"}}]}`,
+		mediaTypeOCIIndex, digestOf(imageManifest))
+	manifests := map[string][]byte{
+		digestOf(imageManifest): imageManifest,
+		digestOf([]byte(index)): []byte(index),
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"token":"secret"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test"`, r.Host))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		prefix := "/v2/org/foo/"
+		rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		kind, digest, _ := strings.Cut(rest, "/")
+		var b []byte
+		switch kind {
+		case "manifests":
+			b = manifests[digest]
+		case "blobs":
+			b = blobs[digest]
+		}
+		if b == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	ref, err := ParseReference(strings.TrimPrefix(srv.URL, "https://") + "/org/foo:1.0@" + digestOf([]byte(index)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{
+		HTTPClient: srv.Client(),
+		CacheDir:   t.TempDir(),
+	}
+	var buf bytes.Buffer
+	if err := c.Flatten(ref, "arm64", "/usr/share/foo", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(b)
+	}
+	want := map[string]string{
+		"foo/":      "",
+		"foo/a.txt": "a2",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Flatten: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	if err := c.Flatten(ref, "riscv64", "/usr/share/foo", io.Discard); err == nil {
+		t.Errorf("Flatten(riscv64) succeeded unexpectedly")
+	}
+}
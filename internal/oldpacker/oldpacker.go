@@ -12,11 +12,10 @@ import (
 	"strings"
 
 	"github.com/gokrazy/internal/config"
-	"github.com/gokrazy/internal/deviceconfig"
 	"github.com/gokrazy/internal/tlsflag"
 	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/elevate"
 	internalpacker "github.com/gokrazy/tools/internal/packer"
-	"github.com/gokrazy/tools/packer"
 )
 
 var (
@@ -235,6 +234,8 @@ func logic(instanceDir string) error {
 }
 
 func Main() {
+	elevate.Main()
+
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, usage)
 		flag.PrintDefaults()
@@ -267,27 +268,6 @@ func Main() {
 		flag.Usage()
 	}
 
-	if os.Getenv("GOKR_PACKER_FD") != "" { // partitioning child process
-		firstPartitionOffsetSectors := deviceconfig.DefaultBootPartitionStartLBA
-		if *deviceType != "" {
-			if devcfg, ok := deviceconfig.GetDeviceConfigBySlug(*deviceType); ok {
-				if devcfg.BootPartitionStartLBA != 0 {
-					firstPartitionOffsetSectors = devcfg.BootPartitionStartLBA
-				}
-			} else {
-				log.Fatalf("unknown device slug %q", *deviceType)
-			}
-		}
-		p := internalpacker.Pack{
-			Pack: packer.NewPackForHost(firstPartitionOffsetSectors, *hostname),
-		}
-
-		if _, err := p.SudoPartition(*overwrite); err != nil {
-			log.Fatal(err)
-		}
-		os.Exit(0)
-	}
-
 	if err := logic(*instanceDir); err != nil {
 		log.Fatal(err)
 	}
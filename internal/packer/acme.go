@@ -0,0 +1,177 @@
+package packer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	acmedns "github.com/gokrazy/tools/internal/acme"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/renameio"
+	"golang.org/x/crypto/acme"
+)
+
+const acmePrefix = "acme:"
+
+// acmeRenewBefore is how long before expiry certificates obtained via ACME
+// are renewed.
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// useTLS returns the --tls flag value (see Pack.tls): Update.UseTLS, or the
+// certificate and key paths of the ACME certificate for acme:<domain>. If
+// renew is true, the certificate is obtained or renewed as needed.
+func (pack *Pack) useTLS(ctx context.Context, cfg *config.Struct, renew bool) (string, error) {
+	if cfg.Update == nil {
+		return "", nil
+	}
+	domain, ok := strings.CutPrefix(cfg.Update.UseTLS, acmePrefix)
+	if !ok {
+		return cfg.Update.UseTLS, nil
+	}
+	if domain == "" {
+		return "", fmt.Errorf("Update.UseTLS: no domain specified in %q (expected acme:<domain>)", cfg.Update.UseTLS)
+	}
+	hostConfigPath := string(config.HostnameSpecific(cfg.Hostname))
+	certPath := filepath.Join(hostConfigPath, "acme-cert.pem")
+	keyPath := filepath.Join(hostConfigPath, "acme-key.pem")
+	err := acmeCertificateValid(certPath, keyPath, domain, time.Now())
+	if err == nil {
+		return certPath + "," + keyPath, nil
+	}
+	if !renew {
+		if _, statErr := os.Stat(certPath); statErr != nil {
+			return "", nil // no certificate yet
+		}
+		log.Printf("not renewing ACME certificate for %s: %v", domain, err)
+		return certPath + "," + keyPath, nil
+	}
+	log.Printf("obtaining ACME certificate for %s: %v", domain, err)
+	var acmeCfg extconfig.ACMEConfig
+	if pack.Ext != nil && pack.Ext.Update != nil && pack.Ext.Update.ACME != nil {
+		acmeCfg = *pack.Ext.Update.ACME
+	}
+	if err := obtainACMECertificate(ctx, pack.httpClient(), acmeCfg, domain, hostConfigPath, certPath, keyPath); err != nil {
+		return "", err
+	}
+	return certPath + "," + keyPath, nil
+}
+
+// acmeCertificateValid returns an error if the certificate at certPath does not
+// exist, does not match the key at keyPath, does not cover domain or expires
+// within acmeRenewBefore of now.
+func acmeCertificateValid(certPath, keyPath, domain string, now time.Time) error {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("no certificate yet")
+		}
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if err := leaf.VerifyHostname(domain); err != nil {
+		return err
+	}
+	if remaining := leaf.NotAfter.Sub(now); remaining < acmeRenewBefore {
+		return fmt.Errorf("certificate expires in %v", remaining.Truncate(time.Hour))
+	}
+	return nil
+}
+
+// acmeAccountKey loads (or generates) the ACME account key, which is shared
+// by all instances.
+func acmeAccountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(config.Gokrazy(), "acme", "account-key.pem")
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data found", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return key, nil
+	}
+	key, err := acmedns.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := renameio.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func obtainACMECertificate(ctx context.Context, httpClient *http.Client, acmeCfg extconfig.ACMEConfig, domain, hostConfigPath, certPath, keyPath string) error {
+	providerName := acmeCfg.DNSProvider
+	if providerName == "" {
+		providerName = "manual"
+	}
+	provider, err := acmedns.ProviderFor(providerName, acmedns.ProviderConfig{
+		Command: acmeCfg.DNSProviderCommand,
+	})
+	if err != nil {
+		return err
+	}
+	accountKey, err := acmeAccountKey()
+	if err != nil {
+		return fmt.Errorf("loading ACME account key: %v", err)
+	}
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: acmeCfg.Directory,
+		HTTPClient:   httpClient,
+	}
+	if err := acmedns.Register(ctx, client, acmeCfg.Email); err != nil {
+		return err
+	}
+	key, err := acmedns.GenerateKey()
+	if err != nil {
+		return err
+	}
+	chain, err := acmedns.ObtainCertificate(ctx, client, []string{domain}, key, provider)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(hostConfigPath, 0755); err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(certPath, chain, 0644); err != nil {
+		return err
+	}
+	log.Printf("obtained ACME certificate for %s (stored in %s)", domain, certPath)
+	return nil
+}
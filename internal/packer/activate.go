@@ -0,0 +1,138 @@
+package packer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gokrazy/tools/internal/renameio"
+)
+
+// pendingActivationFile is the name of the file in the instance directory in
+// which gok update records an update which it did not activate (see
+// PendingActivation).
+const pendingActivationFile = "pending-activation.json"
+
+// PendingActivation describes an update which gok update wrote to the
+// inactive root partition and marked as active (or for testboot), but did not
+// activate by rebooting the device (--no_reboot or --activate_at). gok
+// activate reboots the device into the new version.
+type PendingActivation struct {
+	// Device is the URL of the updated device (without password).
+	Device string
+
+	// BuildTimestamp is the build timestamp of the new version. It is empty
+	// when deploying a gaf file, in which case the update is active once the
+	// build timestamp differs from OldBuildTimestamp.
+	BuildTimestamp    string `json:",omitempty"`
+	OldBuildTimestamp string `json:",omitempty"`
+
+	// At is the time at which to activate the update (gok update
+	// --activate_at), or the zero time for no particular time.
+	At time.Time
+
+	// Updated is the time at which gok update wrote the update.
+	Updated time.Time
+}
+
+func (pack *Pack) pendingActivationPath() string {
+	return pack.instancePath(pendingActivationFile)
+}
+
+// ReadPendingActivation returns the pending activation of the instance (see
+// Pack.InstanceDir). The error wraps fs.ErrNotExist if there is none.
+func (pack *Pack) ReadPendingActivation() (*PendingActivation, error) {
+	b, err := os.ReadFile(pack.pendingActivationPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no pending activation (gok update --no_reboot or --activate_at): %w", err)
+		}
+		return nil, err
+	}
+	var pending PendingActivation
+	if err := json.Unmarshal(b, &pending); err != nil {
+		return nil, fmt.Errorf("%s: %v", pack.pendingActivationPath(), err)
+	}
+	return &pending, nil
+}
+
+func (pack *Pack) writePendingActivation(pending *PendingActivation) error {
+	b, err := json.MarshalIndent(pending, "", "    ")
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(pack.pendingActivationPath(), append(b, '\n'), 0644)
+}
+
+// removePendingActivation removes the pending activation (if any), e.g.
+// after rebooting into a newer version.
+func (pack *Pack) removePendingActivation() error {
+	if err := os.Remove(pack.pendingActivationPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Activate reboots the device into the update which gok update recorded as
+// PendingActivation, after waiting until at (if non-zero) or the time
+// requested using gok update --activate_at, and waits for the device to run
+// the new version.
+func (pack *Pack) Activate(ctx context.Context, at time.Time) error {
+	pending, err := pack.ReadPendingActivation()
+	if err != nil {
+		return err
+	}
+	if at.IsZero() {
+		at = pending.At
+	}
+	updateBaseUrl, updateHttpClient, target, err := pack.connectDevice(ctx)
+	if err != nil {
+		return err
+	}
+	deviceURL := *updateBaseUrl // copy
+	deviceURL.User = nil        // do not leak the password
+	if got, want := deviceURL.Hostname(), pendingDeviceHost(pending.Device); got != want {
+		return fmt.Errorf("the pending activation is for device %s, but the instance is updated at %s", pending.Device, deviceURL.String())
+	}
+
+	updated := func(ctx context.Context) error {
+		if pending.BuildTimestamp != "" {
+			return pollUpdated1(ctx, updateHttpClient, updateBaseUrl.String(), pending.BuildTimestamp)
+		}
+		return pollChanged(ctx, updateHttpClient, updateBaseUrl.String(), pending.OldBuildTimestamp)
+	}
+	if err := updated(ctx); err == nil {
+		fmt.Printf("%s already runs the new version (rebooted since gok update at %v)\n", deviceURL.String(), pending.Updated.Format(time.RFC3339))
+		return pack.removePendingActivation()
+	}
+
+	if wait := time.Until(at); wait > 0 {
+		fmt.Printf("Waiting until %v (%v) to activate the update of %s (cancel with Ctrl-C any time)\n",
+			at.Format(time.RFC3339), wait.Round(time.Second), deviceURL.String())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	if err := pack.rebootAndWait(ctx, target, updated); err != nil {
+		return err
+	}
+	return pack.removePendingActivation()
+}
+
+// pendingDeviceHost returns the host name of the device URL u, as recorded
+// in PendingActivation.Device. The port is ignored, as it differs when
+// TLS is enabled in the meantime.
+func pendingDeviceHost(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return parsed.Hostname()
+}
@@ -0,0 +1,79 @@
+package packer
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPendingActivation(t *testing.T) {
+	parentDir, instance := instanceflag.ParentDir(), instanceflag.Instance()
+	t.Cleanup(func() {
+		instanceflag.SetParentDir(parentDir)
+		instanceflag.SetInstance(instance)
+	})
+	// The pending activation belongs to the instance of the Pack, not to the
+	// instance selected by the -i flag.
+	flagDir := t.TempDir()
+	instanceflag.SetParentDir(flagDir)
+	instanceflag.SetInstance(".")
+	pack := &Pack{InstanceDir: t.TempDir()}
+
+	if _, err := pack.ReadPendingActivation(); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("ReadPendingActivation() = %v, want fs.ErrNotExist", err)
+	}
+
+	want := &PendingActivation{
+		Device:         "http://scanner/",
+		BuildTimestamp: "2024-08-31T12:00:00+02:00",
+		At:             time.Date(2024, 9, 1, 3, 0, 0, 0, time.UTC),
+		Updated:        time.Date(2024, 8, 31, 12, 5, 0, 0, time.UTC),
+	}
+	if err := pack.writePendingActivation(want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(pack.InstanceDir, pendingActivationFile)); err != nil {
+		t.Errorf("pending activation not written to the instance directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(flagDir, pendingActivationFile)); !os.IsNotExist(err) {
+		t.Errorf("pending activation unexpectedly written to the -i instance directory (err = %v)", err)
+	}
+	got, err := pack.ReadPendingActivation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadPendingActivation: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	if err := pack.removePendingActivation(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pack.removePendingActivation(); err != nil {
+		t.Fatalf("removing a non-existing pending activation: %v", err)
+	}
+	if _, err := pack.ReadPendingActivation(); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("ReadPendingActivation() after remove = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestPendingDeviceHost(t *testing.T) {
+	for _, tt := range []struct {
+		device string
+		want   string
+	}{
+		{"http://scanner/", "scanner"},
+		{"https://scanner:8443/", "scanner"},
+		{"http://[fe80::1]:8080/", "fe80::1"},
+	} {
+		if got := pendingDeviceHost(tt.device); got != tt.want {
+			t.Errorf("pendingDeviceHost(%q) = %q, want %q", tt.device, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package packer
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tarball(t testing.TB, entries ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(hdr.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func FuzzExtractArchive(f *testing.F) {
+	f.Add(tarball(f,
+		&tar.Header{Name: "web/assets/fonts/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "web/assets/fonts/a.woff", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "etc/localtime", Typeflag: tar.TypeSymlink, Linkname: "/usr/share/zoneinfo/UTC"},
+	))
+	f.Add(tarball(f,
+		&tar.Header{Name: "/etc/hosts", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "./usr/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644},
+	))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// extractArchive reads files into memory, so skip archives with
+		// large (e.g. sparse) files, which only slow down fuzzing.
+		rd := tar.NewReader(bytes.NewReader(b))
+		for {
+			hdr, err := rd.Next()
+			if err != nil {
+				break
+			}
+			if hdr.Size > 1<<20 {
+				return
+			}
+		}
+		path := filepath.Join(t.TempDir(), "extrafiles.tar")
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		root := &FileInfo{}
+		ae := archiveExtraction{dirs: map[string]*FileInfo{".": root}}
+		if _, err := ae.extractArchive(path); err != nil {
+			return
+		}
+		var check func(dir string, fi *FileInfo)
+		check = func(dir string, fi *FileInfo) {
+			for _, ent := range fi.Dirents {
+				if ent.Filename == "" || ent.Filename == "." || ent.Filename == ".." || filepath.Base(ent.Filename) != ent.Filename {
+					t.Fatalf("%s: invalid directory entry name %q", dir, ent.Filename)
+				}
+				check(filepath.Join(dir, ent.Filename), ent)
+			}
+		}
+		check("/", root)
+	})
+}
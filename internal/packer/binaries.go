@@ -0,0 +1,108 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/secret"
+	"github.com/gokrazy/tools/packer"
+)
+
+// BuildBinaries builds the Go packages pkgs (all packages of the instance if
+// pkgs is empty) into outputDir, using the same build directories, build
+// flags, build tags and binary names (Basenames) as Build, but without
+// creating any file system image. pkgs must be packages of the instance.
+func (pack *Pack) BuildBinaries(ctx context.Context, outputDir string, pkgs []string) error {
+	secretsDir := secret.Dir(pack.instancePath())
+	if _, err := os.Stat(secretsDir); err != nil {
+		secretsDir = "" // instance has no secrets
+	}
+	if err := interpolateConfig(pack.Cfg, pack.InterpolationAllowlist, secretsDir); err != nil {
+		return fmt.Errorf("interpolating config: %v", err)
+	}
+	cfg := pack.Cfg
+	if pack.Ext == nil {
+		ext, err := extconfig.For(cfg)
+		if err != nil {
+			return err
+		}
+		pack.Ext = ext
+	}
+	if err := checkGoToolchain(pack.Ext, pack.goEnvOverrides()); err != nil {
+		return err
+	}
+	if err := checkBuildOptions(pack.Ext); err != nil {
+		return err
+	}
+	pack.resolveTarget()
+	applyArchPackages(pack.Cfg, pack.Ext, pack.target.GOARCH)
+
+	all := append([]string{}, cfg.GokrazyPackagesOrDefault()...)
+	all = append(all, cfg.Packages...)
+	if len(pkgs) == 0 {
+		pkgs = all
+	} else {
+		known := make(map[string]bool)
+		for _, pkg := range all {
+			known[pkg] = true
+		}
+		for _, pkg := range pkgs {
+			if !known[pkg] {
+				return fmt.Errorf("%s is not a package of instance %s (add it using gok add)", pkg, cfg.Hostname)
+			}
+		}
+	}
+
+	packageBuildFlags, err := pack.findBuildFlagsFiles(cfg)
+	if err != nil {
+		return err
+	}
+	packageBuildTags, err := pack.findBuildTagsFiles(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	fmt.Printf("Build target: %s\n", strings.Join(filterGoEnv(pack.goEnv()), " "))
+	fmt.Printf("Building %d Go packages into %s\n", len(pkgs), outputDir)
+	cached := &cachedPackages{}
+	buildEnv := &packer.BuildEnv{
+		BuildDir:    pack.buildDirOrMigrate,
+		Basenames:   pack.Ext.Basenames(),
+		Target:      &pack.target,
+		GoToolchain: pack.Ext.GoToolchain,
+		Env:         pack.goEnvOverrides(),
+		Options:     pack.buildOptions(),
+		Verbose:     pack.Verbose,
+		PackageBuilt: func(importPath string, err error) {
+			if err == nil && !cached.has(importPath) {
+				log.Printf("built %s", importPath)
+			}
+		},
+	}
+	pack.enableBinaryCache(buildEnv, cached)
+	if remote := pack.remoteBuilder(); remote != "" {
+		rb, err := packer.ParseRemoteBuilder(remote)
+		if err != nil {
+			return err
+		}
+		log.Printf("building on remote builder %s", rb.Host)
+		buildEnv.Remote = rb
+	}
+	buildEnv.LogDir, err = pack.buildLogDir()
+	if err != nil {
+		return err
+	}
+	if err := buildEnv.BuildContext(ctx, outputDir, pkgs, packageBuildFlags, packageBuildTags, nil); err != nil {
+		return err
+	}
+	printCachedPackages(cached)
+	return nil
+}
@@ -0,0 +1,521 @@
+package packer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gokrazy/tools/internal/remotecache"
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/gokrazy/tools/packer"
+	"golang.org/x/mod/modfile"
+)
+
+// binaryCacheMaxAge is how long programs remain in the binary cache after
+// they were last used.
+const binaryCacheMaxAge = 30 * 24 * time.Hour
+
+// remoteCacheTimeout limits downloading or uploading one program from or to
+// the remote cache.
+const remoteCacheTimeout = 2 * time.Minute
+
+// binaryCache is the local packer.BinaryCache. It is content-addressed: the
+// action file actions/<key> contains the SHA256 sum of the program, which is
+// stored as blobs/<sum>, so that identical programs (e.g. built for different
+// instances) are stored only once.
+//
+// If remote is non-nil, programs which are not in the local cache are
+// downloaded from remote (using the same names), and newly built programs
+// are uploaded to remote.
+type binaryCache struct {
+	dir    string
+	remote remotecache.Backend
+
+	// pushFailed is set after the first failed upload, so that machines
+	// with read-only access to remote do not try (and warn) again for every
+	// program.
+	pushFailed atomic.Bool
+}
+
+// binaryCacheDir returns the directory of the local binary cache.
+func binaryCacheDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "gokrazy", "binaries"), nil
+}
+
+// newBinaryCache returns the local binary cache, pruning programs which were
+// not used within binaryCacheMaxAge (at most once a day). If remoteURL is
+// non-empty, the cache is backed by the remote cache at remoteURL (see
+// package remotecache), which is accessed using httpClient.
+func newBinaryCache(remoteURL string, httpClient *http.Client) (*binaryCache, error) {
+	dir, err := binaryCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	c := &binaryCache{dir: dir}
+	if remoteURL != "" {
+		c.remote, err = remotecache.Open(remoteURL, httpClient)
+		if err != nil {
+			return nil, err
+		}
+	}
+	marker := filepath.Join(dir, "last-prune")
+	if st, err := os.Stat(marker); err == nil && time.Since(st.ModTime()) < 24*time.Hour {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := c.prune(time.Now().Add(-binaryCacheMaxAge)); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *binaryCache) actionPath(key string) string {
+	return filepath.Join(c.dir, "actions", key[:2], key)
+}
+
+func (c *binaryCache) blobPath(sum string) string {
+	return filepath.Join(c.dir, "blobs", sum[:2], sum)
+}
+
+// InputsHash implements packer.BinaryCache.
+func (c *binaryCache) InputsHash(buildDir string) (string, error) {
+	h := sha256.New()
+	hashFileIfExists := func(path string) error {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		fmt.Fprintf(h, "file %s %x\n", filepath.Base(path), sha256.Sum256(b))
+		return nil
+	}
+	for _, name := range []string{"go.mod", "go.sum", "go.work", "go.work.sum", "vendor/modules.txt"} {
+		if err := hashFileIfExists(filepath.Join(buildDir, name)); err != nil {
+			return "", err
+		}
+	}
+
+	// Local directories, which (unlike module versions) can change without
+	// changing go.mod or go.sum.
+	var dirs []string
+	b, err := os.ReadFile(filepath.Join(buildDir, "go.mod"))
+	if err != nil {
+		return "", err
+	}
+	modf, err := modfile.Parse("go.mod", b, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range modf.Replace {
+		if r.New.Version == "" {
+			dirs = append(dirs, r.New.Path)
+		}
+	}
+	if packer.UsesWorkspace(buildDir) {
+		if b, err := os.ReadFile(filepath.Join(buildDir, "go.work")); err == nil {
+			wf, err := modfile.ParseWork("go.work", b, nil)
+			if err != nil {
+				return "", err
+			}
+			for _, u := range wf.Use {
+				dirs = append(dirs, u.Path)
+			}
+			for _, r := range wf.Replace {
+				if r.New.Version == "" {
+					dirs = append(dirs, r.New.Path)
+				}
+			}
+		}
+	}
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(buildDir, dir)
+		}
+		dh, err := hashDir(dir)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "dir %s %s\n", dir, dh)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Get implements packer.BinaryCache.
+func (c *binaryCache) Get(key, dest string) (bool, error) {
+	ok, err := c.getLocal(key, dest)
+	if ok || err != nil || c.remote == nil {
+		return ok, err
+	}
+	if ok, err := c.download(key); !ok || err != nil {
+		return false, err
+	}
+	return c.getLocal(key, dest)
+}
+
+// download stores the program of key from the remote cache in the local
+// cache, if the remote cache contains it.
+func (c *binaryCache) download(key string) (bool, error) {
+	ctx, canc := context.WithTimeout(context.Background(), remoteCacheTimeout)
+	defer canc()
+	b, err := c.remote.Get(ctx, "actions/"+key)
+	if err != nil {
+		if errors.Is(err, remotecache.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	sum := strings.TrimSpace(string(b))
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return false, fmt.Errorf("%s: actions/%s: invalid content", c.remote, key)
+	}
+	blob, err := c.remote.Get(ctx, "blobs/"+sum)
+	if err != nil {
+		if errors.Is(err, remotecache.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if got := fmt.Sprintf("%x", sha256.Sum256(blob)); got != sum {
+		return false, fmt.Errorf("%s: blobs/%s: corrupt: SHA256 is %s", c.remote, sum, got)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.blobPath(sum)), 0755); err != nil {
+		return false, err
+	}
+	if err := renameio.WriteFile(c.blobPath(sum), blob, 0644); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.actionPath(key)), 0755); err != nil {
+		return false, err
+	}
+	if err := renameio.WriteFile(c.actionPath(key), []byte(sum+"\n"), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *binaryCache) getLocal(key, dest string) (bool, error) {
+	action := c.actionPath(key)
+	b, err := os.ReadFile(action)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	sum := strings.TrimSpace(string(b))
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return false, fmt.Errorf("%s: invalid content", action)
+	}
+	blob := c.blobPath(sum)
+	in, err := os.Open(blob)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil // pruned
+		}
+		return false, err
+	}
+	defer in.Close()
+	out, err := renameio.TempFile("", dest)
+	if err != nil {
+		return false, err
+	}
+	defer out.Cleanup()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		return false, err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != sum {
+		os.Remove(blob)
+		return false, fmt.Errorf("%s: corrupt: SHA256 is %s", blob, got)
+	}
+	if err := out.Chmod(0755); err != nil {
+		return false, err
+	}
+	if err := out.CloseAtomicallyReplace(); err != nil {
+		return false, err
+	}
+	// Record the use for pruning.
+	now := time.Now()
+	os.Chtimes(action, now, now)
+	os.Chtimes(blob, now, now)
+	return true, nil
+}
+
+// Put implements packer.BinaryCache.
+func (c *binaryCache) Put(key, src string) error {
+	sum, err := hashFile(src)
+	if err != nil {
+		return err
+	}
+	blob := c.blobPath(sum)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return err
+		}
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := renameio.TempFile("", blob)
+		if err != nil {
+			return err
+		}
+		defer out.Cleanup()
+		if _, err := io.Copy(out, in); err != nil {
+			return err
+		}
+		if err := out.CloseAtomicallyReplace(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	action := c.actionPath(key)
+	if err := os.MkdirAll(filepath.Dir(action), 0755); err != nil {
+		return err
+	}
+	if err := renameio.WriteFile(action, []byte(sum+"\n"), 0644); err != nil {
+		return err
+	}
+	if c.remote != nil && !c.pushFailed.Load() {
+		if err := c.upload(key, sum); err != nil {
+			c.pushFailed.Store(true)
+			log.Printf("not uploading programs to the remote cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// upload stores the program of key (with SHA256 sum) in the remote cache.
+func (c *binaryCache) upload(key, sum string) error {
+	ctx, canc := context.WithTimeout(context.Background(), remoteCacheTimeout)
+	defer canc()
+	blob, err := os.ReadFile(c.blobPath(sum))
+	if err != nil {
+		return err
+	}
+	// The blob first, so that the action never refers to a missing blob.
+	if err := c.remote.Put(ctx, "blobs/"+sum, blob); err != nil {
+		return err
+	}
+	return c.remote.Put(ctx, "actions/"+key, []byte(sum+"\n"))
+}
+
+// prune removes actions and blobs which were last used before cutoff, and
+// actions whose blob is missing.
+func (c *binaryCache) prune(cutoff time.Time) error {
+	for _, sub := range []string{"blobs", "actions"} {
+		err := filepath.WalkDir(filepath.Join(c.dir, sub), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			remove := info.ModTime().Before(cutoff)
+			if !remove && sub == "actions" {
+				b, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				sum := strings.TrimSpace(string(b))
+				if len(sum) != sha256.Size*2 {
+					remove = true
+				} else if _, err := os.Stat(c.blobPath(sum)); os.IsNotExist(err) {
+					remove = true
+				}
+			}
+			if remove {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BinaryCacheStats describes the contents of the local binary cache.
+type BinaryCacheStats struct {
+	Dir string
+
+	// Actions is the number of cached builds (one per program and set of
+	// build inputs), Blobs the number of distinct programs they refer to.
+	Actions int
+	Blobs   int
+
+	// Bytes is the total size of all blobs.
+	Bytes int64
+
+	// Oldest and Newest are the times at which the least and most recently
+	// used programs were last used (zero if the cache is empty).
+	Oldest time.Time
+	Newest time.Time
+}
+
+// ReadBinaryCacheStats returns statistics about the local binary cache.
+func ReadBinaryCacheStats() (*BinaryCacheStats, error) {
+	dir, err := binaryCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	c := &binaryCache{dir: dir}
+	return c.stats()
+}
+
+// PruneBinaryCache removes programs which were not used within maxAge from
+// the local binary cache, or all programs if maxAge is 0. It returns the
+// statistics before and after pruning.
+func PruneBinaryCache(maxAge time.Duration) (before, after *BinaryCacheStats, _ error) {
+	dir, err := binaryCacheDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &binaryCache{dir: dir}
+	before, err = c.stats()
+	if err != nil {
+		return nil, nil, err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	if maxAge == 0 {
+		// Files can have modification times in the future (e.g. after
+		// copying the cache from a machine whose clock is ahead).
+		cutoff = time.Now().Add(365 * 24 * time.Hour)
+	}
+	if err := c.prune(cutoff); err != nil {
+		return nil, nil, err
+	}
+	after, err = c.stats()
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+func (c *binaryCache) stats() (*BinaryCacheStats, error) {
+	st := &BinaryCacheStats{Dir: c.dir}
+	for _, sub := range []string{"blobs", "actions"} {
+		err := filepath.WalkDir(filepath.Join(c.dir, sub), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			if sub == "actions" {
+				st.Actions++
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			st.Blobs++
+			st.Bytes += info.Size()
+			if mt := info.ModTime(); st.Oldest.IsZero() || mt.Before(st.Oldest) {
+				st.Oldest = mt
+			}
+			if mt := info.ModTime(); mt.After(st.Newest) {
+				st.Newest = mt
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// cachedPackages records the packages which packer.BuildEnv took from the
+// binary cache (see packer.BuildEnv.PackageCached).
+type cachedPackages struct {
+	mu   sync.Mutex
+	pkgs map[string]bool
+}
+
+func (c *cachedPackages) add(importPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pkgs == nil {
+		c.pkgs = make(map[string]bool)
+	}
+	c.pkgs[importPath] = true
+}
+
+func (c *cachedPackages) has(importPath string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pkgs[importPath]
+}
+
+func (c *cachedPackages) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pkgs)
+}
+
+// enableBinaryCache makes be take programs from the binary cache (recording
+// them in cached), unless disabled by Pack.NoBinaryCache. A broken binary
+// cache only results in a warning, as it is an optimization.
+func (pack *Pack) enableBinaryCache(be *packer.BuildEnv, cached *cachedPackages) {
+	if pack.NoBinaryCache {
+		return
+	}
+	c, err := newBinaryCache(pack.RemoteCache, pack.HTTPClient)
+	if err != nil {
+		log.Printf("not using the binary cache: %v", err)
+		return
+	}
+	if c.remote != nil {
+		log.Printf("using remote cache %s", c.remote)
+	}
+	be.Cache = c
+	be.PackageCached = cached.add
+}
+
+// printCachedPackages prints how many programs were taken from the binary
+// cache.
+func printCachedPackages(cached *cachedPackages) {
+	if n := cached.count(); n > 0 {
+		fmt.Printf("Reused %d programs whose inputs did not change since they were last built (binary cache)\n", n)
+	}
+}
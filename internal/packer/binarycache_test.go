@@ -0,0 +1,221 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/tools/internal/remotecache"
+)
+
+func TestBinaryCache(t *testing.T) {
+	c := &binaryCache{dir: t.TempDir()}
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "hello")
+	if err := os.WriteFile(src, []byte("ELF hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	const key = "0123456789abcdef"
+	dest := filepath.Join(tmp, "bin", "hello")
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.Get(key, dest); err != nil || ok {
+		t.Fatalf("Get(empty cache) = %v, %v, want false, nil", ok, err)
+	}
+	if err := c.Put(key, src); err != nil {
+		t.Fatal(err)
+	}
+	// A second program with identical contents is stored only once.
+	if err := c.Put("fedcba9876543210", src); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := filepath.Glob(filepath.Join(c.dir, "blobs", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 {
+		t.Errorf("cache contains %d blobs, want 1", len(blobs))
+	}
+
+	ok, err := c.Get(key, dest)
+	if err != nil || !ok {
+		t.Fatalf("Get = %v, %v, want true, nil", ok, err)
+	}
+	b, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "ELF hello"; got != want {
+		t.Errorf("cached program = %q, want %q", got, want)
+	}
+	st, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm()&0100 == 0 {
+		t.Errorf("cached program is not executable: %v", st.Mode())
+	}
+
+	// Corrupt blobs are detected and removed.
+	if err := os.WriteFile(blobs[0], []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.Get(key, dest); err == nil || ok {
+		t.Errorf("Get(corrupt) = %v, %v, want false, error", ok, err)
+	}
+
+	// Pruning removes everything not used after the cutoff.
+	if err := c.Put(key, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.prune(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.Get(key, dest); err != nil || ok {
+		t.Errorf("Get(pruned) = %v, %v, want false, nil", ok, err)
+	}
+}
+
+// memBackend is a remotecache.Backend which stores objects in memory.
+type memBackend struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	readOnly bool
+	puts     int
+}
+
+func (m *memBackend) Get(ctx context.Context, name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, remotecache.ErrNotFound)
+	}
+	return b, nil
+}
+
+func (m *memBackend) Put(ctx context.Context, name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.puts++
+	if m.readOnly {
+		return fmt.Errorf("%s: permission denied", name)
+	}
+	m.objects[name] = data
+	return nil
+}
+
+func (m *memBackend) String() string { return "mem://" }
+
+func TestBinaryCacheRemote(t *testing.T) {
+	remote := &memBackend{objects: make(map[string][]byte)}
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "hello")
+	if err := os.WriteFile(src, []byte("ELF hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	const key = "0123456789abcdef"
+
+	// A CI builder builds the program and uploads it.
+	builder := &binaryCache{dir: t.TempDir(), remote: remote}
+	if err := builder.Put(key, src); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(remote.objects), 2; got != want {
+		t.Fatalf("remote cache contains %d objects, want %d (action and blob)", got, want)
+	}
+
+	// A laptop with an empty local cache downloads the program.
+	laptop := &binaryCache{dir: t.TempDir(), remote: remote}
+	dest := filepath.Join(tmp, "dest")
+	ok, err := laptop.Get(key, dest)
+	if err != nil || !ok {
+		t.Fatalf("Get = %v, %v, want true, nil", ok, err)
+	}
+	b, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "ELF hello"; got != want {
+		t.Errorf("downloaded program = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(laptop.actionPath(key)); err != nil {
+		t.Errorf("downloaded program not stored in local cache: %v", err)
+	}
+	if ok, err := laptop.Get("fedcba9876543210", dest); err != nil || ok {
+		t.Errorf("Get(unknown) = %v, %v, want false, nil", ok, err)
+	}
+
+	// Corrupt remote blobs are rejected.
+	for name := range remote.objects {
+		if filepath.Dir(name) == "blobs" {
+			remote.objects[name] = []byte("garbage")
+		}
+	}
+	other := &binaryCache{dir: t.TempDir(), remote: remote}
+	if ok, err := other.Get(key, dest); err == nil || ok {
+		t.Errorf("Get(corrupt) = %v, %v, want false, error", ok, err)
+	}
+
+	// Uploading is attempted only once with read-only access.
+	readOnly := &memBackend{objects: make(map[string][]byte), readOnly: true}
+	c := &binaryCache{dir: t.TempDir(), remote: readOnly}
+	for _, key := range []string{"0123456789abcdef", "fedcba9876543210"} {
+		if err := c.Put(key, src); err != nil {
+			t.Fatalf("Put(read-only remote) = %v, want nil", err)
+		}
+	}
+	if got, want := readOnly.puts, 1; got != want {
+		t.Errorf("read-only remote: %d uploads attempted, want %d", got, want)
+	}
+}
+
+func TestBinaryCacheInputsHash(t *testing.T) {
+	tmp := t.TempDir()
+	buildDir := filepath.Join(tmp, "builddir", "example.com", "hello")
+	local := filepath.Join(tmp, "hello")
+	for name, contents := range map[string]string{
+		filepath.Join(buildDir, "go.mod"): "module gokrazy/build/hello\n\nrequire example.com/hello v0.0.0\n\nreplace example.com/hello => ../../../hello\n",
+		filepath.Join(local, "go.mod"):    "module example.com/hello\n",
+		filepath.Join(local, "main.go"):   "package main\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &binaryCache{dir: t.TempDir()}
+	before, err := c.InputsHash(buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.InputsHash(buildDir); err != nil || again != before {
+		t.Fatalf("InputsHash not stable: %q, %v, want %q", again, err, before)
+	}
+
+	// Changing the sources of the locally replaced module changes the hash.
+	if err := os.WriteFile(filepath.Join(local, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	after, err := c.InputsHash(buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == before {
+		t.Errorf("InputsHash did not change after modifying the local module")
+	}
+
+	if err := os.WriteFile(filepath.Join(buildDir, "go.sum"), []byte("example.com/foo v1.0.0 h1:abc=\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if withSum, err := c.InputsHash(buildDir); err != nil || withSum == after {
+		t.Errorf("InputsHash did not change after modifying go.sum (%v)", err)
+	}
+}
@@ -0,0 +1,100 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/gokrazy/internal/fat"
+)
+
+// bootloader describes device-specific configuration of how the device boots
+// the kernel from the boot file system.
+type bootloader struct {
+	// bootCmd is a text/template (see bootScriptData) for a U-Boot boot.cmd
+	// script, which the packer compiles into boot.scr.
+	bootCmd string
+
+	// dtb is the file name of the device tree blob for the device.
+	dtb string
+
+	// tryboot enables the Raspberry Pi firmware tryboot mechanism (Pi 4 and
+	// newer): when rebooted with the tryboot flag (reboot "0 tryboot"), the
+	// firmware reads tryboot.txt instead of config.txt. tryboot.txt sets
+	// os_prefix, so the trial boot uses its own copy of the kernel, device
+	// tree blobs, overlays, initramfs and cmdline.txt in trybootDir (whose
+	// root= refers to trybootRootPartition), while regular boots keep using
+	// the files at the top level of the boot file system.
+	//
+	// Updates of these devices use the gokrazy testboot mechanism, like for
+	// all other devices: test-booting an update with the tryboot flag needs
+	// support on the device (updating only trybootDir, and rebooting with the
+	// tryboot flag), which gokrazy/gokrazy does not provide yet.
+	tryboot bool
+}
+
+// bootloaders contains the bootloader configuration per device type (see
+// deviceconfig.DeviceConfig.Slug) for devices which do not boot using the
+// default Raspberry Pi firmware or UEFI configuration.
+var bootloaders = map[string]bootloader{
+	"raspberrypi5": {
+		tryboot: true,
+	},
+}
+
+// tryboot returns whether the device uses the Raspberry Pi firmware tryboot
+// mechanism, see bootloader.tryboot.
+func (p *Pack) tryboot() bool {
+	return bootloaders[p.Cfg.DeviceType].tryboot
+}
+
+// autobootTxt pins the boot partition for regular and tryboot boots. The
+// tryboot A/B selection happens within the gokrazy boot partition (tryboot.txt
+// selects trybootDir using os_prefix), not by switching boot partitions.
+const autobootTxt = `[all]
+tryboot_a_b=0
+boot_partition=1
+[tryboot]
+boot_partition=1
+`
+
+// writeTryboot writes the files for the tryboot mechanism (see
+// bootloader.tryboot): autoboot.txt, tryboot.txt (config.txt with os_prefix
+// set to trybootDir) and, in trybootDir, the kernelGlobs files of kernelDir,
+// the initramfs (if any) and cmdline.txt (see Pack.trybootCmdline).
+func (p *Pack) writeTryboot(ctx context.Context, fw *fat.Writer, kernelDir string, kernelGlobs []string, initramfsPath, config, cmdline string) error {
+	if err := p.copyGlobsToBoot(ctx, fw, kernelDir, "/"+trybootDir, kernelGlobs); err != nil {
+		return err
+	}
+	if initramfsPath != "" {
+		src, err := os.Open(initramfsPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dest := "/" + trybootDir + "/" + initramfsFilename
+		if st, err := src.Stat(); err == nil {
+			p.recordBootFile(dest, st.Size())
+		}
+		if err := copyFile(fw, dest, src, initramfsPath); err != nil {
+			return err
+		}
+	}
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{
+		{"/autoboot.txt", []byte(autobootTxt)},
+		{"/tryboot.txt", []byte(config + "\nos_prefix=" + trybootDir + "/\n")},
+		{"/" + trybootDir + "/cmdline.txt", padCmdline(p.trybootCmdline(cmdline))},
+	} {
+		w, err := fw.File(f.name, p.now())
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(f.content); err != nil {
+			return fmt.Errorf("%s: %v", f.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gokrazy/internal/fat"
+)
+
+// ubootDistroBoot is a boot.cmd template for U-Boot distro boot
+// (https://u-boot.readthedocs.io/en/latest/develop/distro.html), which
+// provides the device to load files from in ${devtype} ${devnum}:${distro_bootpart}.
+//
+// The kernel command line is read from cmdline.txt at boot time instead of
+// being embedded into the script, because gokrazy updates modify cmdline.txt
+// to switch root partitions.
+const ubootDistroBoot = `# Generated by gokrazy, do not edit. Compile with:
+# mkimage -A {{.Arch}} -O linux -T script -C none -d boot.cmd boot.scr
+setenv bootdev ${devtype} ${devnum}:${distro_bootpart}
+mw.b ${scriptaddr} 0 0x1000
+load ${bootdev} ${scriptaddr} cmdline.txt
+setexpr.s bootargs *${scriptaddr}
+load ${bootdev} ${kernel_addr_r} {{.Kernel}}
+load ${bootdev} ${fdt_addr_r} {{.DTB}}
+{{- if .Initramfs}}
+load ${bootdev} ${ramdisk_addr_r} {{.Initramfs}}
+{{.BootCmd}} ${kernel_addr_r} ${ramdisk_addr_r}:${filesize} ${fdt_addr_r}
+{{- else}}
+{{.BootCmd}} ${kernel_addr_r} - ${fdt_addr_r}
+{{- end}}
+`
+
+// bootScriptData is passed to boot.cmd templates.
+type bootScriptData struct {
+	// Arch is the U-Boot architecture name (e.g. arm64).
+	Arch string
+
+	// BootCmd is the U-Boot command to boot Kernel (booti or bootz).
+	BootCmd string
+
+	// Cmdline is the kernel command line as written to cmdline.txt.
+	Cmdline string
+
+	// Kernel, DTB and Initramfs are file names within the boot file
+	// system. Initramfs is empty if no initramfs is configured.
+	Kernel    string
+	DTB       string
+	Initramfs string
+}
+
+// U-Boot legacy image header constants, see include/image.h in U-Boot.
+const (
+	ubootMagic      = 0x27051956
+	ubootOSLinux    = 5
+	ubootArchARM    = 2
+	ubootArchARM64  = 22
+	ubootArchX86    = 3
+	ubootArchX86_64 = 24
+	ubootTypeScript = 6
+	ubootCompNone   = 0
+)
+
+type ubootHeader struct {
+	Magic     uint32
+	HeaderCRC uint32
+	Time      uint32
+	Size      uint32
+	Load      uint32
+	Entry     uint32
+	DataCRC   uint32
+	OS        uint8
+	Arch      uint8
+	Type      uint8
+	Comp      uint8
+	Name      [32]byte
+}
+
+func ubootArch(goarch string) (uint8, error) {
+	switch goarch {
+	case "arm":
+		return ubootArchARM, nil
+	case "arm64":
+		return ubootArchARM64, nil
+	case "386":
+		return ubootArchX86, nil
+	case "amd64":
+		return ubootArchX86_64, nil
+	}
+	return 0, fmt.Errorf("U-Boot images not supported for GOARCH=%s", goarch)
+}
+
+// compileBootScript returns script as a U-Boot legacy script image, like
+// mkimage -T script -C none would.
+func compileBootScript(script []byte, goarch string, mtime time.Time) ([]byte, error) {
+	arch, err := ubootArch(goarch)
+	if err != nil {
+		return nil, err
+	}
+	// Script images use the multi-file layout: a zero-terminated list of
+	// big-endian file sizes, followed by the (4-byte aligned) files.
+	var data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, uint32(len(script)))
+	binary.Write(&data, binary.BigEndian, uint32(0))
+	data.Write(script)
+	if pad := data.Len() % 4; pad != 0 {
+		data.Write(make([]byte, 4-pad))
+	}
+
+	hdr := ubootHeader{
+		Magic:   ubootMagic,
+		Time:    uint32(mtime.Unix()),
+		Size:    uint32(data.Len()),
+		DataCRC: crc32.ChecksumIEEE(data.Bytes()),
+		OS:      ubootOSLinux,
+		Arch:    arch,
+		Type:    ubootTypeScript,
+		Comp:    ubootCompNone,
+	}
+	copy(hdr.Name[:], "gokrazy boot script")
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &hdr)
+	hdr.HeaderCRC = crc32.ChecksumIEEE(buf.Bytes())
+	buf.Reset()
+	binary.Write(&buf, binary.BigEndian, &hdr)
+	buf.Write(data.Bytes())
+	return buf.Bytes(), nil
+}
+
+// writeBootScript generates boot.scr for devices which boot using U-Boot,
+// unless the kernel package already provides a boot.scr. The boot.cmd
+// template is taken from the kernel package (if present) or from the
+// bootloader configuration of the device type (see deviceSettings).
+func (p *Pack) writeBootScript(fw *fat.Writer, kernelDir, cmdline string, initramfs bool) error {
+	exists, err := fw.Exists("/boot.scr")
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil // provided by the kernel package
+	}
+	dev, err := deviceSettings(p.instancePath(), p.Cfg.DeviceType)
+	if err != nil {
+		return err
+	}
+	bl := dev.bootloader
+	tmpl := bl.bootCmd
+	if b, err := os.ReadFile(filepath.Join(kernelDir, "boot.cmd")); err == nil {
+		tmpl = string(b)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if tmpl == "" {
+		return nil // device does not boot using U-Boot
+	}
+
+	goarch := p.target.GOARCH
+	data := bootScriptData{
+		Arch:    goarch,
+		BootCmd: "booti",
+		Cmdline: strings.TrimSpace(cmdline),
+		Kernel:  "vmlinuz",
+		DTB:     bl.dtb,
+	}
+	if goarch == "arm" {
+		data.BootCmd = "bootz"
+	}
+	if goarch == "amd64" {
+		data.Arch = "x86_64"
+	}
+	if initramfs {
+		data.Initramfs = initramfsFilename
+	}
+	t, err := template.New("boot.cmd").Parse(tmpl)
+	if err != nil {
+		return err
+	}
+	var script bytes.Buffer
+	if err := t.Execute(&script, &data); err != nil {
+		return err
+	}
+	img, err := compileBootScript(script.Bytes(), goarch, p.now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Generating U-Boot boot script (boot.scr)\n")
+	w, err := fw.File("/boot.cmd", p.now())
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(script.Bytes()); err != nil {
+		return err
+	}
+	w, err = fw.File("/boot.scr", p.now())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(img)
+	return err
+}
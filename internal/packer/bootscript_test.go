@@ -0,0 +1,77 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestCompileBootScript(t *testing.T) {
+	script := []byte("echo hello\n") // 11 bytes, padded to 12
+	img, err := compileBootScript(script, "arm64", time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(img), 64+8+12; got != want {
+		t.Fatalf("len(img) = %d; want %d", got, want)
+	}
+	var hdr ubootHeader
+	if err := binary.Read(bytes.NewReader(img), binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Magic != ubootMagic {
+		t.Errorf("magic = %#x; want %#x", hdr.Magic, ubootMagic)
+	}
+	if hdr.Arch != ubootArchARM64 || hdr.Type != ubootTypeScript || hdr.OS != ubootOSLinux {
+		t.Errorf("unexpected header: %+v", hdr)
+	}
+	data := img[64:]
+	if got, want := hdr.DataCRC, crc32.ChecksumIEEE(data); got != want {
+		t.Errorf("data CRC = %#x; want %#x", got, want)
+	}
+	if got, want := binary.BigEndian.Uint32(data), uint32(len(script)); got != want {
+		t.Errorf("script size = %d; want %d", got, want)
+	}
+	if !bytes.HasPrefix(data[8:], script) {
+		t.Errorf("script not found in image data")
+	}
+
+	// The header CRC is computed with the header CRC field zeroed.
+	zeroed := bytes.Clone(img[:64])
+	binary.BigEndian.PutUint32(zeroed[4:], 0)
+	if got, want := hdr.HeaderCRC, crc32.ChecksumIEEE(zeroed); got != want {
+		t.Errorf("header CRC = %#x; want %#x", got, want)
+	}
+
+	if _, err := compileBootScript(script, "riscv64", time.Now()); err == nil {
+		t.Errorf("compileBootScript(riscv64) unexpectedly succeeded")
+	}
+}
+
+func TestDistroBootTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("boot.cmd").Parse(ubootDistroBoot))
+	for _, tt := range []struct {
+		data bootScriptData
+		want string
+	}{
+		{
+			data: bootScriptData{BootCmd: "booti", Kernel: "vmlinuz", DTB: "rk3328-rock64.dtb"},
+			want: "booti ${kernel_addr_r} - ${fdt_addr_r}\n",
+		},
+		{
+			data: bootScriptData{BootCmd: "bootz", Kernel: "vmlinuz", DTB: "x.dtb", Initramfs: "initramfs.img"},
+			want: "load ${bootdev} ${ramdisk_addr_r} initramfs.img\nbootz ${kernel_addr_r} ${ramdisk_addr_r}:${filesize} ${fdt_addr_r}\n",
+		},
+	} {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, &tt.data); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte(tt.want)) {
+			t.Errorf("boot.cmd = %q; want suffix %q", buf.String(), tt.want)
+		}
+	}
+}
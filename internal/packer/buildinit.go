@@ -2,10 +2,12 @@ package packer
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"go/format"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 	"text/template"
@@ -21,6 +23,21 @@ import (
 	"log"
 	"os"
 	"os/exec"
+{{- if .WrappedJSON }}
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+{{- end }}
+{{- if .HealthChecks }}
+	"net/http"
+{{- end }}
+{{- if .Supervised }}
+	"net"
+	"os/signal"
+	"sync"
+{{- end }}
 
 	"github.com/gokrazy/gokrazy"
 )
@@ -31,7 +48,11 @@ var buildTimestamp = {{ printf "%#v" .BuildTimestamp }}
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
+{{ if .WrappedJSON }}
+	if os.Getpid() != 1 {
+		wrap()
+	}
+{{ end }}
 	fmt.Printf("gokrazy build timestamp %s\n", buildTimestamp)
 	if err := gokrazy.Boot(buildTimestamp); err != nil {
 		log.Fatal(err)
@@ -69,8 +90,328 @@ func main() {
 	}
 	select {}
 }
+{{ if .WrappedJSON }}{{ template "wrap" . }}{{ end }}
 `
 
+// initWrapContents is the part of the generated init which wraps service
+// programs: programs whose service configuration cannot be expressed with
+// exec.Cmd alone are replaced by a symlink to /gokrazy/init, which applies the
+// configuration and then executes the program.
+const initWrapContents = `
+// wrappedServices is the JSON encoded configuration of the wrapped services,
+// keyed by program path.
+var wrappedServices = {{ printf "%q" .WrappedJSON }}
+
+type wrapConfig struct {
+	Real   string
+	User   string
+	UID    uint32
+	GID    uint32
+	Groups []uint32
+	Home   string
+
+	MemoryLimitMB int
+	CPUQuota      int
+	OOMScoreAdj   int
+
+	WaitFor []string
+
+	RestartPolicy  string
+	RestartBackoff time.Duration
+	Watchdog       time.Duration
+}
+
+// wrap applies the configuration of the service program os.Args[0] (if it is
+// a wrapped service) and executes the program. wrap returns only if os.Args[0]
+// is not a wrapped service.
+func wrap() {
+	var services map[string]wrapConfig
+	if err := json.Unmarshal([]byte(wrappedServices), &services); err != nil {
+		log.Fatal(err)
+	}
+	cfg, ok := services[os.Args[0]]
+	if !ok {
+		return
+	}
+{{- if .HealthChecks }}
+	waitHealthy(cfg.WaitFor)
+{{- end }}
+	if err := limitResources(cfg); err != nil {
+		log.Fatalf("%s: limiting resources: %v", os.Args[0], err)
+	}
+	if cfg.User != "" {
+		if err := setupUser(cfg); err != nil {
+			log.Fatalf("%s: setting up user %s: %v", os.Args[0], cfg.User, err)
+		}
+	}
+{{- if .Supervised }}
+	if cfg.RestartPolicy != "" || cfg.RestartBackoff > 0 || cfg.Watchdog > 0 {
+		supervise(cfg)
+	}
+{{- end }}
+	if cfg.User != "" {
+		if err := dropPrivileges(cfg); err != nil {
+			log.Fatalf("%s: running as %s: %v", os.Args[0], cfg.User, err)
+		}
+	}
+	if err := syscall.Exec(cfg.Real, os.Args, os.Environ()); err != nil {
+		log.Fatalf("exec %s: %v", cfg.Real, err)
+	}
+}
+
+{{ if .HealthChecks }}
+// waitHealthy blocks until all urls respond with a 2xx HTTP status code.
+func waitHealthy(urls []string) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, u := range urls {
+		for attempt := 0; ; attempt++ {
+			resp, err := client.Get(u)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+					break
+				}
+				err = fmt.Errorf("unexpected HTTP status: %v", resp.Status)
+			}
+			if attempt%30 == 0 {
+				log.Printf("%s: waiting for %s: %v", os.Args[0], u, err)
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}
+}
+{{ end }}
+// limitResources moves the process into a cgroup with the memory and CPU limits
+// of cfg (falling back to RLIMIT_AS for the memory limit if cgroup v2 is not
+// available) and sets its oom_score_adj. Limits are inherited across exec.
+func limitResources(cfg wrapConfig) error {
+	if cfg.OOMScoreAdj != 0 {
+		if err := os.WriteFile("/proc/self/oom_score_adj", []byte(fmt.Sprint(cfg.OOMScoreAdj)), 0644); err != nil {
+			return err
+		}
+	}
+	if cfg.MemoryLimitMB == 0 && cfg.CPUQuota == 0 {
+		return nil
+	}
+	err := joinCgroup(filepath.Base(os.Args[0]), cfg)
+	if err == nil {
+		return nil
+	}
+	if cfg.MemoryLimitMB == 0 {
+		log.Printf("%s: cgroup v2 unavailable, not limiting CPU usage: %v", os.Args[0], err)
+		return nil
+	}
+	log.Printf("%s: cgroup v2 unavailable, limiting address space instead: %v", os.Args[0], err)
+	limit := uint64(cfg.MemoryLimitMB) * 1024 * 1024
+	return syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: limit, Max: limit})
+}
+
+// joinCgroup moves the process into the cgroup /sys/fs/cgroup/gokrazy/<name>,
+// mounting the cgroup v2 hierarchy and creating the cgroup as needed.
+func joinCgroup(name string, cfg wrapConfig) error {
+	const root = "/sys/fs/cgroup"
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		if err := syscall.Mount("cgroup2", root, "cgroup2", 0, ""); err != nil {
+			return fmt.Errorf("mounting cgroup2: %v", err)
+		}
+	}
+	parent := filepath.Join(root, "gokrazy")
+	dir := filepath.Join(parent, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var controllers []string
+	if cfg.MemoryLimitMB > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if cfg.CPUQuota > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	for _, d := range []string{root, parent} {
+		if err := os.WriteFile(filepath.Join(d, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0644); err != nil {
+			return fmt.Errorf("enabling controllers %v: %v", controllers, err)
+		}
+	}
+	if cfg.MemoryLimitMB > 0 {
+		limit := fmt.Sprint(cfg.MemoryLimitMB * 1024 * 1024)
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(limit), 0644); err != nil {
+			return err
+		}
+	}
+	if cfg.CPUQuota > 0 {
+		// cpu.max contains the quota and the period in microseconds.
+		quota := fmt.Sprintf("%d 100000", cfg.CPUQuota*1000)
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte("0"), 0644)
+}
+
+// setupUser sets the HOME and USER environment variables for the user of cfg,
+// creating the home directory if it is on the permanent file system.
+func setupUser(cfg wrapConfig) error {
+	if strings.HasPrefix(cfg.Home, "/perm/") {
+		if _, err := os.Stat(cfg.Home); os.IsNotExist(err) {
+			if err := os.MkdirAll(cfg.Home, 0700); err != nil {
+				return err
+			}
+			if err := os.Chown(cfg.Home, int(cfg.UID), int(cfg.GID)); err != nil {
+				return err
+			}
+		}
+	}
+	os.Setenv("HOME", cfg.Home)
+	os.Setenv("USER", cfg.User)
+	return nil
+}
+
+// dropPrivileges switches to the user and groups of cfg.
+func dropPrivileges(cfg wrapConfig) error {
+	groups := make([]int, 0, len(cfg.Groups))
+	for _, gid := range cfg.Groups {
+		groups = append(groups, int(gid))
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(int(cfg.GID)); err != nil {
+		return err
+	}
+	return syscall.Setuid(int(cfg.UID))
+}
+{{ if .Supervised }}
+// supervise runs the program as a child process (instead of executing it),
+// restarting it according to the restart policy of cfg. supervise exits with
+// status 125, which tells gokrazy not to restart the service, once the
+// program should no longer be restarted.
+func supervise(cfg wrapConfig) {
+	var (
+		mu          sync.Mutex
+		child       *os.Process
+		terminating bool
+	)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			mu.Lock()
+			if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+				terminating = true
+			}
+			if child != nil {
+				child.Signal(sig)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	backoff := cfg.RestartBackoff
+	if backoff == 0 {
+		backoff = 1 * time.Second
+	}
+	for {
+		err := runChild(cfg, func(p *os.Process) {
+			mu.Lock()
+			defer mu.Unlock()
+			child = p
+		})
+		mu.Lock()
+		stop := terminating
+		mu.Unlock()
+		if stop {
+			os.Exit(0)
+		}
+		if cfg.RestartPolicy == "never" ||
+			(cfg.RestartPolicy == "on-failure" && err == nil) {
+			log.Printf("%s: exited (%v), not restarting (RestartPolicy %s)", os.Args[0], err, cfg.RestartPolicy)
+			os.Exit(125)
+		}
+		log.Printf("%s: exited (%v), restarting in %v", os.Args[0], err, backoff)
+		time.Sleep(backoff)
+	}
+}
+
+// runChild runs the program of cfg until it exits, calling started with the
+// child process. If cfg has a watchdog interval, the program must send
+// WATCHDOG=1 notifications (see sd_notify(3)) to the socket in $NOTIFY_SOCKET
+// at least that often, or it is aborted.
+func runChild(cfg wrapConfig, started func(*os.Process)) error {
+	cmd := exec.Command(cfg.Real, os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	if cfg.User != "" {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    cfg.UID,
+			Gid:    cfg.GID,
+			Groups: cfg.Groups,
+		}
+	}
+	var notify *net.UnixConn
+	if cfg.Watchdog > 0 {
+		dir := filepath.Join(os.TempDir(), "gokrazy-notify")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.Base(os.Args[0])+".sock")
+		os.Remove(path)
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		defer os.Remove(path)
+		if cfg.User != "" {
+			if err := os.Chown(path, int(cfg.UID), int(cfg.GID)); err != nil {
+				return err
+			}
+		}
+		notify = conn
+		cmd.Env = append(cmd.Env,
+			"NOTIFY_SOCKET="+path,
+			fmt.Sprintf("WATCHDOG_USEC=%d", cfg.Watchdog.Microseconds()))
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	started(cmd.Process)
+	if notify != nil {
+		go watch(notify, cmd.Process, cfg.Watchdog)
+	}
+	return cmd.Wait()
+}
+
+// watch aborts p (like systemd, with SIGABRT, followed by SIGKILL) when no
+// WATCHDOG=1 notification arrives on conn within interval. watch returns when
+// conn is closed.
+func watch(conn *net.UnixConn, p *os.Process, interval time.Duration) {
+	buf := make([]byte, 4096)
+	deadline := time.Now().Add(interval)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		if os.IsTimeout(err) {
+			log.Printf("%s: watchdog timeout (%v), aborting", os.Args[0], interval)
+			p.Signal(syscall.SIGABRT)
+			time.AfterFunc(10*time.Second, func() { p.Kill() })
+			return
+		}
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line == "WATCHDOG=1" {
+				deadline = time.Now().Add(interval)
+			}
+		}
+	}
+}
+{{ end }}`
+
 var initTmpl = template.Must(template.New("").Funcs(template.FuncMap{
 	"CommandFor": func(flags map[string][]string, path string) string {
 		contents := flags[filepath.Base(path)]
@@ -97,6 +438,10 @@ var initTmpl = template.Must(template.New("").Funcs(template.FuncMap{
 	},
 }).Parse(initTmplContents))
 
+func init() {
+	template.Must(initTmpl.New("wrap").Parse(initWrapContents))
+}
+
 func flattenFiles(prefix string, root *FileInfo) []string {
 	var result []string
 	for _, ent := range root.Dirents {
@@ -116,38 +461,181 @@ type gokrazyInit struct {
 	dontStart        map[string]bool
 	waitForClock     map[string]bool
 	buildTimestamp   string
+
+	// services contains the configuration of services which need to be
+	// wrapped (see initWrapContents), keyed by import path.
+	services map[string]*serviceConfig
+
+	// templatePath is the path to a custom init template (InitTemplatePath),
+	// which replaces initTmplContents if non-empty.
+	templatePath string
+
+	// after maps import paths to the import paths of the packages which are
+	// started before them (see Pack.serviceDependencies).
+	after map[string][]string
+
+	// basenames maps import paths to binary names (see
+	// packer.BuildEnv.Basenames).
+	basenames map[string]string
+
+	// env is the environment for building init (see packer.Target.Env).
+	env []string
+
+	// options are the BuildOptions of the instance, if any.
+	options *packer.BuildOptions
+
+	// instanceDir is the instance directory containing the builddir of
+	// github.com/gokrazy/gokrazy (see Pack.InstanceDir).
+	instanceDir string
 }
 
-func mapKeyBasename[M ~map[string]V, V any](m M) M {
+// mapKeyBasename converts the import path keys of m into binary names, using
+// basenames for overrides.
+func mapKeyBasename[M ~map[string]V, V any](m M, basenames map[string]string) M {
 	r := make(M, len(m))
 	for k, v := range m {
+		if basename, ok := basenames[k]; ok {
+			r[basename] = v
+			continue
+		}
 		r[filepath.Base(k)] = v
 	}
 	return r
 }
 
+// wrapped returns the configuration of the wrapped services, keyed by program
+// path.
+func (g *gokrazyInit) wrapped() map[string]*serviceConfig {
+	services := mapKeyBasename(g.services, g.basenames)
+	wrapped := make(map[string]*serviceConfig)
+	for _, p := range flattenFiles("/", g.root) {
+		svc, ok := services[filepath.Base(p)]
+		if !ok || p == "/gokrazy/init" {
+			continue
+		}
+		cfg := *svc // copy
+		cfg.Real = path.Join(wrappedDir, p)
+		wrapped[p] = &cfg
+	}
+	return wrapped
+}
+
+// orderBinaries returns binaries (program paths) ordered such that each
+// program comes after the programs it depends on (see gokrazyInit.after), but
+// otherwise in the original order.
+func (g *gokrazyInit) orderBinaries(binaries []string) []string {
+	after := make(map[string][]string)
+	for pkg, deps := range mapKeyBasename(g.after, g.basenames) {
+		for _, dep := range deps {
+			depBasename, ok := g.basenames[dep]
+			if !ok {
+				depBasename = filepath.Base(dep)
+			}
+			after[pkg] = append(after[pkg], depBasename)
+		}
+	}
+	byBasename := make(map[string]string)
+	for _, b := range binaries {
+		byBasename[filepath.Base(b)] = b
+	}
+	ordered := make([]string, 0, len(binaries))
+	visited := make(map[string]bool)
+	var visit func(b string)
+	visit = func(b string) {
+		if visited[b] {
+			return
+		}
+		visited[b] = true
+		for _, dep := range after[filepath.Base(b)] {
+			if p, ok := byBasename[dep]; ok {
+				visit(p)
+			}
+		}
+		ordered = append(ordered, b)
+	}
+	for _, b := range binaries {
+		visit(b)
+	}
+	return ordered
+}
+
 func (g *gokrazyInit) generate() ([]byte, error) {
 	var buf bytes.Buffer
 
-	if err := initTmpl.Execute(&buf, struct {
+	var (
+		wrappedJSON  string
+		healthChecks bool
+		supervised   bool
+	)
+	if wrapped := g.wrapped(); len(wrapped) > 0 {
+		b, err := json.Marshal(wrapped)
+		if err != nil {
+			return nil, err
+		}
+		wrappedJSON = string(b)
+		for _, svc := range wrapped {
+			if len(svc.WaitFor) > 0 {
+				healthChecks = true
+			}
+			if svc.supervised() {
+				supervised = true
+			}
+		}
+	}
+
+	tmpl := initTmpl
+	if g.templatePath != "" {
+		contents, err := os.ReadFile(g.templatePath)
+		if err != nil {
+			return nil, err
+		}
+		// Custom templates can use the same functions and include the
+		// service wrapper via {{ template "wrap" . }}.
+		clone, err := initTmpl.Clone()
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err = clone.New(filepath.Base(g.templatePath)).Parse(string(contents))
+		if err != nil {
+			return nil, fmt.Errorf("InitTemplatePath: %v", err)
+		}
+	}
+
+	if err := tmpl.Execute(&buf, struct {
 		Binaries       []string
 		BuildTimestamp string
 		Flags          map[string][]string
 		Env            map[string][]string
 		DontStart      map[string]bool
 		WaitForClock   map[string]bool
+		WrappedJSON    string
+		HealthChecks   bool
+		Supervised     bool
 	}{
-		Binaries:       flattenFiles("/", g.root),
+		Binaries:       g.orderBinaries(flattenFiles("/", g.root)),
 		BuildTimestamp: g.buildTimestamp,
-		Flags:          mapKeyBasename(g.flagFileContents),
-		Env:            mapKeyBasename(g.envFileContents),
-		DontStart:      mapKeyBasename(g.dontStart),
-		WaitForClock:   mapKeyBasename(g.waitForClock),
+		Flags:          mapKeyBasename(g.flagFileContents, g.basenames),
+		Env:            mapKeyBasename(g.envFileContents, g.basenames),
+		DontStart:      mapKeyBasename(g.dontStart, g.basenames),
+		WaitForClock:   mapKeyBasename(g.waitForClock, g.basenames),
+		WrappedJSON:    wrappedJSON,
+		HealthChecks:   healthChecks,
+		Supervised:     supervised,
 	}); err != nil {
 		return nil, err
 	}
 
-	return format.Source(buf.Bytes())
+	if g.templatePath == "" {
+		return format.Source(buf.Bytes())
+	}
+	b, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("InitTemplatePath %s: rendered init is not valid Go: %v", g.templatePath, err)
+	}
+	if wrappedJSON != "" && !bytes.Contains(b, []byte("func wrap()")) {
+		return nil, fmt.Errorf("InitTemplatePath %s: PackageConfig requires the service wrapper, but the template does not include it ({{ if .WrappedJSON }}{{ template \"wrap\" . }}{{ end }})", g.templatePath)
+	}
+	return b, nil
 }
 
 func (g *gokrazyInit) dump(path string) error {
@@ -171,7 +659,7 @@ func (g *gokrazyInit) dump(path string) error {
 
 func (g *gokrazyInit) build() (tmpdir string, err error) {
 	const pkg = "github.com/gokrazy/gokrazy"
-	buildDir, err := packer.BuildDirOrMigrate(pkg)
+	buildDir, err := packer.InstanceBuildDirOrMigrate(g.instanceDir, pkg)
 	if err != nil {
 		return "", fmt.Errorf("PackageDirs(%s): %v", pkg, err)
 	}
@@ -193,16 +681,20 @@ func (g *gokrazyInit) build() (tmpdir string, err error) {
 	defer os.Remove(initGo)
 
 	tags := packer.DefaultTags()
-	cmd := exec.Command("go",
-		"build",
-		"-mod=mod",
+	args := append([]string{"build"}, packer.ModFlags(buildDir)...)
+	args = append(args, g.options.Flags(nil)...)
+	args = append(args,
 		"-o", filepath.Join(tmpdir, "init"),
 		"-tags="+strings.Join(tags, ","),
 		initGo)
+	cmd := exec.Command("go", args...)
 	cmd.Dir = buildDir
-	cmd.Env = packer.Env()
+	cmd.Env = g.env
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
+		if g.templatePath != "" {
+			return "", fmt.Errorf("compiling init rendered from InitTemplatePath %s: %v: %v", g.templatePath, cmd.Args, err)
+		}
 		return "", fmt.Errorf("%v: %v", cmd.Args, err)
 	}
 	return tmpdir, nil
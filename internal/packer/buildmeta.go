@@ -0,0 +1,213 @@
+package packer
+
+import (
+	"debug/buildinfo"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/gokrazy/internal/humanize"
+	"github.com/gokrazy/tools/internal/renameio"
+)
+
+// buildMetadataPath is the path (relative to the instance directory) of the
+// build metadata of the most recent build.
+var buildMetadataPath = filepath.Join("builddir", "build-metadata.json")
+
+// BuildMetadata describes the programs of a build.
+type BuildMetadata struct {
+	BuildTimestamp string           `json:"build_timestamp"`
+	Binaries       []BinaryMetadata `json:"binaries"`
+}
+
+// BinaryMetadata describes a program of a build.
+type BinaryMetadata struct {
+	Path       string `json:"path"` // e.g. /user/scan2drive
+	ImportPath string `json:"import_path"`
+	GoVersion  string `json:"go_version"`
+	Size       int64  `json:"size"`
+
+	// Modules maps module paths to versions (including the main module).
+	Modules map[string]string `json:"modules"`
+}
+
+// collectBuildMetadata reads the size and embedded build information (using
+// readBuildInfo, i.e. buildinfo.ReadFile) of all programs in root.
+func collectBuildMetadata(root *FileInfo, buildTimestamp string, readBuildInfo func(string) (*buildinfo.BuildInfo, error)) (*BuildMetadata, error) {
+	md := &BuildMetadata{BuildTimestamp: buildTimestamp}
+	for _, p := range flattenFiles("/", root) {
+		ent := root.findDirent(p)
+		st, err := os.Stat(ent.FromHost)
+		if err != nil {
+			return nil, err
+		}
+		bin := BinaryMetadata{
+			Path:    p,
+			Size:    st.Size(),
+			Modules: make(map[string]string),
+		}
+		if bi, err := readBuildInfo(ent.FromHost); err == nil {
+			bin.ImportPath = bi.Path
+			bin.GoVersion = bi.GoVersion
+			if bi.Main.Path != "" {
+				bin.Modules[bi.Main.Path] = bi.Main.Version
+			}
+			for _, dep := range bi.Deps {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				bin.Modules[dep.Path] = dep.Version
+			}
+		}
+		md.Binaries = append(md.Binaries, bin)
+	}
+	sort.Slice(md.Binaries, func(i, j int) bool {
+		return md.Binaries[i].Path < md.Binaries[j].Path
+	})
+	return md, nil
+}
+
+// readBuildMetadata returns the build metadata of the previous build stored
+// in path, or nil if there is none.
+func readBuildMetadata(path string) (*BuildMetadata, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var md BuildMetadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &md, nil
+}
+
+func (md *BuildMetadata) write(path string) error {
+	b, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(path, append(b, '\n'), 0644)
+}
+
+func (md *BuildMetadata) binary(p string) (BinaryMetadata, bool) {
+	for _, bin := range md.Binaries {
+		if bin.Path == p {
+			return bin, true
+		}
+	}
+	return BinaryMetadata{}, false
+}
+
+// moduleChanges returns the added, removed and changed modules of cur compared
+// to prev, e.g. “+example.com/foo v1.0.0”.
+func moduleChanges(prev, cur map[string]string) []string {
+	var changes []string
+	for mod, v := range cur {
+		old, ok := prev[mod]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("+%s %s", mod, v))
+		case old != v:
+			changes = append(changes, fmt.Sprintf(" %s %s → %s", mod, old, v))
+		}
+	}
+	for mod, v := range prev {
+		if _, ok := cur[mod]; !ok {
+			changes = append(changes, fmt.Sprintf("-%s %s", mod, v))
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i][1:] < changes[j][1:]
+	})
+	return changes
+}
+
+func sizeDelta(prev, cur int64) string {
+	switch {
+	case cur > prev:
+		return "+" + humanize.Bytes(uint64(cur-prev))
+	case cur < prev:
+		return "-" + humanize.Bytes(uint64(prev-cur))
+	}
+	return "±0"
+}
+
+// printSizes prints the size of each program of md, with the size and module
+// changes compared to prev (if non-nil).
+func (md *BuildMetadata) printSizes(w io.Writer, prev *BuildMetadata) {
+	fmt.Fprintf(w, "\nProgram sizes:\n\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var total, prevTotal int64
+	changes := make(map[string][]string)
+	for _, bin := range md.Binaries {
+		total += bin.Size
+		delta := ""
+		if prev != nil {
+			if old, ok := prev.binary(bin.Path); ok {
+				delta = sizeDelta(old.Size, bin.Size)
+				changes[bin.Path] = moduleChanges(old.Modules, bin.Modules)
+			} else {
+				delta = "new"
+			}
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", bin.Path, humanize.Bytes(uint64(bin.Size)), delta)
+	}
+	totalDelta := ""
+	if prev != nil {
+		for _, bin := range prev.Binaries {
+			prevTotal += bin.Size
+			if _, ok := md.binary(bin.Path); !ok {
+				fmt.Fprintf(tw, "  %s\t\tremoved\n", bin.Path)
+			}
+		}
+		totalDelta = sizeDelta(prevTotal, total)
+	}
+	fmt.Fprintf(tw, "  total\t%s\t%s\n", humanize.Bytes(uint64(total)), totalDelta)
+	tw.Flush()
+
+	for _, bin := range md.Binaries {
+		if len(changes[bin.Path]) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nModule changes in %s:\n", bin.Path)
+		for _, change := range changes[bin.Path] {
+			fmt.Fprintf(w, "  %s\n", change)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// recordBuildMetadata writes the build metadata of the programs in root and
+// prints their sizes if pack.PrintSizes is set. When the programs are reused
+// from a previous build (see BuildMatrix), the metadata is only collected.
+func (pack *Pack) recordBuildMetadata(root *FileInfo, buildTimestamp string) error {
+	md, err := collectBuildMetadata(root, buildTimestamp, buildinfo.ReadFile)
+	if err != nil {
+		return err
+	}
+	pack.buildMetadata = md
+	if pack.reuseBins {
+		return nil
+	}
+	path := pack.instancePath(buildMetadataPath)
+	prev, err := readBuildMetadata(path)
+	if err != nil {
+		return err
+	}
+	if pack.PrintSizes {
+		md.printSizes(os.Stdout, prev)
+	}
+	return md.write(path)
+}
@@ -0,0 +1,286 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/gokrazy/tools/internal/version"
+)
+
+// BundleCacheDir is the directory of a bundle (see Pack.Bundle) containing
+// the files which building the instance takes from the gokrazy cache
+// directory of the user (e.g. ~/.cache/gokrazy), like downloaded extra files.
+// ImportBundle moves them into the gokrazy cache directory.
+const BundleCacheDir = "bundle-cache"
+
+// bundleManifest is the name of the manifest within a bundle. Bundles use the
+// same format as snapshot bundles (see Pack.Snapshot).
+const bundleManifest = "bundle.json"
+
+// BundleManifest describes a bundle, see Pack.Bundle.
+type BundleManifest struct {
+	SnapshotManifest
+
+	// GOOS and GOARCH are the platform of the machine which created the
+	// bundle. The GoToolchain in the bundle runs only on this platform.
+	GOOS   string
+	GOARCH string
+
+	// GoToolchain is the Go toolchain pinned via the GoToolchain config
+	// field, if any.
+	GoToolchain string `json:",omitempty"`
+
+	// Modules is the number of module versions in the bundle.
+	Modules int
+}
+
+// gokrazyCacheDir returns the gokrazy cache directory of the user, in which
+// e.g. extra files (see extraFilesCacheDir) are cached.
+func gokrazyCacheDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "gokrazy"), nil
+}
+
+// bundleModCacheFiles returns the files of the download cache of the
+// ModCacheDir (see Vendor) of the instance directory instanceDir, from which
+// the go command extracts modules without network access, and the number of
+// module versions.
+func bundleModCacheFiles(instanceDir string) ([]snapshotFile, int, error) {
+	var (
+		files   []snapshotFile
+		modules int
+	)
+	download := filepath.Join(instanceDir, ModCacheDir, "cache", "download")
+	err := filepath.WalkDir(download, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		// Lock files and incomplete downloads are not needed.
+		if strings.HasSuffix(p, ".lock") || strings.HasSuffix(p, ".partial") {
+			return nil
+		}
+		if strings.HasSuffix(p, ".zip") {
+			modules++
+		}
+		rel, err := filepath.Rel(instanceDir, p)
+		if err != nil {
+			return err
+		}
+		f, err := newSnapshotFile(filepath.ToSlash(rel), p)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, modules, err
+}
+
+// bundleCacheFiles downloads (unless cached) the ExtraFilePaths URLs and
+// ExtraFileOCI images of the instance and returns their cached files, which
+// are stored below BundleCacheDir.
+func (pack *Pack) bundleCacheFiles() ([]snapshotFile, error) {
+	cacheDir, err := gokrazyCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	var cached []string
+	for pkg, pc := range pack.FileCfg.PackageConfig {
+		for _, value := range pc.ExtraFilePaths {
+			if !isExtraFileURL(value) {
+				continue
+			}
+			fn, err := fetchExtraFile(pack.httpClient(), value, false)
+			if err != nil {
+				return nil, fmt.Errorf("ExtraFilePaths of %s: %v", pkg, err)
+			}
+			if _, err := os.Stat(fn); err != nil {
+				fn += ".tar" // tarball, see fetchExtraFile
+			}
+			cached = append(cached, fn)
+		}
+	}
+	for pkg, pc := range pack.Ext.PackageConfig {
+		for dest, image := range pc.ExtraFileOCI {
+			archive, err := fetchOCIExtraFiles(pack.httpClient(), image, dest, pack.target.GOARCH)
+			if err != nil {
+				return nil, fmt.Errorf("ExtraFileOCI of %s: %v", pkg, err)
+			}
+			cached = append(cached, archive+".tar")
+		}
+	}
+	files := make([]snapshotFile, 0, len(cached))
+	for _, fn := range cached {
+		rel, err := filepath.Rel(cacheDir, fn)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return nil, fmt.Errorf("BUG: cached file %s is not in %s", fn, cacheDir)
+		}
+		f, err := newSnapshotFile(path.Join(BundleCacheDir, filepath.ToSlash(rel)), fn)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Bundle writes a bundle (a gzip-compressed tar archive) of the instance (see
+// Pack.InstanceDir) to w, from which the instance can be built on another
+// machine without network access (see ImportBundle and Pack.Offline). In
+// addition to the files of a snapshot (see Pack.Snapshot), a bundle contains
+// the vendored modules (including the kernel and firmware packages and the
+// GoToolchain, see Pack.Vendor, which must be called first), downloaded
+// ExtraFilePaths URLs and ExtraFileOCI images.
+func (pack *Pack) Bundle(w io.Writer) (*BundleManifest, error) {
+	if pack.Ext == nil {
+		return nil, fmt.Errorf("BUG: Bundle called without Ext")
+	}
+	pack.resolveTarget()
+	instanceDir, err := pack.instanceAbs()
+	if err != nil {
+		return nil, err
+	}
+	files, err := instanceSnapshotFiles(instanceDir)
+	if err != nil {
+		return nil, err
+	}
+	externalFiles, external, err := pack.externalSnapshotFiles(instanceDir)
+	if err != nil {
+		return nil, err
+	}
+	modFiles, modules, err := bundleModCacheFiles(instanceDir)
+	if err != nil {
+		return nil, err
+	}
+	if modules == 0 {
+		return nil, fmt.Errorf("%s/ contains no modules, run gok vendor first", ModCacheDir)
+	}
+	cacheFiles, err := pack.bundleCacheFiles()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, externalFiles...)
+	files = append(files, modFiles...)
+	files = append(files, cacheFiles...)
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	manifest := &BundleManifest{
+		SnapshotManifest: SnapshotManifest{
+			Instance:           pack.FileCfg.Hostname,
+			Created:            time.Now().UTC(),
+			GokVersion:         version.ReadBrief(),
+			Files:              snapshotFileHashes(files),
+			ExternalExtraFiles: external,
+		},
+		GOOS:        runtime.GOOS,
+		GOARCH:      runtime.GOARCH,
+		GoToolchain: pack.Ext.GoToolchain,
+		Modules:     modules,
+	}
+	if _, sbom, err := pack.GenerateSBOM(); err != nil {
+		log.Printf("bundle: not recording SBOM hash: %v", err)
+	} else {
+		manifest.SBOMHash = sbom.SBOMHash
+	}
+	if err := writeSnapshotArchive(w, bundleManifest, manifest, manifest.Created, files); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ReadBundleManifest returns the manifest of the bundle r.
+func ReadBundleManifest(r io.Reader) (*BundleManifest, error) {
+	var manifest BundleManifest
+	if _, err := readSnapshotArchiveManifest(r, "bundle", bundleManifest, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// ImportBundle extracts the bundle r (see Pack.Bundle) into the (new or empty)
+// instance directory dir, verifying the SHA256 sum of every file, and moves
+// the files of BundleCacheDir into the gokrazy cache directory of the user.
+// Like for RestoreSnapshot, the caller is responsible for pointing the
+// ExtraFilePaths entries of ExternalExtraFiles to their SnapshotPath.
+func ImportBundle(r io.Reader, dir string) (*BundleManifest, error) {
+	var manifest BundleManifest
+	tr, err := readSnapshotArchiveManifest(r, "bundle", bundleManifest, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := extractSnapshotArchive(tr, dir, "bundle", bundleManifest, manifest.Files); err != nil {
+		return nil, err
+	}
+	if err := installBundleCache(filepath.Join(dir, BundleCacheDir)); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// installBundleCache moves the files of the extracted BundleCacheDir src into
+// the gokrazy cache directory (keeping files which are already cached) and
+// removes src.
+func installBundleCache(src string) error {
+	cacheDir, err := gokrazyCacheDir()
+	if err != nil {
+		return err
+	}
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(cacheDir, rel)
+		if _, err := os.Stat(dest); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := renameio.TempFile("", dest)
+		if err != nil {
+			return err
+		}
+		defer out.Cleanup()
+		if _, err := io.Copy(out, in); err != nil {
+			return err
+		}
+		return out.CloseAtomicallyReplace()
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
@@ -0,0 +1,126 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+)
+
+// setUserCacheDir makes os.UserCacheDir return dir.
+func setUserCacheDir(t *testing.T, dir string) {
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir) // darwin: $HOME/Library/Caches
+}
+
+func TestBundleImport(t *testing.T) {
+	tmp := t.TempDir()
+	instanceDir := filepath.Join(tmp, "scanner")
+	exportCache := filepath.Join(tmp, "export-cache")
+	setUserCacheDir(t, exportCache)
+	blobCache, err := extraFilesCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := "firmware blob\n"
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(blob)))
+	zip := filepath.Join(ModCacheDir, "cache", "download", "example.com", "scan", "@v", "v1.0.0.zip")
+	for name, contents := range map[string]string{
+		filepath.Join(instanceDir, "config.json"):                                        `{"Hostname":"scanner"}`,
+		filepath.Join(instanceDir, "builddir", "example.com", "scan", "go.mod"):          "module gokrazy/build/scan\n",
+		filepath.Join(instanceDir, zip):                                                  "zip",
+		filepath.Join(instanceDir, ModCacheDir, "cache", "download", "example.com.lock"): "",
+		filepath.Join(instanceDir, ModCacheDir, "example.com", "scan@v1.0.0", "scan.go"): "package main\n",
+		filepath.Join(blobCache, sum, "file"):                                            blob,
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pack := &Pack{
+		InstanceDir: instanceDir,
+		FileCfg: &config.Struct{
+			Hostname:                   "scanner",
+			InternalCompatibilityFlags: &config.InternalCompatibilityFlags{},
+			PackageConfig: map[string]config.PackageConfig{
+				"example.com/scan": {
+					ExtraFilePaths: map[string]string{
+						"/lib/firmware/blob": "https://example.com/blob#sha256=" + sum,
+					},
+				},
+			},
+		},
+		Ext: &extconfig.Struct{},
+	}
+	var buf bytes.Buffer
+	manifest, err := pack.Bundle(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := manifest.Modules, 1; got != want {
+		t.Errorf("Modules = %d, want %d", got, want)
+	}
+	var paths []string
+	for _, f := range manifest.Files {
+		paths = append(paths, f.Path)
+	}
+	got := strings.Join(paths, "\n")
+	for _, want := range []string{
+		"config.json",
+		filepath.ToSlash(zip),
+		BundleCacheDir + "/extrafiles/" + sum + "/file",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("bundle does not contain %s, got:\n%s", want, got)
+		}
+	}
+	for _, notWant := range []string{"example.com.lock", "scan.go"} {
+		if strings.Contains(got, notWant) {
+			t.Errorf("bundle unexpectedly contains %s, got:\n%s", notWant, got)
+		}
+	}
+
+	// A bundle is not a snapshot bundle, and vice versa.
+	if _, err := RestoreSnapshot(bytes.NewReader(buf.Bytes()), filepath.Join(tmp, "snapshot")); err == nil {
+		t.Errorf("RestoreSnapshot(bundle) unexpectedly succeeded")
+	}
+
+	// Import on a machine with an empty cache.
+	setUserCacheDir(t, filepath.Join(tmp, "import-cache"))
+	importDir := filepath.Join(tmp, "imported")
+	imported, err := ImportBundle(bytes.NewReader(buf.Bytes()), importDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Instance != "scanner" {
+		t.Errorf("imported instance = %q, want scanner", imported.Instance)
+	}
+	if _, err := os.Stat(filepath.Join(importDir, zip)); err != nil {
+		t.Errorf("module zip not imported: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(importDir, BundleCacheDir)); !os.IsNotExist(err) {
+		t.Errorf("%s not removed after import: %v", BundleCacheDir, err)
+	}
+	fn, err := fetchExtraFile(http.DefaultClient, "https://example.com/blob#sha256="+sum, true /* offline */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != blob {
+		t.Errorf("imported extra file = %q, want %q", b, blob)
+	}
+}
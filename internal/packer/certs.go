@@ -12,6 +12,8 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gokrazy/internal/config"
@@ -92,8 +94,56 @@ func generateAndStoreSelfSignedCertificate(cfg *config.Struct, hostConfigPath, c
 	return nil
 }
 
-func getCertificate(cfg *config.Struct) (string, string, error) {
-	certPath, keyPath, err := tlsflag.CertificatePathsFor(cfg.Hostname)
+// certificatePathsFor returns the certificate and key paths for hostname
+// according to the --tls flag value useTLS, like tlsflag.CertificatePathsFor
+// does for the process-wide --tls flag.
+func certificatePathsFor(useTLS, hostname string) (certPath string, keyPath string, _ error) {
+	hostConfigPath := config.HostnameSpecific(hostname)
+	certPath = filepath.Join(string(hostConfigPath), "cert.pem")
+	keyPath = filepath.Join(string(hostConfigPath), "key.pem")
+	exist := true
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		exist = false
+	}
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		exist = false
+	}
+
+	switch useTLS {
+	case "self-signed":
+		// Non-existing certificates are created by getCertificate.
+		if !exist {
+			return "", "", &tlsflag.ErrNotYetCreated{
+				HostConfigPath: string(hostConfigPath),
+				CertPath:       certPath,
+				KeyPath:        keyPath,
+			}
+		}
+
+	case "off":
+		return "", "", nil
+
+	case "":
+		// Use the certificate only if it exists.
+		if !exist {
+			return "", "", nil
+		}
+
+	default:
+		var ok bool
+		certPath, keyPath, ok = strings.Cut(useTLS, ",")
+		if !ok {
+			return "", "", fmt.Errorf("no private key supplied")
+		}
+	}
+	return certPath, keyPath, nil
+}
+
+// getCertificate returns the certificate and key paths for cfg according to
+// the --tls flag value useTLS, generating a self-signed certificate if
+// requested.
+func getCertificate(cfg *config.Struct, useTLS string) (string, string, error) {
+	certPath, keyPath, err := certificatePathsFor(useTLS, cfg.Hostname)
 	if err != nil {
 		var nycerr *tlsflag.ErrNotYetCreated
 		if errors.As(err, &nycerr) {
@@ -0,0 +1,511 @@
+package packer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/httpclient"
+	"github.com/gokrazy/internal/progress"
+	"github.com/gokrazy/tools/internal/measure"
+	"github.com/gokrazy/tools/internal/serialupdate"
+	"github.com/gokrazy/updater"
+)
+
+// initUpdateFlags sets the update, insecure and tls fields of pack from the
+// InternalCompatibilityFlags and Update.UseTLS fields of cfg. If renewACME is
+// true, an ACME certificate is obtained or renewed as needed (see useTLS).
+func (pack *Pack) initUpdateFlags(ctx context.Context, cfg *config.Struct, renewACME bool) error {
+	pack.update = cfg.InternalCompatibilityFlags.Update
+	pack.insecure = cfg.InternalCompatibilityFlags.Insecure
+	useTLS, err := pack.useTLS(ctx, cfg, renewACME)
+	if err != nil {
+		return err
+	}
+	pack.tls = useTLS
+	return nil
+}
+
+// newInstallation reports whether pack creates a new installation (as
+// opposed to updating a running device), like updateflag.NewInstallation.
+func (pack *Pack) newInstallation() bool {
+	return pack.update == ""
+}
+
+// updateFlagTarget returns the password and host of the --update URL update, or
+// hostname if update is not a URL, like updateflag.GetUpdateTarget.
+func updateFlagTarget(update, hostname string) (defaultPassword, updateHostname string) {
+	if update == "" || update == "yes" || strings.HasPrefix(update, ":") {
+		return "", hostname
+	}
+	u, err := url.Parse(update)
+	if err != nil {
+		return "", hostname
+	}
+	defaultPassword, _ = u.User.Password()
+	return defaultPassword, u.Host
+}
+
+// updateSettings returns the update settings of cfg with defaults applied,
+// and the URL schema (http or https) to use for updating.
+func (pack *Pack) updateSettings(cfg *config.Struct) (*config.UpdateStruct, string, error) {
+	defaultPassword, updateHostname := updateFlagTarget(pack.update, cfg.Hostname)
+	update, err := cfg.Update.WithFallbackToHostSpecific(cfg.Hostname)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if update.HTTPPort == "" {
+		update.HTTPPort = "80"
+	}
+
+	if update.HTTPSPort == "" {
+		update.HTTPSPort = "443"
+	}
+
+	if update.Hostname == "" {
+		update.Hostname = updateHostname
+	}
+
+	if update.HTTPPassword == "" && !update.NoPassword {
+		pw, err := ensurePasswordFileExists(updateHostname, defaultPassword)
+		if err != nil {
+			return nil, "", err
+		}
+		update.HTTPPassword = pw
+	}
+
+	schema := "http"
+	if update.CertPEM == "" || update.KeyPEM == "" {
+		deployCertFile, deployKeyFile, err := getCertificate(cfg, pack.tls)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if deployCertFile != "" {
+			b, err := os.ReadFile(deployCertFile)
+			if err != nil {
+				return nil, "", err
+			}
+			update.CertPEM = strings.TrimSpace(string(b))
+
+			b, err = os.ReadFile(deployKeyFile)
+			if err != nil {
+				return nil, "", err
+			}
+			update.KeyPEM = strings.TrimSpace(string(b))
+		}
+	}
+	if update.CertPEM != "" && update.KeyPEM != "" {
+		// User requested TLS
+		if pack.insecure {
+			// If -insecure is specified, use http instead of https to make the
+			// process of updating to non-empty -tls= a bit smoother.
+		} else {
+			schema = "https"
+		}
+	}
+	return update, schema, nil
+}
+
+// updateBaseURL returns the base URL of the gokrazy instance to update, like
+// updateflag.BaseURL, but with support for IPv6 literals (with or without
+// brackets) and zones, e.g. fe80::1%eth0. updateFlag is the value of the
+// --update flag: yes, :port or a fully qualified URL.
+func updateBaseURL(updateFlag string, update *config.UpdateStruct, schema string) (*url.URL, error) {
+	if updateFlag != "yes" && !strings.HasPrefix(updateFlag, ":") {
+		// already fully qualified, nothing to add
+		return url.Parse(updateFlag)
+	}
+	port := update.HTTPPort
+	defaultPort := "80"
+	if schema == "https" {
+		port = update.HTTPSPort
+		defaultPort = "443"
+	}
+	if strings.HasPrefix(updateFlag, ":") {
+		port = strings.TrimPrefix(updateFlag, ":")
+	}
+	host := update.Hostname
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if strings.Contains(host, "%25") {
+		// Zone percent-encoded as in URLs (RFC 6874).
+		host = strings.Replace(host, "%25", "%", 1)
+	}
+	if port != defaultPort {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u := &url.URL{
+		Scheme: schema,
+		User:   url.UserPassword("gokrazy", update.HTTPPassword),
+		Host:   host,
+		Path:   "/",
+	}
+	// Round-trip through url.Parse to validate the host (e.g. invalid
+	// zones) and to normalize the URL like updateflag.BaseURL does.
+	return url.Parse(u.String())
+}
+
+// configureUpdateClient configures the transport of client (used for
+// updating) to use the proxy configured in the environment (HTTPS_PROXY etc.)
+// unless it already has a proxy (e.g. cloned from http.DefaultTransport), to
+// trust the certificates of the Update.CACertPath config field and to
+// prefer the configured address family.
+func (pack *Pack) configureUpdateClient(client *http.Client) error {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	if transport.Proxy == nil {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+
+	if path := pack.caCertPath(); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading Update.CACertPath: %v", err)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		pool := transport.TLSClientConfig.RootCAs
+		if pool != nil {
+			pool = pool.Clone()
+		} else if pool, err = x509.SystemCertPool(); err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("Update.CACertPath: no PEM certificates found in %s", path)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	family := pack.AddressFamily
+	if family == "" && pack.Ext != nil {
+		family = pack.Ext.UpdateAddressFamily
+	}
+	if err := preferAddressFamily(transport, family); err != nil {
+		return err
+	}
+	client.Transport = transport
+	return nil
+}
+
+// caCertPath returns the path of the Update.CACertPath config field, or the
+// empty string if it is not set.
+func (pack *Pack) caCertPath() string {
+	if pack.Ext == nil || pack.Ext.Update == nil || pack.Ext.Update.CACertPath == "" {
+		return ""
+	}
+	return pack.instanceRel(pack.Ext.Update.CACertPath)
+}
+
+// preferAddressFamily makes transport first try to connect using the
+// specified address family (ipv4 or ipv6), falling back to the other family.
+// An empty family leaves transport unchanged.
+func preferAddressFamily(transport *http.Transport, family string) error {
+	var network string
+	switch family {
+	case "":
+		return nil
+	case "ipv4":
+		network = "tcp4"
+	case "ipv6":
+		network = "tcp6"
+	default:
+		return fmt.Errorf("invalid address family %q: expected ipv4 or ipv6", family)
+	}
+	var dialer net.Dialer
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	return nil
+}
+
+// connectTarget connects to the gokrazy instance to update, detecting whether
+// it offers https.
+func (pack *Pack) connectTarget(update *config.UpdateStruct, schema string) (*url.URL, *http.Client, *updater.Target, error) {
+	updateBaseUrl, err := updateBaseURL(pack.update, update, schema)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	updateHttpClient, foundMatchingCertificate, err := httpclient.GetTLSHttpClientByTLSFlag(pack.tls, pack.insecure, updateBaseUrl)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("getting http client by tls flag: %v", err)
+	}
+	if err := pack.configureUpdateClient(updateHttpClient); err != nil {
+		return nil, nil, nil, err
+	}
+	done := measure.Interactively("probing https")
+	remoteScheme, err := httpclient.GetRemoteScheme(updateBaseUrl)
+	done("")
+	if remoteScheme == "https" && !pack.insecure {
+		updateBaseUrl.Scheme = "https"
+		pack.update = updateBaseUrl.String()
+	}
+
+	if updateBaseUrl.Scheme != "https" && foundMatchingCertificate {
+		fmt.Printf("\n")
+		fmt.Printf("!!!WARNING!!! Possible SSL-Stripping detected!\n")
+		fmt.Printf("Found certificate for hostname in your client configuration but the host does not offer https!\n")
+		fmt.Printf("\n")
+		if !pack.insecure {
+			return nil, nil, nil, fmt.Errorf("update canceled: TLS certificate found, but negotiating a TLS connection with the target failed")
+		}
+		fmt.Printf("Proceeding anyway as requested (--insecure).\n")
+	}
+
+	// Opt out of PARTUUID= for updating until we can check the remote
+	// userland version is new enough to understand how to set the active
+	// root partition when PARTUUID= is in use.
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	updateBaseUrl.Path = "/"
+
+	target, err := updater.NewTarget(updateBaseUrl.String(), updateHttpClient)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("checking target partuuid support: %v", err)
+	}
+	return updateBaseUrl, updateHttpClient, target, nil
+}
+
+const (
+	defaultRebootTimeout = 5 * time.Minute
+	defaultPollInterval  = 1 * time.Second
+)
+
+// rebootSettings returns how long to wait for the device after rebooting and
+// how often to poll it, from the Pack fields, the config fields or the
+// defaults (in that order of precedence).
+func (pack *Pack) rebootSettings() (timeout, interval time.Duration, _ error) {
+	timeout, interval = defaultRebootTimeout, defaultPollInterval
+	if ext := pack.Ext; ext != nil {
+		if ext.RebootTimeout != "" {
+			d, err := time.ParseDuration(ext.RebootTimeout)
+			if err != nil {
+				return 0, 0, fmt.Errorf("RebootTimeout: %v", err)
+			}
+			timeout = d
+		}
+		if ext.PollInterval != "" {
+			d, err := time.ParseDuration(ext.PollInterval)
+			if err != nil {
+				return 0, 0, fmt.Errorf("PollInterval: %v", err)
+			}
+			interval = d
+		}
+	}
+	if pack.RebootTimeout != 0 {
+		timeout = pack.RebootTimeout
+	}
+	if pack.PollInterval != 0 {
+		interval = pack.PollInterval
+	}
+	if timeout <= 0 || interval <= 0 {
+		return 0, 0, fmt.Errorf("reboot timeout (%v) and poll interval (%v) must be positive", timeout, interval)
+	}
+	return timeout, interval, nil
+}
+
+// noReboot reports whether to skip rebooting the device after updating.
+func (pack *Pack) noReboot() bool {
+	return pack.NoReboot || (pack.Ext != nil && pack.Ext.NoReboot)
+}
+
+// deployment describes the images to upload to a gokrazy instance.
+type deployment struct {
+	// name identifies the target in log messages, e.g. its URL.
+	name   string
+	target updateTarget
+
+	// uploads are uploaded before the boot file system.
+	uploads []upload
+	boot    io.Reader
+	mbr     io.Reader
+
+	testboot bool
+
+	// updated returns nil once the device runs the new version.
+	updated func(context.Context) error
+
+	// pending, if non-nil, is recorded when not rebooting the device (see
+	// PendingActivation). Device, BuildTimestamp and OldBuildTimestamp must
+	// be set.
+	pending *PendingActivation
+}
+
+// parallelUploads returns whether the uploads of a deployment (see
+// deployment.uploads) can be sent to target in parallel.
+//
+// gokrazy devices need no support for this: each update handler serializes
+// its own requests with a mutex (see nonConcurrentUpdateHandler in
+// github.com/gokrazy/gokrazy/update.go), and the uploads have distinct
+// destinations which do not overlap: the inactive root partition, and the
+// root device files, whose [Offset, Offset+MaxLength) ranges must not
+// overlap each other or the partitions (see deviceconfig.RootFile). The boot
+// file system, which affects the running system, is still uploaded after
+// all other uploads succeeded.
+//
+// The serial console transfers one file at a time.
+func parallelUploads(target updateTarget) bool {
+	_, serial := target.(*serialupdate.Target)
+	return !serial
+}
+
+// deploy uploads the images of d to the target, switches to the new root
+// partition, reboots and waits for the device to run the new version.
+func (pack *Pack) deploy(ctx context.Context, d deployment) error {
+	if _, _, err := pack.rebootSettings(); err != nil {
+		return err
+	}
+	target := d.target
+	fmt.Printf("Updating %s\n", d.name)
+	pack.stage(StageUpload)
+
+	progctx, canc := context.WithCancel(ctx)
+	defer canc()
+	prog := &progress.Reporter{}
+	go prog.Report(progctx)
+
+	if pack.UploadConcurrency > 1 && parallelUploads(target) {
+		// Upload the root file system and device files in parallel, but only
+		// upload the boot file system once these succeeded (see below).
+		if err := pack.uploadParallel(ctx, prog, target, d.uploads); err != nil {
+			return err
+		}
+	} else {
+		if pack.UploadConcurrency > 1 {
+			log.Printf("uploading sequentially over the serial console")
+		}
+		// Start with the root file system because writing to the non-active
+		// partition cannot break the currently running system.
+		for _, u := range d.uploads {
+			if err := pack.updateWithProgress(ctx, prog, u.reader, target, u.logStr, u.stream); err != nil {
+				if u.optional && errors.Is(err, updater.ErrUpdateHandlerNotImplemented) {
+					log.Printf("target does not support updating %s yet, ignoring", u.logStr)
+					continue
+				}
+				return err
+			}
+		}
+	}
+
+	// The boot file system is always uploaded last, as overwriting the boot
+	// partition affects the currently running system.
+	if err := pack.updateWithProgress(ctx, prog, d.boot, target, "boot file system", "boot"); err != nil {
+		return err
+	}
+
+	if err := target.StreamTo("mbr", &ctxReader{ctx: ctx, r: d.mbr}); err != nil {
+		if err == updater.ErrUpdateHandlerNotImplemented {
+			log.Printf("target does not support updating MBR yet, ignoring")
+		} else {
+			return fmt.Errorf("updating MBR: %v", err)
+		}
+	}
+
+	if d.testboot {
+		if err := target.Testboot(); err != nil {
+			return fmt.Errorf("enable testboot of non-active partition: %v", err)
+		}
+	} else {
+		if err := target.Switch(); err != nil {
+			return fmt.Errorf("switching to non-active partition: %v", err)
+		}
+	}
+
+	// Stop progress reporting to not mess up the following logs output.
+	canc()
+
+	if pack.noReboot() || !pack.ActivateAt.IsZero() {
+		if d.pending != nil {
+			d.pending.At = pack.ActivateAt
+			d.pending.Updated = time.Now()
+			if err := pack.writePendingActivation(d.pending); err != nil {
+				return err
+			}
+		}
+		if !pack.ActivateAt.IsZero() {
+			fmt.Printf("Updated, not rebooting: run gok activate to reboot into the new version at %v, e.g. from a cron job (or it becomes active on the next boot)\n", pack.ActivateAt.Format(time.RFC3339))
+			return nil
+		}
+		fmt.Printf("Updated, not rebooting (--no_reboot): the new version becomes active on the next boot (or using gok activate)\n")
+		return nil
+	}
+
+	if err := pack.rebootAndWait(ctx, target, d.updated); err != nil {
+		return err
+	}
+	if d.pending != nil {
+		// An earlier update which was not activated is superseded.
+		return pack.removePendingActivation()
+	}
+	return nil
+}
+
+// rebootAndWait reboots the target and waits for the device to run the new
+// version, i.e. until updated returns nil.
+func (pack *Pack) rebootAndWait(ctx context.Context, target updateTarget, updated func(context.Context) error) error {
+	polltimeout, pollinterval, err := pack.rebootSettings()
+	if err != nil {
+		return err
+	}
+	pack.stage(StageReboot)
+	fmt.Printf("Triggering reboot\n")
+	if err := target.Reboot(); err != nil {
+		if errors.Is(err, syscall.ECONNRESET) {
+			fmt.Printf("ignoring reboot error: %v\n", err)
+		} else {
+			return fmt.Errorf("reboot: %v", err)
+		}
+	}
+
+	fmt.Printf("Updated, waiting %v for the device to become reachable (cancel with Ctrl-C any time)\n", polltimeout)
+
+	pollctx, canc := context.WithTimeout(ctx, polltimeout)
+	defer canc()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := pollctx.Err(); err != nil {
+			return fmt.Errorf("device did not become healthy after update (%v)", err)
+		}
+		if err := updated(pollctx); err != nil {
+			log.Printf("device not yet reachable: %v", err)
+			select {
+			case <-pollctx.Done():
+			case <-time.After(pollinterval):
+			}
+			continue
+		}
+
+		fmt.Printf("Device ready to use!\n")
+		break
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/updater"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeDevice implements the update protocol of a gokrazy device (see
+// github.com/gokrazy/gokrazy/update.go) and records the requests it handles,
+// e.g. "PUT /update/root" or "POST /reboot".
+type fakeDevice struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	requests []string
+	status   DeviceStatus
+}
+
+func newFakeDevice(t *testing.T) *fakeDevice {
+	dev := &fakeDevice{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/update/features", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"features":"partuuid,updatehash,gpt,"}`)
+	})
+	mux.HandleFunc("/update/", func(w http.ResponseWriter, r *http.Request) {
+		dev.record(r.Method + " " + r.URL.Path)
+		if r.Method != http.MethodPut {
+			return // switch, testboot
+		}
+		var h hash.Hash = sha256.New()
+		if r.Header.Get("X-Gokrazy-Update-Hash") == "crc32" {
+			h = crc32.NewIEEE()
+		}
+		if _, err := io.Copy(h, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%x", h.Sum(nil))
+	})
+	mux.HandleFunc("/reboot", func(w http.ResponseWriter, r *http.Request) {
+		dev.record(r.Method + " " + r.URL.Path)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		dev.mu.Lock()
+		defer dev.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dev.status)
+	})
+	dev.srv = httptest.NewServer(mux)
+	t.Cleanup(dev.srv.Close)
+	return dev
+}
+
+func (dev *fakeDevice) record(req string) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	dev.requests = append(dev.requests, req)
+}
+
+func (dev *fakeDevice) Requests() []string {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return append([]string(nil), dev.requests...)
+}
+
+// URL returns the base URL of the device, like connectTarget.
+func (dev *fakeDevice) URL() string {
+	return dev.srv.URL + "/"
+}
+
+func (dev *fakeDevice) target(t *testing.T) *updater.Target {
+	target, err := updater.NewTarget(dev.URL(), dev.srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// testDeployment returns a deployment of root and boot file systems to dev,
+// which is done once the device runs build.
+func testDeployment(t *testing.T, dev *fakeDevice, build string) deployment {
+	client := dev.srv.Client()
+	return deployment{
+		name:   dev.URL(),
+		target: dev.target(t),
+		uploads: []upload{
+			{logStr: "root file system", stream: "root", reader: strings.NewReader("root")},
+		},
+		boot: bytes.NewReader([]byte("boot")),
+		mbr:  strings.NewReader("mbr"),
+		updated: func(ctx context.Context) error {
+			return pollUpdated1(ctx, client, dev.URL(), build)
+		},
+	}
+}
+
+// waitReader returns the contents of r once dev received the request want,
+// i.e. an upload reading from it only completes if want is uploaded in
+// parallel.
+type waitReader struct {
+	dev  *fakeDevice
+	want string
+	r    io.Reader
+}
+
+func (w *waitReader) Read(p []byte) (int, error) {
+	for deadline := time.Now().Add(5 * time.Second); !slices.Contains(w.dev.Requests(), w.want); {
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("%s not received during the upload", w.want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return w.r.Read(p)
+}
+
+func TestDeployParallelUploads(t *testing.T) {
+	dev := newFakeDevice(t)
+	dev.status = DeviceStatus{BuildTimestamp: "new"}
+	d := testDeployment(t, dev, "new")
+	d.uploads = []upload{
+		{
+			logStr: "root file system",
+			stream: "root",
+			reader: &waitReader{dev: dev, want: "PUT /update/device-specific/u-boot.bin", r: strings.NewReader("root")},
+		},
+		{
+			logStr: "root device file u-boot.bin",
+			stream: "device-specific/u-boot.bin",
+			reader: strings.NewReader("u-boot"),
+		},
+	}
+	pack := &Pack{UploadConcurrency: 2, PollInterval: time.Millisecond}
+	if err := pack.deploy(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"PUT /update/device-specific/u-boot.bin",
+		"PUT /update/root",
+		"PUT /update/boot",
+		"PUT /update/mbr",
+		"POST /update/switch",
+		"POST /reboot",
+	}
+	if diff := cmp.Diff(want, dev.Requests()); diff != "" {
+		t.Errorf("requests: unexpected diff (-want +got):\n%s", diff)
+	}
+}
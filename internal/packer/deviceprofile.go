@@ -0,0 +1,242 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/deviceconfig"
+)
+
+// DeviceProfilesFile is the name of the file in the instance directory which
+// defines device types (in addition to the device types built into gokrazy),
+// so that a new board can be supported without a gokrazy release.
+const DeviceProfilesFile = "devices.json"
+
+// DeviceProfile describes how to create images for a device type which is
+// not built into gokrazy, see DeviceProfilesFile.
+type DeviceProfile struct {
+	// BootPartitionStartLBA is the sector at which the boot partition starts
+	// (default 8192, i.e. 4 MiB). Bootloaders which the device loads from
+	// fixed offsets (RootDeviceFiles) must fit before this sector.
+	BootPartitionStartLBA int64 `json:",omitempty"`
+
+	// MBROnlyWithoutGPT must be set for devices whose bootloader does not
+	// support GPT (or which store bootloaders where the GPT would be).
+	MBROnlyWithoutGPT bool `json:",omitempty"`
+
+	// RootDeviceFiles are files of the kernel package which are written to
+	// the disk at a fixed byte offset (e.g. U-Boot). gok update uploads them
+	// as well, but the device only writes them if its gokrazy version knows
+	// the device model (see deviceconfig.DeviceConfigs).
+	RootDeviceFiles []deviceconfig.RootFile `json:",omitempty"`
+
+	// KernelGlobs and FirmwareGlobs are the patterns (see path.Match) of
+	// files of the kernel and firmware package to copy to the boot file
+	// system, replacing the default patterns (e.g. vmlinuz, *.dtb).
+	KernelGlobs   []string `json:",omitempty"`
+	FirmwareGlobs []string `json:",omitempty"`
+
+	// UBootDTB is the device tree blob (e.g. rk3328-rock64.dtb) for devices
+	// which boot using U-Boot: gokrazy generates a boot.scr which loads the
+	// kernel, the device tree blob and cmdline.txt, unless the kernel package
+	// contains boot.scr or boot.cmd.
+	UBootDTB string `json:",omitempty"`
+}
+
+// deviceProfiles is the format of DeviceProfilesFile.
+type deviceProfiles struct {
+	// Devices maps device type names (for the DeviceType config field) to
+	// their profile.
+	Devices map[string]DeviceProfile
+}
+
+// deviceTypeRe matches valid device type names.
+var deviceTypeRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// gptSectors is the number of sectors at the start of a GPT disk occupied by
+// the protective MBR, the GPT header and the partition entries.
+const gptSectors = 34
+
+// builtinDeviceType reports whether slug is a device type built into
+// gokrazy.
+func builtinDeviceType(slug string) bool {
+	if _, ok := deviceconfig.GetDeviceConfigBySlug(slug); ok {
+		return true
+	}
+	_, ok := bootloaders[slug]
+	return ok
+}
+
+// ReadDeviceProfiles reads and validates the DeviceProfilesFile of the
+// instance directory dir. A missing file results in no device profiles.
+func ReadDeviceProfiles(dir string) (map[string]DeviceProfile, error) {
+	fn := filepath.Join(dir, DeviceProfilesFile)
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var profiles deviceProfiles
+	if err := dec.Decode(&profiles); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	names := make([]string, 0, len(profiles.Devices))
+	for name := range profiles.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := checkDeviceProfile(name, profiles.Devices[name]); err != nil {
+			return nil, fmt.Errorf("%s: device %s: %v", fn, name, err)
+		}
+	}
+	return profiles.Devices, nil
+}
+
+// checkDeviceProfile verifies that the profile of device type name results in
+// a bootable disk layout.
+func checkDeviceProfile(name string, profile DeviceProfile) error {
+	if !deviceTypeRe.MatchString(name) {
+		return fmt.Errorf("invalid name: must consist of lower case letters, digits, _ and - (e.g. rock5b)")
+	}
+	if builtinDeviceType(name) {
+		return fmt.Errorf("device type is built into gokrazy and cannot be redefined")
+	}
+	bootStart := profile.BootPartitionStartLBA
+	if bootStart == 0 {
+		bootStart = deviceconfig.DefaultBootPartitionStartLBA
+	}
+	firstSector := int64(gptSectors)
+	if profile.MBROnlyWithoutGPT {
+		firstSector = 1
+	}
+	if bootStart < firstSector {
+		return fmt.Errorf("BootPartitionStartLBA %d overlaps the partition table", bootStart)
+	}
+	files := make([]deviceconfig.RootFile, len(profile.RootDeviceFiles))
+	copy(files, profile.RootDeviceFiles)
+	sort.Slice(files, func(i, j int) bool { return files[i].Offset < files[j].Offset })
+	for idx, f := range files {
+		if f.Name == "" || f.Name != filepath.Base(f.Name) || f.Name == "." || f.Name == ".." {
+			return fmt.Errorf("RootDeviceFiles: invalid Name %q: must be a file name of the kernel package", f.Name)
+		}
+		if f.MaxLength <= 0 {
+			return fmt.Errorf("RootDeviceFiles: %s: MaxLength must be positive", f.Name)
+		}
+		if f.Offset < firstSector*512 {
+			what := "the GPT (set MBROnlyWithoutGPT if the device requires this offset)"
+			if profile.MBROnlyWithoutGPT {
+				what = "the MBR"
+			}
+			return fmt.Errorf("RootDeviceFiles: %s: Offset %d overlaps %s", f.Name, f.Offset, what)
+		}
+		if end := f.Offset + f.MaxLength; end > bootStart*512 {
+			return fmt.Errorf("RootDeviceFiles: %s: ends at byte %d, after the start of the boot partition (byte %d, see BootPartitionStartLBA)", f.Name, end, bootStart*512)
+		}
+		if idx > 0 {
+			prev := files[idx-1]
+			if prev.Offset+prev.MaxLength > f.Offset {
+				return fmt.Errorf("RootDeviceFiles: %s and %s overlap", prev.Name, f.Name)
+			}
+		}
+	}
+	for _, globs := range []struct {
+		field    string
+		patterns []string
+	}{
+		{"KernelGlobs", profile.KernelGlobs},
+		{"FirmwareGlobs", profile.FirmwareGlobs},
+	} {
+		for _, pattern := range globs.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: %q: %v", globs.field, pattern, err)
+			}
+			if path.IsAbs(pattern) || strings.HasPrefix(path.Clean(pattern), "..") {
+				return fmt.Errorf("%s: %q must be relative to the package directory", globs.field, pattern)
+			}
+		}
+	}
+	if profile.UBootDTB != "" && profile.UBootDTB != path.Base(profile.UBootDTB) {
+		return fmt.Errorf("UBootDTB %q must be a file name (e.g. rk3328-rock64.dtb)", profile.UBootDTB)
+	}
+	return nil
+}
+
+// settings returns the partitioning and boot settings of the device profile.
+func (profile DeviceProfile) settings() device {
+	dev := device{
+		firstPartitionOffsetSectors: deviceconfig.DefaultBootPartitionStartLBA,
+		mbrOnlyWithoutGpt:           profile.MBROnlyWithoutGPT,
+		rootDeviceFiles:             profile.RootDeviceFiles,
+		kernelGlobs:                 kernelGlobs,
+		firmwareGlobs:               firmwareGlobs,
+	}
+	if profile.BootPartitionStartLBA != 0 {
+		dev.firstPartitionOffsetSectors = profile.BootPartitionStartLBA
+	}
+	if len(profile.KernelGlobs) > 0 {
+		dev.kernelGlobs = profile.KernelGlobs
+	}
+	if len(profile.FirmwareGlobs) > 0 {
+		dev.firmwareGlobs = profile.FirmwareGlobs
+	}
+	if profile.UBootDTB != "" {
+		dev.bootloader = bootloader{
+			bootCmd: ubootDistroBoot,
+			dtb:     profile.UBootDTB,
+		}
+	}
+	return dev
+}
+
+// CheckDeviceType returns an error if slug is neither empty, a device type
+// built into gokrazy, nor defined in the DeviceProfilesFile of the instance
+// directory instanceDir.
+func CheckDeviceType(instanceDir, slug string) error {
+	_, err := deviceSettings(instanceDir, slug)
+	return err
+}
+
+// deviceSettings returns the settings of the device type slug (empty for the
+// default device, a Raspberry Pi): a device type built into gokrazy, or one
+// defined in the DeviceProfilesFile of the instance directory instanceDir.
+func deviceSettings(instanceDir, slug string) (device, error) {
+	dev := device{
+		firstPartitionOffsetSectors: deviceconfig.DefaultBootPartitionStartLBA,
+		kernelGlobs:                 kernelGlobs,
+		firmwareGlobs:               firmwareGlobs,
+	}
+	if slug == "" {
+		return dev, nil
+	}
+	if builtinDeviceType(slug) {
+		if devcfg, ok := deviceconfig.GetDeviceConfigBySlug(slug); ok {
+			dev.rootDeviceFiles = devcfg.RootDeviceFiles
+			dev.mbrOnlyWithoutGpt = devcfg.MBROnlyWithoutGPT
+			if devcfg.BootPartitionStartLBA != 0 {
+				dev.firstPartitionOffsetSectors = devcfg.BootPartitionStartLBA
+			}
+		}
+		dev.bootloader = bootloaders[slug]
+		return dev, nil
+	}
+	profiles, err := ReadDeviceProfiles(instanceDir)
+	if err != nil {
+		return device{}, err
+	}
+	if profile, ok := profiles[slug]; ok {
+		return profile.settings(), nil
+	}
+	return device{}, fmt.Errorf("unknown device slug %q (not built into gokrazy, and not defined in %s)", slug, DeviceProfilesFile)
+}
@@ -0,0 +1,156 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/deviceconfig"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDeviceProfiles(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := deviceSettings(dir, "rock5b"); err == nil || !strings.Contains(err.Error(), "unknown device slug") {
+		t.Errorf("deviceSettings(undefined) = %v, want unknown device slug error", err)
+	}
+
+	const profiles = `{
+  "Devices": {
+    "rock5b": {
+      "BootPartitionStartLBA": 32768,
+      "RootDeviceFiles": [
+        {"Name": "u-boot-rockchip.bin", "Offset": 32768, "MaxLength": 16744448}
+      ],
+      "KernelGlobs": ["vmlinuz", "rockchip/*.dtb"],
+      "UBootDTB": "rk3588-rock-5b.dtb"
+    }
+  }
+}`
+	if err := os.WriteFile(filepath.Join(dir, DeviceProfilesFile), []byte(profiles), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dev, err := deviceSettings(dir, "rock5b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := device{
+		firstPartitionOffsetSectors: 32768,
+		rootDeviceFiles: []deviceconfig.RootFile{
+			{Name: "u-boot-rockchip.bin", Offset: 32768, MaxLength: 16744448},
+		},
+		kernelGlobs:   []string{"vmlinuz", "rockchip/*.dtb"},
+		firmwareGlobs: firmwareGlobs,
+		bootloader: bootloader{
+			bootCmd: ubootDistroBoot,
+			dtb:     "rk3588-rock-5b.dtb",
+		},
+	}
+	if diff := cmp.Diff(want, dev, cmp.AllowUnexported(device{}, bootloader{})); diff != "" {
+		t.Errorf("deviceSettings: unexpected diff (-want +got):\n%s", diff)
+	}
+	if err := CheckDeviceType(dir, "rock5b"); err != nil {
+		t.Errorf("CheckDeviceType(rock5b) = %v", err)
+	}
+
+	// Built-in device types do not require a profile.
+	if dev, err := deviceSettings(dir, "odroidhc1"); err != nil || !dev.mbrOnlyWithoutGpt {
+		t.Errorf("deviceSettings(odroidhc1) = %+v, %v, want MBR-only device", dev, err)
+	}
+}
+
+func TestCheckDeviceProfile(t *testing.T) {
+	uboot := deviceconfig.RootFile{Name: "u-boot.bin", Offset: 32768, MaxLength: 1 << 20}
+	for _, tt := range []struct {
+		name    string
+		device  string
+		profile DeviceProfile
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			device:  "myboard",
+			profile: DeviceProfile{RootDeviceFiles: []deviceconfig.RootFile{uboot}},
+		},
+		{
+			name:    "invalid name",
+			device:  "My Board",
+			wantErr: "invalid name",
+		},
+		{
+			name:    "builtin",
+			device:  "rock64",
+			wantErr: "built into gokrazy",
+		},
+		{
+			name:   "overlaps GPT",
+			device: "myboard",
+			profile: DeviceProfile{RootDeviceFiles: []deviceconfig.RootFile{
+				{Name: "bl1.bin", Offset: 512, MaxLength: 512},
+			}},
+			wantErr: "overlaps the GPT",
+		},
+		{
+			name:   "MBR only",
+			device: "myboard",
+			profile: DeviceProfile{
+				MBROnlyWithoutGPT: true,
+				RootDeviceFiles: []deviceconfig.RootFile{
+					{Name: "bl1.bin", Offset: 512, MaxLength: 512},
+				},
+			},
+		},
+		{
+			name:   "overlapping files",
+			device: "myboard",
+			profile: DeviceProfile{RootDeviceFiles: []deviceconfig.RootFile{
+				uboot,
+				{Name: "tzsw.bin", Offset: 32768 + 4096, MaxLength: 4096},
+			}},
+			wantErr: "u-boot.bin and tzsw.bin overlap",
+		},
+		{
+			name:   "overlaps boot partition",
+			device: "myboard",
+			profile: DeviceProfile{RootDeviceFiles: []deviceconfig.RootFile{
+				{Name: "u-boot.bin", Offset: 32768, MaxLength: 8 << 20},
+			}},
+			wantErr: "after the start of the boot partition",
+		},
+		{
+			name:   "path as name",
+			device: "myboard",
+			profile: DeviceProfile{RootDeviceFiles: []deviceconfig.RootFile{
+				{Name: "../u-boot.bin", Offset: 32768, MaxLength: 512},
+			}},
+			wantErr: "invalid Name",
+		},
+		{
+			name:    "bad glob",
+			device:  "myboard",
+			profile: DeviceProfile{KernelGlobs: []string{"[.dtb"}},
+			wantErr: "KernelGlobs",
+		},
+		{
+			name:    "glob outside package",
+			device:  "myboard",
+			profile: DeviceProfile{FirmwareGlobs: []string{"../*.bin"}},
+			wantErr: "relative to the package directory",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDeviceProfile(tt.device, tt.profile)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkDeviceProfile = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkDeviceProfile = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/gokrazy/internal/humanize"
+	"github.com/gokrazy/tools/packer"
+)
+
+// Values of Pack.Discard.
+const (
+	DiscardOff    = "off"    // do not discard (default)
+	DiscardUnused = "unused" // discard the unused parts of the boot and root partitions
+	DiscardAll    = "all"    // discard all partitions (including perm) before writing
+)
+
+// discardRange is a range of a device to discard (see discard).
+type discardRange struct {
+	offset uint64
+	length uint64
+}
+
+// discardRanges returns the ranges to discard on a device of devsize bytes
+// for the Pack.Discard mode, following the partition layout of p.Pack (see
+// packer.Pack.Partition). For DiscardAll, the ranges are discarded before
+// writing, otherwise after writing the boot and root file systems. Partition
+// 3 (the inactive root partition) is not written by a full overwrite, so it
+// is unused.
+func (p *Pack) discardRanges(devsize uint64, boot, root writtenRange) []discardRange {
+	first := p.PartitionOffset(1)
+	switch p.Discard {
+	case DiscardAll:
+		permSize := uint64(p.PermSizeKB(devsize)) * 1024
+		return []discardRange{{offset: first, length: p.PartitionOffset(4) - first + permSize}}
+
+	case DiscardUnused:
+		var ranges []discardRange
+		// unused tail of the boot and root partitions
+		for _, part := range []struct {
+			r     writtenRange
+			start uint64
+			size  uint64
+		}{
+			{boot, p.PartitionOffset(1), p.BootPartitionBytes()},
+			{root, p.PartitionOffset(2), packer.RootPartitionBytes},
+		} {
+			// BLKDISCARD requires sector-aligned ranges
+			start := (uint64(part.r.offset+part.r.length) + 511) &^ 511
+			if end := part.start + part.size; start < end {
+				ranges = append(ranges, discardRange{offset: start, length: end - start})
+			}
+		}
+		return append(ranges, discardRange{offset: p.PartitionOffset(3), length: packer.RootPartitionBytes})
+	}
+	return nil
+}
+
+// discardDevice discards (TRIMs) ranges of the device f, which improves the
+// write speed and longevity of SD cards and eMMC. Devices which do not
+// support discarding (e.g. many USB card readers) are skipped.
+func discardDevice(f *os.File, dev string, ranges []discardRange) error {
+	var total uint64
+	for _, r := range ranges {
+		if err := discard(f, r.offset, r.length); err != nil {
+			if errors.Is(err, errors.ErrUnsupported) ||
+				errors.Is(err, syscall.EOPNOTSUPP) ||
+				errors.Is(err, syscall.ENOTTY) ||
+				errors.Is(err, syscall.EINVAL) {
+				log.Printf("%s does not support discarding, skipping (%v)", dev, err)
+				return nil
+			}
+			return fmt.Errorf("discarding %d bytes at offset %d of %s: %v", r.length, r.offset, dev, err)
+		}
+		total += r.length
+	}
+	if total > 0 {
+		log.Printf("discarded %s of %s", humanize.Bytes(total), dev)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package packer
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// discard issues BLKDISCARD for length bytes at offset of the block device f.
+func discard(f *os.File, offset, length uint64) error {
+	r := [2]uint64{offset, length}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKDISCARD, uintptr(unsafe.Pointer(&r[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
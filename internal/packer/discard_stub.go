@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package packer
+
+import (
+	"errors"
+	"os"
+)
+
+func discard(f *os.File, offset, length uint64) error {
+	return errors.ErrUnsupported
+}
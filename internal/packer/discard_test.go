@@ -0,0 +1,55 @@
+package packer
+
+import (
+	"testing"
+
+	"github.com/gokrazy/tools/packer"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiscardRanges(t *testing.T) {
+	const first = 8192 // sectors
+	const firstBytes = first * 512
+	boot := writtenRange{offset: firstBytes, length: 30*MB + 100}
+	root := writtenRange{offset: firstBytes + 100*MB, length: 200 * MB}
+	p := &Pack{Pack: packer.NewPackForHost(first, "discard")}
+
+	p.Discard = DiscardOff
+	if got := p.discardRanges(0, boot, root); len(got) != 0 {
+		t.Errorf("discardRanges(off) = %v, want none", got)
+	}
+
+	p.Discard = DiscardUnused
+	want := []discardRange{
+		{offset: firstBytes + 30*MB + 512, length: 70*MB - 512},
+		{offset: firstBytes + 300*MB, length: 300 * MB},
+		{offset: firstBytes + 600*MB, length: 500 * MB},
+	}
+	got := p.discardRanges(0, boot, root)
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(discardRange{})); diff != "" {
+		t.Errorf("discardRanges(unused): unexpected ranges (-want +got):\n%s", diff)
+	}
+
+	// A larger boot partition (BootPartitionSizeMB) moves the root partitions.
+	p.BootPartitionMB = 128
+	root.offset = firstBytes + 128*MB
+	want = []discardRange{
+		{offset: firstBytes + 30*MB + 512, length: 98*MB - 512},
+		{offset: firstBytes + 328*MB, length: 300 * MB},
+		{offset: firstBytes + 628*MB, length: 500 * MB},
+	}
+	got = p.discardRanges(0, boot, root)
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(discardRange{})); diff != "" {
+		t.Errorf("discardRanges(unused, 128 MB boot): unexpected ranges (-want +got):\n%s", diff)
+	}
+
+	p.Discard = DiscardAll
+	const devsize = 2000 * MB
+	all := p.discardRanges(devsize, writtenRange{}, writtenRange{})
+	if len(all) != 1 || all[0].offset != firstBytes {
+		t.Fatalf("discardRanges(all) = %v, want one range starting at the first partition", all)
+	}
+	if end := all[0].offset + all[0].length; end > devsize {
+		t.Errorf("discardRanges(all) ends at %d, beyond the end of the device (%d)", end, devsize)
+	}
+}
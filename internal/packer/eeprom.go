@@ -0,0 +1,233 @@
+package packer
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/gokrazy/tools/internal/eeprom"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/updater"
+)
+
+// EEPROMFiles are the files of an EEPROM package which gok installs into the
+// boot file system to update the EEPROM of a Raspberry Pi 4 or newer.
+type EEPROMFiles struct {
+	// Pieeprom and VL805 are the paths of the selected pieeprom-*.bin
+	// (bootloader) and vl805-*.bin (USB controller firmware) files.
+	Pieeprom string
+	VL805    string
+
+	// PieepromSHA256 and VL805SHA256 are the (hexadecimal) sha256 sums of
+	// Pieeprom and VL805, which gokrazy reports as its EEPROM version.
+	PieepromSHA256 string
+	VL805SHA256    string
+
+	// Recovery is the path of recovery.bin, which flashes the EEPROM when the
+	// device boots.
+	Recovery string
+
+	// PieepromImage is the contents of Pieeprom with the
+	// BootloaderExtraEEPROM lines applied to its bootconf.txt, which gok
+	// installs as pieeprom.upd. ImageSHA256 is its sha256 sum, which equals
+	// PieepromSHA256 unless BootloaderExtraEEPROM is set.
+	PieepromImage []byte
+	ImageSHA256   string
+}
+
+// Installed reports whether the device runs the EEPROM version v of files.
+// Devices which do not report their EEPROM version are never up-to-date.
+func (files *EEPROMFiles) Installed(v updater.EEPROMVersion) bool {
+	return files.ImageSHA256 == v.PieepromSHA256 &&
+		files.VL805SHA256 == v.VL805SHA256
+}
+
+// eepromConfig returns the EEPROM config of the instance.
+func (p *Pack) eepromConfig() extconfig.EEPROMConfig {
+	if p.Ext == nil || p.Ext.EEPROM == nil {
+		return extconfig.EEPROMConfig{}
+	}
+	return *p.Ext.EEPROM
+}
+
+var sha256Re = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// checkEEPROM verifies the EEPROM config and the BootloaderExtraEEPROM lines
+// of ext.
+func checkEEPROM(ext *extconfig.Struct) error {
+	if err := eeprom.CheckLines(ext.BootloaderExtraEEPROM); err != nil {
+		return fmt.Errorf("BootloaderExtraEEPROM: %v", err)
+	}
+	e := ext.EEPROM
+	if e == nil {
+		return nil
+	}
+	if e.Skip && len(ext.BootloaderExtraEEPROM) > 0 {
+		return fmt.Errorf("BootloaderExtraEEPROM has no effect when EEPROM.Skip is set")
+	}
+	for _, pin := range []struct {
+		field, sum string
+	}{
+		{"PieepromSHA256", e.PieepromSHA256},
+		{"VL805SHA256", e.VL805SHA256},
+	} {
+		if pin.sum == "" {
+			continue
+		}
+		if e.Skip {
+			return fmt.Errorf("EEPROM: %s has no effect when Skip is set", pin.field)
+		}
+		if !sha256Re.MatchString(pin.sum) {
+			return fmt.Errorf("EEPROM: %s: %q is not a sha256 sum (64 lower case hex digits, see gok eeprom status)", pin.field, pin.sum)
+		}
+	}
+	return nil
+}
+
+// selectEEPROMFile returns the path and sha256 sum of the file in dir which
+// matches pattern and has the sha256 sum pin or, if pin is empty, sorts last.
+// This corresponds to most recent for the pieeprom-*.bin files, which contain
+// the date in yyyy-mm-dd format.
+func selectEEPROMFile(dir, pattern, field, pin string) (fn, sum string, _ error) {
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return "", "", err
+	}
+	if len(matches) == 0 {
+		return "", "", fmt.Errorf("invalid -eeprom_package: no files matching %s", pattern)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	for _, match := range matches {
+		sum, err := hashFile(match)
+		if err != nil {
+			return "", "", err
+		}
+		if pin == "" || sum == pin {
+			return match, sum, nil
+		}
+	}
+	return "", "", fmt.Errorf("EEPROM.%s pins %s, but the EEPROM package (%s) contains no %s file with this sha256 sum", field, pin, dir, pattern)
+}
+
+// selectEEPROMFiles returns the EEPROM files of the EEPROM package directory
+// dir to install, honoring the pinned versions of cfg and applying the
+// bootloader configuration lines (see extconfig.Struct.BootloaderExtraEEPROM).
+func selectEEPROMFiles(dir string, cfg extconfig.EEPROMConfig, lines []string) (*EEPROMFiles, error) {
+	var (
+		files EEPROMFiles
+		err   error
+	)
+	files.Pieeprom, files.PieepromSHA256, err = selectEEPROMFile(dir, "pieeprom-*.bin", "PieepromSHA256", cfg.PieepromSHA256)
+	if err != nil {
+		return nil, err
+	}
+	files.VL805, files.VL805SHA256, err = selectEEPROMFile(dir, "vl805-*.bin", "VL805SHA256", cfg.VL805SHA256)
+	if err != nil {
+		return nil, err
+	}
+	files.Recovery, _, err = selectEEPROMFile(dir, "recovery.bin", "", "")
+	if err != nil {
+		return nil, err
+	}
+	files.PieepromImage, err = os.ReadFile(files.Pieeprom)
+	if err != nil {
+		return nil, err
+	}
+	files.ImageSHA256 = files.PieepromSHA256
+	if len(lines) > 0 {
+		files.PieepromImage, err = eeprom.Assemble(files.PieepromImage, lines)
+		if err != nil {
+			return nil, fmt.Errorf("BootloaderExtraEEPROM: %s: %v", filepath.Base(files.Pieeprom), err)
+		}
+		files.ImageSHA256 = fmt.Sprintf("%x", sha256.Sum256(files.PieepromImage))
+	}
+	return &files, nil
+}
+
+// bootloaderExtraEEPROM returns the BootloaderExtraEEPROM lines of the
+// instance.
+func (p *Pack) bootloaderExtraEEPROM() []string {
+	if p.Ext == nil {
+		return nil
+	}
+	return p.Ext.BootloaderExtraEEPROM
+}
+
+// EEPROMFiles returns the EEPROM files of the EEPROM package of the instance
+// which gok update installs (unless EEPROM.Skip is set), without connecting
+// to the device.
+func (pack *Pack) EEPROMFiles() (*EEPROMFiles, error) {
+	if pack.Ext == nil {
+		ext, err := extconfig.For(pack.Cfg)
+		if err != nil {
+			return nil, err
+		}
+		pack.Ext = ext
+	}
+	if err := checkEEPROM(pack.Ext); err != nil {
+		return nil, err
+	}
+	pack.resolveTarget()
+	applyArchPackages(pack.Cfg, pack.Ext, pack.target.GOARCH)
+	pkg := pack.Cfg.EEPROMPackageOrDefault()
+	if pkg == "" {
+		return nil, fmt.Errorf("instance %s has no EEPROMPackage configured", pack.Cfg.Hostname)
+	}
+	dir, err := pack.packageDir(pkg)
+	if err != nil {
+		return nil, err
+	}
+	return selectEEPROMFiles(dir, pack.eepromConfig(), pack.bootloaderExtraEEPROM())
+}
+
+// EEPROMStatus compares the EEPROM files which gok update installs with the
+// EEPROM version of the device, see Pack.EEPROMStatus.
+type EEPROMStatus struct {
+	// Package is the EEPROM package of the instance.
+	Package string
+
+	// Files are the EEPROM files of Package which gok update installs
+	// (unless Skip is set).
+	Files *EEPROMFiles
+
+	// Device is the EEPROM version which the device reports. It is empty
+	// for devices without EEPROM (e.g. Raspberry Pi 3) and for devices
+	// running a gokrazy version which does not report the EEPROM version.
+	Device updater.EEPROMVersion
+
+	// Skip and Pinned reflect the EEPROM config of the instance.
+	Skip   bool
+	Pinned bool
+}
+
+// Flash reports whether gok update makes the device flash its EEPROM on the
+// next boot.
+func (s *EEPROMStatus) Flash() bool {
+	return !s.Skip && !s.Files.Installed(s.Device)
+}
+
+// EEPROMStatus compares the EEPROM files of the EEPROM package of the instance
+// with the EEPROM version which the running device reports, without modifying
+// the device. Call it in the instance directory.
+func (pack *Pack) EEPROMStatus(ctx context.Context) (*EEPROMStatus, error) {
+	_, _, target, err := pack.connectDevice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files, err := pack.EEPROMFiles()
+	if err != nil {
+		return nil, err
+	}
+	cfg := pack.eepromConfig()
+	return &EEPROMStatus{
+		Package: pack.Cfg.EEPROMPackageOrDefault(),
+		Files:   files,
+		Device:  target.InstalledEEPROM(),
+		Skip:    cfg.Skip,
+		Pinned:  cfg.PieepromSHA256 != "" || cfg.VL805SHA256 != "",
+	}, nil
+}
@@ -0,0 +1,156 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/tools/internal/eeprom"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/updater"
+)
+
+func TestSelectEEPROMFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"pieeprom-2024-04-15.bin": "eeprom",
+		"pieeprom-2023-01-11.bin": "older eeprom",
+		"vl805-000138c0.bin":      "vl805",
+		"recovery.bin":            "recovery",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+
+	files, err := selectEEPROMFiles(dir, extconfig.EEPROMConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := filepath.Base(files.Pieeprom), "pieeprom-2024-04-15.bin"; got != want {
+		t.Errorf("Pieeprom = %s, want %s (most recent)", got, want)
+	}
+	if files.PieepromSHA256 != sum("eeprom") || files.VL805SHA256 != sum("vl805") {
+		t.Errorf("unexpected sums: %+v", files)
+	}
+	if files.Installed(updater.EEPROMVersion{}) {
+		t.Errorf("Installed(not reported) = true, want false")
+	}
+	if !files.Installed(updater.EEPROMVersion{PieepromSHA256: sum("eeprom"), VL805SHA256: sum("vl805")}) {
+		t.Errorf("Installed(same version) = false, want true")
+	}
+
+	pinned, err := selectEEPROMFiles(dir, extconfig.EEPROMConfig{PieepromSHA256: sum("older eeprom")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := filepath.Base(pinned.Pieeprom), "pieeprom-2023-01-11.bin"; got != want {
+		t.Errorf("pinned Pieeprom = %s, want %s", got, want)
+	}
+
+	_, err = selectEEPROMFiles(dir, extconfig.EEPROMConfig{VL805SHA256: sum("newer vl805")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "EEPROM.VL805SHA256 pins") {
+		t.Errorf("selectEEPROMFiles(missing pin) = %v, want EEPROM.VL805SHA256 error", err)
+	}
+}
+
+func TestSelectEEPROMFilesBootloaderExtraEEPROM(t *testing.T) {
+	// A pieeprom image containing only bootconf.txt, followed by erased
+	// flash.
+	const bootconf = "[all]\nBOOT_UART=0\n"
+	image := bytes.Repeat([]byte{0xff}, 4096)
+	binary.BigEndian.PutUint32(image[0:], 0x55aaf11f)
+	binary.BigEndian.PutUint32(image[4:], uint32(12+len(bootconf)))
+	copy(image[8:], "bootconf.txt")
+	copy(image[20:], bootconf)
+
+	dir := t.TempDir()
+	for name, contents := range map[string][]byte{
+		"pieeprom-2024-04-15.bin": image,
+		"vl805-000138c0.bin":      []byte("vl805"),
+		"recovery.bin":            []byte("recovery"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := selectEEPROMFiles(dir, extconfig.EEPROMConfig{}, []string{"BOOT_ORDER=0xf41"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := eeprom.Bootconf(files.PieepromImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bootconf + "BOOT_ORDER=0xf41\n"; string(got) != want {
+		t.Errorf("bootconf.txt = %q, want %q", got, want)
+	}
+	if got, want := files.PieepromSHA256, fmt.Sprintf("%x", sha256.Sum256(image)); got != want {
+		t.Errorf("PieepromSHA256 = %s, want %s (package file)", got, want)
+	}
+	if got, want := files.ImageSHA256, fmt.Sprintf("%x", sha256.Sum256(files.PieepromImage)); got != want {
+		t.Errorf("ImageSHA256 = %s, want %s (modified image)", got, want)
+	}
+	if files.Installed(updater.EEPROMVersion{PieepromSHA256: files.PieepromSHA256, VL805SHA256: files.VL805SHA256}) {
+		t.Errorf("Installed(unmodified image) = true, want false")
+	}
+	if !files.Installed(updater.EEPROMVersion{PieepromSHA256: files.ImageSHA256, VL805SHA256: files.VL805SHA256}) {
+		t.Errorf("Installed(modified image) = false, want true")
+	}
+}
+
+func TestCheckEEPROM(t *testing.T) {
+	valid := fmt.Sprintf("%x", sha256.Sum256(nil))
+	for _, tt := range []struct {
+		name    string
+		eeprom  *extconfig.EEPROMConfig
+		lines   []string
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "skip", eeprom: &extconfig.EEPROMConfig{Skip: true}},
+		{name: "pinned", eeprom: &extconfig.EEPROMConfig{PieepromSHA256: valid, VL805SHA256: valid}},
+		{
+			name:    "invalid sum",
+			eeprom:  &extconfig.EEPROMConfig{PieepromSHA256: "2024-04-15"},
+			wantErr: "is not a sha256 sum",
+		},
+		{
+			name:    "skip and pin",
+			eeprom:  &extconfig.EEPROMConfig{Skip: true, VL805SHA256: valid},
+			wantErr: "no effect when Skip is set",
+		},
+		{name: "bootloader lines", lines: []string{"BOOT_ORDER=0xf41"}},
+		{
+			name:    "invalid bootloader line",
+			lines:   []string{"BOOT_ORDER 0xf41"},
+			wantErr: "must be KEY=VALUE",
+		},
+		{
+			name:    "skip and bootloader lines",
+			eeprom:  &extconfig.EEPROMConfig{Skip: true},
+			lines:   []string{"BOOT_ORDER=0xf41"},
+			wantErr: "no effect when EEPROM.Skip is set",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkEEPROM(&extconfig.Struct{EEPROM: tt.eeprom, BootloaderExtraEEPROM: tt.lines})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkEEPROM = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkEEPROM = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
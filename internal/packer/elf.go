@@ -2,15 +2,15 @@ package packer
 
 import (
 	"debug/elf"
-	"log"
 )
 
-func fileIsELFOrFatal(filePath string) {
+func fileIsELF(filePath string) error {
 	f, err := elf.Open(filePath)
 	if err != nil {
-		log.Fatalf("%s is not an ELF binary! %v (perhaps running into https://github.com/golang/go/issues/53804?)", filePath, err)
+		return &NotELFError{Path: filePath, Err: err}
 	}
 	if err := f.Close(); err != nil {
-		log.Fatalf("%s is not an ELF binary! Close: %v (perhaps running into https://github.com/golang/go/issues/53804?)", filePath, err)
+		return &NotELFError{Path: filePath, Err: err}
 	}
+	return nil
 }
@@ -0,0 +1,221 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/gokrazy/internal/humanize"
+)
+
+var (
+	// ErrTargetMounted is returned (wrapped in a *TargetMountedError) when
+	// refusing to overwrite a device which has mounted partitions.
+	ErrTargetMounted = errors.New("target device is mounted")
+
+	// ErrArchMismatch is returned (wrapped in an *ArchMismatchError) when the
+	// kernel architecture does not match the target architecture (GOARCH).
+	ErrArchMismatch = errors.New("kernel architecture does not match target architecture")
+
+	// ErrDuplicatePaths is returned (wrapped in a *DuplicatePathsError) when
+	// multiple sources install the same paths into the root file system.
+	ErrDuplicatePaths = errors.New("root file system contains duplicate paths")
+
+	// ErrNotELF is returned (wrapped in a *NotELFError) when a built program
+	// is not an ELF binary.
+	ErrNotELF = errors.New("not an ELF binary")
+
+	// ErrSizeBudget is returned (wrapped in a *SizeBudgetError) when a file
+	// system exceeds its size budget.
+	ErrSizeBudget = errors.New("file system exceeds size budget")
+
+	// ErrOrphanedConfig is returned (wrapped in an *OrphanedConfigError) in
+	// strict mode when per-package configuration does not take effect.
+	ErrOrphanedConfig = errors.New("per-package configuration does not take effect")
+
+	// ErrOffline is returned (possibly wrapped in an *OfflineError) in
+	// offline mode when a module or extra file required for the build is not
+	// available locally.
+	ErrOffline = errors.New("not available offline")
+
+	// ErrVerify is returned (wrapped in a *VerifyError) when the data read
+	// back from a full disk image or device differs from the written data.
+	ErrVerify = errors.New("written data does not match")
+)
+
+// VerifyError is returned when reading back the written data (see
+// Pack.Verify) results in different data, e.g. because of a broken SD card.
+type VerifyError struct {
+	Path   string
+	What   string
+	Offset int64
+	Length int64
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verifying %s: %s (%s at offset %d) reads back different data than was written", e.Path, e.What, humanize.Bytes(uint64(e.Length)), e.Offset)
+}
+
+func (e *VerifyError) Unwrap() error { return ErrVerify }
+
+func (e *VerifyError) Hint() string {
+	return "the SD card or card reader is likely faulty, retry with a different SD card or card reader"
+}
+
+// OfflineError is returned in offline mode (see Pack.Offline) when the
+// modules of BuildDir cannot be resolved without network access.
+type OfflineError struct {
+	BuildDir string
+	Err      error
+}
+
+func (e *OfflineError) Error() string {
+	return fmt.Sprintf("offline mode: %s: %v", e.BuildDir, e.Err)
+}
+
+func (e *OfflineError) Unwrap() error { return ErrOffline }
+
+func (e *OfflineError) Hint() string {
+	return "run gok vendor (with network access) to download all modules of the instance into " + ModCacheDir + "/"
+}
+
+// OrphanedConfigError is returned in strict mode (see Pack.Strict) when
+// per-package configuration does not take effect, see FindOrphans.
+type OrphanedConfigError struct {
+	Orphans []Orphan
+}
+
+func (e *OrphanedConfigError) Error() string {
+	lines := make([]string, len(e.Orphans))
+	for idx, o := range e.Orphans {
+		lines[idx] = "  " + o.String()
+	}
+	return fmt.Sprintf("%d per-package configurations do not take effect:\n%s", len(e.Orphans), strings.Join(lines, "\n"))
+}
+
+func (e *OrphanedConfigError) Unwrap() error { return ErrOrphanedConfig }
+
+func (e *OrphanedConfigError) Hint() string {
+	return "remove the configuration or fix the package names (e.g. after renaming a package), see gok doctor"
+}
+
+// TargetMountedError is returned when a partition of Device is mounted.
+type TargetMountedError struct {
+	Device    string
+	Partition string
+}
+
+func (e *TargetMountedError) Error() string {
+	return fmt.Sprintf("partition %s of device %s is mounted", e.Partition, e.Device)
+}
+
+func (e *TargetMountedError) Unwrap() error { return ErrTargetMounted }
+
+func (e *TargetMountedError) Hint() string {
+	if runtime.GOOS == "darwin" {
+		return fmt.Sprintf("unmount all partitions of %s (e.g. diskutil unmountDisk %s) and try again", e.Device, e.Device)
+	}
+	return fmt.Sprintf("unmount all partitions of %s (e.g. umount %s) and try again", e.Device, e.Partition)
+}
+
+// ArchMismatchError is returned when the kernel package was built for a
+// different architecture than the target architecture.
+type ArchMismatchError struct {
+	KernelPackage string
+	KernelArch    string
+	TargetArch    string
+}
+
+func (e *ArchMismatchError) Error() string {
+	return fmt.Sprintf("target architecture %q (GOARCH) doesn't match the %s kernel type %q",
+		e.TargetArch,
+		e.KernelPackage,
+		e.KernelArch)
+}
+
+func (e *ArchMismatchError) Unwrap() error { return ErrArchMismatch }
+
+func (e *ArchMismatchError) Hint() string {
+	return fmt.Sprintf("set GOARCH=%s in the Environment config field, or use a kernel package for %s", e.KernelArch, e.TargetArch)
+}
+
+// DuplicatePathsError is returned when Paths are installed by more than one
+// source. Source and Other describe the colliding sources (e.g. “extra files
+// of package x”), Other is empty if the duplicates are within Source.
+type DuplicatePathsError struct {
+	Source string
+	Other  string
+	Paths  []string
+}
+
+func (e *DuplicatePathsError) Error() string {
+	if e.Other == "" {
+		return fmt.Sprintf("%s contains duplicate files: %s", e.Source, strings.Join(e.Paths, ", "))
+	}
+	return fmt.Sprintf("%s collides with %s: %s", e.Source, e.Other, strings.Join(e.Paths, ", "))
+}
+
+func (e *DuplicatePathsError) Unwrap() error { return ErrDuplicatePaths }
+
+func (e *DuplicatePathsError) Hint() string {
+	return "remove one of the packages installing these paths from your config, or set a different basename (Basename package config field)"
+}
+
+// NotELFError is returned when the build output at Path is not an ELF binary.
+type NotELFError struct {
+	Path string
+	Err  error
+}
+
+func (e *NotELFError) Error() string {
+	return fmt.Sprintf("%s is not an ELF binary! %v", e.Path, e.Err)
+}
+
+func (e *NotELFError) Unwrap() []error { return []error{ErrNotELF, e.Err} }
+
+func (e *NotELFError) Hint() string {
+	return "perhaps running into https://github.com/golang/go/issues/53804?"
+}
+
+// SizeBudgetError is returned when a file system is larger than its size
+// budget (RootSizeBudgetMB or BootSizeBudgetMB, or the partition size).
+type SizeBudgetError struct {
+	FileSystem string // root or boot
+	Budget     int64
+
+	// InputSize is the total (uncompressed) size of the files of the file
+	// system, Largest contains the largest files.
+	InputSize int64
+	Largest   []SizeContributor
+}
+
+func (e *SizeBudgetError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s file system exceeds its size budget of %s (total file size: %s); largest files:",
+		e.FileSystem,
+		humanize.Bytes(uint64(e.Budget)),
+		humanize.Bytes(uint64(e.InputSize)))
+	b.WriteString("\n")
+	printContributors(&b, e.Largest)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (e *SizeBudgetError) Unwrap() error { return ErrSizeBudget }
+
+func (e *SizeBudgetError) Hint() string {
+	if e.FileSystem == "boot" {
+		return "use a smaller kernel, firmware or initramfs, or raise BootSizeBudgetMB (at most the boot partition size) and BootPartitionSizeMB (at most 128 MB, takes effect with gok overwrite)"
+	}
+	return "remove packages or extra files (gok update --sizes shows program sizes), or raise RootSizeBudgetMB (at most 500 MB, the root partition size)"
+}
+
+// Hint returns a remediation hint for err (or any error it wraps), or the
+// empty string if there is none.
+func Hint(err error) string {
+	var h interface{ Hint() string }
+	if errors.As(err, &h) {
+		return h.Hint()
+	}
+	return ""
+}
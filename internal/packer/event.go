@@ -0,0 +1,51 @@
+package packer
+
+import (
+	"time"
+)
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+const (
+	EventStage          EventType = "stage"           // Stage
+	EventPackageStarted EventType = "package_started" // Package
+	EventPackageBuilt   EventType = "package_built"   // Package, Cached, Error
+	EventImage          EventType = "image"           // Path, Bytes
+	EventSBOM           EventType = "sbom"            // SBOMHash
+	EventUpload         EventType = "upload"          // Stream, Bytes, Total
+	EventProgress       EventType = "progress"        // Stage, Unit, Done, Total, ETASeconds
+	EventResult         EventType = "result"          // Error
+)
+
+// Event is a machine-readable build event, see Pack.OnEvent.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	Stage    Stage  `json:"stage,omitempty"`
+	Package  string `json:"package,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Stream   string `json:"stream,omitempty"`
+	Bytes    uint64 `json:"bytes,omitempty"`
+	Total    uint64 `json:"total,omitempty"`
+	SBOMHash string `json:"sbom_hash,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// Cached is set for EventPackageBuilt when the program was not built,
+	// but taken from the binary cache (see Pack.NoBinaryCache).
+	Cached bool `json:"cached,omitempty"`
+
+	// Progress of the current stage (EventProgress).
+	Unit       string  `json:"unit,omitempty"`
+	Done       uint64  `json:"done,omitempty"`
+	ETASeconds float64 `json:"eta_seconds,omitempty"`
+}
+
+func (pack *Pack) event(ev Event) {
+	if pack.OnEvent == nil {
+		return
+	}
+	ev.Time = time.Now()
+	pack.OnEvent(ev)
+}
@@ -0,0 +1,210 @@
+package packer
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/tools/internal/oci"
+	"github.com/gokrazy/tools/internal/renameio"
+)
+
+// isExtraFileURL reports whether an ExtraFilePaths value refers to a file
+// which needs to be downloaded.
+func isExtraFileURL(value string) bool {
+	return strings.HasPrefix(value, "https://") ||
+		strings.HasPrefix(value, "http://")
+}
+
+// parseExtraFileURL splits an ExtraFilePaths value of the form
+// https://example.com/foo.tar.gz#sha256=<hex> into the URL to download and
+// the expected SHA256 sum.
+func parseExtraFileURL(value string) (*url.URL, string, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, "", err
+	}
+	sum, ok := strings.CutPrefix(u.Fragment, "sha256=")
+	if !ok || len(sum) != 2*sha256.Size {
+		return nil, "", fmt.Errorf("%s: URLs must be pinned using #sha256=<hex>", value)
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return nil, "", fmt.Errorf("%s: invalid sha256: %v", value, err)
+	}
+	u.Fragment = ""
+	return u, strings.ToLower(sum), nil
+}
+
+// extraFilesCacheDir returns the directory in which downloaded extra files
+// are stored, keyed by their SHA256 sum.
+func extraFilesCacheDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "gokrazy", "extrafiles"), nil
+}
+
+// isTarball reports whether name is a (possibly gzip-compressed) tar archive.
+func isTarball(name string) (tarball, compressed bool) {
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return true, false
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return true, true
+	}
+	return false, false
+}
+
+// httpClient returns Pack.HTTPClient, or http.DefaultClient if unset.
+func (pack *Pack) httpClient() *http.Client {
+	if pack.HTTPClient != nil {
+		return pack.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// fetchExtraFile downloads the ExtraFilePaths URL value (unless it is already
+// cached), verifies its checksum and returns the path to use instead:
+//
+//   - for tarballs, the path of the (decompressed) archive without its .tar
+//     suffix, so that it is extracted like a local extrafiles archive
+//   - for all other files, the path of the downloaded file
+//
+// Downloads use httpClient. In offline mode, fetchExtraFile fails if value is
+// not cached.
+func fetchExtraFile(httpClient *http.Client, value string, offline bool) (string, error) {
+	u, sum, err := parseExtraFileURL(value)
+	if err != nil {
+		return "", err
+	}
+	cacheDir, err := extraFilesCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cacheDir, sum)
+	fn := filepath.Join(dir, "file")
+	archive := filepath.Join(dir, "archive")
+	tarball, compressed := isTarball(path.Base(u.Path))
+
+	result, cached := fn, fn
+	if tarball {
+		result, cached = archive, archive+".tar"
+	}
+	if _, err := os.Stat(cached); err == nil {
+		return result, nil
+	}
+
+	if offline {
+		return "", fmt.Errorf("%s is not cached (see gok vendor): %w", u, ErrOffline)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	log.Printf("downloading %s", u)
+	resp, err := httpClient.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("downloading %s: unexpected HTTP status: got %v, want %v", u, resp.Status, want)
+	}
+	f, err := renameio.TempFile("", fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Cleanup()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return "", fmt.Errorf("downloading %s: %v", u, err)
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != sum {
+		return "", fmt.Errorf("downloading %s: checksum mismatch: got sha256=%s, want sha256=%s", u, got, sum)
+	}
+	if err := f.CloseAtomicallyReplace(); err != nil {
+		return "", err
+	}
+
+	if !tarball {
+		return result, nil
+	}
+	if err := unpackTarball(fn, archive+".tar", compressed); err != nil {
+		return "", fmt.Errorf("%s: %v", u, err)
+	}
+	return result, nil
+}
+
+// unpackTarball stores the tar archive src at dest, decompressing it if
+// needed.
+func unpackTarball(src, dest string, compressed bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var rd io.Reader = in
+	if compressed {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		rd = zr
+	}
+	out, err := renameio.TempFile("", dest)
+	if err != nil {
+		return err
+	}
+	defer out.Cleanup()
+	if _, err := io.Copy(out, rd); err != nil {
+		return err
+	}
+	return out.CloseAtomicallyReplace()
+}
+
+// fetchOCIExtraFiles pulls image and returns the path (without .tar suffix)
+// of a cached archive containing the file or directory dest of the image,
+// relative to the parent directory of dest, for architecture goarch, using
+// httpClient for the registry.
+func fetchOCIExtraFiles(httpClient *http.Client, image, dest, goarch string) (string, error) {
+	ref, err := oci.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	client, err := oci.NewClient()
+	if err != nil {
+		return "", err
+	}
+	client.HTTPClient = httpClient
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(ref.Digest+"\x00"+goarch+"\x00"+dest)))
+	archive := filepath.Join(client.CacheDir, "extrafiles", key)
+	if _, err := os.Stat(archive + ".tar"); err == nil {
+		return archive, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		return "", err
+	}
+	log.Printf("pulling %s (linux/%s)", ref, goarch)
+	f, err := renameio.TempFile("", archive+".tar")
+	if err != nil {
+		return "", err
+	}
+	defer f.Cleanup()
+	if err := client.Flatten(ref, goarch, dest, f); err != nil {
+		return "", err
+	}
+	if err := f.CloseAtomicallyReplace(); err != nil {
+		return "", err
+	}
+	return archive, nil
+}
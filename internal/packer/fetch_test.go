@@ -0,0 +1,120 @@
+package packer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFetchExtraFile(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir()) // for macOS
+
+	var tarball bytes.Buffer
+	zw := gzip.NewWriter(&tarball)
+	tw := tar.NewWriter(zw)
+	contents := []byte("hello world\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/hello.txt", Mode: 0644, Size: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/hello.tar.gz":
+			w.Write(tarball.Bytes())
+		case "/hello.txt":
+			w.Write(contents)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	t.Run("File", func(t *testing.T) {
+		value := fmt.Sprintf("%s/hello.txt#sha256=%x", srv.URL, sha256.Sum256(contents))
+		fn, err := fetchExtraFile(http.DefaultClient, value, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, contents) {
+			t.Errorf("unexpected contents: got %q, want %q", b, contents)
+		}
+	})
+
+	t.Run("Tarball", func(t *testing.T) {
+		value := fmt.Sprintf("%s/hello.tar.gz#sha256=%x", srv.URL, sha256.Sum256(tarball.Bytes()))
+		before := requests
+		for i := 0; i < 2; i++ {
+			path, err := fetchExtraFile(http.DefaultClient, value, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path + ".tar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdr, err := tar.NewReader(f).Next()
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := hdr.Name, "etc/hello.txt"; got != want {
+				t.Errorf("unexpected archive entry: got %q, want %q", got, want)
+			}
+		}
+		if got, want := requests-before, 1; got != want {
+			t.Errorf("unexpected number of downloads: got %d, want %d (cached)", got, want)
+		}
+	})
+
+	t.Run("ChecksumMismatch", func(t *testing.T) {
+		value := fmt.Sprintf("%s/hello.txt#sha256=%x", srv.URL, sha256.Sum256([]byte("other")))
+		if _, err := fetchExtraFile(http.DefaultClient, value, false); err == nil {
+			t.Errorf("fetchExtraFile succeeded unexpectedly")
+		}
+	})
+
+	t.Run("Offline", func(t *testing.T) {
+		// hello.txt is cached by the File subtest.
+		cached := fmt.Sprintf("%s/hello.txt#sha256=%x", srv.URL, sha256.Sum256(contents))
+		before := requests
+		if _, err := fetchExtraFile(http.DefaultClient, cached, true); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := requests-before, 0; got != want {
+			t.Errorf("unexpected number of downloads in offline mode: got %d, want %d", got, want)
+		}
+		uncached := fmt.Sprintf("%s/other.txt#sha256=%x", srv.URL, sha256.Sum256([]byte("other")))
+		if _, err := fetchExtraFile(http.DefaultClient, uncached, true); !errors.Is(err, ErrOffline) {
+			t.Errorf("fetchExtraFile(http.DefaultClient, uncached, offline) = %v, want ErrOffline", err)
+		}
+	})
+
+	t.Run("Unpinned", func(t *testing.T) {
+		if _, err := fetchExtraFile(http.DefaultClient, srv.URL+"/hello.txt", false); err == nil {
+			t.Errorf("fetchExtraFile succeeded unexpectedly")
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package packer
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/internal/humanize"
+	"github.com/gokrazy/internal/progress"
+)
+
+// flashSyncInterval is how many bytes flashWriter writes to a device before
+// calling fsync. Without regular syncs, the kernel buffers hundreds of
+// megabytes, so that progress reflects the page cache instead of the (often
+// slow) SD card, and closing the device blocks for minutes.
+const flashSyncInterval = 32 * MB
+
+// flashWriter writes to the full disk image file or device f, counting the
+// written bytes for progress reporting.
+type flashWriter struct {
+	f      *os.File
+	sync   bool // call fsync every flashSyncInterval bytes
+	phase  *phaseProgress
+	prog   *progress.Reporter
+	status string
+	start  time.Time
+	total  uint64
+	hash   hash.Hash // nil unless verifying (Pack.Verify)
+
+	mu       sync.Mutex
+	written  uint64
+	unsynced uint64
+	lastETA  time.Time
+}
+
+func (w *flashWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	if w.hash != nil {
+		w.hash.Write(b[:n])
+	}
+	progress.Writer{}.Write(b[:n])
+	w.phase.add(uint64(n))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.written += uint64(n)
+	if time.Since(w.lastETA) > time.Second && w.written < w.total {
+		w.lastETA = time.Now()
+		elapsed := time.Since(w.start)
+		eta := time.Duration(float64(elapsed) * float64(w.total-w.written) / float64(w.written))
+		w.prog.SetStatus(fmt.Sprintf("%s, ETA %v", w.status, eta.Round(time.Second)))
+	}
+	if err != nil {
+		return n, err
+	}
+	if w.sync {
+		w.unsynced += uint64(n)
+		if w.unsynced >= flashSyncInterval {
+			w.unsynced = 0
+			if err := w.f.Sync(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeWithProgress calls write with a writer to f, reporting the progress
+// (bytes written, rate and ETA, assuming total bytes) of writing logStr. When
+// writing to a device (isDev), the data is synced regularly and when done.
+// The returned range covers the written data, starting at the current offset
+// of f.
+func (p *Pack) writeWithProgress(ctx context.Context, f *os.File, isDev bool, logStr string, total uint64, write func(w io.Writer) error) (writtenRange, error) {
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return writtenRange{}, err
+	}
+	progctx, canc := context.WithCancel(ctx)
+	defer canc()
+	prog := &progress.Reporter{}
+	status := "write " + logStr
+	prog.SetStatus(status)
+	prog.SetTotal(total)
+	progress.Reset()
+	go prog.Report(progctx)
+
+	// The progress.Reporter displays interactive progress already, so the
+	// phaseProgress only produces events.
+	fw := &flashWriter{
+		f:      f,
+		sync:   isDev,
+		phase:  p.newPhaseProgress(StageWrite, "bytes", "", total),
+		prog:   prog,
+		status: status,
+		start:  time.Now(),
+		total:  total,
+	}
+	if p.Verify {
+		fw.hash = sha256.New()
+	}
+	if err := write(fw); err != nil {
+		return writtenRange{}, err
+	}
+	if isDev {
+		if err := f.Sync(); err != nil {
+			return writtenRange{}, err
+		}
+	}
+	canc()
+	duration := time.Since(fw.start)
+	written := progress.Reset()
+	fmt.Printf("\rWrote %s (%s) at %.2f MiB/s (total: %v)\n",
+		logStr,
+		humanize.Bytes(written),
+		float64(written)/duration.Seconds()/1024/1024,
+		duration.Round(time.Second))
+	rng := writtenRange{
+		what:   logStr,
+		offset: offset,
+		length: int64(fw.written),
+	}
+	if fw.hash != nil {
+		rng.sum = fw.hash.Sum(nil)
+	}
+	return rng, nil
+}
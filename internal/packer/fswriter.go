@@ -0,0 +1,64 @@
+package packer
+
+import (
+	"time"
+
+	"github.com/gokrazy/tools/packer"
+	"golang.org/x/sync/errgroup"
+)
+
+// Clock returns the modification time to use for files which the boot and
+// root file system writers generate (as opposed to copy).
+type Clock func() time.Time
+
+// PackageDirResolver returns the directory of the Go package pkg, e.g. the
+// kernel package, from which the boot file system writer copies files.
+type PackageDirResolver func(pkg string) (string, error)
+
+// now returns the current time according to Pack.clock, or time.Now.
+func (p *Pack) now() time.Time {
+	if p.clock != nil {
+		return p.clock()
+	}
+	return time.Now()
+}
+
+// packageDir resolves pkg using Pack.resolvePackageDir, or
+// packer.PackageDir (within the instance directory).
+func (p *Pack) packageDir(pkg string) (string, error) {
+	if p.resolvePackageDir != nil {
+		return p.resolvePackageDir(pkg)
+	}
+	be := &packer.BuildEnv{
+		BuildDir: p.buildDirOrMigrate,
+		Env:      p.goEnvOverrides(),
+	}
+	if p.target.GOARCH != "" {
+		be.Target = &p.target
+	}
+	if p.Ext != nil {
+		be.GoToolchain = p.Ext.GoToolchain
+	}
+	return be.PackageDir(pkg)
+}
+
+// packageDirs is like packer.PackageDirs, using packageDir.
+func (p *Pack) packageDirs(pkgs []string) ([]string, error) {
+	var eg errgroup.Group
+	dirs := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		i, pkg := i, pkg // copy
+		eg.Go(func() error {
+			dir, err := p.packageDir(pkg)
+			if err != nil {
+				return err
+			}
+			dirs[i] = dir
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
@@ -0,0 +1,188 @@
+package packer
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/imagefs"
+	"github.com/gokrazy/tools/packer"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+var goldenTime = time.Date(2024, 8, 27, 19, 0, 0, 0, time.UTC)
+
+// fsListing lists all files of the image in f (see imagefs.Open) with their
+// mode, size and SHA256 sum. The listing does not include a hash of the
+// whole image, because the compressed data (compress/zlib) differs between
+// Go versions.
+func fsListing(t *testing.T, f *os.File) string {
+	t.Helper()
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	fsys, err := imagefs.Open(f, st.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%v %8d %s", info.Mode(), info.Size(), path)
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			fmt.Fprintf(&b, " -> %s", info.(interface{ LinkTarget() string }).LinkTarget())
+		case info.Mode().IsRegular():
+			contents, err := fs.ReadFile(fsys, path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, " sha256:%x", sha256.Sum256(contents))
+		}
+		b.WriteString("\n")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s (run go test -update if intended):\ngot:\n%s\nwant:\n%s", golden, got, want)
+	}
+}
+
+// writeGoldenFiles creates the files (path: contents) in dir, with
+// goldenTime as modification time.
+func writeGoldenFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, goldenTime, goldenTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriteRootGolden(t *testing.T) {
+	root := &FileInfo{
+		Dirents: []*FileInfo{
+			{Filename: "etc", Dirents: []*FileInfo{
+				{Filename: "hostname", FromLiteral: "golden\n"},
+				{Filename: "localtime", SymlinkDest: "/usr/share/zoneinfo/UTC"},
+			}},
+			{Filename: "gokrazy", Dirents: []*FileInfo{
+				{Filename: "init", FromLiteral: "\x7fELF init", Mode: 0755},
+			}},
+			{Filename: "user", Dirents: []*FileInfo{
+				{Filename: "hello", FromLiteral: strings.Repeat("hello world\n", 20000), Mode: 0755},
+			}},
+		},
+	}
+	p := &Pack{clock: func() time.Time { return goldenTime }}
+	f, err := os.Create(filepath.Join(t.TempDir(), "root.squashfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := p.writeRoot(context.Background(), f, root); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "root.golden", fsListing(t, f))
+}
+
+func TestWriteBootGolden(t *testing.T) {
+	tmp := t.TempDir()
+	dirs := map[string]string{
+		"example.com/kernel":   filepath.Join(tmp, "kernel"),
+		"example.com/firmware": filepath.Join(tmp, "firmware"),
+		"example.com/eeprom":   filepath.Join(tmp, "eeprom"),
+	}
+	writeGoldenFiles(t, dirs["example.com/kernel"], map[string]string{
+		"vmlinuz":                   "kernel image",
+		"cmdline.txt":               "console=tty1 root=/dev/mmcblk0p2 init=/gokrazy/init rootwait",
+		"config.txt":                "enable_uart=0\n",
+		"bcm2711-rpi-4-b.dtb":       "device tree",
+		"overlays/disable-bt.dtbo":  "overlay",
+		"overlays/overlay_map.dtb":  "overlay map",
+		"modules/not-copied.ko.xz":  "kernel module",
+		"unrelated/not-copied.file": "",
+	})
+	writeGoldenFiles(t, dirs["example.com/firmware"], map[string]string{
+		"start4.elf":   "firmware",
+		"fixup4.dat":   "fixup",
+		"bootcode.bin": "bootcode",
+	})
+	writeGoldenFiles(t, dirs["example.com/eeprom"], map[string]string{
+		"pieeprom-2024-04-15.bin": "eeprom",
+		"pieeprom-2023-01-11.bin": "older eeprom",
+		"vl805-000138c0.bin":      "vl805",
+		"recovery.bin":            "recovery",
+	})
+	kernel, firmware, eeprom := "example.com/kernel", "example.com/firmware", "example.com/eeprom"
+	pack := packer.NewPackForHost(8192, "golden")
+	p := &Pack{
+		Pack: pack,
+		Cfg: &config.Struct{
+			Hostname:                   "golden",
+			KernelPackage:              &kernel,
+			FirmwarePackage:            &firmware,
+			EEPROMPackage:              &eeprom,
+			InternalCompatibilityFlags: &config.InternalCompatibilityFlags{},
+		},
+		Ext:   &extconfig.Struct{},
+		clock: func() time.Time { return goldenTime },
+		resolvePackageDir: func(pkg string) (string, error) {
+			dir, ok := dirs[pkg]
+			if !ok {
+				return "", fmt.Errorf("unexpected package %q", pkg)
+			}
+			return dir, nil
+		},
+	}
+	f, err := os.Create(filepath.Join(tmp, "boot.fat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := p.writeBoot(context.Background(), f, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "boot.golden", fsListing(t, f))
+}
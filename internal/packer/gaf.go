@@ -2,15 +2,22 @@ package packer
 
 import (
 	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/packer"
 )
 
 // overwriteGaf writes a gaf (gokrazy archive format) file
 // by packing build artifacts and
 // storing them into a newly created, uncompressed zip.
-func (p *Pack) overwriteGaf(root *FileInfo) error {
+func (p *Pack) overwriteGaf(ctx context.Context, root *FileInfo) error {
 	dir, err := os.MkdirTemp("", "gokrazy")
 	if err != nil {
 		return err
@@ -41,11 +48,11 @@ func (p *Pack) overwriteGaf(root *FileInfo) error {
 	}
 	defer os.Remove(tmpSBOM.Name())
 
-	if err := p.writeBoot(tmpBoot, tmpMBR.Name()); err != nil {
+	if err := p.writeBoot(ctx, tmpBoot, tmpMBR.Name()); err != nil {
 		return err
 	}
 
-	if err := writeRoot(tmpRoot, root); err != nil {
+	if err := p.writeRoot(ctx, tmpRoot, root); err != nil {
 		return err
 	}
 
@@ -54,7 +61,8 @@ func (p *Pack) overwriteGaf(root *FileInfo) error {
 	// as the SBOM should reflect what’s going into gokrazy,
 	// not its internal implementation details
 	// (i.e.  cfg.InternalCompatibilityFlags untouched).
-	sbomMarshaled, _, err := GenerateSBOM(p.FileCfg)
+	sbomPack := &Pack{FileCfg: p.FileCfg, GOARCH: p.GOARCH, InstanceDir: p.InstanceDir, Env: p.Env}
+	sbomMarshaled, _, err := sbomPack.GenerateSBOM()
 	if err != nil {
 		return err
 	}
@@ -131,3 +139,332 @@ func writeGafArchive(sourceDir, targetFile string) error {
 		return nil
 	})
 }
+
+// GafComponents lists the files contained in a gaf file, in the order in
+// which they are written to a disk.
+var GafComponents = []string{
+	"mbr.img",
+	"boot.img",
+	"root.img",
+	"sbom.json",
+}
+
+// Gaf is an opened gaf (gokrazy archive format) file.
+type Gaf struct {
+	zr *zip.ReadCloser
+}
+
+// OpenGaf opens the gaf file at path for reading.
+func OpenGaf(path string) (*Gaf, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening gaf file %s: %v", path, err)
+	}
+	return &Gaf{zr: zr}, nil
+}
+
+// Close closes the gaf file.
+func (g *Gaf) Close() error {
+	return g.zr.Close()
+}
+
+// Files returns all files contained in the gaf file, in archive order.
+func (g *Gaf) Files() []*zip.File {
+	return g.zr.File
+}
+
+// File returns the gaf file component name (see GafComponents), or an error
+// if the gaf file does not contain it.
+func (g *Gaf) File(name string) (*zip.File, error) {
+	for _, f := range g.zr.File {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("gaf file does not contain %s", name)
+}
+
+// SBOM returns the SBOM contained in the gaf file.
+func (g *Gaf) SBOM() (*SBOMWithHash, error) {
+	f, err := g.File("sbom.json")
+	if err != nil {
+		return nil, err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var sbom SBOMWithHash
+	if err := json.NewDecoder(rc).Decode(&sbom); err != nil {
+		return nil, fmt.Errorf("decoding sbom.json: %v", err)
+	}
+	return &sbom, nil
+}
+
+// deployGaf updates the gokrazy instance described by pack.Cfg with the
+// images of the prebuilt gaf file pack.FromGaf, without building.
+func (pack *Pack) deployGaf(ctx context.Context) error {
+	cfg := pack.Cfg
+	// The certificate is part of the gaf file, so an ACME certificate must
+	// not be renewed here.
+	if err := pack.initUpdateFlags(ctx, cfg, false); err != nil {
+		return err
+	}
+	if pack.newInstallation() {
+		return fmt.Errorf("deploying a gaf file requires updating an existing installation")
+	}
+
+	gaf, err := OpenGaf(pack.FromGaf)
+	if err != nil {
+		return err
+	}
+	defer gaf.Close()
+	sbom, err := gaf.SBOM()
+	if err != nil {
+		return err
+	}
+	pack.event(Event{Type: EventSBOM, SBOMHash: sbom.SBOMHash})
+	pack.notification.NewSBOMHash = sbom.SBOMHash
+	pack.sbom = sbom
+	fmt.Printf("Deploying %s (SBOM hash %s)\n", pack.FromGaf, sbom.SBOMHash)
+
+	readers := make(map[string]io.Reader)
+	for _, name := range []string{"mbr.img", "boot.img", "root.img"} {
+		f, err := gaf.File(name)
+		if err != nil {
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		readers[name] = rc
+	}
+
+	update, schema, err := pack.updateSettings(cfg)
+	if err != nil {
+		return err
+	}
+	updateBaseUrl, updateHttpClient, target, err := pack.connectTarget(update, schema)
+	if err != nil {
+		return err
+	}
+	// gaf files are built for new installations, i.e. they use GPT
+	// PARTUUIDs to refer to the root partition.
+	if !target.Supports("gpt") || !target.Supports("partuuid") {
+		return fmt.Errorf("target does not support GPT PARTUUIDs, which gaf files require: update it using gok update first")
+	}
+	oldStatus, err := remoteStatus(ctx, updateHttpClient, updateBaseUrl.String())
+	if err != nil {
+		return err
+	}
+	oldBuildTimestamp := oldStatus.BuildTimestamp
+	deviceURL := *updateBaseUrl // copy
+	deviceURL.User = nil
+	pack.notification.Device = deviceURL.String()
+	pack.notification.OldSBOMHash = oldStatus.SBOMHash
+
+	return pack.deploy(ctx, deployment{
+		name:   updateBaseUrl.String(),
+		target: target,
+		uploads: []upload{
+			{
+				logStr: "root file system",
+				stream: "root",
+				reader: readers["root.img"],
+			},
+		},
+		boot:     readers["boot.img"],
+		mbr:      readers["mbr.img"],
+		testboot: cfg.InternalCompatibilityFlags.Testboot,
+		pending: &PendingActivation{
+			Device:            deviceURL.String(),
+			OldBuildTimestamp: oldBuildTimestamp,
+		},
+		updated: func(ctx context.Context) error {
+			return pollChanged(ctx, updateHttpClient, updateBaseUrl.String(), oldBuildTimestamp)
+		},
+	})
+}
+
+// copyGafFile copies the gaf file component name to w, failing if it
+// exceeds limit bytes (the partition size).
+func copyGafFile(gaf *Gaf, name string, w io.Writer, limit uint64) error {
+	f, err := gaf.File(name)
+	if err != nil {
+		return err
+	}
+	if f.UncompressedSize64 > limit {
+		return fmt.Errorf("%s too large: %d bytes exceed the partition size of %d bytes", name, f.UncompressedSize64, limit)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// overwriteFromGaf writes a full disk image (partition table, boot and root
+// file system, empty perm partition) to pack.Output.Path, using the boot and
+// root file systems of the prebuilt gaf file pack.FromGaf.
+func (pack *Pack) overwriteFromGaf(ctx context.Context) error {
+	cfg := pack.Cfg
+	if err := checkBootPartitionSize(pack.Ext); err != nil {
+		return err
+	}
+	dev, err := deviceSettings(pack.instancePath(), cfg.DeviceType)
+	if err != nil {
+		return err
+	}
+	if len(dev.rootDeviceFiles) > 0 {
+		log.Printf("WARNING: gaf files do not contain the root device files (e.g. bootloaders) of device type %q, the image will not contain them", cfg.DeviceType)
+	}
+	// gaf files are built for new installations, so the partition table
+	// needs to match the PARTUUIDs that boot.img refers to.
+	pack.Pack = packer.NewPackForHost(dev.firstPartitionOffsetSectors, cfg.Hostname)
+	pack.Pack.BootPartitionMB = int64(pack.Ext.BootPartitionSizeMB)
+	pack.Pack.UsePartuuid = true
+	pack.Pack.UseGPTPartuuid = !dev.mbrOnlyWithoutGpt
+	pack.Pack.UseGPT = !dev.mbrOnlyWithoutGpt
+
+	gaf, err := OpenGaf(pack.FromGaf)
+	if err != nil {
+		return err
+	}
+	defer gaf.Close()
+	sbom, err := gaf.SBOM()
+	if err != nil {
+		return err
+	}
+	pack.event(Event{Type: EventSBOM, SBOMHash: sbom.SBOMHash})
+	pack.sbom = sbom
+
+	pack.stage(StageWrite)
+	path := pack.Output.Path
+	if err := checkDevice(path); err != nil {
+		return err
+	}
+	st, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	isDev := err == nil && st.Mode()&os.ModeDevice == os.ModeDevice
+
+	var f *os.File
+	if isDev {
+		if err := verifyNotMounted(path); err != nil {
+			return err
+		}
+		f, err = pack.partition(path)
+		if err != nil {
+			return err
+		}
+		if pack.Discard == DiscardAll {
+			devsize, err := deviceSize(f.Fd())
+			if err != nil {
+				return err
+			}
+			if err := discardDevice(f, path, pack.discardRanges(devsize, writtenRange{}, writtenRange{})); err != nil {
+				return err
+			}
+		}
+	} else {
+		targetStorageBytes := cfg.InternalCompatibilityFlags.TargetStorageBytes
+		lower := int(pack.PartitionOffset(4)) + 100*MB
+		if targetStorageBytes < lower || targetStorageBytes%512 != 0 {
+			return fmt.Errorf("--target_storage_bytes must be a multiple of 512 (sector size) and at least %d when using overwrite with a file", lower)
+		}
+		f, err = os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(int64(targetStorageBytes)); err != nil {
+			return err
+		}
+		if err := pack.Partition(f, uint64(targetStorageBytes)); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+
+	log.Printf("writing boot and root file systems of %s (SBOM hash %s) to %s", pack.FromGaf, sbom.SBOMHash, path)
+	if _, err := f.Seek(pack.FirstPartitionOffsetSectors*512, io.SeekStart); err != nil {
+		return err
+	}
+	bootRange, err := pack.writeWithProgress(ctx, f, isDev, "boot file system to "+path, pack.BootPartitionBytes(), func(w io.Writer) error {
+		return copyGafFile(gaf, "boot.img", w, pack.BootPartitionBytes())
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeMBR(pack.FirstPartitionOffsetSectors, &offsetReadSeeker{f, pack.FirstPartitionOffsetSectors * 512}, f, pack.Partuuid); err != nil {
+		return err
+	}
+	if _, err := f.Seek(int64(pack.PartitionOffset(2)), io.SeekStart); err != nil {
+		return err
+	}
+	rootImg, err := gaf.File("root.img")
+	if err != nil {
+		return err
+	}
+	rootRange, err := pack.writeWithProgress(ctx, f, isDev, "root file system to "+path, rootImg.UncompressedSize64, func(w io.Writer) error {
+		return copyGafFile(gaf, "root.img", w, packer.RootPartitionBytes)
+	})
+	if err != nil {
+		return err
+	}
+	if isDev && pack.Discard == DiscardUnused {
+		if err := discardDevice(f, path, pack.discardRanges(0, bootRange, rootRange)); err != nil {
+			return err
+		}
+	}
+	if pack.Verify {
+		if err := verifyWritten(f, path, []writtenRange{bootRange, rootRange}); err != nil {
+			return err
+		}
+	}
+	devsize := uint64(cfg.InternalCompatibilityFlags.TargetStorageBytes)
+	if isDev {
+		if devsize, err = deviceSize(f.Fd()); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := checkPermSeed(pack.Ext); err != nil {
+		return err
+	}
+	createdPerm, err := pack.createPerm(ctx, path, devsize)
+	if err != nil {
+		return err
+	}
+	pack.event(Event{Type: EventImage, Path: path})
+
+	if !isDev && !createdPerm {
+		fmt.Printf("If your applications need to store persistent data, create a file system using e.g.:\n")
+		fmt.Printf("\t/sbin/mkfs.ext4 -F -E offset=%v %s %v\n", pack.PartitionOffset(4), path, pack.PermSizeKB(uint64(cfg.InternalCompatibilityFlags.TargetStorageBytes)))
+		fmt.Printf("\n")
+	}
+	return nil
+}
+
+// buildFromGaf deploys the prebuilt gaf file pack.FromGaf or, when writing a
+// full disk image, converts it.
+func (pack *Pack) buildFromGaf(ctx context.Context) error {
+	if pack.Ext == nil {
+		ext, err := extconfig.For(pack.Cfg)
+		if err != nil {
+			return err
+		}
+		pack.Ext = ext
+	}
+	if pack.Output != nil && pack.Output.Type == OutputTypeFull && pack.Output.Path != "" {
+		return pack.overwriteFromGaf(ctx)
+	}
+	return pack.deployGaf(ctx)
+}
@@ -0,0 +1,42 @@
+package packer
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/packer"
+)
+
+// goToolchainRe matches the toolchain names accepted by GOTOOLCHAIN, e.g.
+// go1.22.4 or go1.23rc1. Selection modes like local or +auto are rejected,
+// because they do not pin a specific version.
+var goToolchainRe = regexp.MustCompile(`^go1\.[0-9]+(\.[0-9]+)?((rc|beta)[0-9]+)?$`)
+
+// checkGoToolchain verifies that the Go toolchain pinned in the GoToolchain
+// config field (if any) is valid and that the go command honors it (older go
+// commands ignore GOTOOLCHAIN). env contains additional environment variables,
+// see Pack.goEnvOverrides.
+func checkGoToolchain(ext *extconfig.Struct, env []string) error {
+	if ext.GoToolchain == "" {
+		return nil
+	}
+	if !goToolchainRe.MatchString(ext.GoToolchain) {
+		return fmt.Errorf("invalid GoToolchain %q: expected a Go release like go1.22.4", ext.GoToolchain)
+	}
+	got, err := goVersion(goToolchainEnv(ext, env))
+	if err != nil {
+		return err
+	}
+	if got != ext.GoToolchain {
+		return fmt.Errorf("GoToolchain %s is configured, but the go command uses %s (Go 1.21 or newer is required to switch toolchains)", ext.GoToolchain, got)
+	}
+	return nil
+}
+
+// goToolchainEnv returns the environment for go commands which do not build
+// for the target (e.g. go env), using the GoToolchain of ext and the
+// additional environment variables env.
+func goToolchainEnv(ext *extconfig.Struct, env []string) []string {
+	return packer.GoEnv(packer.TargetFromEnv(packer.Target{}), ext.GoToolchain, env...)
+}
@@ -0,0 +1,98 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/fat"
+)
+
+const (
+	bootloaderSystemdBoot = "systemd-boot"
+	bootloaderGrub        = "grub"
+)
+
+// grubImages maps the file names of GRUB EFI images (as built by e.g.
+// grub-mkimage -O x86_64-efi -p /EFI/BOOT) to their UEFI fallback path.
+var grubImages = []struct {
+	name string
+	dest string
+}{
+	{"grubx64.efi", "/EFI/BOOT/BOOTX64.EFI"},
+	{"grubaa64.efi", "/EFI/BOOT/BOOTAA64.EFI"},
+}
+
+// bootloaderName returns the configured UEFI bootloader, see
+// extconfig.Struct.Bootloader.
+func (p *Pack) bootloaderName() (string, error) {
+	if p.Ext == nil || p.Ext.Bootloader == "" {
+		return bootloaderSystemdBoot, nil
+	}
+	switch bl := p.Ext.Bootloader; bl {
+	case bootloaderSystemdBoot, bootloaderGrub:
+		return bl, nil
+	default:
+		return "", fmt.Errorf("unknown Bootloader %q, expected %q or %q", bl, bootloaderSystemdBoot, bootloaderGrub)
+	}
+}
+
+// grubCfg returns the contents of the grub.cfg file, which boots the kernel
+// with the (padded) kernel command line.
+func grubCfg(cmdline string, initramfs bool) string {
+	var b strings.Builder
+	b.WriteString("set timeout=0\n")
+	b.WriteString("set default=0\n")
+	b.WriteString("menuentry \"gokrazy\" {\n")
+	fmt.Fprintf(&b, "\tlinux /vmlinuz %s\n", cmdline)
+	if initramfs {
+		fmt.Fprintf(&b, "\tinitrd /%s\n", initramfsFilename)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// writeGrub copies the GRUB EFI images from the GrubPackage (or the kernel
+// package) directory into the boot file system. The images must be built
+// with prefix /EFI/BOOT so that GRUB reads the generated /EFI/BOOT/grub.cfg.
+func (p *Pack) writeGrub(fw *fat.Writer, kernelDir string) error {
+	dir := kernelDir
+	if pkg := p.Ext.GrubPackage; pkg != "" {
+		var err error
+		dir, err = p.packageDir(pkg)
+		if err != nil {
+			return err
+		}
+	}
+	var found int
+	for _, img := range grubImages {
+		path := filepath.Join(dir, img.name)
+		src, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		defer src.Close()
+		if err := copyFile(fw, img.dest, src, path); err != nil {
+			return err
+		}
+		found++
+	}
+	if found == 0 {
+		return fmt.Errorf("Bootloader %q: neither grubx64.efi nor grubaa64.efi found in %s (build them using grub-mkimage -p /EFI/BOOT)", bootloaderGrub, dir)
+	}
+	return nil
+}
+
+func writeGrubCfg(fw *fat.Writer, cmdline string, initramfs bool, modTime time.Time) error {
+	w, err := fw.File("/EFI/BOOT/grub.cfg", modTime)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(grubCfg(cmdline, initramfs)))
+	return err
+}
@@ -0,0 +1,92 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/updater"
+)
+
+// connectDevice connects to the running device of the instance with the
+// update settings of gok update, for operations which do not deploy a new
+// build (e.g. Activate or Rollback).
+func (pack *Pack) connectDevice(ctx context.Context) (*url.URL, *http.Client, *updater.Target, error) {
+	cfg := pack.Cfg
+	if pack.Ext == nil {
+		ext, err := extconfig.For(cfg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		pack.Ext = ext
+	}
+	if err := pack.initUpdateFlags(ctx, cfg, false); err != nil {
+		return nil, nil, nil, err
+	}
+	update, schema, err := pack.updateSettings(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return pack.connectTarget(update, schema)
+}
+
+// Status returns the status of the running device of the instance.
+func (pack *Pack) Status(ctx context.Context) (*DeviceStatus, error) {
+	updateBaseUrl, updateHttpClient, _, err := pack.connectDevice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return remoteStatus(ctx, updateHttpClient, updateBaseUrl.String())
+}
+
+// SBOMHash returns the SBOM hash of the build which Build deployed, or the
+// empty string if Build was not called (or failed before building).
+func (pack *Pack) SBOMHash() string {
+	return pack.notification.NewSBOMHash
+}
+
+// CheckHealth returns nil if the device of the instance responds to status
+// requests and runs the build with SBOM hash wantSBOMHash. Devices running
+// gokrazy versions which do not report their SBOM hash are only checked for
+// responding.
+func (pack *Pack) CheckHealth(ctx context.Context, wantSBOMHash string) error {
+	status, err := pack.Status(ctx)
+	if err != nil {
+		return err
+	}
+	return checkStatus(status, wantSBOMHash)
+}
+
+func checkStatus(status *DeviceStatus, wantSBOMHash string) error {
+	if status.SBOMHash == "" || wantSBOMHash == "" {
+		return nil
+	}
+	if status.SBOMHash != wantSBOMHash {
+		return fmt.Errorf("device runs SBOM hash %s (build %s), want %s", status.SBOMHash, status.BuildTimestamp, wantSBOMHash)
+	}
+	return nil
+}
+
+// Rollback switches the device of the instance back to the other root
+// partition, which holds the build the device ran before the most recent
+// update, reboots the device and waits until it runs the build old again.
+//
+// Only the root file system is rolled back: the boot file system (kernel,
+// firmware) of the most recent update remains.
+func (pack *Pack) Rollback(ctx context.Context, old *DeviceStatus) error {
+	updateBaseUrl, updateHttpClient, target, err := pack.connectDevice(ctx)
+	if err != nil {
+		return err
+	}
+	deviceURL := *updateBaseUrl // copy
+	deviceURL.User = nil        // do not leak the password
+	fmt.Printf("Rolling back %s to build %s\n", deviceURL.String(), old.BuildTimestamp)
+	if err := target.Switch(); err != nil {
+		return fmt.Errorf("switching to the previous root partition: %v", err)
+	}
+	return pack.rebootAndWait(ctx, target, func(ctx context.Context) error {
+		return pollUpdated1(ctx, updateHttpClient, updateBaseUrl.String(), old.BuildTimestamp)
+	})
+}
@@ -0,0 +1,36 @@
+package packer
+
+import "testing"
+
+func TestCheckStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		status  DeviceStatus
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "match",
+			status: DeviceStatus{BuildTimestamp: "new", SBOMHash: "abc"},
+			want:   "abc",
+		},
+		{
+			name:    "mismatch",
+			status:  DeviceStatus{BuildTimestamp: "old", SBOMHash: "def"},
+			want:    "abc",
+			wantErr: true,
+		},
+		{
+			name:   "not reported by device",
+			status: DeviceStatus{BuildTimestamp: "new"},
+			want:   "abc",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStatus(&tt.status, tt.want)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkStatus = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/gokrazy/tools/internal/version"
+)
+
+// historyFile is the name of the file in Pack.HistoryDir which contains one
+// Deployment (JSON) per line.
+const historyFile = "deployments.jsonl"
+
+// Deployment is an entry of the deployment history of an instance, see
+// Pack.HistoryDir.
+type Deployment struct {
+	Time            time.Time
+	DurationSeconds float64
+
+	// GokVersion is the version of the program which deployed (see
+	// version.ReadBrief).
+	GokVersion string
+
+	// Operation is update or overwrite.
+	Operation string
+
+	// Target is the device URL (without credentials), serial port, file or
+	// block device which was updated or written.
+	Target string
+
+	// FromGaf is the gaf file which was deployed instead of building, if any.
+	FromGaf string `json:",omitempty"`
+
+	BuildTimestamp string `json:",omitempty"`
+
+	// SBOMHash is empty if the deployment failed before generating the
+	// SBOM. The SBOM itself is stored in the sbom/ sub directory.
+	SBOMHash string `json:",omitempty"`
+
+	Success bool
+	Error   string `json:",omitempty"`
+
+	// Programs lists the module versions of each program.
+	Programs []DeployedProgram `json:",omitempty"`
+}
+
+// DeployedProgram describes a program of a Deployment.
+type DeployedProgram struct {
+	Path    string            // e.g. /user/scan2drive
+	Modules map[string]string // module path to version
+}
+
+// Duration returns how long the deployment took.
+func (d *Deployment) Duration() time.Duration {
+	return time.Duration(d.DurationSeconds * float64(time.Second))
+}
+
+func (d *Deployment) program(p string) (DeployedProgram, bool) {
+	for _, prog := range d.Programs {
+		if prog.Path == p {
+			return prog, true
+		}
+	}
+	return DeployedProgram{}, false
+}
+
+// ProgramChanges returns the programs which were added to or removed from d
+// compared to prev, and the module changes of the other programs, e.g.
+// “/user/scan2drive: +example.com/foo v1.0.0”.
+func (d *Deployment) ProgramChanges(prev *Deployment) []string {
+	var changes []string
+	for _, prog := range d.Programs {
+		old, ok := prev.program(prog.Path)
+		if !ok {
+			changes = append(changes, fmt.Sprintf("%s: new program", prog.Path))
+			continue
+		}
+		for _, change := range moduleChanges(old.Modules, prog.Modules) {
+			changes = append(changes, fmt.Sprintf("%s: %s", prog.Path, change))
+		}
+	}
+	for _, prog := range prev.Programs {
+		if _, ok := d.program(prog.Path); !ok {
+			changes = append(changes, fmt.Sprintf("%s: removed", prog.Path))
+		}
+	}
+	return changes
+}
+
+// ReadHistory returns the deployments recorded in the history directory dir
+// (see Pack.HistoryDir), oldest first. A missing history is empty.
+func ReadHistory(dir string) ([]Deployment, error) {
+	f, err := os.Open(filepath.Join(dir, historyFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var deployments []Deployment
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*MB)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var d Deployment
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", f.Name(), line, err)
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, scanner.Err()
+}
+
+func historySBOMPath(dir, hash string) string {
+	return filepath.Join(dir, "sbom", hash+".json")
+}
+
+// ReadHistorySBOM returns the SBOM with hash (of a Deployment) from the
+// history directory dir.
+func ReadHistorySBOM(dir, hash string) (*SBOMWithHash, error) {
+	b, err := os.ReadFile(historySBOMPath(dir, hash))
+	if err != nil {
+		return nil, err
+	}
+	var sbom SBOMWithHash
+	if err := json.Unmarshal(b, &sbom); err != nil {
+		return nil, fmt.Errorf("%s: %v", historySBOMPath(dir, hash), err)
+	}
+	return &sbom, nil
+}
+
+// appendHistory appends d to the history in dir and stores sbom (if non-nil
+// and not stored yet).
+func appendHistory(dir string, d *Deployment, sbom *SBOMWithHash) error {
+	if sbom != nil {
+		path := historySBOMPath(dir, sbom.SBOMHash)
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			b, err := json.MarshalIndent(sbom, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := renameio.WriteFile(path, append(b, '\n'), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, historyFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// historyTarget returns what pack updates or writes, for Deployment.Target.
+func (pack *Pack) historyTarget() (operation, target string) {
+	if pack.Cfg != nil && pack.Cfg.InternalCompatibilityFlags != nil {
+		flags := pack.Cfg.InternalCompatibilityFlags
+		if flags.Update != "" {
+			if pack.Serial != "" {
+				return "update", "serial console " + pack.Serial
+			}
+			return "update", pack.notification.Device
+		}
+		if flags.Overwrite != "" {
+			return "overwrite", flags.Overwrite
+		}
+		var parts []string
+		for _, part := range []struct{ name, path string }{
+			{"boot", flags.OverwriteBoot},
+			{"root", flags.OverwriteRoot},
+			{"mbr", flags.OverwriteMBR},
+		} {
+			if part.path != "" {
+				parts = append(parts, part.name+"="+part.path)
+			}
+		}
+		if len(parts) > 0 {
+			return "overwrite", strings.Join(parts, " ")
+		}
+	}
+	if pack.Output != nil && pack.Output.Path != "" {
+		return "overwrite", pack.Output.Path
+	}
+	return "", ""
+}
+
+// recordHistory appends the deployment which started at start and resulted
+// in err to the history in pack.HistoryDir, if set. Errors are only logged,
+// as the deployment itself is done.
+func (pack *Pack) recordHistory(start time.Time, err error) {
+	if pack.HistoryDir == "" {
+		return
+	}
+	operation, target := pack.historyTarget()
+	if operation == "" {
+		return // neither updating nor writing, e.g. gok build
+	}
+	d := &Deployment{
+		Time:            start,
+		DurationSeconds: time.Since(start).Seconds(),
+		GokVersion:      version.ReadBrief(),
+		Operation:       operation,
+		Target:          target,
+		FromGaf:         pack.FromGaf,
+		Success:         err == nil,
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	if pack.sbom != nil {
+		d.SBOMHash = pack.sbom.SBOMHash
+	}
+	if md := pack.buildMetadata; md != nil {
+		d.BuildTimestamp = md.BuildTimestamp
+		for _, bin := range md.Binaries {
+			d.Programs = append(d.Programs, DeployedProgram{
+				Path:    bin.Path,
+				Modules: bin.Modules,
+			})
+		}
+		sort.Slice(d.Programs, func(i, j int) bool {
+			return d.Programs[i].Path < d.Programs[j].Path
+		})
+	}
+	if err := appendHistory(pack.HistoryDir, d, pack.sbom); err != nil {
+		log.Printf("recording deployment history: %v", err)
+	}
+}
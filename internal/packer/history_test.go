@@ -0,0 +1,159 @@
+package packer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHistory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "history")
+
+	got, err := ReadHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("ReadHistory(missing dir) = %v, want none", got)
+	}
+
+	sbom := &SBOMWithHash{
+		SBOMHash: "abc",
+		SBOM:     SBOM{GoToolchain: "go1.22.0"},
+	}
+	pack := &Pack{
+		HistoryDir: dir,
+		Cfg: &config.Struct{
+			InternalCompatibilityFlags: &config.InternalCompatibilityFlags{Update: "yes"},
+		},
+		buildMetadata: &BuildMetadata{
+			BuildTimestamp: "2024-09-01T03:00:00Z",
+			Binaries: []BinaryMetadata{
+				{Path: "/user/scan2drive", Modules: map[string]string{"example.com/foo": "v1.0.0"}},
+				{Path: "/gokrazy/init", Modules: map[string]string{"github.com/gokrazy/gokrazy": "v0.1.0"}},
+			},
+		},
+		sbom: sbom,
+	}
+	pack.notification.Device = "http://scanner/"
+	start := time.Date(2024, 9, 1, 3, 0, 0, 0, time.UTC)
+	pack.recordHistory(start, nil)
+	// The same build fails to deploy the second time.
+	pack.recordHistory(start.Add(time.Hour), errors.New("device did not become healthy"))
+
+	// Neither updating nor overwriting: not recorded.
+	(&Pack{HistoryDir: dir}).recordHistory(start, nil)
+
+	got, err = ReadHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("ReadHistory returned %d deployments, want 2", len(got))
+	}
+	first := got[0]
+	if !first.Success || first.Operation != "update" || first.Target != "http://scanner/" || first.SBOMHash != "abc" {
+		t.Errorf("unexpected first deployment: %+v", first)
+	}
+	if got, want := first.Programs[0].Path, "/gokrazy/init"; got != want {
+		t.Errorf("first program = %q, want %q (sorted by path)", got, want)
+	}
+	if second := got[1]; second.Success || second.Error != "device did not become healthy" {
+		t.Errorf("unexpected second deployment: %+v", second)
+	}
+
+	stored, err := ReadHistorySBOM(dir, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(sbom, stored); diff != "" {
+		t.Errorf("ReadHistorySBOM: unexpected diff (-want +got):\n%s", diff)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "sbom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("sbom directory contains %d files, want 1 (deduplicated by hash)", len(entries))
+	}
+}
+
+func TestHistoryTarget(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		pack          *Pack
+		wantOperation string
+		wantTarget    string
+	}{
+		{
+			name: "serial",
+			pack: &Pack{
+				Serial: "/dev/ttyUSB0",
+				Cfg:    &config.Struct{InternalCompatibilityFlags: &config.InternalCompatibilityFlags{Update: "yes"}},
+			},
+			wantOperation: "update",
+			wantTarget:    "serial console /dev/ttyUSB0",
+		},
+		{
+			name: "full",
+			pack: &Pack{
+				Cfg: &config.Struct{InternalCompatibilityFlags: &config.InternalCompatibilityFlags{Overwrite: "/dev/sdx"}},
+			},
+			wantOperation: "overwrite",
+			wantTarget:    "/dev/sdx",
+		},
+		{
+			name: "partitions",
+			pack: &Pack{
+				Cfg: &config.Struct{InternalCompatibilityFlags: &config.InternalCompatibilityFlags{
+					OverwriteBoot: "/tmp/boot.fat",
+					OverwriteRoot: "/tmp/root.squashfs",
+				}},
+			},
+			wantOperation: "overwrite",
+			wantTarget:    "boot=/tmp/boot.fat root=/tmp/root.squashfs",
+		},
+		{
+			name: "gaf",
+			pack: &Pack{
+				Cfg:    &config.Struct{InternalCompatibilityFlags: &config.InternalCompatibilityFlags{}},
+				Output: &OutputStruct{Type: OutputTypeGaf, Path: "/tmp/scanner.gaf"},
+			},
+			wantOperation: "overwrite",
+			wantTarget:    "/tmp/scanner.gaf",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			operation, target := tt.pack.historyTarget()
+			if operation != tt.wantOperation || target != tt.wantTarget {
+				t.Errorf("historyTarget() = %q, %q, want %q, %q", operation, target, tt.wantOperation, tt.wantTarget)
+			}
+		})
+	}
+}
+
+func TestProgramChanges(t *testing.T) {
+	prev := &Deployment{Programs: []DeployedProgram{
+		{Path: "/gokrazy/init", Modules: map[string]string{"github.com/gokrazy/gokrazy": "v0.1.0"}},
+		{Path: "/user/old", Modules: map[string]string{}},
+	}}
+	cur := &Deployment{Programs: []DeployedProgram{
+		{Path: "/gokrazy/init", Modules: map[string]string{"github.com/gokrazy/gokrazy": "v0.2.0"}},
+		{Path: "/user/new", Modules: map[string]string{}},
+	}}
+	got := strings.Join(cur.ProgramChanges(prev), "\n")
+	want := strings.Join([]string{
+		"/gokrazy/init:  github.com/gokrazy/gokrazy v0.1.0 → v0.2.0",
+		"/user/new: new program",
+		"/user/old: removed",
+	}, "\n")
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ProgramChanges: unexpected diff (-want +got):\n%s", diff)
+	}
+}
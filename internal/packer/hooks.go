@@ -0,0 +1,228 @@
+package packer
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+)
+
+// hookEnv lists the environment variables which are passed through to
+// PrePackHooks. All other environment variables are removed, so that hooks
+// produce the same outputs on every machine.
+var hookEnv = []string{
+	"PATH",
+	"HOME",
+	"TMPDIR",
+	"GOPROXY",
+	"GOPATH",
+	"GOCACHE",
+	"GOMODCACHE",
+	"GOTOOLCHAIN",
+
+	// for private modules, see go help private
+	"GOPRIVATE",
+	"GONOPROXY",
+	"GONOSUMDB",
+	"GOINSECURE",
+	"NETRC",
+	"SSH_AUTH_SOCK",
+	"GIT_SSH_COMMAND",
+}
+
+// checkHookOutput returns an error if output (as declared in a PrePackHook)
+// does not refer to a path within the package directory.
+func checkHookOutput(output string) error {
+	if !filepath.IsLocal(output) {
+		return fmt.Errorf("output %q must be a relative path within the package directory", output)
+	}
+	return nil
+}
+
+// hookEnviron returns the environment for running the PrePackHooks of pkg,
+// with the go settings (e.g. GOARCH or GOMODCACHE) of goEnv, which is based on
+// the process environment (see Pack.goEnv).
+func hookEnviron(pkg string, goEnv []string) []string {
+	var env []string
+	for _, key := range hookEnv {
+		if val, ok := lookupGoEnv(goEnv, key); ok {
+			env = append(env, key+"="+val)
+		}
+	}
+	for _, kv := range goEnv {
+		if strings.HasPrefix(kv, "GOARCH=") ||
+			strings.HasPrefix(kv, "GOOS=") ||
+			strings.HasPrefix(kv, "GOTOOLCHAIN=") {
+			env = append(env, kv)
+		}
+	}
+	return append(env, "GOKRAZY_PACKAGE="+pkg)
+}
+
+// lookupGoEnv returns the value of the last entry for key in goEnv, which
+// takes precedence in go commands.
+func lookupGoEnv(goEnv []string, key string) (string, bool) {
+	for i := len(goEnv) - 1; i >= 0; i-- {
+		if val, ok := strings.CutPrefix(goEnv[i], key+"="); ok {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// hookPackages returns the packages with PrePackHooks, sorted by import
+// path.
+func hookPackages(ext *extconfig.Struct) []string {
+	var pkgs []string
+	for pkg, pc := range ext.PackageConfig {
+		if len(pc.PrePackHooks) > 0 {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// runPrePackHooks runs the PrePackHooks of all packages in their package
+// directory and verifies that they created their declared outputs.
+func (pack *Pack) runPrePackHooks(ctx context.Context) error {
+	for _, pkg := range hookPackages(pack.Ext) {
+		dir, err := pack.packageDir(pkg)
+		if err != nil {
+			return err
+		}
+		for _, hook := range pack.Ext.PackageConfig[pkg].PrePackHooks {
+			if len(hook.Command) == 0 {
+				return fmt.Errorf("PrePackHooks of %s: empty Command", pkg)
+			}
+			for _, output := range hook.Outputs {
+				if err := checkHookOutput(output); err != nil {
+					return fmt.Errorf("PrePackHooks of %s: %v", pkg, err)
+				}
+			}
+			cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+			cmd.Dir = dir
+			cmd.Env = hookEnviron(pkg, pack.goEnv())
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			log.Printf("running pre-pack hook of %s: %v", pkg, cmd.Args)
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("PrePackHooks of %s: %v: %v", pkg, cmd.Args, err)
+			}
+			for _, output := range hook.Outputs {
+				if _, err := os.Stat(filepath.Join(dir, output)); err != nil {
+					return fmt.Errorf("PrePackHooks of %s: %v did not create declared output: %v", pkg, cmd.Args, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hookOutputHashes returns the hashes of all declared PrePackHooks outputs.
+// Outputs which are directories are hashed using hashDir.
+func (pack *Pack) hookOutputHashes(ext *extconfig.Struct) ([]FileHash, error) {
+	var hashes []FileHash
+	for _, pkg := range hookPackages(ext) {
+		dir, err := pack.packageDir(pkg)
+		if err != nil {
+			return nil, err
+		}
+		for _, hook := range ext.PackageConfig[pkg].PrePackHooks {
+			for _, output := range hook.Outputs {
+				if err := checkHookOutput(output); err != nil {
+					return nil, fmt.Errorf("PrePackHooks of %s: %v", pkg, err)
+				}
+				path := filepath.Join(dir, output)
+				st, err := os.Stat(path)
+				if err != nil {
+					return nil, fmt.Errorf("PrePackHooks of %s: %v (run gok update or gok overwrite to run the hooks)", pkg, err)
+				}
+				var hash string
+				if st.IsDir() {
+					hash, err = hashDir(path)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					b, err := os.ReadFile(path)
+					if err != nil {
+						return nil, err
+					}
+					hash = fmt.Sprintf("%x", sha256.Sum256(b))
+				}
+				hashes = append(hashes, FileHash{
+					Path: pkg + "/" + filepath.ToSlash(output),
+					Hash: hash,
+				})
+			}
+		}
+	}
+	return hashes, nil
+}
+
+// hookArtifacts are the artifacts of a build which instance-level hooks
+// (see extconfig.Hooks) can access via GOKRAZY_* environment variables.
+type hookArtifacts struct {
+	instance       string // GOKRAZY_INSTANCE
+	buildTimestamp string // GOKRAZY_BUILD_TIMESTAMP
+	binDir         string // GOKRAZY_BIN_DIR: the built Go programs
+	sbom           string // GOKRAZY_SBOM: sbom.json
+	boot           string // GOKRAZY_BOOT: boot file system (FAT)
+	root           string // GOKRAZY_ROOT: root file system (SquashFS)
+	mbr            string // GOKRAZY_MBR: master boot record
+	gaf            string // GOKRAZY_GAF
+	full           string // GOKRAZY_FULL: full disk image (file or device)
+	deviceURL      string // GOKRAZY_DEVICE_URL: the updated device
+}
+
+// environ returns the GOKRAZY_* environment variables of all artifacts which
+// were produced.
+func (a *hookArtifacts) environ() []string {
+	var env []string
+	for _, kv := range []struct{ key, val string }{
+		{"GOKRAZY_INSTANCE", a.instance},
+		{"GOKRAZY_BUILD_TIMESTAMP", a.buildTimestamp},
+		{"GOKRAZY_BIN_DIR", a.binDir},
+		{"GOKRAZY_SBOM", a.sbom},
+		{"GOKRAZY_BOOT", a.boot},
+		{"GOKRAZY_ROOT", a.root},
+		{"GOKRAZY_MBR", a.mbr},
+		{"GOKRAZY_GAF", a.gaf},
+		{"GOKRAZY_FULL", a.full},
+		{"GOKRAZY_DEVICE_URL", a.deviceURL},
+	} {
+		if kv.val != "" {
+			env = append(env, kv.key+"="+kv.val)
+		}
+	}
+	return env
+}
+
+// runInstanceHooks runs hooks (the name hooks of the Hooks config field, e.g.
+// PostBuild) in the instance directory, with the environment of gok plus the
+// GOKRAZY_* environment variables of a.
+func (pack *Pack) runInstanceHooks(ctx context.Context, name string, hooks []extconfig.InstanceHook, a *hookArtifacts) error {
+	for _, hook := range hooks {
+		if len(hook.Command) == 0 {
+			return fmt.Errorf("%s hook: empty Command", name)
+		}
+		cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+		cmd.Dir = pack.instancePath()
+		cmd.Env = append(os.Environ(), a.environ()...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		log.Printf("running %s hook: %v", name, cmd.Args)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook: %v: %v", name, cmd.Args, err)
+		}
+	}
+	return nil
+}
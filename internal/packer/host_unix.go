@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package packer
+
+import (
+	"os"
+	"syscall"
+)
+
+// setUmask sets the umask of the process, which build processes inherit.
+func setUmask(mask int) {
+	syscall.Umask(mask)
+}
+
+// checkDevice returns an error if writing to the device at path is not
+// supported on this operating system.
+func checkDevice(path string) error {
+	return nil
+}
+
+// hostFileMode returns the permissions to use for the host file st in the
+// root file system.
+func hostFileMode(st os.FileInfo) os.FileMode {
+	return st.Mode()
+}
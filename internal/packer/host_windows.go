@@ -0,0 +1,30 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// setUmask does nothing: Windows has no umask.
+func setUmask(mask int) {}
+
+// checkDevice returns an error if path refers to a device (e.g.
+// \\.\PhysicalDrive1): writing to devices is not supported on Windows.
+func checkDevice(path string) error {
+	if strings.HasPrefix(path, `\\.\`) || strings.HasPrefix(path, `//./`) {
+		return fmt.Errorf("%s: writing to devices is not supported on Windows, write a disk image file instead (e.g. --full=gokrazy.img --target_storage_bytes=2147483648) and flash it using e.g. Raspberry Pi Imager", path)
+	}
+	return nil
+}
+
+// hostFileMode returns the permissions to use for the host file st in the
+// root file system. Windows file permissions only distinguish read-only
+// files and have no executable bit, so all files are made executable, as
+// programs built for gokrazy need to be.
+func hostFileMode(st os.FileInfo) os.FileMode {
+	if st.Mode()&0200 == 0 {
+		return 0555
+	}
+	return 0755
+}
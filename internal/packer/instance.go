@@ -0,0 +1,88 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/packer"
+)
+
+// ReadConfig reads the config.json file of the gokrazy instance directory
+// instanceDir, like config.ReadFromFile does for the instance selected by the
+// instanceflag package.
+func ReadConfig(instanceDir string) (*config.Struct, error) {
+	configJSON := filepath.Join(instanceDir, "config.json")
+	f, err := os.Open(configJSON)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config.Struct
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", configJSON, err)
+	}
+	if cfg.Update == nil {
+		cfg.Update = &config.UpdateStruct{}
+	}
+	if cfg.InternalCompatibilityFlags == nil {
+		cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
+	}
+	cfg.Meta.Instance = filepath.Base(instanceDir)
+	cfg.Meta.Path = configJSON
+	cfg.Meta.LastModified = st.ModTime()
+	return &cfg, nil
+}
+
+// configPath returns the path of the file cfg was read from, defaulting to
+// the config.json of the instance selected by the instanceflag package.
+func configPath(cfg *config.Struct) string {
+	if cfg.Meta.Path != "" {
+		return cfg.Meta.Path
+	}
+	return config.InstanceConfigPath()
+}
+
+// instancePath returns the path of elem within the instance directory, see
+// Pack.InstanceDir. Without elements, it returns the instance directory (the
+// empty string for the working directory).
+func (pack *Pack) instancePath(elem ...string) string {
+	return filepath.Join(append([]string{pack.InstanceDir}, elem...)...)
+}
+
+// instanceAbs returns the absolute path of elem within the instance
+// directory, e.g. for passing it to go commands running in a builddir.
+func (pack *Pack) instanceAbs(elem ...string) (string, error) {
+	return filepath.Abs(pack.instancePath(elem...))
+}
+
+// instanceRel resolves path, which is relative to the instance directory
+// (e.g. an ExtraFilePaths config field) unless absolute.
+func (pack *Pack) instanceRel(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return pack.instancePath(path)
+}
+
+// buildDir is like packer.BuildDir, within the instance directory.
+func (pack *Pack) buildDir(importPath string) string {
+	return packer.InstanceBuildDir(pack.InstanceDir, importPath)
+}
+
+// buildDirOrMigrate is like packer.BuildDirOrMigrate, within the instance
+// directory.
+func (pack *Pack) buildDirOrMigrate(importPath string) (string, error) {
+	return packer.InstanceBuildDirOrMigrate(pack.InstanceDir, importPath)
+}
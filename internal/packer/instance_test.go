@@ -0,0 +1,42 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "scanner")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const configJSON = `{"Hostname": "scanner", "Packages": ["github.com/gokrazy/hello"]}`
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(configJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Hostname, "scanner"; got != want {
+		t.Errorf("Hostname = %q, want %q", got, want)
+	}
+	if got, want := cfg.Meta.Instance, "scanner"; got != want {
+		t.Errorf("Meta.Instance = %q, want %q", got, want)
+	}
+	if got, want := configPath(cfg), filepath.Join(dir, "config.json"); got != want {
+		t.Errorf("configPath = %q, want %q", got, want)
+	}
+	if cfg.Update == nil || cfg.InternalCompatibilityFlags == nil {
+		t.Errorf("ReadConfig did not initialize Update and InternalCompatibilityFlags")
+	}
+
+	pack := &Pack{InstanceDir: dir}
+	if got, want := pack.instanceRel("extra.txt"), filepath.Join(dir, "extra.txt"); got != want {
+		t.Errorf("instanceRel(extra.txt) = %q, want %q", got, want)
+	}
+	if got, want := pack.instanceRel("/etc/extra.txt"), "/etc/extra.txt"; got != want {
+		t.Errorf("instanceRel(/etc/extra.txt) = %q, want %q", got, want)
+	}
+}
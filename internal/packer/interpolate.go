@@ -0,0 +1,235 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/secret"
+)
+
+// interpolator expands ${NAME} (environment variable), ${file:/path} (file
+// contents) and ${secret:name} (instance secret) references in config
+// values. Environment variables and files are only expanded when explicitly
+// allowed, so that config.json files in (shared) git repositories cannot be
+// used to exfiltrate arbitrary environment variables or files. Secrets are
+// always allowed, as they are stored within the instance directory.
+type interpolator struct {
+	// allowed contains environment variable names (e.g. WIFI_PSK) and file
+	// references (e.g. file:/etc/secrets/ or file:/etc/secrets/psk.txt). File
+	// references ending in a slash allow all files in that directory.
+	allowed []string
+
+	lookupEnv func(string) (string, bool)
+	readFile  func(string) ([]byte, error)
+
+	// decryptSecret is nil if the instance has no secrets directory.
+	decryptSecret func(string) ([]byte, error)
+}
+
+func newInterpolator(allowed []string, secretsDir string) *interpolator {
+	ip := &interpolator{
+		allowed:   allowed,
+		lookupEnv: os.LookupEnv,
+		readFile:  os.ReadFile,
+	}
+	if secretsDir != "" {
+		ip.decryptSecret = func(name string) ([]byte, error) {
+			return secret.Decrypt(secretsDir, name)
+		}
+	}
+	return ip
+}
+
+func (ip *interpolator) isAllowed(ref string) bool {
+	for _, a := range ip.allowed {
+		if a == ref {
+			return true
+		}
+		if strings.HasPrefix(a, "file:") &&
+			strings.HasSuffix(a, "/") &&
+			strings.HasPrefix(ref, a) &&
+			!strings.Contains(strings.TrimPrefix(ref, a), "..") {
+			return true
+		}
+	}
+	return false
+}
+
+func (ip *interpolator) resolve(ref string) (string, error) {
+	if name, ok := strings.CutPrefix(ref, "secret:"); ok {
+		if ip.decryptSecret == nil {
+			return "", fmt.Errorf("${%s}: instance has no secrets, add one using 'gok secret add'", ref)
+		}
+		b, err := ip.decryptSecret(name)
+		if err != nil {
+			return "", fmt.Errorf("${%s}: %v", ref, err)
+		}
+		return strings.TrimRight(string(b), "\n"), nil
+	}
+	if !ip.isAllowed(ref) {
+		return "", fmt.Errorf("${%s} is not allowed, use --interpolate=%s to allow it", ref, ref)
+	}
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		b, err := ip.readFile(path)
+		if err != nil {
+			return "", err
+		}
+		// Strip the trailing newline that most editors add, like shell
+		// command substitution does.
+		return strings.TrimRight(string(b), "\n"), nil
+	}
+	val, ok := ip.lookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("${%s}: environment variable not set", ref)
+	}
+	return val, nil
+}
+
+// expand replaces all ${…} references in s. A literal $ can be written as $$.
+func (ip *interpolator) expand(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil // fast path
+	}
+	var b strings.Builder
+	for {
+		idx := strings.IndexByte(s, '$')
+		if idx == -1 || idx == len(s)-1 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:idx])
+		s = s[idx:]
+		switch s[1] {
+		case '$':
+			b.WriteByte('$')
+			s = s[2:]
+
+		case '{':
+			end := strings.IndexByte(s, '}')
+			if end == -1 {
+				return "", fmt.Errorf("unterminated ${ reference in %q", s)
+			}
+			val, err := ip.resolve(s[2:end])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(val)
+			s = s[end+1:]
+
+		default:
+			b.WriteByte('$')
+			s = s[1:]
+		}
+	}
+	return b.String(), nil
+}
+
+func (ip *interpolator) expandAll(values []string) ([]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	result := make([]string, len(values))
+	for idx, val := range values {
+		expanded, err := ip.expand(val)
+		if err != nil {
+			return nil, err
+		}
+		result[idx] = expanded
+	}
+	return result, nil
+}
+
+// interpolateConfig expands ${…} references in the config fields which
+// typically contain secrets: CommandLineFlags, Environment, ExtraFileContents
+// and Update.HTTPPassword.
+//
+// Interpolation is only enabled when allowed is non-empty or the instance has
+// a secrets directory (secretsDir is non-empty), so that existing configs
+// containing literal ${…} strings keep working unchanged.
+//
+// interpolateConfig does not modify the maps or slices referenced by cfg,
+// but replaces them with modified copies, so that the config as read from
+// disk (used for the SBOM) does not contain any secrets.
+func interpolateConfig(cfg *config.Struct, allowed []string, secretsDir string) error {
+	if len(allowed) == 0 && secretsDir == "" {
+		return nil
+	}
+	ip := newInterpolator(allowed, secretsDir)
+
+	if cfg.Update != nil && cfg.Update.HTTPPassword != "" {
+		pw, err := ip.expand(cfg.Update.HTTPPassword)
+		if err != nil {
+			return fmt.Errorf("Update.HTTPPassword: %v", err)
+		}
+		update := *cfg.Update // copy
+		update.HTTPPassword = pw
+		cfg.Update = &update
+	}
+
+	packageConfig := make(map[string]config.PackageConfig, len(cfg.PackageConfig))
+	for pkg, pc := range cfg.PackageConfig {
+		var err error
+		pc.CommandLineFlags, err = ip.expandAll(pc.CommandLineFlags)
+		if err != nil {
+			return fmt.Errorf("PackageConfig[%s].CommandLineFlags: %v", pkg, err)
+		}
+		pc.Environment, err = ip.expandAll(pc.Environment)
+		if err != nil {
+			return fmt.Errorf("PackageConfig[%s].Environment: %v", pkg, err)
+		}
+		if pc.ExtraFileContents != nil {
+			contents := make(map[string]string, len(pc.ExtraFileContents))
+			for dest, val := range pc.ExtraFileContents {
+				expanded, err := ip.expand(val)
+				if err != nil {
+					return fmt.Errorf("PackageConfig[%s].ExtraFileContents[%s]: %v", pkg, dest, err)
+				}
+				contents[dest] = expanded
+			}
+			pc.ExtraFileContents = contents
+		}
+		packageConfig[pkg] = pc
+	}
+	if cfg.PackageConfig != nil {
+		cfg.PackageConfig = packageConfig
+	}
+	return nil
+}
+
+var secretRefRe = regexp.MustCompile(`\$\{secret:([^}]+)\}`)
+
+// secretReferences returns the (sorted, de-duplicated) names of all secrets
+// which are referenced in cfg and ext (which may be nil).
+func secretReferences(cfg *config.Struct, ext *extconfig.Struct) []string {
+	var values []string
+	if cfg.Update != nil {
+		values = append(values, cfg.Update.HTTPPassword)
+	}
+	if ext != nil && ext.Network != nil && ext.Network.WiFi != nil {
+		values = append(values, ext.Network.WiFi.PSK)
+	}
+	for _, pc := range cfg.PackageConfig {
+		values = append(values, pc.CommandLineFlags...)
+		values = append(values, pc.Environment...)
+		for _, val := range pc.ExtraFileContents {
+			values = append(values, val)
+		}
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, val := range values {
+		for _, match := range secretRefRe.FindAllStringSubmatch(val, -1) {
+			if name := match[1]; !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,93 @@
+package packer
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInterpolate(t *testing.T) {
+	ip := &interpolator{
+		allowed: []string{"WIFI_PSK", "UNSET", "file:/etc/secrets/"},
+		lookupEnv: func(name string) (string, bool) {
+			if name == "WIFI_PSK" {
+				return "hunter2", true
+			}
+			return "", false
+		},
+		readFile: func(path string) ([]byte, error) {
+			if path == "/etc/secrets/pw.txt" {
+				return []byte("secret\n"), nil
+			}
+			return nil, os.ErrNotExist
+		},
+		decryptSecret: func(name string) ([]byte, error) {
+			if name == "api-token" {
+				return []byte("tok3n\n"), nil
+			}
+			return nil, os.ErrNotExist
+		},
+	}
+
+	for _, tt := range []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: "-listen=:8080", want: "-listen=:8080"},
+		{in: "PSK=${WIFI_PSK}", want: "PSK=hunter2"},
+		{in: "${WIFI_PSK}/${file:/etc/secrets/pw.txt}", want: "hunter2/secret"},
+		{in: "price: $$5, $HOME", want: "price: $5, $HOME"},
+		{in: "trailing $", want: "trailing $"},
+		{in: "-token=${secret:api-token}", want: "-token=tok3n"},
+		{in: "${secret:missing}", wantErr: "not exist"},
+		{in: "${HOME}", wantErr: "not allowed"},
+		{in: "${UNSET}", wantErr: "not set"},
+		{in: "${file:/etc/passwd}", wantErr: "not allowed"},
+		{in: "${file:/etc/secrets/../passwd}", wantErr: "not allowed"},
+		{in: "${WIFI_PSK", wantErr: "unterminated"},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ip.expand(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expand(%q) = %v; want error containing %q", tt.in, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expand(%q) = %q; want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretReferences(t *testing.T) {
+	cfg := &config.Struct{
+		Update: &config.UpdateStruct{
+			HTTPPassword: "${secret:http-password}",
+		},
+		PackageConfig: map[string]config.PackageConfig{
+			"github.com/gokrazy/wifi": {
+				ExtraFileContents: map[string]string{
+					"/etc/wifi.json": `{"ssid": "x", "psk": "${secret:psk}"}`,
+				},
+			},
+			"example.com/cmd/app": {
+				CommandLineFlags: []string{"-token=${secret:psk}", "-verbose"},
+				Environment:      []string{"HOME=${HOME}"},
+			},
+		},
+	}
+	got := secretReferences(cfg, nil)
+	want := []string{"http-password", "psk"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("secretReferences: unexpected diff (-want +got):\n%s", diff)
+	}
+}
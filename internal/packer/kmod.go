@@ -0,0 +1,184 @@
+package packer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+var moduleSuffixes = []string{".ko", ".ko.xz", ".ko.gz", ".ko.zst"}
+
+// moduleName returns the kernel module name of the module file at p
+// (e.g. kernel/drivers/net/wireless/brcm80211/brcmfmac/brcmfmac.ko.xz), or
+// the empty string if p is not a kernel module file. Like modprobe, dashes
+// are normalized to underscores.
+func moduleName(p string) string {
+	base := path.Base(p)
+	for _, suffix := range moduleSuffixes {
+		if name, ok := strings.CutSuffix(base, suffix); ok {
+			return strings.ReplaceAll(name, "-", "_")
+		}
+	}
+	return ""
+}
+
+// modulesDepLine is a line of a modules.dep file, which lists the
+// dependencies of a kernel module.
+type modulesDepLine struct {
+	path string
+	deps []string
+	line string
+}
+
+// parseModulesDep parses a modules.dep file as generated by depmod(8).
+func parseModulesDep(r io.Reader) ([]modulesDepLine, error) {
+	var lines []modulesDepLine
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		p, deps, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed modules.dep line: %q", line)
+		}
+		lines = append(lines, modulesDepLine{
+			path: p,
+			deps: strings.Fields(deps),
+			line: line,
+		})
+	}
+	return lines, scanner.Err()
+}
+
+// modulesToKeep returns the paths of the modules named in include and all
+// modules they (transitively) depend on.
+func modulesToKeep(lines []modulesDepLine, include []string) (map[string]bool, error) {
+	byName := make(map[string]modulesDepLine, len(lines))
+	byPath := make(map[string]modulesDepLine, len(lines))
+	for _, l := range lines {
+		byName[moduleName(l.path)] = l
+		byPath[l.path] = l
+	}
+	keep := make(map[string]bool)
+	var visit func(l modulesDepLine)
+	visit = func(l modulesDepLine) {
+		if keep[l.path] {
+			return
+		}
+		keep[l.path] = true
+		for _, dep := range l.deps {
+			if dl, ok := byPath[dep]; ok {
+				visit(dl)
+			}
+		}
+	}
+	for _, name := range include {
+		l, ok := byName[strings.ReplaceAll(name, "-", "_")]
+		if !ok {
+			return nil, fmt.Errorf("KernelModulesInclude: kernel module %q not found in modules.dep", name)
+		}
+		visit(l)
+	}
+	return keep, nil
+}
+
+// pruneModuleFiles removes all kernel module files below dir (relative path
+// prefix) which are not in keep. Directories which end up empty are removed.
+// It returns the number of modules that were removed.
+func pruneModuleFiles(dir *FileInfo, prefix string, keep map[string]bool) int {
+	var removed int
+	dirents := dir.Dirents[:0]
+	for _, ent := range dir.Dirents {
+		p := path.Join(prefix, ent.Filename)
+		if ent.isFile() {
+			if moduleName(p) != "" && !keep[p] {
+				removed++
+				continue
+			}
+			dirents = append(dirents, ent)
+			continue
+		}
+		if ent.SymlinkDest == "" {
+			removed += pruneModuleFiles(ent, p, keep)
+			if len(ent.Dirents) == 0 {
+				continue
+			}
+		}
+		dirents = append(dirents, ent)
+	}
+	dir.Dirents = dirents
+	return removed
+}
+
+func readFileInfo(fi *FileInfo) ([]byte, error) {
+	if fi.FromHost != "" {
+		return os.ReadFile(fi.FromHost)
+	}
+	return []byte(fi.FromLiteral), nil
+}
+
+// pruneModules removes all kernel modules from modules (the lib/modules
+// directory) which are not listed in include or required by the listed
+// modules. modules.dep is rewritten accordingly.
+func pruneModules(modules *FileInfo, include []string) error {
+	for _, version := range modules.Dirents {
+		if version.isFile() || version.SymlinkDest != "" {
+			continue
+		}
+		var dep *FileInfo
+		for _, ent := range version.Dirents {
+			if ent.Filename == "modules.dep" {
+				dep = ent
+				break
+			}
+		}
+		if dep == nil {
+			return fmt.Errorf("KernelModulesAutoprune: lib/modules/%s/modules.dep not found", version.Filename)
+		}
+		b, err := readFileInfo(dep)
+		if err != nil {
+			return err
+		}
+		lines, err := parseModulesDep(strings.NewReader(string(b)))
+		if err != nil {
+			return err
+		}
+		keep, err := modulesToKeep(lines, include)
+		if err != nil {
+			return err
+		}
+
+		var kept []string
+		for _, l := range lines {
+			if keep[l.path] {
+				kept = append(kept, l.line+"\n")
+			}
+		}
+
+		// modprobe prefers modules.dep.bin over modules.dep, so remove the
+		// binary index, which would still reference the pruned modules. An
+		// empty FromLiteral would turn modules.dep into a directory, so
+		// remove modules.dep if no modules are kept.
+		dirents := version.Dirents[:0]
+		for _, ent := range version.Dirents {
+			if ent.Filename == "modules.dep.bin" ||
+				(ent == dep && len(kept) == 0) {
+				continue
+			}
+			dirents = append(dirents, ent)
+		}
+		version.Dirents = dirents
+		dep.FromHost = ""
+		dep.FromLiteral = strings.Join(kept, "")
+
+		removed := pruneModuleFiles(version, "", keep)
+
+		fmt.Printf("Pruned kernel modules (%s): keeping %d of %d modules\n", version.Filename, len(kept), len(kept)+removed)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package packer
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPruneModules(t *testing.T) {
+	const modulesDep = `kernel/drivers/net/wireless/brcm80211/brcmfmac/brcmfmac.ko: kernel/drivers/net/wireless/brcm80211/brcmutil/brcmutil.ko kernel/net/wireless/cfg80211.ko
+kernel/drivers/net/wireless/brcm80211/brcmutil/brcmutil.ko:
+kernel/net/wireless/cfg80211.ko: kernel/net/rfkill/rfkill.ko
+kernel/net/rfkill/rfkill.ko:
+kernel/sound/usb/snd-usb-audio.ko.xz: kernel/sound/core/snd.ko.xz
+kernel/sound/core/snd.ko.xz:
+`
+	file := func(name string) *FileInfo {
+		return &FileInfo{Filename: name, FromHost: "/nonexistent/" + name}
+	}
+	dir := func(name string, dirents ...*FileInfo) *FileInfo {
+		return &FileInfo{Filename: name, Dirents: dirents}
+	}
+	modules := dir("modules",
+		dir("6.6.31-v8",
+			&FileInfo{Filename: "modules.dep", FromLiteral: modulesDep},
+			file("modules.dep.bin"),
+			file("modules.alias"),
+			dir("kernel",
+				dir("drivers", dir("net", dir("wireless", dir("brcm80211",
+					dir("brcmfmac", file("brcmfmac.ko")),
+					dir("brcmutil", file("brcmutil.ko")))))),
+				dir("net",
+					dir("wireless", file("cfg80211.ko")),
+					dir("rfkill", file("rfkill.ko"))),
+				dir("sound",
+					dir("usb", file("snd-usb-audio.ko.xz")),
+					dir("core", file("snd.ko.xz"))))))
+
+	if err := pruneModules(modules, []string{"cfg80211"}); err != nil {
+		t.Fatal(err)
+	}
+
+	version := modules.Dirents[0]
+	got := version.pathList()
+	want := []string{
+		"modules.dep",
+		"modules.alias",
+		"kernel/net/wireless/cfg80211.ko",
+		"kernel/net/rfkill/rfkill.ko",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("pruneModules: unexpected files (-want +got):\n%s", diff)
+	}
+
+	wantDep := `kernel/net/wireless/cfg80211.ko: kernel/net/rfkill/rfkill.ko
+kernel/net/rfkill/rfkill.ko:
+`
+	if diff := cmp.Diff(wantDep, version.mustFindDirent("modules.dep").FromLiteral); diff != "" {
+		t.Errorf("modules.dep: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	if err := pruneModules(modules, []string{"nonexistent"}); err == nil {
+		t.Errorf("pruneModules(nonexistent) unexpectedly succeeded")
+	}
+}
+
+func TestModuleName(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"kernel/sound/usb/snd-usb-audio.ko.xz", "snd_usb_audio"},
+		{"kernel/net/wireless/cfg80211.ko", "cfg80211"},
+		{"kernel/net/wireless/cfg80211.ko.zst", "cfg80211"},
+		{"modules.dep", ""},
+	} {
+		if got := moduleName(tt.path); got != tt.want {
+			t.Errorf("moduleName(%q) = %q; want %q", tt.path, got, tt.want)
+		}
+	}
+}
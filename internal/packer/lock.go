@@ -0,0 +1,308 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/packer"
+	"golang.org/x/mod/modfile"
+)
+
+// LockFile is the name of the lock file within the gokrazy instance directory.
+const LockFile = "gok.lock"
+
+// Lock pins all inputs of a gokrazy instance build: the Go toolchain version,
+// the versions of all modules (including the kernel, firmware and EEPROM
+// packages) and the contents of all extra files.
+type Lock struct {
+	// GoVersion is the version of the Go toolchain (go env GOVERSION).
+	GoVersion string `json:"go_version"`
+
+	// Modules is sorted by builddir and module path.
+	Modules []LockedModule `json:"modules"`
+
+	// ExtraFileHashes is sorted by path. Paths within the instance directory
+	// are relative.
+	ExtraFileHashes []FileHash `json:"extra_file_hashes"`
+}
+
+// LockedModule is a module requirement of a builddir go.mod file.
+type LockedModule struct {
+	// BuildDir is relative to the instance directory, e.g.
+	// builddir/github.com/gokrazy/kernel.rpi.
+	BuildDir string `json:"builddir"`
+
+	Path    string `json:"path"`
+	Version string `json:"version"`
+
+	// Replace is the replacement module path or directory, if any.
+	Replace string `json:"replace,omitempty"`
+
+	// Sum is the go.sum hash of the module, or the directory hash for
+	// directory replacements.
+	Sum string `json:"sum,omitempty"`
+}
+
+// ReadLock reads the lock file at path.
+func ReadLock(path string) (*Lock, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var l Lock
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", path, err)
+	}
+	return &l, nil
+}
+
+// Marshal returns l formatted for storing it in the lock file.
+func (l *Lock) Marshal() ([]byte, error) {
+	b, err := json.MarshalIndent(l, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func goVersion(env []string) (string, error) {
+	cmd := exec.Command("go", "env", "GOVERSION")
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// readGoSum returns the module hashes (h1:…) of the go.sum file at path, keyed
+// by “module version”. Missing go.sum files are treated as empty.
+func readGoSum(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[fields[0]+" "+fields[1]] = fields[2]
+	}
+	return sums, scanner.Err()
+}
+
+// lockedModules returns the module requirements of the go.mod file in
+// buildDir (relative to instanceDir).
+func lockedModules(instanceDir, buildDir string) ([]LockedModule, error) {
+	b, err := os.ReadFile(filepath.Join(instanceDir, buildDir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	modf, err := modfile.Parse("go.mod", b, nil)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := readGoSum(filepath.Join(instanceDir, buildDir, "go.sum"))
+	if err != nil {
+		return nil, err
+	}
+	replace := make(map[string]*modfile.Replace)
+	for _, r := range modf.Replace {
+		replace[r.Old.Path] = r
+	}
+	var modules []LockedModule
+	for _, r := range modf.Require {
+		m := LockedModule{
+			BuildDir: buildDir,
+			Path:     r.Mod.Path,
+			Version:  r.Mod.Version,
+			Sum:      sums[r.Mod.Path+" "+r.Mod.Version],
+		}
+		if rep, ok := replace[r.Mod.Path]; ok && (rep.Old.Version == "" || rep.Old.Version == r.Mod.Version) {
+			m.Replace = rep.New.Path
+			if rep.New.Version != "" {
+				// replace directive that references a ModulePath
+				m.Version = rep.New.Version
+				m.Sum = sums[rep.New.Path+" "+rep.New.Version]
+			} else {
+				// replace directive that references a FilePath
+				dir := rep.New.Path
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(instanceDir, buildDir, dir)
+				}
+				h, err := hashDir(dir)
+				if err != nil {
+					return nil, err
+				}
+				m.Sum = h
+			}
+		}
+		modules = append(modules, m)
+	}
+	return modules, nil
+}
+
+// GenerateLock generates the lock for pack.FileCfg, which is resolved
+// relative to the instance directory (see InstanceDir).
+func (pack *Pack) GenerateLock() (*Lock, error) {
+	cfg := pack.FileCfg
+	instancePath, err := pack.instanceAbs()
+	if err != nil {
+		return nil, err
+	}
+	ext := pack.Ext
+	if ext == nil {
+		ext, err = extconfig.For(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := checkGoToolchain(ext, pack.goEnvOverrides()); err != nil {
+		return nil, err
+	}
+	goVersion, err := goVersion(goToolchainEnv(ext, pack.goEnvOverrides()))
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lock{GoVersion: goVersion}
+
+	seen := make(map[string]bool)
+	for _, pkg := range append(getGokrazySystemPackages(cfg), cfg.Packages...) {
+		if idx := strings.IndexByte(pkg, '@'); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		// Lock files record builddirs relative to the instance directory.
+		buildDir, err := filepath.Rel(instancePath, packer.InstanceBuildDir(instancePath, pkg))
+		if err != nil {
+			return nil, err
+		}
+		if seen[buildDir] {
+			continue
+		}
+		seen[buildDir] = true
+		modules, err := lockedModules(instancePath, buildDir)
+		if err != nil {
+			return nil, err
+		}
+		lock.Modules = append(lock.Modules, modules...)
+	}
+	sort.Slice(lock.Modules, func(i, j int) bool {
+		a, b := lock.Modules[i], lock.Modules[j]
+		if a.BuildDir != b.BuildDir {
+			return a.BuildDir < b.BuildDir
+		}
+		return a.Path < b.Path
+	})
+
+	_, sbom, err := pack.GenerateSBOM()
+	if err != nil {
+		return nil, err
+	}
+	for _, fh := range sbom.SBOM.ExtraFileHashes {
+		if rel, err := filepath.Rel(instancePath, fh.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			fh.Path = rel
+		}
+		lock.ExtraFileHashes = append(lock.ExtraFileHashes, fh)
+	}
+	sort.Slice(lock.ExtraFileHashes, func(i, j int) bool {
+		return lock.ExtraFileHashes[i].Path < lock.ExtraFileHashes[j].Path
+	})
+	return lock, nil
+}
+
+// lockDiff returns a human-readable description of all differences between
+// want (the lock file) and got (the current state).
+func lockDiff(want, got *Lock) []string {
+	var diffs []string
+	if want.GoVersion != got.GoVersion {
+		diffs = append(diffs, fmt.Sprintf("Go toolchain: locked %s, using %s", want.GoVersion, got.GoVersion))
+	}
+
+	key := func(m LockedModule) string { return m.BuildDir + ": " + m.Path }
+	desc := func(m LockedModule) string {
+		s := m.Version
+		if m.Replace != "" {
+			s = "=> " + m.Replace + " " + m.Version
+		}
+		return strings.TrimSpace(s) + " " + m.Sum
+	}
+	wantModules := make(map[string]LockedModule)
+	for _, m := range want.Modules {
+		wantModules[key(m)] = m
+	}
+	gotModules := make(map[string]LockedModule)
+	for _, m := range got.Modules {
+		gotModules[key(m)] = m
+		w, ok := wantModules[key(m)]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("module %s: not locked (%s)", key(m), desc(m)))
+			continue
+		}
+		if w != m {
+			diffs = append(diffs, fmt.Sprintf("module %s: locked %s, resolved %s", key(m), desc(w), desc(m)))
+		}
+	}
+	for _, m := range want.Modules {
+		if _, ok := gotModules[key(m)]; !ok {
+			diffs = append(diffs, fmt.Sprintf("module %s: locked, but no longer required", key(m)))
+		}
+	}
+
+	wantFiles := make(map[string]string)
+	for _, fh := range want.ExtraFileHashes {
+		wantFiles[fh.Path] = fh.Hash
+	}
+	gotFiles := make(map[string]bool)
+	for _, fh := range got.ExtraFileHashes {
+		gotFiles[fh.Path] = true
+		w, ok := wantFiles[fh.Path]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("extra file %s: not locked", fh.Path))
+			continue
+		}
+		if w != fh.Hash {
+			diffs = append(diffs, fmt.Sprintf("extra file %s: locked hash %s, got %s", fh.Path, w, fh.Hash))
+		}
+	}
+	for _, fh := range want.ExtraFileHashes {
+		if !gotFiles[fh.Path] {
+			diffs = append(diffs, fmt.Sprintf("extra file %s: locked, but no longer used", fh.Path))
+		}
+	}
+	return diffs
+}
+
+// verifyLock returns an error if the current build inputs differ from the
+// lock file.
+func (pack *Pack) verifyLock() error {
+	want, err := ReadLock(pack.instancePath(LockFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("--locked specified, but %s does not exist. Create it using 'gok lock'", LockFile)
+		}
+		return err
+	}
+	got, err := pack.GenerateLock()
+	if err != nil {
+		return err
+	}
+	if diffs := lockDiff(want, got); len(diffs) > 0 {
+		return fmt.Errorf("build inputs differ from %s (update it using 'gok lock'):\n  %s", LockFile, strings.Join(diffs, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLockedModules(t *testing.T) {
+	buildDir := t.TempDir()
+	const goMod = `module gokrazy/build/hello
+
+go 1.22
+
+require (
+	github.com/gokrazy/hello v0.0.0-20230812115537-9d8a28e8c9f6
+	github.com/gokrazy/kernel.rpi v0.0.0-20240801063131-8a2a3e3fb3e3
+)
+
+replace github.com/gokrazy/kernel.rpi => github.com/example/kernel.rpi v1.0.0
+`
+	const goSum = `github.com/example/kernel.rpi v1.0.0 h1:kernel=
+github.com/example/kernel.rpi v1.0.0/go.mod h1:kernelmod=
+github.com/gokrazy/hello v0.0.0-20230812115537-9d8a28e8c9f6 h1:hello=
+github.com/gokrazy/hello v0.0.0-20230812115537-9d8a28e8c9f6/go.mod h1:hellomod=
+`
+	if err := os.WriteFile(filepath.Join(buildDir, "go.mod"), []byte(goMod), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, "go.sum"), []byte(goSum), 0644); err != nil {
+		t.Fatal(err)
+	}
+	instanceDir, rel := filepath.Split(buildDir)
+	got, err := lockedModules(instanceDir, rel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LockedModule{
+		{
+			BuildDir: rel,
+			Path:     "github.com/gokrazy/hello",
+			Version:  "v0.0.0-20230812115537-9d8a28e8c9f6",
+			Sum:      "h1:hello=",
+		},
+		{
+			BuildDir: rel,
+			Path:     "github.com/gokrazy/kernel.rpi",
+			Version:  "v1.0.0",
+			Replace:  "github.com/example/kernel.rpi",
+			Sum:      "h1:kernel=",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("lockedModules: unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLockDiff(t *testing.T) {
+	locked := &Lock{
+		GoVersion: "go1.22.4",
+		Modules: []LockedModule{
+			{BuildDir: "builddir/a", Path: "example.com/a", Version: "v1.0.0", Sum: "h1:a="},
+			{BuildDir: "builddir/b", Path: "example.com/b", Version: "v1.0.0", Sum: "h1:b="},
+		},
+		ExtraFileHashes: []FileHash{
+			{Path: "extra/config.txt", Hash: "1234"},
+		},
+	}
+	if diffs := lockDiff(locked, locked); len(diffs) > 0 {
+		t.Errorf("lockDiff(locked, locked) = %q; want no differences", diffs)
+	}
+
+	current := &Lock{
+		GoVersion: "go1.23.0",
+		Modules: []LockedModule{
+			{BuildDir: "builddir/a", Path: "example.com/a", Version: "v1.1.0", Sum: "h1:a2="},
+			{BuildDir: "builddir/c", Path: "example.com/c", Version: "v1.0.0", Sum: "h1:c="},
+		},
+		ExtraFileHashes: []FileHash{
+			{Path: "extra/config.txt", Hash: "5678"},
+		},
+	}
+	want := []string{
+		"Go toolchain: locked go1.22.4, using go1.23.0",
+		"module builddir/a: example.com/a: locked v1.0.0 h1:a=, resolved v1.1.0 h1:a2=",
+		"module builddir/c: example.com/c: not locked (v1.0.0 h1:c=)",
+		"module builddir/b: example.com/b: locked, but no longer required",
+		"extra file extra/config.txt: locked hash 1234, got 5678",
+	}
+	if diff := cmp.Diff(want, lockDiff(locked, current)); diff != "" {
+		t.Errorf("lockDiff: unexpected diff (-want +got):\n%s", diff)
+	}
+}
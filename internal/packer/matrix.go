@@ -0,0 +1,84 @@
+package packer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gokrazy/internal/config"
+)
+
+// defaultDeviceType is the name under which BuildMatrix accepts the empty
+// device type (Raspberry Pi 3/4, PCs and VMs).
+const defaultDeviceType = "default"
+
+// CloneConfig returns a deep copy of cfg, e.g. so that each build of
+// BuildMatrix can modify (e.g. interpolate) its config independently, or for
+// keeping an untouched copy in Pack.FileCfg.
+func CloneConfig(cfg *config.Struct) (*config.Struct, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var clone config.Struct
+	if err := json.Unmarshal(b, &clone); err != nil {
+		return nil, err
+	}
+	clone.Meta = cfg.Meta
+	return &clone, nil
+}
+
+// BuildMatrix builds the Go programs of the instance once and then writes one
+// gaf file per device type into gafDir, named <hostname>-<device type>.gaf.
+// The gaf files differ only in their boot file system and device-specific
+// settings. Use "default" for the empty DeviceType.
+func (pack *Pack) BuildMatrix(ctx context.Context, programName string, deviceTypes []string, gafDir string) error {
+	if len(deviceTypes) == 0 {
+		return fmt.Errorf("no device types specified")
+	}
+	for _, deviceType := range deviceTypes {
+		if deviceType == defaultDeviceType {
+			continue
+		}
+		if _, err := deviceSettings(pack.instancePath(), deviceType); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(gafDir, 0755); err != nil {
+		return err
+	}
+
+	bindir, err := os.MkdirTemp("", "gokrazy-bins-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bindir)
+
+	for idx, deviceType := range deviceTypes {
+		cfg, err := CloneConfig(pack.Cfg)
+		if err != nil {
+			return err
+		}
+		cfg.DeviceType = deviceType
+		if deviceType == defaultDeviceType {
+			cfg.DeviceType = ""
+		}
+		gafPath := filepath.Join(gafDir, cfg.Hostname+"-"+deviceType+".gaf")
+		fmt.Printf("\n=== device type %s: %s\n\n", deviceType, gafPath)
+
+		devPack := *pack
+		devPack.Cfg = cfg
+		devPack.Output = &OutputStruct{
+			Type: OutputTypeGaf,
+			Path: gafPath,
+		}
+		devPack.binDir = bindir
+		devPack.reuseBins = idx > 0
+		if err := devPack.Build(ctx, programName); err != nil {
+			return fmt.Errorf("device type %s: %w", deviceType, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package packer
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+)
+
+// mountDevice is a MountDevices entry including its extension fields, as
+// written to /etc/gokrazy/mountdevices.json.
+type mountDevice struct {
+	Source  string
+	Type    string
+	Target  string
+	Options string
+
+	Fsck       bool `json:",omitempty"`
+	AutoFormat bool `json:",omitempty"`
+}
+
+// mountDevices returns the MountDevices entries of cfg, merged with the
+// extension fields of ext.
+func mountDevices(cfg *config.Struct, ext *extconfig.Struct) []mountDevice {
+	devs := make([]mountDevice, len(cfg.MountDevices))
+	for idx, md := range cfg.MountDevices {
+		devs[idx] = mountDevice{
+			Source:  md.Source,
+			Type:    md.Type,
+			Target:  md.Target,
+			Options: md.Options,
+		}
+		if idx < len(ext.MountDevices) {
+			devs[idx].Fsck = ext.MountDevices[idx].Fsck
+			devs[idx].AutoFormat = ext.MountDevices[idx].AutoFormat
+		}
+	}
+	return devs
+}
+
+// autoFormatTypes are the file system types which gokrazy can create on
+// MountDevices with AutoFormat.
+var autoFormatTypes = map[string]bool{
+	"ext4": true,
+	"vfat": true,
+}
+
+// reservedMountTargets are directories of the root file system which must not
+// be used as (or contain) a mount target.
+var reservedMountTargets = []string{
+	"/",
+	"/dev",
+	"/etc",
+	"/gokrazy",
+	"/lib",
+	"/proc",
+	"/sys",
+	"/user",
+}
+
+// checkMountDevices verifies the MountDevices entries and returns warnings
+// about entries which are valid, but likely mistakes (e.g. two devices
+// mounted on the same target).
+func checkMountDevices(devs []mountDevice) (warnings []string, _ error) {
+	targets := make(map[string]int)
+	sources := make(map[string]int)
+	for idx, md := range devs {
+		prefix := fmt.Sprintf("MountDevices[%d]", idx)
+		if md.Source == "" {
+			return nil, fmt.Errorf("%s: Source must not be empty", prefix)
+		}
+		if md.Type == "" {
+			return nil, fmt.Errorf("%s: Type must not be empty", prefix)
+		}
+		if !path.IsAbs(md.Target) || path.Clean(md.Target) != strings.TrimSuffix(md.Target, "/") {
+			return nil, fmt.Errorf("%s: Target %q must be an absolute, clean path (e.g. /mnt/usb)", prefix, md.Target)
+		}
+		target := path.Clean(md.Target)
+		for _, reserved := range reservedMountTargets {
+			if target == reserved || (reserved != "/" && strings.HasPrefix(target, reserved+"/")) {
+				return nil, fmt.Errorf("%s: Target %q is (within) reserved directory %s", prefix, md.Target, reserved)
+			}
+		}
+		if strings.ContainsAny(md.Options, " \t\n") {
+			return nil, fmt.Errorf("%s: Options %q must be comma-separated without whitespace", prefix, md.Options)
+		}
+		if md.AutoFormat && !autoFormatTypes[md.Type] {
+			return nil, fmt.Errorf("%s: AutoFormat is only supported for Type ext4 and vfat, not %q", prefix, md.Type)
+		}
+
+		if other, ok := targets[target]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s and MountDevices[%d] are both mounted on %s", prefix, other, target))
+		} else {
+			targets[target] = idx
+		}
+		if other, ok := sources[md.Source]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s and MountDevices[%d] both mount %s", prefix, other, md.Source))
+		} else {
+			sources[md.Source] = idx
+		}
+		dir := path.Dir(target)
+		if dir != "/mnt" && dir != "/perm" && !strings.HasPrefix(dir, "/perm/") {
+			warnings = append(warnings, fmt.Sprintf("%s: Target %s is not a directory in /mnt, make sure it exists on the root file system", prefix, target))
+		}
+	}
+	for target, idx := range targets {
+		for other, otherIdx := range targets {
+			if strings.HasPrefix(target, other+"/") {
+				warnings = append(warnings, fmt.Sprintf("MountDevices[%d]: Target %s is within the Target of MountDevices[%d] (%s), the mounts must happen in order", idx, target, otherIdx, other))
+			}
+		}
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
@@ -0,0 +1,87 @@
+package packer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMountDevices(t *testing.T) {
+	cfg := &config.Struct{
+		MountDevices: []config.MountDevice{
+			{Source: "PARTUUID=abcdef", Type: "ext4", Target: "/mnt/usb", Options: "noatime"},
+			{Source: "/dev/sdb1", Type: "vfat", Target: "/mnt/camera"},
+		},
+	}
+	ext := &extconfig.Struct{
+		MountDevices: []extconfig.MountDevice{
+			{Fsck: true, AutoFormat: true},
+		},
+	}
+	want := []mountDevice{
+		{Source: "PARTUUID=abcdef", Type: "ext4", Target: "/mnt/usb", Options: "noatime", Fsck: true, AutoFormat: true},
+		{Source: "/dev/sdb1", Type: "vfat", Target: "/mnt/camera"},
+	}
+	if diff := cmp.Diff(want, mountDevices(cfg, ext)); diff != "" {
+		t.Errorf("mountDevices: unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckMountDevices(t *testing.T) {
+	usb := mountDevice{Source: "PARTUUID=abcdef", Type: "ext4", Target: "/mnt/usb"}
+	for _, tt := range []struct {
+		name         string
+		devs         []mountDevice
+		wantErr      string
+		wantWarnings []string
+	}{
+		{name: "valid", devs: []mountDevice{usb}},
+		{
+			name:    "relative target",
+			devs:    []mountDevice{{Source: "/dev/sda1", Type: "ext4", Target: "mnt/usb"}},
+			wantErr: "absolute, clean path",
+		},
+		{
+			name:    "reserved target",
+			devs:    []mountDevice{{Source: "/dev/sda1", Type: "ext4", Target: "/etc/foo"}},
+			wantErr: "reserved directory /etc",
+		},
+		{
+			name:    "AutoFormat with unsupported type",
+			devs:    []mountDevice{{Source: "/dev/sda1", Type: "btrfs", Target: "/mnt/usb", AutoFormat: true}},
+			wantErr: "AutoFormat is only supported",
+		},
+		{
+			name: "collisions",
+			devs: []mountDevice{
+				usb,
+				{Source: "/dev/sdb1", Type: "vfat", Target: "/mnt/usb/"},
+				{Source: "/dev/sdb1", Type: "vfat", Target: "/srv/data"},
+			},
+			wantWarnings: []string{
+				"MountDevices[1] and MountDevices[0] are both mounted on /mnt/usb",
+				"MountDevices[2] and MountDevices[1] both mount /dev/sdb1",
+				"MountDevices[2]: Target /srv/data is not a directory in /mnt, make sure it exists on the root file system",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings, err := checkMountDevices(tt.devs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("checkMountDevices = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.wantWarnings, warnings); diff != "" {
+				t.Errorf("checkMountDevices: unexpected warnings (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package packer
+
+import "golang.org/x/sys/unix"
+
+// mountedDevices returns the sources (e.g. /dev/disk4s1) of all mounted file
+// systems.
+func mountedDevices() ([]string, error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]unix.Statfs_t, n)
+	n, err = unix.Getfsstat(buf, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]string, 0, n)
+	for _, st := range buf[:n] {
+		devices = append(devices, unix.ByteSliceToString(st.Mntfromname[:]))
+	}
+	return devices, nil
+}
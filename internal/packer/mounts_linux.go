@@ -0,0 +1,30 @@
+package packer
+
+import (
+	"os"
+	"strings"
+)
+
+// mountedDevices returns the sources (e.g. /dev/sdx1) of all mounted file
+// systems.
+func mountedDevices() ([]string, error) {
+	b, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	var devices []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		// The optional fields are terminated by a single hyphen, followed by
+		// the file system type and the mount source, see proc(5).
+		_, after, ok := strings.Cut(line, " - ")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(after)
+		if len(fields) < 2 {
+			continue
+		}
+		devices = append(devices, fields[1])
+	}
+	return devices, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package packer
+
+// mountedDevices returns no devices: this platform has no code for listing
+// mounted file systems, so verifyNotMounted falls back to not verifying.
+func mountedDevices() ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,29 @@
+package packer
+
+import "testing"
+
+func TestMountedPartition(t *testing.T) {
+	mounted := []string{
+		"/dev/root",
+		"/dev/sda1",
+		"/dev/mmcblk0p2",
+		"/dev/disk4s1",
+		"/dev/disk10s2",
+	}
+	for _, tt := range []struct {
+		dev  string
+		want string
+	}{
+		{"/dev/sda", "/dev/sda1"},
+		{"/dev/sdb", ""},
+		{"/dev/mmcblk0", "/dev/mmcblk0p2"},
+		{"/dev/disk4", "/dev/disk4s1"},
+		{"/dev/rdisk4", "/dev/disk4s1"},
+		{"/dev/disk1", ""}, // not a prefix match of /dev/disk10s2
+		{"/dev/disk10", "/dev/disk10s2"},
+	} {
+		if got := mountedPartition(tt.dev, mounted); got != tt.want {
+			t.Errorf("mountedPartition(%q) = %q, want %q", tt.dev, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+)
+
+// wifiPackage reads /etc/wifi.json, as rendered from Network.WiFi.
+const wifiPackage = "github.com/gokrazy/wifi"
+
+// checkNetwork verifies the Network config field.
+func checkNetwork(cfg *config.Struct, ext *extconfig.Struct) error {
+	nw := ext.Network
+	if nw == nil {
+		return nil
+	}
+	if nw.WiFi != nil {
+		if nw.WiFi.SSID == "" {
+			return fmt.Errorf("Network.WiFi: SSID must not be empty")
+		}
+		if _, ok := cfg.PackageConfig[wifiPackage].ExtraFileContents["/etc/wifi.json"]; ok {
+			return fmt.Errorf("Network.WiFi conflicts with PackageConfig[%q].ExtraFileContents[/etc/wifi.json], remove one of them", wifiPackage)
+		}
+	}
+	seen := make(map[string]bool)
+	for idx, iface := range nw.Interfaces {
+		if iface.Name == "" {
+			return fmt.Errorf("Network.Interfaces[%d]: Name must not be empty", idx)
+		}
+		if seen[iface.Name] {
+			return fmt.Errorf("Network.Interfaces: duplicate interface %q", iface.Name)
+		}
+		seen[iface.Name] = true
+		for _, addr := range iface.Addresses {
+			if _, err := netip.ParsePrefix(addr); err != nil {
+				return fmt.Errorf("Network.Interfaces[%q]: invalid address (expected CIDR notation, e.g. 192.168.1.5/24): %v", iface.Name, err)
+			}
+		}
+		if iface.Gateway != "" {
+			if _, err := netip.ParseAddr(iface.Gateway); err != nil {
+				return fmt.Errorf("Network.Interfaces[%q]: invalid Gateway: %v", iface.Name, err)
+			}
+		}
+	}
+	for _, server := range nw.DNS {
+		if _, err := netip.ParseAddr(server); err != nil {
+			return fmt.Errorf("Network.DNS: %v", err)
+		}
+	}
+	return nil
+}
+
+// networkFiles contains the files rendered from the Network config field.
+type networkFiles struct {
+	// etc contains wifi.json and resolv.conf (if DNS servers are
+	// configured), etcGokrazy contains interfaces.json.
+	etc        []*FileInfo
+	etcGokrazy []*FileInfo
+}
+
+// renderNetwork renders nw into files for /etc. The WiFi PSK is expanded
+// using ip (e.g. ${secret:wifi-psk}).
+func renderNetwork(nw *extconfig.Network, ip *interpolator) (networkFiles, error) {
+	var files networkFiles
+	if nw == nil {
+		return files, nil
+	}
+	if nw.WiFi != nil {
+		psk, err := ip.expand(nw.WiFi.PSK)
+		if err != nil {
+			return files, fmt.Errorf("Network.WiFi.PSK: %v", err)
+		}
+		b, err := json.MarshalIndent(struct {
+			SSID string `json:"ssid"`
+			PSK  string `json:"psk,omitempty"`
+		}{
+			SSID: nw.WiFi.SSID,
+			PSK:  psk,
+		}, "", "  ")
+		if err != nil {
+			return files, err
+		}
+		files.etc = append(files.etc, &FileInfo{
+			Filename:    "wifi.json",
+			Mode:        0400,
+			FromLiteral: string(b) + "\n",
+		})
+	}
+	if len(nw.DNS) > 0 {
+		var b strings.Builder
+		for _, server := range nw.DNS {
+			fmt.Fprintf(&b, "nameserver %s\n", server)
+		}
+		files.etc = append(files.etc, &FileInfo{
+			Filename:    "resolv.conf",
+			FromLiteral: b.String(),
+		})
+	}
+	if len(nw.Interfaces) > 0 {
+		b, err := json.MarshalIndent(nw.Interfaces, "", "  ")
+		if err != nil {
+			return files, err
+		}
+		files.etcGokrazy = append(files.etcGokrazy, &FileInfo{
+			Filename:    "interfaces.json",
+			FromLiteral: string(b) + "\n",
+		})
+	}
+	return files, nil
+}
@@ -0,0 +1,145 @@
+package packer
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckNetwork(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		nw      *extconfig.Network
+		wantErr string
+	}{
+		{name: "unset"},
+		{
+			name: "valid",
+			nw: &extconfig.Network{
+				WiFi: &extconfig.WiFi{SSID: "home", PSK: "${secret:wifi-psk}"},
+				Interfaces: []extconfig.NetworkInterface{
+					{Name: "eth0", Addresses: []string{"192.168.1.5/24", "fd00::5/64"}, Gateway: "192.168.1.1"},
+				},
+				DNS: []string{"192.168.1.1", "2001:4860:4860::8888"},
+			},
+		},
+		{
+			name:    "empty SSID",
+			nw:      &extconfig.Network{WiFi: &extconfig.WiFi{PSK: "x"}},
+			wantErr: "SSID must not be empty",
+		},
+		{
+			name: "address without prefix",
+			nw: &extconfig.Network{
+				Interfaces: []extconfig.NetworkInterface{
+					{Name: "eth0", Addresses: []string{"192.168.1.5"}},
+				},
+			},
+			wantErr: "invalid address",
+		},
+		{
+			name: "duplicate interface",
+			nw: &extconfig.Network{
+				Interfaces: []extconfig.NetworkInterface{{Name: "eth0"}, {Name: "eth0"}},
+			},
+			wantErr: "duplicate interface",
+		},
+		{
+			name:    "invalid DNS server",
+			nw:      &extconfig.Network{DNS: []string{"dns.example"}},
+			wantErr: "Network.DNS",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkNetwork(&config.Struct{}, &extconfig.Struct{Network: tt.nw})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkNetwork: unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkNetwork = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("ExtraFileContents conflict", func(t *testing.T) {
+		cfg := &config.Struct{
+			PackageConfig: map[string]config.PackageConfig{
+				wifiPackage: {
+					ExtraFileContents: map[string]string{
+						"/etc/wifi.json": `{"ssid": "home"}`,
+					},
+				},
+			},
+		}
+		ext := &extconfig.Struct{
+			Network: &extconfig.Network{WiFi: &extconfig.WiFi{SSID: "home"}},
+		}
+		if err := checkNetwork(cfg, ext); err == nil {
+			t.Fatalf("checkNetwork unexpectedly succeeded")
+		}
+	})
+}
+
+func TestRenderNetwork(t *testing.T) {
+	ip := &interpolator{
+		decryptSecret: func(name string) ([]byte, error) {
+			if name == "wifi-psk" {
+				return []byte("hunter2\n"), nil
+			}
+			return nil, os.ErrNotExist
+		},
+	}
+	files, err := renderNetwork(&extconfig.Network{
+		WiFi: &extconfig.WiFi{SSID: "home", PSK: "${secret:wifi-psk}"},
+		Interfaces: []extconfig.NetworkInterface{
+			{Name: "eth0", Addresses: []string{"192.168.1.5/24"}, Gateway: "192.168.1.1"},
+		},
+		DNS: []string{"192.168.1.1", "9.9.9.9"},
+	}, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*FileInfo{
+		{
+			Filename: "wifi.json",
+			Mode:     0400,
+			FromLiteral: `{
+  "ssid": "home",
+  "psk": "hunter2"
+}
+`,
+		},
+		{
+			Filename:    "resolv.conf",
+			FromLiteral: "nameserver 192.168.1.1\nnameserver 9.9.9.9\n",
+		},
+	}
+	if diff := cmp.Diff(want, files.etc); diff != "" {
+		t.Errorf("renderNetwork: unexpected /etc diff (-want +got):\n%s", diff)
+	}
+	wantGokrazy := []*FileInfo{
+		{
+			Filename: "interfaces.json",
+			FromLiteral: `[
+  {
+    "Name": "eth0",
+    "Addresses": [
+      "192.168.1.5/24"
+    ],
+    "Gateway": "192.168.1.1"
+  }
+]
+`,
+		},
+	}
+	if diff := cmp.Diff(wantGokrazy, files.etcGokrazy); diff != "" {
+		t.Errorf("renderNetwork: unexpected /etc/gokrazy diff (-want +got):\n%s", diff)
+	}
+}
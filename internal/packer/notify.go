@@ -0,0 +1,169 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+)
+
+// Notification describes the outcome of gok update, see extconfig.Notify.
+type Notification struct {
+	Instance string `json:"instance"`
+
+	// Device is the URL of the updated device (without credentials).
+	Device string `json:"device,omitempty"`
+
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+
+	// OldSBOMHash is empty if the device did not report its SBOM hash.
+	OldSBOMHash string `json:"old_sbom_hash,omitempty"`
+	NewSBOMHash string `json:"new_sbom_hash,omitempty"`
+
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// Text returns a human-readable summary of n, e.g. for chat messages.
+func (n *Notification) Text() string {
+	var b strings.Builder
+	if n.Success {
+		fmt.Fprintf(&b, "gokrazy instance %s updated successfully", n.Instance)
+	} else {
+		fmt.Fprintf(&b, "updating gokrazy instance %s failed: %s", n.Instance, n.Error)
+	}
+	fmt.Fprintf(&b, " (took %v)\n", time.Duration(n.DurationSeconds*float64(time.Second)).Round(time.Second))
+	if n.Device != "" {
+		fmt.Fprintf(&b, "device: %s\n", n.Device)
+	}
+	old := n.OldSBOMHash
+	if old == "" {
+		old = "unknown"
+	}
+	fmt.Fprintf(&b, "SBOM hash: %s → %s\n", old, n.NewSBOMHash)
+	return b.String()
+}
+
+func postJSON(ctx context.Context, httpClient *http.Client, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	return nil
+}
+
+// emailMessage returns the RFC 5322 message of n for sending via SMTP.
+func emailMessage(cfg *extconfig.EmailNotify, n *Notification) []byte {
+	status := "succeeded"
+	if !n.Success {
+		status = "FAILED"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&b, "Subject: gok update %s: %s\r\n", n.Instance, status)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(n.Text(), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+func sendEmail(cfg *extconfig.EmailNotify, n *Notification) error {
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		password, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return err
+		}
+		host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", cfg.Username, strings.TrimSpace(string(password)), host)
+	}
+	return smtp.SendMail(cfg.SMTPAddr, auth, cfg.From, cfg.To, emailMessage(cfg, n))
+}
+
+// notify sends n to all configured notification endpoints. Errors are only
+// logged, so that failing notifications do not change the outcome of the
+// update.
+func notify(httpClient *http.Client, cfg *extconfig.Notify, n *Notification) {
+	if cfg == nil || (n.Success && cfg.OnlyFailures) {
+		return
+	}
+	// The context of the update might be canceled (e.g. on Ctrl-C), but the
+	// notification should still be sent.
+	ctx, canc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer canc()
+	if cfg.WebhookURL != "" {
+		if err := postJSON(ctx, httpClient, cfg.WebhookURL, n); err != nil {
+			log.Printf("sending webhook notification: %v", err)
+		}
+	}
+	if cfg.SlackWebhookURL != "" {
+		msg := struct {
+			Text string `json:"text"`
+		}{n.Text()}
+		if err := postJSON(ctx, httpClient, cfg.SlackWebhookURL, msg); err != nil {
+			log.Printf("sending Slack notification: %v", err)
+		}
+	}
+	if cfg.Email != nil {
+		if err := sendEmail(cfg.Email, n); err != nil {
+			log.Printf("sending email notification: %v", err)
+		}
+	}
+}
+
+// notifyUpdate sends a notification about the update which started at start
+// and resulted in err, if pack updates a device and notifications are
+// configured.
+func (pack *Pack) notifyUpdate(start time.Time, err error) {
+	if pack.Cfg == nil ||
+		pack.Cfg.InternalCompatibilityFlags == nil ||
+		pack.Cfg.InternalCompatibilityFlags.Update == "" {
+		return // not updating
+	}
+	ext := pack.Ext
+	if ext == nil {
+		// The build failed before reading the extension config fields.
+		var extErr error
+		if ext, extErr = extconfig.For(pack.Cfg); extErr != nil {
+			ext = &extconfig.Struct{}
+		}
+	}
+	n := pack.notification
+	n.Instance = pack.Cfg.Hostname
+	n.Success = err == nil
+	if err != nil {
+		n.Error = err.Error()
+	}
+	n.DurationSeconds = time.Since(start).Seconds()
+	cfg := ext.Notify
+	if cfg == nil {
+		cfg = pack.Notify
+	}
+	notify(pack.httpClient(), cfg, &n)
+}
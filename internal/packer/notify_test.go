@@ -0,0 +1,79 @@
+package packer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNotify(t *testing.T) {
+	var (
+		webhook Notification
+		slack   struct {
+			Text string `json:"text"`
+		}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v any = &webhook
+		if r.URL.Path == "/slack" {
+			v = &slack
+		}
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	n := Notification{
+		Instance:        "scanner",
+		Device:          "http://scanner/",
+		Error:           "device did not become healthy after update",
+		OldSBOMHash:     "01d",
+		NewSBOMHash:     "2e3",
+		DurationSeconds: 61,
+	}
+	cfg := &extconfig.Notify{
+		WebhookURL:      srv.URL + "/webhook",
+		SlackWebhookURL: srv.URL + "/slack",
+		OnlyFailures:    true,
+	}
+	notify(http.DefaultClient, cfg, &n)
+	if diff := cmp.Diff(n, webhook); diff != "" {
+		t.Errorf("unexpected webhook notification: diff (-want +got):\n%s", diff)
+	}
+	want := `updating gokrazy instance scanner failed: device did not become healthy after update (took 1m1s)
+device: http://scanner/
+SBOM hash: 01d → 2e3
+`
+	if diff := cmp.Diff(want, slack.Text); diff != "" {
+		t.Errorf("unexpected Slack message: diff (-want +got):\n%s", diff)
+	}
+
+	// OnlyFailures suppresses notifications about successful updates.
+	webhook = Notification{}
+	n.Success = true
+	n.Error = ""
+	notify(http.DefaultClient, cfg, &n)
+	if webhook.Instance != "" {
+		t.Errorf("unexpected notification about successful update: %+v", webhook)
+	}
+
+	msg := string(emailMessage(&extconfig.EmailNotify{
+		From: "gok@example.com",
+		To:   []string{"ops@example.com", "oncall@example.com"},
+	}, &n))
+	for _, want := range []string{
+		"To: ops@example.com, oncall@example.com\r\n",
+		"Subject: gok update scanner: succeeded\r\n",
+		"\r\n\r\ngokrazy instance scanner updated successfully (took 1m1s)\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("email message does not contain %q:\n%s", want, msg)
+		}
+	}
+}
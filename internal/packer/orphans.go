@@ -0,0 +1,156 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+)
+
+// legacyFileTypes are the kinds of legacy per-package configuration files,
+// stored in <kind>/<pkg>/<kind>.txt (see findPackageFiles).
+var legacyFileTypes = []string{
+	"flags",
+	"buildflags",
+	"buildtags",
+	"env",
+	"dontstart",
+	"waitforclock",
+}
+
+// Orphan is per-package configuration which does not take effect, e.g.
+// because the package was renamed or removed from the instance.
+type Orphan struct {
+	// Source is the file (relative to the instance directory) or config
+	// field (e.g. PackageConfig["github.com/x/y"]) of the configuration.
+	Source string
+
+	// Reason explains why the configuration does not take effect.
+	Reason string
+}
+
+func (o Orphan) String() string {
+	return o.Source + ": " + o.Reason
+}
+
+// knownPackages returns the packages which per-package configuration may
+// refer to: all packages of the build, including kernel, firmware and EEPROM
+// packages.
+func knownPackages(cfg *config.Struct) map[string]bool {
+	known := buildPackageMapFromFlags(cfg)
+	for _, pkg := range []*string{cfg.KernelPackage, cfg.FirmwarePackage, cfg.EEPROMPackage} {
+		if pkg != nil && *pkg != "" {
+			known[*pkg] = true
+		}
+	}
+	return known
+}
+
+// FindOrphans returns the per-package configuration of the instance in the
+// current directory (with config cfg and extension config fields ext) which
+// does not take effect: legacy per-package files and PackageConfig entries
+// for packages which are not part of the build, and legacy files which are
+// ignored because cfg contains PackageConfig entries.
+func FindOrphans(cfg *config.Struct, ext *extconfig.Struct) ([]Orphan, error) {
+	return findOrphans("", cfg, ext)
+}
+
+// findOrphans is like FindOrphans, but for the instance in instanceDir.
+func findOrphans(instanceDir string, cfg *config.Struct, ext *extconfig.Struct) ([]Orphan, error) {
+	known := knownPackages(cfg)
+	var orphans []Orphan
+
+	configured := make(map[string]bool)
+	for pkg := range cfg.PackageConfig {
+		configured[pkg] = true
+	}
+	for pkg := range ext.PackageConfig {
+		configured[pkg] = true
+	}
+	for pkg := range configured {
+		if !known[pkg] {
+			orphans = append(orphans, Orphan{
+				Source: fmt.Sprintf("PackageConfig[%q]", pkg),
+				Reason: "package is not part of the build",
+			})
+		}
+	}
+
+	// reason returns why the legacy configuration of pkg does not take
+	// effect, or the empty string if it does.
+	reason := func(pkg string) string {
+		if len(cfg.PackageConfig) > 0 {
+			return "ignored because config.json contains PackageConfig entries (see gok migrate)"
+		}
+		if !known[pkg] {
+			return "package is not part of the build"
+		}
+		return ""
+	}
+	for _, kind := range legacyFileTypes {
+		files, err := findPackageFiles(instanceDir, kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			pkg := strings.TrimSuffix(strings.TrimPrefix(f.path, kind+"/"), "/"+kind+".txt")
+			if r := reason(pkg); r != "" {
+				orphans = append(orphans, Orphan{Source: f.path, Reason: r})
+			}
+		}
+	}
+
+	// Legacy extra files are stored in extrafiles/<pkg>/<path>. Report the
+	// directories containing files which belong to no known package, unless
+	// ExtraFilePaths refer to them (as written by gok migrate).
+	var referenced []string
+	for _, pc := range cfg.PackageConfig {
+		for _, path := range pc.ExtraFilePaths {
+			referenced = append(referenced, filepath.Clean(path))
+		}
+	}
+	orphanedDirs := make(map[string]string)
+	err := filepath.Walk(filepath.Join(instanceDir, "extrafiles"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		path, err = filepath.Rel(instanceDir, path)
+		if err != nil {
+			return err
+		}
+		for _, ref := range referenced {
+			if path == ref || strings.HasPrefix(path, ref+string(filepath.Separator)) {
+				return nil
+			}
+		}
+		rel := filepath.ToSlash(strings.TrimPrefix(path, "extrafiles"+string(filepath.Separator)))
+		for pkg := range known {
+			if strings.HasPrefix(rel, pkg+"/") {
+				if r := reason(pkg); r != "" {
+					orphanedDirs[filepath.Join("extrafiles", pkg)] = r
+				}
+				return nil
+			}
+		}
+		orphanedDirs[filepath.Dir(path)] = "package is not part of the build"
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for dir, r := range orphanedDirs {
+		orphans = append(orphans, Orphan{Source: dir + "/", Reason: r})
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Source < orphans[j].Source
+	})
+	return orphans, nil
+}
@@ -0,0 +1,97 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFindOrphans(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{
+		"flags/github.com/gokrazy/hello/flags.txt",
+		"flags/github.com/old/name/flags.txt",
+		"env/github.com/old/name/env.txt",
+		"extrafiles/github.com/gokrazy/hello/etc/hello.conf",
+		"extrafiles/github.com/old/name/etc/name.conf",
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("-v\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	emptyGokrazyPackages := []string{}
+	cfg := &config.Struct{
+		Packages:        []string{"github.com/gokrazy/hello"},
+		GokrazyPackages: &emptyGokrazyPackages,
+	}
+	ext := &extconfig.Struct{
+		PackageConfig: map[string]extconfig.PackageConfig{
+			"github.com/old/name": {MemoryLimitMB: 64},
+		},
+	}
+	orphans, err := FindOrphans(cfg, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Orphan{
+		{Source: `PackageConfig["github.com/old/name"]`, Reason: "package is not part of the build"},
+		{Source: "env/github.com/old/name/env.txt", Reason: "package is not part of the build"},
+		{Source: "extrafiles/github.com/old/name/etc/", Reason: "package is not part of the build"},
+		{Source: "flags/github.com/old/name/flags.txt", Reason: "package is not part of the build"},
+	}
+	if diff := cmp.Diff(want, orphans); diff != "" {
+		t.Errorf("FindOrphans: unexpected orphans: diff (-want +got):\n%s", diff)
+	}
+
+	// Once config.json contains PackageConfig, all legacy files are ignored,
+	// except for extra files referenced via ExtraFilePaths.
+	cfg.PackageConfig = map[string]config.PackageConfig{
+		"github.com/gokrazy/hello": {
+			ExtraFilePaths: map[string]string{"/": "extrafiles/github.com/gokrazy/hello"},
+		},
+	}
+	orphans, err = FindOrphans(cfg, &extconfig.Struct{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ignored = "ignored because config.json contains PackageConfig entries (see gok migrate)"
+	want = []Orphan{
+		{Source: "env/github.com/old/name/env.txt", Reason: ignored},
+		{Source: "extrafiles/github.com/old/name/etc/", Reason: "package is not part of the build"},
+		{Source: "flags/github.com/gokrazy/hello/flags.txt", Reason: ignored},
+		{Source: "flags/github.com/old/name/flags.txt", Reason: ignored},
+	}
+	if diff := cmp.Diff(want, orphans); diff != "" {
+		t.Errorf("FindOrphans: unexpected orphans: diff (-want +got):\n%s", diff)
+	}
+
+	// The result does not depend on the working directory when passing the
+	// instance directory explicitly (see Pack.InstanceDir).
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	orphans, err = findOrphans(dir, cfg, &extconfig.Struct{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, orphans); diff != "" {
+		t.Errorf("findOrphans(%s): unexpected orphans: diff (-want +got):\n%s", dir, diff)
+	}
+}
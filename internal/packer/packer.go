@@ -5,7 +5,9 @@ package packer
 import (
 	"archive/tar"
 	"bufio"
+	"cmp"
 	"context"
+	"debug/elf"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -16,24 +18,24 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/deviceconfig"
-	"github.com/gokrazy/internal/httpclient"
 	"github.com/gokrazy/internal/humanize"
 	"github.com/gokrazy/internal/progress"
-	"github.com/gokrazy/internal/tlsflag"
-	"github.com/gokrazy/internal/updateflag"
-	"github.com/gokrazy/tools/internal/measure"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/secret"
+	"github.com/gokrazy/tools/internal/serialupdate"
 	"github.com/gokrazy/tools/internal/version"
 	"github.com/gokrazy/tools/packer"
 	"github.com/gokrazy/updater"
+	"golang.org/x/sync/errgroup"
 )
 
 const MB = 1024 * 1024
@@ -43,9 +45,12 @@ type filePathAndModTime struct {
 	modTime time.Time
 }
 
-func findPackageFiles(fileType string) ([]filePathAndModTime, error) {
+// findPackageFiles returns the legacy per-package configuration files
+// <fileType>/<pkg>/<fileType>.txt of the instance directory instanceDir. The
+// returned paths are relative to instanceDir.
+func findPackageFiles(instanceDir, fileType string) ([]filePathAndModTime, error) {
 	var packageFilePaths []filePathAndModTime
-	err := filepath.Walk(fileType, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(filepath.Join(instanceDir, fileType), func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -53,8 +58,12 @@ func findPackageFiles(fileType string) ([]filePathAndModTime, error) {
 			return nil
 		}
 		if strings.HasSuffix(path, fmt.Sprintf("/%s.txt", fileType)) {
+			rel, err := filepath.Rel(instanceDir, path)
+			if err != nil {
+				return err
+			}
 			packageFilePaths = append(packageFilePaths, filePathAndModTime{
-				path:    path,
+				path:    rel,
 				modTime: info.ModTime(),
 			})
 		}
@@ -75,8 +84,14 @@ type packageConfigFile struct {
 	lastModified time.Time
 }
 
-// packageConfigFiles is a map from package path to packageConfigFile, for constructing output that is keyed per package
-var packageConfigFiles = make(map[string][]packageConfigFile)
+// addPackageConfigFile records that pkg is configured by the specified file,
+// for constructing output that is keyed per package.
+func (pack *Pack) addPackageConfigFile(pkg string, f packageConfigFile) {
+	if pack.packageConfigFiles == nil {
+		pack.packageConfigFiles = make(map[string][]packageConfigFile)
+	}
+	pack.packageConfigFiles[pkg] = append(pack.packageConfigFiles[pkg], f)
+}
 
 func buildPackageMapFromFlags(cfg *config.Struct) map[string]bool {
 	buildPackages := make(map[string]bool)
@@ -99,7 +114,7 @@ func buildPackagesFromFlags(cfg *config.Struct) []string {
 	return buildPackages
 }
 
-func findFlagFiles(cfg *config.Struct) (map[string][]string, error) {
+func (pack *Pack) findFlagFiles(cfg *config.Struct) (map[string][]string, error) {
 	if len(cfg.PackageConfig) > 0 {
 		contents := make(map[string][]string)
 		for pkg, packageConfig := range cfg.PackageConfig {
@@ -107,7 +122,7 @@ func findFlagFiles(cfg *config.Struct) (map[string][]string, error) {
 				continue
 			}
 			contents[pkg] = packageConfig.CommandLineFlags
-			packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+			pack.addPackageConfigFile(pkg, packageConfigFile{
 				kind:         "be started with command-line flags",
 				path:         cfg.Meta.Path,
 				lastModified: cfg.Meta.LastModified,
@@ -116,7 +131,7 @@ func findFlagFiles(cfg *config.Struct) (map[string][]string, error) {
 		return contents, nil
 	}
 
-	flagFilePaths, err := findPackageFiles("flags")
+	flagFilePaths, err := findPackageFiles(pack.instancePath(), "flags")
 	if err != nil {
 		return nil, err
 	}
@@ -134,13 +149,13 @@ func findFlagFiles(cfg *config.Struct) (map[string][]string, error) {
 			log.Printf("WARNING: flag file %s does not match any specified package (%s)", pkg, cfg.Packages)
 			continue
 		}
-		packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+		pack.addPackageConfigFile(pkg, packageConfigFile{
 			kind:         "be started with command-line flags",
 			path:         p.path,
 			lastModified: p.modTime,
 		})
 
-		b, err := os.ReadFile(p.path)
+		b, err := os.ReadFile(pack.instancePath(p.path))
 		if err != nil {
 			return nil, err
 		}
@@ -151,7 +166,7 @@ func findFlagFiles(cfg *config.Struct) (map[string][]string, error) {
 	return contents, nil
 }
 
-func findBuildFlagsFiles(cfg *config.Struct) (map[string][]string, error) {
+func (pack *Pack) findBuildFlagsFiles(cfg *config.Struct) (map[string][]string, error) {
 	if len(cfg.PackageConfig) > 0 {
 		contents := make(map[string][]string)
 		for pkg, packageConfig := range cfg.PackageConfig {
@@ -159,7 +174,7 @@ func findBuildFlagsFiles(cfg *config.Struct) (map[string][]string, error) {
 				continue
 			}
 			contents[pkg] = packageConfig.GoBuildFlags
-			packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+			pack.addPackageConfigFile(pkg, packageConfigFile{
 				kind:         "be compiled with build flags",
 				path:         cfg.Meta.Path,
 				lastModified: cfg.Meta.LastModified,
@@ -168,7 +183,7 @@ func findBuildFlagsFiles(cfg *config.Struct) (map[string][]string, error) {
 		return contents, nil
 	}
 
-	buildFlagsFilePaths, err := findPackageFiles("buildflags")
+	buildFlagsFilePaths, err := findPackageFiles(pack.instancePath(), "buildflags")
 	if err != nil {
 		return nil, err
 	}
@@ -186,13 +201,13 @@ func findBuildFlagsFiles(cfg *config.Struct) (map[string][]string, error) {
 			log.Printf("WARNING: buildflags file %s does not match any specified package (%s)", pkg, cfg.Packages)
 			continue
 		}
-		packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+		pack.addPackageConfigFile(pkg, packageConfigFile{
 			kind:         "be compiled with build flags",
 			path:         p.path,
 			lastModified: p.modTime,
 		})
 
-		b, err := os.ReadFile(p.path)
+		b, err := os.ReadFile(pack.instancePath(p.path))
 		if err != nil {
 			return nil, err
 		}
@@ -216,7 +231,7 @@ func findBuildFlagsFiles(cfg *config.Struct) (map[string][]string, error) {
 	return contents, nil
 }
 
-func findBuildTagsFiles(cfg *config.Struct) (map[string][]string, error) {
+func (pack *Pack) findBuildTagsFiles(cfg *config.Struct) (map[string][]string, error) {
 	if len(cfg.PackageConfig) > 0 {
 		contents := make(map[string][]string)
 		for pkg, packageConfig := range cfg.PackageConfig {
@@ -224,7 +239,7 @@ func findBuildTagsFiles(cfg *config.Struct) (map[string][]string, error) {
 				continue
 			}
 			contents[pkg] = packageConfig.GoBuildTags
-			packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+			pack.addPackageConfigFile(pkg, packageConfigFile{
 				kind:         "be compiled with build tags",
 				path:         cfg.Meta.Path,
 				lastModified: cfg.Meta.LastModified,
@@ -233,7 +248,7 @@ func findBuildTagsFiles(cfg *config.Struct) (map[string][]string, error) {
 		return contents, nil
 	}
 
-	buildTagsFiles, err := findPackageFiles("buildtags")
+	buildTagsFiles, err := findPackageFiles(pack.instancePath(), "buildtags")
 	if err != nil {
 		return nil, err
 	}
@@ -251,13 +266,13 @@ func findBuildTagsFiles(cfg *config.Struct) (map[string][]string, error) {
 			log.Printf("WARNING: buildtags file %s does not match any specified package (%s)", pkg, cfg.Packages)
 			continue
 		}
-		packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+		pack.addPackageConfigFile(pkg, packageConfigFile{
 			kind:         "be compiled with build tags",
 			path:         p.path,
 			lastModified: p.modTime,
 		})
 
-		b, err := os.ReadFile(p.path)
+		b, err := os.ReadFile(pack.instancePath(p.path))
 		if err != nil {
 			return nil, err
 		}
@@ -281,7 +296,7 @@ func findBuildTagsFiles(cfg *config.Struct) (map[string][]string, error) {
 	return contents, nil
 }
 
-func findEnvFiles(cfg *config.Struct) (map[string][]string, error) {
+func (pack *Pack) findEnvFiles(cfg *config.Struct) (map[string][]string, error) {
 	if len(cfg.PackageConfig) > 0 {
 		contents := make(map[string][]string)
 		for pkg, packageConfig := range cfg.PackageConfig {
@@ -289,7 +304,7 @@ func findEnvFiles(cfg *config.Struct) (map[string][]string, error) {
 				continue
 			}
 			contents[pkg] = packageConfig.Environment
-			packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+			pack.addPackageConfigFile(pkg, packageConfigFile{
 				kind:         "be started with environment variables",
 				path:         cfg.Meta.Path,
 				lastModified: cfg.Meta.LastModified,
@@ -298,7 +313,7 @@ func findEnvFiles(cfg *config.Struct) (map[string][]string, error) {
 		return contents, nil
 	}
 
-	buildFlagsFilePaths, err := findPackageFiles("env")
+	buildFlagsFilePaths, err := findPackageFiles(pack.instancePath(), "env")
 	if err != nil {
 		return nil, err
 	}
@@ -316,13 +331,13 @@ func findEnvFiles(cfg *config.Struct) (map[string][]string, error) {
 			log.Printf("WARNING: environment variable file %s does not match any specified package (%s)", pkg, cfg.Packages)
 			continue
 		}
-		packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+		pack.addPackageConfigFile(pkg, packageConfigFile{
 			kind:         "be started with environment variables",
 			path:         p.path,
 			lastModified: p.modTime,
 		})
 
-		b, err := os.ReadFile(p.path)
+		b, err := os.ReadFile(pack.instancePath(p.path))
 		if err != nil {
 			return nil, err
 		}
@@ -428,8 +443,8 @@ func (ae *archiveExtraction) mkdirp(dir string) {
 	}
 }
 
-func (ae *archiveExtraction) extractArchive(path string) (time.Time, error) {
-	f, err := os.Open(path)
+func (ae *archiveExtraction) extractArchive(archive string) (time.Time, error) {
+	f, err := os.Open(archive)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return time.Time{}, nil
@@ -451,18 +466,32 @@ func (ae *archiveExtraction) extractArchive(path string) (time.Time, error) {
 
 		// header.Name is e.g. usr/lib/aarch64-linux-gnu/xtables/libebt_mark.so
 		// for files, but e.g. usr/lib/ (note the trailing /) for directories.
-		filename := strings.TrimSuffix(header.Name, "/")
-
-		fi := &FileInfo{
-			Filename: filepath.Base(filename),
-			Mode:     os.FileMode(header.Mode),
+		// Archives created using tar -C dir . contain names like ./usr/lib/,
+		// and names can be absolute or contain .. elements, which are clamped
+		// to the root directory (like GNU tar does).
+		filename := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if filename == "" {
+			continue // the root directory itself
 		}
 
 		if latestTime.Before(header.ModTime) {
 			latestTime = header.ModTime
 		}
 
-		dir := filepath.Dir(filename)
+		if header.Typeflag == tar.TypeDir {
+			if dir, ok := ae.dirs[filename]; ok {
+				// Created by mkdirp for an earlier entry within the directory.
+				dir.Mode = os.FileMode(header.Mode)
+				continue
+			}
+		}
+
+		fi := &FileInfo{
+			Filename: path.Base(filename),
+			Mode:     os.FileMode(header.Mode),
+		}
+
+		dir := path.Dir(filename)
 		// Create all directory elements. Archives can contain directory entries
 		// without having entries for their parent, e.g. web/assets/fonts/ might
 		// be the first entry in an archive.
@@ -493,9 +522,7 @@ func (ae *archiveExtraction) extractArchive(path string) (time.Time, error) {
 
 // findExtraFilesInDir probes for extrafiles .tar files (possibly with an
 // architecture suffix like _amd64), or whether dir itself exists.
-func findExtraFilesInDir(dir string) (string, error) {
-	targetArch := packer.TargetArch()
-
+func findExtraFilesInDir(dir, targetArch string) (string, error) {
 	var err error
 	for _, p := range []string{
 		dir + "_" + targetArch + ".tar",
@@ -517,13 +544,13 @@ func findExtraFilesInDir(dir string) (string, error) {
 // between findExtraFilesInDir and addExtraFilesFromDir. Maybe
 // findExtraFilesInDir could os.Open the file and pass the file handle to the
 // caller. That would prevent any TOCTOU problems.
-func addExtraFilesFromDir(pkg, dir string, fi *FileInfo) error {
+func (pack *Pack) addExtraFilesFromDir(pkg, dir string, fi *FileInfo) error {
 	ae := archiveExtraction{
 		dirs: make(map[string]*FileInfo),
 	}
 	ae.dirs["."] = fi // root
 
-	targetArch := packer.TargetArch()
+	targetArch := pack.target.GOARCH
 
 	effectivePath := dir + "_" + targetArch + ".tar"
 	latestModTime, err := ae.extractArchive(effectivePath)
@@ -548,7 +575,7 @@ func addExtraFilesFromDir(pkg, dir string, fi *FileInfo) error {
 		}
 	}
 
-	packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+	pack.addPackageConfigFile(pkg, packageConfigFile{
 		kind:         "include extra files in the root file system",
 		path:         effectivePath,
 		lastModified: latestModTime,
@@ -576,13 +603,21 @@ func mkdirp(root *FileInfo, dir string) *FileInfo {
 	return parent
 }
 
-func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
+func (pack *Pack) findExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 	extraFiles := make(map[string][]*FileInfo)
 	if len(cfg.PackageConfig) > 0 {
 		for pkg, packageConfig := range cfg.PackageConfig {
 			var fileInfos []*FileInfo
 
 			for dest, path := range packageConfig.ExtraFilePaths {
+				if isExtraFileURL(path) {
+					fetched, err := fetchExtraFile(pack.httpClient(), path, pack.Offline)
+					if err != nil {
+						return nil, fmt.Errorf("ExtraFilePaths of %s: %v", pkg, err)
+					}
+					path = fetched
+				}
+				path = pack.instanceRel(path)
 				root := &FileInfo{}
 				if st, err := os.Stat(path); err == nil && st.Mode().IsRegular() {
 					// Copy a file from the host
@@ -591,7 +626,7 @@ func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 						Filename: filepath.Base(dest),
 						FromHost: path,
 					})
-					packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+					pack.addPackageConfigFile(pkg, packageConfigFile{
 						kind:         "include extra files in the root file system",
 						path:         path,
 						lastModified: st.ModTime(),
@@ -600,13 +635,13 @@ func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 					// Check if the ExtraFilePaths entry refers to an extrafiles
 					// .tar archive or an existing directory. If nothing can be
 					// found, report the error so the user can fix their config.
-					_, err := findExtraFilesInDir(path)
+					_, err := findExtraFilesInDir(path, pack.target.GOARCH)
 					if err != nil {
 						return nil, fmt.Errorf("ExtraFilePaths of %s: %v", pkg, err)
 					}
 					// Copy a tarball or directory from the host
 					dir := mkdirp(root, dest)
-					if err := addExtraFilesFromDir(pkg, path, dir); err != nil {
+					if err := pack.addExtraFilesFromDir(pkg, path, dir); err != nil {
 						return nil, err
 					}
 				}
@@ -621,28 +656,41 @@ func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 					Filename:    filepath.Base(dest),
 					FromLiteral: contents,
 				})
-				packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+				pack.addPackageConfigFile(pkg, packageConfigFile{
 					kind: "include extra files in the root file system",
 				})
 				fileInfos = append(fileInfos, root)
 			}
 
+			for dest, image := range pack.Ext.PackageConfig[pkg].ExtraFileOCI {
+				path, err := fetchOCIExtraFiles(pack.httpClient(), image, dest, pack.target.GOARCH)
+				if err != nil {
+					return nil, fmt.Errorf("ExtraFileOCI of %s: %v", pkg, err)
+				}
+				root := &FileInfo{}
+				dir := mkdirp(root, filepath.Dir(dest))
+				if err := pack.addExtraFilesFromDir(pkg, path, dir); err != nil {
+					return nil, err
+				}
+				fileInfos = append(fileInfos, root)
+			}
+
 			extraFiles[pkg] = fileInfos
 		}
 		// fall through to look for extra files in <pkg>/_gokrazy/extrafiles
 	}
 
 	buildPackages := buildPackagesFromFlags(cfg)
-	packageDirs, err := packer.PackageDirs(buildPackages)
+	packageDirs, err := pack.packageDirs(buildPackages)
 	if err != nil {
 		return nil, err
 	}
 	for idx, pkg := range buildPackages {
 		if len(cfg.PackageConfig) == 0 {
 			// Look for extra files in $PWD/extrafiles/<pkg>/
-			dir := filepath.Join("extrafiles", pkg)
+			dir := pack.instancePath("extrafiles", pkg)
 			root := &FileInfo{}
-			if err := addExtraFilesFromDir(pkg, dir, root); err != nil {
+			if err := pack.addExtraFilesFromDir(pkg, dir, root); err != nil {
 				return nil, err
 			}
 			extraFiles[pkg] = append(extraFiles[pkg], root)
@@ -652,7 +700,7 @@ func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 			dir := packageDirs[idx]
 			subdir := filepath.Join(dir, "_gokrazy", "extrafiles")
 			root := &FileInfo{}
-			if err := addExtraFilesFromDir(pkg, subdir, root); err != nil {
+			if err := pack.addExtraFilesFromDir(pkg, subdir, root); err != nil {
 				return nil, err
 			}
 			extraFiles[pkg] = append(extraFiles[pkg], root)
@@ -662,7 +710,7 @@ func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 	return extraFiles, nil
 }
 
-func findDontStart(cfg *config.Struct) (map[string]bool, error) {
+func (pack *Pack) findDontStart(cfg *config.Struct) (map[string]bool, error) {
 	if len(cfg.PackageConfig) > 0 {
 		contents := make(map[string]bool)
 		for pkg, packageConfig := range cfg.PackageConfig {
@@ -670,7 +718,7 @@ func findDontStart(cfg *config.Struct) (map[string]bool, error) {
 				continue
 			}
 			contents[pkg] = packageConfig.DontStart
-			packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+			pack.addPackageConfigFile(pkg, packageConfigFile{
 				kind:         "not be started at boot",
 				path:         cfg.Meta.Path,
 				lastModified: cfg.Meta.LastModified,
@@ -679,7 +727,7 @@ func findDontStart(cfg *config.Struct) (map[string]bool, error) {
 		return contents, nil
 	}
 
-	dontStartPaths, err := findPackageFiles("dontstart")
+	dontStartPaths, err := findPackageFiles(pack.instancePath(), "dontstart")
 	if err != nil {
 		return nil, err
 	}
@@ -697,7 +745,7 @@ func findDontStart(cfg *config.Struct) (map[string]bool, error) {
 			log.Printf("WARNING: dontstart.txt file %s does not match any specified package (%s)", pkg, cfg.Packages)
 			continue
 		}
-		packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+		pack.addPackageConfigFile(pkg, packageConfigFile{
 			kind:         "not be started at boot",
 			path:         p.path,
 			lastModified: p.modTime,
@@ -709,7 +757,7 @@ func findDontStart(cfg *config.Struct) (map[string]bool, error) {
 	return contents, nil
 }
 
-func findWaitForClock(cfg *config.Struct) (map[string]bool, error) {
+func (pack *Pack) findWaitForClock(cfg *config.Struct) (map[string]bool, error) {
 	if len(cfg.PackageConfig) > 0 {
 		contents := make(map[string]bool)
 		for pkg, packageConfig := range cfg.PackageConfig {
@@ -717,7 +765,7 @@ func findWaitForClock(cfg *config.Struct) (map[string]bool, error) {
 				continue
 			}
 			contents[pkg] = packageConfig.WaitForClock
-			packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+			pack.addPackageConfigFile(pkg, packageConfigFile{
 				kind:         "wait for clock synchronization before start",
 				path:         cfg.Meta.Path,
 				lastModified: cfg.Meta.LastModified,
@@ -726,7 +774,7 @@ func findWaitForClock(cfg *config.Struct) (map[string]bool, error) {
 		return contents, nil
 	}
 
-	waitForClockPaths, err := findPackageFiles("waitforclock")
+	waitForClockPaths, err := findPackageFiles(pack.instancePath(), "waitforclock")
 	if err != nil {
 		return nil, err
 	}
@@ -744,7 +792,7 @@ func findWaitForClock(cfg *config.Struct) (map[string]bool, error) {
 			log.Printf("WARNING: waitforclock.txt file %s does not match any specified package (%s)", pkg, cfg.Packages)
 			continue
 		}
-		packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
+		pack.addPackageConfigFile(pkg, packageConfigFile{
 			kind:         "wait for clock synchronization before start",
 			path:         p.path,
 			lastModified: p.modTime,
@@ -763,25 +811,35 @@ func (cw *countingWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func (p *Pack) writeBootFile(bootfilename, mbrfilename string) error {
+// removeOnAbort removes the partially written output file fn if writing it
+// failed because ctx was canceled.
+func removeOnAbort(ctx context.Context, fn string, err error) {
+	if err != nil && ctx.Err() != nil {
+		os.Remove(fn)
+	}
+}
+
+func (p *Pack) writeBootFile(ctx context.Context, bootfilename, mbrfilename string) (err error) {
 	f, err := os.Create(bootfilename)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if err := p.writeBoot(f, mbrfilename); err != nil {
+	defer func() { removeOnAbort(ctx, bootfilename, err) }()
+	if err := p.writeBoot(ctx, f, mbrfilename); err != nil {
 		return err
 	}
 	return f.Close()
 }
 
-func writeRootFile(filename string, root *FileInfo) error {
+func (p *Pack) writeRootFile(ctx context.Context, filename string, root *FileInfo) (err error) {
 	f, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if err := writeRoot(f, root); err != nil {
+	defer func() { removeOnAbort(ctx, filename, err) }()
+	if err := p.writeRoot(ctx, f, root); err != nil {
 		return err
 	}
 	return f.Close()
@@ -799,26 +857,41 @@ func partitionPath(base, num string) string {
 }
 
 func verifyNotMounted(dev string) error {
-	b, err := os.ReadFile("/proc/self/mountinfo")
+	mounted, err := mountedDevices()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // platform does not have /proc/self/mountinfo, fall back to not verifying
-		}
 		return err
 	}
-	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
-		parts := strings.Split(line, " ")
-		if len(parts) < 9 {
+	if partition := mountedPartition(dev, mounted); partition != "" {
+		return &TargetMountedError{Device: dev, Partition: partition}
+	}
+	return nil
+}
+
+// mountedPartition returns the first of the mounted devices which is dev or
+// one of its partitions (e.g. /dev/sdx1, /dev/mmcblk0p1 or /dev/disk4s1), or
+// the empty string if none is mounted. On macOS, the raw device (/dev/rdiskN)
+// refers to the same disk as /dev/diskN.
+func mountedPartition(dev string, mounted []string) string {
+	dev = strings.Replace(dev, "/dev/rdisk", "/dev/disk", 1)
+	for _, m := range mounted {
+		rest, ok := strings.CutPrefix(m, dev)
+		if !ok {
 			continue
 		}
-		if strings.HasPrefix(parts[9], dev) {
-			return fmt.Errorf("partition %s of device %s is mounted", parts[9], dev)
+		if rest == "" {
+			return m
+		}
+		if rest[0] == 'p' || rest[0] == 's' {
+			rest = rest[1:]
+		}
+		if rest != "" && strings.Trim(rest, "0123456789") == "" {
+			return m
 		}
 	}
-	return nil
+	return ""
 }
 
-func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []deviceconfig.RootFile) error {
+func (p *Pack) overwriteDevice(ctx context.Context, dev string, root *FileInfo, rootDeviceFiles []deviceconfig.RootFile) error {
 	if err := verifyNotMounted(dev); err != nil {
 		return err
 	}
@@ -834,11 +907,25 @@ func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []dev
 	}
 	defer f.Close()
 
+	devsize, err := deviceSize(f.Fd())
+	if err != nil {
+		return err
+	}
+
+	if p.Discard == DiscardAll {
+		if err := discardDevice(f, dev, p.discardRanges(devsize, writtenRange{}, writtenRange{})); err != nil {
+			return err
+		}
+	}
+
 	if _, err := f.Seek(p.FirstPartitionOffsetSectors*512, io.SeekStart); err != nil {
 		return err
 	}
 
-	if err := p.writeBoot(f, ""); err != nil {
+	bootRange, err := p.writeWithProgress(ctx, f, true, "boot file system to "+dev, p.BootPartitionBytes(), func(w io.Writer) error {
+		return p.writeBoot(ctx, w, "")
+	})
+	if err != nil {
 		return err
 	}
 
@@ -846,7 +933,7 @@ func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []dev
 		return err
 	}
 
-	if _, err := f.Seek((p.FirstPartitionOffsetSectors+(100*MB/512))*512, io.SeekStart); err != nil {
+	if _, err := f.Seek(int64(p.PartitionOffset(2)), io.SeekStart); err != nil {
 		return err
 	}
 
@@ -857,14 +944,22 @@ func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []dev
 	defer os.Remove(tmp.Name())
 	defer tmp.Close()
 
-	if err := writeRoot(tmp, root); err != nil {
+	if err := p.writeRoot(ctx, tmp, root); err != nil {
+		return err
+	}
+	rootSize, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
 		return err
 	}
 	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
 
-	if _, err := io.Copy(f, tmp); err != nil {
+	rootRange, err := p.writeWithProgress(ctx, f, true, "root file system to "+dev, uint64(rootSize), func(w io.Writer) error {
+		_, err := io.Copy(w, tmp)
+		return err
+	})
+	if err != nil {
 		return err
 	}
 
@@ -872,10 +967,29 @@ func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []dev
 		return err
 	}
 
+	if p.Discard == DiscardUnused {
+		if err := discardDevice(f, dev, p.discardRanges(devsize, bootRange, rootRange)); err != nil {
+			return err
+		}
+	}
+
+	if p.Verify {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		if err := verifyWritten(f, dev, []writtenRange{bootRange, rootRange}); err != nil {
+			return err
+		}
+	}
+
 	if err := f.Close(); err != nil {
 		return err
 	}
 
+	if created, err := p.createPerm(ctx, dev, devsize); err != nil || created {
+		return err
+	}
+
 	fmt.Printf("If your applications need to store persistent data, unplug and re-plug the SD card, then create a file system using e.g.:\n")
 	fmt.Printf("\n")
 	partition := partitionPath(dev, "4")
@@ -905,11 +1019,13 @@ func (ors *offsetReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	return ors.ReadSeeker.Seek(offset, whence)
 }
 
-func (p *Pack) overwriteFile(root *FileInfo, rootDeviceFiles []deviceconfig.RootFile, firstPartitionOffsetSectors int64) (bootSize int64, rootSize int64, err error) {
+func (p *Pack) overwriteFile(ctx context.Context, root *FileInfo, rootDeviceFiles []deviceconfig.RootFile, firstPartitionOffsetSectors int64) (bootSize int64, rootSize int64, err error) {
 	f, err := os.Create(p.Cfg.InternalCompatibilityFlags.Overwrite)
 	if err != nil {
 		return 0, 0, err
 	}
+	defer f.Close()
+	defer func() { removeOnAbort(ctx, p.Cfg.InternalCompatibilityFlags.Overwrite, err) }()
 
 	if err := f.Truncate(int64(p.Cfg.InternalCompatibilityFlags.TargetStorageBytes)); err != nil {
 		return 0, 0, err
@@ -922,8 +1038,12 @@ func (p *Pack) overwriteFile(root *FileInfo, rootDeviceFiles []deviceconfig.Root
 	if _, err := f.Seek(p.FirstPartitionOffsetSectors*512, io.SeekStart); err != nil {
 		return 0, 0, err
 	}
+	path := p.Cfg.InternalCompatibilityFlags.Overwrite
 	var bs countingWriter
-	if err := p.writeBoot(io.MultiWriter(f, &bs), ""); err != nil {
+	bootRange, err := p.writeWithProgress(ctx, f, false, "boot file system to "+path, p.BootPartitionBytes(), func(w io.Writer) error {
+		return p.writeBoot(ctx, io.MultiWriter(w, &bs), "")
+	})
+	if err != nil {
 		return 0, 0, err
 	}
 
@@ -931,7 +1051,7 @@ func (p *Pack) overwriteFile(root *FileInfo, rootDeviceFiles []deviceconfig.Root
 		return 0, 0, err
 	}
 
-	if _, err := f.Seek(p.FirstPartitionOffsetSectors*512+100*MB, io.SeekStart); err != nil {
+	if _, err := f.Seek(int64(p.PartitionOffset(2)), io.SeekStart); err != nil {
 		return 0, 0, err
 	}
 
@@ -942,7 +1062,11 @@ func (p *Pack) overwriteFile(root *FileInfo, rootDeviceFiles []deviceconfig.Root
 	defer os.Remove(tmp.Name())
 	defer tmp.Close()
 
-	if err := writeRoot(tmp, root); err != nil {
+	if err := p.writeRoot(ctx, tmp, root); err != nil {
+		return 0, 0, err
+	}
+	tmpSize, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
 		return 0, 0, err
 	}
 	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
@@ -950,7 +1074,11 @@ func (p *Pack) overwriteFile(root *FileInfo, rootDeviceFiles []deviceconfig.Root
 	}
 
 	var rs countingWriter
-	if _, err := io.Copy(io.MultiWriter(f, &rs), tmp); err != nil {
+	rootRange, err := p.writeWithProgress(ctx, f, false, "root file system to "+path, uint64(tmpSize), func(w io.Writer) error {
+		_, err := io.Copy(io.MultiWriter(w, &rs), tmp)
+		return err
+	})
+	if err != nil {
 		return 0, 0, err
 	}
 
@@ -958,11 +1086,24 @@ func (p *Pack) overwriteFile(root *FileInfo, rootDeviceFiles []deviceconfig.Root
 		return 0, 0, err
 	}
 
+	if p.Verify {
+		if err := verifyWritten(f, path, []writtenRange{bootRange, rootRange}); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return 0, 0, err
+	}
+	if created, err := p.createPerm(ctx, p.Cfg.InternalCompatibilityFlags.Overwrite, uint64(p.Cfg.InternalCompatibilityFlags.TargetStorageBytes)); err != nil || created {
+		return int64(bs), int64(rs), err
+	}
+
 	fmt.Printf("If your applications need to store persistent data, create a file system using e.g.:\n")
-	fmt.Printf("\t/sbin/mkfs.ext4 -F -E offset=%v %s %v\n", p.FirstPartitionOffsetSectors*512+1100*MB, p.Cfg.InternalCompatibilityFlags.Overwrite, packer.PermSizeInKB(firstPartitionOffsetSectors, uint64(p.Cfg.InternalCompatibilityFlags.TargetStorageBytes)))
+	fmt.Printf("\t/sbin/mkfs.ext4 -F -E offset=%v %s %v\n", p.PartitionOffset(4), p.Cfg.InternalCompatibilityFlags.Overwrite, p.PermSizeKB(uint64(p.Cfg.InternalCompatibilityFlags.TargetStorageBytes)))
 	fmt.Printf("\n")
 
-	return int64(bs), int64(rs), f.Close()
+	return int64(bs), int64(rs), nil
 }
 
 type OutputType string
@@ -985,6 +1126,230 @@ type Pack struct {
 	FileCfg *config.Struct
 	Cfg     *config.Struct
 	Output  *OutputStruct
+
+	// Ext holds the extension config fields (see package extconfig). If
+	// nil, they are read from the file Cfg was loaded from.
+	Ext *extconfig.Struct
+
+	// InstanceDir is the gokrazy instance directory, which contains the
+	// builddir/, the LockFile and the files referenced by relative paths in
+	// Cfg. If empty, the working directory is used (gok changes into the
+	// instance directory).
+	InstanceDir string
+
+	// InterpolationAllowlist lists the environment variables (e.g. WIFI_PSK)
+	// and files (e.g. file:/etc/secrets/) which may be referenced using ${…}
+	// in Cfg. Interpolation is disabled when the list is empty.
+	InterpolationAllowlist []string
+
+	// UploadConcurrency is the maximum number of parallel uploads (root file
+	// system, root device files) when updating over the network. Values
+	// smaller than 2 result in sequential uploads, as do updates over the
+	// serial console (see parallelUploads).
+	UploadConcurrency int
+
+	// Strict makes the build fail if per-package configuration does not take
+	// effect (see FindOrphans), e.g. flags of a renamed package.
+	Strict bool
+
+	// Locked makes the build fail if the build inputs (Go toolchain, module
+	// versions, extra files) differ from the LockFile.
+	Locked bool
+
+	// Offline makes the build fail (with an *OfflineError) instead of
+	// downloading modules or extra files, see Vendor.
+	Offline bool
+
+	// Env contains additional environment variables (KEY=VALUE) for all go
+	// commands, e.g. GOPROXY or GOFLAGS, which take precedence over the
+	// process environment.
+	Env []string
+
+	// HTTPClient, if non-nil, is used for all HTTP requests except for those
+	// to the device: extra file downloads, notifications, ACME and the remote
+	// cache. It defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	// MkfsPerm creates an ext4 file system on the perm partition when
+	// writing a full disk image or device (populated with the PermSeed
+	// files, which imply MkfsPerm).
+	MkfsPerm bool
+
+	// Verify re-reads the boot and root file systems after writing a full
+	// disk image or device and fails with a *VerifyError if the data differs
+	// from the written data, e.g. because of a broken SD card.
+	Verify bool
+
+	// Discard is one of DiscardOff (or empty), DiscardUnused or DiscardAll
+	// and controls which parts of a device are discarded (BLKDISCARD) when
+	// writing a full disk image to the device.
+	Discard string
+
+	// FromGaf, if non-empty, is the path to a prebuilt gaf file which Build
+	// deploys (or writes as a full disk image, for OutputTypeFull) instead of
+	// building the gokrazy instance.
+	FromGaf string
+
+	// RemoteBuilder, if non-empty, overrides the RemoteBuilder config field
+	// (see packer.ParseRemoteBuilder).
+	RemoteBuilder string
+
+	// Serial, if non-empty, is the serial port (e.g. /dev/ttyUSB0) connected
+	// to the console of the device to update, for updating devices without
+	// working network. SerialBaud defaults to 115200.
+	Serial     string
+	SerialBaud int
+
+	// RebootTimeout and PollInterval, if non-zero, override the RebootTimeout
+	// and PollInterval config fields.
+	RebootTimeout time.Duration
+	PollInterval  time.Duration
+
+	// NoReboot skips rebooting the device after updating (and waiting for
+	// the new version), like the NoReboot config field.
+	NoReboot bool
+
+	// ActivateAt, if non-zero, skips rebooting the device after updating
+	// like NoReboot, and records the update as PendingActivation, so that
+	// Activate (gok activate) reboots the device at ActivateAt, e.g. during
+	// a maintenance window.
+	ActivateAt time.Time
+
+	// NewHTTPPassword, if non-empty, is stored in the new root file system
+	// instead of Update.HTTPPassword (which is still used for uploading), and
+	// used for checking whether the device runs the new version. gok passwd
+	// uses it for rotating the password.
+	NewHTTPPassword string
+
+	// AddressFamily, if non-empty, overrides the UpdateAddressFamily config
+	// field (ipv4 or ipv6).
+	AddressFamily string
+
+	// GOARCH, if non-empty, overrides the target architecture of the Target
+	// config field and the GOARCH environment variable, e.g. for gok
+	// overwrite --archs.
+	GOARCH string
+
+	// WithLicenses makes GenerateSBOM detect the licenses of all Go modules
+	// the programs are built from (see SBOM.ModuleLicenses).
+	WithLicenses bool
+
+	// Provenance writes an in-toto/SLSA provenance document (see Statement)
+	// alongside gaf files and full disk image files. If ProvenanceKey is
+	// non-empty, it is the path to a PEM-encoded ed25519 private key with which
+	// the document is signed (as a DSSE envelope).
+	Provenance    bool
+	ProvenanceKey string
+
+	// Notify, if non-nil, configures update notifications for instances
+	// which do not configure the Notify config field (e.g. from the global
+	// gok configuration file).
+	Notify *extconfig.Notify
+
+	// HistoryDir, if non-empty, is the directory in which Build records
+	// every update and overwrite (successful or not) as a Deployment, see
+	// ReadHistory.
+	HistoryDir string
+
+	// Verbose prints the output of go build while building, in addition to
+	// storing it in BuildLogsDir.
+	Verbose bool
+
+	// NoBinaryCache builds all programs, instead of reusing programs whose
+	// inputs (module graph, sources of local modules, Go toolchain, build
+	// flags and target) did not change since they were last built.
+	NoBinaryCache bool
+
+	// RemoteCache, if non-empty, is the URL of a remote cache (see package
+	// remotecache) which backs the binary cache, so that machines building
+	// the same instance share programs.
+	RemoteCache string
+
+	// PrintSizes prints the size of each program (and how it changed compared
+	// to the previous build, see BuildMetadata) after building.
+	PrintSizes bool
+
+	// OnStage, if non-nil, is called whenever the build enters a new Stage.
+	OnStage func(Stage)
+
+	// OnEvent, if non-nil, is called for every build Event. OnEvent may be
+	// called concurrently from multiple goroutines.
+	OnEvent func(Event)
+
+	// target is the platform to build for, see resolveTarget.
+	target packer.Target
+
+	// update, insecure and tls are the --update, --insecure and --tls
+	// settings (see the updateflag and tlsflag packages) of this Pack, set
+	// by initUpdateFlags. They are not stored in the process-wide state of
+	// those packages, so that Packs can be used concurrently.
+	update   string
+	insecure bool
+	tls      string
+
+	// modCache, if non-empty, is the module cache of all go commands (see
+	// Vendor and Offline). modCacheRW keeps its files writable.
+	modCache   string
+	modCacheRW bool
+
+	// binDir, if non-empty, is the directory into which the Go programs are
+	// built (instead of a temporary directory). If reuseBins is set, the
+	// programs are not built at all, but taken from binDir. See BuildMatrix.
+	binDir    string
+	reuseBins bool
+
+	// bootFiles contains the largest files written to the boot file system,
+	// for reporting a SizeBudgetError.
+	bootFiles []SizeContributor
+
+	// buildMetadata describes the programs of the current build, for
+	// recording them in the provenance document.
+	buildMetadata *BuildMetadata
+
+	// sbom is the SBOM of the build (or gaf file) which Build deploys, for
+	// the deployment history.
+	sbom *SBOMWithHash
+
+	// notification is filled in while updating, see notifyUpdate.
+	notification Notification
+
+	// packageConfigFiles is a map from package path to packageConfigFile,
+	// for constructing output that is keyed per package.
+	packageConfigFiles map[string][]packageConfigFile
+
+	// clock and resolvePackageDir, if non-nil, replace time.Now and go list
+	// in writeBoot and writeRoot, so that they produce byte-for-byte
+	// reproducible file systems from in-memory inputs (see the golden tests).
+	clock             Clock
+	resolvePackageDir PackageDirResolver
+}
+
+// Stage identifies a phase of building (and possibly deploying) a gokrazy
+// instance.
+type Stage string
+
+const (
+	StageBuild    Stage = "build"    // building Go packages
+	StageAssemble Stage = "assemble" // assembling the root file system
+	StageWrite    Stage = "write"    // writing boot/root/mbr images
+	StageUpload   Stage = "upload"   // uploading images to the device
+	StageReboot   Stage = "reboot"   // rebooting the device
+	StageDone     Stage = "done"
+)
+
+func (pack *Pack) stage(s Stage) {
+	if pack.OnStage != nil {
+		pack.OnStage(s)
+	}
+	pack.event(Event{Type: EventStage, Stage: s})
+}
+
+// remoteBuilder returns the remote builder specification to use, if any.
+func (pack *Pack) remoteBuilder() string {
+	if pack.RemoteBuilder != "" {
+		return pack.RemoteBuilder
+	}
+	return pack.Ext.RemoteBuilder
 }
 
 func filterGoEnv(env []string) []string {
@@ -1000,47 +1365,207 @@ func filterGoEnv(env []string) []string {
 	return relevant
 }
 
-func (pack *Pack) logic(programName string) error {
+// resolveTarget sets pack.target from Pack.GOARCH, the Target config field and
+// the environment (see packer.TargetFromEnv), in that order of precedence.
+func (pack *Pack) resolveTarget() {
+	var cfg packer.Target
+	if t := pack.Ext.Target; t != nil {
+		cfg = packer.Target{
+			GOOS:   t.GOOS,
+			GOARCH: t.GOARCH,
+			GOARM:  t.GOARM,
+		}
+	}
+	if pack.GOARCH != "" {
+		cfg.GOARCH = pack.GOARCH
+	}
+	pack.target = packer.TargetFromEnv(cfg)
+	if cfg.GOOS != "" {
+		pack.target.GOOS = cfg.GOOS
+	}
+	if cfg.GOARCH != "" {
+		// GOARM from the environment refers to another architecture.
+		pack.target.GOARCH = cfg.GOARCH
+		pack.target.GOARM = cfg.GOARM
+	}
+}
+
+// buildOptions returns the BuildOptions config field for packer.BuildEnv.
+func (pack *Pack) buildOptions() *packer.BuildOptions {
+	o := pack.Ext.BuildOptions
+	if o == nil {
+		return nil
+	}
+	return &packer.BuildOptions{
+		Trimpath:   o.Trimpath,
+		StripDebug: o.StripDebug,
+		BuildMode:  o.BuildMode,
+	}
+}
+
+// BuildLogsDir is the directory within the instance directory in which the
+// go build output of each program is stored (see packer.BuildEnv.LogDir).
+const BuildLogsDir = "build-logs"
+
+// buildLogDir returns the absolute path of BuildLogsDir, after removing the
+// build logs of the previous build.
+func (pack *Pack) buildLogDir() (string, error) {
+	dir, err := pack.instanceAbs(BuildLogsDir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// checkBuildOptions verifies the BuildOptions config field.
+func checkBuildOptions(ext *extconfig.Struct) error {
+	if o := ext.BuildOptions; o != nil {
+		switch o.BuildMode {
+		case "", "exe", "pie":
+		default:
+			return fmt.Errorf("invalid BuildOptions.BuildMode %q: must be exe or pie", o.BuildMode)
+		}
+	}
+	return nil
+}
+
+// goEnv returns the environment for go commands that build for pack.target,
+// using the GoToolchain config field.
+func (pack *Pack) goEnv() []string {
+	return packer.GoEnv(pack.target, pack.Ext.GoToolchain, pack.goEnvOverrides()...)
+}
+
+// applyArchPackages overrides the kernel, firmware and EEPROM packages of
+// cfg with the ArchPackages of goarch, if any.
+func applyArchPackages(cfg *config.Struct, ext *extconfig.Struct, goarch string) {
+	ap, ok := ext.ArchPackages[goarch]
+	if !ok {
+		return
+	}
+	if ap.KernelPackage != nil {
+		cfg.KernelPackage = ap.KernelPackage
+	}
+	if ap.FirmwarePackage != nil {
+		cfg.FirmwarePackage = ap.FirmwarePackage
+	}
+	if ap.EEPROMPackage != nil {
+		cfg.EEPROMPackage = ap.EEPROMPackage
+	}
+}
+
+// device holds the partitioning and boot settings of a device type (see
+// deviceSettings).
+type device struct {
+	firstPartitionOffsetSectors int64
+	mbrOnlyWithoutGpt           bool
+	rootDeviceFiles             []deviceconfig.RootFile
+
+	// kernelGlobs and firmwareGlobs are the files of the kernel and
+	// firmware package to copy to the boot file system.
+	kernelGlobs   []string
+	firmwareGlobs []string
+
+	bootloader bootloader
+}
+
+func (pack *Pack) logic(ctx context.Context, programName string) error {
+	secretsDir := secret.Dir(pack.instancePath())
+	if _, err := os.Stat(secretsDir); err != nil {
+		secretsDir = "" // instance has no secrets
+	}
+	if err := interpolateConfig(pack.Cfg, pack.InterpolationAllowlist, secretsDir); err != nil {
+		return fmt.Errorf("interpolating config: %v", err)
+	}
 	cfg := pack.Cfg
-	updateflag.SetUpdate(cfg.InternalCompatibilityFlags.Update)
-	tlsflag.SetInsecure(cfg.InternalCompatibilityFlags.Insecure)
-	tlsflag.SetUseTLS(cfg.Update.UseTLS)
+	if pack.Ext == nil {
+		ext, err := extconfig.For(cfg)
+		if err != nil {
+			return err
+		}
+		pack.Ext = ext
+	}
+	if pack.Offline && pack.modCache == "" {
+		modCache, err := pack.offlineModCache()
+		if err != nil {
+			return err
+		}
+		pack.modCache = modCache
+	}
+	if err := checkGoToolchain(pack.Ext, pack.goEnvOverrides()); err != nil {
+		return err
+	}
+	if pack.Strict {
+		orphans, err := findOrphans(pack.instancePath(), cfg, pack.Ext)
+		if err != nil {
+			return err
+		}
+		if len(orphans) > 0 {
+			return &OrphanedConfigError{Orphans: orphans}
+		}
+	}
+	if err := checkRootCompression(pack.Ext); err != nil {
+		return err
+	}
+	if err := checkBootPartitionSize(pack.Ext); err != nil {
+		return err
+	}
+	if err := checkBuildOptions(pack.Ext); err != nil {
+		return err
+	}
+	if err := checkNetwork(cfg, pack.Ext); err != nil {
+		return err
+	}
+	if err := checkPermSeed(pack.Ext); err != nil {
+		return err
+	}
+	if err := checkEEPROM(pack.Ext); err != nil {
+		return err
+	}
+	mountWarnings, err := checkMountDevices(mountDevices(cfg, pack.Ext))
+	if err != nil {
+		return err
+	}
+	for _, w := range mountWarnings {
+		log.Printf("WARNING: %s", w)
+	}
+	pack.resolveTarget()
+	applyArchPackages(pack.Cfg, pack.Ext, pack.target.GOARCH)
+	if pack.Offline && pack.FromGaf == "" {
+		if err := pack.verifyOffline(ctx); err != nil {
+			return err
+		}
+	}
+	if err := pack.initUpdateFlags(ctx, cfg, true); err != nil {
+		return err
+	}
 
-	if !updateflag.NewInstallation() && cfg.InternalCompatibilityFlags.Overwrite != "" {
+	if !pack.newInstallation() && cfg.InternalCompatibilityFlags.Overwrite != "" {
 		return fmt.Errorf("both -update and -overwrite are specified; use either one, not both")
 	}
 
-	var mbrOnlyWithoutGpt bool
-	firstPartitionOffsetSectors := deviceconfig.DefaultBootPartitionStartLBA
-	var rootDeviceFiles []deviceconfig.RootFile
-	if cfg.DeviceType != "" {
-		if devcfg, ok := deviceconfig.GetDeviceConfigBySlug(cfg.DeviceType); ok {
-			rootDeviceFiles = devcfg.RootDeviceFiles
-			mbrOnlyWithoutGpt = devcfg.MBROnlyWithoutGPT
-			if devcfg.BootPartitionStartLBA != 0 {
-				firstPartitionOffsetSectors = devcfg.BootPartitionStartLBA
-			}
-		} else {
-			return fmt.Errorf("unknown device slug %q", cfg.DeviceType)
-		}
+	dev, err := deviceSettings(pack.instancePath(), cfg.DeviceType)
+	if err != nil {
+		return err
 	}
+	firstPartitionOffsetSectors := dev.firstPartitionOffsetSectors
+	rootDeviceFiles := dev.rootDeviceFiles
 
 	pack.Pack = packer.NewPackForHost(firstPartitionOffsetSectors, cfg.Hostname)
+	pack.Pack.BootPartitionMB = int64(pack.Ext.BootPartitionSizeMB)
 
-	newInstallation := updateflag.NewInstallation()
-	useGPT := newInstallation && !mbrOnlyWithoutGpt
+	newInstallation := pack.newInstallation()
+	useGPT := newInstallation && !dev.mbrOnlyWithoutGpt
 
 	pack.Pack.UsePartuuid = newInstallation
 	pack.Pack.UseGPTPartuuid = useGPT
 	pack.Pack.UseGPT = useGPT
 
-	if os.Getenv("GOKR_PACKER_FD") != "" { // partitioning child process
-		if _, err := pack.SudoPartition(cfg.InternalCompatibilityFlags.Overwrite); err != nil {
-			log.Fatal(err)
-		}
-		os.Exit(0)
-	}
-
 	fmt.Printf("%s %s on GOARCH=%s GOOS=%s\n\n",
 		programName,
 		version.ReadBrief(),
@@ -1052,7 +1577,7 @@ func (pack *Pack) logic(programName string) error {
 		fmt.Printf("Updating gokrazy installation on http://%s\n\n", cfg.Hostname)
 	}
 
-	fmt.Printf("Build target: %s\n", strings.Join(filterGoEnv(packer.Env()), " "))
+	fmt.Printf("Build target: %s\n", strings.Join(filterGoEnv(pack.goEnv()), " "))
 
 	buildTimestamp := time.Now().Format(time.RFC3339)
 	fmt.Printf("Build timestamp: %s\n", buildTimestamp)
@@ -1077,47 +1602,56 @@ func (pack *Pack) logic(programName string) error {
 		return err
 	}
 
-	bindir, err := os.MkdirTemp("", "gokrazy-bins-")
-	if err != nil {
-		return err
+	bindir := pack.binDir
+	if bindir == "" {
+		bindir, err = os.MkdirTemp("", "gokrazy-bins-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(bindir)
 	}
-	defer os.RemoveAll(bindir)
 
-	packageBuildFlags, err := findBuildFlagsFiles(cfg)
+	packageBuildFlags, err := pack.findBuildFlagsFiles(cfg)
 	if err != nil {
 		return err
 	}
 
-	packageBuildTags, err := findBuildTagsFiles(cfg)
+	packageBuildTags, err := pack.findBuildTagsFiles(cfg)
 	if err != nil {
 		return err
 	}
 
-	flagFileContents, err := findFlagFiles(cfg)
+	flagFileContents, err := pack.findFlagFiles(cfg)
 	if err != nil {
 		return err
 	}
 
-	envFileContents, err := findEnvFiles(cfg)
+	envFileContents, err := pack.findEnvFiles(cfg)
 	if err != nil {
 		return err
 	}
 
-	dontStart, err := findDontStart(cfg)
+	dontStart, err := pack.findDontStart(cfg)
 	if err != nil {
 		return err
 	}
 
-	waitForClock, err := findWaitForClock(cfg)
+	waitForClock, err := pack.findWaitForClock(cfg)
 	if err != nil {
 		return err
 	}
 
+	if pack.Locked {
+		if err := pack.verifyLock(); err != nil {
+			return err
+		}
+	}
+
 	args := cfg.Packages
 	fmt.Printf("Building %d Go packages:\n\n", len(args))
 	for _, pkg := range args {
 		fmt.Printf("  %s\n", pkg)
-		for _, configFile := range packageConfigFiles[pkg] {
+		for _, configFile := range pack.packageConfigFiles[pkg] {
 			fmt.Printf("    will %s\n",
 				configFile.kind)
 			fmt.Printf("      from %s\n",
@@ -1143,16 +1677,65 @@ func (pack *Pack) logic(programName string) error {
 	}
 	// Ensure all build processes use umask 022. Programs like ntp which do
 	// privilege separation need the o+x bit.
-	syscall.Umask(0022)
+	setUmask(0022)
+	pack.stage(StageBuild)
+	buildProgress := pack.newPhaseProgress(StageBuild, "packages", "building (go compiler)", uint64(len(pkgs)))
+	basenames := pack.Ext.Basenames()
+	cached := &cachedPackages{}
 	buildEnv := &packer.BuildEnv{
-		BuildDir: packer.BuildDirOrMigrate,
+		BuildDir:    pack.buildDirOrMigrate,
+		Basenames:   basenames,
+		Target:      &pack.target,
+		GoToolchain: pack.Ext.GoToolchain,
+		Env:         pack.goEnvOverrides(),
+		Options:     pack.buildOptions(),
+		Verbose:     pack.Verbose,
+		PackageStarted: func(importPath string) {
+			pack.event(Event{Type: EventPackageStarted, Package: importPath})
+		},
+		PackageBuilt: func(importPath string, err error) {
+			ev := Event{Type: EventPackageBuilt, Package: importPath, Cached: cached.has(importPath)}
+			if err != nil {
+				ev.Error = err.Error()
+			}
+			pack.event(ev)
+			buildProgress.add(1)
+		},
 	}
-	if err := buildEnv.Build(bindir, pkgs, packageBuildFlags, packageBuildTags, noBuildPkgs); err != nil {
-		return err
+	if remote := pack.remoteBuilder(); remote != "" {
+		rb, err := packer.ParseRemoteBuilder(remote)
+		if err != nil {
+			return err
+		}
+		log.Printf("building on remote builder %s", rb.Host)
+		buildEnv.Remote = rb
+	}
+	if pack.reuseBins {
+		fmt.Printf("Re-using the Go programs built in %s\n", bindir)
+		buildProgress.add(uint64(len(pkgs)))
+	} else {
+		buildEnv.LogDir, err = pack.buildLogDir()
+		if err != nil {
+			return err
+		}
+		pack.enableBinaryCache(buildEnv, cached)
+		if err := buildEnv.BuildContext(ctx, bindir, pkgs, packageBuildFlags, packageBuildTags, noBuildPkgs); err != nil {
+			return err
+		}
+		printCachedPackages(cached)
+	}
+
+	if pack.Locked {
+		// Building might have resolved missing modules (go get), so verify
+		// the lock once more.
+		if err := pack.verifyLock(); err != nil {
+			return err
+		}
 	}
 
 	fmt.Println()
 
+	pack.stage(StageAssemble)
 	if err := pack.validateTargetArchMatchesKernel(); err != nil {
 		return err
 	}
@@ -1162,9 +1745,30 @@ func (pack *Pack) logic(programName string) error {
 		return err
 	}
 
-	packageConfigFiles = make(map[string][]packageConfigFile)
+	if err := pack.recordBuildMetadata(root, buildTimestamp); err != nil {
+		return err
+	}
+
+	hooks := pack.Ext.Hooks
+	if hooks == nil {
+		hooks = &extconfig.Hooks{}
+	}
+	artifacts := &hookArtifacts{
+		instance:       cfg.Hostname,
+		buildTimestamp: buildTimestamp,
+		binDir:         bindir,
+	}
+	if err := pack.runInstanceHooks(ctx, "PostBuild", hooks.PostBuild, artifacts); err != nil {
+		return err
+	}
+
+	pack.packageConfigFiles = nil
+
+	if err := pack.runPrePackHooks(ctx); err != nil {
+		return err
+	}
 
-	extraFiles, err := FindExtraFiles(cfg)
+	extraFiles, err := pack.findExtraFiles(cfg)
 	if err != nil {
 		return err
 	}
@@ -1179,14 +1783,14 @@ func (pack *Pack) logic(programName string) error {
 		}
 	}
 
-	if len(packageConfigFiles) > 0 {
+	if len(pack.packageConfigFiles) > 0 {
 		fmt.Printf("Including extra files for Go packages:\n\n")
 		for _, pkg := range args {
-			if len(packageConfigFiles[pkg]) == 0 {
+			if len(pack.packageConfigFiles[pkg]) == 0 {
 				continue
 			}
 			fmt.Printf("  %s\n", pkg)
-			for _, configFile := range packageConfigFiles[pkg] {
+			for _, configFile := range pack.packageConfigFiles[pkg] {
 				fmt.Printf("    will %s\n",
 					configFile.kind)
 				fmt.Printf("      from %s\n",
@@ -1199,6 +1803,26 @@ func (pack *Pack) logic(programName string) error {
 		}
 	}
 
+	userDB, err := newUserDatabase(pack.Ext.Users, pack.Ext.Groups)
+	if err != nil {
+		return err
+	}
+	services, err := pack.serviceConfigs(userDB)
+	if err != nil {
+		return err
+	}
+	after, err := pack.serviceDependencies(pkgs)
+	if err != nil {
+		return err
+	}
+	if (len(services) > 0 || len(after) > 0) && cfg.InternalCompatibilityFlags.InitPkg != "" {
+		return fmt.Errorf("PackageConfig service settings (e.g. RunAsUser, After) cannot be used with a custom InitPkg (%s)", cfg.InternalCompatibilityFlags.InitPkg)
+	}
+
+	if pack.Ext.InitTemplatePath != "" && cfg.InternalCompatibilityFlags.InitPkg != "" {
+		return fmt.Errorf("InitTemplatePath cannot be used with a custom InitPkg (%s)", cfg.InternalCompatibilityFlags.InitPkg)
+	}
+
 	if cfg.InternalCompatibilityFlags.InitPkg == "" {
 		gokrazyInit := &gokrazyInit{
 			root:             root,
@@ -1207,6 +1831,15 @@ func (pack *Pack) logic(programName string) error {
 			buildTimestamp:   buildTimestamp,
 			dontStart:        dontStart,
 			waitForClock:     waitForClock,
+			basenames:        basenames,
+			services:         services,
+			after:            after,
+			env:              pack.goEnv(),
+			options:          pack.buildOptions(),
+			instanceDir:      pack.InstanceDir,
+		}
+		if path := pack.Ext.InitTemplatePath; path != "" {
+			gokrazyInit.templatePath = pack.instanceRel(path)
 		}
 		if cfg.InternalCompatibilityFlags.OverwriteInit != "" {
 			return gokrazyInit.dump(cfg.InternalCompatibilityFlags.OverwriteInit)
@@ -1220,41 +1853,26 @@ func (pack *Pack) logic(programName string) error {
 
 		initPath := filepath.Join(tmpdir, "init")
 
-		fileIsELFOrFatal(initPath)
+		if err := fileIsELF(initPath); err != nil {
+			return err
+		}
 
+		wrapped := gokrazyInit.wrapped()
 		gokrazy := root.mustFindDirent("gokrazy")
 		gokrazy.Dirents = append(gokrazy.Dirents, &FileInfo{
 			Filename: "init",
 			FromHost: initPath,
 		})
+		if err := wrapPrograms(root, wrapped); err != nil {
+			return err
+		}
 	}
 
-	defaultPassword, updateHostname := updateflag.GetUpdateTarget(cfg.Hostname)
-	update, err := cfg.Update.WithFallbackToHostSpecific(cfg.Hostname)
+	update, schema, err := pack.updateSettings(cfg)
 	if err != nil {
 		return err
 	}
 
-	if update.HTTPPort == "" {
-		update.HTTPPort = "80"
-	}
-
-	if update.HTTPSPort == "" {
-		update.HTTPSPort = "443"
-	}
-
-	if update.Hostname == "" {
-		update.Hostname = updateHostname
-	}
-
-	if update.HTTPPassword == "" && !update.NoPassword {
-		pw, err := ensurePasswordFileExists(updateHostname, defaultPassword)
-		if err != nil {
-			return err
-		}
-		update.HTTPPassword = pw
-	}
-
 	for _, dir := range []string{"bin", "dev", "etc", "proc", "sys", "tmp", "perm", "lib", "run", "mnt"} {
 		root.Dirents = append(root.Dirents, &FileInfo{
 			Filename: dir,
@@ -1282,7 +1900,7 @@ func (pack *Pack) logic(programName string) error {
 	}
 
 	// include lib/modules from kernelPackage dir, if present
-	kernelDir, err := packer.PackageDir(cfg.KernelPackageOrDefault())
+	kernelDir, err := pack.packageDir(cfg.KernelPackageOrDefault())
 	if err != nil {
 		return err
 	}
@@ -1296,6 +1914,11 @@ func (pack *Pack) logic(programName string) error {
 		if err != nil {
 			return err
 		}
+		if pack.Ext.KernelModulesAutoprune {
+			if err := pruneModules(modules, pack.Ext.KernelModulesInclude); err != nil {
+				return err
+			}
+		}
 		lib := root.mustFindDirent("lib")
 		lib.Dirents = append(lib.Dirents, modules)
 	}
@@ -1316,10 +1939,18 @@ func (pack *Pack) logic(programName string) error {
 			FromHost: hostLocaltime,
 		})
 	}
-	etc.Dirents = append(etc.Dirents, &FileInfo{
-		Filename:    "resolv.conf",
-		SymlinkDest: "/tmp/resolv.conf",
-	})
+	network, err := renderNetwork(pack.Ext.Network, newInterpolator(pack.InterpolationAllowlist, secretsDir))
+	if err != nil {
+		return err
+	}
+	if pack.Ext.Network == nil || len(pack.Ext.Network.DNS) == 0 {
+		// The DHCP client writes /tmp/resolv.conf.
+		etc.Dirents = append(etc.Dirents, &FileInfo{
+			Filename:    "resolv.conf",
+			SymlinkDest: "/tmp/resolv.conf",
+		})
+	}
+	etc.Dirents = append(etc.Dirents, network.etc...)
 	etc.Dirents = append(etc.Dirents, &FileInfo{
 		Filename: "hosts",
 		FromLiteral: `127.0.0.1 localhost
@@ -1330,6 +1961,16 @@ func (pack *Pack) logic(programName string) error {
 		Filename:    "hostname",
 		FromLiteral: cfg.Hostname,
 	})
+	if len(pack.Ext.Users) > 0 || len(pack.Ext.Groups) > 0 {
+		etc.Dirents = append(etc.Dirents, &FileInfo{
+			Filename:    "passwd",
+			FromLiteral: userDB.passwd(),
+		})
+		etc.Dirents = append(etc.Dirents, &FileInfo{
+			Filename:    "group",
+			FromLiteral: userDB.group(),
+		})
+	}
 
 	ssl := &FileInfo{Filename: "ssl"}
 	ssl.Dirents = append(ssl.Dirents, &FileInfo{
@@ -1337,36 +1978,7 @@ func (pack *Pack) logic(programName string) error {
 		FromLiteral: systemCertsPEM,
 	})
 
-	schema := "http"
-	if update.CertPEM == "" || update.KeyPEM == "" {
-		deployCertFile, deployKeyFile, err := getCertificate(cfg)
-		if err != nil {
-			return err
-		}
-
-		if deployCertFile != "" {
-			b, err := os.ReadFile(deployCertFile)
-			if err != nil {
-				return err
-			}
-			update.CertPEM = strings.TrimSpace(string(b))
-
-			b, err = os.ReadFile(deployKeyFile)
-			if err != nil {
-				return err
-			}
-			update.KeyPEM = strings.TrimSpace(string(b))
-		}
-	}
 	if update.CertPEM != "" && update.KeyPEM != "" {
-		// User requested TLS
-		if tlsflag.Insecure() {
-			// If -insecure is specified, use http instead of https to make the
-			// process of updating to non-empty -tls= a bit smoother.
-		} else {
-			schema = "https"
-		}
-
 		ssl.Dirents = append(ssl.Dirents, &FileInfo{
 			Filename:    "gokrazy-web.pem",
 			FromLiteral: update.CertPEM,
@@ -1383,7 +1995,7 @@ func (pack *Pack) logic(programName string) error {
 		etc.Dirents = append(etc.Dirents, &FileInfo{
 			Filename:    "gokr-pw.txt",
 			Mode:        0400,
-			FromLiteral: update.HTTPPassword,
+			FromLiteral: cmp.Or(pack.NewHTTPPassword, update.HTTPPassword),
 		})
 	}
 
@@ -1402,17 +2014,35 @@ func (pack *Pack) logic(programName string) error {
 	// as the SBOM should reflect what’s going into gokrazy,
 	// not its internal implementation details
 	// (i.e.  cfg.InternalCompatibilityFlags untouched).
-	sbom, _, err := GenerateSBOM(pack.FileCfg)
+	sbomPack := &Pack{FileCfg: pack.FileCfg, GOARCH: pack.GOARCH, InstanceDir: pack.InstanceDir, Env: pack.Env}
+	sbom, sbomWithHash, err := sbomPack.GenerateSBOM()
 	if err != nil {
 		return err
 	}
+	pack.event(Event{Type: EventSBOM, SBOMHash: sbomWithHash.SBOMHash})
+	pack.notification.NewSBOMHash = sbomWithHash.SBOMHash
+	pack.sbom = &sbomWithHash
+	if len(hooks.PostImage) > 0 || len(hooks.PostUpdate) > 0 {
+		f, err := os.CreateTemp("", "gokrazy-sbom-*.json")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.Write(sbom); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		artifacts.sbom = f.Name()
+	}
 
 	etcGokrazy := &FileInfo{Filename: "gokrazy"}
 	etcGokrazy.Dirents = append(etcGokrazy.Dirents, &FileInfo{
 		Filename:    "sbom.json",
 		FromLiteral: string(sbom),
 	})
-	mountdevices, err := json.Marshal(cfg.MountDevices)
+	mountdevices, err := json.Marshal(mountDevices(cfg, pack.Ext))
 	if err != nil {
 		return err
 	}
@@ -1420,18 +2050,23 @@ func (pack *Pack) logic(programName string) error {
 		Filename:    "mountdevices.json",
 		FromLiteral: string(mountdevices),
 	})
+	etcGokrazy.Dirents = append(etcGokrazy.Dirents, network.etcGokrazy...)
 	etc.Dirents = append(etc.Dirents, etcGokrazy)
 
 	empty := &FileInfo{Filename: ""}
 	if paths := getDuplication(root, empty); len(paths) > 0 {
-		return fmt.Errorf("root file system contains duplicate files: your config contains multiple packages that install %s", paths)
+		return &DuplicatePathsError{Source: "root file system", Paths: paths}
 	}
 
 	for pkg1, fs := range extraFiles {
 		for _, fs1 := range fs {
 			// check against root fs
 			if paths := getDuplication(root, fs1); len(paths) > 0 {
-				return fmt.Errorf("extra files of package %s collides with root file system: %v", pkg1, paths)
+				return &DuplicatePathsError{
+					Source: "extra files of package " + pkg1,
+					Other:  "root file system",
+					Paths:  paths,
+				}
 			}
 
 			// check against other packages
@@ -1442,11 +2077,23 @@ func (pack *Pack) logic(programName string) error {
 					}
 
 					if paths := getDuplication(fs1, fs2); len(paths) > 0 {
-						return fmt.Errorf("extra files of package %s collides with package %s: %v", pkg1, pkg2, paths)
+						return &DuplicatePathsError{
+							Source: "extra files of package " + pkg1,
+							Other:  "package " + pkg2,
+							Paths:  paths,
+						}
 					}
 				}
 			}
 
+			if svc := services[pkg1]; svc != nil && svc.User != "" {
+				// The program does not run as root, but all files are
+				// owned by root.
+				if err := makeReadable(fs1); err != nil {
+					return err
+				}
+			}
+
 			// add extra files to rootfs
 			if err := root.combine(fs1); err != nil {
 				return fmt.Errorf("failed to add extra files from package %s: %v", pkg1, err)
@@ -1455,52 +2102,26 @@ func (pack *Pack) logic(programName string) error {
 	}
 
 	var (
-		updateHttpClient         *http.Client
-		foundMatchingCertificate bool
-		updateBaseUrl            *url.URL
-		target                   *updater.Target
+		updateHttpClient *http.Client
+		updateBaseUrl    *url.URL
+		target           updateTarget
+		serialTarget     *serialupdate.Target
 	)
 
-	if !updateflag.NewInstallation() {
-		updateBaseUrl, err = updateflag.BaseURL(update.HTTPPort, update.HTTPSPort, schema, update.Hostname, update.HTTPPassword)
-		if err != nil {
-			return err
-		}
-
-		updateHttpClient, foundMatchingCertificate, err = httpclient.GetTLSHttpClientByTLSFlag(tlsflag.GetUseTLS(), tlsflag.GetInsecure(), updateBaseUrl)
-		if err != nil {
-			return fmt.Errorf("getting http client by tls flag: %v", err)
-		}
-		done := measure.Interactively("probing https")
-		remoteScheme, err := httpclient.GetRemoteScheme(updateBaseUrl)
-		done("")
-		if remoteScheme == "https" && !tlsflag.Insecure() {
-			updateBaseUrl.Scheme = "https"
-			updateflag.SetUpdate(updateBaseUrl.String())
-		}
-
-		if updateBaseUrl.Scheme != "https" && foundMatchingCertificate {
-			fmt.Printf("\n")
-			fmt.Printf("!!!WARNING!!! Possible SSL-Stripping detected!\n")
-			fmt.Printf("Found certificate for hostname in your client configuration but the host does not offer https!\n")
-			fmt.Printf("\n")
-			if !tlsflag.Insecure() {
-				log.Fatalf("update canceled: TLS certificate found, but negotiating a TLS connection with the target failed")
+	if !pack.newInstallation() {
+		if pack.Serial != "" {
+			var port *os.File
+			serialTarget, port, err = pack.connectSerialTarget()
+			if err != nil {
+				return err
+			}
+			defer port.Close()
+			target = serialTarget
+		} else {
+			updateBaseUrl, updateHttpClient, target, err = pack.connectTarget(update, schema)
+			if err != nil {
+				return err
 			}
-			fmt.Printf("Proceeding anyway as requested (--insecure).\n")
-		}
-
-		// Opt out of PARTUUID= for updating until we can check the remote
-		// userland version is new enough to understand how to set the active
-		// root partition when PARTUUID= is in use.
-		if err != nil {
-			return err
-		}
-		updateBaseUrl.Path = "/"
-
-		target, err = updater.NewTarget(updateBaseUrl.String(), updateHttpClient)
-		if err != nil {
-			return fmt.Errorf("checking target partuuid support: %v", err)
 		}
 		pack.UsePartuuid = target.Supports("partuuid")
 		pack.UseGPTPartuuid = target.Supports("gpt")
@@ -1513,6 +2134,7 @@ func (pack *Pack) logic(programName string) error {
 	fmt.Printf("  use PARTUUID: %v\n", pack.UsePartuuid)
 	fmt.Printf("  use GPT PARTUUID: %v\n", pack.UseGPTPartuuid)
 
+	pack.stage(StageWrite)
 	// Determine where to write the boot and root images to.
 	var (
 		isDev                    bool
@@ -1523,6 +2145,9 @@ func (pack *Pack) logic(programName string) error {
 	case cfg.InternalCompatibilityFlags.Overwrite != "" ||
 		(pack.Output != nil && pack.Output.Type == OutputTypeFull && pack.Output.Path != ""):
 
+		if err := checkDevice(cfg.InternalCompatibilityFlags.Overwrite); err != nil {
+			return err
+		}
 		st, err := os.Stat(cfg.InternalCompatibilityFlags.Overwrite)
 		if err != nil && !os.IsNotExist(err) {
 			return err
@@ -1531,13 +2156,13 @@ func (pack *Pack) logic(programName string) error {
 		isDev = err == nil && st.Mode()&os.ModeDevice == os.ModeDevice
 
 		if isDev {
-			if err := pack.overwriteDevice(cfg.InternalCompatibilityFlags.Overwrite, root, rootDeviceFiles); err != nil {
+			if err := pack.overwriteDevice(ctx, cfg.InternalCompatibilityFlags.Overwrite, root, rootDeviceFiles); err != nil {
 				return err
 			}
 			fmt.Printf("To boot gokrazy, plug the SD card into a supported device (see https://gokrazy.org/platforms/)\n")
 			fmt.Printf("\n")
 		} else {
-			lower := 1200*MB + int(firstPartitionOffsetSectors)
+			lower := int(pack.PartitionOffset(4)) + 100*MB
 
 			if cfg.InternalCompatibilityFlags.TargetStorageBytes == 0 {
 				return fmt.Errorf("--target_storage_bytes is required (e.g. --target_storage_bytes=%d) when using overwrite with a file", lower)
@@ -1549,7 +2174,7 @@ func (pack *Pack) logic(programName string) error {
 				return fmt.Errorf("--target_storage_bytes must be at least %d (for boot + 2 root file systems + 100 MB /perm)", lower)
 			}
 
-			bootSize, rootSize, err = pack.overwriteFile(root, rootDeviceFiles, firstPartitionOffsetSectors)
+			bootSize, rootSize, err = pack.overwriteFile(ctx, root, rootDeviceFiles, firstPartitionOffsetSectors)
 			if err != nil {
 				return err
 			}
@@ -1559,7 +2184,7 @@ func (pack *Pack) logic(programName string) error {
 		}
 
 	case pack.Output != nil && pack.Output.Type == OutputTypeGaf && pack.Output.Path != "":
-		if err := pack.overwriteGaf(root); err != nil {
+		if err := pack.overwriteGaf(ctx, root); err != nil {
 			return err
 		}
 
@@ -1574,13 +2199,13 @@ func (pack *Pack) logic(programName string) error {
 				defer os.Remove(tmpMBR.Name())
 				mbrfn = tmpMBR.Name()
 			}
-			if err := pack.writeBootFile(cfg.InternalCompatibilityFlags.OverwriteBoot, mbrfn); err != nil {
+			if err := pack.writeBootFile(ctx, cfg.InternalCompatibilityFlags.OverwriteBoot, mbrfn); err != nil {
 				return err
 			}
 		}
 
 		if cfg.InternalCompatibilityFlags.OverwriteRoot != "" {
-			if err := writeRootFile(cfg.InternalCompatibilityFlags.OverwriteRoot, root); err != nil {
+			if err := pack.writeRootFile(ctx, cfg.InternalCompatibilityFlags.OverwriteRoot, root); err != nil {
 				return err
 			}
 		}
@@ -1598,7 +2223,7 @@ func (pack *Pack) logic(programName string) error {
 			}
 			defer os.Remove(tmpBoot.Name())
 
-			if err := pack.writeBoot(tmpBoot, tmpMBR.Name()); err != nil {
+			if err := pack.writeBoot(ctx, tmpBoot, tmpMBR.Name()); err != nil {
 				return err
 			}
 
@@ -1608,12 +2233,80 @@ func (pack *Pack) logic(programName string) error {
 			}
 			defer os.Remove(tmpRoot.Name())
 
-			if err := writeRoot(tmpRoot, root); err != nil {
+			if err := pack.writeRoot(ctx, tmpRoot, root); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, path := range []string{
+		cfg.InternalCompatibilityFlags.Overwrite,
+		cfg.InternalCompatibilityFlags.OverwriteBoot,
+		cfg.InternalCompatibilityFlags.OverwriteRoot,
+		cfg.InternalCompatibilityFlags.OverwriteMBR,
+	} {
+		if path == "" {
+			continue
+		}
+		ev := Event{Type: EventImage, Path: path}
+		if st, err := os.Stat(path); err == nil && st.Mode().IsRegular() {
+			ev.Bytes = uint64(st.Size())
+		}
+		pack.event(ev)
+	}
+	if pack.Output != nil && pack.Output.Type == OutputTypeGaf && pack.Output.Path != "" {
+		ev := Event{Type: EventImage, Path: pack.Output.Path}
+		if st, err := os.Stat(pack.Output.Path); err == nil {
+			ev.Bytes = uint64(st.Size())
+		}
+		pack.event(ev)
+	}
+
+	if pack.Provenance {
+		in := provenanceInputs{
+			hostname:       cfg.Hostname,
+			target:         pack.target.String(),
+			sbom:           sbomWithHash,
+			metadata:       pack.buildMetadata,
+			buildTimestamp: buildTimestamp,
+		}
+		switch {
+		case pack.Output != nil && pack.Output.Type == OutputTypeGaf && pack.Output.Path != "":
+			in.outputType = OutputTypeGaf
+			if err := pack.writeProvenance(pack.Output.Path, in); err != nil {
+				return err
+			}
+		case cfg.InternalCompatibilityFlags.Overwrite != "" && !isDev:
+			in.outputType = OutputTypeFull
+			if err := pack.writeProvenance(cfg.InternalCompatibilityFlags.Overwrite, in); err != nil {
 				return err
 			}
 		}
 	}
 
+	artifacts.full = cfg.InternalCompatibilityFlags.Overwrite
+	artifacts.boot = cfg.InternalCompatibilityFlags.OverwriteBoot
+	artifacts.root = cfg.InternalCompatibilityFlags.OverwriteRoot
+	artifacts.mbr = cfg.InternalCompatibilityFlags.OverwriteMBR
+	if pack.Output != nil && pack.Output.Type == OutputTypeGaf {
+		artifacts.gaf = pack.Output.Path
+	}
+	for _, f := range []struct {
+		path *string
+		tmp  *os.File
+	}{
+		{&artifacts.boot, tmpBoot},
+		{&artifacts.root, tmpRoot},
+		{&artifacts.mbr, tmpMBR},
+	} {
+		if *f.path == "" && f.tmp != nil {
+			*f.path = f.tmp.Name()
+		}
+	}
+	if err := pack.runInstanceHooks(ctx, "PostImage", hooks.PostImage, artifacts); err != nil {
+		return err
+	}
+
 	fmt.Printf("\nBuild complete!\n")
 
 	hostPort := update.Hostname
@@ -1667,7 +2360,7 @@ func (pack *Pack) logic(programName string) error {
 		fmt.Printf("Did you maybe configure a DNS server other than your router?\n\n")
 	}
 
-	if updateflag.NewInstallation() {
+	if pack.newInstallation() {
 		return nil
 	}
 
@@ -1703,7 +2396,7 @@ func (pack *Pack) logic(programName string) error {
 			if err != nil {
 				return err
 			}
-			if _, err := rootFile.Seek(firstPartitionOffsetSectors*512+100*MB, io.SeekStart); err != nil {
+			if _, err := rootFile.Seek(int64(pack.PartitionOffset(2)), io.SeekStart); err != nil {
 				return err
 			}
 			rootReader = &io.LimitedReader{
@@ -1767,97 +2460,78 @@ func (pack *Pack) logic(programName string) error {
 		}
 	}
 
-	updateBaseUrl.Path = "/"
-	fmt.Printf("Updating %s\n", updateBaseUrl.String())
-
-	progctx, canc := context.WithCancel(context.Background())
-	defer canc()
-	prog := &progress.Reporter{}
-	go prog.Report(progctx)
-
-	// Start with the root file system because writing to the non-active
-	// partition cannot break the currently running system.
-	if err := updateWithProgress(prog, rootReader, target, "root file system", "root"); err != nil {
-		return err
+	uploads := []upload{
+		{
+			logStr: "root file system",
+			stream: "root",
+			reader: rootReader,
+		},
 	}
-
 	for _, rootDeviceFile := range rootDeviceFiles {
 		f, err := os.Open(filepath.Join(kernelDir, rootDeviceFile.Name))
 		if err != nil {
 			return err
 		}
+		defer f.Close()
+		uploads = append(uploads, upload{
+			logStr:   fmt.Sprintf("root device file %s", rootDeviceFile.Name),
+			stream:   filepath.Join("device-specific", rootDeviceFile.Name),
+			reader:   f,
+			optional: true,
+		})
+	}
 
-		if err := updateWithProgress(
-			prog, f, target, fmt.Sprintf("root device file %s", rootDeviceFile.Name),
-			filepath.Join("device-specific", rootDeviceFile.Name),
-		); err != nil {
-			if errors.Is(err, updater.ErrUpdateHandlerNotImplemented) {
-				log.Printf("target does not support updating device file %s yet, ignoring", rootDeviceFile.Name)
-				continue
-			}
+	if serialTarget != nil {
+		if err := pack.deploy(ctx, deployment{
+			name:     "serial console " + pack.Serial,
+			target:   serialTarget,
+			uploads:  uploads,
+			boot:     bootReader,
+			mbr:      mbrReader,
+			testboot: cfg.InternalCompatibilityFlags.Testboot,
+			updated: func(ctx context.Context) error {
+				return serialUpdated(serialTarget, buildTimestamp)
+			},
+		}); err != nil {
 			return err
 		}
-	}
-
-	if err := updateWithProgress(prog, bootReader, target, "boot file system", "boot"); err != nil {
+		return pack.runInstanceHooks(ctx, "PostUpdate", hooks.PostUpdate, artifacts)
+	}
+
+	deviceURL := *updateBaseUrl // copy
+	deviceURL.User = nil        // do not leak the password
+	pack.notification.Device = deviceURL.String()
+	if status, err := remoteStatus(ctx, updateHttpClient, updateBaseUrl.String()); err == nil {
+		pack.notification.OldSBOMHash = status.SBOMHash
+	}
+	if err := pack.deploy(ctx, deployment{
+		name:     updateBaseUrl.String(),
+		target:   target,
+		uploads:  uploads,
+		boot:     bootReader,
+		mbr:      mbrReader,
+		testboot: cfg.InternalCompatibilityFlags.Testboot,
+		pending: &PendingActivation{
+			Device:         deviceURL.String(),
+			BuildTimestamp: buildTimestamp,
+		},
+		updated: func(ctx context.Context) error {
+			pollUrl := *updateBaseUrl // copy
+			if pack.NewHTTPPassword != "" {
+				pollUrl.User = url.UserPassword("gokrazy", pack.NewHTTPPassword)
+			}
+			return pollUpdated1(ctx, updateHttpClient, pollUrl.String(), buildTimestamp)
+		},
+	}); err != nil {
 		return err
 	}
-
-	if err := target.StreamTo("mbr", mbrReader); err != nil {
-		if err == updater.ErrUpdateHandlerNotImplemented {
-			log.Printf("target does not support updating MBR yet, ignoring")
-		} else {
-			return fmt.Errorf("updating MBR: %v", err)
-		}
-	}
-
-	if cfg.InternalCompatibilityFlags.Testboot {
-		if err := target.Testboot(); err != nil {
-			return fmt.Errorf("enable testboot of non-active partition: %v", err)
-		}
-	} else {
-		if err := target.Switch(); err != nil {
-			return fmt.Errorf("switching to non-active partition: %v", err)
-		}
-	}
-
-	// Stop progress reporting to not mess up the following logs output.
-	canc()
-
-	fmt.Printf("Triggering reboot\n")
-	if err := target.Reboot(); err != nil {
-		if errors.Is(err, syscall.ECONNRESET) {
-			fmt.Printf("ignoring reboot error: %v\n", err)
-		} else {
-			return fmt.Errorf("reboot: %v", err)
-		}
-	}
-
-	const polltimeout = 5 * time.Minute
-	fmt.Printf("Updated, waiting %v for the device to become reachable (cancel with Ctrl-C any time)\n", polltimeout)
-
-	pollctx, canc := context.WithTimeout(context.Background(), polltimeout)
-	defer canc()
-	for {
-		if err := pollctx.Err(); err != nil {
-			return fmt.Errorf("device did not become healthy after update (%v)", err)
-		}
-		if err := pollUpdated1(pollctx, updateHttpClient, updateBaseUrl.String(), buildTimestamp); err != nil {
-			log.Printf("device not yet reachable: %v", err)
-			time.Sleep(1 * time.Second)
-			continue
-		}
-
-		fmt.Printf("Device ready to use!\n")
-		break
-	}
-
-	return nil
+	artifacts.deviceURL = deviceURL.String()
+	return pack.runInstanceHooks(ctx, "PostUpdate", hooks.PostUpdate, artifacts)
 }
 
 // kernelGoarch returns the GOARCH value that corresponds to the provided
-// vmlinuz header. It returns one of "arm", "arm64", "386", "amd64" or the empty
-// string if not detected.
+// vmlinuz header. It returns one of "arm", "arm64", "386", "amd64", "riscv64",
+// "mips", "mipsle", "mips64", "mips64le" or the empty string if not detected.
 func kernelGoarch(hdr []byte) string {
 	// Some constants from the file(1) command's magic.
 	const (
@@ -1871,10 +2545,26 @@ func kernelGoarch(hdr []byte) string {
 		x86Magic            = 0xaa55
 		x86MagicOffset      = 0x1fe
 		x86XloadflagsOffset = 0x236
+		// riscv64: https://docs.kernel.org/arch/riscv/boot-image-header.html
+		riscvMagic2       = 0x05435352 // "RSC\x05"
+		riscvMagic2Offset = 0x38
+		riscvMagic        = "RISCV\x00\x00\x00" // deprecated, but still set
+		riscvMagicOffset  = 0x30
 	)
 	if len(hdr) >= arm64MagicOffset+4 && binary.LittleEndian.Uint32(hdr[arm64MagicOffset:]) == arm64Magic {
 		return "arm64"
 	}
+	if len(hdr) >= riscvMagic2Offset+4 && binary.LittleEndian.Uint32(hdr[riscvMagic2Offset:]) == riscvMagic2 {
+		return "riscv64"
+	}
+	if len(hdr) >= riscvMagicOffset+len(riscvMagic) && string(hdr[riscvMagicOffset:riscvMagicOffset+len(riscvMagic)]) == riscvMagic {
+		return "riscv64"
+	}
+	if arch := elfKernelGoarch(hdr); arch != "" {
+		// MIPS kernels are typically booted as ELF files (vmlinux or
+		// vmlinuz), as opposed to the other architectures’ boot images.
+		return arch
+	}
 	if len(hdr) >= arm32MagicOffset+4 && binary.LittleEndian.Uint32(hdr[arm32MagicOffset:]) == arm32Magic {
 		return "arm"
 	}
@@ -1889,6 +2579,41 @@ func kernelGoarch(hdr []byte) string {
 	return ""
 }
 
+// elfKernelGoarch returns the GOARCH value that corresponds to the provided
+// ELF header, or the empty string if hdr is not an ELF header of a supported
+// architecture.
+func elfKernelGoarch(hdr []byte) string {
+	const (
+		eiClass     = 4
+		eiData      = 5
+		eMachineOff = 0x12
+	)
+	if len(hdr) < eMachineOff+2 || string(hdr[:4]) != elf.ELFMAG {
+		return ""
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	if elf.Data(hdr[eiData]) == elf.ELFDATA2MSB {
+		bo = binary.BigEndian
+	}
+	is64 := elf.Class(hdr[eiClass]) == elf.ELFCLASS64
+	switch elf.Machine(bo.Uint16(hdr[eMachineOff:])) {
+	case elf.EM_MIPS:
+		arch := "mips"
+		if is64 {
+			arch = "mips64"
+		}
+		if bo == binary.LittleEndian {
+			arch += "le"
+		}
+		return arch
+	case elf.EM_RISCV:
+		if is64 {
+			return "riscv64"
+		}
+	}
+	return ""
+}
+
 // validateTargetArchMatchesKernel validates that the packer.TargetArch
 // corresponds to the kernel's architecture.
 //
@@ -1898,7 +2623,7 @@ func kernelGoarch(hdr []byte) string {
 // architecture.
 func (pack *Pack) validateTargetArchMatchesKernel() error {
 	cfg := pack.Cfg
-	kernelDir, err := packer.PackageDir(cfg.KernelPackageOrDefault())
+	kernelDir, err := pack.packageDir(cfg.KernelPackageOrDefault())
 	if err != nil {
 		return err
 	}
@@ -1916,31 +2641,38 @@ func (pack *Pack) validateTargetArchMatchesKernel() error {
 	if kernelArch == "" {
 		return fmt.Errorf("kernel %v architecture in %s not detected", cfg.KernelPackageOrDefault(), kernelPath)
 	}
-	targetArch := packer.TargetArch()
+	targetArch := pack.target.GOARCH
 	if kernelArch != targetArch {
-		return fmt.Errorf("target architecture %q (GOARCH) doesn't match the %s kernel type %q",
-			targetArch,
-			cfg.KernelPackageOrDefault(),
-			kernelArch)
+		return &ArchMismatchError{
+			KernelPackage: cfg.KernelPackageOrDefault(),
+			KernelArch:    kernelArch,
+			TargetArch:    targetArch,
+		}
 	}
 	return nil
 }
 
-func updateWithProgress(prog *progress.Reporter, reader io.Reader, target *updater.Target, logStr string, stream string) error {
+func (pack *Pack) updateWithProgress(ctx context.Context, prog *progress.Reporter, reader io.Reader, target updateTarget, logStr string, stream string) error {
 	start := time.Now()
 	prog.SetStatus(fmt.Sprintf("update %s", logStr))
 	prog.SetTotal(0)
 
+	// The progress.Reporter displays interactive progress already, so the
+	// phaseProgress only produces events.
+	phase := pack.newPhaseProgress(StageUpload, "bytes", "", 0)
 	if stater, ok := reader.(interface{ Stat() (os.FileInfo, error) }); ok {
 		if st, err := stater.Stat(); err == nil {
 			prog.SetTotal(uint64(st.Size()))
+			phase.setTotal(uint64(st.Size()))
 		}
 	}
-	if err := target.StreamTo(stream, io.TeeReader(reader, &progress.Writer{})); err != nil {
+	r := &ctxReader{ctx: ctx, r: reader}
+	if err := target.StreamTo(stream, io.TeeReader(r, io.MultiWriter(&progress.Writer{}, phase))); err != nil {
 		return fmt.Errorf("updating %s: %w", logStr, err)
 	}
 	duration := time.Since(start)
 	transferred := progress.Reset()
+	pack.event(Event{Type: EventUpload, Stream: stream, Bytes: transferred, Total: transferred})
 	fmt.Printf("\rTransferred %s (%s) at %.2f MiB/s (total: %v)\n",
 		logStr,
 		humanize.Bytes(transferred),
@@ -1950,39 +2682,156 @@ func updateWithProgress(prog *progress.Reporter, reader io.Reader, target *updat
 	return nil
 }
 
+// upload is one stream to upload to the target device.
+type upload struct {
+	logStr string
+	stream string
+	reader io.Reader
+
+	// optional uploads are skipped if the target does not support them.
+	optional bool
+}
+
+// ctxReader reads from r until ctx is canceled, at which point it returns
+// ctx.Err(), aborting the HTTP upload which reads from it.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// readerSize returns the number of bytes r will return, if known.
+func readerSize(r io.Reader) (uint64, bool) {
+	switch r := r.(type) {
+	case *io.LimitedReader:
+		return uint64(r.N), true
+	case interface{ Stat() (os.FileInfo, error) }:
+		if st, err := r.Stat(); err == nil {
+			return uint64(st.Size()), true
+		}
+	}
+	return 0, false
+}
+
+// uploadParallel uploads all uploads over (at most pack.UploadConcurrency)
+// parallel HTTP connections.
+func (pack *Pack) uploadParallel(ctx context.Context, prog *progress.Reporter, target updateTarget, uploads []upload) error {
+	start := time.Now()
+	var total uint64
+	for _, u := range uploads {
+		if size, ok := readerSize(u.reader); ok {
+			total += size
+		}
+	}
+	prog.SetStatus(fmt.Sprintf("update (%d parallel uploads)", min(len(uploads), pack.UploadConcurrency)))
+	prog.SetTotal(total)
+	phase := pack.newPhaseProgress(StageUpload, "bytes", "", total)
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(pack.UploadConcurrency)
+	for _, u := range uploads {
+		eg.Go(func() error {
+			counter := new(countingWriter)
+			r := io.TeeReader(&ctxReader{ctx: ctx, r: u.reader}, io.MultiWriter(&progress.Writer{}, phase, counter))
+			if err := target.StreamTo(u.stream, r); err != nil {
+				if u.optional && errors.Is(err, updater.ErrUpdateHandlerNotImplemented) {
+					log.Printf("target does not support updating %s yet, ignoring", u.logStr)
+					return nil
+				}
+				return fmt.Errorf("updating %s: %w", u.logStr, err)
+			}
+			pack.event(Event{Type: EventUpload, Stream: u.stream, Bytes: uint64(*counter), Total: uint64(*counter)})
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	duration := time.Since(start)
+	transferred := progress.Reset()
+	fmt.Printf("\rTransferred %d files (%s) at %.2f MiB/s (total: %v)\n",
+		len(uploads),
+		humanize.Bytes(transferred),
+		float64(transferred)/duration.Seconds()/1024/1024,
+		duration.Round(time.Second))
+	return nil
+}
+
+// Main calls Build and exits the program when Build returns an error, printing
+// the remediation hint of the error (see Hint), if any. Programs that want to
+// handle errors themselves should call Build instead.
 func (pack *Pack) Main(programName string) {
-	if err := pack.logic(programName); err != nil {
+	if err := pack.Build(context.Background(), programName); err != nil {
+		if hint := Hint(err); hint != "" {
+			log.Fatalf("%v\nhint: %s", err, hint)
+		}
 		log.Fatal(err)
 	}
 }
 
+// Build builds the gokrazy instance described by pack.Cfg, writes the
+// configured output and, when updating, deploys the instance over the
+// network. Unlike Main, Build returns errors instead of exiting the program.
+//
+// If FromGaf is set, Build deploys the gaf file (or converts it into a full
+// disk image, see Output) instead of building.
+//
+// When ctx is canceled, Build stops running child processes (e.g. go build),
+// aborts writing images or uploads, removes its temporary files and returns
+// ctx.Err().
+func (pack *Pack) Build(ctx context.Context, programName string) error {
+	build := pack.logic
+	if pack.FromGaf != "" {
+		build = func(ctx context.Context, _ string) error { return pack.buildFromGaf(ctx) }
+	}
+	start := time.Now()
+	if err := build(ctx, programName); err != nil {
+		pack.event(Event{Type: EventResult, Error: err.Error()})
+		pack.notifyUpdate(start, err)
+		pack.recordHistory(start, err)
+		return err
+	}
+	pack.notifyUpdate(start, nil)
+	pack.recordHistory(start, nil)
+	pack.stage(StageDone)
+	pack.event(Event{Type: EventResult})
+	return nil
+}
+
 func PerPackageConfigForMigration(cfg *config.Struct) (map[string]config.PackageConfig, error) {
-	packageBuildFlags, err := findBuildFlagsFiles(cfg)
+	pack := &Pack{}
+	packageBuildFlags, err := pack.findBuildFlagsFiles(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	packageBuildTags, err := findBuildTagsFiles(cfg)
+	packageBuildTags, err := pack.findBuildTagsFiles(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	flagFileContents, err := findFlagFiles(cfg)
+	flagFileContents, err := pack.findFlagFiles(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	envFileContents, err := findEnvFiles(cfg)
+	envFileContents, err := pack.findEnvFiles(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	dontStart, err := findDontStart(cfg)
+	dontStart, err := pack.findDontStart(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	waitForClock, err := findWaitForClock(cfg)
+	waitForClock, err := pack.findWaitForClock(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -1,12 +1,28 @@
 package packer
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestKernelGoarch(t *testing.T) {
-	for _, arch := range []string{"386", "arm", "arm64", "amd64"} {
+	for _, arch := range []string{"386", "arm", "arm64", "amd64", "riscv64", "mips", "mipsle"} {
 		t.Run(arch, func(t *testing.T) {
 			k, err := os.ReadFile("testdata/kernel." + arch)
 			if err != nil {
@@ -19,3 +35,466 @@ func TestKernelGoarch(t *testing.T) {
 		})
 	}
 }
+
+func TestGoToolchainRe(t *testing.T) {
+	for _, tt := range []struct {
+		toolchain string
+		want      bool
+	}{
+		{"go1.22.4", true},
+		{"go1.22", true},
+		{"go1.23rc1", true},
+		{"go1.21beta2", true},
+		{"local", false},
+		{"auto", false},
+		{"go1.22.4+auto", false},
+		{"1.22.4", false},
+	} {
+		if got := goToolchainRe.MatchString(tt.toolchain); got != tt.want {
+			t.Errorf("goToolchainRe.MatchString(%q) = %v; want %v", tt.toolchain, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHookOutput(t *testing.T) {
+	for _, output := range []string{"_gokrazy/extrafiles", "web/dist/index.html"} {
+		if err := checkHookOutput(output); err != nil {
+			t.Errorf("checkHookOutput(%q) = %v; want nil", output, err)
+		}
+	}
+	for _, output := range []string{"", "/etc/passwd", "../other", "web/../../other"} {
+		if err := checkHookOutput(output); err == nil {
+			t.Errorf("checkHookOutput(%q) succeeded unexpectedly", output)
+		}
+	}
+}
+
+func TestPollChanged(t *testing.T) {
+	var buildTimestamp atomic.Value
+	buildTimestamp.Store("2024-01-01T00:00:00Z")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"BuildTimestamp": %q}`, buildTimestamp.Load())
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	old, err := remoteBuildTimestamp(ctx, srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pollChanged(ctx, srv.Client(), srv.URL, old); err == nil {
+		t.Errorf("pollChanged succeeded before the update")
+	}
+	buildTimestamp.Store("2024-02-01T00:00:00Z")
+	if err := pollChanged(ctx, srv.Client(), srv.URL, old); err != nil {
+		t.Errorf("pollChanged after the update: %v", err)
+	}
+	if err := pollUpdated1(ctx, srv.Client(), srv.URL, "2024-02-01T00:00:00Z"); err != nil {
+		t.Errorf("pollUpdated1: %v", err)
+	}
+}
+
+func TestErrorHints(t *testing.T) {
+	var err error = &DuplicatePathsError{Source: "root file system", Paths: []string{"/user/foo"}}
+	err = fmt.Errorf("building: %w", err)
+	if !errors.Is(err, ErrDuplicatePaths) {
+		t.Errorf("errors.Is(%v, ErrDuplicatePaths) = false, want true", err)
+	}
+	var dup *DuplicatePathsError
+	if !errors.As(err, &dup) || len(dup.Paths) != 1 {
+		t.Errorf("errors.As(%v) did not return the duplicate paths", err)
+	}
+	if Hint(err) == "" {
+		t.Errorf("Hint(%v) unexpectedly empty", err)
+	}
+	if got := Hint(fmt.Errorf("plain error")); got != "" {
+		t.Errorf("Hint(plain error) = %q, want empty", got)
+	}
+}
+
+func TestRebootSettings(t *testing.T) {
+	for _, tt := range []struct {
+		desc         string
+		pack         *Pack
+		wantTimeout  time.Duration
+		wantInterval time.Duration
+	}{
+		{
+			desc:         "defaults",
+			pack:         &Pack{},
+			wantTimeout:  defaultRebootTimeout,
+			wantInterval: defaultPollInterval,
+		},
+		{
+			desc:         "config",
+			pack:         &Pack{Ext: &extconfig.Struct{RebootTimeout: "10m", PollInterval: "5s"}},
+			wantTimeout:  10 * time.Minute,
+			wantInterval: 5 * time.Second,
+		},
+		{
+			desc: "flags override config",
+			pack: &Pack{
+				Ext:           &extconfig.Struct{RebootTimeout: "10m", PollInterval: "5s"},
+				RebootTimeout: 30 * time.Second,
+			},
+			wantTimeout:  30 * time.Second,
+			wantInterval: 5 * time.Second,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			timeout, interval, err := tt.pack.rebootSettings()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if timeout != tt.wantTimeout || interval != tt.wantInterval {
+				t.Errorf("rebootSettings() = %v, %v, want %v, %v", timeout, interval, tt.wantTimeout, tt.wantInterval)
+			}
+		})
+	}
+
+	if _, _, err := (&Pack{Ext: &extconfig.Struct{PollInterval: "soon"}}).rebootSettings(); err == nil {
+		t.Errorf("rebootSettings() with invalid PollInterval succeeded unexpectedly")
+	}
+}
+
+func TestUpdateBaseURL(t *testing.T) {
+	for _, tt := range []struct {
+		updateFlag string
+		hostname   string
+		schema     string
+		want       string
+	}{
+		{"yes", "scanner", "http", "http://gokrazy:pw@scanner/"},
+		{"yes", "scanner", "https", "https://gokrazy:pw@scanner:8443/"},
+		{":8080", "scanner", "http", "http://gokrazy:pw@scanner:8080/"},
+		{"yes", "10.0.0.76", "http", "http://gokrazy:pw@10.0.0.76/"},
+		{"yes", "2001:db8::1", "http", "http://gokrazy:pw@[2001:db8::1]/"},
+		{"yes", "[2001:db8::1]", "https", "https://gokrazy:pw@[2001:db8::1]:8443/"},
+		{"yes", "fe80::1%eth0", "http", "http://gokrazy:pw@[fe80::1%25eth0]/"},
+		{":8080", "fe80::1%25eth0", "http", "http://gokrazy:pw@[fe80::1%25eth0]:8080/"},
+		{"http://gokrazy:other@[fe80::2%25wlan0]/", "scanner", "http", "http://gokrazy:other@[fe80::2%25wlan0]/"},
+	} {
+		update := &config.UpdateStruct{
+			Hostname:     tt.hostname,
+			HTTPPort:     "80",
+			HTTPSPort:    "8443",
+			HTTPPassword: "pw",
+		}
+		u, err := updateBaseURL(tt.updateFlag, update, tt.schema)
+		if err != nil {
+			t.Errorf("updateBaseURL(%q, %q, %q): %v", tt.updateFlag, tt.hostname, tt.schema, err)
+			continue
+		}
+		if got := u.String(); got != tt.want {
+			t.Errorf("updateBaseURL(%q, %q, %q) = %q, want %q", tt.updateFlag, tt.hostname, tt.schema, got, tt.want)
+		}
+	}
+
+	if u, err := updateBaseURL("yes", &config.UpdateStruct{Hostname: "fe80::1%eth0", HTTPPort: "80"}, "http"); err != nil {
+		t.Fatal(err)
+	} else if got, want := u.Hostname(), "fe80::1%eth0"; got != want {
+		t.Errorf("Hostname() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildMetadata(t *testing.T) {
+	dir := t.TempDir()
+	scan2drive := filepath.Join(dir, "scan2drive")
+	if err := os.WriteFile(scan2drive, make([]byte, 4096), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Programs built from a GOPATH or with -trimpath may have no main module.
+	noMain := filepath.Join(dir, "nomain")
+	if err := os.WriteFile(noMain, make([]byte, 512), 0755); err != nil {
+		t.Fatal(err)
+	}
+	buildInfos := map[string]*debug.BuildInfo{
+		scan2drive: {
+			GoVersion: "go1.22.6",
+			Path:      "github.com/stapelberg/scan2drive/cmd/scan2drive",
+			Main:      debug.Module{Path: "github.com/stapelberg/scan2drive", Version: "v0.0.0-20240101000000-abcdef012345"},
+			Deps: []*debug.Module{
+				{Path: "github.com/google/renameio/v2", Version: "v2.0.0"},
+				{Path: "golang.org/x/oauth2", Version: "v0.20.0", Replace: &debug.Module{Path: "example.com/oauth2", Version: "v0.20.1"}},
+			},
+		},
+		noMain: {
+			GoVersion: "go1.22.6",
+			Path:      "nomain",
+		},
+	}
+	readBuildInfo := func(path string) (*debug.BuildInfo, error) {
+		if bi, ok := buildInfos[path]; ok {
+			return bi, nil
+		}
+		return nil, fmt.Errorf("%s: no build info", path)
+	}
+	root := &FileInfo{Dirents: []*FileInfo{
+		{Filename: "user", Dirents: []*FileInfo{
+			{Filename: "scan2drive", FromHost: scan2drive},
+			{Filename: "nomain", FromHost: noMain},
+		}},
+	}}
+	md, err := collectBuildMetadata(root, "2024-01-01T00:00:00Z", readBuildInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BinaryMetadata{
+		{
+			Path:       "/user/nomain",
+			ImportPath: "nomain",
+			GoVersion:  "go1.22.6",
+			Size:       512,
+			Modules:    map[string]string{},
+		},
+		{
+			Path:       "/user/scan2drive",
+			ImportPath: "github.com/stapelberg/scan2drive/cmd/scan2drive",
+			GoVersion:  "go1.22.6",
+			Size:       4096,
+			Modules: map[string]string{
+				"github.com/stapelberg/scan2drive": "v0.0.0-20240101000000-abcdef012345",
+				"github.com/google/renameio/v2":    "v2.0.0",
+				"example.com/oauth2":               "v0.20.1",
+			},
+		},
+	}
+	if diff := cmp.Diff(want, md.Binaries); diff != "" {
+		t.Errorf("collectBuildMetadata: unexpected binaries: diff (-want +got):\n%s", diff)
+	}
+
+	prev := &BuildMetadata{Binaries: []BinaryMetadata{
+		{Path: "/user/scan2drive", Size: 4096 - 1024, Modules: map[string]string{
+			"github.com/google/renameio/v2": "v2.0.0-old",
+			"example.com/removed":           "v1.0.0",
+		}},
+	}}
+	var buf strings.Builder
+	md.printSizes(&buf, prev)
+	for _, want := range []string{
+		"/user/scan2drive",
+		"+1024 B",
+		"-example.com/removed v1.0.0",
+		"github.com/google/renameio/v2 v2.0.0-old → v2.0.0",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("printSizes output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "+ \n") {
+		t.Errorf("printSizes output contains an empty module line:\n%s", buf.String())
+	}
+}
+
+func TestSizeBudget(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	bw, err := newBudgetWriter(f, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bw.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	// Seeking is relative to where the file system started.
+	if _, err := bw.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bw.Write(make([]byte, 1024)); err != nil {
+		t.Fatalf("writing within budget: %v", err)
+	}
+	if !bw.nearlyExceeded() {
+		t.Errorf("nearlyExceeded() = false after writing the entire budget")
+	}
+	_, err = bw.Write([]byte{0})
+	contributors := []SizeContributor{
+		{Path: "/user/small", Size: 100},
+		{Path: "/user/large", Size: 2000},
+	}
+	err = bw.checkErr(err, "root", contributors)
+	if !errors.Is(err, ErrSizeBudget) {
+		t.Fatalf("writing beyond budget: got %v, want ErrSizeBudget", err)
+	}
+	var sbe *SizeBudgetError
+	if !errors.As(err, &sbe) {
+		t.Fatalf("got %T, want *SizeBudgetError", err)
+	}
+	if got, want := sbe.InputSize, int64(2100); got != want {
+		t.Errorf("InputSize = %d, want %d", got, want)
+	}
+	if got, want := sbe.Largest[0].Path, "/user/large"; got != want {
+		t.Errorf("largest contributor = %q, want %q", got, want)
+	}
+
+	if got, want := sizeBudget(0, rootPartitionBytes), int64(rootPartitionBytes); got != want {
+		t.Errorf("sizeBudget(0) = %d, want %d", got, want)
+	}
+	if got, want := sizeBudget(1000, rootPartitionBytes), int64(rootPartitionBytes); got != want {
+		t.Errorf("sizeBudget(1000) = %d, want %d (partition size)", got, want)
+	}
+}
+
+func TestCheckRootCompression(t *testing.T) {
+	for _, tt := range []struct {
+		compression string
+		blockSizeKB int
+		wantErr     string
+	}{
+		{"", 0, ""},
+		{"gzip", 128, ""},
+		{"zstd", 0, `the only supported value is "gzip"`},
+		{"lzo", 0, `the only supported value is "gzip"`},
+		{"none", 0, `the only supported value is "gzip"`},
+		{"gzip", 100, "the only supported value is 128"},
+		{"gzip", 256, "the only supported value is 128"},
+	} {
+		ext := &extconfig.Struct{
+			RootCompression: tt.compression,
+			RootBlockSizeKB: tt.blockSizeKB,
+		}
+		err := checkRootCompression(ext)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("checkRootCompression(%q, %d) = %v, want nil", tt.compression, tt.blockSizeKB, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("checkRootCompression(%q, %d) = %v, want error containing %q", tt.compression, tt.blockSizeKB, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckBootPartitionSize(t *testing.T) {
+	for _, tt := range []struct {
+		sizeMB  int
+		wantErr bool
+	}{
+		{0, false},
+		{100, false},
+		{128, false},
+		{64, true},
+		{129, true},
+		{1024, true},
+	} {
+		ext := &extconfig.Struct{BootPartitionSizeMB: tt.sizeMB}
+		err := checkBootPartitionSize(ext)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("checkBootPartitionSize(%d) = %v, want error: %v", tt.sizeMB, err, tt.wantErr)
+		}
+	}
+
+	var p Pack
+	p.BootPartitionMB = 128
+	if got, want := p.bootSizeBudget(), int64(128*MB); got != want {
+		t.Errorf("bootSizeBudget() with BootPartitionMB 128 = %d, want %d", got, want)
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	t.Setenv("GOOS", "")
+	t.Setenv("GOARCH", "arm")
+	t.Setenv("GOARM", "6")
+	for _, tt := range []struct {
+		name   string
+		target *extconfig.Target
+		goarch string
+		// want are the GOOS, GOARCH and GOARM values of the go command
+		// environment ("" for unset).
+		want [3]string
+	}{
+		{name: "environment", want: [3]string{"linux", "arm", "6"}},
+		{name: "config", target: &extconfig.Target{GOARCH: "amd64"}, want: [3]string{"linux", "amd64", ""}},
+		{name: "config without GOARM", target: &extconfig.Target{GOARCH: "arm"}, want: [3]string{"linux", "arm", ""}},
+		{name: "config GOARM", target: &extconfig.Target{GOARCH: "arm", GOARM: "7"}, want: [3]string{"linux", "arm", "7"}},
+		{name: "archs", target: &extconfig.Target{GOARCH: "amd64"}, goarch: "arm64", want: [3]string{"linux", "arm64", ""}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pack := &Pack{Ext: &extconfig.Struct{Target: tt.target}, GOARCH: tt.goarch}
+			pack.resolveTarget()
+			env := pack.goEnv()
+			var got [3]string
+			for i, key := range []string{"GOOS", "GOARCH", "GOARM"} {
+				got[i], _ = lookupGoEnv(env, key)
+			}
+			if got != tt.want {
+				t.Errorf("goEnv() GOOS, GOARCH, GOARM = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloneConfig(t *testing.T) {
+	cfg := &config.Struct{
+		Hostname:   "scanner",
+		DeviceType: "raspberrypi5",
+		PackageConfig: map[string]config.PackageConfig{
+			"github.com/stapelberg/scan2drive/cmd/scan2drive": {
+				CommandLineFlags: []string{"-port=80"},
+			},
+		},
+	}
+	cfg.Meta.Path = "/home/michael/gokrazy/scanner/config.json"
+	clone, err := CloneConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone.DeviceType = "odroidhc1"
+	clone.PackageConfig["github.com/stapelberg/scan2drive/cmd/scan2drive"].CommandLineFlags[0] = "-port=8080"
+	if got, want := cfg.DeviceType, "raspberrypi5"; got != want {
+		t.Errorf("DeviceType = %q after modifying the clone, want %q", got, want)
+	}
+	if got, want := cfg.PackageConfig["github.com/stapelberg/scan2drive/cmd/scan2drive"].CommandLineFlags[0], "-port=80"; got != want {
+		t.Errorf("CommandLineFlags[0] = %q after modifying the clone, want %q", got, want)
+	}
+	if got, want := clone.Meta.Path, cfg.Meta.Path; got != want {
+		t.Errorf("clone.Meta.Path = %q, want %q", got, want)
+	}
+}
+
+func TestGoEnvOverrides(t *testing.T) {
+	t.Setenv("GOFLAGS", "-mod=mod")
+	t.Setenv("GOPROXY", "https://proxy.example")
+	pack := &Pack{
+		Env:        []string{"GOFLAGS=-trimpath"},
+		Offline:    true,
+		modCache:   "/tmp/modcache",
+		modCacheRW: true,
+	}
+	want := []string{
+		"GOFLAGS=-trimpath",
+		"GOPROXY=off",
+		"GOSUMDB=off",
+		"GOMODCACHE=/tmp/modcache",
+		"GOFLAGS=-trimpath -modcacherw",
+	}
+	got := pack.goEnvOverrides()
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("goEnvOverrides() = %q, want %q", got, want)
+	}
+	// The process environment is left alone.
+	if got, want := os.Getenv("GOPROXY"), "https://proxy.example"; got != want {
+		t.Errorf("GOPROXY = %q, want %q", got, want)
+	}
+
+	// Without Env, GOFLAGS extends the process environment.
+	pack = &Pack{modCacheRW: true}
+	if got, _ := lookupGoEnv(pack.goEnvOverrides(), "GOFLAGS"); got != "-mod=mod -modcacherw" {
+		t.Errorf("GOFLAGS = %q, want %q", got, "-mod=mod -modcacherw")
+	}
+
+	// PrePackHooks use the module cache, too.
+	pack = &Pack{Ext: &extconfig.Struct{}, Offline: true, modCache: "/tmp/modcache"}
+	env := hookEnviron("example.com/hook", pack.goEnv())
+	for _, kv := range []string{"GOPROXY=off", "GOMODCACHE=/tmp/modcache"} {
+		if !slices.Contains(env, kv) {
+			t.Errorf("hookEnviron() = %q, want it to contain %q", env, kv)
+		}
+	}
+}
@@ -1,16 +1,33 @@
 package packer
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"os"
-	"os/exec"
-	"strconv"
 	"syscall"
+
+	"github.com/gokrazy/tools/internal/elevate"
+	"github.com/gokrazy/tools/packer"
 )
 
-func (p *Pack) partitionDevice(o *os.File, path string) error {
+func init() {
+	// reread-partitions makes the kernel re-read the partition table of the
+	// device args[0], which requires CAP_SYS_ADMIN.
+	elevate.Register("reread-partitions", func(args []string) (*os.File, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("reread-partitions: expected exactly one device")
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return nil, (&packer.Pack{}).RereadPartitions(f)
+	})
+}
+
+func (p *Pack) partitionDevice(o *os.File, path string, elevated bool) error {
 	devsize, err := deviceSize(uintptr(o.Fd()))
 	if err != nil {
 		return err
@@ -24,114 +41,25 @@ func (p *Pack) partitionDevice(o *os.File, path string) error {
 		return err
 	}
 
-	return p.RereadPartitions(o)
-}
-
-func mustUnixConn(fd uintptr) *net.UnixConn {
-	fc, err := net.FileConn(os.NewFile(fd, ""))
-	if err != nil {
-		panic(err)
-	}
-	return fc.(*net.UnixConn)
-}
-
-func (p *Pack) SudoPartition(path string) (*os.File, error) {
-	if fd, err := strconv.Atoi(os.Getenv("GOKR_PACKER_FD")); err == nil {
-		// child process
-		conn := mustUnixConn(uintptr(fd))
-		f, err := os.Create(path)
-		if err != nil {
-			return nil, err
-		}
-		if err := p.partitionDevice(f, path); err != nil {
-			return nil, err
+	if elevated {
+		if err := o.Sync(); err != nil {
+			return err
 		}
-		_, _, err = conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), nil)
-		return nil, err
-	}
-
-	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
-	if err != nil {
-		return nil, err
-	}
-	syscall.CloseOnExec(pair[0]) // used in the parent process
-
-	// Use absolute path because $PATH might not be the same when using sudo:
-	if exe, err := os.Executable(); err == nil {
-		os.Args[0] = exe
-	}
-
-	cmd := exec.Command("sudo", append([]string{"--preserve-env"}, os.Args...)...)
-	// We cannot use cmd.ExtraFiles with sudo, as sudo closes all file
-	// descriptors but stdin, stdout and stderr.
-	cmd.Env = []string{
-		"GOKR_PACKER_FD=1",
-		fmt.Sprintf("HOME=%s", os.Getenv("HOME")), // for instance config detection
-	}
-	cmd.Stdout = os.NewFile(uintptr(pair[1]), "")
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
-
-	go func() {
-		err := cmd.Wait()
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
-
-	// receive file descriptor
-	conn := mustUnixConn(uintptr(pair[0]))
-	// 32 bytes as per
-	// https://github.com/golang/go/blob/21d2e15ee1bed44a7a1b8f775aff4a57cae9533a/src/syscall/syscall_unix_test.go#L177
-	oob := make([]byte, 32)
-	_, oobn, _, _, err := conn.ReadMsgUnix(nil, oob)
-	if err != nil {
-		return nil, err
-	}
-	if oobn <= 0 {
-		return nil, fmt.Errorf("ReadMsgUnix: oobn <= 0")
-	}
-
-	// file descriptors are now open in this process
-	scm, err := syscall.ParseSocketControlMessage(oob[:oobn])
-	if err != nil {
-		return nil, err
-	}
-	if got, want := len(scm), 1; got != want {
-		return nil, fmt.Errorf("SCM message: got %d, want %d", got, want)
-	}
-
-	fds, err := syscall.ParseUnixRights(&scm[0])
-	if err != nil {
-		return nil, err
-	}
-	if got, want := len(fds), 1; got != want {
-		return nil, fmt.Errorf("ParseUnixRights: got %d fds, want %d fds", got, want)
+		_, err := elevate.Run("reread-partitions", path)
+		return err
 	}
-
-	return os.NewFile(uintptr(fds[0]), ""), nil
+	return p.RereadPartitions(o)
 }
 
+// partition opens the device at path (using sudo as per the Sudo config
+// setting, see package elevate) and writes the partition table.
 func (p *Pack) partition(path string) (*os.File, error) {
-	if p.Cfg.InternalCompatibilityFlags.SudoOrDefault() == "always" {
-		return p.SudoPartition(path)
-	}
-	o, err := os.Create(path)
+	o, elevated, err := elevate.OpenFile(p.Cfg.InternalCompatibilityFlags.SudoOrDefault(), path)
 	if err != nil {
-		pe, ok := err.(*os.PathError)
-		if ok && pe.Err == syscall.EACCES && p.Cfg.InternalCompatibilityFlags.SudoOrDefault() == "auto" {
-			// permission denied
-			log.Printf("Using sudo to gain permission to format %s", path)
-			log.Printf("If you prefer, cancel and use: sudo setfacl -m u:${USER}:rw %s", path)
-			return p.SudoPartition(path)
-		}
-		if ok && pe.Err == syscall.EROFS {
+		if errors.Is(err, syscall.EROFS) {
 			log.Printf("%s read-only; check if you have a physical write-protect switch on your SD card?", path)
-			return nil, err
 		}
 		return nil, err
 	}
-	return o, p.partitionDevice(o, path)
+	return o, p.partitionDevice(o, path, elevated)
 }
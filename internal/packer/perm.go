@@ -0,0 +1,154 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/tools/internal/elevate"
+	"github.com/gokrazy/tools/internal/extconfig"
+)
+
+// checkPermSeed verifies the PermSeed config field: all destinations must be
+// within /perm and all sources must exist.
+func checkPermSeed(ext *extconfig.Struct) error {
+	for dest, src := range ext.PermSeed {
+		if !strings.HasPrefix(dest, "/perm/") || path.Clean(dest) != dest {
+			return fmt.Errorf("PermSeed[%q]: destination must be a clean path within /perm, e.g. /perm/db/initial.db", dest)
+		}
+		if _, err := os.Stat(src); err != nil {
+			return fmt.Errorf("PermSeed[%q]: %v", dest, err)
+		}
+	}
+	return nil
+}
+
+// stagePermSeed copies the PermSeed files and directories into dir, which
+// corresponds to /perm.
+func stagePermSeed(seed map[string]string, dir string) error {
+	for dest, src := range seed {
+		target := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(dest, "/perm/")))
+		err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			dst := filepath.Join(target, rel)
+			if d.IsDir() {
+				return os.MkdirAll(dst, 0755)
+			}
+			if !d.Type().IsRegular() {
+				return fmt.Errorf("%s: only regular files and directories are supported", p)
+			}
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			return copyRegularFile(dst, p)
+		})
+		if err != nil {
+			return fmt.Errorf("PermSeed[%q]: %v", dest, err)
+		}
+	}
+	return nil
+}
+
+func copyRegularFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// lookPathMkfsExt4 returns the path to mkfs.ext4, which is often installed
+// in /sbin (not in $PATH for regular users).
+func lookPathMkfsExt4() (string, error) {
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	if err == nil {
+		return mkfs, nil
+	}
+	if _, statErr := os.Stat("/sbin/mkfs.ext4"); statErr == nil {
+		return "/sbin/mkfs.ext4", nil
+	}
+	return "", fmt.Errorf("mkfs.ext4 not found, install e2fsprogs: %v", err)
+}
+
+// createPerm creates the perm file system on the full image or device at
+// path (of devsize bytes) if requested (Pack.MkfsPerm) or required (PermSeed),
+// and returns whether it did. Without PermSeed, a missing mkfs.ext4 is not an
+// error: the caller prints instructions for creating the file system instead.
+func (p *Pack) createPerm(ctx context.Context, path string, devsize uint64) (bool, error) {
+	if !p.MkfsPerm && len(p.Ext.PermSeed) == 0 {
+		return false, nil
+	}
+	if len(p.Ext.PermSeed) == 0 {
+		if _, err := lookPathMkfsExt4(); err != nil {
+			log.Printf("WARNING: not creating the perm file system: %v", err)
+			return false, nil
+		}
+	}
+	return true, p.mkfsPerm(ctx, path, devsize)
+}
+
+// mkfsPerm creates an ext4 file system on the perm partition (partition 4) of
+// the image file or device at path (of devsize bytes), populated with the
+// PermSeed files. mkfs.ext4 (from e2fsprogs) writes to path directly, using
+// the offset of the perm partition, so that no partition device node is
+// required.
+func (p *Pack) mkfsPerm(ctx context.Context, path string, devsize uint64) error {
+	mkfs, err := lookPathMkfsExt4()
+	if err != nil {
+		return fmt.Errorf("creating the perm file system: %v", err)
+	}
+
+	seedDir, err := os.MkdirTemp("", "gokrazy-perm")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(seedDir)
+	if err := stagePermSeed(p.Ext.PermSeed, seedDir); err != nil {
+		return err
+	}
+
+	offset := p.PartitionOffset(4)
+	sizeKB := p.PermSizeKB(devsize)
+	args := []string{
+		"-F",
+		"-q",
+		"-E", fmt.Sprintf("offset=%d,root_owner=0:0", offset),
+		"-d", seedDir,
+		path,
+		fmt.Sprint(sizeKB),
+	}
+	log.Printf("creating perm file system (%d KB) on %s", sizeKB, path)
+	mkfsCmd := elevate.Command(ctx, p.Cfg.InternalCompatibilityFlags.SudoOrDefault(), !elevate.Writable(path), mkfs, args...)
+	mkfsCmd.Stdout = os.Stdout
+	mkfsCmd.Stderr = os.Stderr
+	if err := mkfsCmd.Run(); err != nil {
+		return fmt.Errorf("%v: %v", mkfsCmd.Args, err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/packer"
+)
+
+func TestCheckPermSeed(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "initial.db")
+	if err := os.WriteFile(src, []byte("db"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		dest    string
+		src     string
+		wantErr bool
+	}{
+		{dest: "/perm/db/initial.db", src: src},
+		{dest: "/etc/initial.db", src: src, wantErr: true},
+		{dest: "/perm/../etc/initial.db", src: src, wantErr: true},
+		{dest: "/perm/db/initial.db", src: src + ".missing", wantErr: true},
+	} {
+		err := checkPermSeed(&extconfig.Struct{PermSeed: map[string]string{tt.dest: tt.src}})
+		if got := err != nil; got != tt.wantErr {
+			t.Errorf("checkPermSeed(%s=%s) = %v, want error: %v", tt.dest, tt.src, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMkfsPerm(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		t.Skip("debugfs not found")
+	}
+	tmp := t.TempDir()
+	seed := filepath.Join(tmp, "seed")
+	if err := os.MkdirAll(filepath.Join(seed, "wifi"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(seed, "wifi", "wpa_supplicant.conf"), []byte("network={}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img := filepath.Join(tmp, "full.img")
+	const devsize = 1300 * MB
+	f, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(devsize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	p := &Pack{
+		Pack: packer.NewPackForHost(8192, "perm-test"),
+		Cfg: &config.Struct{
+			InternalCompatibilityFlags: &config.InternalCompatibilityFlags{},
+		},
+		Ext: &extconfig.Struct{
+			PermSeed: map[string]string{"/perm/etc": seed},
+		},
+	}
+	if err := p.mkfsPerm(context.Background(), img, devsize); err != nil {
+		t.Fatal(err)
+	}
+
+	offset := p.FirstPartitionOffsetSectors*512 + 1100*MB
+	debugfs := exec.Command("debugfs", "-R", "cat /etc/wifi/wpa_supplicant.conf", fmt.Sprintf("%s?offset=%d", img, offset))
+	out, err := debugfs.Output()
+	if err != nil {
+		t.Fatalf("%v: %v", debugfs.Args, err)
+	}
+	if got, want := string(out), "network={}\n"; got != want {
+		t.Errorf("seeded file: got %q, want %q", got, want)
+	}
+}
+
+func TestCreatePermDisabled(t *testing.T) {
+	p := &Pack{Ext: &extconfig.Struct{}}
+	created, err := p.createPerm(context.Background(), filepath.Join(t.TempDir(), "full.img"), 1300*MB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Errorf("createPerm created a file system, even though MkfsPerm is false and PermSeed is empty")
+	}
+}
@@ -0,0 +1,123 @@
+package packer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/internal/humanize"
+	"github.com/gokrazy/tools/internal/measure"
+)
+
+// progressInterval limits how often progress is reported.
+const progressInterval = 500 * time.Millisecond
+
+// phaseProgress tracks the progress of a long-running phase (e.g. building n
+// Go packages, or writing n bytes to the root file system) and estimates the
+// remaining time. Progress is reported as EventProgress and, if status is
+// non-empty, on the interactive status line.
+//
+// A nil *phaseProgress is valid and reports nothing.
+type phaseProgress struct {
+	pack   *Pack
+	stage  Stage
+	unit   string // "packages" or "bytes"
+	status string
+	start  time.Time
+
+	mu         sync.Mutex
+	done       uint64
+	total      uint64
+	lastReport time.Time
+}
+
+func (pack *Pack) newPhaseProgress(stage Stage, unit, status string, total uint64) *phaseProgress {
+	return &phaseProgress{
+		pack:   pack,
+		stage:  stage,
+		unit:   unit,
+		status: status,
+		start:  time.Now(),
+		total:  total,
+	}
+}
+
+// add records that n more units are done.
+func (pp *phaseProgress) add(n uint64) {
+	if pp == nil {
+		return
+	}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.done += n
+	if pp.done > pp.total {
+		pp.total = pp.done
+	}
+	if time.Since(pp.lastReport) < progressInterval && pp.done < pp.total {
+		return
+	}
+	pp.lastReport = time.Now()
+	pp.report()
+}
+
+// setTotal updates the total number of units, e.g. once a more precise
+// estimate is available.
+func (pp *phaseProgress) setTotal(total uint64) {
+	if pp == nil {
+		return
+	}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if total > pp.done {
+		pp.total = total
+	}
+}
+
+// Write implements io.Writer so that phaseProgress can count bytes, e.g. via
+// io.TeeReader.
+func (pp *phaseProgress) Write(b []byte) (int, error) {
+	pp.add(uint64(len(b)))
+	return len(b), nil
+}
+
+// eta returns the estimated remaining time, assuming a constant rate.
+func (pp *phaseProgress) eta() time.Duration {
+	if pp.done == 0 || pp.done >= pp.total {
+		return 0
+	}
+	elapsed := time.Since(pp.start)
+	return time.Duration(float64(elapsed) * float64(pp.total-pp.done) / float64(pp.done))
+}
+
+func (pp *phaseProgress) format(n uint64) string {
+	if pp.unit == "bytes" {
+		return humanize.Bytes(n)
+	}
+	return fmt.Sprintf("%d %s", n, pp.unit)
+}
+
+// report must be called with pp.mu held.
+func (pp *phaseProgress) report() {
+	eta := pp.eta()
+	pp.pack.event(Event{
+		Type:       EventProgress,
+		Stage:      pp.stage,
+		Unit:       pp.unit,
+		Done:       pp.done,
+		Total:      pp.total,
+		ETASeconds: eta.Seconds(),
+	})
+	if pp.status == "" {
+		return
+	}
+	var line string
+	if pp.unit == "bytes" {
+		line = fmt.Sprintf("[%s] %s of %s (%d%%)", pp.status, pp.format(pp.done), pp.format(pp.total), pp.done*100/max(pp.total, 1))
+	} else {
+		line = fmt.Sprintf("[%s] %d/%s", pp.status, pp.done, pp.format(pp.total))
+	}
+	if eta > 0 {
+		line += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	measure.Update(line)
+}
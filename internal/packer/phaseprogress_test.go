@@ -0,0 +1,82 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPhaseProgress(t *testing.T) {
+	var events []Event
+	pack := &Pack{
+		OnEvent: func(ev Event) { events = append(events, ev) },
+	}
+	pp := pack.newPhaseProgress(StageBuild, "packages", "", 4)
+	pp.start = time.Now().Add(-10 * time.Second)
+	pp.add(1)
+	if got, want := len(events), 1; got != want {
+		t.Fatalf("got %d events, want %d", got, want)
+	}
+	ev := events[0]
+	if ev.Type != EventProgress || ev.Done != 1 || ev.Total != 4 {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+	// 1 package took 10s, so 3 more packages should take about 30s.
+	if ev.ETASeconds < 29 || ev.ETASeconds > 31 {
+		t.Errorf("ETASeconds = %v, want approximately 30", ev.ETASeconds)
+	}
+
+	// Further progress within progressInterval is not reported…
+	pp.add(1)
+	if got, want := len(events), 1; got != want {
+		t.Fatalf("got %d events, want %d", got, want)
+	}
+	// …unless the phase is complete.
+	pp.add(2)
+	if got, want := len(events), 2; got != want {
+		t.Fatalf("got %d events, want %d", got, want)
+	}
+	if ev := events[1]; ev.Done != 4 || ev.ETASeconds != 0 {
+		t.Errorf("unexpected final event: %+v", ev)
+	}
+
+	var nilProgress *phaseProgress
+	nilProgress.add(1) // must not panic
+}
+
+func TestWriteWithProgress(t *testing.T) {
+	var events []Event
+	pack := &Pack{
+		OnEvent: func(ev Event) { events = append(events, ev) },
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "full.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := bytes.Repeat([]byte{0xaa}, 3*MB)
+	_, err = pack.writeWithProgress(context.Background(), f, true, "root file system", uint64(len(data)), func(w io.Writer) error {
+		_, err := io.Copy(w, bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Size(), int64(len(data)); got != want {
+		t.Errorf("written size = %d, want %d", got, want)
+	}
+	if len(events) == 0 {
+		t.Fatalf("no progress events")
+	}
+	if ev := events[len(events)-1]; ev.Stage != StageWrite || ev.Done != uint64(len(data)) {
+		t.Errorf("unexpected final event: %+v", ev)
+	}
+}
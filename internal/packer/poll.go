@@ -9,36 +9,74 @@ import (
 	"time"
 )
 
+// DeviceStatus is the part of the status (JSON) of a gokrazy device which
+// gok uses.
+type DeviceStatus struct {
+	BuildTimestamp string `json:"BuildTimestamp"`
+
+	// SBOMHash is only reported by recent gokrazy versions.
+	SBOMHash string `json:"SBOMHash"`
+}
+
 // TODO: move getting the remote build timestamp into the updater package
-func pollUpdated1(ctx context.Context, updateHttpClient *http.Client, updateBaseUrl, targetBuildTimestamp string) error {
+func remoteBuildTimestamp(ctx context.Context, updateHttpClient *http.Client, updateBaseUrl string) (string, error) {
+	status, err := remoteStatus(ctx, updateHttpClient, updateBaseUrl)
+	if err != nil {
+		return "", err
+	}
+	return status.BuildTimestamp, nil
+}
+
+func remoteStatus(ctx context.Context, updateHttpClient *http.Client, updateBaseUrl string) (*DeviceStatus, error) {
 	// Cap each individual poll request to 5 seconds.
 	ctx, canc := context.WithTimeout(ctx, 5*time.Second)
 	defer canc()
 	req, err := http.NewRequest("GET", updateBaseUrl, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := updateHttpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer resp.Body.Close()
 	if got, want := resp.StatusCode, http.StatusOK; got != want {
-		return fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
+		return nil, fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
 	}
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
-	}
-	var status struct {
-		BuildTimestamp string `json:"BuildTimestamp"`
+		return nil, err
 	}
+	var status DeviceStatus
 	if err := json.Unmarshal(b, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func pollUpdated1(ctx context.Context, updateHttpClient *http.Client, updateBaseUrl, targetBuildTimestamp string) error {
+	got, err := remoteBuildTimestamp(ctx, updateHttpClient, updateBaseUrl)
+	if err != nil {
 		return err
 	}
-	if got, want := status.BuildTimestamp, targetBuildTimestamp; got != want {
+	if want := targetBuildTimestamp; got != want {
 		return fmt.Errorf("device on old revision (%s), want %s", got, want)
 	}
 	return nil
 }
+
+// pollChanged returns nil once the device runs a build other than
+// oldBuildTimestamp, for deploying prebuilt images whose build timestamp is
+// unknown.
+func pollChanged(ctx context.Context, updateHttpClient *http.Client, updateBaseUrl, oldBuildTimestamp string) error {
+	got, err := remoteBuildTimestamp(ctx, updateHttpClient, updateBaseUrl)
+	if err != nil {
+		return err
+	}
+	if got == oldBuildTimestamp {
+		return fmt.Errorf("device on old revision (%s)", got)
+	}
+	return nil
+}
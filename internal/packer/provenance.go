@@ -0,0 +1,266 @@
+package packer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gokrazy/tools/internal/renameio"
+	"github.com/gokrazy/tools/internal/version"
+)
+
+const (
+	inTotoStatementType  = "https://in-toto.io/Statement/v1"
+	slsaProvenanceType   = "https://slsa.dev/provenance/v1"
+	gokrazyBuildType     = "https://gokrazy.org/gok/build/v1"
+	inTotoPayloadType    = "application/vnd.in-toto+json"
+	provenanceFileSuffix = ".intoto.json"
+)
+
+// ProvenancePath returns the path of the provenance document which is written
+// alongside the image at path.
+func ProvenancePath(path string) string {
+	return path + provenanceFileSuffix
+}
+
+// ResourceDescriptor is an in-toto resource descriptor, see
+// https://github.com/in-toto/attestation/blob/main/spec/v1/resource_descriptor.md
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// Statement is an in-toto statement with a SLSA provenance predicate, see
+// https://slsa.dev/spec/v1.0/provenance
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+// Provenance describes how an image was built.
+type Provenance struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   map[string]string    `json:"externalParameters"`
+		InternalParameters   map[string]string    `json:"internalParameters"`
+		ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  string `json:"startedOn"`
+			FinishedOn string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// Envelope is a DSSE envelope, see
+// https://github.com/secure-systems-lab/dsse/blob/master/envelope.md
+type Envelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     string              `json:"payload"` // base64
+	Signatures  []EnvelopeSignature `json:"signatures"`
+}
+
+// EnvelopeSignature is a signature of a DSSE envelope.
+type EnvelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"` // base64
+}
+
+// pae returns the DSSE pre-authentication encoding of payload, which is what
+// gets signed.
+func pae(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// hashFile returns the hex-encoded SHA256 sum of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// provenanceInputs are the inputs of a build, as recorded in its provenance.
+type provenanceInputs struct {
+	hostname       string
+	outputType     OutputType
+	target         string // e.g. linux/arm64
+	sbom           SBOMWithHash
+	metadata       *BuildMetadata
+	buildTimestamp string
+}
+
+// newStatement returns the provenance statement for the artifact at path.
+func newStatement(path string, in provenanceInputs, finished time.Time) (*Statement, error) {
+	artifactHash, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	st := &Statement{
+		Type: inTotoStatementType,
+		Subject: []ResourceDescriptor{
+			{
+				Name:   filepath.Base(path),
+				Digest: map[string]string{"sha256": artifactHash},
+			},
+		},
+		PredicateType: slsaProvenanceType,
+	}
+	def := &st.Predicate.BuildDefinition
+	def.BuildType = gokrazyBuildType
+	def.ExternalParameters = map[string]string{
+		"instance": in.hostname,
+		"output":   string(in.outputType),
+	}
+	def.InternalParameters = map[string]string{
+		"target": in.target,
+	}
+	def.ResolvedDependencies = []ResourceDescriptor{
+		{
+			Name:   "config.json",
+			Digest: map[string]string{"sha256": in.sbom.SBOM.ConfigHash.Hash},
+		},
+		{
+			Name:   "sbom.json",
+			Digest: map[string]string{"sha256": in.sbom.SBOMHash},
+		},
+	}
+	if md := in.metadata; md != nil {
+		goVersions := make(map[string]bool)
+		modules := make(map[string]bool)
+		for _, bin := range md.Binaries {
+			if bin.GoVersion != "" {
+				goVersions[bin.GoVersion] = true
+			}
+			for mod, ver := range bin.Modules {
+				modules[mod+"@"+ver] = true
+			}
+		}
+		var toolchains []string
+		for v := range goVersions {
+			toolchains = append(toolchains, v)
+		}
+		sort.Strings(toolchains)
+		for _, v := range toolchains {
+			def.ResolvedDependencies = append(def.ResolvedDependencies, ResourceDescriptor{
+				Name: "go",
+				URI:  "https://go.dev/dl/" + v,
+			})
+		}
+		var mods []string
+		for m := range modules {
+			mods = append(mods, m)
+		}
+		sort.Strings(mods)
+		for _, m := range mods {
+			def.ResolvedDependencies = append(def.ResolvedDependencies, ResourceDescriptor{
+				URI: "pkg:golang/" + m,
+			})
+		}
+	}
+	run := &st.Predicate.RunDetails
+	run.Builder.ID = "https://github.com/gokrazy/tools/cmd/gok@" + version.ReadBrief()
+	run.Metadata.StartedOn = in.buildTimestamp
+	run.Metadata.FinishedOn = finished.Format(time.RFC3339)
+	return st, nil
+}
+
+// readSigningKey reads a PEM-encoded PKCS #8 ed25519 private key, e.g. as
+// generated by openssl genpkey -algorithm ed25519.
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T, expected an ed25519 key", path, key)
+	}
+	return priv, nil
+}
+
+// signStatement wraps st into a DSSE envelope signed by key. The key ID is the
+// SHA256 sum of the public key.
+func signStatement(st *Statement, key ed25519.PrivateKey) (*Envelope, error) {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := key.Sign(nil, pae(inTotoPayloadType, payload), crypto.Hash(0))
+	if err != nil {
+		return nil, err
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	return &Envelope{
+		PayloadType: inTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []EnvelopeSignature{
+			{
+				KeyID: fmt.Sprintf("%x", sha256.Sum256(pub)),
+				Sig:   base64.StdEncoding.EncodeToString(sig),
+			},
+		},
+	}, nil
+}
+
+// writeProvenance writes the provenance document of the image at path to
+// ProvenancePath(path). If pack.ProvenanceKey is set, the document is a signed
+// DSSE envelope, otherwise a plain in-toto statement.
+func (pack *Pack) writeProvenance(path string, in provenanceInputs) error {
+	st, err := newStatement(path, in, time.Now())
+	if err != nil {
+		return err
+	}
+	var doc any = st
+	if pack.ProvenanceKey != "" {
+		key, err := readSigningKey(pack.ProvenanceKey)
+		if err != nil {
+			return err
+		}
+		if doc, err = signStatement(st, key); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	provPath := ProvenancePath(path)
+	if err := renameio.WriteFile(provPath, b, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote provenance to %s\n", provPath)
+	return nil
+}
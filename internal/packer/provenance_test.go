@@ -0,0 +1,127 @@
+package packer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProvenance(t *testing.T) {
+	tmp := t.TempDir()
+	gaf := filepath.Join(tmp, "scanner.gaf")
+	if err := os.WriteFile(gaf, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	in := provenanceInputs{
+		hostname:   "scanner",
+		outputType: OutputTypeGaf,
+		target:     "linux/arm64",
+		sbom: SBOMWithHash{
+			SBOMHash: "5b0m",
+			SBOM:     SBOM{ConfigHash: FileHash{Path: "config.json", Hash: "c0nf"}},
+		},
+		metadata: &BuildMetadata{
+			Binaries: []BinaryMetadata{
+				{
+					GoVersion: "go1.22.4",
+					Modules: map[string]string{
+						"github.com/gokrazy/gokrazy": "v0.0.0-20240101",
+						"golang.org/x/sys":           "v0.20.0",
+					},
+				},
+				{
+					GoVersion: "go1.22.4",
+					Modules: map[string]string{
+						"golang.org/x/sys": "v0.20.0",
+					},
+				},
+			},
+		},
+		buildTimestamp: "2024-06-01T10:00:00Z",
+	}
+	st, err := newStatement(gaf, in, time.Date(2024, 6, 1, 10, 5, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSubject := []ResourceDescriptor{
+		{
+			Name: "scanner.gaf",
+			// echo -n hello | sha256sum
+			Digest: map[string]string{"sha256": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		},
+	}
+	if diff := cmp.Diff(wantSubject, st.Subject); diff != "" {
+		t.Errorf("unexpected subject: diff (-want +got):\n%s", diff)
+	}
+	wantDeps := []ResourceDescriptor{
+		{Name: "config.json", Digest: map[string]string{"sha256": "c0nf"}},
+		{Name: "sbom.json", Digest: map[string]string{"sha256": "5b0m"}},
+		{Name: "go", URI: "https://go.dev/dl/go1.22.4"},
+		{URI: "pkg:golang/github.com/gokrazy/gokrazy@v0.0.0-20240101"},
+		{URI: "pkg:golang/golang.org/x/sys@v0.20.0"},
+	}
+	if diff := cmp.Diff(wantDeps, st.Predicate.BuildDefinition.ResolvedDependencies); diff != "" {
+		t.Errorf("unexpected resolved dependencies: diff (-want +got):\n%s", diff)
+	}
+	if got, want := st.Predicate.RunDetails.Metadata.FinishedOn, "2024-06-01T10:05:00Z"; got != want {
+		t.Errorf("FinishedOn = %q, want %q", got, want)
+	}
+
+	// Sign the statement and verify the signature of the DSSE envelope.
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(tmp, "key.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pack := &Pack{ProvenanceKey: keyPath}
+	if err := pack.writeProvenance(gaf, in); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(ProvenancePath(gaf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env Envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(env.Signatures), 1; got != want {
+		t.Fatalf("got %d signatures, want %d", got, want)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(env.Signatures[0].Sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pub, pae(env.PayloadType, payload), sig) {
+		t.Errorf("signature verification failed")
+	}
+	var signed Statement
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantSubject, signed.Subject); diff != "" {
+		t.Errorf("unexpected signed subject: diff (-want +got):\n%s", diff)
+	}
+}
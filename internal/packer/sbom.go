@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/gokrazy/internal/config"
-	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/internal/license"
+	"github.com/gokrazy/tools/internal/oci"
+	"github.com/gokrazy/tools/internal/secret"
 	"github.com/gokrazy/tools/packer"
 	"golang.org/x/mod/modfile"
 )
@@ -39,6 +43,78 @@ type SBOM struct {
 	// It contains one entry for each file referenced via ExtraFilePaths:
 	// https://gokrazy.org/userguide/instance-config/#packageextrafilepaths
 	ExtraFileHashes []FileHash `json:"extra_file_hashes"`
+
+	// SecretHashes is list of FileHashes, sorted by path.
+	//
+	// It contains one entry for each secret referenced via ${secret:name}
+	// (e.g. in Network.WiFi.PSK). The hash is computed over the encrypted
+	// secret file, so that the SBOM changes when a secret changes without
+	// revealing the secret value.
+	SecretHashes []FileHash `json:"secret_hashes,omitempty"`
+
+	// HookOutputHashes is list of FileHashes, sorted by path.
+	//
+	// It contains one entry for each output declared in PrePackHooks. The
+	// path is the package import path followed by the output path.
+	HookOutputHashes []FileHash `json:"hook_output_hashes,omitempty"`
+
+	// OCIImages is list of OCIImages, sorted by package and path.
+	//
+	// It contains one entry for each ExtraFileOCI config entry.
+	OCIImages []OCIImage `json:"oci_images,omitempty"`
+
+	// GoToolchain is the Go toolchain pinned via the GoToolchain config
+	// field, if any.
+	GoToolchain string `json:"go_toolchain,omitempty"`
+
+	// BootFileHashes is list of BootFileHashes, sorted by path.
+	//
+	// It contains one entry for each file of the kernel, firmware, EEPROM
+	// and initramfs which is copied into the boot file system.
+	BootFileHashes []BootFileHash `json:"boot_file_hashes,omitempty"`
+
+	// ModuleLicenses is list of ModuleLicenses, sorted by module path and
+	// version.
+	//
+	// It contains one entry for each module which provides packages of the
+	// Go programs, and is only filled in when Pack.WithLicenses is set.
+	ModuleLicenses []ModuleLicense `json:"module_licenses,omitempty"`
+}
+
+type BootFileHash struct {
+	// Path is the path in the boot file system, e.g. /vmlinuz.
+	Path string `json:"path"`
+
+	// Hash is the SHA256 sum of the file.
+	Hash string `json:"hash"`
+
+	// Package is the package (e.g. github.com/gokrazy/kernel.rpi) providing
+	// the file, Version is the version of its module.
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type ModuleLicense struct {
+	Module  string `json:"module"`
+	Version string `json:"version,omitempty"`
+
+	// License is an SPDX license expression (e.g. BSD-3-Clause), or
+	// NOASSERTION if no license could be detected.
+	License string `json:"license"`
+}
+
+type OCIImage struct {
+	// Package is the package whose ExtraFileOCI config references Image.
+	Package string `json:"package"`
+
+	// Path is the path within the image and the root file system.
+	Path string `json:"path"`
+
+	// Image is the image reference without digest, e.g. ghcr.io/org/foo:1.2.
+	Image string `json:"image"`
+
+	// Digest is the digest the image is pinned to.
+	Digest string `json:"digest"`
 }
 
 type SBOMWithHash struct {
@@ -53,25 +129,43 @@ type SBOMWithHash struct {
 // not its internal implementation details
 // (i.e.  cfg.InternalCompatibilityFlags untouched).
 func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
-	instancePath, err := os.Getwd()
+	pack := &Pack{FileCfg: cfg}
+	return pack.GenerateSBOM()
+}
+
+// GenerateSBOM generates a Software Bills Of Material (SBOM) for pack.FileCfg,
+// which is resolved relative to the instance directory (see InstanceDir).
+// GenerateSBOM does not change the working directory, so it is safe to call
+// concurrently on separate Pack values.
+func (pack *Pack) GenerateSBOM() ([]byte, SBOMWithHash, error) {
+	cfg := pack.FileCfg
+	instancePath, err := pack.instanceAbs()
 	if err != nil {
 		return nil, SBOMWithHash{}, err
 	}
-	defer os.Chdir(instancePath)
 
-	formattedCfg, err := cfg.FormatForFile()
+	if pack.Ext == nil {
+		pack.Ext, err = extconfig.For(cfg)
+		if err != nil {
+			return nil, SBOMWithHash{}, err
+		}
+	}
+	ext := pack.Ext
+	pack.resolveTarget()
+	formattedCfg, err := extconfig.FormatForFile(cfg, ext)
 	if err != nil {
 		return nil, SBOMWithHash{}, err
 	}
 
 	result := SBOM{
 		ConfigHash: FileHash{
-			Path: config.InstanceConfigPath(),
+			Path: configPath(cfg),
 			Hash: fmt.Sprintf("%x", sha256.Sum256([]byte(string(formattedCfg)))),
 		},
+		GoToolchain: ext.GoToolchain,
 	}
 
-	extraFiles, err := FindExtraFiles(cfg)
+	extraFiles, err := pack.findExtraFiles(cfg)
 	if err != nil {
 		return nil, SBOMWithHash{}, err
 	}
@@ -85,14 +179,12 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 		if idx := strings.IndexByte(pkg, '@'); idx > -1 {
 			pkg = pkg[:idx]
 		}
-		buildDir := packer.BuildDir(pkg)
-		buildDir = filepath.Join(instancePath, buildDir)
+		buildDir := packer.InstanceBuildDir(instancePath, pkg)
 
-		if err := os.Chdir(buildDir); err != nil {
+		if _, err := os.Stat(buildDir); err != nil {
 			if os.IsNotExist(err) {
-				wd, _ := os.Getwd()
-				errStr := fmt.Sprintf("Error: build directory %q does not exist in %q\n", buildDir, wd)
-				errStr += fmt.Sprintf("Try 'gok -i %s add %s' followed by an update.\n", instanceflag.Instance(), pkg)
+				errStr := fmt.Sprintf("Error: build directory %q does not exist in %q\n", buildDir, instancePath)
+				errStr += fmt.Sprintf("Try 'gok -i %s add %s' followed by an update.\n", cfg.Meta.Instance, pkg)
 				errStr += "Afterwards, your 'gok sbom' command should work"
 				return nil, SBOMWithHash{}, fmt.Errorf("%s: %w", errStr, err)
 			} else {
@@ -100,10 +192,7 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 			}
 		}
 
-		path, err := filepath.Abs("go.mod")
-		if err != nil {
-			return nil, SBOMWithHash{}, err
-		}
+		path := filepath.Join(buildDir, "go.mod")
 		b, err := os.ReadFile(path)
 		if err != nil {
 			return nil, SBOMWithHash{}, err
@@ -123,9 +212,9 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 				continue
 			}
 			// replace directive that references a FilePath
-			dir, err := filepath.Abs(r.New.Path)
-			if err != nil {
-				return nil, SBOMWithHash{}, err
+			dir := r.New.Path
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(buildDir, dir)
 			}
 			// Especially when a go.mod template was used, the same replace
 			// directive can be repeated many times across different packages,
@@ -143,15 +232,6 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 			}
 		}
 
-		// Restore the working directory before possibly 'continue'ing.
-		if err := os.Chdir(config.InstancePath()); err != nil {
-			if os.IsNotExist(err) {
-				// best-effort compatibility for old setups
-			} else {
-				return nil, SBOMWithHash{}, err
-			}
-		}
-
 		files := append([]*FileInfo{}, extraFiles[pkg]...)
 		if len(files) == 0 {
 			continue
@@ -167,9 +247,9 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 				continue
 			}
 
-			path, err := filepath.Abs(fi.FromHost)
-			if err != nil {
-				return nil, SBOMWithHash{}, err
+			path := fi.FromHost
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(instancePath, path)
 			}
 			b, err := os.ReadFile(path)
 			if err != nil {
@@ -182,6 +262,63 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 		}
 	}
 
+	for _, name := range secretReferences(cfg, ext) {
+		path := secret.Path(secret.Dir(instancePath), name)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, SBOMWithHash{}, err
+		}
+		result.SecretHashes = append(result.SecretHashes, FileHash{
+			Path: path,
+			Hash: fmt.Sprintf("%x", sha256.Sum256(b)),
+		})
+	}
+
+	hookOutputs, err := pack.hookOutputHashes(ext)
+	if err != nil {
+		return nil, SBOMWithHash{}, err
+	}
+	result.HookOutputHashes = hookOutputs
+
+	for pkg, pc := range ext.PackageConfig {
+		for dest, image := range pc.ExtraFileOCI {
+			ref, err := oci.ParseReference(image)
+			if err != nil {
+				return nil, SBOMWithHash{}, err
+			}
+			img := ref.Registry + "/" + ref.Repository
+			if ref.Tag != "" {
+				img += ":" + ref.Tag
+			}
+			result.OCIImages = append(result.OCIImages, OCIImage{
+				Package: pkg,
+				Path:    dest,
+				Image:   img,
+				Digest:  ref.Digest,
+			})
+		}
+	}
+	result.BootFileHashes, err = pack.bootFileHashes(instancePath, cfg)
+	if err != nil {
+		return nil, SBOMWithHash{}, err
+	}
+
+	if pack.WithLicenses {
+		result.ModuleLicenses, err = pack.moduleLicenses(instancePath, packages)
+		if err != nil {
+			return nil, SBOMWithHash{}, err
+		}
+	}
+
+	sort.Slice(result.OCIImages, func(i, j int) bool {
+		a := result.OCIImages[i]
+		b := result.OCIImages[j]
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.Path < b.Path
+	})
+
 	sort.Slice(result.GoModHashes, func(i, j int) bool {
 		a := result.GoModHashes[i]
 		b := result.GoModHashes[j]
@@ -214,6 +351,179 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 	return sM, sH, nil
 }
 
+// bootFileHashes hashes the files which writeBoot copies from the kernel,
+// firmware, EEPROM and initramfs packages of cfg into the boot file system.
+func (pack *Pack) bootFileHashes(instancePath string, cfg *config.Struct) ([]BootFileHash, error) {
+	bootCfg := *cfg
+	applyArchPackages(&bootCfg, pack.Ext, pack.target.GOARCH)
+
+	var result []BootFileHash
+	add := func(bootPath, src, pkg, version string) error {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		result = append(result, BootFileHash{
+			Path:    bootPath,
+			Hash:    fmt.Sprintf("%x", sha256.Sum256(b)),
+			Package: pkg,
+			Version: version,
+		})
+		return nil
+	}
+	addGlobs := func(pkg string, globs []string) error {
+		dir, version, err := pack.packageDirVersion(instancePath, pkg)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range globs {
+			matches, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return err
+			}
+			for _, m := range matches {
+				relPath, err := filepath.Rel(dir, m)
+				if err != nil {
+					return err
+				}
+				if err := add("/"+filepath.ToSlash(relPath), m, pkg, version); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := addGlobs(bootCfg.KernelPackageOrDefault(), kernelGlobs); err != nil {
+		return nil, err
+	}
+	if fw := bootCfg.FirmwarePackageOrDefault(); fw != "" {
+		if err := addGlobs(fw, firmwareGlobs); err != nil {
+			return nil, err
+		}
+	}
+	if eeprom := bootCfg.EEPROMPackageOrDefault(); eeprom != "" {
+		dir, version, err := pack.packageDirVersion(instancePath, eeprom)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range []struct{ pattern, target string }{
+			{"pieeprom-*.bin", "/pieeprom.upd"},
+			{"vl805-*.bin", "/vl805.bin"},
+			{"recovery.bin", "/recovery.bin"},
+		} {
+			matches, err := filepath.Glob(filepath.Join(dir, f.pattern))
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				continue
+			}
+			// Like writeBoot, select the file that sorts last (most recent).
+			sort.Strings(matches)
+			if err := add(f.target, matches[len(matches)-1], eeprom, version); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if ext := pack.Ext; ext.InitramfsPath != "" || ext.InitramfsPackage != "" {
+		src, err := pack.initramfsPath()
+		if err != nil {
+			return nil, err
+		}
+		var version string
+		if ext.InitramfsPath == "" {
+			_, version, err = pack.packageDirVersion(instancePath, ext.InitramfsPackage)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := add("/"+initramfsFilename, src, ext.InitramfsPackage, version); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+// packageDirVersion returns the directory of pkg and the version of the
+// module providing it, resolved in the build directory of pkg.
+func (pack *Pack) packageDirVersion(instancePath, pkg string) (dir, version string, _ error) {
+	buildDir := packer.InstanceBuildDir(instancePath, pkg)
+	args := append([]string{"list"}, packer.ModFlags(buildDir)...)
+	args = append(args,
+		"-tags", strings.Join(packer.DefaultTags(), ","),
+		"-f", "{{ .Dir }}\t{{ with .Module }}{{ .Version }}{{ end }}",
+		pkg)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = buildDir
+	cmd.Env = pack.goEnv()
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	dir, version, _ = strings.Cut(strings.TrimSpace(string(out)), "\t")
+	return dir, version, nil
+}
+
+// moduleLicenses detects the licenses of the modules providing the
+// (non-standard library) dependencies of packages.
+func (pack *Pack) moduleLicenses(instancePath string, packages []string) ([]ModuleLicense, error) {
+	type module struct{ path, version string }
+	dirs := make(map[module]string)
+	for _, pkg := range packages {
+		if idx := strings.IndexByte(pkg, '@'); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		buildDir := packer.InstanceBuildDir(instancePath, pkg)
+		args := append([]string{"list"}, packer.ModFlags(buildDir)...)
+		args = append(args,
+			"-deps",
+			"-tags", strings.Join(packer.DefaultTags(), ","),
+			"-f", `{{ with .Module }}{{ if not .Main }}{{ .Path }} {{ .Version }} {{ with .Replace }}{{ .Dir }}{{ else }}{{ .Dir }}{{ end }}{{ end }}{{ end }}`,
+			pkg)
+		cmd := exec.Command("go", args...)
+		cmd.Dir = buildDir
+		cmd.Env = pack.goEnv()
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) != 3 || fields[2] == "" {
+				continue
+			}
+			dirs[module{fields[0], fields[1]}] = fields[2]
+		}
+	}
+	licenses := make([]ModuleLicense, 0, len(dirs))
+	for mod, dir := range dirs {
+		id, err := license.Detect(dir)
+		if err != nil {
+			return nil, err
+		}
+		licenses = append(licenses, ModuleLicense{
+			Module:  mod.path,
+			Version: mod.version,
+			License: id,
+		})
+	}
+	sort.Slice(licenses, func(i, j int) bool {
+		a, b := licenses[i], licenses[j]
+		if a.Module != b.Module {
+			return a.Module < b.Module
+		}
+		return a.Version < b.Version
+	})
+	return licenses, nil
+}
+
 func getGokrazySystemPackages(cfg *config.Struct) []string {
 	pkgs := append([]string{}, cfg.GokrazyPackagesOrDefault()...)
 	pkgs = append(pkgs, packer.InitDeps(cfg.InternalCompatibilityFlags.InitPkg)...)
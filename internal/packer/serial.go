@@ -0,0 +1,56 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gokrazy/tools/internal/serialupdate"
+	"github.com/gokrazy/updater"
+)
+
+// updateTarget is a gokrazy device to update, either over the network
+// (*updater.Target) or over its serial console (*serialupdate.Target).
+type updateTarget interface {
+	Supports(feature updater.ProtocolFeature) bool
+	StreamTo(dest string, r io.Reader) error
+	Switch() error
+	Testboot() error
+	Reboot() error
+	InstalledEEPROM() updater.EEPROMVersion
+}
+
+// defaultSerialBaud is the baud rate of the gokrazy serial console.
+const defaultSerialBaud = 115200
+
+// connectSerialTarget opens the serial port pack.Serial and greets the
+// gokrazy device connected to it. The caller must close the returned port.
+func (pack *Pack) connectSerialTarget() (*serialupdate.Target, *os.File, error) {
+	baud := pack.SerialBaud
+	if baud == 0 {
+		baud = defaultSerialBaud
+	}
+	port, err := serialupdate.OpenPort(pack.Serial, baud)
+	if err != nil {
+		return nil, nil, err
+	}
+	target, err := serialupdate.NewTarget(port)
+	if err != nil {
+		port.Close()
+		return nil, nil, fmt.Errorf("%s: %v", pack.Serial, err)
+	}
+	return target, port, nil
+}
+
+// serialUpdated returns nil once the device connected via target runs the
+// gokrazy installation with the specified build timestamp.
+func serialUpdated(target *serialupdate.Target, buildTimestamp string) error {
+	ts, err := target.BuildTimestamp()
+	if err != nil {
+		return err
+	}
+	if ts != buildTimestamp {
+		return fmt.Errorf("device runs build %q, waiting for %q", ts, buildTimestamp)
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package packer
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+)
+
+// serviceConfig is the configuration which the generated init applies when
+// starting a service, by wrapping the service program (see initWrapContents).
+// The fields must match those of wrapConfig in initWrapContents.
+type serviceConfig struct {
+	// Real is the path of the program in the root file system. The
+	// program’s usual path (e.g. /user/foo) is a symlink to /gokrazy/init,
+	// which applies the configuration and then executes Real.
+	Real string `json:"real"`
+
+	// User, UID, GID, Groups and Home specify the credentials of the program
+	// (see RunAsUser).
+	User   string   `json:"user,omitempty"`
+	UID    uint32   `json:"uid,omitempty"`
+	GID    uint32   `json:"gid,omitempty"`
+	Groups []uint32 `json:"groups,omitempty"`
+	Home   string   `json:"home,omitempty"`
+
+	// MemoryLimitMB, CPUQuota and OOMScoreAdj limit the resources of the
+	// program (see extconfig.PackageConfig).
+	MemoryLimitMB int `json:"memoryLimitMB,omitempty"`
+	CPUQuota      int `json:"cpuQuota,omitempty"`
+	OOMScoreAdj   int `json:"oomScoreAdj,omitempty"`
+
+	// WaitFor contains the health check URLs of required packages, which
+	// must pass before the program is started.
+	WaitFor []string `json:"waitFor,omitempty"`
+
+	// RestartPolicy (on-failure or never), RestartBackoff and Watchdog make
+	// the wrapper supervise the program (see extconfig.PackageConfig).
+	RestartPolicy  string        `json:"restartPolicy,omitempty"`
+	RestartBackoff time.Duration `json:"restartBackoff,omitempty"`
+	Watchdog       time.Duration `json:"watchdog,omitempty"`
+}
+
+// supervised returns whether the wrapper runs the program as a child process
+// instead of executing it.
+func (svc *serviceConfig) supervised() bool {
+	return svc.RestartPolicy != "" || svc.RestartBackoff > 0 || svc.Watchdog > 0
+}
+
+// wrappedDir is the directory of the root file system which contains the
+// programs of wrapped services.
+const wrappedDir = "/gokrazy/wrapped"
+
+// userDatabase is the user and group database of the root file system.
+type userDatabase struct {
+	users  []extconfig.User
+	groups []extconfig.Group
+}
+
+// newUserDatabase validates users and groups and returns a database which
+// includes the root and nobody users, the root and nogroup groups and a
+// group for each user whose primary group is not listed in groups.
+func newUserDatabase(users []extconfig.User, groups []extconfig.Group) (*userDatabase, error) {
+	db := &userDatabase{
+		users: []extconfig.User{
+			{Name: "root", UID: 0, GID: 0, Home: "/"},
+		},
+		groups: []extconfig.Group{
+			{Name: "root", GID: 0},
+		},
+	}
+	groupNames := map[string]bool{"root": true}
+	gids := map[int]bool{0: true}
+	for _, g := range groups {
+		if err := validateAccountName(g.Name); err != nil {
+			return nil, fmt.Errorf("Groups: %v", err)
+		}
+		if groupNames[g.Name] || gids[g.GID] {
+			return nil, fmt.Errorf("Groups: duplicate group %q (GID %d)", g.Name, g.GID)
+		}
+		groupNames[g.Name] = true
+		gids[g.GID] = true
+		db.groups = append(db.groups, g)
+	}
+	userNames := map[string]bool{"root": true}
+	uids := map[int]bool{0: true}
+	for _, u := range users {
+		if err := validateAccountName(u.Name); err != nil {
+			return nil, fmt.Errorf("Users: %v", err)
+		}
+		if u.UID <= 0 || u.UID >= 65534 {
+			return nil, fmt.Errorf("Users: user %q: UID %d out of range (1-65533)", u.Name, u.UID)
+		}
+		if userNames[u.Name] || uids[u.UID] {
+			return nil, fmt.Errorf("Users: duplicate user %q (UID %d)", u.Name, u.UID)
+		}
+		userNames[u.Name] = true
+		uids[u.UID] = true
+		if u.GID == 0 {
+			u.GID = u.UID
+		}
+		if u.Home == "" {
+			u.Home = "/perm/home/" + u.Name
+		}
+		if !gids[u.GID] {
+			if groupNames[u.Name] {
+				return nil, fmt.Errorf("Users: user %q: primary group %d does not exist", u.Name, u.GID)
+			}
+			groupNames[u.Name] = true
+			gids[u.GID] = true
+			db.groups = append(db.groups, extconfig.Group{Name: u.Name, GID: u.GID})
+		}
+		for _, g := range u.Groups {
+			if !groupNames[g] {
+				return nil, fmt.Errorf("Users: user %q: group %q does not exist", u.Name, g)
+			}
+		}
+		db.users = append(db.users, u)
+	}
+	db.users = append(db.users, extconfig.User{Name: "nobody", UID: 65534, GID: 65534, Home: "/"})
+	if !gids[65534] {
+		db.groups = append(db.groups, extconfig.Group{Name: "nogroup", GID: 65534})
+	}
+	return db, nil
+}
+
+func validateAccountName(name string) error {
+	if name == "" || strings.ContainsAny(name, ":\n ,") {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+func (db *userDatabase) user(name string) (extconfig.User, bool) {
+	for _, u := range db.users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return extconfig.User{}, false
+}
+
+func (db *userDatabase) gid(group string) (int, bool) {
+	for _, g := range db.groups {
+		if g.Name == group {
+			return g.GID, true
+		}
+	}
+	return 0, false
+}
+
+// passwd returns the contents of /etc/passwd.
+func (db *userDatabase) passwd() string {
+	var b strings.Builder
+	for _, u := range db.users {
+		fmt.Fprintf(&b, "%s:x:%d:%d:%s:%s:/bin/sh\n", u.Name, u.UID, u.GID, u.Name, u.Home)
+	}
+	return b.String()
+}
+
+// group returns the contents of /etc/group.
+func (db *userDatabase) group() string {
+	members := make(map[string][]string)
+	for _, u := range db.users {
+		for _, g := range u.Groups {
+			members[g] = append(members[g], u.Name)
+		}
+	}
+	var b strings.Builder
+	for _, g := range db.groups {
+		fmt.Fprintf(&b, "%s:x:%d:%s\n", g.Name, g.GID, strings.Join(members[g.Name], ","))
+	}
+	return b.String()
+}
+
+// serviceDependencies returns the packages after which each package is started
+// (After and Requires), keyed by import path. All referenced packages must be
+// part of pkgs and there must be no dependency cycles.
+func (pack *Pack) serviceDependencies(pkgs []string) (map[string][]string, error) {
+	if pack.Ext == nil {
+		return nil, nil
+	}
+	known := make(map[string]bool)
+	for _, pkg := range pkgs {
+		known[pkg] = true
+	}
+	after := make(map[string][]string)
+	for pkg, pc := range pack.Ext.PackageConfig {
+		if !known[pkg] {
+			continue
+		}
+		for _, dep := range append(append([]string{}, pc.After...), pc.Requires...) {
+			if !known[dep] {
+				return nil, fmt.Errorf("PackageConfig[%q]: dependency %q is not a package of this instance", pkg, dep)
+			}
+			after[pkg] = append(after[pkg], dep)
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(pkg string, chain []string) error
+	visit = func(pkg string, chain []string) error {
+		switch state[pkg] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(chain, pkg), " → "))
+		case visited:
+			return nil
+		}
+		state[pkg] = visiting
+		for _, dep := range after[pkg] {
+			if err := visit(dep, append(chain, pkg)); err != nil {
+				return err
+			}
+		}
+		state[pkg] = visited
+		return nil
+	}
+	for _, pkg := range pkgs {
+		if err := visit(pkg, nil); err != nil {
+			return nil, err
+		}
+	}
+	return after, nil
+}
+
+// serviceConfigs returns the configuration of all services which need to be
+// wrapped by the generated init, keyed by import path.
+func (pack *Pack) serviceConfigs(db *userDatabase) (map[string]*serviceConfig, error) {
+	if pack.Ext == nil {
+		return nil, nil
+	}
+	services := make(map[string]*serviceConfig)
+	for pkg, pc := range pack.Ext.PackageConfig {
+		if pc.MemoryLimitMB < 0 {
+			return nil, fmt.Errorf("PackageConfig[%q].MemoryLimitMB: must not be negative", pkg)
+		}
+		if pc.CPUQuota < 0 {
+			return nil, fmt.Errorf("PackageConfig[%q].CPUQuota: must not be negative", pkg)
+		}
+		if pc.OOMScoreAdj < -1000 || pc.OOMScoreAdj > 1000 {
+			return nil, fmt.Errorf("PackageConfig[%q].OOMScoreAdj: %d out of range (-1000 to 1000)", pkg, pc.OOMScoreAdj)
+		}
+		svc := &serviceConfig{
+			MemoryLimitMB: pc.MemoryLimitMB,
+			CPUQuota:      pc.CPUQuota,
+			OOMScoreAdj:   pc.OOMScoreAdj,
+		}
+		if pc.HealthCheckURL != "" {
+			u, err := url.Parse(pc.HealthCheckURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("PackageConfig[%q].HealthCheckURL: %q is not an http:// or https:// URL", pkg, pc.HealthCheckURL)
+			}
+		}
+		for _, dep := range pc.Requires {
+			if u := pack.Ext.PackageConfig[dep].HealthCheckURL; u != "" {
+				svc.WaitFor = append(svc.WaitFor, u)
+			}
+		}
+		switch pc.RestartPolicy {
+		case "", "always":
+		case "on-failure", "never":
+			svc.RestartPolicy = pc.RestartPolicy
+		default:
+			return nil, fmt.Errorf("PackageConfig[%q].RestartPolicy: unknown policy %q (want always, on-failure or never)", pkg, pc.RestartPolicy)
+		}
+		for _, d := range []struct {
+			field string
+			val   string
+			dest  *time.Duration
+		}{
+			{"RestartBackoff", pc.RestartBackoff, &svc.RestartBackoff},
+			{"WatchdogInterval", pc.WatchdogInterval, &svc.Watchdog},
+		} {
+			if d.val == "" {
+				continue
+			}
+			dur, err := time.ParseDuration(d.val)
+			if err != nil || dur <= 0 {
+				return nil, fmt.Errorf("PackageConfig[%q].%s: %q is not a positive duration", pkg, d.field, d.val)
+			}
+			*d.dest = dur
+		}
+		wrap := pc.MemoryLimitMB > 0 || pc.CPUQuota > 0 || pc.OOMScoreAdj != 0 || len(svc.WaitFor) > 0 || svc.supervised()
+		if pc.RunAsUser != "" {
+			u, ok := db.user(pc.RunAsUser)
+			if !ok {
+				return nil, fmt.Errorf("PackageConfig[%q].RunAsUser: user %q not found in Users", pkg, pc.RunAsUser)
+			}
+			svc.User = u.Name
+			svc.UID = uint32(u.UID)
+			svc.GID = uint32(u.GID)
+			svc.Home = u.Home
+			for _, g := range u.Groups {
+				gid, _ := db.gid(g)
+				svc.Groups = append(svc.Groups, uint32(gid))
+			}
+			wrap = true
+		}
+		if wrap {
+			services[pkg] = svc
+		}
+	}
+	return services, nil
+}
+
+// findDirent returns the directory entry at the slash-separated path p
+// (relative to fi), or nil if it does not exist.
+func (fi *FileInfo) findDirent(p string) *FileInfo {
+	cur := fi
+	for _, component := range strings.Split(strings.Trim(p, "/"), "/") {
+		var next *FileInfo
+		for _, ent := range cur.Dirents {
+			if ent.Filename == component {
+				next = ent
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		cur = next
+	}
+	return cur
+}
+
+// wrapPrograms moves the programs of the wrapped services (keyed by path, see
+// gokrazyInit.wrapped) into wrappedDir and replaces them with symlinks to
+// /gokrazy/init.
+func wrapPrograms(root *FileInfo, wrapped map[string]*serviceConfig) error {
+	paths := make([]string, 0, len(wrapped))
+	for p := range wrapped {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		ent := root.findDirent(p)
+		if ent == nil || ent.FromHost == "" {
+			return fmt.Errorf("BUG: program %s not found in root file system", p)
+		}
+		real := &FileInfo{Filename: "", Dirents: []*FileInfo{{Filename: path.Base(p), FromHost: ent.FromHost}}}
+		for dir := path.Dir(wrapped[p].Real); dir != "/"; dir = path.Dir(dir) {
+			real = &FileInfo{Filename: "", Dirents: []*FileInfo{{Filename: path.Base(dir), Dirents: real.Dirents}}}
+		}
+		if err := root.combine(real); err != nil {
+			return err
+		}
+		*ent = FileInfo{
+			Filename:    ent.Filename,
+			SymlinkDest: "/gokrazy/init",
+		}
+	}
+	return nil
+}
+
+// makeReadable makes the regular files of fi readable for all users, for
+// extra files of programs which do not run as root: the root file system
+// does not store file ownership (all files are owned by root).
+func makeReadable(fi *FileInfo) error {
+	if fi.FromHost != "" && fi.Mode == 0 {
+		st, err := os.Stat(fi.FromHost)
+		if err != nil {
+			return err
+		}
+		fi.Mode = st.Mode().Perm()
+	}
+	if fi.isFile() {
+		fi.Mode |= 0444
+	}
+	for _, ent := range fi.Dirents {
+		if err := makeReadable(ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUserDatabase(t *testing.T) {
+	db, err := newUserDatabase([]extconfig.User{
+		{Name: "scan", UID: 1000, Groups: []string{"video"}},
+		{Name: "web", UID: 1001, GID: 44, Home: "/srv/web"},
+	}, []extconfig.Group{
+		{Name: "video", GID: 44},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPasswd := `root:x:0:0:root:/:/bin/sh
+scan:x:1000:1000:scan:/perm/home/scan:/bin/sh
+web:x:1001:44:web:/srv/web:/bin/sh
+nobody:x:65534:65534:nobody:/:/bin/sh
+`
+	if diff := cmp.Diff(wantPasswd, db.passwd()); diff != "" {
+		t.Errorf("passwd: unexpected diff (-want +got):\n%s", diff)
+	}
+	wantGroup := `root:x:0:
+video:x:44:scan
+scan:x:1000:
+nogroup:x:65534:
+`
+	if diff := cmp.Diff(wantGroup, db.group()); diff != "" {
+		t.Errorf("group: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	for _, users := range [][]extconfig.User{
+		{{Name: "root", UID: 1}},
+		{{Name: "a", UID: 1000}, {Name: "b", UID: 1000}},
+		{{Name: "a", UID: 0}},
+		{{Name: "a:b", UID: 1000}},
+		{{Name: "a", UID: 1000, Groups: []string{"missing"}}},
+	} {
+		if _, err := newUserDatabase(users, nil); err == nil {
+			t.Errorf("newUserDatabase(%+v) succeeded unexpectedly", users)
+		}
+	}
+}
+
+func TestWrapPrograms(t *testing.T) {
+	root := &FileInfo{
+		Dirents: []*FileInfo{
+			{Filename: "gokrazy", Dirents: []*FileInfo{
+				{Filename: "dhcp", FromHost: "/tmp/bin/dhcp"},
+			}},
+			{Filename: "user", Dirents: []*FileInfo{
+				{Filename: "scanner", FromHost: "/tmp/bin/scanner"},
+			}},
+		},
+	}
+	g := &gokrazyInit{
+		root:     root,
+		services: map[string]*serviceConfig{"example.com/cmd/scanner": {User: "scan", UID: 1000, GID: 1000}},
+	}
+	wrapped := g.wrapped()
+	if got, want := wrapped["/user/scanner"].Real, "/gokrazy/wrapped/user/scanner"; got != want {
+		t.Errorf("wrapped()[/user/scanner].Real = %q, want %q", got, want)
+	}
+	b, err := g.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "wrap()") {
+		t.Errorf("generated init does not call wrap()")
+	}
+
+	if err := wrapPrograms(root, wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if got := root.findDirent("user/scanner").SymlinkDest; got != "/gokrazy/init" {
+		t.Errorf("/user/scanner: SymlinkDest = %q, want /gokrazy/init", got)
+	}
+	if got := root.findDirent("gokrazy/wrapped/user/scanner"); got == nil || got.FromHost != "/tmp/bin/scanner" {
+		t.Errorf("/gokrazy/wrapped/user/scanner = %+v, want program", got)
+	}
+}
+
+func TestServiceConfigs(t *testing.T) {
+	db, err := newUserDatabase(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := &Pack{Ext: &extconfig.Struct{
+		PackageConfig: map[string]extconfig.PackageConfig{
+			"example.com/cmd/scanner": {MemoryLimitMB: 64, CPUQuota: 50},
+			"example.com/cmd/web":     {},
+		},
+	}}
+	services, err := pack.serviceConfigs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*serviceConfig{
+		"example.com/cmd/scanner": {MemoryLimitMB: 64, CPUQuota: 50},
+	}
+	if diff := cmp.Diff(want, services); diff != "" {
+		t.Errorf("serviceConfigs: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	pack.Ext.PackageConfig["example.com/cmd/web"] = extconfig.PackageConfig{
+		RestartPolicy:    "on-failure",
+		WatchdogInterval: "30s",
+	}
+	services, err = pack.serviceConfigs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc := services["example.com/cmd/web"]; svc == nil || !svc.supervised() || svc.Watchdog != 30*time.Second {
+		t.Errorf("serviceConfigs: web = %+v, want supervised with 30s watchdog", svc)
+	}
+
+	for _, pc := range []extconfig.PackageConfig{
+		{OOMScoreAdj: 1001},
+		{RestartPolicy: "sometimes"},
+		{RestartBackoff: "-1s"},
+	} {
+		pack.Ext.PackageConfig["example.com/cmd/web"] = pc
+		if _, err := pack.serviceConfigs(db); err == nil {
+			t.Errorf("serviceConfigs with %+v succeeded unexpectedly", pc)
+		}
+	}
+}
+
+func TestServiceDependencies(t *testing.T) {
+	pkgs := []string{"example.com/cmd/web", "example.com/cmd/db", "example.com/cmd/scanner"}
+	pack := &Pack{Ext: &extconfig.Struct{
+		PackageConfig: map[string]extconfig.PackageConfig{
+			"example.com/cmd/web": {Requires: []string{"example.com/cmd/db"}},
+			"example.com/cmd/db":  {After: []string{"example.com/cmd/scanner"}},
+		},
+	}}
+	after, err := pack.serviceDependencies(pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gokrazyInit{after: after}
+	got := g.orderBinaries([]string{"/user/web", "/user/db", "/user/scanner"})
+	want := []string{"/user/scanner", "/user/db", "/user/web"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("orderBinaries: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	pack.Ext.PackageConfig["example.com/cmd/scanner"] = extconfig.PackageConfig{After: []string{"example.com/cmd/web"}}
+	if _, err := pack.serviceDependencies(pkgs); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("serviceDependencies with cycle = %v, want cycle error", err)
+	}
+	pack.Ext.PackageConfig["example.com/cmd/scanner"] = extconfig.PackageConfig{After: []string{"example.com/cmd/missing"}}
+	if _, err := pack.serviceDependencies(pkgs); err == nil {
+		t.Errorf("serviceDependencies with unknown dependency succeeded unexpectedly")
+	}
+}
+
+func TestInitTemplatePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "init.tmpl")
+	const tmpl = `package main
+
+// {{ len .Binaries }} binaries
+func main() {}
+{{ if .WrappedJSON }}{{ template "wrap" . }}{{ end }}
+`
+	if err := os.WriteFile(path, []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g := &gokrazyInit{
+		root: &FileInfo{Dirents: []*FileInfo{
+			{Filename: "user", Dirents: []*FileInfo{{Filename: "scanner", FromHost: "/tmp/bin/scanner"}}},
+		}},
+		templatePath: path,
+	}
+	b, err := g.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "// 1 binaries") {
+		t.Errorf("generate() did not render the custom template: %s", b)
+	}
+
+	if err := os.WriteFile(path, []byte("package main\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g.services = map[string]*serviceConfig{"example.com/cmd/scanner": {OOMScoreAdj: 500}}
+	if _, err := g.generate(); err == nil {
+		t.Errorf("generate() with a template lacking the service wrapper succeeded unexpectedly")
+	}
+}
@@ -0,0 +1,181 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/gokrazy/internal/humanize"
+	"github.com/gokrazy/tools/packer"
+)
+
+const (
+	// rootPartitionBytes is the size of the root partitions (see
+	// packer.Pack.Partition).
+	rootPartitionBytes = packer.RootPartitionBytes
+
+	// nearlyFullPercent is the file system usage (in percent of the budget)
+	// above which a warning is printed.
+	nearlyFullPercent = 90
+
+	// maxContributors is the number of largest files listed in a
+	// SizeBudgetError.
+	maxContributors = 10
+)
+
+// SizeContributor is a file of a file system and its size.
+type SizeContributor struct {
+	Path string
+	Size int64
+}
+
+// largestContributors returns the n largest of contributors.
+func largestContributors(contributors []SizeContributor, n int) []SizeContributor {
+	sorted := append([]SizeContributor(nil), contributors...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Size > sorted[j].Size
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// rootContributors returns the files of the root file system with their
+// (input) sizes.
+func rootContributors(fi *FileInfo, dir string) []SizeContributor {
+	var result []SizeContributor
+	for _, ent := range fi.Dirents {
+		p := path.Join(dir, ent.Filename)
+		switch {
+		case ent.FromHost != "":
+			if st, err := os.Stat(ent.FromHost); err == nil {
+				result = append(result, SizeContributor{Path: p, Size: st.Size()})
+			}
+		case ent.FromLiteral != "":
+			result = append(result, SizeContributor{Path: p, Size: int64(len(ent.FromLiteral))})
+		default:
+			result = append(result, rootContributors(ent, p)...)
+		}
+	}
+	return result
+}
+
+// printContributors prints one line per contributor, largest first.
+func printContributors(w io.Writer, contributors []SizeContributor) {
+	for _, c := range contributors {
+		fmt.Fprintf(w, "  %10s  %s\n", humanize.Bytes(uint64(c.Size)), c.Path)
+	}
+}
+
+// sizeBudget returns the size budget of a file system: the configured budget
+// (in MB, if non-zero), but at most the partition size.
+func sizeBudget(budgetMB int, partition int64) int64 {
+	if budgetMB > 0 && int64(budgetMB)*MB < partition {
+		return int64(budgetMB) * MB
+	}
+	return partition
+}
+
+func (p *Pack) rootSizeBudget() int64 {
+	if p.Ext == nil {
+		return rootPartitionBytes
+	}
+	return sizeBudget(p.Ext.RootSizeBudgetMB, rootPartitionBytes)
+}
+
+func (p *Pack) bootSizeBudget() int64 {
+	bootPartitionBytes := int64(p.BootPartitionBytes())
+	if p.Ext == nil {
+		return bootPartitionBytes
+	}
+	return sizeBudget(p.Ext.BootSizeBudgetMB, bootPartitionBytes)
+}
+
+// errBudgetExceeded is returned by budgetWriter.
+var errBudgetExceeded = errors.New("size budget exceeded")
+
+// budgetWriter fails writes beyond budget bytes (relative to the offset at
+// which writing started), so that an oversized file system is detected before
+// it overflows its partition.
+type budgetWriter struct {
+	w      io.Writer
+	budget int64
+	start  int64
+	off    int64
+
+	// size is the largest offset written to, i.e. the file system size.
+	size int64
+
+	exceeded bool
+}
+
+func newBudgetWriter(w io.Writer, budget int64) (*budgetWriter, error) {
+	bw := &budgetWriter{w: w, budget: budget}
+	if s, ok := w.(io.Seeker); ok {
+		start, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		bw.start = start
+	}
+	return bw, nil
+}
+
+func (bw *budgetWriter) Write(p []byte) (int, error) {
+	if bw.off+int64(len(p)) > bw.budget {
+		bw.exceeded = true
+		return 0, errBudgetExceeded
+	}
+	n, err := bw.w.Write(p)
+	bw.off += int64(n)
+	bw.size = max(bw.size, bw.off)
+	return n, err
+}
+
+func (bw *budgetWriter) Seek(offset int64, whence int) (int64, error) {
+	s, ok := bw.w.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("BUG: budgetWriter: underlying writer is not an io.Seeker")
+	}
+	if whence == io.SeekStart {
+		offset += bw.start
+	}
+	off, err := s.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	bw.off = off - bw.start
+	return bw.off, nil
+}
+
+// nearlyExceeded reports whether the file system written so far uses more than
+// nearlyFullPercent of the budget.
+func (bw *budgetWriter) nearlyExceeded() bool {
+	return bw.size*100 > bw.budget*nearlyFullPercent
+}
+
+// checkErr returns a *SizeBudgetError instead of err if writing failed
+// because the budget was exceeded.
+func (bw *budgetWriter) checkErr(err error, fileSystem string, contributors []SizeContributor) error {
+	if err == nil || !bw.exceeded {
+		return err
+	}
+	var total int64
+	for _, c := range contributors {
+		total += c.Size
+	}
+	return &SizeBudgetError{
+		FileSystem: fileSystem,
+		Budget:     bw.budget,
+		InputSize:  total,
+		Largest:    largestContributors(contributors, maxContributors),
+	}
+}
+
+func (p *Pack) recordBootFile(path string, size int64) {
+	p.bootFiles = append(p.bootFiles, SizeContributor{Path: path, Size: size})
+}
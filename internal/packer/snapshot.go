@@ -0,0 +1,455 @@
+package packer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/tools/internal/version"
+)
+
+// SnapshotDir is the directory of the instance directory in which
+// RestoreSnapshot places the ExternalExtraFiles of a snapshot.
+const SnapshotDir = "snapshot-extrafiles"
+
+// snapshotManifest is the name of the manifest within a snapshot bundle. It
+// is the first entry of the bundle, followed by the files of the instance
+// directory below instance/.
+const snapshotManifest = "snapshot.json"
+
+// snapshotSkipDirs are directories of the instance directory which a
+// snapshot does not contain, as they are generated (or downloaded) again
+// when building. Of builddir, only go.mod and go.sum files are included.
+var snapshotSkipDirs = map[string]bool{
+	BuildLogsDir: true,
+	ModCacheDir:  true,
+	"history":    true,
+	".git":       true,
+}
+
+// SnapshotManifest describes a snapshot bundle, see Pack.Snapshot.
+type SnapshotManifest struct {
+	Instance   string
+	Created    time.Time
+	GokVersion string
+
+	// SBOMHash is the SBOM hash of the instance at the time of the snapshot,
+	// if it could be generated.
+	SBOMHash string `json:",omitempty"`
+
+	// Files lists all files of the bundle, with paths relative to the
+	// instance directory (slash-separated) and their SHA256 sum.
+	Files []FileHash
+
+	// ExternalExtraFiles lists the ExtraFilePaths entries which refer to
+	// files or directories outside of the instance directory. The bundle
+	// contains them below SnapshotDir.
+	ExternalExtraFiles []ExternalExtraFile `json:",omitempty"`
+}
+
+// ExternalExtraFile is an ExtraFilePaths entry referring to a file or
+// directory outside of the instance directory.
+type ExternalExtraFile struct {
+	Package string
+	Dest    string
+
+	// Path is the original ExtraFilePaths value.
+	Path string
+
+	// Hash is the SHA256 sum of the file, or for directories, of the paths
+	// and SHA256 sums of all files in the directory.
+	Hash string
+
+	// SnapshotPath is the path relative to the instance directory at which
+	// the bundle contains the file or directory, e.g.
+	// snapshot-extrafiles/<hash>/config.txt.
+	SnapshotPath string
+}
+
+// snapshotFile is a file to include in a snapshot bundle.
+type snapshotFile struct {
+	name string // relative to the instance directory, slash-separated
+	src  string // path on the host
+	mode fs.FileMode
+	hash string
+}
+
+func newSnapshotFile(name, src string) (snapshotFile, error) {
+	st, err := os.Stat(src)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	hash, err := hashFile(src)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	return snapshotFile{name: name, src: src, mode: st.Mode().Perm(), hash: hash}, nil
+}
+
+// instanceSnapshotFiles returns the files of the instance directory
+// instanceDir which belong into a snapshot.
+func instanceSnapshotFiles(instanceDir string) ([]snapshotFile, error) {
+	var files []snapshotFile
+	err := filepath.WalkDir(instanceDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(instanceDir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if snapshotSkipDirs[name] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			log.Printf("snapshot: skipping %s: not a regular file", name)
+			return nil
+		}
+		if strings.HasPrefix(name, "builddir/") &&
+			path.Base(name) != "go.mod" &&
+			path.Base(name) != "go.sum" {
+			return nil
+		}
+		f, err := newSnapshotFile(name, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+// externalSnapshotFiles returns the files of ExtraFilePaths entries (of
+// pack.FileCfg) outside of the instance directory instanceDir.
+func (pack *Pack) externalSnapshotFiles(instanceDir string) ([]snapshotFile, []ExternalExtraFile, error) {
+	var (
+		files    []snapshotFile
+		external []ExternalExtraFile
+	)
+	pkgs := make([]string, 0, len(pack.FileCfg.PackageConfig))
+	for pkg := range pack.FileCfg.PackageConfig {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		paths := pack.FileCfg.PackageConfig[pkg].ExtraFilePaths
+		dests := make([]string, 0, len(paths))
+		for dest := range paths {
+			dests = append(dests, dest)
+		}
+		sort.Strings(dests)
+		for _, dest := range dests {
+			value := paths[dest]
+			if isExtraFileURL(value) {
+				continue // pinned by hash, downloaded when building
+			}
+			abs, err := filepath.Abs(pack.instanceRel(value))
+			if err != nil {
+				return nil, nil, err
+			}
+			if rel, err := filepath.Rel(instanceDir, abs); err == nil && !strings.HasPrefix(rel, "..") {
+				continue // part of the instance directory
+			}
+			ef, efFiles, err := snapshotExternal(abs)
+			if err != nil {
+				return nil, nil, fmt.Errorf("ExtraFilePaths of %s: %v", pkg, err)
+			}
+			ef.Package = pkg
+			ef.Dest = dest
+			ef.Path = value
+			external = append(external, ef)
+			files = append(files, efFiles...)
+		}
+	}
+	return files, external, nil
+}
+
+// snapshotExternal returns the snapshot files of the file or directory abs.
+func snapshotExternal(abs string) (ExternalExtraFile, []snapshotFile, error) {
+	st, err := os.Stat(abs)
+	if err != nil {
+		return ExternalExtraFile{}, nil, err
+	}
+	base := filepath.Base(abs)
+	if !st.IsDir() {
+		f, err := newSnapshotFile("", abs)
+		if err != nil {
+			return ExternalExtraFile{}, nil, err
+		}
+		f.name = path.Join(SnapshotDir, f.hash, base)
+		return ExternalExtraFile{Hash: f.hash, SnapshotPath: f.name}, []snapshotFile{f}, nil
+	}
+	var files []snapshotFile
+	err = filepath.WalkDir(abs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(abs, p)
+		if err != nil {
+			return err
+		}
+		f, err := newSnapshotFile(filepath.ToSlash(rel), p)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return ExternalExtraFile{}, nil, err
+	}
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%s\n", f.name, f.hash)
+	}
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+	dir := path.Join(SnapshotDir, hash, base)
+	for idx := range files {
+		files[idx].name = path.Join(dir, files[idx].name)
+	}
+	return ExternalExtraFile{Hash: hash, SnapshotPath: dir}, files, nil
+}
+
+// Snapshot writes a snapshot bundle (a gzip-compressed tar archive) of the
+// instance (see Pack.InstanceDir) to w: config.json, the go.mod and go.sum
+// files of all builddirs, extra files, gok.lock, (encrypted) secrets and all
+// other files of the instance directory, except for build logs, the
+// deployment history and vendored modules. Files or directories outside of
+// the instance directory to which ExtraFilePaths refer are included, too.
+// ExtraFilePaths URLs are pinned by their hash and not included.
+func (pack *Pack) Snapshot(w io.Writer) (*SnapshotManifest, error) {
+	instanceDir, err := pack.instanceAbs()
+	if err != nil {
+		return nil, err
+	}
+	files, err := instanceSnapshotFiles(instanceDir)
+	if err != nil {
+		return nil, err
+	}
+	externalFiles, external, err := pack.externalSnapshotFiles(instanceDir)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, externalFiles...)
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	manifest := &SnapshotManifest{
+		Instance:           pack.FileCfg.Hostname,
+		Created:            time.Now().UTC(),
+		GokVersion:         version.ReadBrief(),
+		ExternalExtraFiles: external,
+	}
+	manifest.Files = snapshotFileHashes(files)
+	if _, sbom, err := pack.GenerateSBOM(); err != nil {
+		log.Printf("snapshot: not recording SBOM hash: %v", err)
+	} else {
+		manifest.SBOMHash = sbom.SBOMHash
+	}
+	if err := writeSnapshotArchive(w, snapshotManifest, manifest, manifest.Created, files); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// snapshotFileHashes returns the FileHash entries of files (sorted by name),
+// skipping duplicates.
+func snapshotFileHashes(files []snapshotFile) []FileHash {
+	var hashes []FileHash
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if seen[f.name] {
+			continue // external directory referenced twice
+		}
+		seen[f.name] = true
+		hashes = append(hashes, FileHash{Path: f.name, Hash: f.hash})
+	}
+	return hashes
+}
+
+// writeSnapshotArchive writes a gzip-compressed tar archive to w, containing
+// manifest (JSON-encoded) as manifestName, followed by files below
+// instance/.
+func writeSnapshotArchive(w io.Writer, manifestName string, manifest any, created time.Time, files []snapshotFile) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: created,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+	written := make(map[string]bool)
+	for _, f := range files {
+		if written[f.name] {
+			continue
+		}
+		written[f.name] = true
+		if err := writeSnapshotFile(tw, f); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeSnapshotFile(tw *tar.Writer, f snapshotFile) error {
+	in, err := os.Open(f.src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    "instance/" + f.name,
+		Mode:    int64(f.mode),
+		Size:    st.Size(),
+		ModTime: st.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, in)
+	return err
+}
+
+// ReadSnapshotManifest returns the manifest of the snapshot bundle r.
+func ReadSnapshotManifest(r io.Reader) (*SnapshotManifest, error) {
+	var manifest SnapshotManifest
+	if _, err := readSnapshotArchiveManifest(r, "snapshot bundle", snapshotManifest, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// readSnapshotArchiveManifest decodes the manifest manifestName (the first
+// entry) of the archive r (a kind, e.g. "snapshot bundle") into manifest,
+// returning a reader positioned at the next entry.
+func readSnapshotArchiveManifest(r io.Reader, kind, manifestName string, manifest any) (*tar.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a %s: %v", kind, err)
+	}
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("not a %s: %v", kind, err)
+	}
+	if hdr.Name != manifestName {
+		return nil, fmt.Errorf("not a %s: first entry is %q, not %s", kind, hdr.Name, manifestName)
+	}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("%s: %v", manifestName, err)
+	}
+	return tr, nil
+}
+
+// RestoreSnapshot extracts the snapshot bundle r (see Pack.Snapshot) into the
+// (new or empty) instance directory dir, verifying the SHA256 sum of every
+// file. The caller is responsible for pointing the ExtraFilePaths entries of
+// SnapshotManifest.ExternalExtraFiles to their SnapshotPath.
+func RestoreSnapshot(r io.Reader, dir string) (*SnapshotManifest, error) {
+	var manifest SnapshotManifest
+	tr, err := readSnapshotArchiveManifest(r, "snapshot bundle", snapshotManifest, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := extractSnapshotArchive(tr, dir, "snapshot bundle", snapshotManifest, manifest.Files); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// extractSnapshotArchive extracts the remaining entries of the archive tr (a
+// kind, e.g. "snapshot bundle") into the (new or empty) directory dir,
+// verifying that they match files (as listed in manifestName).
+func extractSnapshotArchive(tr *tar.Reader, dir, kind, manifestName string, files []FileHash) error {
+	want := make(map[string]string)
+	for _, f := range files {
+		want[f.Path] = f.Hash
+	}
+
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s already exists and is not empty", dir)
+	}
+	restored := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, ok := strings.CutPrefix(hdr.Name, "instance/")
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected entry %q in %s", hdr.Name, kind)
+		}
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("invalid path %q in %s", hdr.Name, kind)
+		}
+		wantHash, ok := want[name]
+		if !ok {
+			return fmt.Errorf("%s: not listed in %s", name, manifestName)
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(out, h), tr); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		if got := fmt.Sprintf("%x", h.Sum(nil)); got != wantHash {
+			return fmt.Errorf("%s: SHA256 mismatch: got %s, want %s", name, got, wantHash)
+		}
+		restored[name] = true
+	}
+	var missing []string
+	for _, f := range files {
+		if !restored[f.Path] {
+			missing = append(missing, f.Path)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New(kind + " is incomplete, missing: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
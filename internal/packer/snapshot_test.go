@@ -0,0 +1,132 @@
+package packer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	tmp := t.TempDir()
+	instanceDir := filepath.Join(tmp, "scanner")
+	external := filepath.Join(tmp, "external", "config.txt")
+	for name, contents := range map[string]string{
+		filepath.Join(instanceDir, "config.json"):                                     `{"Hostname":"scanner"}`,
+		filepath.Join(instanceDir, "builddir", "example.com", "scan", "go.mod"):       "module gokrazy/build/scan\n",
+		filepath.Join(instanceDir, "builddir", "example.com", "scan", "go.sum"):       "",
+		filepath.Join(instanceDir, "builddir", "example.com", "scan", "scan.go"):      "package main\n",
+		filepath.Join(instanceDir, "extrafiles", "example.com", "scan", "etc", "a"):   "a\n",
+		filepath.Join(instanceDir, BuildLogsDir, "scan.log"):                          "log\n",
+		filepath.Join(instanceDir, "history", "deployments.jsonl"):                    "{}\n",
+		filepath.Join(instanceDir, ModCacheDir, "cache", "download", "example.com.v"): "zip",
+		external: "dtoverlay=foo\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pack := &Pack{
+		InstanceDir: instanceDir,
+		FileCfg: &config.Struct{
+			Hostname: "scanner",
+			PackageConfig: map[string]config.PackageConfig{
+				"example.com/scan": {
+					ExtraFilePaths: map[string]string{
+						"/etc/scan/config.txt": external,
+						"/etc/scan/url":        "https://example.com/blob.tar#sha256=abc",
+					},
+				},
+			},
+		},
+	}
+	var buf bytes.Buffer
+	manifest, err := pack.Snapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range manifest.Files {
+		paths = append(paths, f.Path)
+	}
+	got := strings.Join(paths, "\n")
+	for _, want := range []string{
+		"config.json",
+		"builddir/example.com/scan/go.mod",
+		"builddir/example.com/scan/go.sum",
+		"extrafiles/example.com/scan/etc/a",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("snapshot does not contain %s, got:\n%s", want, got)
+		}
+	}
+	for _, notWant := range []string{"scan.go", "scan.log", "deployments.jsonl", "example.com.v"} {
+		if strings.Contains(got, notWant) {
+			t.Errorf("snapshot unexpectedly contains %s, got:\n%s", notWant, got)
+		}
+	}
+	if len(manifest.ExternalExtraFiles) != 1 {
+		t.Fatalf("ExternalExtraFiles = %+v, want exactly the config.txt entry", manifest.ExternalExtraFiles)
+	}
+	ef := manifest.ExternalExtraFiles[0]
+	if ef.Path != external || ef.Dest != "/etc/scan/config.txt" || !strings.HasSuffix(ef.SnapshotPath, "/config.txt") {
+		t.Errorf("unexpected external extra file: %+v", ef)
+	}
+
+	restoreDir := filepath.Join(tmp, "restored")
+	restored, err := RestoreSnapshot(bytes.NewReader(buf.Bytes()), restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Instance != "scanner" {
+		t.Errorf("restored instance = %q, want scanner", restored.Instance)
+	}
+	b, err := os.ReadFile(filepath.Join(restoreDir, filepath.FromSlash(ef.SnapshotPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "dtoverlay=foo\n"; got != want {
+		t.Errorf("restored external extra file = %q, want %q", got, want)
+	}
+
+	if _, err := RestoreSnapshot(bytes.NewReader(buf.Bytes()), restoreDir); err == nil {
+		t.Errorf("RestoreSnapshot into non-empty directory unexpectedly succeeded")
+	}
+}
+
+func TestRestoreSnapshotHashMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, f := range []struct{ name, contents string }{
+		{snapshotManifest, `{"Instance":"scanner","Files":[{"Path":"config.json","Hash":"0000"}]}`},
+		{"instance/config.json", `{"Hostname":"scanner"}`},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, f.contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := RestoreSnapshot(&buf, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "SHA256 mismatch") {
+		t.Errorf("RestoreSnapshot = %v, want SHA256 mismatch error", err)
+	}
+}
@@ -0,0 +1,131 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/extconfig"
+	"github.com/gokrazy/tools/packer"
+	"golang.org/x/mod/modfile"
+)
+
+// usedPackages returns all packages of the instance which are built or whose
+// directories are used (e.g. kernel packages), including the packages of all
+// ArchPackages, InitramfsPackage and GrubPackage.
+func usedPackages(cfg *config.Struct, ext *extconfig.Struct) []string {
+	pkgs := append(getGokrazySystemPackages(cfg), cfg.Packages...)
+	for _, ap := range ext.ArchPackages {
+		for _, pkg := range []*string{ap.KernelPackage, ap.FirmwarePackage, ap.EEPROMPackage} {
+			if pkg != nil && *pkg != "" {
+				pkgs = append(pkgs, *pkg)
+			}
+		}
+	}
+	for _, pkg := range []string{ext.InitramfsPackage, ext.GrubPackage} {
+		if pkg != "" {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	for idx, pkg := range pkgs {
+		if i := strings.IndexByte(pkg, '@'); i > -1 {
+			pkgs[idx] = pkg[:i]
+		}
+	}
+	return pkgs
+}
+
+// BuildDirs returns the builddirs (directories containing a go.mod file
+// within builddir/, relative to the current directory) of the instance in the
+// current directory, sorted by path.
+func BuildDirs() ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir("builddir", func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() == "go.mod" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// UnusedBuildDirs returns the builddirs of the instance in the current
+// directory which none of the packages of cfg (and ext) is built in, e.g.
+// because the package was removed from the instance.
+func UnusedBuildDirs(cfg *config.Struct, ext *extconfig.Struct) ([]string, error) {
+	dirs, err := BuildDirs()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, pkg := range usedPackages(cfg, ext) {
+		used[packer.BuildDir(pkg)] = true
+	}
+	var unused []string
+	for _, dir := range dirs {
+		if !used[dir] {
+			unused = append(unused, dir)
+		}
+	}
+	return unused, nil
+}
+
+// DanglingReplaces returns the replace directives of the go.mod file in
+// buildDir which refer to directories that do not exist (anymore).
+func DanglingReplaces(buildDir string) ([]*modfile.Replace, error) {
+	b, err := os.ReadFile(filepath.Join(buildDir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	modf, err := modfile.Parse("go.mod", b, nil)
+	if err != nil {
+		return nil, err
+	}
+	var dangling []*modfile.Replace
+	for _, r := range modf.Replace {
+		if r.New.Version != "" {
+			continue // module replacement, not a directory
+		}
+		dir := r.New.Path
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(buildDir, dir)
+		}
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			dangling = append(dangling, r)
+		}
+	}
+	return dangling, nil
+}
+
+// DropReplaces removes the replace directives of the go.mod file in buildDir.
+func DropReplaces(buildDir string, replaces []*modfile.Replace) error {
+	goMod := filepath.Join(buildDir, "go.mod")
+	b, err := os.ReadFile(goMod)
+	if err != nil {
+		return err
+	}
+	modf, err := modfile.Parse("go.mod", b, nil)
+	if err != nil {
+		return err
+	}
+	for _, r := range replaces {
+		if err := modf.DropReplace(r.Old.Path, r.Old.Version); err != nil {
+			return err
+		}
+	}
+	modf.Cleanup()
+	b, err = modf.Format()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(goMod, b, 0644)
+}
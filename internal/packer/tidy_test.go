@@ -0,0 +1,65 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDanglingReplaces(t *testing.T) {
+	dir := t.TempDir()
+	buildDir := filepath.Join(dir, "builddir", "github.com", "gokrazy", "hello")
+	if err := os.MkdirAll(filepath.Join(dir, "exists"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(buildDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const goMod = `module gokrazy/build/hello
+
+go 1.22
+
+require (
+	github.com/gokrazy/hello v0.0.0
+	github.com/gokrazy/gone v0.0.0
+	github.com/gokrazy/forked v0.0.0
+)
+
+replace github.com/gokrazy/hello => ../../../../exists
+
+replace github.com/gokrazy/gone => ../../../../gone
+
+replace github.com/gokrazy/forked => github.com/example/forked v1.0.0
+`
+	if err := os.WriteFile(filepath.Join(buildDir, "go.mod"), []byte(goMod), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dangling, err := DanglingReplaces(buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(dangling), 1; got != want {
+		t.Fatalf("DanglingReplaces: got %d replaces, want %d", got, want)
+	}
+	if got, want := dangling[0].Old.Path, "github.com/gokrazy/gone"; got != want {
+		t.Errorf("DanglingReplaces: got %q, want %q", got, want)
+	}
+
+	if err := DropReplaces(buildDir, dangling); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(buildDir, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "=> ../../../../gone") {
+		t.Errorf("go.mod still contains the dangling replace directive:\n%s", b)
+	}
+	for _, want := range []string{"=> ../../../../exists", "=> github.com/example/forked v1.0.0"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("go.mod unexpectedly lost replace directive %q:\n%s", want, b)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package packer
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// rootRe matches the root= kernel parameter, like on the device.
+var rootRe = regexp.MustCompile(`root=[^ ]+`)
+
+// trybootDir is the boot file system directory (os_prefix in tryboot.txt)
+// containing the kernel, device tree blobs, overlays, initramfs and
+// cmdline.txt of the trial boot, see bootloader.tryboot.
+const trybootDir = "tryboot"
+
+// trybootRootPartition is the root partition which the trial boot uses: the
+// root partition which new installations do not boot (they boot partition
+// 2).
+const trybootRootPartition = 3
+
+// trybootCmdline returns cmdline (see writeCmdline) with root= referring to
+// the trial boot root partition, for the cmdline.txt in trybootDir.
+func (p *Pack) trybootCmdline(cmdline string) string {
+	root := fmt.Sprintf("/dev/mmcblk0p%d", trybootRootPartition)
+	if p.ModifyCmdlineRoot() {
+		root = p.RootPartition(trybootRootPartition)
+	}
+	return rootRe.ReplaceAllLiteralString(cmdline, "root="+root)
+}
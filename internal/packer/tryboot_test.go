@@ -0,0 +1,37 @@
+package packer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+func TestTrybootCmdline(t *testing.T) {
+	const cmdline = "console=tty1 root=/dev/mmcblk0p2 init=/gokrazy/init rootwait"
+	gpt := packer.NewPackForHost(8192, "scanner")
+	gptRoot := func(n int) string { return gpt.RootPartition(n) }
+	for _, tt := range []struct {
+		name    string
+		pack    packer.Pack
+		wantArg string
+	}{
+		{name: "gpt", pack: gpt, wantArg: "root=" + gptRoot(3)},
+		{name: "mbr", pack: packer.Pack{Partuuid: 0x2e18c40c, UsePartuuid: true}, wantArg: "root=PARTUUID=2e18c40c-03"},
+		{name: "no partuuid", wantArg: "root=/dev/mmcblk0p3"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pack{Pack: tt.pack}
+			got := p.trybootCmdline(cmdline)
+			if !strings.Contains(got, " "+tt.wantArg+" ") {
+				t.Errorf("trybootCmdline = %q, want %s", got, tt.wantArg)
+			}
+			if strings.Count(got, "root=") != 1 {
+				t.Errorf("trybootCmdline = %q, want exactly one root=", got)
+			}
+		})
+	}
+	if got, want := gptRoot(2), gpt.Root(); got != want {
+		t.Errorf("RootPartition(2) = %q, want Root() = %q", got, want)
+	}
+}
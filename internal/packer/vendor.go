@@ -0,0 +1,178 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+// ModCacheDir is the name of the Go module cache directory within the gokrazy
+// instance directory. gok vendor (see Pack.Vendor) downloads all modules of
+// the instance into it, and offline builds (see Pack.Offline) use it.
+const ModCacheDir = "modcache"
+
+// packagesByBuildDir groups the packages of the instance (see usedPackages)
+// by their builddir, as returned by buildDirFn (e.g. Pack.buildDirOrMigrate).
+func (pack *Pack) packagesByBuildDir(buildDirFn func(string) (string, error)) (map[string][]string, []string, error) {
+	byDir := make(map[string][]string)
+	var dirs []string
+	for _, pkg := range usedPackages(pack.Cfg, pack.Ext) {
+		buildDir, err := buildDirFn(pkg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := byDir[buildDir]; !ok {
+			dirs = append(dirs, buildDir)
+		}
+		byDir[buildDir] = append(byDir[buildDir], pkg)
+	}
+	sort.Strings(dirs)
+	return byDir, dirs, nil
+}
+
+// goCommand runs the go command with args in buildDir. The error contains
+// the output of the go command.
+func (pack *Pack) goCommand(ctx context.Context, buildDir string, args ...string) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = buildDir
+	cmd.Env = pack.goEnv()
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %v\n%s", cmd.Args, err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// Vendor downloads all modules which are required for building the instance
+// (see InstanceDir) (including the kernel, firmware and EEPROM
+// packages of all ArchPackages, and the GoToolchain, if any) into modCache,
+// and all ExtraFilePaths URLs into the extra files cache, so that the
+// instance can be built without network access (see Offline).
+func (pack *Pack) Vendor(ctx context.Context, modCache string, stdout io.Writer) error {
+	cfg := pack.Cfg
+	if pack.Ext == nil {
+		return fmt.Errorf("BUG: Vendor called without Ext")
+	}
+	pack.modCache = modCache
+	// Keep the module cache writable, so that it can be removed with rm -rf.
+	pack.modCacheRW = true
+	if err := checkGoToolchain(pack.Ext, pack.goEnvOverrides()); err != nil {
+		return err
+	}
+	pack.resolveTarget()
+
+	byDir, dirs, err := pack.packagesByBuildDir(pack.buildDirOrMigrate)
+	if err != nil {
+		return err
+	}
+	// Resolve packages which are not yet required by their builddir go.mod
+	// (go get), without building them.
+	buildEnv := &packer.BuildEnv{
+		BuildDir:    pack.buildDirOrMigrate,
+		Target:      &pack.target,
+		GoToolchain: pack.Ext.GoToolchain,
+		Env:         pack.goEnvOverrides(),
+	}
+	if err := buildEnv.BuildContext(ctx, "", nil, nil, nil, usedPackages(cfg, pack.Ext)); err != nil {
+		return err
+	}
+	for _, buildDir := range dirs {
+		fmt.Fprintf(stdout, "downloading modules of %s\n", buildDir)
+		if err := pack.goCommand(ctx, buildDir, "mod", "download"); err != nil {
+			return err
+		}
+		// Load all dependencies for the target, which downloads the go.mod
+		// files of all modules in the module graph.
+		args := append([]string{"list"}, packer.ModFlags(buildDir)...)
+		args = append(args, "-deps", "-tags", strings.Join(packer.DefaultTags(), ","), "-f", "{{ .ImportPath }}")
+		args = append(args, byDir[buildDir]...)
+		if err := pack.goCommand(ctx, buildDir, args...); err != nil {
+			return err
+		}
+	}
+
+	var urls int
+	for pkg, pc := range cfg.PackageConfig {
+		for _, path := range pc.ExtraFilePaths {
+			if !isExtraFileURL(path) {
+				continue
+			}
+			if _, err := fetchExtraFile(pack.httpClient(), path, false); err != nil {
+				return fmt.Errorf("ExtraFilePaths of %s: %v", pkg, err)
+			}
+			urls++
+		}
+	}
+	fmt.Fprintf(stdout, "Downloaded the modules of %d builddirs into %s and %d extra files.\n", len(dirs), modCache, urls)
+	return nil
+}
+
+// offlineModCache returns the absolute path of the ModCacheDir of the instance
+// (see Vendor) if it exists, for use as the module cache of offline builds.
+func (pack *Pack) offlineModCache() (string, error) {
+	modCache, err := pack.instanceAbs(ModCacheDir)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(modCache); err != nil {
+		return "", nil
+	}
+	return modCache, nil
+}
+
+// goEnvOverrides returns the environment variables which take precedence
+// over the process environment in all go commands: Env, plus the module cache
+// of Vendor and offline builds. With GOPROXY=off, go commands fail when a
+// module is not in the module cache.
+func (pack *Pack) goEnvOverrides() []string {
+	env := append([]string{}, pack.Env...)
+	if pack.Offline {
+		// Modules cannot be downloaded, so there is nothing to look up in
+		// the checksum database: modules in the module cache were verified
+		// when downloading them.
+		env = append(env, "GOPROXY=off", "GOSUMDB=off")
+	}
+	if pack.modCache != "" {
+		env = append(env, "GOMODCACHE="+pack.modCache)
+	}
+	if pack.modCacheRW {
+		goflags, ok := lookupGoEnv(env, "GOFLAGS")
+		if !ok {
+			goflags = os.Getenv("GOFLAGS")
+		}
+		env = append(env, "GOFLAGS="+strings.TrimSpace(goflags+" -modcacherw"))
+	}
+	return env
+}
+
+// verifyOffline returns an *OfflineError if a module which is required for
+// building the instance is not available without network access.
+func (pack *Pack) verifyOffline(ctx context.Context) error {
+	// Do not create builddirs: resolving the packages of a new builddir
+	// requires network access.
+	_, dirs, err := pack.packagesByBuildDir(func(pkg string) (string, error) {
+		return pack.buildDir(pkg), nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, buildDir := range dirs {
+		if _, err := os.Stat(filepath.Join(buildDir, "go.mod")); err != nil {
+			return &OfflineError{BuildDir: buildDir, Err: err}
+		}
+		if err := pack.goCommand(ctx, buildDir, "mod", "download"); err != nil {
+			return &OfflineError{BuildDir: buildDir, Err: err}
+		}
+	}
+	return nil
+}
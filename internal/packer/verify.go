@@ -0,0 +1,53 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gokrazy/internal/humanize"
+)
+
+// writtenRange is a range of the full disk image or device which
+// writeWithProgress wrote, identified by the SHA-256 hash of the written data,
+// for verifying the written data (see Pack.Verify).
+type writtenRange struct {
+	what   string // e.g. “root file system to /dev/sdx”
+	offset int64
+	length int64
+	sum    []byte
+}
+
+// verifyWritten re-reads the ranges of f (the full disk image or device at
+// path) and compares their hashes with the hashes of the written data. The
+// page cache is dropped first so that the data is read from the device.
+func verifyWritten(f *os.File, path string, ranges []writtenRange) error {
+	if err := dropPageCache(f); err != nil {
+		return fmt.Errorf("dropping page cache of %s: %v", path, err)
+	}
+	for _, r := range ranges {
+		start := time.Now()
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(f, r.offset, r.length)); err != nil {
+			return fmt.Errorf("verifying %s: %v", r.what, err)
+		}
+		if got := h.Sum(nil); !bytes.Equal(got, r.sum) {
+			return &VerifyError{
+				Path:   path,
+				What:   r.what,
+				Offset: r.offset,
+				Length: r.length,
+			}
+		}
+		duration := time.Since(start)
+		fmt.Printf("Verified %s (%s) at %.2f MiB/s (total: %v)\n",
+			r.what,
+			humanize.Bytes(uint64(r.length)),
+			float64(r.length)/duration.Seconds()/1024/1024,
+			duration.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package packer
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPageCache drops the (synced) cached pages of f, so that subsequent reads
+// are served by the device.
+func dropPageCache(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package packer
+
+import "os"
+
+// dropPageCache is a no-op on this operating system. On macOS, reads from
+// raw devices (/dev/rdiskN) bypass the buffer cache.
+func dropPageCache(f *os.File) error {
+	return nil
+}
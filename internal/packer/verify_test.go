@@ -0,0 +1,47 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyWritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "full.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(MB, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	pack := &Pack{Verify: true}
+	data := bytes.Repeat([]byte{0xaa}, 2*MB)
+	rng, err := pack.writeWithProgress(context.Background(), f, false, "root file system", uint64(len(data)), func(w io.Writer) error {
+		_, err := io.Copy(w, bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng.offset != MB || rng.length != int64(len(data)) {
+		t.Fatalf("unexpected range: offset %d, length %d", rng.offset, rng.length)
+	}
+	if err := verifyWritten(f, path, []writtenRange{rng}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a broken SD card by flipping a byte in the written range.
+	if _, err := f.WriteAt([]byte{0x55}, MB+1234); err != nil {
+		t.Fatal(err)
+	}
+	err = verifyWritten(f, path, []writtenRange{rng})
+	if !errors.Is(err, ErrVerify) {
+		t.Errorf("verifyWritten(corrupted) = %v, want ErrVerify", err)
+	}
+}
@@ -3,6 +3,7 @@ package packer
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -21,9 +22,11 @@ import (
 	"github.com/gokrazy/internal/humanize"
 	"github.com/gokrazy/internal/mbr"
 	"github.com/gokrazy/internal/squashfs"
+	"github.com/gokrazy/tools/internal/extconfig"
 	"github.com/gokrazy/tools/internal/measure"
 	"github.com/gokrazy/tools/packer"
 	"github.com/gokrazy/tools/third_party/systemd-250.5-1"
+	"github.com/gokrazy/updater"
 )
 
 func copyFile(fw *fat.Writer, dest string, src fs.File, srcName string) error {
@@ -48,7 +51,9 @@ func copyFile(fw *fat.Writer, dest string, src fs.File, srcName string) error {
 	return src.Close()
 }
 
-func copyFileSquash(d *squashfs.Directory, dest, src string) error {
+// copyFileSquash copies src to dest in d, with the permissions of src unless
+// mode is non-zero.
+func copyFileSquash(d *squashfs.Directory, dest, src string, mode os.FileMode, prog *phaseProgress) error {
 	f, err := os.Open(src)
 	if err != nil {
 		return err
@@ -58,20 +63,60 @@ func copyFileSquash(d *squashfs.Directory, dest, src string) error {
 	if err != nil {
 		return err
 	}
-	w, err := d.File(filepath.Base(dest), st.ModTime(), st.Mode()&os.ModePerm)
+	if mode == 0 {
+		mode = hostFileMode(st)
+	}
+	w, err := d.File(filepath.Base(dest), st.ModTime(), mode&os.ModePerm)
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(w, f); err != nil {
+	var r io.Reader = f
+	if prog != nil {
+		r = io.TeeReader(f, prog)
+	}
+	if _, err := io.Copy(w, r); err != nil {
 		return err
 	}
 	return w.Close()
 }
 
-func (p *Pack) writeCmdline(fw *fat.Writer, src string) error {
+// initramfsFilename is the file name of the initramfs (if any) within the boot
+// file system and within the InitramfsPackage directory.
+const initramfsFilename = "initramfs.img"
+
+// initramfsPath returns the path to the configured initramfs file, or the
+// empty string if no initramfs is configured.
+func (p *Pack) initramfsPath() (string, error) {
+	if p.Ext == nil {
+		return "", nil
+	}
+	if path := p.Ext.InitramfsPath; path != "" {
+		return p.instanceRel(path), nil
+	}
+	if pkg := p.Ext.InitramfsPackage; pkg != "" {
+		dir, err := p.packageDir(pkg)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, initramfsFilename), nil
+	}
+	return "", nil
+}
+
+// padCmdline pads the kernel command line with enough whitespace that can be
+// used for in-place file overwrites to add additional command line flags for
+// the gokrazy update process.
+func padCmdline(cmdline string) []byte {
+	const pad = 64
+	return append([]byte(cmdline), bytes.Repeat([]byte{' '}, pad)...)
+}
+
+// writeCmdline writes cmdline.txt (and the systemd-boot entry, if
+// applicable) and returns the kernel command line.
+func (p *Pack) writeCmdline(fw *fat.Writer, src string, initramfs bool) (string, error) {
 	b, err := os.ReadFile(src)
 	if err != nil {
-		return err
+		return "", err
 	}
 	cmdline := "console=tty1 "
 	serialConsole := p.Cfg.SerialConsoleOrDefault()
@@ -95,56 +140,70 @@ func (p *Pack) writeCmdline(fw *fat.Writer, src string) error {
 		log.Printf("(not using PARTUUID= in cmdline.txt yet)")
 	}
 
-	// Pad the kernel command line with enough whitespace that can be used for
-	// in-place file overwrites to add additional command line flags for the
-	// gokrazy update process:
-	const pad = 64
-	padded := append([]byte(cmdline), bytes.Repeat([]byte{' '}, pad)...)
+	padded := padCmdline(cmdline)
 
-	w, err := fw.File("/cmdline.txt", time.Now())
+	w, err := fw.File("/cmdline.txt", p.now())
 	if err != nil {
-		return err
+		return "", err
 	}
 	if _, err := w.Write(padded); err != nil {
-		return err
+		return "", err
 	}
 
-	if p.UseGPTPartuuid {
+	bootloader, err := p.bootloaderName()
+	if err != nil {
+		return "", err
+	}
+	if p.UseGPTPartuuid && bootloader == bootloaderGrub {
+		// The padding allows for in-place overwrites, like in cmdline.txt.
+		if err := writeGrubCfg(fw, string(padded), initramfs, p.now()); err != nil {
+			return "", err
+		}
+	} else if p.UseGPTPartuuid {
 		// In addition to the cmdline.txt for the Raspberry Pi bootloader, also
 		// write a systemd-boot entries configuration file as per
 		// https://systemd.io/BOOT_LOADER_SPECIFICATION/
-		w, err = fw.File("/loader/entries/gokrazy.conf", time.Now())
+		w, err = fw.File("/loader/entries/gokrazy.conf", p.now())
 		if err != nil {
-			return err
+			return "", err
 		}
 		fmt.Fprintf(w, `title gokrazy
 linux /vmlinuz
 `)
+		if initramfs {
+			fmt.Fprintf(w, "initrd /%s\n", initramfsFilename)
+		}
 		if _, err := w.Write(append([]byte("options "), padded...)); err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	return nil
+	return cmdline, nil
 }
 
-func (p *Pack) writeConfig(fw *fat.Writer, src string) error {
+func (p *Pack) writeConfig(fw *fat.Writer, src string, initramfs bool) (string, error) {
 	b, err := os.ReadFile(src)
 	if err != nil {
-		return err
+		return "", err
 	}
 	config := string(b)
 	if p.Cfg.SerialConsoleOrDefault() != "off" {
 		config = strings.ReplaceAll(config, "enable_uart=0", "enable_uart=1")
 	}
 	config += "\n"
+	if initramfs {
+		// followkernel loads the initramfs into memory right after the kernel.
+		config += "initramfs " + initramfsFilename + " followkernel\n"
+	}
 	config += strings.Join(p.Cfg.BootloaderExtraLines, "\n")
-	w, err := fw.File("/config.txt", time.Now())
+	w, err := fw.File("/config.txt", p.now())
 	if err != nil {
-		return err
+		return "", err
+	}
+	if _, err := w.Write([]byte(config)); err != nil {
+		return "", err
 	}
-	_, err = w.Write([]byte(config))
-	return err
+	return config, nil
 }
 
 func shortenSHA256(sum []byte) string {
@@ -173,13 +232,18 @@ var (
 	}
 )
 
-func (p *Pack) copyGlobsToBoot(fw *fat.Writer, srcDir string, globs []string) error {
+// copyGlobsToBoot copies the files of srcDir matching globs to the directory
+// dstDir of the boot file system ("" for the top level, or e.g. "/tryboot").
+func (p *Pack) copyGlobsToBoot(ctx context.Context, fw *fat.Writer, srcDir, dstDir string, globs []string) error {
 	for _, pattern := range globs {
 		matches, err := filepath.Glob(filepath.Join(srcDir, pattern))
 		if err != nil {
 			return err
 		}
 		for _, m := range matches {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			src, err := os.Open(m)
 			if err != nil {
 				return err
@@ -188,7 +252,11 @@ func (p *Pack) copyGlobsToBoot(fw *fat.Writer, srcDir string, globs []string) er
 			if err != nil {
 				return err
 			}
-			if err := copyFile(fw, "/"+relPath, src, m); err != nil {
+			dest := dstDir + "/" + filepath.ToSlash(relPath)
+			if st, err := src.Stat(); err == nil {
+				p.recordBootFile(dest, st.Size())
+			}
+			if err := copyFile(fw, dest, src, m); err != nil {
 				return err
 			}
 		}
@@ -196,7 +264,7 @@ func (p *Pack) copyGlobsToBoot(fw *fat.Writer, srcDir string, globs []string) er
 	return nil
 }
 
-func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
+func (p *Pack) writeBoot(ctx context.Context, f io.Writer, mbrfilename string) (err error) {
 	fmt.Printf("\n")
 	fmt.Printf("Creating boot file system\n")
 	done := measure.Interactively("creating boot file system")
@@ -208,7 +276,7 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 	var firmwareDir string
 	if fw := p.Cfg.FirmwarePackageOrDefault(); fw != "" {
 		var err error
-		firmwareDir, err = packer.PackageDir(fw)
+		firmwareDir, err = p.packageDir(fw)
 		if err != nil {
 			return err
 		}
@@ -216,76 +284,103 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 	var eepromDir string
 	if eeprom := p.Cfg.EEPROMPackageOrDefault(); eeprom != "" {
 		var err error
-		eepromDir, err = packer.PackageDir(eeprom)
+		eepromDir, err = p.packageDir(eeprom)
 		if err != nil {
 			return err
 		}
 	}
-	kernelDir, err := packer.PackageDir(p.Cfg.KernelPackageOrDefault())
+	kernelDir, err := p.packageDir(p.Cfg.KernelPackageOrDefault())
 	if err != nil {
 		return err
 	}
 
 	fmt.Printf("\nKernel directory: %s\n", kernelDir)
 
-	bufw := bufio.NewWriter(f)
+	dev, err := deviceSettings(p.instancePath(), p.Cfg.DeviceType)
+	if err != nil {
+		return err
+	}
+
+	p.bootFiles = nil
+	bw, err := newBudgetWriter(f, p.bootSizeBudget())
+	if err != nil {
+		return err
+	}
+	defer func() { err = bw.checkErr(err, "boot", p.bootFiles) }()
+	bufw := bufio.NewWriter(bw)
 	fw, err := fat.NewWriter(bufw)
 	if err != nil {
 		return err
 	}
 
-	err = p.copyGlobsToBoot(fw, kernelDir, kernelGlobs)
+	err = p.copyGlobsToBoot(ctx, fw, kernelDir, "", dev.kernelGlobs)
 	if err != nil {
 		return err
 	}
 
-	if firmwareDir != "" {
-		err = p.copyGlobsToBoot(fw, firmwareDir, firmwareGlobs)
+	initramfsPath, err := p.initramfsPath()
+	if err != nil {
+		return err
+	}
+	if initramfsPath != "" {
+		fmt.Printf("Initramfs: %s\n", initramfsPath)
+		src, err := os.Open(initramfsPath)
 		if err != nil {
 			return err
 		}
+		defer src.Close()
+		if st, err := src.Stat(); err == nil {
+			p.recordBootFile("/"+initramfsFilename, st.Size())
+		}
+		if err := copyFile(fw, "/"+initramfsFilename, src, initramfsPath); err != nil {
+			return err
+		}
 	}
+	initramfs := initramfsPath != ""
 
-	// EEPROM update procedure. See also:
-	// https://news.ycombinator.com/item?id=21674550
-	writeEepromUpdateFile := func(globPattern, target string) (sig string, _ error) {
-		matches, err := filepath.Glob(globPattern)
+	if firmwareDir != "" {
+		err = p.copyGlobsToBoot(ctx, fw, firmwareDir, "", dev.firmwareGlobs)
 		if err != nil {
-			return "", err
-		}
-		if len(matches) == 0 {
-			return "", fmt.Errorf("invalid -eeprom_package: no files matching %s", filepath.Base(globPattern))
+			return err
 		}
+	}
 
-		// Select the EEPROM file that sorts last.
-		// This corresponds to most recent for the pieeprom-*.bin files,
-		// which contain the date in yyyy-mm-dd format.
-		sort.Sort(sort.Reverse(sort.StringSlice(matches)))
-
-		f, err := os.Open(matches[0])
+	// EEPROM update procedure. See also:
+	// https://news.ycombinator.com/item?id=21674550
+	// contents, if non-nil, replaces the contents of src (e.g. a pieeprom
+	// file with BootloaderExtraEEPROM applied).
+	writeEepromUpdateFile := func(src, target string, contents []byte) error {
+		f, err := os.Open(src)
 		if err != nil {
-			return "", err
+			return err
 		}
 		defer f.Close()
 		st, err := f.Stat()
 		if err != nil {
-			return "", err
+			return err
+		}
+		var r io.Reader = f
+		size := st.Size()
+		if contents != nil {
+			r = bytes.NewReader(contents)
+			size = int64(len(contents))
 		}
 		// Copy the EEPROM file into the image and calculate its SHA256 hash
 		// while doing so:
 		w, err := fw.File(target, st.ModTime())
 		if err != nil {
-			return "", err
+			return err
 		}
 		h := sha256.New()
-		if _, err := io.Copy(w, io.TeeReader(f, h)); err != nil {
-			return "", err
+		if _, err := io.Copy(w, io.TeeReader(r, h)); err != nil {
+			return err
 		}
+		p.recordBootFile(target, size)
 
 		if base := filepath.Base(target); base == "recovery.bin" || base == "RECOVERY.000" {
 			fmt.Printf("  %s\n", base)
 			// No signature required for recovery.bin itself.
-			return "", nil
+			return nil
 		}
 		fmt.Printf("  %s (sig %s)\n", filepath.Base(target), shortenSHA256(h.Sum(nil)))
 
@@ -293,46 +388,80 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 		sigFn := target
 		ext := filepath.Ext(sigFn)
 		if ext == "" {
-			return "", fmt.Errorf("BUG: cannot derive signature file name from matches[0]=%q", matches[0])
+			return fmt.Errorf("BUG: cannot derive signature file name from src=%q", src)
 		}
 		sigFn = strings.TrimSuffix(sigFn, ext) + ".sig"
 		w, err = fw.File(sigFn, st.ModTime())
 		if err != nil {
-			return "", err
+			return err
 		}
 		_, err = fmt.Fprintf(w, "%x\n", h.Sum(nil))
-		return fmt.Sprintf("%x", h.Sum(nil)), err
+		return err
 	}
 	if eepromDir != "" {
 		fmt.Printf("EEPROM update summary:\n")
-		pieSig, err := writeEepromUpdateFile(filepath.Join(eepromDir, "pieeprom-*.bin"), "/pieeprom.upd")
-		if err != nil {
-			return err
-		}
-		vlSig, err := writeEepromUpdateFile(filepath.Join(eepromDir, "vl805-*.bin"), "/vl805.bin")
-		if err != nil {
-			return err
-		}
-		targetFilename := "/recovery.bin"
-		if pieSig == p.ExistingEEPROM.PieepromSHA256 &&
-			vlSig == p.ExistingEEPROM.VL805SHA256 {
-			fmt.Printf("  installing recovery.bin as RECOVERY.000 (EEPROM already up-to-date)\n")
-			targetFilename = "/RECOVERY.000"
-		}
-		if _, err := writeEepromUpdateFile(filepath.Join(eepromDir, "recovery.bin"), targetFilename); err != nil {
-			return err
+		eepromCfg := p.eepromConfig()
+		if eepromCfg.Skip {
+			fmt.Printf("  skipped (EEPROM.Skip is set)\n")
+		} else {
+			lines := p.bootloaderExtraEEPROM()
+			files, err := selectEEPROMFiles(eepromDir, eepromCfg, lines)
+			if err != nil {
+				return err
+			}
+			if len(lines) > 0 {
+				fmt.Printf("  applying %d BootloaderExtraEEPROM lines to bootconf.txt\n", len(lines))
+			}
+			if err := writeEepromUpdateFile(files.Pieeprom, "/pieeprom.upd", files.PieepromImage); err != nil {
+				return err
+			}
+			if err := writeEepromUpdateFile(files.VL805, "/vl805.bin", nil); err != nil {
+				return err
+			}
+			targetFilename := "/recovery.bin"
+			if files.Installed(updater.EEPROMVersion(p.ExistingEEPROM)) {
+				fmt.Printf("  installing recovery.bin as RECOVERY.000 (EEPROM already up-to-date)\n")
+				targetFilename = "/RECOVERY.000"
+			}
+			if err := writeEepromUpdateFile(files.Recovery, targetFilename, nil); err != nil {
+				return err
+			}
 		}
 	}
 
-	if err := p.writeCmdline(fw, filepath.Join(kernelDir, "cmdline.txt")); err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	if err := p.writeConfig(fw, filepath.Join(kernelDir, "config.txt")); err != nil {
+	cmdline, err := p.writeCmdline(fw, filepath.Join(kernelDir, "cmdline.txt"), initramfs)
+	if err != nil {
 		return err
 	}
 
-	if p.UseGPTPartuuid {
+	if err := p.writeBootScript(fw, kernelDir, cmdline, initramfs); err != nil {
+		return err
+	}
+
+	config, err := p.writeConfig(fw, filepath.Join(kernelDir, "config.txt"), initramfs)
+	if err != nil {
+		return err
+	}
+
+	if p.tryboot() {
+		if err := p.writeTryboot(ctx, fw, kernelDir, dev.kernelGlobs, initramfsPath, config, cmdline); err != nil {
+			return err
+		}
+	}
+
+	bootloader, err := p.bootloaderName()
+	if err != nil {
+		return err
+	}
+	if p.UseGPTPartuuid && bootloader == bootloaderGrub {
+		if err := p.writeGrub(fw, kernelDir); err != nil {
+			return err
+		}
+	} else if p.UseGPTPartuuid {
 		srcX86, err := systemd.SystemdBootX64.Open("systemd-bootx64.efi")
 		if err != nil {
 			return err
@@ -356,17 +485,25 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 	if err := bufw.Flush(); err != nil {
 		return err
 	}
-	if seeker, ok := f.(io.Seeker); ok {
-		off, err := seeker.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return err
-		}
-		fragment = ", " + humanize.Bytes(uint64(off))
+	fragment = fmt.Sprintf(", %s (%s free)",
+		humanize.Bytes(uint64(bw.size)),
+		humanize.Bytes(uint64(bw.budget-bw.size)))
+	if bw.nearlyExceeded() {
+		defer func() {
+			fmt.Printf("Warning: the boot file system uses %s of its %s budget; largest files:\n",
+				humanize.Bytes(uint64(bw.size)),
+				humanize.Bytes(uint64(bw.budget)))
+			printContributors(os.Stdout, largestContributors(p.bootFiles, maxContributors))
+		}()
 	}
 	if mbrfilename != "" {
 		if _, ok := f.(io.ReadSeeker); !ok {
 			return fmt.Errorf("BUG: f does not implement io.ReadSeeker")
 		}
+		if initramfs {
+			// The gokrazy MBR bootloader only loads vmlinuz and cmdline.txt.
+			fmt.Printf("Warning: legacy BIOS boot does not load the initramfs, only UEFI and Raspberry Pi boot do\n")
+		}
 		fmbr, err := os.OpenFile(mbrfilename, os.O_RDWR|os.O_CREATE, 0600)
 		if err != nil {
 			return err
@@ -464,7 +601,9 @@ func findBins(cfg *config.Struct, buildEnv *packer.BuildEnv, bindir string) (*Fi
 	gokrazy := FileInfo{Filename: "gokrazy"}
 	for _, pkg := range gokrazyMainPkgs {
 		binPath := filepath.Join(bindir, pkg.Basename())
-		fileIsELFOrFatal(binPath)
+		if err := fileIsELF(binPath); err != nil {
+			return nil, err
+		}
 		gokrazy.Dirents = append(gokrazy.Dirents, &FileInfo{
 			Filename: pkg.Basename(),
 			FromHost: binPath,
@@ -482,7 +621,9 @@ func findBins(cfg *config.Struct, buildEnv *packer.BuildEnv, bindir string) (*Fi
 				continue
 			}
 			binPath := filepath.Join(bindir, pkg.Basename())
-			fileIsELFOrFatal(binPath)
+			if err := fileIsELF(binPath); err != nil {
+				return nil, err
+			}
 			gokrazy.Dirents = append(gokrazy.Dirents, &FileInfo{
 				Filename: pkg.Basename(),
 				FromHost: binPath,
@@ -498,7 +639,9 @@ func findBins(cfg *config.Struct, buildEnv *packer.BuildEnv, bindir string) (*Fi
 	user := FileInfo{Filename: "user"}
 	for _, pkg := range mainPkgs {
 		binPath := filepath.Join(bindir, pkg.Basename())
-		fileIsELFOrFatal(binPath)
+		if err := fileIsELF(binPath); err != nil {
+			return nil, err
+		}
 		user.Dirents = append(user.Dirents, &FileInfo{
 			Filename: pkg.Basename(),
 			FromHost: binPath,
@@ -508,70 +651,137 @@ func findBins(cfg *config.Struct, buildEnv *packer.BuildEnv, bindir string) (*Fi
 	return &result, nil
 }
 
-func writeFileInfo(dir *squashfs.Directory, fi *FileInfo) error {
+// inputSize returns the total size of all regular files in fi, used for
+// estimating the progress of writing the root file system.
+func (fi *FileInfo) inputSize() uint64 {
+	if fi.FromHost != "" {
+		if st, err := os.Stat(fi.FromHost); err == nil {
+			return uint64(st.Size())
+		}
+		return 0
+	}
+	size := uint64(len(fi.FromLiteral))
+	for _, ent := range fi.Dirents {
+		size += ent.inputSize()
+	}
+	return size
+}
+
+// writeFileInfo writes fi (recursively) into dir, using modTime for all
+// directories, symlinks and files which are not copied from the host.
+func writeFileInfo(ctx context.Context, dir *squashfs.Directory, fi *FileInfo, modTime time.Time, prog *phaseProgress) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if fi.FromHost != "" { // copy a regular file
-		return copyFileSquash(dir, fi.Filename, fi.FromHost)
+		return copyFileSquash(dir, fi.Filename, fi.FromHost, fi.Mode, prog)
 	}
 	if fi.FromLiteral != "" { // write a regular file
 		mode := fi.Mode
 		if mode == 0 {
 			mode = 0444
 		}
-		w, err := dir.File(fi.Filename, time.Now(), mode)
+		w, err := dir.File(fi.Filename, modTime, mode)
 		if err != nil {
 			return err
 		}
 		if _, err := w.Write([]byte(fi.FromLiteral)); err != nil {
 			return err
 		}
+		prog.add(uint64(len(fi.FromLiteral)))
 		return w.Close()
 	}
 
 	if fi.SymlinkDest != "" { // create a symlink
-		return dir.Symlink(fi.SymlinkDest, fi.Filename, time.Now(), 0444)
+		return dir.Symlink(fi.SymlinkDest, fi.Filename, modTime, 0444)
 	}
 	// subdir
 	var d *squashfs.Directory
 	if fi.Filename == "" { // root
 		d = dir
 	} else {
-		d = dir.Directory(fi.Filename, time.Now())
+		d = dir.Directory(fi.Filename, modTime)
 	}
 	sort.Slice(fi.Dirents, func(i, j int) bool {
 		return fi.Dirents[i].Filename < fi.Dirents[j].Filename
 	})
 	for _, ent := range fi.Dirents {
-		if err := writeFileInfo(d, ent); err != nil {
+		if err := writeFileInfo(ctx, d, ent, modTime, prog); err != nil {
 			return err
 		}
 	}
 	return d.Flush()
 }
 
-func writeRoot(f io.WriteSeeker, root *FileInfo) error {
+// checkRootCompression returns an error if the configured RootCompression or
+// RootBlockSizeKB cannot be used.
+func checkRootCompression(ext *extconfig.Struct) error {
+	// The SquashFS writer only implements gzip with 128 KB blocks.
+	if c := ext.RootCompression; c != "" && c != "gzip" {
+		return fmt.Errorf("unsupported RootCompression %q: the only supported value is \"gzip\" (the SquashFS writer does not implement other compression algorithms)", c)
+	}
+	if bs := ext.RootBlockSizeKB; bs != 0 && bs != 128 {
+		return fmt.Errorf("unsupported RootBlockSizeKB %d: the only supported value is 128 (the SquashFS writer does not implement other block sizes)", bs)
+	}
+	return nil
+}
+
+// maxBootPartitionMB is the largest supported BootPartitionSizeMB: the FAT16B
+// file systems which the fat package writes (2 KB clusters) cannot be larger.
+const maxBootPartitionMB = 128
+
+// checkBootPartitionSize returns an error if the configured
+// BootPartitionSizeMB cannot be used.
+func checkBootPartitionSize(ext *extconfig.Struct) error {
+	if mb := ext.BootPartitionSizeMB; mb != 0 && (mb < packer.DefaultBootPartitionMB || mb > maxBootPartitionMB) {
+		return fmt.Errorf("unsupported BootPartitionSizeMB %d: must be between %d and %d (the boot file system is FAT16B)", mb, packer.DefaultBootPartitionMB, maxBootPartitionMB)
+	}
+	return nil
+}
+
+// compressionRatio formats the size of a file system compared to the size of
+// its files, e.g. “, 41.2 MiB (ratio 2.31)”.
+func compressionRatio(inputSize uint64, size int64) string {
+	if size <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %s (ratio %.2f)", humanize.Bytes(uint64(size)), float64(inputSize)/float64(size))
+}
+
+func (p *Pack) writeRoot(ctx context.Context, f io.WriteSeeker, root *FileInfo) error {
 	fmt.Printf("\n")
 	fmt.Printf("Creating root file system\n")
-	done := measure.Interactively("creating root file system")
+	const status = "creating root file system"
+	done := measure.Interactively(status)
+	fragment := ""
 	defer func() {
-		done("")
+		done(fragment)
 	}()
 
-	// TODO: make fw.Flush() report the size of the root fs
-
-	fw, err := squashfs.NewWriter(f, time.Now())
+	bw, err := newBudgetWriter(f, p.rootSizeBudget())
 	if err != nil {
 		return err
 	}
-
-	if err := writeFileInfo(fw.Root, root); err != nil {
+	modTime := p.now()
+	fw, err := squashfs.NewWriter(bw, modTime)
+	if err != nil {
 		return err
 	}
 
-	return fw.Flush()
+	prog := p.newPhaseProgress(StageAssemble, "bytes", status, root.inputSize())
+	if err := writeFileInfo(ctx, fw.Root, root, modTime, prog); err != nil {
+		return bw.checkErr(err, "root", rootContributors(root, "/"))
+	}
+
+	if err := fw.Flush(); err != nil {
+		return bw.checkErr(err, "root", rootContributors(root, "/"))
+	}
+	fragment = compressionRatio(root.inputSize(), bw.size)
+	return nil
 }
 
 func (p *Pack) writeRootDeviceFiles(f io.WriteSeeker, rootDeviceFiles []deviceconfig.RootFile) error {
-	kernelDir, err := packer.PackageDir(p.Cfg.KernelPackageOrDefault())
+	kernelDir, err := p.packageDir(p.Cfg.KernelPackageOrDefault())
 	if err != nil {
 		return err
 	}
@@ -585,6 +795,12 @@ func (p *Pack) writeRootDeviceFiles(f io.WriteSeeker, rootDeviceFiles []deviceco
 		if err != nil {
 			return err
 		}
+		// Larger files would overwrite the next root device file or the
+		// boot partition.
+		if st, err := source.Stat(); err == nil && rootFile.MaxLength > 0 && st.Size() > rootFile.MaxLength {
+			source.Close()
+			return fmt.Errorf("root device file %s is %d bytes, exceeding its MaxLength of %d bytes", rootFile.Name, st.Size(), rootFile.MaxLength)
+		}
 		if _, err := io.Copy(f, source); err != nil {
 			return err
 		}
@@ -0,0 +1,188 @@
+// Package remotecache implements remote backends for the binary cache, so that
+// machines building the same gokrazy instance (e.g. CI builders and developer
+// laptops) can share built programs.
+//
+// Backends store opaque objects by name (e.g. blobs/<sha256>) and are selected
+// by URL:
+//
+//   - http://host/path or https://host/path: GET and PUT requests below the
+//     URL, e.g. for bazel-remote, nginx (WebDAV) or any other HTTP cache.
+//     User information in the URL is sent as HTTP basic authentication.
+//   - s3://bucket/prefix: Amazon S3 (or a compatible service), authenticated
+//     with AWS Signature Version 4, see NewS3.
+//   - gs://bucket/prefix: Google Cloud Storage via its S3-compatible XML API,
+//     authenticated with an HMAC key, see NewS3.
+package remotecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Backend.Get for objects which do not exist.
+var ErrNotFound = errors.New("not found in remote cache")
+
+// Backend is a remote object store.
+type Backend interface {
+	// Get returns the contents of the object name, or an error wrapping
+	// ErrNotFound.
+	Get(ctx context.Context, name string) ([]byte, error)
+
+	// Put stores data as the object name, replacing any existing object.
+	Put(ctx context.Context, name string, data []byte) error
+
+	// String returns the URL of the backend, without credentials.
+	String() string
+}
+
+// Client is the HTTP client used by backends without a client of their own.
+var Client = &http.Client{Timeout: 5 * time.Minute}
+
+// Open returns the backend for rawURL (see the package documentation). If
+// client is non-nil, the backend uses it for all requests (with the timeout
+// of Client, unless client has a timeout).
+func Open(rawURL string, client *http.Client) (Backend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil && client.Timeout == 0 {
+		c := *client // copy
+		c.Timeout = Client.Timeout
+		client = &c
+	}
+	switch u.Scheme {
+	case "http", "https":
+		h := NewHTTP(u)
+		h.Client = client
+		return h, nil
+	case "s3", "gs":
+		s, err := NewS3(u)
+		if err != nil {
+			return nil, err
+		}
+		s.Client = client
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported remote cache URL %q: expected http://, https://, s3:// or gs://", u.Redacted())
+}
+
+// HTTP is a Backend which stores objects using HTTP GET and PUT requests.
+type HTTP struct {
+	// Client is used for all requests. If nil, the package-level Client is
+	// used.
+	Client *http.Client
+
+	base *url.URL
+}
+
+// NewHTTP returns an HTTP backend storing objects below base.
+func NewHTTP(base *url.URL) *HTTP {
+	b := *base // copy
+	b.Path = strings.TrimSuffix(b.Path, "/")
+	return &HTTP{base: &b}
+}
+
+func (h *HTTP) String() string { return h.base.Redacted() }
+
+func (h *HTTP) request(ctx context.Context, method, name string, body []byte) (*http.Request, error) {
+	u := *h.base // copy
+	u.User = nil
+	u.Path += "/" + name
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	if h.base.User != nil {
+		password, _ := h.base.User.Password()
+		req.SetBasicAuth(h.base.User.Username(), password)
+	}
+	return req, nil
+}
+
+// Get implements Backend.
+func (h *HTTP) Get(ctx context.Context, name string) ([]byte, error) {
+	req, err := h.request(ctx, "GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doGet(h.Client, req)
+}
+
+// Put implements Backend.
+func (h *HTTP) Put(ctx context.Context, name string, data []byte) error {
+	req, err := h.request(ctx, "PUT", name, data)
+	if err != nil {
+		return err
+	}
+	return doPut(h.Client, req)
+}
+
+// clientOr returns client, or the package-level Client if client is nil.
+func clientOr(client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	return Client
+}
+
+func doGet(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := clientOr(client).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", req.URL.Path, ErrNotFound)
+	}
+	if err := checkStatus(req, resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func doPut(client *http.Client, req *http.Request) error {
+	resp, err := clientOr(client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(req, resp)
+}
+
+// StatusError is returned for unexpected HTTP status codes.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       []byte // (the beginning of) the response body
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: unexpected HTTP status %v: %s", e.Method, e.URL, e.Status, bytes.TrimSpace(e.Body))
+}
+
+func checkStatus(req *http.Request, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &StatusError{
+		Method:     req.Method,
+		URL:        req.URL.Redacted(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       body,
+	}
+}
@@ -0,0 +1,253 @@
+package remotecache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 is a Backend which stores objects in an Amazon S3 bucket (or in a
+// bucket of an S3-compatible service, like Google Cloud Storage or MinIO).
+type S3 struct {
+	// Endpoint is the base URL of the service. For Amazon S3, requests are
+	// sent to https://<bucket>.s3.<region>.amazonaws.com/ (virtual-hosted
+	// style); for other endpoints, to <Endpoint>/<bucket>/ (path style).
+	Endpoint *url.URL
+	Bucket   string
+	Prefix   string
+	Region   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Client is used for all requests. If nil, the package-level Client is
+	// used.
+	Client *http.Client
+
+	scheme string
+	now    func() time.Time
+}
+
+// NewS3 returns an S3 backend for u (s3://bucket/prefix or
+// gs://bucket/prefix). The credentials are read from the environment:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN (optional).
+// The region is read from AWS_REGION or AWS_DEFAULT_REGION (default
+// us-east-1), a custom endpoint from AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL.
+//
+// For gs:// URLs, the endpoint is https://storage.googleapis.com and the
+// credentials are an HMAC key of a service account (access ID and secret).
+func NewS3(u *url.URL) (*S3, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: missing bucket name, expected e.g. %s://bucket/prefix", u.Redacted(), u.Scheme)
+	}
+	s := &S3{
+		Bucket:          u.Host,
+		Prefix:          strings.Trim(u.Path, "/"),
+		Region:          firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		scheme:          u.Scheme,
+		now:             time.Now,
+	}
+	endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL")
+	if u.Scheme == "gs" {
+		endpoint = "https://storage.googleapis.com"
+		if s.Region == "" {
+			s.Region = "auto"
+		}
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint: %v", err)
+		}
+		s.Endpoint = e
+	}
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return nil, fmt.Errorf("%s: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set", u.Redacted())
+	}
+	return s, nil
+}
+
+func firstEnv(keys ...string) string {
+	for _, key := range keys {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (s *S3) String() string {
+	return s.scheme + "://" + s.Bucket + "/" + s.Prefix
+}
+
+// objectURL returns the URL of the object name.
+func (s *S3) objectURL(name string) *url.URL {
+	key := name
+	if s.Prefix != "" {
+		key = s.Prefix + "/" + name
+	}
+	if s.Endpoint == nil {
+		return &url.URL{
+			Scheme: "https",
+			Host:   s.Bucket + ".s3." + s.Region + ".amazonaws.com",
+			Path:   "/" + key,
+		}
+	}
+	u := *s.Endpoint // copy
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	return &u
+}
+
+func (s *S3) request(ctx context.Context, method, name string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(name).String(), strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	if s.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.SessionToken)
+	}
+	s.sign(req, s.now().UTC())
+	return req, nil
+}
+
+// Get implements Backend.
+func (s *S3) Get(ctx context.Context, name string) ([]byte, error) {
+	req, err := s.request(ctx, "GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := doGet(s.Client, req)
+	var se *StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusForbidden {
+		// Without s3:ListBucket permission, S3 responds with 403 instead
+		// of 404 for missing objects.
+		return nil, fmt.Errorf("%v: %w", err, ErrNotFound)
+	}
+	return b, err
+}
+
+// Put implements Backend.
+func (s *S3) Put(ctx context.Context, name string, data []byte) error {
+	req, err := s.request(ctx, "PUT", name, data)
+	if err != nil {
+		return err
+	}
+	return doPut(s.Client, req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, signing
+// the Host header and all x-amz-* and range headers. The
+// x-amz-content-sha256 header must be set.
+func (s *S3) sign(req *http.Request, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "x-amz-") || key == "range" || key == "content-md5" {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for key := range headers {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, key := range names {
+		canonicalHeaders.WriteString(key + ":" + headers[key] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.EscapedPath()),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalURI returns the escaped path in the form required by Signature
+// Version 4 for S3: each segment URI-encoded once.
+func canonicalURI(escapedPath string) string {
+	if escapedPath == "" {
+		return "/"
+	}
+	segments := strings.Split(escapedPath, "/")
+	for idx, seg := range segments {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			continue
+		}
+		segments[idx] = uriEncode(unescaped)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(values url.Values) string {
+	var pairs []string
+	for key, vals := range values {
+		for _, v := range vals {
+			pairs = append(pairs, uriEncode(key)+"="+uriEncode(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes s as specified for Signature Version 4: all bytes except
+// unreserved characters (A-Z, a-z, 0-9, -, ., _, ~) are percent-encoded.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,4 @@
+// Package renameio provides the subset of github.com/google/renameio/v2 that
+// gok uses, on all operating systems: renameio does not support Windows, so
+// this package falls back to writing a temporary file and renaming it.
+package renameio
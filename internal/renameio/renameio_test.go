@@ -0,0 +1,51 @@
+package renameio
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileExistingPermissions(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(fn, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fn, []byte("new"), 0644, WithExistingPermissions()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "new"; got != want {
+		t.Errorf("contents: got %q, want %q", got, want)
+	}
+	st, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Errorf("permissions: got %v, want %v", got, want)
+	}
+}
+
+func TestTempFileCleanup(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "blob")
+	f, err := TempFile("", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	f.Cleanup()
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 0 {
+		t.Errorf("Cleanup left files behind: %v", ents)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package renameio
+
+import (
+	"os"
+
+	"github.com/google/renameio/v2"
+)
+
+type (
+	Option      = renameio.Option
+	PendingFile = renameio.PendingFile
+)
+
+// WithExistingPermissions keeps the permissions of the file being replaced.
+func WithExistingPermissions() Option { return renameio.WithExistingPermissions() }
+
+// TempFile creates a file which replaces path when closed, see
+// renameio.TempFile.
+func TempFile(dir, path string) (*PendingFile, error) { return renameio.TempFile(dir, path) }
+
+// WriteFile atomically replaces filename with data, see renameio.WriteFile.
+func WriteFile(filename string, data []byte, perm os.FileMode, opts ...Option) error {
+	return renameio.WriteFile(filename, data, perm, opts...)
+}
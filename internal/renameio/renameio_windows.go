@@ -0,0 +1,100 @@
+package renameio
+
+import (
+	"os"
+	"path/filepath"
+)
+
+type config struct {
+	existingPermissions bool
+}
+
+// Option configures WriteFile.
+type Option func(*config)
+
+// WithExistingPermissions keeps the permissions of the file being replaced.
+func WithExistingPermissions() Option {
+	return func(c *config) { c.existingPermissions = true }
+}
+
+// PendingFile is a temporary file which replaces path when closed using
+// CloseAtomicallyReplace.
+type PendingFile struct {
+	*os.File
+
+	path   string
+	done   bool
+	closed bool
+}
+
+// TempFile creates a temporary file in dir (or the directory of path, if
+// empty) which replaces path when closed using CloseAtomicallyReplace.
+func TempFile(dir, path string) (*PendingFile, error) {
+	if dir == "" {
+		dir = filepath.Dir(path)
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	return &PendingFile{File: f, path: path}, nil
+}
+
+// Cleanup removes the temporary file, unless CloseAtomicallyReplace succeeded.
+func (t *PendingFile) Cleanup() error {
+	if t.done {
+		return nil
+	}
+	var closeErr error
+	if !t.closed {
+		closeErr = t.File.Close()
+	}
+	if err := os.Remove(t.Name()); err != nil {
+		return err
+	}
+	t.done = true
+	return closeErr
+}
+
+// CloseAtomicallyReplace syncs and closes the temporary file and renames it
+// to path, replacing any existing file.
+func (t *PendingFile) CloseAtomicallyReplace() error {
+	if err := t.Sync(); err != nil {
+		return err
+	}
+	t.closed = true
+	if err := t.File.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(t.Name(), t.path); err != nil {
+		return err
+	}
+	t.done = true
+	return nil
+}
+
+// WriteFile replaces filename with data, using a temporary file which is
+// renamed to filename.
+func WriteFile(filename string, data []byte, perm os.FileMode, opts ...Option) error {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.existingPermissions {
+		if st, err := os.Stat(filename); err == nil {
+			perm = st.Mode().Perm()
+		}
+	}
+	t, err := TempFile("", filename)
+	if err != nil {
+		return err
+	}
+	defer t.Cleanup()
+	if err := t.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err := t.Write(data); err != nil {
+		return err
+	}
+	return t.CloseAtomicallyReplace()
+}
@@ -0,0 +1,148 @@
+// Package secret implements storage of gokrazy instance secrets.
+//
+// Secrets are stored encrypted using age (https://age-encryption.org/) in the
+// secrets directory of the gokrazy instance, so that the instance directory
+// can be checked into git without leaking secret values. Config values can
+// reference secrets as ${secret:name}, which the packer resolves at pack time.
+package secret
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+)
+
+const (
+	// Suffix is the file name suffix of encrypted secrets.
+	Suffix = ".age"
+
+	// RecipientsFile is the name of the age recipients file (one public key
+	// per line) within the secrets directory.
+	RecipientsFile = "recipients.txt"
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ValidateName returns an error if name cannot be used as a secret name.
+func ValidateName(name string) error {
+	if !validName.MatchString(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid secret name %q: must consist of letters, digits, _, . and - only", name)
+	}
+	return nil
+}
+
+// Dir returns the secrets directory of the specified instance directory.
+func Dir(instancePath string) string {
+	return filepath.Join(instancePath, "secrets")
+}
+
+// Path returns the path of the encrypted secret name within dir.
+func Path(dir, name string) string {
+	return filepath.Join(dir, name+Suffix)
+}
+
+// IdentityPath returns the path to the age identity (private key) file which
+// is used for decrypting secrets. It can be overridden using the
+// GOKRAZY_AGE_IDENTITY environment variable.
+func IdentityPath() string {
+	if path := os.Getenv("GOKRAZY_AGE_IDENTITY"); path != "" {
+		return path
+	}
+	return filepath.Join(config.Gokrazy(), "age-identity.txt")
+}
+
+func runAge(stdin []byte, args ...string) ([]byte, error) {
+	age := exec.Command("age", args...)
+	age.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	age.Stderr = &stderr
+	out, err := age.Output()
+	if err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("%v: %v: %s", age.Args, err, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("%v: %v", age.Args, err)
+	}
+	return out, nil
+}
+
+// ensureRecipients creates the recipients file in dir (derived from the
+// identity file) unless it already exists.
+func ensureRecipients(dir string) (string, error) {
+	recipients := filepath.Join(dir, RecipientsFile)
+	if _, err := os.Stat(recipients); err == nil {
+		return recipients, nil
+	}
+	identity := IdentityPath()
+	if _, err := os.Stat(identity); err != nil {
+		return "", fmt.Errorf("neither %s nor %s exist. Create an identity using 'age-keygen -o %s', or list age recipients in %s", recipients, identity, identity, recipients)
+	}
+	keygen := exec.Command("age-keygen", "-y", identity)
+	keygen.Stderr = os.Stderr
+	pub, err := keygen.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", keygen.Args, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(recipients, pub, 0644); err != nil {
+		return "", err
+	}
+	return recipients, nil
+}
+
+// Add encrypts plaintext for all recipients and stores it as secret name in
+// dir, overwriting any existing secret of the same name.
+func Add(dir, name string, plaintext []byte) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	recipients, err := ensureRecipients(dir)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := runAge(plaintext, "--encrypt", "--armor", "--recipients-file", recipients)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(Path(dir, name), ciphertext, 0644)
+}
+
+// Decrypt returns the plaintext of secret name in dir.
+func Decrypt(dir, name string) ([]byte, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	ciphertext, err := os.ReadFile(Path(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return runAge(ciphertext, "--decrypt", "--identity", IdentityPath())
+}
+
+// List returns the names of all secrets in dir, sorted.
+func List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, ent := range entries {
+		if name, ok := strings.CutSuffix(ent.Name(), Suffix); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,181 @@
+package secret
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateName(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		valid bool
+	}{
+		{"wifi-password", true},
+		{"API_TOKEN.v2", true},
+		{"a", true},
+		{"", false},
+		{".hidden", false},
+		{"..", false},
+		{"a/b", false},
+		{"../escape", false},
+		{"with space", false},
+		{"dollar$", false},
+	} {
+		err := ValidateName(tt.name)
+		if got := err == nil; got != tt.valid {
+			t.Errorf("ValidateName(%q) = %v, want valid: %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	for _, tt := range []struct {
+		instancePath string
+		name         string
+		want         string
+	}{
+		{"/home/user/gokrazy/scanner", "wifi", "/home/user/gokrazy/scanner/secrets/wifi.age"},
+		{"scanner", "api.token", "scanner/secrets/api.token.age"},
+	} {
+		if got := Path(Dir(tt.instancePath), tt.name); got != filepath.FromSlash(tt.want) {
+			t.Errorf("Path(Dir(%q), %q) = %q, want %q", tt.instancePath, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		desc  string
+		files []string
+		want  []string
+	}{
+		{"empty", nil, nil},
+		{"secrets", []string{"b.age", "a.age"}, []string{"a", "b"}},
+		{"other files", []string{RecipientsFile, "notes.txt", "c.age"}, []string{"a", "b", "c"}},
+	} {
+		for _, fn := range tt.files {
+			if err := os.WriteFile(filepath.Join(dir, fn), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := List(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("List (%s): unexpected names (-want +got):\n%s", tt.desc, diff)
+		}
+	}
+
+	// A missing secrets directory contains no secrets.
+	got, err := List(filepath.Join(dir, "missing"))
+	if err != nil || got != nil {
+		t.Errorf("List(missing) = %v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestEnsureRecipients(t *testing.T) {
+	for _, tt := range []struct {
+		desc       string
+		recipients string // contents of RecipientsFile, if non-empty
+		wantErr    string
+	}{
+		{
+			desc:       "existing recipients file",
+			recipients: "age1examplerecipient\n",
+		},
+		{
+			desc:    "neither recipients nor identity",
+			wantErr: "age-keygen -o",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("GOKRAZY_AGE_IDENTITY", filepath.Join(dir, "missing-identity.txt"))
+			want := filepath.Join(dir, RecipientsFile)
+			if tt.recipients != "" {
+				if err := os.WriteFile(want, []byte(tt.recipients), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := ensureRecipients(dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ensureRecipients() = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("ensureRecipients() = %q, want %q", got, want)
+			}
+			b, err := os.ReadFile(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.recipients {
+				t.Errorf("ensureRecipients modified %s: got %q, want %q", RecipientsFile, b, tt.recipients)
+			}
+		})
+	}
+}
+
+// newIdentity creates an age identity and points GOKRAZY_AGE_IDENTITY at it.
+// The test is skipped if age is not installed.
+func newIdentity(t *testing.T) {
+	t.Helper()
+	for _, tool := range []string{"age", "age-keygen"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found in $PATH", tool)
+		}
+	}
+	identity := filepath.Join(t.TempDir(), "age-identity.txt")
+	keygen := exec.Command("age-keygen", "-o", identity)
+	if out, err := keygen.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %v: %s", keygen.Args, err, out)
+	}
+	t.Setenv("GOKRAZY_AGE_IDENTITY", identity)
+}
+
+func TestAddDecrypt(t *testing.T) {
+	newIdentity(t)
+	dir := Dir(t.TempDir())
+
+	const plaintext = "hunter2\n"
+	if err := Add(dir, "wifi", []byte(plaintext)); err != nil {
+		t.Fatal(err)
+	}
+	// Add derives the recipients file from the identity.
+	if _, err := os.Stat(filepath.Join(dir, RecipientsFile)); err != nil {
+		t.Errorf("Add did not create %s: %v", RecipientsFile, err)
+	}
+	ciphertext, err := os.ReadFile(Path(dir, "wifi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(ciphertext), strings.TrimSpace(plaintext)) {
+		t.Errorf("secret stored in plain text: %q", ciphertext)
+	}
+	got, err := Decrypt(dir, "wifi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != plaintext {
+		t.Errorf("Decrypt(wifi) = %q, want %q", got, plaintext)
+	}
+
+	if err := Add(dir, "../escape", []byte(plaintext)); err == nil {
+		t.Errorf("Add(../escape) unexpectedly succeeded")
+	}
+	if _, err := Decrypt(dir, "missing"); !os.IsNotExist(err) {
+		t.Errorf("Decrypt(missing) = %v, want not exist error", err)
+	}
+}
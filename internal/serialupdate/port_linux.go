@@ -0,0 +1,65 @@
+package serialupdate
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var baudRates = map[int]uint32{
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	921600:  unix.B921600,
+	1500000: unix.B1500000,
+}
+
+// OpenPort opens the serial port at path (e.g. /dev/ttyUSB0) in raw mode
+// (8N1, no flow control) with the specified baud rate.
+func OpenPort(path string, baud int) (*os.File, error) {
+	rate, ok := baudRates[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var ioctlErr error
+	if err := sc.Control(func(fd uintptr) {
+		var t *unix.Termios
+		t, ioctlErr = unix.IoctlGetTermios(int(fd), unix.TCGETS)
+		if ioctlErr != nil {
+			return
+		}
+		// Equivalent to cfmakeraw(3):
+		t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF
+		t.Oflag &^= unix.OPOST
+		t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+		t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | rate
+		t.Ispeed = rate
+		t.Ospeed = rate
+		t.Cc[unix.VMIN] = 1
+		t.Cc[unix.VTIME] = 0
+		ioctlErr = unix.IoctlSetTermios(int(fd), unix.TCSETS, t)
+	}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if ioctlErr != nil {
+		f.Close()
+		return nil, fmt.Errorf("configuring %s: %v", path, ioctlErr)
+	}
+	return f, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package serialupdate
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// OpenPort is only implemented on Linux.
+func OpenPort(path string, baud int) (*os.File, error) {
+	return nil, fmt.Errorf("serial updates are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,255 @@
+// Package serialupdate implements updating a gokrazy device over its serial
+// console, for recovering devices whose network configuration is broken.
+//
+// The protocol is a simple request/response protocol of frames, which can be
+// interleaved with regular console output of the device:
+//
+//	magic (1 byte, 'g') | type (1 byte) | length (uint32, big endian) |
+//	payload (length bytes) | CRC-32 (IEEE) of type, length and payload
+//
+// Bytes which do not belong to a valid frame are ignored. The host sends one
+// request at a time and waits for the device to answer with an Ack frame
+// (whose payload depends on the request) or a Nack frame (whose payload is an
+// error message):
+//
+//   - Hello: the device answers with its space-separated protocol features
+//     (like the HTTP updater’s /update/features)
+//   - Open (payload: destination, e.g. root or boot): starts a stream
+//   - Data (payload: up to ChunkSize bytes): appends to the current stream
+//   - Close (payload: SHA256 of the stream): the device verifies the hash and
+//     answers once the stream has been written
+//   - Switch, Testboot, Reboot: like the corresponding HTTP updater requests
+//   - Status: the device answers with its build timestamp
+package serialupdate
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/updater"
+)
+
+// Frame types.
+const (
+	TypeHello    = 'H'
+	TypeOpen     = 'O'
+	TypeData     = 'D'
+	TypeClose    = 'C'
+	TypeSwitch   = 'S'
+	TypeTestboot = 'T'
+	TypeReboot   = 'R'
+	TypeStatus   = 'V'
+	TypeAck      = 'A'
+	TypeNack     = 'N'
+)
+
+const (
+	magic = 'g'
+
+	// ChunkSize is the maximum payload size of Data frames.
+	ChunkSize = 4096
+
+	// maxPayload bounds the payload size of frames, so that garbage on the
+	// serial line cannot result in large allocations.
+	maxPayload = 64 << 10
+
+	// maxFrame is the size of a frame with maxPayload bytes of payload.
+	maxFrame = 1 + 1 + 4 + maxPayload + 4
+)
+
+// Frame is a protocol frame.
+type Frame struct {
+	Type    byte
+	Payload []byte
+}
+
+// WriteFrame writes f to w.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf := make([]byte, 0, 1+1+4+len(f.Payload)+4)
+	buf = append(buf, magic, f.Type)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.Payload)))
+	buf = append(buf, f.Payload...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[1:]))
+	_, err := w.Write(buf)
+	return err
+}
+
+// NewReader returns a buffered reader for use with ReadFrame.
+func NewReader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, maxFrame)
+}
+
+// ReadFrame reads the next valid frame from r (see NewReader), skipping all
+// other bytes (e.g. console output).
+func ReadFrame(r *bufio.Reader) (Frame, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return Frame{}, err
+		}
+		if b != magic {
+			continue
+		}
+		hdr, err := r.Peek(1 + 4)
+		if err != nil {
+			return Frame{}, err
+		}
+		length := binary.BigEndian.Uint32(hdr[1:])
+		if length > maxPayload {
+			continue // not a frame
+		}
+		frame, err := r.Peek(1 + 4 + int(length) + 4)
+		if err != nil {
+			return Frame{}, err
+		}
+		body := frame[:1+4+length]
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(frame[len(body):]) {
+			continue // not a frame (or corrupted), resynchronize
+		}
+		f := Frame{
+			Type:    body[0],
+			Payload: bytes.Clone(body[1+4:]),
+		}
+		if _, err := r.Discard(len(frame)); err != nil {
+			return Frame{}, err
+		}
+		return f, nil
+	}
+}
+
+// Target is a gokrazy device which is updated over its serial console. Its
+// methods correspond to those of updater.Target.
+type Target struct {
+	rw       io.ReadWriter
+	br       *bufio.Reader
+	timeout  time.Duration
+	features []string
+}
+
+// DefaultTimeout is how long a Target waits for the device to answer a
+// request, if the connection supports read deadlines.
+const DefaultTimeout = 30 * time.Second
+
+// NewTarget greets the device connected via rw and returns a Target.
+func NewTarget(rw io.ReadWriter) (*Target, error) {
+	t := &Target{
+		rw:      rw,
+		br:      NewReader(rw),
+		timeout: DefaultTimeout,
+	}
+	resp, err := t.request(Frame{Type: TypeHello})
+	if err != nil {
+		return nil, fmt.Errorf("serial hello: %v", err)
+	}
+	t.features = strings.Fields(string(resp))
+	return t, nil
+}
+
+// request sends req and returns the payload of the device’s Ack frame.
+func (t *Target) request(req Frame) ([]byte, error) {
+	if err := WriteFrame(t.rw, req); err != nil {
+		return nil, err
+	}
+	if d, ok := t.rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if err := d.SetReadDeadline(time.Now().Add(t.timeout)); err == nil {
+			defer d.SetReadDeadline(time.Time{})
+		}
+	}
+	resp, err := ReadFrame(t.br)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Type {
+	case TypeAck:
+		return resp.Payload, nil
+	case TypeNack:
+		msg := string(resp.Payload)
+		if msg == "not implemented" {
+			return nil, updater.ErrUpdateHandlerNotImplemented
+		}
+		return nil, errors.New(msg)
+	}
+	return nil, fmt.Errorf("unexpected response frame type %q", resp.Type)
+}
+
+// Supports returns whether the device supports the specified protocol feature.
+func (t *Target) Supports(feature updater.ProtocolFeature) bool {
+	for _, f := range t.features {
+		if f == string(feature) {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamTo streams from r to the specified destination (see
+// updater.Target.StreamTo).
+func (t *Target) StreamTo(dest string, r io.Reader) error {
+	if _, err := t.request(Frame{Type: TypeOpen, Payload: []byte(dest)}); err != nil {
+		return err
+	}
+	h := sha256.New()
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			if _, err := t.request(Frame{Type: TypeData, Payload: buf[:n]}); err != nil {
+				return fmt.Errorf("streaming to %s: %v", dest, err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := t.request(Frame{Type: TypeClose, Payload: h.Sum(nil)}); err != nil {
+		return fmt.Errorf("streaming to %s: %v", dest, err)
+	}
+	return nil
+}
+
+// Switch makes the device boot the inactive root partition on next boot.
+func (t *Target) Switch() error {
+	_, err := t.request(Frame{Type: TypeSwitch})
+	return err
+}
+
+// Testboot makes the device boot the inactive root partition on next boot
+// only.
+func (t *Target) Testboot() error {
+	_, err := t.request(Frame{Type: TypeTestboot})
+	return err
+}
+
+// Reboot reboots the device.
+func (t *Target) Reboot() error {
+	_, err := t.request(Frame{Type: TypeReboot})
+	return err
+}
+
+// InstalledEEPROM returns the zero value: the serial protocol does not report
+// the Raspberry Pi EEPROM version.
+func (t *Target) InstalledEEPROM() updater.EEPROMVersion {
+	return updater.EEPROMVersion{}
+}
+
+// BuildTimestamp returns the build timestamp of the gokrazy installation which
+// the device is running.
+func (t *Target) BuildTimestamp() (string, error) {
+	resp, err := t.request(Frame{Type: TypeStatus})
+	if err != nil {
+		return "", err
+	}
+	return string(resp), nil
+}
@@ -0,0 +1,115 @@
+package serialupdate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/updater"
+)
+
+// fakeDevice implements the device side of the protocol, writing console
+// output before each response.
+func fakeDevice(conn net.Conn, streams map[string][]byte) {
+	br := NewReader(conn)
+	var (
+		dest string
+		buf  bytes.Buffer
+	)
+	for {
+		req, err := ReadFrame(br)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("gokrazy console output\n"))
+		resp := Frame{Type: TypeAck}
+		switch req.Type {
+		case TypeHello:
+			resp.Payload = []byte("partuuid updatehash")
+		case TypeOpen:
+			dest = string(req.Payload)
+			if dest == "mbr" {
+				resp = Frame{Type: TypeNack, Payload: []byte("not implemented")}
+			}
+			buf.Reset()
+		case TypeData:
+			buf.Write(req.Payload)
+		case TypeClose:
+			if sum := sha256.Sum256(buf.Bytes()); !bytes.Equal(sum[:], req.Payload) {
+				resp = Frame{Type: TypeNack, Payload: []byte("hash mismatch")}
+				break
+			}
+			streams[dest] = bytes.Clone(buf.Bytes())
+		case TypeStatus:
+			resp.Payload = []byte("2024-08-27T19:00:26+02:00")
+		}
+		if err := WriteFrame(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestTarget(t *testing.T) {
+	host, device := net.Pipe()
+	defer host.Close()
+	streams := make(map[string][]byte)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeDevice(device, streams)
+	}()
+
+	target, err := NewTarget(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !target.Supports("partuuid") || target.Supports("gpt") {
+		t.Errorf("unexpected features: %v", target.features)
+	}
+
+	root := strings.Repeat("squashfs", 3*ChunkSize/8+1)
+	if err := target.StreamTo("root", strings.NewReader(root)); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.StreamTo("mbr", strings.NewReader("mbr")); !errors.Is(err, updater.ErrUpdateHandlerNotImplemented) {
+		t.Errorf("StreamTo(mbr) = %v, want ErrUpdateHandlerNotImplemented", err)
+	}
+	if err := target.Switch(); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := target.BuildTimestamp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2024-08-27T19:00:26+02:00"; ts != want {
+		t.Errorf("BuildTimestamp() = %q, want %q", ts, want)
+	}
+	host.Close()
+	<-done
+
+	if got := string(streams["root"]); got != root {
+		t.Errorf("device received %d bytes of root, want %d bytes", len(got), len(root))
+	}
+}
+
+func TestReadFrameResync(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("garbage gA\x00\x00\x00\x01x1234 more garbage")
+	if err := WriteFrame(&buf, Frame{Type: TypeAck, Payload: []byte("ok")}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ReadFrame(NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != TypeAck || string(f.Payload) != "ok" {
+		t.Errorf("ReadFrame() = %q, %q, want Ack, ok", f.Type, f.Payload)
+	}
+	if _, err := ReadFrame(NewReader(&buf)); err != io.EOF {
+		t.Errorf("ReadFrame() at end = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,368 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/tools/internal/version"
+)
+
+// Exporter exports the spans and metrics of a Recorder.
+type Exporter struct {
+	// OTLPEndpoint, if non-empty, is the base URL of an OpenTelemetry
+	// collector (e.g. http://localhost:4318), to which spans are sent via
+	// POST /v1/traces and metrics via POST /v1/metrics.
+	OTLPEndpoint string
+
+	// OTLPHeaders are additional HTTP headers for OTLP requests, e.g. for
+	// authentication.
+	OTLPHeaders map[string]string
+
+	// Pushgateway, if non-empty, is the base URL of a Prometheus Pushgateway
+	// (e.g. http://localhost:9091), to which metrics are pushed with grouping
+	// key job=gok, instance=<instance>.
+	Pushgateway string
+
+	// Client is used for all requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// ParseHeaders parses headers in the format of the
+// OTEL_EXPORTER_OTLP_HEADERS environment variable: comma-separated key=value
+// pairs with URL-encoded values.
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q: expected key=value", kv)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid header %q: %v", kv, err)
+		}
+		headers[strings.TrimSpace(key)] = value
+	}
+	return headers, nil
+}
+
+// Enabled returns whether e exports anywhere.
+func (e *Exporter) Enabled() bool {
+	return e.OTLPEndpoint != "" || e.Pushgateway != ""
+}
+
+func (e *Exporter) client() *http.Client {
+	if e.Client != nil {
+		return e.Client
+	}
+	return http.DefaultClient
+}
+
+// Export exports the spans and metrics of r to all configured destinations.
+func (e *Exporter) Export(ctx context.Context, r *Recorder) error {
+	if e.OTLPEndpoint != "" {
+		base := strings.TrimSuffix(e.OTLPEndpoint, "/")
+		if err := e.post(ctx, base+"/v1/traces", otlpTraces(r)); err != nil {
+			return fmt.Errorf("exporting traces: %v", err)
+		}
+		if err := e.post(ctx, base+"/v1/metrics", otlpMetrics(r)); err != nil {
+			return fmt.Errorf("exporting metrics: %v", err)
+		}
+	}
+	if e.Pushgateway != "" {
+		if err := e.push(ctx, r); err != nil {
+			return fmt.Errorf("pushing metrics: %v", err)
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) do(req *http.Request) error {
+	resp, err := e.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: unexpected HTTP status: %v: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+func (e *Exporter) post(ctx context.Context, u string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.OTLPHeaders {
+		req.Header.Set(key, value)
+	}
+	return e.do(req)
+}
+
+func (e *Exporter) push(ctx context.Context, r *Recorder) error {
+	var buf bytes.Buffer
+	WritePrometheus(&buf, r.Metrics())
+	u := strings.TrimSuffix(e.Pushgateway, "/") + "/metrics/job/gok/instance/" + url.PathEscape(r.Instance)
+	// PUT replaces all metrics of the grouping key, so that metrics of
+	// stages or packages which the last operation did not have disappear.
+	req, err := http.NewRequestWithContext(ctx, "PUT", u, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	return e.do(req)
+}
+
+// WritePrometheus writes the Gauge metrics in the Prometheus text exposition
+// format to w.
+func WritePrometheus(w io.Writer, metrics []Metric) {
+	for _, m := range metrics {
+		if m.Kind != Gauge {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", m.Name, m.Help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", m.Name)
+		for _, p := range m.Points {
+			fmt.Fprintf(w, "%s%s %s\n", m.Name, promLabels(p.Labels), strconv.FormatFloat(p.Value, 'g', -1, 64))
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels))
+	for _, key := range sortedKeys(labels) {
+		parts = append(parts, key+`="`+promEscaper.Replace(labels[key])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// The following types implement the JSON encoding of OTLP (see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding), which
+// encodes trace and span IDs as hex strings and 64-bit integers as strings.
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+func otlpAttributes(m map[string]string) []otlpKeyValue {
+	attrs := make([]otlpKeyValue, 0, len(m))
+	for _, key := range sortedKeys(m) {
+		attrs = append(attrs, otlpKeyValue{Key: key, Value: otlpValue{StringValue: m[key]}})
+	}
+	return attrs
+}
+
+func resource(r *Recorder) otlpResource {
+	return otlpResource{Attributes: otlpAttributes(map[string]string{
+		"service.name":     "gok",
+		"service.version":  version.ReadBrief(),
+		"gokrazy.instance": r.Instance,
+	})}
+}
+
+var scope = otlpScope{Name: "github.com/gokrazy/tools"}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0: unset, 1: ok, 2: error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"` // 1: internal
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpTraces(r *Recorder) *otlpTraceRequest {
+	var spans []otlpSpan
+	for _, s := range r.Spans() {
+		end := s.End
+		if end.IsZero() {
+			end = s.Start
+		}
+		status := otlpStatus{Code: 1}
+		if s.Error != "" {
+			status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		spans = append(spans, otlpSpan{
+			TraceID:           r.TraceID(),
+			SpanID:            s.ID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              1,
+			StartTimeUnixNano: unixNano(s.Start),
+			EndTimeUnixNano:   unixNano(end),
+			Attributes:        otlpAttributes(s.Attrs),
+			Status:            status,
+		})
+	}
+	return &otlpTraceRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: resource(r),
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: scope,
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+	AsInt             string         `json:"asInt,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"` // 1: delta
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+func otlpMetrics(r *Recorder) *otlpMetricsRequest {
+	spans := r.Spans()
+	start, end := spans[0].Start, spans[0].End
+	if end.IsZero() {
+		end = r.now()
+	}
+	var metrics []otlpMetric
+	for _, m := range r.Metrics() {
+		om := otlpMetric{
+			Name:        m.Name,
+			Description: m.Help,
+			Unit:        m.Unit,
+		}
+		var points []otlpDataPoint
+		for _, p := range m.Points {
+			dp := otlpDataPoint{
+				Attributes:   otlpAttributes(p.Labels),
+				TimeUnixNano: unixNano(end),
+			}
+			switch m.Kind {
+			case DeltaCounter:
+				dp.StartTimeUnixNano = unixNano(start)
+				dp.AsInt = strconv.FormatInt(int64(math.Round(p.Value)), 10)
+			default:
+				v := p.Value
+				dp.AsDouble = &v
+			}
+			points = append(points, dp)
+		}
+		switch m.Kind {
+		case DeltaCounter:
+			om.Sum = &otlpSum{DataPoints: points, AggregationTemporality: 1, IsMonotonic: true}
+		default:
+			om.Gauge = &otlpGauge{DataPoints: points}
+		}
+		metrics = append(metrics, om)
+	}
+	return &otlpMetricsRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: resource(r),
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   scope,
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
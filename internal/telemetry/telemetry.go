@@ -0,0 +1,334 @@
+// Package telemetry records the build events of a gok operation (see
+// packer.Event) as spans and metrics, and exports them to an OpenTelemetry
+// collector (OTLP over HTTP, JSON encoding) or a Prometheus Pushgateway, so
+// that teams running gok in CI or fleet automation can monitor build
+// durations, upload throughput and failures over time.
+package telemetry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/tools/internal/packer"
+)
+
+// Span is a timed part of a gok operation, e.g. a stage or the build of a Go
+// package.
+type Span struct {
+	ID       string // 16 hex digits
+	ParentID string // empty for the root span
+	Name     string
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+	Error    string
+}
+
+// MetricKind is the kind of a Metric.
+type MetricKind int
+
+const (
+	// Gauge metrics describe the last operation, e.g. its duration.
+	Gauge MetricKind = iota
+
+	// DeltaCounter metrics count occurrences within the operation, e.g. 1
+	// for a failed operation. They are only exported via OTLP (with delta
+	// temporality), as the Pushgateway keeps only the last push.
+	DeltaCounter
+)
+
+// Metric is a named set of data points.
+type Metric struct {
+	Name   string
+	Help   string
+	Unit   string
+	Kind   MetricKind
+	Points []Point
+}
+
+// Point is a data point of a Metric.
+type Point struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Recorder records the events of one gok operation (e.g. gok update) of an
+// instance. Its OnEvent method is a packer.Pack.OnEvent handler.
+type Recorder struct {
+	Operation string // e.g. update
+	Instance  string
+
+	now func() time.Time // for testing
+
+	mu        sync.Mutex
+	traceID   string
+	root      *Span
+	stage     *Span
+	stages    []*Span
+	packages  map[string]*Span
+	pkgOrder  []*Span
+	uploads   []*Span
+	uploadLen map[string]uint64
+	finished  bool
+}
+
+// NewRecorder returns a Recorder for operation of instance. The operation
+// starts now.
+func NewRecorder(operation, instance string) *Recorder {
+	r := &Recorder{
+		Operation: operation,
+		Instance:  instance,
+		now:       time.Now,
+	}
+	r.init()
+	return r
+}
+
+func (r *Recorder) init() {
+	r.traceID = randomID(16)
+	r.root = &Span{
+		ID:    randomID(8),
+		Name:  "gok " + r.Operation,
+		Start: r.now(),
+		Attrs: map[string]string{"gokrazy.instance": r.Instance},
+	}
+	r.packages = make(map[string]*Span)
+	r.uploadLen = make(map[string]uint64)
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+func (r *Recorder) child(parent *Span, name string, start time.Time) *Span {
+	return &Span{
+		ID:       randomID(8),
+		ParentID: parent.ID,
+		Name:     name,
+		Start:    start,
+		Attrs:    make(map[string]string),
+	}
+}
+
+// OnEvent records ev.
+func (r *Recorder) OnEvent(ev packer.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := ev.Time
+	if t.IsZero() {
+		t = r.now()
+	}
+	switch ev.Type {
+	case packer.EventStage:
+		if r.stage != nil {
+			r.stage.End = t
+		}
+		r.stage = nil
+		if ev.Stage == packer.StageDone {
+			return
+		}
+		r.stage = r.child(r.root, string(ev.Stage), t)
+		r.stage.Attrs["gok.stage"] = string(ev.Stage)
+		r.stages = append(r.stages, r.stage)
+
+	case packer.EventPackageStarted:
+		parent := r.root
+		if r.stage != nil {
+			parent = r.stage
+		}
+		s := r.child(parent, "build "+ev.Package, t)
+		s.Attrs["go.package"] = ev.Package
+		r.packages[ev.Package] = s
+		r.pkgOrder = append(r.pkgOrder, s)
+
+	case packer.EventPackageBuilt:
+		s, ok := r.packages[ev.Package]
+		if !ok {
+			return
+		}
+		s.End = t
+		s.Error = ev.Error
+
+	case packer.EventSBOM:
+		r.root.Attrs["gokrazy.sbom_hash"] = ev.SBOMHash
+
+	case packer.EventUpload:
+		parent, start := r.root, r.root.Start
+		if r.stage != nil && r.stage.Name == string(packer.StageUpload) {
+			parent, start = r.stage, r.stage.Start
+		}
+		s := r.child(parent, "upload "+ev.Stream, start)
+		s.End = t
+		s.Attrs["gok.stream"] = ev.Stream
+		r.uploads = append(r.uploads, s)
+		r.uploadLen[s.ID] = ev.Bytes
+
+	case packer.EventResult:
+		r.finish(t, ev.Error)
+	}
+}
+
+func (r *Recorder) finish(t time.Time, errStr string) {
+	if r.finished {
+		return
+	}
+	r.finished = true
+	r.root.End = t
+	r.root.Error = errStr
+	if r.stage != nil {
+		r.stage.End = t
+		r.stage.Error = errStr
+		r.stage = nil
+	}
+	for _, s := range r.pkgOrder {
+		if s.End.IsZero() {
+			s.End = t
+			s.Error = "canceled"
+		}
+	}
+}
+
+// Finish ends the operation with err (nil on success), unless an
+// EventResult already ended it, e.g. when the operation failed before the
+// packer started.
+func (r *Recorder) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+	r.finish(r.now(), errStr)
+}
+
+// Spans returns the root span, followed by all other spans in the order in
+// which they started.
+func (r *Recorder) Spans() []Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := []Span{*r.root}
+	for _, list := range [][]*Span{r.stages, r.pkgOrder, r.uploads} {
+		for _, s := range list {
+			spans = append(spans, *s)
+		}
+	}
+	sort.SliceStable(spans[1:], func(i, j int) bool {
+		return spans[1+i].Start.Before(spans[1+j].Start)
+	})
+	return spans
+}
+
+// TraceID returns the trace ID (32 hex digits) of the operation.
+func (r *Recorder) TraceID() string {
+	return r.traceID
+}
+
+// Metrics returns the metrics of the operation. Every data point has an
+// operation label.
+func (r *Recorder) Metrics() []Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	labels := func(kv ...string) map[string]string {
+		m := map[string]string{"operation": r.Operation}
+		for i := 0; i+1 < len(kv); i += 2 {
+			m[kv[i]] = kv[i+1]
+		}
+		return m
+	}
+	var success, failed float64 = 1, 0
+	if r.root.Error != "" {
+		success, failed = 0, 1
+	}
+	end := r.root.End
+	if end.IsZero() {
+		end = r.now()
+	}
+	metrics := []Metric{
+		{
+			Name:   "gok_operation_duration_seconds",
+			Help:   "Duration of the last gok operation.",
+			Unit:   "s",
+			Points: []Point{{Labels: labels(), Value: end.Sub(r.root.Start).Seconds()}},
+		},
+		{
+			Name:   "gok_operation_success",
+			Help:   "Whether the last gok operation succeeded (1) or failed (0).",
+			Points: []Point{{Labels: labels(), Value: success}},
+		},
+		{
+			Name:   "gok_operation_timestamp_seconds",
+			Help:   "Unix time at which the last gok operation ended.",
+			Unit:   "s",
+			Points: []Point{{Labels: labels(), Value: float64(end.UnixNano()) / 1e9}},
+		},
+		{
+			Name:   "gok_operation_failures_total",
+			Help:   "Number of failed gok operations.",
+			Kind:   DeltaCounter,
+			Points: []Point{{Labels: labels(), Value: failed}},
+		},
+	}
+
+	stages := Metric{
+		Name: "gok_stage_duration_seconds",
+		Help: "Duration of each stage of the last gok operation.",
+		Unit: "s",
+	}
+	for _, s := range r.stages {
+		if s.End.IsZero() {
+			continue
+		}
+		stages.Points = append(stages.Points, Point{
+			Labels: labels("stage", s.Attrs["gok.stage"]),
+			Value:  s.End.Sub(s.Start).Seconds(),
+		})
+	}
+
+	packages := Metric{
+		Name: "gok_package_build_duration_seconds",
+		Help: "Duration of building each Go package in the last gok operation.",
+		Unit: "s",
+	}
+	for _, s := range r.pkgOrder {
+		if s.End.IsZero() || s.Error != "" {
+			continue
+		}
+		packages.Points = append(packages.Points, Point{
+			Labels: labels("package", s.Attrs["go.package"]),
+			Value:  s.End.Sub(s.Start).Seconds(),
+		})
+	}
+
+	uploadBytes := Metric{
+		Name: "gok_upload_bytes",
+		Help: "Bytes uploaded per stream (e.g. root, boot) in the last gok operation.",
+		Unit: "By",
+	}
+	throughput := Metric{
+		Name: "gok_upload_throughput_bytes_per_second",
+		Help: "Upload throughput per stream in the last gok operation.",
+		Unit: "By/s",
+	}
+	for _, s := range r.uploads {
+		n := r.uploadLen[s.ID]
+		l := labels("stream", s.Attrs["gok.stream"])
+		uploadBytes.Points = append(uploadBytes.Points, Point{Labels: l, Value: float64(n)})
+		if d := s.End.Sub(s.Start).Seconds(); d > 0 {
+			throughput.Points = append(throughput.Points, Point{Labels: l, Value: float64(n) / d})
+		}
+	}
+
+	for _, m := range []Metric{stages, packages, uploadBytes, throughput} {
+		if len(m.Points) > 0 {
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics
+}
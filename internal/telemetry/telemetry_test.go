@@ -0,0 +1,202 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/google/go-cmp/cmp"
+)
+
+var t0 = time.Date(2024, 9, 1, 3, 0, 0, 0, time.UTC)
+
+func at(sec float64) time.Time {
+	return t0.Add(time.Duration(sec * float64(time.Second)))
+}
+
+// record returns a recorder which recorded a typical gok update.
+func record(t *testing.T, result string) *Recorder {
+	t.Helper()
+	r := &Recorder{
+		Operation: "update",
+		Instance:  "scanner",
+		now:       func() time.Time { return t0 },
+	}
+	r.init()
+	for _, ev := range []packer.Event{
+		{Type: packer.EventStage, Stage: packer.StageBuild, Time: at(0)},
+		{Type: packer.EventPackageStarted, Package: "github.com/gokrazy/hello", Time: at(1)},
+		{Type: packer.EventPackageStarted, Package: "github.com/gokrazy/breakglass", Time: at(1)},
+		{Type: packer.EventPackageBuilt, Package: "github.com/gokrazy/hello", Time: at(3)},
+		{Type: packer.EventPackageBuilt, Package: "github.com/gokrazy/breakglass", Time: at(5)},
+		{Type: packer.EventSBOM, SBOMHash: "abc", Time: at(5)},
+		{Type: packer.EventStage, Stage: packer.StageUpload, Time: at(10)},
+		{Type: packer.EventUpload, Stream: "root", Bytes: 8 << 20, Time: at(14)},
+		{Type: packer.EventUpload, Stream: "boot", Bytes: 1 << 20, Time: at(12)},
+		{Type: packer.EventStage, Stage: packer.StageReboot, Time: at(14)},
+		{Type: packer.EventStage, Stage: packer.StageDone, Time: at(20)},
+		{Type: packer.EventResult, Error: result, Time: at(20)},
+	} {
+		r.OnEvent(ev)
+	}
+	return r
+}
+
+func TestSpans(t *testing.T) {
+	r := record(t, "")
+	spans := r.Spans()
+	var got []string
+	byID := make(map[string]Span)
+	for _, s := range spans {
+		byID[s.ID] = s
+	}
+	for _, s := range spans {
+		parent := "-"
+		if s.ParentID != "" {
+			parent = byID[s.ParentID].Name
+		}
+		got = append(got, s.Name+" <- "+parent+" "+s.End.Sub(s.Start).String())
+	}
+	want := []string{
+		"gok update <- - 20s",
+		"build <- gok update 10s",
+		"build github.com/gokrazy/hello <- build 2s",
+		"build github.com/gokrazy/breakglass <- build 4s",
+		"upload <- gok update 4s",
+		"upload root <- upload 4s",
+		"upload boot <- upload 2s",
+		"reboot <- gok update 6s",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Spans: unexpected diff (-want +got):\n%s", diff)
+	}
+	if got, want := spans[0].Attrs["gokrazy.sbom_hash"], "abc"; got != want {
+		t.Errorf("root span sbom hash = %q, want %q", got, want)
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	WritePrometheus(&buf, record(t, "device did not become healthy").Metrics())
+	got := buf.String()
+	for _, want := range []string{
+		`gok_operation_duration_seconds{operation="update"} 20`,
+		`gok_operation_success{operation="update"} 0`,
+		`gok_stage_duration_seconds{operation="update",stage="build"} 10`,
+		`gok_package_build_duration_seconds{operation="update",package="github.com/gokrazy/breakglass"} 4`,
+		`gok_upload_bytes{operation="update",stream="root"} 8.388608e+06`,
+		`gok_upload_throughput_bytes_per_second{operation="update",stream="boot"} 524288`,
+		"# TYPE gok_operation_success gauge",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Prometheus output does not contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "gok_operation_failures_total") {
+		t.Errorf("Prometheus output unexpectedly contains delta counter gok_operation_failures_total:\n%s", got)
+	}
+}
+
+func TestFinishWithoutResult(t *testing.T) {
+	r := &Recorder{Operation: "update", Instance: "scanner", now: func() time.Time { return at(3) }}
+	r.init()
+	r.root.Start = t0
+	r.OnEvent(packer.Event{Type: packer.EventStage, Stage: packer.StageBuild, Time: at(1)})
+	r.OnEvent(packer.Event{Type: packer.EventPackageStarted, Package: "hello", Time: at(2)})
+	r.Finish(context.Canceled)
+	for _, s := range r.Spans() {
+		if s.End.IsZero() {
+			t.Errorf("span %q did not end", s.Name)
+		}
+		if s.Error == "" {
+			t.Errorf("span %q has no error", s.Name)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]string)
+		auth     string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests[r.Method+" "+r.URL.Path] = string(b)
+		if r.URL.Path == "/v1/traces" {
+			auth = r.Header.Get("Authorization")
+		}
+	}))
+	defer srv.Close()
+
+	headers, err := ParseHeaders("Authorization=Bearer%20secret, X-Empty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Exporter{
+		OTLPEndpoint: srv.URL + "/",
+		OTLPHeaders:  headers,
+		Pushgateway:  srv.URL,
+	}
+	if err := e.Export(context.Background(), record(t, "")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := auth, "Bearer secret"; got != want {
+		t.Errorf("Authorization header = %q, want %q", got, want)
+	}
+
+	var traces otlpTraceRequest
+	if err := json.Unmarshal([]byte(requests["POST /v1/traces"]), &traces); err != nil {
+		t.Fatal(err)
+	}
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if got, want := len(spans), 8; got != want {
+		t.Fatalf("exported %d spans, want %d", got, want)
+	}
+	if got := spans[0]; len(got.TraceID) != 32 || len(got.SpanID) != 16 || got.ParentSpanID != "" {
+		t.Errorf("root span has unexpected IDs: %+v", got)
+	}
+	if got, want := spans[0].EndTimeUnixNano, "1725159620000000000"; got != want {
+		t.Errorf("root span end = %s, want %s", got, want)
+	}
+
+	var metrics otlpMetricsRequest
+	if err := json.Unmarshal([]byte(requests["POST /v1/metrics"]), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	var failures *otlpMetric
+	for idx, m := range metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		if m.Name == "gok_operation_failures_total" {
+			failures = &metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics[idx]
+		}
+	}
+	if failures == nil || failures.Sum == nil {
+		t.Fatalf("gok_operation_failures_total not exported as sum")
+	}
+	if got, want := failures.Sum.DataPoints[0].AsInt, "0"; got != want {
+		t.Errorf("gok_operation_failures_total = %s, want %s", got, want)
+	}
+
+	if got := requests["PUT /metrics/job/gok/instance/scanner"]; !strings.Contains(got, "gok_operation_success") {
+		t.Errorf("pushed metrics do not contain gok_operation_success:\n%s", got)
+	}
+}
+
+func TestParseHeadersError(t *testing.T) {
+	if _, err := ParseHeaders("novalue"); err == nil {
+		t.Errorf("ParseHeaders(novalue) = nil error, want error")
+	}
+}
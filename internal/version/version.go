@@ -54,3 +54,14 @@ func ReadBrief() string {
 	}
 	return "g" + revision + modifiedSuffix
 }
+
+// Module returns the module version of the running binary, e.g.
+// v0.0.0-20230107144322-7a5757f46310, or (devel) when built from a local
+// checkout.
+func Module() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	return info.Main.Version
+}
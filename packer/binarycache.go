@@ -0,0 +1,114 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// BinaryCache stores built programs by a key which covers all inputs of
+// their build, so that BuildEnv can skip building programs whose inputs did
+// not change since they were last built (see BuildEnv.Cache). Unlike the
+// build cache of the go command, which skips compiling unchanged packages,
+// BinaryCache skips running go build (including linking) altogether.
+type BinaryCache interface {
+	// InputsHash returns a hash of the inputs of builds in buildDir which
+	// are not part of the go build command line: the module graph (go.mod,
+	// go.sum, go.work, vendor/modules.txt) and the sources of modules which
+	// are replaced by local directories or used from a workspace.
+	InputsHash(buildDir string) (string, error)
+
+	// Get copies the program stored under key to dest and returns true, or
+	// returns false if there is no such program.
+	Get(key, dest string) (bool, error)
+
+	// Put stores the program at src under key.
+	Put(key, src string) error
+}
+
+// cacheEnvNames are the environment variables which affect the output of go
+// build, see cacheEnv. Other GO* variables (e.g. GOPATH, GOCACHE, GOPROXY)
+// only change where and how go build finds its inputs, which are already
+// covered by the toolchain version and BinaryCache.InputsHash.
+var cacheEnvNames = map[string]bool{
+	"GOOS":         true,
+	"GOARCH":       true,
+	"GOARM":        true,
+	"GOAMD64":      true,
+	"GOEXPERIMENT": true,
+	"GOFLAGS":      true,
+	"GOTOOLCHAIN":  true,
+	"CC":           true,
+	"CXX":          true,
+	"AR":           true,
+}
+
+// cacheEnvPrefixes are the prefixes of further environment variables which
+// affect the output of go build, see cacheEnv.
+var cacheEnvPrefixes = []string{
+	"CGO_",
+	"PKG_CONFIG",
+}
+
+// cacheEnvVar reports whether the environment variable key affects the
+// output of go build.
+func cacheEnvVar(key string) bool {
+	if cacheEnvNames[key] {
+		return true
+	}
+	for _, prefix := range cacheEnvPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheEnv returns the (sorted, deduplicated) variables of env which affect
+// the output of go build, so that unrelated variables (e.g. SSH_AUTH_SOCK or
+// GOPATH) do not prevent reusing cached programs.
+func cacheEnv(env []string) []string {
+	vars := make(map[string]string)
+	for _, e := range env {
+		key, _, _ := strings.Cut(e, "=")
+		if cacheEnvVar(key) {
+			vars[key] = e // later values take precedence, like in os/exec
+		}
+	}
+	filtered := make([]string, 0, len(vars))
+	for _, e := range vars {
+		filtered = append(filtered, e)
+	}
+	sort.Strings(filtered)
+	return filtered
+}
+
+// binaryCacheKey returns the BinaryCache key for running go build with args
+// (which include the import path and output-independent flags) and env,
+// using the Go toolchain goVersion, in a builddir whose inputs hash to
+// inputsHash.
+func binaryCacheKey(goVersion, inputsHash string, env, args []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "gokrazy binary cache v1\n%s\n%s\n", goVersion, inputsHash)
+	for _, e := range cacheEnv(env) {
+		fmt.Fprintf(h, "env %q\n", e)
+	}
+	for _, arg := range args {
+		fmt.Fprintf(h, "arg %q\n", arg)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// goVersion returns the version of the Go toolchain selected by env, e.g.
+// go1.22.4 (GOTOOLCHAIN is taken into account).
+func goVersion(env []string) (string, error) {
+	cmd := exec.Command("go", "env", "GOVERSION")
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
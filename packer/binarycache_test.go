@@ -0,0 +1,55 @@
+package packer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCacheEnv(t *testing.T) {
+	env := []string{
+		"HOME=/home/michael",
+		"SSH_AUTH_SOCK=/tmp/ssh-agent",
+		"GOARCH=amd64",
+		"CGO_ENABLED=0",
+		"GOARCH=arm64", // later values take precedence
+		"CC=clang",
+	}
+	want := []string{"CC=clang", "CGO_ENABLED=0", "GOARCH=arm64"}
+	if got := cacheEnv(env); !reflect.DeepEqual(got, want) {
+		t.Errorf("cacheEnv() = %q, want %q", got, want)
+	}
+}
+
+func TestBinaryCacheKey(t *testing.T) {
+	env := []string{"GOARCH=arm64", "GOOS=linux"}
+	args := []string{"build", "-mod=mod", "-tags=gokrazy", "github.com/gokrazy/hello"}
+	key := binaryCacheKey("go1.22.4", "inputs", env, args)
+
+	if got := binaryCacheKey("go1.22.4", "inputs", append([]string{"TERM=xterm"}, env...), args); got != key {
+		t.Errorf("key changed by unrelated environment variable")
+	}
+	for _, e := range []string{
+		"GOPATH=/home/michael/go",
+		"GOMODCACHE=/home/michael/go/pkg/mod",
+		"GOCACHE=/home/michael/.cache/go-build",
+		"GOROOT=/usr/local/go",
+		"GOPROXY=off",
+		"GOKRAZY_PARENT_DIR=/home/michael/gokrazy",
+	} {
+		if got := binaryCacheKey("go1.22.4", "inputs", append([]string{e}, env...), args); got != key {
+			t.Errorf("key changed by %s", e)
+		}
+	}
+	for name, other := range map[string]string{
+		"toolchain": binaryCacheKey("go1.22.5", "inputs", env, args),
+		"inputs":    binaryCacheKey("go1.22.4", "changed", env, args),
+		"target":    binaryCacheKey("go1.22.4", "inputs", []string{"GOARCH=amd64", "GOOS=linux"}, args),
+		"goarm":     binaryCacheKey("go1.22.4", "inputs", append([]string{"GOARM=7"}, env...), args),
+		"cgo":       binaryCacheKey("go1.22.4", "inputs", append([]string{"CGO_ENABLED=1"}, env...), args),
+		"tags":      binaryCacheKey("go1.22.4", "inputs", env, []string{"build", "-mod=mod", "-tags=gokrazy,debug", "github.com/gokrazy/hello"}),
+	} {
+		if other == key {
+			t.Errorf("key not changed by %s", name)
+		}
+	}
+}
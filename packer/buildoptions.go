@@ -0,0 +1,62 @@
+package packer
+
+import "strings"
+
+// BuildOptions are go build options which apply to all packages, in addition
+// to the per-package build flags (GoBuildFlags).
+type BuildOptions struct {
+	// Trimpath removes file system paths from the binaries (-trimpath),
+	// which makes builds reproducible across machines.
+	Trimpath bool
+
+	// StripDebug omits the symbol table and DWARF debug information from the
+	// binaries (-ldflags=-s -w), which makes them considerably smaller.
+	StripDebug bool
+
+	// BuildMode, if non-empty, is passed as -buildmode (e.g. pie).
+	BuildMode string
+}
+
+// stripLdflags are the linker flags for StripDebug.
+const stripLdflags = "-s -w"
+
+// Flags returns the go build flags for o, merged with packageFlags: the
+// per-package flags come last, so that they take precedence. As the go
+// command only uses the last -ldflags flag, the StripDebug linker flags are
+// prepended to the -ldflags of packageFlags instead of being overridden.
+func (o *BuildOptions) Flags(packageFlags []string) []string {
+	if o == nil {
+		return packageFlags
+	}
+	var flags []string
+	if o.Trimpath {
+		flags = append(flags, "-trimpath")
+	}
+	if o.BuildMode != "" {
+		flags = append(flags, "-buildmode="+o.BuildMode)
+	}
+	if !o.StripDebug {
+		return append(flags, packageFlags...)
+	}
+	merged := false
+	rest := make([]string, 0, len(packageFlags))
+	for idx := 0; idx < len(packageFlags); idx++ {
+		flag := packageFlags[idx]
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(flag, "-"), "=")
+		if strings.TrimPrefix(name, "-") != "ldflags" {
+			rest = append(rest, flag)
+			continue
+		}
+		if !hasValue && idx+1 < len(packageFlags) {
+			// -ldflags "-X main.version=1" (separate value)
+			idx++
+			value = packageFlags[idx]
+		}
+		rest = append(rest, "-ldflags="+stripLdflags+" "+value)
+		merged = true
+	}
+	if !merged {
+		flags = append(flags, "-ldflags="+stripLdflags)
+	}
+	return append(flags, rest...)
+}
@@ -2,6 +2,7 @@ package packer
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -29,50 +30,98 @@ func DefaultTags() []string {
 	}
 }
 
-func TargetArch() string {
-	if arch := os.Getenv("GOARCH"); arch != "" {
-		return arch
+// Target is the platform for which to build Go programs.
+type Target struct {
+	GOOS   string // defaults to linux
+	GOARCH string // defaults to arm64 (Raspberry Pi 3, 4, Zero 2 W)
+	GOARM  string // only used with GOARCH=arm, e.g. 7
+}
+
+// TargetFromEnv returns the Target selected by the GOOS, GOARCH and GOARM
+// environment variables, falling back to def for unset variables and to the
+// defaults (linux/arm64) if def does not specify a field either.
+func TargetFromEnv(def Target) Target {
+	t := def
+	for _, v := range []struct {
+		key   string
+		field *string
+	}{
+		{"GOOS", &t.GOOS},
+		{"GOARCH", &t.GOARCH},
+		{"GOARM", &t.GOARM},
+	} {
+		if val := os.Getenv(v.key); val != "" {
+			*v.field = val
+		}
+	}
+	if t.GOOS == "" {
+		t.GOOS = "linux" // Raspberry Pi 3, 4, Zero 2 W
+	}
+	if t.GOARCH == "" {
+		t.GOARCH = "arm64" // Raspberry Pi 3, 4, Zero 2 W
 	}
-	return "arm64" // Raspberry Pi 3, 4, Zero 2 W
+	return t
 }
 
-var (
-	envOnce sync.Once
-	env     []string
-)
+func (t Target) String() string {
+	if t.GOARM != "" {
+		return t.GOOS + "/" + t.GOARCH + "/v" + t.GOARM
+	}
+	return t.GOOS + "/" + t.GOARCH
+}
 
-func goEnv() []string {
-	goarch := TargetArch()
+// Env returns the environment for go commands that build for t, see GoEnv.
+func (t Target) Env() []string {
+	return GoEnv(t, "")
+}
 
-	goos := "linux" // Raspberry Pi 3, 4, Zero 2 W
-	if e := os.Getenv("GOOS"); e != "" {
-		goos = e
-	}
+func TargetArch() string {
+	return TargetFromEnv(Target{}).GOARCH
+}
 
+// GoEnv returns the environment for go commands that build for t, based on
+// the process environment. GOOS, GOARCH and GOARM are taken from t only: a
+// GOARM of the process environment is dropped, as it might refer to another
+// GOARCH than t (TargetFromEnv includes it where applicable). If goToolchain
+// is non-empty (e.g. go1.22.4), GOTOOLCHAIN selects that Go toolchain. The
+// extra environment variables (KEY=VALUE, e.g. GOPROXY=off) take precedence
+// over the process environment.
+func GoEnv(t Target, goToolchain string, extra ...string) []string {
 	cgoEnabledFound := false
-	env := os.Environ()
-	for idx, e := range env {
+	var env []string
+	for _, e := range os.Environ() {
 		if strings.HasPrefix(e, "CGO_ENABLED=") {
 			cgoEnabledFound = true
 		}
 		if strings.HasPrefix(e, "GOBIN=") {
-			env[idx] = "GOBIN="
+			e = "GOBIN="
 		}
+		if strings.HasPrefix(e, "GOARM=") {
+			continue
+		}
+		env = append(env, e)
 	}
 	if !cgoEnabledFound {
 		env = append(env, "CGO_ENABLED=0")
 	}
+	if goToolchain != "" {
+		env = append(env, "GOTOOLCHAIN="+goToolchain)
+	}
+	if t.GOARM != "" {
+		env = append(env, "GOARM="+t.GOARM)
+	}
+	env = append(env, extra...)
 	return append(env,
-		fmt.Sprintf("GOARCH=%s", goarch),
-		fmt.Sprintf("GOOS=%s", goos),
+		fmt.Sprintf("GOARCH=%s", t.GOARCH),
+		fmt.Sprintf("GOOS=%s", t.GOOS),
 		"GOBIN=")
 }
 
+// Env returns the environment for go commands that build for the Target
+// selected by the environment (see TargetFromEnv). The environment is read
+// on every call, so changes (e.g. of GOARCH) take effect immediately.
 func Env() []string {
-	envOnce.Do(func() {
-		env = goEnv()
-	})
-	return env
+	return TargetFromEnv(Target{}).Env()
 }
 
 func InitDeps(initPkg string) []string {
@@ -84,6 +133,13 @@ func InitDeps(initPkg string) []string {
 }
 
 func BuildDir(importPath string) string {
+	return InstanceBuildDir("", importPath)
+}
+
+// InstanceBuildDir is like BuildDir, but returns the builddir of importPath
+// within the gokrazy instance directory instanceDir instead of the working
+// directory.
+func InstanceBuildDir(instanceDir, importPath string) string {
 	importPath = strings.TrimSuffix(importPath, "/...")
 	buildDir := filepath.Join("builddir", importPath)
 
@@ -98,16 +154,46 @@ func BuildDir(importPath string) string {
 	// - a single builddir, preserving behavior of older gokrazy
 	parts := strings.Split(buildDir, string(os.PathSeparator))
 	for idx := len(parts); idx > 0; idx-- {
-		dir := strings.Join(parts[:idx], string(os.PathSeparator))
+		dir := filepath.Join(instanceDir, strings.Join(parts[:idx], string(os.PathSeparator)))
 		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
 			return dir
 		}
 	}
-	return buildDir
+	return filepath.Join(instanceDir, buildDir)
+}
+
+// UsesWorkspace returns true if go commands in buildDir run in workspace
+// mode, i.e. buildDir contains a go.work file (see gok work) or the GOWORK
+// environment variable selects a go.work file.
+func UsesWorkspace(buildDir string) bool {
+	switch gowork := os.Getenv("GOWORK"); gowork {
+	case "off":
+		return false
+	case "":
+		_, err := os.Stat(filepath.Join(buildDir, "go.work"))
+		return err == nil
+	default:
+		return true
+	}
+}
+
+// ModFlags returns the -mod flag for go commands in buildDir: -mod=mod
+// allows go commands to update go.mod, but cannot be used in workspace mode.
+func ModFlags(buildDir string) []string {
+	if UsesWorkspace(buildDir) {
+		return nil
+	}
+	return []string{"-mod=mod"}
 }
 
 func BuildDirOrMigrate(importPath string) (string, error) {
-	buildDir := BuildDir(importPath)
+	return InstanceBuildDirOrMigrate("", importPath)
+}
+
+// InstanceBuildDirOrMigrate is like BuildDirOrMigrate, but for the gokrazy
+// instance directory instanceDir instead of the working directory.
+func InstanceBuildDirOrMigrate(instanceDir, importPath string) (string, error) {
+	buildDir := InstanceBuildDir(instanceDir, importPath)
 
 	// Create and bootstrap a per-package builddir/ by copying go.mod
 	// from the root if there is no go.mod in the builddir yet.
@@ -117,13 +203,13 @@ func BuildDirOrMigrate(importPath string) (string, error) {
 	goMod := filepath.Join(buildDir, "go.mod")
 	goSum := filepath.Join(buildDir, "go.sum")
 	if _, err := os.Stat(goMod); os.IsNotExist(err) {
-		rootGoMod, err := os.ReadFile("go.mod")
+		rootGoMod, err := os.ReadFile(filepath.Join(instanceDir, "go.mod"))
 		if err != nil && !os.IsNotExist(err) {
 			return "", err
 		}
 		migrating := err == nil // root go.mod exists
 
-		wd, err := os.Getwd()
+		wd, err := filepath.Abs(instanceDir)
 		if err != nil {
 			return "", err
 		}
@@ -178,7 +264,7 @@ func BuildDirOrMigrate(importPath string) (string, error) {
 			log.Printf("Migrated go.mod to %s, see https://gokrazy.org/development/modules/", goMod)
 		}
 
-		rootGoSum, err := os.ReadFile("go.sum")
+		rootGoSum, err := os.ReadFile(filepath.Join(instanceDir, "go.sum"))
 		if err != nil && !os.IsNotExist(err) {
 			return "", err
 		}
@@ -189,9 +275,9 @@ func BuildDirOrMigrate(importPath string) (string, error) {
 	return buildDir, nil
 }
 
-func warnWithoutProxy() {
+func warnWithoutProxy(env []string) {
 	goproxy := exec.Command("go", "env", "GOPROXY")
-	goproxy.Env = Env()
+	goproxy.Env = env
 	goproxy.Stderr = os.Stderr
 	if logExec {
 		log.Printf("getIncomplete: %v", goproxy.Args)
@@ -210,8 +296,8 @@ func warnWithoutProxy() {
 		"go env -w GOPROXY=https://proxy.golang.org,direct")
 }
 
-func getIncomplete(buildDir string, incomplete []string) error {
-	warnWithoutProxy()
+func getIncomplete(env []string, buildDir string, incomplete []string) error {
+	warnWithoutProxy(env)
 
 	log.Printf("getting incomplete packages %v", incomplete)
 	cmd := exec.Command("go",
@@ -219,7 +305,7 @@ func getIncomplete(buildDir string, incomplete []string) error {
 			"get",
 		}, incomplete...)...)
 	cmd.Dir = buildDir
-	cmd.Env = Env()
+	cmd.Env = env
 	cmd.Stderr = os.Stderr
 	if logExec {
 		log.Printf("getIncomplete: %v (in %s)", cmd.Args, buildDir)
@@ -230,17 +316,15 @@ func getIncomplete(buildDir string, incomplete []string) error {
 	return nil
 }
 
-func getPkg(buildDir string, pkg string) error {
+func getPkg(env []string, buildDir string, pkg string) error {
 	// run “go get” for incomplete packages (most likely just not present)
 	cmd := exec.Command("go",
-		append([]string{
-			"list",
-			"-mod=mod",
+		append(append([]string{"list"}, ModFlags(buildDir)...),
 			"-e",
 			"-tags", "gokrazy",
 			"-f", "{{ .ImportPath }} {{ if .Incomplete }}error{{ else }}ok{{ end }}",
-		}, pkg)...)
-	cmd.Env = Env()
+			pkg)...)
+	cmd.Env = env
 	cmd.Dir = buildDir
 	cmd.Stderr = os.Stderr
 	if logExec {
@@ -253,7 +337,7 @@ func getPkg(buildDir string, pkg string) error {
 		// otherwise
 
 		// Treat any error as incomplete
-		return getIncomplete(buildDir, []string{pkg})
+		return getIncomplete(env, buildDir, []string{pkg})
 		// return fmt.Errorf("%v: %v", cmd.Args, err)
 	}
 	if strings.TrimSpace(string(output)) == "" {
@@ -261,7 +345,7 @@ func getPkg(buildDir string, pkg string) error {
 		// (e.g. github.com/rtr7/router7/cmd/... without having the
 		// github.com/rtr7/router7 module in go.mod), the output will be empty,
 		// and we should try getting the corresponding package/module.
-		return getIncomplete(buildDir, []string{pkg})
+		return getIncomplete(env, buildDir, []string{pkg})
 	}
 	var incomplete []string
 	const errorSuffix = " error"
@@ -273,27 +357,102 @@ func getPkg(buildDir string, pkg string) error {
 	}
 
 	if len(incomplete) > 0 {
-		return getIncomplete(buildDir, incomplete)
+		return getIncomplete(env, buildDir, incomplete)
 	}
 	return nil
 }
 
 type BuildEnv struct {
 	BuildDir func(string) (string, error)
+
+	// Basenames maps import paths to binary names, overriding the default
+	// Pkg.Basename.
+	Basenames map[string]string
+
+	// Remote, if non-nil, builds the packages on a remote builder instead of
+	// locally. Resolving packages (go get, go list) still happens locally.
+	Remote *RemoteBuilder
+
+	// Options, if non-nil, apply to all packages (see BuildOptions.Flags).
+	Options *BuildOptions
+
+	// LogDir, if non-empty, is the directory in which the output of go build
+	// is stored per package (as <basename>.log) instead of being printed to
+	// stderr, where the output of concurrent builds would be interleaved.
+	// Errors refer to the build log of the failing package.
+	LogDir string
+
+	// Verbose prints the go build output to stderr while building, in
+	// addition to storing it in LogDir.
+	Verbose bool
+
+	// PackageStarted, if non-nil, is called before building each Go package.
+	PackageStarted func(importPath string)
+
+	// PackageBuilt, if non-nil, is called after building each Go package,
+	// with a non-nil err if the package failed to build.
+	PackageBuilt func(importPath string, err error)
+
+	// Target, if non-nil, is the platform to build for instead of the one
+	// selected by the environment (see TargetFromEnv).
+	Target *Target
+
+	// GoToolchain, if non-empty, is the Go toolchain (e.g. go1.22.4) to build
+	// with, see GoEnv.
+	GoToolchain string
+
+	// Env contains additional environment variables (KEY=VALUE) for all go
+	// commands, which take precedence over the process environment, e.g.
+	// GOMODCACHE or GOPROXY=off.
+	Env []string
+
+	// Cache, if non-nil, provides programs which were built before with the
+	// same inputs, instead of building them again. Newly built programs are
+	// stored in Cache.
+	Cache BinaryCache
+
+	// PackageCached, if non-nil, is called (instead of PackageStarted) for
+	// each Go package which is taken from Cache. PackageBuilt is called, too.
+	PackageCached func(importPath string)
 }
 
+func (be *BuildEnv) env() []string {
+	target := TargetFromEnv(Target{})
+	if be.Target != nil {
+		target = *be.Target
+	}
+	return GoEnv(target, be.GoToolchain, be.Env...)
+}
+
+// Build is like BuildContext, but uses context.Background().
 func (be *BuildEnv) Build(bindir string, packages []string, packageBuildFlags, packageBuildTags map[string][]string, noBuildPackages []string) error {
+	return be.BuildContext(context.Background(), bindir, packages, packageBuildFlags, packageBuildTags, noBuildPackages)
+}
+
+// BuildContext builds the main packages of packages into bindir. When ctx is
+// canceled or a package fails to build, all go build processes are killed.
+func (be *BuildEnv) BuildContext(ctx context.Context, bindir string, packages []string, packageBuildFlags, packageBuildTags map[string][]string, noBuildPackages []string) error {
 	done := measure.Interactively("building (go compiler)")
 	defer done("")
 
-	var eg errgroup.Group
+	env := be.env()
+	var goVer string
+	if be.Cache != nil {
+		var err error
+		goVer, err = goVersion(env)
+		if err != nil {
+			return err
+		}
+	}
+	inputsHashes := make(map[string]string)
+	eg, ctx := errgroup.WithContext(ctx)
 	for _, incompleteNoBuildPkg := range noBuildPackages {
 		buildDir, err := be.BuildDir(incompleteNoBuildPkg)
 		if err != nil {
 			return fmt.Errorf("buildDir(%s): %v", incompleteNoBuildPkg, err)
 		}
 
-		if err := getPkg(buildDir, incompleteNoBuildPkg); err != nil {
+		if err := getPkg(env, buildDir, incompleteNoBuildPkg); err != nil {
 			return err
 		}
 	}
@@ -303,52 +462,143 @@ func (be *BuildEnv) Build(bindir string, packages []string, packageBuildFlags, p
 			return fmt.Errorf("buildDir(%s): %v", incompletePkg, err)
 		}
 
-		if err := getPkg(buildDir, incompletePkg); err != nil {
+		if err := getPkg(env, buildDir, incompletePkg); err != nil {
 			return err
 		}
 
+		if be.Remote != nil && UsesWorkspace(buildDir) {
+			return fmt.Errorf("%s: workspaces (go.work) are not supported with remote builders, as the used module directories are local", buildDir)
+		}
+
 		mainPkgs, err := be.MainPackages([]string{incompletePkg})
 		if err != nil {
 			return err
 		}
+		if _, ok := inputsHashes[buildDir]; !ok && be.Cache != nil {
+			// Computed after getPkg, which might have modified go.mod.
+			inputsHashes[buildDir], err = be.Cache.InputsHash(buildDir)
+			if err != nil {
+				return fmt.Errorf("%s: %v", buildDir, err)
+			}
+		}
 		for _, pkg := range mainPkgs {
 			pkg := pkg // copy
 			eg.Go(func() error {
-				args := []string{
-					"build",
-					"-mod=mod",
-					"-o", filepath.Join(bindir, pkg.Basename()),
-				}
+				output := filepath.Join(bindir, pkg.Basename())
+				args := append([]string{"build"}, ModFlags(buildDir)...)
 				tags := append(DefaultTags(), packageBuildTags[pkg.ImportPath]...)
 				args = append(args, "-tags="+strings.Join(tags, ","))
-				if buildFlags := packageBuildFlags[pkg.ImportPath]; len(buildFlags) > 0 {
+				if buildFlags := be.Options.Flags(packageBuildFlags[pkg.ImportPath]); len(buildFlags) > 0 {
 					args = append(args, buildFlags...)
 				}
 				args = append(args, pkg.ImportPath)
-				cmd := exec.Command("go", args...)
-				cmd.Env = Env()
-				cmd.Dir = buildDir
-				cmd.Stderr = os.Stderr
-				if logExec {
-					log.Printf("Build: %v (in %s)", cmd.Args, buildDir)
+				var cacheKey string
+				if be.Cache != nil {
+					cacheKey = binaryCacheKey(goVer, inputsHashes[buildDir], env, args)
+					ok, err := be.Cache.Get(cacheKey, output)
+					if err != nil {
+						log.Printf("%s: binary cache: %v", pkg.ImportPath, err)
+					}
+					if ok {
+						if be.PackageCached != nil {
+							be.PackageCached(pkg.ImportPath)
+						}
+						if be.PackageBuilt != nil {
+							be.PackageBuilt(pkg.ImportPath, nil)
+						}
+						return nil
+					}
+				}
+				if be.PackageStarted != nil {
+					be.PackageStarted(pkg.ImportPath)
+				}
+				stderr, logPath, closeLog, err := be.buildLog(pkg)
+				if err != nil {
+					return err
+				}
+				if be.Remote != nil {
+					err = be.Remote.build(ctx, env, buildDir, output, args, stderr)
+				} else {
+					args = append([]string{args[0], "-o", output}, args[1:]...)
+					cmd := exec.CommandContext(ctx, "go", args...)
+					cmd.Env = env
+					cmd.Dir = buildDir
+					cmd.Stdout = stderr
+					cmd.Stderr = stderr
+					if logExec {
+						log.Printf("Build: %v (in %s)", cmd.Args, buildDir)
+					}
+					if err = cmd.Run(); err != nil {
+						err = fmt.Errorf("%v: %v", cmd.Args, err)
+					}
 				}
-				if err := cmd.Run(); err != nil {
-					return fmt.Errorf("%v: %v", cmd.Args, err)
+				if cerr := closeLog(); err == nil {
+					err = cerr
 				}
-				return nil
+				if err != nil && logPath != "" {
+					err = fmt.Errorf("%v\nbuild log %s:\n%s", err, logPath, logTail(logPath, 20))
+				}
+				if err == nil && be.Cache != nil {
+					if err := be.Cache.Put(cacheKey, output); err != nil {
+						log.Printf("%s: binary cache: %v", pkg.ImportPath, err)
+					}
+				}
+				if be.PackageBuilt != nil {
+					be.PackageBuilt(pkg.ImportPath, err)
+				}
+				return err
 			})
 		}
 	}
 	return eg.Wait()
 }
 
+// buildLog returns the writer for the go build output of pkg (see LogDir
+// and Verbose), the path of its build log (if any) and a function to close
+// the build log.
+func (be *BuildEnv) buildLog(pkg Pkg) (_ io.Writer, logPath string, closeLog func() error, _ error) {
+	if be.LogDir == "" {
+		return os.Stderr, "", func() error { return nil }, nil
+	}
+	logPath = filepath.Join(be.LogDir, pkg.Basename()+".log")
+	f, err := os.Create(logPath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	fmt.Fprintf(f, "# %s\n", pkg.ImportPath)
+	var w io.Writer = f
+	if be.Verbose {
+		w = io.MultiWriter(f, os.Stderr)
+	}
+	return w, logPath, f.Close, nil
+}
+
+// logTail returns (at most) the last n lines of the build log at path.
+func logTail(path string, n int) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err.Error()
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) > n {
+		lines = append([]string{"[…]"}, lines[len(lines)-n:]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
 type Pkg struct {
 	Name       string `json:"Name"`
 	ImportPath string `json:"ImportPath"`
 	Target     string `json:"Target"`
+
+	// BasenameOverride, if non-empty, is returned by Basename.
+	BasenameOverride string `json:"-"`
 }
 
 func (p *Pkg) Basename() string {
+	if p.BasenameOverride != "" {
+		return p.BasenameOverride
+	}
 	if p.Target != "" {
 		return filepath.Base(p.Target)
 	}
@@ -386,7 +636,7 @@ func (be *BuildEnv) mainPackage(pkg string) ([]Pkg, error) {
 	var buf bytes.Buffer
 	cmd := exec.Command("go", append([]string{"list", "-tags", "gokrazy", "-json"}, pkg)...)
 	cmd.Dir = buildDir
-	cmd.Env = Env()
+	cmd.Env = be.env()
 	cmd.Stdout = &buf
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -404,6 +654,7 @@ func (be *BuildEnv) mainPackage(pkg string) ([]Pkg, error) {
 		if p.Name != "main" {
 			continue
 		}
+		p.BasenameOverride = be.Basenames[p.ImportPath]
 		result = append(result, p)
 	}
 	return result, nil
@@ -438,14 +689,23 @@ func (be *BuildEnv) MainPackages(pkgs []string) ([]Pkg, error) {
 	return result, nil
 }
 
+// PackageDir returns the directory of pkg, resolved in its builddir (see
+// BuildDirOrMigrate), using the process environment.
 func PackageDir(pkg string) (string, error) {
-	buildDir, err := BuildDirOrMigrate(pkg)
+	return (&BuildEnv{BuildDir: BuildDirOrMigrate}).PackageDir(pkg)
+}
+
+// PackageDir returns the directory of pkg, resolved in its builddir.
+func (be *BuildEnv) PackageDir(pkg string) (string, error) {
+	buildDir, err := be.BuildDir(pkg)
 	if err != nil {
 		return "", fmt.Errorf("PackageDirs(%s): %v", pkg, err)
 	}
 
-	cmd := exec.Command("go", "list", "-mod=mod", "-tags", "gokrazy", "-f", "{{ .Dir }}", pkg)
-	cmd.Env = Env()
+	args := append([]string{"list"}, ModFlags(buildDir)...)
+	args = append(args, "-tags", "gokrazy", "-f", "{{ .Dir }}", pkg)
+	cmd := exec.Command("go", args...)
+	cmd.Env = be.env()
 	cmd.Dir = buildDir
 	cmd.Stderr = os.Stderr
 	if logExec {
@@ -1,6 +1,13 @@
 package packer
 
-import "testing"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestPkgBasename(t *testing.T) {
 	tests := []struct {
@@ -45,3 +52,134 @@ func TestPkgBasename(t *testing.T) {
 		})
 	}
 }
+
+func TestTargetFromEnv(t *testing.T) {
+	t.Setenv("GOOS", "")
+	t.Setenv("GOARCH", "")
+	t.Setenv("GOARM", "")
+	if got, want := TargetFromEnv(Target{}).String(), "linux/arm64"; got != want {
+		t.Errorf("TargetFromEnv() = %q, want %q", got, want)
+	}
+	def := Target{GOARCH: "arm", GOARM: "6"}
+	if got, want := TargetFromEnv(def).String(), "linux/arm/v6"; got != want {
+		t.Errorf("TargetFromEnv(%+v) = %q, want %q", def, got, want)
+	}
+	// The environment takes precedence over the defaults (e.g. from config):
+	t.Setenv("GOARCH", "amd64")
+	if got, want := TargetFromEnv(Target{GOARCH: "arm64"}).GOARCH, "amd64"; got != want {
+		t.Errorf("TargetFromEnv(GOARCH=arm64) with GOARCH=amd64 in env = %q, want %q", got, want)
+	}
+}
+
+func TestModFlags(t *testing.T) {
+	t.Setenv("GOWORK", "")
+	buildDir := t.TempDir()
+	if got, want := ModFlags(buildDir), []string{"-mod=mod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ModFlags(without go.work) = %q, want %q", got, want)
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, "go.work"), []byte("go 1.22\n\nuse .\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := ModFlags(buildDir); got != nil {
+		t.Errorf("ModFlags(with go.work) = %q, want nil", got)
+	}
+	t.Setenv("GOWORK", "off")
+	if got, want := ModFlags(buildDir), []string{"-mod=mod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ModFlags(GOWORK=off) = %q, want %q", got, want)
+	}
+}
+
+func TestBuildOptionsFlags(t *testing.T) {
+	for _, tt := range []struct {
+		desc         string
+		options      *BuildOptions
+		packageFlags []string
+		want         []string
+	}{
+		{
+			desc:         "nil",
+			packageFlags: []string{"-race"},
+			want:         []string{"-race"},
+		},
+		{
+			desc:    "all",
+			options: &BuildOptions{Trimpath: true, StripDebug: true, BuildMode: "pie"},
+			want:    []string{"-trimpath", "-buildmode=pie", "-ldflags=-s -w"},
+		},
+		{
+			desc:         "merged ldflags",
+			options:      &BuildOptions{StripDebug: true},
+			packageFlags: []string{"-ldflags=-X main.version=1", "-tags=x"},
+			want:         []string{"-ldflags=-s -w -X main.version=1", "-tags=x"},
+		},
+		{
+			desc:         "merged separate ldflags",
+			options:      &BuildOptions{StripDebug: true},
+			packageFlags: []string{"--ldflags", "-X main.version=1"},
+			want:         []string{"-ldflags=-s -w -X main.version=1"},
+		},
+		{
+			desc:         "package flags last",
+			options:      &BuildOptions{BuildMode: "pie"},
+			packageFlags: []string{"-buildmode=exe"},
+			want:         []string{"-buildmode=pie", "-buildmode=exe"},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got := tt.options.Flags(tt.packageFlags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Flags(%q) = %q, want %q", tt.packageFlags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildLog(t *testing.T) {
+	be := &BuildEnv{LogDir: t.TempDir()}
+	w, logPath, closeLog, err := be.buildLog(Pkg{ImportPath: "example.com/cmd/hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := logPath, filepath.Join(be.LogDir, "hello.log"); got != want {
+		t.Errorf("buildLog: got path %q, want %q", got, want)
+	}
+	for i := 1; i <= 30; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	if err := closeLog(); err != nil {
+		t.Fatal(err)
+	}
+	tail := logTail(logPath, 3)
+	if want := "[…]\nline 28\nline 29\nline 30"; tail != want {
+		t.Errorf("logTail = %q, want %q", tail, want)
+	}
+}
+
+// lookupEnv returns the value of the last entry for key in env, like os/exec.
+func lookupEnv(env []string, key string) string {
+	var val string
+	for _, e := range env {
+		if v, ok := strings.CutPrefix(e, key+"="); ok {
+			val = v
+		}
+	}
+	return val
+}
+
+func TestGoEnvExtra(t *testing.T) {
+	t.Setenv("GOPROXY", "https://proxy.example")
+	t.Setenv("GOFLAGS", "-mod=mod")
+	env := GoEnv(Target{GOARCH: "arm64"}, "", "GOPROXY=off", "GOMODCACHE=/tmp/modcache")
+	for key, want := range map[string]string{
+		"GOPROXY":    "off",
+		"GOMODCACHE": "/tmp/modcache",
+		"GOFLAGS":    "-mod=mod",
+		"GOARCH":     "arm64",
+	} {
+		if got := lookupEnv(env, key); got != want {
+			t.Errorf("GoEnv: %s = %q, want %q", key, got, want)
+		}
+	}
+	if got, want := os.Getenv("GOPROXY"), "https://proxy.example"; got != want {
+		t.Errorf("GoEnv modified the process environment: GOPROXY = %q, want %q", got, want)
+	}
+}
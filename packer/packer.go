@@ -12,8 +12,6 @@ import (
 	"log"
 	"os"
 	"unicode/utf16"
-
-	"golang.org/x/sys/unix"
 )
 
 // Pack represents one pack process.
@@ -27,6 +25,9 @@ type Pack struct {
 		VL805SHA256    string // vl805.sig
 	}
 	FirstPartitionOffsetSectors int64
+	// BootPartitionMB is the size of the boot partition in MB, or 0 for
+	// DefaultBootPartitionMB.
+	BootPartitionMB int64
 }
 
 func NewPackForHost(firstPartitionOffsetSectors int64, hostname string) Pack {
@@ -61,11 +62,17 @@ func (p *Pack) GPTPARTUUID(partition uint16) string {
 }
 
 func (p *Pack) Root() string {
+	return p.RootPartition(2)
+}
+
+// RootPartition is like Root, but refers to the root partition number
+// (2 or 3) instead of the root partition of new installations (2).
+func (p *Pack) RootPartition(number int) string {
 	if p.UseGPTPartuuid {
-		return fmt.Sprintf("PARTUUID=%s/PARTNROFF=1", p.GPTPARTUUID(1))
+		return fmt.Sprintf("PARTUUID=%s/PARTNROFF=%d", p.GPTPARTUUID(1), number-1)
 	}
 	if p.UsePartuuid {
-		return fmt.Sprintf("PARTUUID=%08x-02", p.Partuuid)
+		return fmt.Sprintf("PARTUUID=%08x-%02d", p.Partuuid, number)
 	}
 	return "" // should only be called if ModifyCmdlineRoot()
 }
@@ -96,9 +103,39 @@ var (
 
 const MB = 1024 * 1024
 
-func permSize(firstPartitionOffsetSectors int64, devsize uint64) uint32 {
-	permStart := uint32(firstPartitionOffsetSectors + (1100 * MB / 512))
-	permSize := uint32((devsize / 512) - uint64(firstPartitionOffsetSectors) - (1100 * MB / 512))
+const (
+	// DefaultBootPartitionMB is the size of the boot partition unless
+	// Pack.BootPartitionMB is set.
+	DefaultBootPartitionMB = 100
+
+	// RootPartitionBytes is the size of each of the two root partitions.
+	RootPartitionBytes = 500 * MB
+)
+
+// BootPartitionBytes returns the size of the boot partition (partition 1).
+func (p *Pack) BootPartitionBytes() uint64 {
+	if p.BootPartitionMB > 0 {
+		return uint64(p.BootPartitionMB) * MB
+	}
+	return DefaultBootPartitionMB * MB
+}
+
+// PartitionOffset returns the offset in bytes of partition number: 1 (boot),
+// 2 and 3 (root) or 4 (perm).
+func (p *Pack) PartitionOffset(number int) uint64 {
+	offset := uint64(p.FirstPartitionOffsetSectors) * 512
+	if number > 1 {
+		offset += p.BootPartitionBytes()
+	}
+	if number > 2 {
+		offset += uint64(number-2) * RootPartitionBytes
+	}
+	return offset
+}
+
+func (p *Pack) permSize(devsize uint64) uint32 {
+	permStart := uint32(p.PartitionOffset(4) / 512)
+	permSize := uint32((devsize - p.PartitionOffset(4)) / 512)
 	// LBA -33 to LBA -1 need to remain unused for the secondary GPT header
 	lastAddressable := uint32((devsize / 512) - 1) // 0-indexed
 	if lastLBA := uint32(lastAddressable - 33); permStart+permSize >= lastLBA {
@@ -107,8 +144,18 @@ func permSize(firstPartitionOffsetSectors int64, devsize uint64) uint32 {
 	return permSize
 }
 
+// PermSizeInKB returns the size of the perm partition (partition 4) on a
+// device of devsize bytes with the default boot partition size, see
+// Pack.PermSizeKB.
 func PermSizeInKB(firstPartitionOffsetSectors int64, devsize uint64) uint32 {
-	permSizeLBA := permSize(firstPartitionOffsetSectors, devsize)
+	p := Pack{FirstPartitionOffsetSectors: firstPartitionOffsetSectors}
+	return p.PermSizeKB(devsize)
+}
+
+// PermSizeKB returns the size of the perm partition (partition 4) on a device
+// of devsize bytes.
+func (p *Pack) PermSizeKB(devsize uint64) uint32 {
+	permSizeLBA := p.permSize(devsize)
 	permSizeBytes := permSizeLBA * 512
 	return permSizeBytes / 1024
 }
@@ -116,7 +163,7 @@ func PermSizeInKB(firstPartitionOffsetSectors int64, devsize uint64) uint32 {
 // writePartitionTable writes a Hybrid MBR: it contains the GPT protective
 // partition so that the Linux kernel recognizes the disk as GPT, but it also
 // contains the FAT32 partition so that the Raspberry Pi bootloader still works.
-func writePartitionTable(firstPartitionOffsetSectors int64, w io.Writer) error {
+func (p *Pack) writePartitionTable(w io.Writer) error {
 	for _, v := range []interface{}{
 		[446]byte{}, // boot code
 
@@ -125,8 +172,8 @@ func writePartitionTable(firstPartitionOffsetSectors int64, w io.Writer) error {
 		invalidCHS,
 		FAT,
 		invalidCHS,
-		uint32(firstPartitionOffsetSectors),
-		uint32(100 * MB / 512), // 100MB in size
+		uint32(p.FirstPartitionOffsetSectors),
+		uint32(p.BootPartitionBytes() / 512),
 
 		// Partition 2 is the protective GPT partition so that the Linux kernel
 		// will recognize the disk as GPT.
@@ -135,7 +182,7 @@ func writePartitionTable(firstPartitionOffsetSectors int64, w io.Writer) error {
 		byte(0xEE),
 		invalidCHS,
 		uint32(1),
-		uint32(firstPartitionOffsetSectors - 1),
+		uint32(p.FirstPartitionOffsetSectors - 1),
 
 		[16]byte{}, // partition 3
 		[16]byte{}, // partition 4
@@ -155,7 +202,7 @@ func writePartitionTable(firstPartitionOffsetSectors int64, w io.Writer) error {
 // by GPT metadata. For example, Odroid HC2 clobbers sectors 1-2046 with binary blobs
 // required for booting - these devices are incompatible with GPT. See
 // https://wiki.odroid.com/odroid-xu4/software/partition_table#ubuntu_partition_table.
-func writeMBRPartitionTable(firstPartitionOffsetSectors int64, w io.Writer, devsize uint64) error {
+func (p *Pack) writeMBRPartitionTable(w io.Writer, devsize uint64) error {
 	for _, v := range []interface{}{
 		[446]byte{}, // boot code
 
@@ -164,32 +211,32 @@ func writeMBRPartitionTable(firstPartitionOffsetSectors int64, w io.Writer, devs
 		invalidCHS,
 		FAT,
 		invalidCHS,
-		uint32(firstPartitionOffsetSectors),
-		uint32(100 * MB / 512), // 100MB in size
+		uint32(p.FirstPartitionOffsetSectors),
+		uint32(p.BootPartitionBytes() / 512),
 
 		// Partition 2 is squash partition 1.
 		inactive,
 		invalidCHS,
 		Linux,
 		invalidCHS,
-		uint32(firstPartitionOffsetSectors + 100*MB/512),
-		uint32(500 * MB / 512),
+		uint32(p.PartitionOffset(2) / 512),
+		uint32(RootPartitionBytes / 512),
 
 		// Partition 3 is squash partition 2.
 		inactive,
 		invalidCHS,
 		Linux,
 		invalidCHS,
-		uint32(firstPartitionOffsetSectors + 600*MB/512),
-		uint32(500 * MB / 512),
+		uint32(p.PartitionOffset(3) / 512),
+		uint32(RootPartitionBytes / 512),
 
 		// Partition 4 is the perm partition.
 		inactive,
 		invalidCHS,
 		Linux,
 		invalidCHS,
-		uint32(firstPartitionOffsetSectors + 1100*MB/512),
-		uint32(devsize/512 - uint64(firstPartitionOffsetSectors) - 1100*MB/512),
+		uint32(p.PartitionOffset(4) / 512),
+		uint32((devsize - p.PartitionOffset(4)) / 512),
 
 		signature,
 	} {
@@ -274,16 +321,16 @@ func (p *Pack) writeGPT(w io.Writer, devsize uint64, primary bool) error {
 		Name       [72]byte
 	}
 	partition0First := uint64(p.FirstPartitionOffsetSectors)
-	partition0Last := partition0First + (100 * MB / 512) - 1
+	partition0Last := partition0First + (p.BootPartitionBytes() / 512) - 1
 
 	partition1First := partition0Last + 1
-	partition1Last := partition1First + (500 * MB / 512) - 1
+	partition1Last := partition1First + (RootPartitionBytes / 512) - 1
 
 	partition2First := partition1Last + 1
-	partition2Last := partition2First + (500 * MB / 512) - 1
+	partition2Last := partition2First + (RootPartitionBytes / 512) - 1
 
 	partition3First := partition2Last + 1
-	partition3Last := partition3First + uint64(permSize(p.FirstPartitionOffsetSectors, devsize)) - 1
+	partition3Last := partition3First + uint64(p.permSize(devsize)) - 1
 
 	var rootType [16]byte
 	switch os.Getenv("GOARCH") {
@@ -430,16 +477,36 @@ func (p *Pack) writeGPT(w io.Writer, devsize uint64, primary bool) error {
 	return nil
 }
 
+// minDeviceSize returns the size in bytes of the smallest device which fits
+// the gokrazy partitions (boot, 2 root and a non-empty perm partition) and the
+// secondary GPT. permSize keeps the 34 sectors before the secondary GPT
+// header unused.
+func (p *Pack) minDeviceSize() uint64 {
+	return p.PartitionOffset(4) + 35*512
+}
+
 func (p *Pack) Partition(o *os.File, devsize uint64) error {
-	minsize := uint64(1100 * MB)
-	if devsize < minsize {
-		return fmt.Errorf("device is too small (at least %d MB needed, %d MB available)", minsize/MB, devsize/MB)
+	return p.writePartitionTables(o, devsize)
+}
+
+// writePartitionTables writes the MBR (and GPT, if UseGPT) of a device of
+// devsize bytes to w.
+func (p *Pack) writePartitionTables(o io.WriteSeeker, devsize uint64) error {
+	minFirst := int64(1) // the MBR
+	if p.UseGPT {
+		minFirst = 34 // the MBR, the GPT header and the GPT partition entries
+	}
+	if first := p.FirstPartitionOffsetSectors; first < minFirst {
+		return fmt.Errorf("first partition offset %d overlaps the partition table (must be at least %d sectors)", first, minFirst)
+	}
+	if minsize := p.minDeviceSize(); devsize < minsize {
+		return fmt.Errorf("device is too small (at least %d MB needed, %d MB available)", (minsize+MB-1)/MB, devsize/MB)
 	}
 	if !p.UseGPT {
-		return writeMBRPartitionTable(p.FirstPartitionOffsetSectors, o, devsize)
+		return p.writeMBRPartitionTable(o, devsize)
 	}
 
-	if err := writePartitionTable(p.FirstPartitionOffsetSectors, o); err != nil {
+	if err := p.writePartitionTable(o); err != nil {
 		return err
 	}
 
@@ -464,12 +531,12 @@ func (p *Pack) Partition(o *os.File, devsize uint64) error {
 
 func (p *Pack) RereadPartitions(o *os.File) error {
 	// Make Linux re-read the partition table. Sequence of system calls like in fdisk(8).
-	unix.Sync()
+	syncFilesystems()
 
 	if err := rereadPartitions(o); err != nil {
 		log.Printf("Re-reading partition table failed: %v. Remember to unplug and re-plug the SD card before creating a file system for persistent data, if desired.", err)
 	}
 
-	unix.Sync()
+	syncFilesystems()
 	return nil
 }
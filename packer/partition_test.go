@@ -0,0 +1,308 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// sparseFile is an in-memory io.WriteSeeker for devices of arbitrary size.
+type sparseFile struct {
+	off    int64
+	chunks map[int64][]byte
+}
+
+func (f *sparseFile) Write(b []byte) (int, error) {
+	if f.chunks == nil {
+		f.chunks = make(map[int64][]byte)
+	}
+	f.chunks[f.off] = append([]byte(nil), b...)
+	f.off += int64(len(b))
+	return len(b), nil
+}
+
+func (f *sparseFile) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, fmt.Errorf("sparseFile: unsupported whence %d", whence)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// readAt returns n bytes at offset, with unwritten bytes being zero.
+func (f *sparseFile) readAt(offset int64, n int) []byte {
+	b := make([]byte, n)
+	for off, chunk := range f.chunks {
+		for i, c := range chunk {
+			if pos := off + int64(i) - offset; pos >= 0 && pos < int64(n) {
+				b[pos] = c
+			}
+		}
+	}
+	return b
+}
+
+// offsets returns the offsets of all written chunks, in ascending order.
+func (f *sparseFile) offsets() []int64 {
+	var offsets []int64
+	for off := range f.chunks {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
+
+// hexdump formats the written, non-zero 16 byte rows of f, skipping
+// all-zero rows like hexdump(1) does.
+func (f *sparseFile) hexdump() string {
+	var b strings.Builder
+	rows := make(map[int64]bool)
+	for off, chunk := range f.chunks {
+		for i, c := range chunk {
+			if c != 0 {
+				rows[(off+int64(i))&^15] = true
+			}
+		}
+	}
+	var offsets []int64
+	for off := range rows {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for idx, off := range offsets {
+		if idx > 0 && offsets[idx-1] != off-16 {
+			b.WriteString("*\n")
+		}
+		fmt.Fprintf(&b, "%012x  % x\n", off, f.readAt(off, 16))
+	}
+	return b.String()
+}
+
+type mbrPartition struct {
+	Status byte
+	_      [3]byte
+	Type   byte
+	_      [3]byte
+	Start  uint32
+	Size   uint32
+}
+
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	CRC32Header    uint32
+	Reserved       uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesStart   uint64
+	EntriesCount   uint32
+	EntriesSize    uint32
+	CRC32Array     uint32
+}
+
+type gptEntry struct {
+	TypeGUID   [16]byte
+	GUID       [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [72]byte
+}
+
+// extent is a range of sectors [first, last].
+type extent struct {
+	what        string
+	first, last uint64
+}
+
+func checkExtents(t *testing.T, devSectors uint64, extents []extent) {
+	t.Helper()
+	sort.Slice(extents, func(i, j int) bool { return extents[i].first < extents[j].first })
+	for idx, e := range extents {
+		if e.last < e.first {
+			t.Errorf("%s: empty or negative extent [%d, %d]", e.what, e.first, e.last)
+		}
+		if e.last >= devSectors {
+			t.Errorf("%s: extent [%d, %d] exceeds the device (%d sectors)", e.what, e.first, e.last, devSectors)
+		}
+		if idx > 0 && extents[idx-1].last >= e.first {
+			t.Errorf("%s [%d, %d] overlaps %s [%d, %d]", e.what, e.first, e.last, extents[idx-1].what, extents[idx-1].first, extents[idx-1].last)
+		}
+	}
+}
+
+func readGPT(t *testing.T, f *sparseFile, lba uint64) (gptHeader, []gptEntry) {
+	t.Helper()
+	var hdr gptHeader
+	b := f.readAt(int64(lba*512), 92)
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(hdr.Signature[:]), "EFI PART"; got != want {
+		t.Fatalf("GPT header at LBA %d: signature %q, want %q", lba, got, want)
+	}
+	binary.LittleEndian.PutUint32(b[16:], 0)
+	if got, want := crc32.ChecksumIEEE(b), hdr.CRC32Header; got != want {
+		t.Errorf("GPT header at LBA %d: CRC32 %x, want %x", lba, got, want)
+	}
+	if hdr.CurrentLBA != lba {
+		t.Errorf("GPT header at LBA %d: CurrentLBA = %d", lba, hdr.CurrentLBA)
+	}
+	entries := f.readAt(int64(hdr.EntriesStart*512), int(hdr.EntriesCount*hdr.EntriesSize))
+	if got, want := crc32.ChecksumIEEE(entries), hdr.CRC32Array; got != want {
+		t.Errorf("GPT entries at LBA %d: CRC32 %x, want %x", hdr.EntriesStart, got, want)
+	}
+	var parts []gptEntry
+	for off := 0; off < len(entries); off += int(hdr.EntriesSize) {
+		var e gptEntry
+		if err := binary.Read(bytes.NewReader(entries[off:]), binary.LittleEndian, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.TypeGUID != ([16]byte{}) {
+			parts = append(parts, e)
+		}
+	}
+	return hdr, parts
+}
+
+// checkPartitionTables verifies that the partition tables written to f for a
+// device of devsize bytes describe the gokrazy partitions consistently and
+// within the device.
+func checkPartitionTables(t *testing.T, p *Pack, f *sparseFile, devsize uint64) {
+	t.Helper()
+	devSectors := devsize / 512
+	var mbr struct {
+		BootCode   [446]byte
+		Partitions [4]mbrPartition
+		Signature  uint16
+	}
+	if err := binary.Read(bytes.NewReader(f.readAt(0, 512)), binary.LittleEndian, &mbr); err != nil {
+		t.Fatal(err)
+	}
+	if mbr.Signature != signature {
+		t.Fatalf("MBR signature %#x, want %#x", mbr.Signature, signature)
+	}
+	boot := mbr.Partitions[0]
+	if boot.Type != FAT || boot.Start != uint32(p.FirstPartitionOffsetSectors) || uint64(boot.Size) != p.BootPartitionBytes()/512 {
+		t.Errorf("MBR partition 1 = %+v, want FAT at sector %d, %d bytes", boot, p.FirstPartitionOffsetSectors, p.BootPartitionBytes())
+	}
+
+	if !p.UseGPT {
+		extents := []extent{{what: "MBR", first: 0, last: 0}}
+		for idx, part := range mbr.Partitions {
+			extents = append(extents, extent{
+				what:  fmt.Sprintf("MBR partition %d", idx+1),
+				first: uint64(part.Start),
+				last:  uint64(part.Start) + uint64(part.Size) - 1,
+			})
+		}
+		checkExtents(t, devSectors, extents)
+		return
+	}
+
+	if got, want := mbr.Partitions[1].Type, byte(0xEE); got != want {
+		t.Errorf("MBR partition 2 type %#x, want protective GPT partition (%#x)", got, want)
+	}
+	lastLBA := devSectors - 1
+	primary, entries := readGPT(t, f, 1)
+	backup, backupEntries := readGPT(t, f, lastLBA)
+	if primary.BackupLBA != lastLBA || backup.BackupLBA != 1 {
+		t.Errorf("GPT BackupLBA: primary %d, backup %d, want %d and 1", primary.BackupLBA, backup.BackupLBA, lastLBA)
+	}
+	if len(entries) != 4 || fmt.Sprint(entries) != fmt.Sprint(backupEntries) {
+		t.Fatalf("GPT entries: got %d primary entries, %d backup entries, want 4 identical entries", len(entries), len(backupEntries))
+	}
+	if entries[0].FirstLBA != uint64(boot.Start) || entries[0].LastLBA != uint64(boot.Start+boot.Size-1) {
+		t.Errorf("GPT partition 1 [%d, %d] differs from MBR partition 1 %+v", entries[0].FirstLBA, entries[0].LastLBA, boot)
+	}
+	extents := []extent{
+		{"MBR", 0, 0},
+		{"primary GPT", 1, primary.EntriesStart + 31},
+		{"backup GPT", backup.EntriesStart, lastLBA},
+	}
+	for idx, e := range entries {
+		if e.FirstLBA < primary.FirstUsableLBA || e.LastLBA > primary.LastUsableLBA {
+			t.Errorf("GPT partition %d [%d, %d] outside of the usable range [%d, %d]", idx+1, e.FirstLBA, e.LastLBA, primary.FirstUsableLBA, primary.LastUsableLBA)
+		}
+		extents = append(extents, extent{fmt.Sprintf("GPT partition %d", idx+1), e.FirstLBA, e.LastLBA})
+	}
+	checkExtents(t, devSectors, extents)
+}
+
+func TestPartitionGolden(t *testing.T) {
+	t.Setenv("GOARCH", "arm64") // for the root partition type GUID
+	const devsize = 2 * 1024 * MB
+	for _, tt := range []struct {
+		name   string
+		first  int64
+		useGPT bool
+		bootMB int64
+	}{
+		{"gpt-8192", 8192, true, 0},
+		{"mbr-8192", 8192, false, 0},
+		{"mbr-2048", 2048, false, 0}, // e.g. Odroid HC2 (see writeMBRPartitionTable)
+		{"gpt-8192-boot128", 8192, true, 128},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPackForHost(tt.first, "golden")
+			p.UseGPT = tt.useGPT
+			p.BootPartitionMB = tt.bootMB
+			var f sparseFile
+			if err := p.writePartitionTables(&f, devsize); err != nil {
+				t.Fatal(err)
+			}
+			checkPartitionTables(t, &p, &f, devsize)
+
+			got := f.hexdump()
+			golden := filepath.Join("testdata", "partition-"+tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("partition tables differ from %s (run go test -update if intended):\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func FuzzPartitionTables(f *testing.F) {
+	minsize := (&Pack{FirstPartitionOffsetSectors: 2048}).minDeviceSize()
+	f.Add(int64(8192), uint64(2*1024*MB), true, uint8(0))
+	f.Add(int64(8192), uint64(32*1024*MB+4096), false, uint8(0))
+	f.Add(int64(2048), uint64(1101*MB), true, uint8(0))
+	f.Add(int64(2048), minsize, false, uint8(0))
+	f.Add(int64(0), uint64(4*1024*MB), false, uint8(0))
+	f.Add(int64(10), uint64(4*1024*MB), true, uint8(0))
+	f.Add(int64(8192), uint64(1<<45), true, uint8(0))
+	f.Add(int64(8192), uint64(2*1024*MB), false, uint8(128))
+	f.Fuzz(func(t *testing.T, first int64, devsize uint64, useGPT bool, bootMB uint8) {
+		p := NewPackForHost(first, "fuzz")
+		p.UseGPT = useGPT
+		p.BootPartitionMB = int64(bootMB)
+		var file sparseFile
+		if err := p.writePartitionTables(&file, devsize); err != nil {
+			return
+		}
+		checkPartitionTables(t, &p, &file, devsize)
+	})
+}
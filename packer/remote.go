@@ -0,0 +1,265 @@
+package packer
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/modfile"
+)
+
+// defaultRemoteDir is the directory (relative to the home directory of the
+// remote user) in which RemoteBuilder stores build directories.
+const defaultRemoteDir = ".cache/gokrazy-remote-build"
+
+// remoteEnv lists the environment variables which are forwarded to the
+// remote builder.
+var remoteEnv = []string{
+	"GOARCH",
+	"GOOS",
+	"GOARM",
+	"GOAMD64",
+	"CGO_ENABLED",
+	"GOTOOLCHAIN",
+	"GOPROXY",
+	"GOPRIVATE",
+	"GONOPROXY",
+	"GONOSUMDB",
+	"GOINSECURE",
+	"GOFLAGS",
+}
+
+// RemoteBuilder builds Go packages on another machine (e.g. a fast arm64
+// server) via SSH. The build directory is copied to the builder, go build
+// runs there with the target environment (GOARCH, GOOS, …) and the resulting
+// binary is copied back.
+//
+// The builder needs to have Go and tar installed.
+type RemoteBuilder struct {
+	// Host is the SSH destination, e.g. user@builder.
+	Host string
+
+	// Port is the SSH port, or empty for the default port.
+	Port string
+
+	// Dir is the directory on the builder in which build directories are
+	// stored. Relative paths are relative to the home directory.
+	Dir string
+
+	mu     sync.Mutex
+	synced map[string]func() (string, error) // local → remote build dir
+}
+
+// ParseRemoteBuilder parses a remote builder specification of the form
+// ssh://[user@]host[:port][/dir].
+func ParseRemoteBuilder(spec string) (*RemoteBuilder, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ssh" {
+		return nil, fmt.Errorf("unsupported remote builder %q: expected ssh://[user@]host[:port][/dir]", spec)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("remote builder %q: missing host", spec)
+	}
+	rb := &RemoteBuilder{
+		Host: u.Hostname(),
+		Port: u.Port(),
+		Dir:  strings.TrimPrefix(u.Path, "/"),
+	}
+	if u.User != nil {
+		rb.Host = u.User.Username() + "@" + rb.Host
+	}
+	if strings.HasPrefix(u.Path, "//") {
+		rb.Dir = u.Path[1:] // ssh://host//abs/path
+	}
+	if rb.Dir == "" {
+		rb.Dir = defaultRemoteDir
+	}
+	return rb, nil
+}
+
+// shellQuote quotes s for use in a POSIX shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (rb *RemoteBuilder) command(ctx context.Context, script string) *exec.Cmd {
+	args := []string{"-o", "BatchMode=yes"}
+	if rb.Port != "" {
+		args = append(args, "-p", rb.Port)
+	}
+	args = append(args, rb.Host, script)
+	return exec.CommandContext(ctx, "ssh", args...)
+}
+
+// checkReplaceDirectives returns an error if the go.mod file in buildDir
+// references directories, which are not available on the remote builder.
+func checkReplaceDirectives(buildDir string) error {
+	b, err := os.ReadFile(filepath.Join(buildDir, "go.mod"))
+	if err != nil {
+		return err
+	}
+	modf, err := modfile.Parse("go.mod", b, nil)
+	if err != nil {
+		return err
+	}
+	for _, r := range modf.Replace {
+		if r.New.Version == "" {
+			return fmt.Errorf("%s: replace directive %s => %s references a local directory, which is not supported with remote builds", buildDir, r.Old.Path, r.New.Path)
+		}
+	}
+	return nil
+}
+
+// writeTar writes all regular files of dir to w as a tar archive.
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(fn string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fn)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// sync copies buildDir to the remote builder (once per buildDir) and returns
+// the remote directory.
+func (rb *RemoteBuilder) sync(ctx context.Context, buildDir string) (string, error) {
+	rb.mu.Lock()
+	if rb.synced == nil {
+		rb.synced = make(map[string]func() (string, error))
+	}
+	once, ok := rb.synced[buildDir]
+	if !ok {
+		once = sync.OnceValues(func() (string, error) {
+			return rb.upload(ctx, buildDir)
+		})
+		rb.synced[buildDir] = once
+	}
+	rb.mu.Unlock()
+	return once()
+}
+
+func (rb *RemoteBuilder) upload(ctx context.Context, buildDir string) (string, error) {
+	if err := checkReplaceDirectives(buildDir); err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(buildDir)
+	if err != nil {
+		return "", err
+	}
+	remoteDir := path.Join(rb.Dir, fmt.Sprintf("%x", sha256.Sum256([]byte(abs)))[:16])
+	q := shellQuote(remoteDir)
+	cmd := rb.command(ctx, "rm -rf "+q+" && mkdir -p "+q+" && tar -x -C "+q)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	if logExec {
+		log.Printf("RemoteBuilder: %v", cmd.Args)
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	tarErr := writeTar(stdin, buildDir)
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("copying %s to %s: %v", buildDir, rb.Host, err)
+	}
+	if tarErr != nil {
+		return "", tarErr
+	}
+	return remoteDir, nil
+}
+
+// build runs go build with args (which must not contain -o) and the target
+// settings of env in the remote copy of buildDir and stores the resulting
+// binary in output. The output of go build is written to stderr.
+func (rb *RemoteBuilder) build(ctx context.Context, env []string, buildDir, output string, args []string, stderr io.Writer) (err error) {
+	remoteDir, err := rb.sync(ctx, buildDir)
+	if err != nil {
+		return err
+	}
+	remoteOutput := path.Join(".gokrazy-bin", filepath.Base(output))
+
+	var remote []string
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		for _, fwd := range remoteEnv {
+			if key == fwd {
+				remote = append(remote, shellQuote(kv))
+				break
+			}
+		}
+	}
+	goArgs := []string{"go", args[0], "-o", remoteOutput}
+	for _, arg := range args[1:] {
+		goArgs = append(goArgs, shellQuote(arg))
+	}
+	script := "cd " + shellQuote(remoteDir) +
+		" && env " + strings.Join(remote, " ") + " " + strings.Join(goArgs, " ") +
+		" && cat " + shellQuote(remoteOutput)
+	cmd := rb.command(ctx, script)
+	cmd.Stderr = stderr
+	if logExec {
+		log.Printf("RemoteBuilder: %v", cmd.Args)
+	}
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(output) // do not leave a partial binary behind
+		}
+	}()
+	cmd.Stdout = f
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("remote build on %s: %v: %v", rb.Host, args, err)
+	}
+	return f.Close()
+}
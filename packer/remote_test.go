@@ -0,0 +1,50 @@
+package packer
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseRemoteBuilder(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want *RemoteBuilder
+	}{
+		{
+			spec: "ssh://builder",
+			want: &RemoteBuilder{Host: "builder", Dir: defaultRemoteDir},
+		},
+		{
+			spec: "ssh://user@builder:2222/gokrazy",
+			want: &RemoteBuilder{Host: "user@builder", Port: "2222", Dir: "gokrazy"},
+		},
+		{
+			spec: "ssh://builder//srv/gokrazy",
+			want: &RemoteBuilder{Host: "builder", Dir: "/srv/gokrazy"},
+		},
+	} {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseRemoteBuilder(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got, cmpopts.IgnoreUnexported(RemoteBuilder{})); diff != "" {
+				t.Errorf("ParseRemoteBuilder: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, spec := range []string{"builder", "https://builder", "ssh:///dir"} {
+		if _, err := ParseRemoteBuilder(spec); err == nil {
+			t.Errorf("ParseRemoteBuilder(%q) succeeded unexpectedly", spec)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, want := shellQuote(`it's`), `'it'\''s'`; got != want {
+		t.Errorf("shellQuote = %s; want %s", got, want)
+	}
+}
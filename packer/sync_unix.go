@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package packer
+
+import "golang.org/x/sys/unix"
+
+// syncFilesystems commits all file system caches to disk.
+func syncFilesystems() {
+	unix.Sync()
+}
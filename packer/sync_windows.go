@@ -0,0 +1,5 @@
+package packer
+
+// syncFilesystems does nothing: writing to devices is not supported on
+// Windows, see rereadPartitions.
+func syncFilesystems() {}